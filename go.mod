@@ -9,6 +9,7 @@ require (
 	github.com/emirpasic/gods v1.12.0
 	github.com/ianbruene/go-difflib v1.2.0
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
+	github.com/klauspost/compress v1.11.13
 	github.com/termie/go-shutil v0.0.0-20140729215957-bcacb06fecae
 	gitlab.com/esr/fqme v0.1.0
 	gitlab.com/ianbruene/kommandant v0.6.0
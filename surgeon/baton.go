@@ -11,8 +11,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,7 @@ import (
 // Baton is the overall state of the output
 type Baton struct {
 	progressEnabled bool
+	timeless        bool // Leave out times, for deterministic mode
 	logFunc         func(string)
 	stream          *os.File
 	channel         chan Message
@@ -29,6 +32,7 @@ type Baton struct {
 	counter         Counter
 	progress        Progress
 	process         Process
+	memory          Memory
 }
 
 // Twirly is the state of a twirly indefinite progress meter that ships indications to stdout.
@@ -55,6 +59,7 @@ type Progress struct {
 	count      uint64
 	lastcount  uint64
 	expected   uint64
+	timeless   bool
 }
 
 // Process prints a message before and after the other status messages
@@ -66,6 +71,14 @@ type Process struct {
 	start      time.Time
 }
 
+// Memory caches the resident-memory figure shown on the status line, so
+// that rendering doesn't read it from the system on every twirl
+type Memory struct {
+	sync.Mutex
+	lastupdate time.Time
+	rss        uint64
+}
+
 type msgType uint8
 
 const (
@@ -91,6 +104,7 @@ type Message struct {
 
 const twirlInterval = 100 * time.Millisecond // Rate-limit baton twirls
 const progressInterval = 1 * time.Second     // Rate-limit progress messages
+const memoryInterval = 5 * time.Second       // Rate-limit resident-memory sampling
 
 // newBaton creates a new Baton object, allowing the caller to control
 // the interactivity hint and to provide a function which the baton
@@ -151,6 +165,19 @@ func (baton *Baton) setInteractivity(enabled bool) {
 	}
 }
 
+// setTimeless controls whether progress messages leave out elapsed
+// times, rates, and memory use, which vary from run to run.
+func (baton *Baton) setTimeless(enabled bool) {
+	if baton != nil {
+		baton.channel <- Message{SYNC, nil}
+		baton.timeless = enabled
+		baton.progress.Lock()
+		baton.progress.timeless = enabled
+		baton.progress.Unlock()
+		<-baton.channel
+	}
+}
+
 // log prints out a simple log message
 func (baton *Baton) printLog(str []byte) {
 	if baton != nil {
@@ -213,10 +240,15 @@ func (baton *Baton) endProcess(endmsg ...string) {
 		if endmsg != nil {
 			baton.process.endmsg = []byte(strings.Join(endmsg, " "))
 		}
-		fmt.Fprintf(baton, "%s ...(%s) %s.",
-			baton.process.startmsg,
-			time.Since(baton.process.start).Round(time.Millisecond*10),
-			baton.process.endmsg)
+		if baton.timeless {
+			fmt.Fprintf(baton, "%s ... %s.",
+				baton.process.startmsg, baton.process.endmsg)
+		} else {
+			fmt.Fprintf(baton, "%s ...(%s) %s.",
+				baton.process.startmsg,
+				time.Since(baton.process.start).Round(time.Millisecond*10),
+				baton.process.endmsg)
+		}
 		baton.process.startmsg = nil
 		baton.process.endmsg = nil
 		baton.channel <- Message{PROGRESS, nil}
@@ -325,11 +357,62 @@ func (baton *Baton) Sync() {
 	}
 }
 
+// residentSetSize returns the resident memory of this process in bytes,
+// or 0 where the platform doesn't make that cheap to find out.
+func residentSetSize() uint64 {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// formatMemory renders a byte count in the largest fitting binary unit.
+func formatMemory(n uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
+
+// sample returns the resident memory as of the last sampling, taking a
+// fresh sample if that is more than memoryInterval old.
+func (memory *Memory) sample() uint64 {
+	memory.Lock()
+	defer memory.Unlock()
+	if time.Since(memory.lastupdate) > memoryInterval {
+		memory.rss = residentSetSize()
+		memory.lastupdate = time.Now()
+	}
+	return memory.rss
+}
+
 func (baton *Baton) render(buf io.Writer) {
 	baton.process.renderPre(buf)
 	baton.counter.render(buf)
 	baton.progress.render(buf)
-	fmt.Fprintf(buf, " (%v)", time.Since(baton.start).Round(time.Second))
+	if !baton.timeless {
+		if rss := baton.memory.sample(); rss > 0 {
+			fmt.Fprintf(buf, " (%v, %s resident)", time.Since(baton.start).Round(time.Second), formatMemory(rss))
+		} else {
+			fmt.Fprintf(buf, " (%v)", time.Since(baton.start).Round(time.Second))
+		}
+	}
 	baton.twirly.render(buf)
 	baton.process.renderPost(buf)
 }
@@ -368,7 +451,11 @@ func (baton *Progress) render(b io.Writer) {
 			return fmt.Sprintf("%.2fT", n/1000000000000)
 		}
 	}
-	if baton.expected > 0 {
+	if baton.expected > 0 && baton.timeless {
+		fmt.Fprintf(b, "%s %.2f%% %s/%s", baton.tag,
+			float64(baton.count)/float64(baton.expected)*100,
+			scale(float64(baton.count)), scale(float64(baton.expected)))
+	} else if baton.expected > 0 {
 		frac := float64(baton.count) / float64(baton.expected)
 		elapsed := baton.lastupdate.Sub(baton.start)
 		rate := float64(baton.count) / elapsed.Seconds()
@@ -0,0 +1,205 @@
+// This module implements the shared blob store. Normally each
+// repository keeps its own on-disk copy of every blob it has content
+// for, so identical content read into several repositories, or cloned
+// into both halves of a divided one, is stored once per copy. With the
+// blobstore option set, content is instead written once into a
+// content-addressed store under the session directory, and the blob
+// file of each repository is a hard link to it.
+//
+// The store counts the blobs sharing each of its files, and removes a
+// file when the last of them lets go, on new content, on cleanup of
+// its repository, or before an edit that must not be seen by the
+// others. Files are keyed by the SHA-256 of their uncompressed content
+// and by the codec that wrote them, since compressed copies made with
+// different codecs are different files.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// blobStore is a content-addressed store of blob files.
+type blobStore struct {
+	dir  string
+	lock sync.Mutex
+	refs map[string]int // Number of blobs linked to each file
+}
+
+var blobStores struct {
+	sync.Mutex
+	bydir map[string]*blobStore
+}
+
+// sessionBlobStore returns the store for repositories with the given
+// base directory, creating it if need be. Hard links cannot cross
+// filesystems, so each base directory gets its own.
+func sessionBlobStore(basedir string) *blobStore {
+	dir := filepath.Join(basedir, fmt.Sprintf(".rs%d.blobstore", os.Getpid()))
+	blobStores.Lock()
+	defer blobStores.Unlock()
+	if blobStores.bydir == nil {
+		blobStores.bydir = make(map[string]*blobStore)
+	}
+	store, ok := blobStores.bydir[dir]
+	if !ok {
+		store = &blobStore{dir: dir, refs: make(map[string]int)}
+		blobStores.bydir[dir] = store
+	}
+	return store
+}
+
+// storeKey names the file holding content with a given digest
+// written by a codec.
+func storeKey(digest hash.Hash, codec *blobCodec) string {
+	name := "raw"
+	if codec != nil {
+		name = codec.name
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+	return filepath.Join(name, sum[0:2], sum)
+}
+
+// path returns where the file with a key lives.
+func (store *blobStore) path(key string) string {
+	return filepath.Join(store.dir, key)
+}
+
+// put writes content from a reader into the store through a codec,
+// unless it is there already, takes a reference to it, and returns
+// its key and uncompressed length.
+func (store *blobStore) put(content io.Reader, codec *blobCodec) (string, int64, error) {
+	if err := os.MkdirAll(store.dir, userReadWriteSearchMode); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(store.dir, "incoming")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	var output io.WriteCloser = tmp
+	if codec != nil {
+		if output, err = codec.writer(tmp); err != nil {
+			tmp.Close()
+			return "", 0, err
+		}
+	}
+	digest := sha256.New()
+	size, err := io.Copy(output, io.TeeReader(content, digest))
+	if codec != nil {
+		if cerr := output.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	key := storeKey(digest, codec)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.refs[key] == 0 {
+		target := store.path(key)
+		if err := os.MkdirAll(filepath.Dir(target), userReadWriteSearchMode); err != nil {
+			return "", 0, err
+		}
+		if err := os.Rename(tmp.Name(), target); err != nil {
+			return "", 0, err
+		}
+	}
+	store.refs[key]++
+	return key, size, nil
+}
+
+// acquire takes another reference to a file in the store.
+func (store *blobStore) acquire(key string) {
+	store.lock.Lock()
+	store.refs[key]++
+	store.lock.Unlock()
+}
+
+// release drops a reference to a file in the store, removing the file
+// when no blob is left linked to it.
+func (store *blobStore) release(key string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.refs[key]--
+	if store.refs[key] <= 0 {
+		delete(store.refs, key)
+		os.Remove(store.path(key))
+	}
+}
+
+// link makes a blob file a hard link to a file in the store, copying
+// the file if it cannot be linked.
+func (store *blobStore) link(key string, target string) error {
+	os.Remove(target)
+	if os.Link(store.path(key), target) == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(store.path(key))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(target, data, userReadWriteMode)
+}
+
+// storeContent writes the content of a blob from a reader into the
+// store of its repository and links the blob file to it. It returns
+// the uncompressed length of the content.
+func (b *Blob) storeContent(content io.Reader) int64 {
+	b.unstore()
+	store := b.repo.store
+	key, size, err := store.put(content, b.repo.codec)
+	if err != nil {
+		panic(fmt.Errorf("Blob write: %v", err))
+	}
+	if err = store.link(key, b.getBlobfile(true)); err != nil {
+		store.release(key)
+		panic(fmt.Errorf("Blob write: %v", err))
+	}
+	b.store, b.storeKey = store, key
+	return size
+}
+
+// unstore drops the blob's reference to the store, if it has one,
+// and removes its blob file so that writing a new one cannot change
+// what other blobs see.
+func (b *Blob) unstore() {
+	if b.store == nil {
+		return
+	}
+	os.Remove(b.getBlobfile(false))
+	b.store.release(b.storeKey)
+	b.store, b.storeKey = nil, ""
+}
+
+// unshare gives a blob a private copy of its file, so that it can be
+// edited in place without changing the content of other blobs.
+func (b *Blob) unshare() {
+	if b.store == nil {
+		return
+	}
+	blobfile := b.getBlobfile(false)
+	data, err := ioutil.ReadFile(blobfile)
+	if err != nil {
+		panic(fmt.Errorf("Blob read: %v", err))
+	}
+	b.unstore()
+	if err = ioutil.WriteFile(blobfile, data, userReadWriteMode); err != nil {
+		panic(fmt.Errorf("Blob write: %v", err))
+	}
+}
@@ -0,0 +1,138 @@
+// Check commit comments against a project's comment policy.
+//
+// A policy file holds one rule per line, a keyword followed by its
+// argument; blank lines and lines beginning with # are ignored.
+// Each kind of rule is a constructor registered in commentRuleMakers,
+// so a new kind of check needs only a type and an entry there.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// commentRule is one check of a comment policy.
+type commentRule interface {
+	String() string
+	violatedBy(comment string) bool
+}
+
+// subjectLengthRule limits the length of a comment's first line.
+type subjectLengthRule struct {
+	max int
+}
+
+func (r subjectLengthRule) String() string {
+	return fmt.Sprintf("subject-length %d", r.max)
+}
+
+func (r subjectLengthRule) violatedBy(comment string) bool {
+	subject := strings.TrimSpace(strings.SplitN(comment, "\n", 2)[0])
+	return utf8.RuneCountInString(subject) > r.max
+}
+
+// requireRule insists on a match for a pattern, such as a ticket
+// reference, somewhere in a comment.
+type requireRule struct {
+	source  string
+	pattern *regexp.Regexp
+}
+
+func (r requireRule) String() string {
+	return "require " + r.source
+}
+
+func (r requireRule) violatedBy(comment string) bool {
+	return !r.pattern.MatchString(comment)
+}
+
+// forbidRule rejects comments containing a word, ignoring case.
+type forbidRule struct {
+	word    string
+	pattern *regexp.Regexp
+}
+
+func (r forbidRule) String() string {
+	return "forbid " + r.word
+}
+
+func (r forbidRule) violatedBy(comment string) bool {
+	return r.pattern.MatchString(comment)
+}
+
+// commentRuleMakers maps policy keywords to rule constructors.
+var commentRuleMakers = map[string]func(arg string) (commentRule, error){
+	"subject-length": func(arg string) (commentRule, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("subject-length needs a positive integer, not %q", arg)
+		}
+		return subjectLengthRule{n}, nil
+	},
+	"require": func(arg string) (commentRule, error) {
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("ill-formed pattern %q: %v", arg, err)
+		}
+		return requireRule{arg, re}, nil
+	},
+	"forbid": func(arg string) (commentRule, error) {
+		re := regexp.MustCompile(`(?i)(^|\W)` + regexp.QuoteMeta(arg) + `($|\W)`)
+		return forbidRule{arg, re}, nil
+	},
+}
+
+// readCommentPolicy parses a policy file into its rules.
+func readCommentPolicy(r io.Reader) ([]commentRule, error) {
+	var rules []commentRule
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		maker, ok := commentRuleMakers[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown rule %q", lineno, fields[0])
+		}
+		if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("line %d: rule %s needs an argument", lineno, fields[0])
+		}
+		rule, err := maker(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// checkComments reports, for each rule, the selected commits whose
+// comments violate it. Each report ends with the violators as a list
+// of event numbers usable as a selection, e.g. for msgout.
+func (repo *Repository) checkComments(selection orderedIntSet, rules []commentRule, report func(string)) {
+	for _, rule := range rules {
+		var violators []string
+		for _, ei := range selection {
+			commit, ok := repo.events[ei].(*Commit)
+			if ok && rule.violatedBy(commit.Comment) {
+				violators = append(violators, strconv.Itoa(ei+1))
+			}
+		}
+		if len(violators) > 0 {
+			report(fmt.Sprintf("%s: %s", rule, strings.Join(violators, ",")))
+		}
+	}
+}
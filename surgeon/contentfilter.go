@@ -0,0 +1,199 @@
+// This module implements content filter hooks, after git's clean and
+// smudge filters. A hook runs the content of files whose paths match
+// a glob through a filter of the kind the filter command takes: a
+// clean hook as a repository is read in, a smudge hook as it is
+// written out. This makes it possible to strip CRLF line endings,
+// re-encode text, or redact secrets during a conversion without a
+// separate editing pass.
+//
+// Filtering happens to fileops rather than blobs, because one blob
+// may be shared by paths a hook applies to and paths it does not.
+// On read, a blob is rewritten in place when every path referring to
+// it gets the same hooks, and otherwise split. On write the stored
+// repository is left alone; the filtered content is written inline
+// with each fileop, and a blob no unfiltered path needs is not
+// written at all, so that content redacted on the way out does not
+// leak into the stream.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// contentFilter is one clean or smudge hook.
+type contentFilter struct {
+	phase   string // "clean" or "smudge"
+	pattern string // .gitattributes-style glob
+	spec    string // filter specification, as for the filter command
+	filter  *filterCommand
+}
+
+func (cf *contentFilter) String() string {
+	return fmt.Sprintf("%s %s %s", cf.phase, cf.pattern, cf.spec)
+}
+
+// contentFiltersFor returns the hooks of a phase that apply to a
+// path, in the order they were declared.
+func contentFiltersFor(phase string, pathname string) []*contentFilter {
+	var hooks []*contentFilter
+	for _, cf := range control.contentFilters {
+		if cf.phase == phase && lfsMatch(cf.pattern, pathname) {
+			hooks = append(hooks, cf)
+		}
+	}
+	return hooks
+}
+
+// filterable tells whether a fileop carries file content hooks may
+// change; symlinks and submodule links are left alone.
+func filterable(op *FileOp) bool {
+	return op.op == opM && op.mode != gitlinkMode && op.mode != "120000"
+}
+
+// runContentFilters runs content through a chain of hooks.
+func runContentFilters(hooks []*contentFilter, content []byte, paths []string) []byte {
+	substitutions := map[string]string{"%PATHS%": strings.Join(paths, " ")}
+	text := string(content)
+	for _, cf := range hooks {
+		text = cf.filter.do(text, substitutions)
+	}
+	return []byte(text)
+}
+
+// cleanContent runs the clean hooks over the content of the files
+// modified in the commits. It returns the number of fileops whose
+// content was filtered.
+func (repo *Repository) cleanContent(commits []*Commit) int {
+	// Group the references to each blob by the hooks that apply
+	type group struct {
+		key   string
+		hooks []*contentFilter
+		ops   []*FileOp
+		paths []string
+	}
+	groups := make(map[*Blob][]*group)
+	var blobs []*Blob
+	var inlines []*FileOp
+	owner := make(map[*FileOp]*Commit)
+	for _, commit := range commits {
+		for _, op := range commit.operations() {
+			if !filterable(op) {
+				continue
+			}
+			hooks := contentFiltersFor("clean", op.Path)
+			if op.ref == "inline" {
+				if len(hooks) > 0 {
+					inlines = append(inlines, op)
+					owner[op] = commit
+				}
+				continue
+			}
+			blob, ok := repo.markToEvent(op.ref).(*Blob)
+			if !ok {
+				continue
+			}
+			if groups[blob] == nil {
+				blobs = append(blobs, blob)
+			}
+			key := fmt.Sprint(hooks)
+			var g *group
+			for _, candidate := range groups[blob] {
+				if candidate.key == key {
+					g = candidate
+				}
+			}
+			if g == nil {
+				g = &group{key: key, hooks: hooks}
+				groups[blob] = append(groups[blob], g)
+			}
+			g.ops = append(g.ops, op)
+			g.paths = append(g.paths, op.Path)
+			owner[op] = commit
+		}
+	}
+	count := 0
+	control.baton.startProgress("cleaning content", uint64(len(blobs)+len(inlines)))
+	for i, blob := range blobs {
+		control.baton.percentProgress(uint64(i))
+		for _, g := range groups[blob] {
+			if len(g.hooks) == 0 {
+				continue
+			}
+			content := runContentFilters(g.hooks, blob.getContent(), g.paths)
+			if len(g.ops) == len(blob.opset) {
+				blob.setContent(content, noOffset)
+				blob.hash.invalidate()
+			} else {
+				filtered := newBlob(repo)
+				filtered.setContent(content, noOffset)
+				filtered.setMark(repo.newmark())
+				repo.insertEvent(filtered, repo.eventToIndex(blob)+1, "filtered blob creation")
+				for _, op := range g.ops {
+					blob.removeOperation(op)
+					op.ref = filtered.mark
+					filtered.appendOperation(op)
+				}
+			}
+			for _, op := range g.ops {
+				owner[op].invalidateManifests()
+			}
+			count += len(g.ops)
+		}
+	}
+	for i, op := range inlines {
+		control.baton.percentProgress(uint64(len(blobs) + i))
+		op.inline = runContentFilters(contentFiltersFor("clean", op.Path), op.inline, []string{op.Path})
+		owner[op].invalidateManifests()
+		count++
+	}
+	control.baton.endProgress()
+	return count
+}
+
+// smudgedAway tells whether every fileop referring to a blob gets
+// smudge hooks, so that the blob itself need not be written.
+func (b *Blob) smudgedAway() bool {
+	if len(b.opset) == 0 {
+		return false
+	}
+	for op := range b.opset {
+		if !filterable(op) || len(contentFiltersFor("smudge", op.Path)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// saveSmudged writes a fileop with the smudge hooks that apply to it
+// run over its content, inline. It returns false, writing nothing,
+// if no hook applies.
+func (fileop *FileOp) saveSmudged(w io.Writer) bool {
+	if !filterable(fileop) {
+		return false
+	}
+	hooks := contentFiltersFor("smudge", fileop.Path)
+	if len(hooks) == 0 {
+		return false
+	}
+	content := fileop.inline
+	if fileop.ref != "inline" {
+		blob, ok := fileop.repo.markToEvent(fileop.ref).(*Blob)
+		if !ok {
+			return false
+		}
+		content = blob.getContent()
+	}
+	content = runContentFilters(hooks, content, []string{fileop.Path})
+	path := fileop.Path
+	if needsQuoting(path) {
+		path = cQuote(path)
+	}
+	fmt.Fprintf(w, "M %s inline %s\ndata %d\n%s\n", fileop.mode, path, len(content), content)
+	return true
+}
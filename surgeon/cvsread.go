@@ -0,0 +1,744 @@
+// This module reads CVS and RCS repositories directly from their ,v
+// master files, so that a conversion does not need cvs-fast-export.
+// It is used when that tool is not installed, or when the read
+// command is given the --native option.
+//
+// Each master is parsed whole. The head revision is stored as
+// complete text, its trunk ancestors as reverse diffs from their
+// successors, and branch revisions as forward diffs from their
+// predecessors; every revision's content is reconstructed up front.
+// File revisions are then coalesced into changesets: revisions on
+// the same branch with the same author and log message, no more than
+// cvsCommitWindow apart, and touching each file at most once. A
+// branch is rooted at the latest changeset holding one of its
+// branch-point revisions, and a tag becomes a lightweight tag on the
+// latest changeset holding one of its revisions.
+//
+// Keywords are not expanded; file content is exactly what the masters
+// store. Vendor branches are treated like any other branch.
+//
+// The master file format is documented in rcsfile(5).
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cvsCommitWindow is the largest gap between two file revisions that
+// still allows them to be coalesced into one changeset.
+const cvsCommitWindow = 300 * time.Second
+
+// rcsDelta is one revision of a master file.
+type rcsDelta struct {
+	revision string
+	date     time.Time
+	author   string
+	state    string
+	branches []string
+	next     string
+	log      string
+	text     []byte
+	content  []byte    // reconstructed file content
+	parent   *rcsDelta // previous revision in the file's history
+}
+
+func (d *rcsDelta) dead() bool {
+	return d.state == "dead"
+}
+
+// rcsSymbol is a tag or branch name from a master's symbols phrase.
+type rcsSymbol struct {
+	name     string
+	revision string
+}
+
+// rcsMaster is a parsed ,v file.
+type rcsMaster struct {
+	path       string // path of the working file
+	head       string
+	executable bool
+	symbols    []rcsSymbol
+	deltas     map[string]*rcsDelta
+}
+
+// rcsLexer splits a master file into RCS tokens.
+type rcsLexer struct {
+	data []byte
+	pos  int
+}
+
+func isRCSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// next returns the next token.  Strings come back with their @
+// quoting removed and isString set.
+func (lx *rcsLexer) next() (token []byte, isString bool, err error) {
+	for lx.pos < len(lx.data) && isRCSSpace(lx.data[lx.pos]) {
+		lx.pos++
+	}
+	if lx.pos >= len(lx.data) {
+		return nil, false, io.EOF
+	}
+	switch lx.data[lx.pos] {
+	case ';', ':':
+		lx.pos++
+		return lx.data[lx.pos-1 : lx.pos], false, nil
+	case '@':
+		lx.pos++
+		var out []byte
+		for {
+			i := bytes.IndexByte(lx.data[lx.pos:], '@')
+			if i < 0 {
+				return nil, true, errors.New("unterminated string")
+			}
+			out = append(out, lx.data[lx.pos:lx.pos+i]...)
+			lx.pos += i + 1
+			if lx.pos < len(lx.data) && lx.data[lx.pos] == '@' {
+				out = append(out, '@')
+				lx.pos++
+				continue
+			}
+			return out, true, nil
+		}
+	}
+	start := lx.pos
+	for lx.pos < len(lx.data) {
+		c := lx.data[lx.pos]
+		if isRCSSpace(c) || c == ';' || c == ':' || c == '@' {
+			break
+		}
+		lx.pos++
+	}
+	return lx.data[start:lx.pos], false, nil
+}
+
+// peek returns the next token without consuming it.
+func (lx *rcsLexer) peek() (token []byte, isString bool, err error) {
+	pos := lx.pos
+	token, isString, err = lx.next()
+	lx.pos = pos
+	return token, isString, err
+}
+
+// phrase returns the words of a phrase up to its terminating
+// semicolon, leaving out colons.
+func (lx *rcsLexer) phrase() ([]string, error) {
+	var words []string
+	for {
+		token, isString, err := lx.next()
+		if err != nil {
+			return nil, err
+		}
+		if !isString && string(token) == ";" {
+			return words, nil
+		}
+		if !isString && string(token) == ":" {
+			continue
+		}
+		words = append(words, string(token))
+	}
+}
+
+// isRevision tells whether a token is a revision number, which is
+// how delta and deltatext entries begin.
+func isRevision(token []byte, isString bool) bool {
+	return !isString && len(token) > 0 && token[0] >= '0' && token[0] <= '9'
+}
+
+// parseRCSDate parses a master file date.  Years before 2000 may be
+// written with two digits.
+func parseRCSDate(s string) (time.Time, error) {
+	fields := strings.Split(s, ".")
+	if len(fields) != 6 {
+		return time.Time{}, fmt.Errorf("ill-formed date %q", s)
+	}
+	var n [6]int
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("ill-formed date %q", s)
+		}
+		n[i] = v
+	}
+	if n[0] < 100 {
+		n[0] += 1900
+	}
+	return time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, time.UTC), nil
+}
+
+// parseRCSMaster parses the content of a ,v file.
+func parseRCSMaster(path string, data []byte) (*rcsMaster, error) {
+	lx := &rcsLexer{data: data}
+	master := &rcsMaster{path: path, deltas: make(map[string]*rcsDelta)}
+	fail := func(err error) (*rcsMaster, error) {
+		if err == io.EOF {
+			err = errors.New("unexpected end of file")
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// Admin section
+	for {
+		token, isString, err := lx.peek()
+		if err != nil {
+			return fail(err)
+		}
+		if isRevision(token, isString) || string(token) == "desc" {
+			break
+		}
+		lx.next()
+		words, err := lx.phrase()
+		if err != nil {
+			return fail(err)
+		}
+		switch string(token) {
+		case "head":
+			if len(words) > 0 {
+				master.head = words[0]
+			}
+		case "symbols":
+			for i := 0; i+1 < len(words); i += 2 {
+				master.symbols = append(master.symbols, rcsSymbol{words[i], words[i+1]})
+			}
+		}
+	}
+	// Delta nodes
+	for {
+		token, _, err := lx.next()
+		if err != nil {
+			return fail(err)
+		}
+		if string(token) == "desc" {
+			break
+		}
+		delta := &rcsDelta{revision: string(token)}
+		master.deltas[delta.revision] = delta
+		for {
+			key, isString, err := lx.peek()
+			if err != nil {
+				return fail(err)
+			}
+			if isRevision(key, isString) || string(key) == "desc" {
+				break
+			}
+			lx.next()
+			words, err := lx.phrase()
+			if err != nil {
+				return fail(err)
+			}
+			if len(words) == 0 {
+				continue
+			}
+			switch string(key) {
+			case "date":
+				delta.date, err = parseRCSDate(words[0])
+				if err != nil {
+					return fail(err)
+				}
+			case "author":
+				delta.author = words[0]
+			case "state":
+				delta.state = words[0]
+			case "branches":
+				delta.branches = words
+			case "next":
+				delta.next = words[0]
+			}
+		}
+	}
+	if _, _, err := lx.next(); err != nil {
+		return fail(err)
+	}
+	// Delta texts
+	for {
+		token, _, err := lx.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		delta, ok := master.deltas[string(token)]
+		if !ok {
+			return fail(fmt.Errorf("text for unknown revision %s", token))
+		}
+		for {
+			key, isString, err := lx.peek()
+			if err == io.EOF || isRevision(key, isString) {
+				break
+			} else if err != nil {
+				return fail(err)
+			}
+			lx.next()
+			switch string(key) {
+			case "log", "text":
+				value, _, err := lx.next()
+				if err != nil {
+					return fail(err)
+				}
+				if string(key) == "log" {
+					delta.log = string(value)
+				} else {
+					delta.text = value
+				}
+			default:
+				if _, err := lx.phrase(); err != nil {
+					return fail(err)
+				}
+			}
+		}
+	}
+	return master, nil
+}
+
+// splitRCSLines splits text into lines, each keeping its newline.
+func splitRCSLines(text []byte) [][]byte {
+	var lines [][]byte
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// applyRCSDiff applies an RCS diff, made of "dL N" (delete N lines
+// from line L) and "aL N" (add the N following lines after line L)
+// commands, to base.  Line numbers refer to base.
+func applyRCSDiff(base []byte, diff []byte) ([]byte, error) {
+	src := splitRCSLines(base)
+	cmds := splitRCSLines(diff)
+	var out []byte
+	copyTo := func(cur, end int) {
+		for _, line := range src[cur:end] {
+			out = append(out, line...)
+		}
+	}
+	cur := 0
+	for i := 0; i < len(cmds); {
+		cmd := cmds[i]
+		i++
+		var l, n int
+		if len(cmd) < 2 {
+			return nil, fmt.Errorf("ill-formed diff command %q", cmd)
+		}
+		if _, err := fmt.Sscanf(string(cmd[1:]), "%d %d", &l, &n); err != nil {
+			return nil, fmt.Errorf("ill-formed diff command %q", cmd)
+		}
+		switch cmd[0] {
+		case 'd':
+			if l-1 < cur || l-1+n > len(src) {
+				return nil, fmt.Errorf("diff command %q out of range", bytes.TrimSpace(cmd))
+			}
+			copyTo(cur, l-1)
+			cur = l - 1 + n
+		case 'a':
+			if l < cur || l > len(src) || i+n > len(cmds) {
+				return nil, fmt.Errorf("diff command %q out of range", bytes.TrimSpace(cmd))
+			}
+			copyTo(cur, l)
+			cur = l
+			for _, line := range cmds[i : i+n] {
+				out = append(out, line...)
+			}
+			i += n
+		default:
+			return nil, fmt.Errorf("ill-formed diff command %q", cmd)
+		}
+	}
+	copyTo(cur, len(src))
+	return out, nil
+}
+
+// expand reconstructs the content of every revision reachable from
+// the head and links each revision to its parent. Unreachable
+// revisions are dropped.
+func (master *rcsMaster) expand() error {
+	seen := make(map[string]bool)
+	// chain walks a line of development starting at rev. Trunk
+	// deltas are reverse diffs from the successor, branch deltas
+	// forward diffs from the predecessor; either way the diff
+	// applies to the previous delta visited.
+	var chain func(rev string, prev *rcsDelta, trunk bool) ([]*rcsDelta, error)
+	chain = func(rev string, prev *rcsDelta, trunk bool) ([]*rcsDelta, error) {
+		var line []*rcsDelta
+		for rev != "" {
+			delta, ok := master.deltas[rev]
+			if !ok {
+				return nil, fmt.Errorf("%s: missing revision %s", master.path, rev)
+			}
+			if seen[rev] {
+				return nil, fmt.Errorf("%s: revision %s is reached twice", master.path, rev)
+			}
+			seen[rev] = true
+			if prev == nil {
+				delta.content = delta.text
+			} else {
+				content, err := applyRCSDiff(prev.content, delta.text)
+				if err != nil {
+					return nil, fmt.Errorf("%s: revision %s: %v", master.path, rev, err)
+				}
+				delta.content = content
+				if trunk {
+					prev.parent = delta
+				} else {
+					delta.parent = prev
+				}
+			}
+			line = append(line, delta)
+			prev = delta
+			rev = delta.next
+		}
+		return line, nil
+	}
+	var branches func(line []*rcsDelta) error
+	branches = func(line []*rcsDelta) error {
+		for _, delta := range line {
+			for _, rev := range delta.branches {
+				sub, err := chain(rev, delta, false)
+				if err != nil {
+					return err
+				}
+				if len(sub) > 0 {
+					sub[0].parent = delta
+				}
+				if err := branches(sub); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	trunk, err := chain(master.head, nil, true)
+	if err != nil {
+		return err
+	}
+	if err := branches(trunk); err != nil {
+		return err
+	}
+	for rev := range master.deltas {
+		if !seen[rev] {
+			delete(master.deltas, rev)
+		}
+	}
+	return nil
+}
+
+// branchNames maps the branch numbers of a master to their names.
+// A branch symbol is either a magic number with a zero in the
+// next-to-last place (1.2.0.4 names branch 1.2.4) or, for vendor
+// branches, the branch number itself.
+func (master *rcsMaster) branchNames() map[string]string {
+	names := make(map[string]string)
+	for _, symbol := range master.symbols {
+		parts := strings.Split(symbol.revision, ".")
+		if len(parts)%2 == 1 {
+			names[symbol.revision] = symbol.name
+		} else if len(parts) > 2 && parts[len(parts)-2] == "0" {
+			parts = append(parts[:len(parts)-2], parts[len(parts)-1])
+			names[strings.Join(parts, ".")] = symbol.name
+		}
+	}
+	return names
+}
+
+// rcsBranchOf returns the number of the branch a revision is on, or
+// the empty string for the trunk.
+func rcsBranchOf(revision string) string {
+	parts := strings.Split(revision, ".")
+	if len(parts) <= 2 {
+		return ""
+	}
+	return strings.Join(parts[:len(parts)-1], ".")
+}
+
+// isRCSTag tells whether a symbol names a revision rather than a branch.
+func isRCSTag(revision string) bool {
+	parts := strings.Split(revision, ".")
+	return len(parts)%2 == 0 && !(len(parts) > 2 && parts[len(parts)-2] == "0")
+}
+
+// rcsWorkingPath turns the path of a master into the path of its
+// working file, dropping the ,v suffix and any Attic or RCS directory.
+func rcsWorkingPath(path string) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	path = strings.TrimSuffix(path, ",v")
+	dir, base := filepath.Split(path)
+	dir = strings.TrimSuffix(dir, "/")
+	if filepath.Base(dir) == "Attic" || filepath.Base(dir) == "RCS" {
+		dir = filepath.Dir(dir)
+	}
+	if dir == "" || dir == "." {
+		return base
+	}
+	return dir + "/" + base
+}
+
+// cvsFileRev is one revision of one file, with the branch it is on.
+type cvsFileRev struct {
+	master *rcsMaster
+	delta  *rcsDelta
+	branch string
+}
+
+// cvsChangeset is a group of file revisions that become one commit.
+type cvsChangeset struct {
+	index  int
+	branch string
+	author string
+	log    string
+	date   time.Time // date of the latest revision
+	revs   []*cvsFileRev
+	paths  map[string]bool
+	parent *cvsChangeset
+	commit *Commit
+}
+
+// cvsBranchRef returns the ref for a CVS branch name.
+func cvsBranchRef(branch string) string {
+	if branch == "" {
+		return "refs/heads/master"
+	}
+	return "refs/heads/" + branch
+}
+
+// readCVS fills the repository from the ,v masters under the current
+// directory.
+func (repo *Repository) readCVS() error {
+	var masters []*rcsMaster
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == "CVSROOT" || strings.HasPrefix(info.Name(), ".rs") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ",v") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		master, err := parseRCSMaster(rcsWorkingPath(path), data)
+		if err != nil {
+			return err
+		}
+		master.executable = info.Mode()&0111 != 0
+		if err := master.expand(); err != nil {
+			return err
+		}
+		masters = append(masters, master)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Collect the file revisions worth a fileop. A dead revision
+	// is a deletion unless there was nothing alive to delete, as
+	// with the dead 1.1 CVS makes for a file added on a branch.
+	var revs []*cvsFileRev
+	for _, master := range masters {
+		names := master.branchNames()
+		for _, delta := range master.deltas {
+			if delta.dead() && (delta.parent == nil || delta.parent.dead()) {
+				continue
+			}
+			branch := rcsBranchOf(delta.revision)
+			if branch != "" {
+				if name, ok := names[branch]; ok {
+					branch = name
+				} else {
+					branch = "unlabeled-" + branch
+				}
+			}
+			revs = append(revs, &cvsFileRev{master, delta, branch})
+		}
+	}
+	sort.SliceStable(revs, func(i, j int) bool {
+		if !revs[i].delta.date.Equal(revs[j].delta.date) {
+			return revs[i].delta.date.Before(revs[j].delta.date)
+		}
+		if revs[i].master.path != revs[j].master.path {
+			return revs[i].master.path < revs[j].master.path
+		}
+		return revs[i].delta.revision < revs[j].delta.revision
+	})
+
+	// Coalesce them into changesets
+	type changesetKey struct {
+		branch string
+		author string
+		log    string
+	}
+	open := make(map[changesetKey]*cvsChangeset)
+	located := make(map[*rcsDelta]*cvsChangeset)
+	var changesets []*cvsChangeset
+	for _, rev := range revs {
+		key := changesetKey{rev.branch, rev.delta.author, rev.delta.log}
+		cs := open[key]
+		if cs == nil || rev.delta.date.Sub(cs.date) > cvsCommitWindow || cs.paths[rev.master.path] {
+			cs = &cvsChangeset{
+				index:  len(changesets),
+				branch: rev.branch,
+				author: rev.delta.author,
+				log:    rev.delta.log,
+				paths:  make(map[string]bool),
+			}
+			open[key] = cs
+			changesets = append(changesets, cs)
+		}
+		cs.revs = append(cs.revs, rev)
+		cs.paths[rev.master.path] = true
+		cs.date = rev.delta.date
+		located[rev.delta] = cs
+	}
+
+	// latest returns the latest changeset, earlier than limit,
+	// that holds one of the given revisions.
+	latest := func(deltas []*rcsDelta, limit int) *cvsChangeset {
+		var found *cvsChangeset
+		for _, delta := range deltas {
+			if cs := located[delta]; cs != nil && cs.index < limit && (found == nil || cs.index > found.index) {
+				found = cs
+			}
+		}
+		return found
+	}
+
+	// Link each changeset to its predecessor on its branch, or
+	// the first one on a branch to where the branch sprouted.
+	last := make(map[string]*cvsChangeset)
+	for _, cs := range changesets {
+		if prev := last[cs.branch]; prev != nil {
+			cs.parent = prev
+		} else {
+			var points []*rcsDelta
+			for _, rev := range cs.revs {
+				if rev.delta.parent != nil && rcsBranchOf(rev.delta.parent.revision) != rcsBranchOf(rev.delta.revision) {
+					points = append(points, rev.delta.parent)
+				}
+			}
+			cs.parent = latest(points, cs.index)
+		}
+		last[cs.branch] = cs
+	}
+
+	for _, cs := range changesets {
+		commit := newCommit(repo)
+		attribution := fmt.Sprintf("%s <%s> %d +0000", cs.author, cs.author, cs.date.Unix())
+		newattr, err := newAttribution(attribution)
+		if err != nil {
+			return fmt.Errorf("ill-formed attribution %q", attribution)
+		}
+		commit.committer = *newattr
+		commit.Comment = cs.log
+		if commit.Comment != "" && !strings.HasSuffix(commit.Comment, control.lineSep) {
+			commit.Comment += control.lineSep
+		}
+		commit.setBranch(cvsBranchRef(cs.branch))
+		if cs.parent != nil {
+			commit.setParents([]CommitLike{cs.parent.commit})
+		}
+		sort.SliceStable(cs.revs, func(i, j int) bool {
+			return cs.revs[i].master.path < cs.revs[j].master.path
+		})
+		var legacy strings.Builder
+		for _, rev := range cs.revs {
+			op := newFileOp(repo)
+			if rev.delta.dead() {
+				op.construct(opD, rev.master.path)
+			} else {
+				blob := newBlob(repo)
+				blob.setContent(rev.delta.content, noOffset)
+				blob.setMark(repo.newmark())
+				repo.addEvent(blob)
+				mode := "100644"
+				if rev.master.executable {
+					mode = "100755"
+				}
+				op.construct(opM, mode, blob.getMark(), rev.master.path)
+			}
+			commit.appendOperation(op)
+			fmt.Fprintf(&legacy, "%s %s\n", rev.master.path, rev.delta.revision)
+		}
+		props := newOrderedMap()
+		commit.properties = &props
+		commit.properties.set("cvs-revisions", legacy.String())
+		for _, line := range strings.Split(strings.TrimSuffix(legacy.String(), "\n"), "\n") {
+			repo.legacyMap["CVS:"+line] = commit
+		}
+		commit.setMark(repo.newmark())
+		repo.addEvent(commit)
+		cs.commit = commit
+	}
+
+	// Tags go on the latest changeset holding one of their
+	// revisions. Branches without revisions of their own become
+	// resets at their branch point.
+	tagged := make(map[string][]*rcsDelta)
+	sprouts := make(map[string][]*rcsDelta)
+	for _, master := range masters {
+		for _, symbol := range master.symbols {
+			if isRCSTag(symbol.revision) {
+				if delta, ok := master.deltas[symbol.revision]; ok {
+					tagged[symbol.name] = append(tagged[symbol.name], delta)
+				}
+			} else if _, ok := last[symbol.name]; !ok {
+				parts := strings.Split(symbol.revision, ".")
+				n := len(parts) - 1
+				if len(parts)%2 == 0 {
+					n = len(parts) - 2
+				}
+				point := strings.Join(parts[:n], ".")
+				if delta, ok := master.deltas[point]; ok {
+					sprouts[symbol.name] = append(sprouts[symbol.name], delta)
+				}
+			}
+		}
+	}
+	resets := func(refs map[string][]*rcsDelta, prefix string) {
+		names := make([]string, 0, len(refs))
+		for name := range refs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cs := latest(refs[name], len(changesets))
+			if cs == nil {
+				if logEnable(logWARN) {
+					logit("%s%s has no revisions to attach to, ignored", prefix, name)
+				}
+				continue
+			}
+			repo.addEvent(newReset(repo, prefix+name, cs.commit.mark, ""))
+		}
+	}
+	resets(sprouts, "refs/heads/")
+	resets(tagged, "refs/tags/")
+	if len(repo.events) == 0 {
+		return errors.New("no revisions found in master files")
+	}
+	return nil
+}
@@ -58,11 +58,11 @@ import (
 // signature is a file signature - path, hash value of content and permissions."
 type signature struct {
 	//pathname string
-	hashval [sha1.Size]byte
+	hashval gitHashType
 	perms   string
 }
 
-func newSignature(hashval [sha1.Size]byte, perms int) *signature {
+func newSignature(hashval gitHashType, perms int) *signature {
 	ps := new(signature)
 	ps.hashval = hashval
 	// Map to the restricted set of modes that are allowed in
@@ -77,8 +77,7 @@ func newSignature(hashval [sha1.Size]byte, perms int) *signature {
 }
 
 func (s signature) String() string {
-	return fmt.Sprintf("<%s:%02x%02x%02x%02x%02x%02x>",
-		s.perms, s.hashval[0], s.hashval[1], s.hashval[2], s.hashval[3], s.hashval[4], s.hashval[5])
+	return fmt.Sprintf("<%s:%s>", s.perms, s.hashval.hexify()[:12])
 }
 
 func (s signature) Equal(other signature) bool {
@@ -125,6 +124,7 @@ type CommitMeta struct {
 	ci     string
 	ai     string
 	branch string
+	why    string // How the branch was assigned, for the coloring report
 }
 
 // How these are structured: RepoStreamer is the common code that
@@ -176,7 +176,7 @@ func (cm *ColorMixer) simulateGitColoring(mc MixerCapable, base *RepoStreamer) {
 		if logEnable(logTOPOLOGY) {
 			logit("outside branch coloring %s %s", base.refs.get(refname), refname)
 		}
-		cm._branchColor(base.refs.get(refname), refname)
+		cm._branchColor(base.refs.get(refname), refname, "")
 	}
 }
 
@@ -187,7 +187,9 @@ func (cm *ColorMixer) simulateGitColoring(mc MixerCapable, base *RepoStreamer) {
 // (year 1 rather than 1970) overflows an int64.
 var farFuture = time.Unix(1<<62-1, 0)
 
-func (cm *ColorMixer) _branchColor(rev, color string) {
+// _branchColor colors rev and its eligible ancestors. The from argument
+// is the child the coloring propagated from, or empty at a branch tip.
+func (cm *ColorMixer) _branchColor(rev, color, from string) {
 	if cm.base.branchesAreColored && strings.HasPrefix(color, "refs/heads/") {
 		return
 	}
@@ -222,6 +224,11 @@ func (cm *ColorMixer) _branchColor(rev, color string) {
 	for {
 		timestamp := cm.commitStamps[rev]
 		cm.base.meta[rev].branch = color
+		if from == "" {
+			cm.base.meta[rev].why = "tip of " + color
+		} else {
+			cm.base.meta[rev].why = "colored from child " + from
+		}
 		// We only want to color back to parents that don't have a branch
 		// assigned or whose assigned branch was from an earlier commit
 		// than the one we're coloring from now; this emulates the git
@@ -247,6 +254,7 @@ func (cm *ColorMixer) _branchColor(rev, color string) {
 		} else if len(parents) == 1 {
 			// This case avoids munching excessive stack space by recursing
 			// too deep on large repos.
+			from = rev
 			rev = parents[0]
 			// Mark the parent with the timestamp of the child it is
 			// being colored from
@@ -257,7 +265,7 @@ func (cm *ColorMixer) _branchColor(rev, color string) {
 				// Mark each parent with the timestamp of the child it is
 				// being colored from
 				cm.childStamps[parent] = timestamp
-				cm._branchColor(parent, color)
+				cm._branchColor(parent, color, rev)
 			}
 			break
 		}
@@ -479,6 +487,7 @@ func (ge *GitExtractor) colorBranches(rs *RepoStreamer) error {
 			h := marks[fields[1]]
 			// This is a valid (commit hash, branch name) pair
 			rs.meta[h].branch = branch
+			rs.meta[h].why = "git fast-export"
 			branch = ""
 		} else if branch != "" {
 			// The mark line for a commit should always be the
@@ -543,13 +552,12 @@ func (ge *GitExtractor) manifest(rev string) []manifestEntry {
 			continue
 		}
 		tabs := strings.SplitN(fields[2], "\t", 2)
+		// A SHA-256 repository gives 64 hex digits rather than 40
 		hash, err := hex.DecodeString(tabs[0])
 		if err != nil {
 			panic(throw("extractor", "Malformed blob hash: %v", err))
 		}
-		var fixedhash [sha1.Size]byte
-		copy(fixedhash[:], hash)
-		sig := newSignature(fixedhash, perms)
+		sig := newSignature(gitHashBytes(hash), perms)
 		var me manifestEntry
 		me.pathname = tabs[1]
 		me.sig = sig
@@ -580,12 +588,12 @@ type HgExtractor struct {
 	tagsFound      bool
 	bookmarksFound bool
 	hgcl           *HgClient
-	hashTranslate  map[[sha1.Size]byte][sha1.Size]byte
+	hashTranslate  map[[sha1.Size]byte]gitHashType
 }
 
 func newHgExtractor() *HgExtractor {
 	he := new(HgExtractor)
-	he.hashTranslate = make(map[[sha1.Size]byte][sha1.Size]byte)
+	he.hashTranslate = make(map[[sha1.Size]byte]gitHashType)
 	return he
 }
 
@@ -865,6 +873,7 @@ func (he *HgExtractor) gatherChildTimestamps(rs *RepoStreamer) map[string]time.T
 			logit("setting default branch of %s to %s", h, branch)
 		}
 		rs.meta[h].branch = branch
+		rs.meta[h].why = "hg branch metadata"
 		// Fill in the branch tips with child timestamps to
 		// ensure that they can't be over-colored (other
 		// commits in the ancestor tree of a branch can be
@@ -905,7 +914,16 @@ func (he *HgExtractor) _branchColorItems() *OrderedMap {
 
 // colorBanches assigns branches to commits in an extracted repository
 func (he *HgExtractor) colorBranches(rs *RepoStreamer) error {
-	colorItems := he._branchColorItems()
+	var colorItems *OrderedMap
+	if rs.options.Contains("--hg-branches") {
+		// The user has asked for hg's own named-branch
+		// assignments even where tags or bookmarks would make
+		// the git coloring differ.
+		items := he._hgBranchItems()
+		colorItems = &items
+	} else {
+		colorItems = he._branchColorItems()
+	}
 	if colorItems != nil {
 		// If the repo will give us a complete list of (commit
 		// hash, branch name) pairs, use that to do the coloring
@@ -918,6 +936,7 @@ func (he *HgExtractor) colorBranches(rs *RepoStreamer) error {
 				logit("setting branch from color items, %s to %s", h, color)
 			}
 			rs.meta[h].branch = color
+			rs.meta[h].why = "hg branch metadata"
 		}
 	} else {
 		// Otherwise we have to emulate the git coloring algorithm
@@ -1029,7 +1048,7 @@ func (he HgExtractor) manifest(rev string) []manifestEntry {
 				if _, err := io.Copy(hash, tempFile); err != nil {
 					panic(throw("extractor", "Couldn't hash blob: %v", err))
 				}
-				copy(fixedhash[:], hash.Sum(nil))
+				fixedhash = gitHashBytes(hash.Sum(nil))
 				he.hashTranslate[fixedhghash] = fixedhash
 			}()
 		}
@@ -1068,6 +1087,742 @@ func (he HgExtractor) getComment(rev string) string {
 	return data
 }
 
+// BzrExtractor is a repository extractor for Bazaar and its successor
+// Breezy.  It needs nothing but the command-line client, so it works
+// where the fast-import plugin is missing.
+//
+// It reads one branch, the one in the repository directory; the
+// revisions merged into it are extracted too, but all of them are
+// colored with that branch.  Only lightweight tags are recovered,
+// because those are the only kind bzr has.
+type BzrExtractor struct {
+	command   string                  // brz, or bzr if Breezy is absent
+	revisions map[string]*bzrRevision // revision ID -> parsed log entry
+	tip       string                  // revision ID of the branch tip
+	scratch   string                  // directory holding the checkout
+	checkout  string                  // checkout updated by manifest()
+}
+
+// bzrRevision is what bzr log --long tells us about a revision.
+type bzrRevision struct {
+	id        string
+	depth     int // Merge nesting, 0 for mainline revisions
+	parents   []string
+	committer string
+	author    string
+	timestamp string
+	tags      []string
+	message   string
+}
+
+func newBzrExtractor() *BzrExtractor {
+	be := new(BzrExtractor)
+	be.revisions = make(map[string]*bzrRevision)
+	return be
+}
+
+// bzrLogSeparator begins each entry of bzr log --long output
+var bzrLogSeparator = strings.Repeat("-", 60)
+
+// parseBzrLog parses the output of "bzr log -n0 --long --show-ids",
+// returning revisions in the order they were listed, newest first.
+// Merged revisions follow the revision that merged them, indented
+// four spaces deeper; message lines are indented two more spaces than
+// the fields of their entry.
+func parseBzrLog(r io.Reader) ([]*bzrRevision, error) {
+	var revisions []*bzrRevision
+	var current *bzrRevision
+	inMessage := false
+	var message []string
+	finish := func() {
+		if current != nil {
+			current.message = strings.TrimRight(strings.Join(message, "\n"), "\n") + "\n"
+		}
+		message = nil
+		inMessage = false
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		if text == bzrLogSeparator && indent%4 == 0 {
+			finish()
+			current = &bzrRevision{depth: indent / 4}
+			revisions = append(revisions, current)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		margin := current.depth * 4
+		if inMessage {
+			if strings.TrimSpace(line) == "" {
+				message = append(message, "")
+			} else if indent >= margin+2 {
+				message = append(message, line[margin+2:])
+			} else {
+				return nil, fmt.Errorf("ill-formed message line in bzr log: %q", line)
+			}
+			continue
+		}
+		if indent != margin {
+			continue
+		}
+		colon := strings.Index(text, ":")
+		if colon == -1 {
+			continue
+		}
+		key, value := text[:colon], strings.TrimSpace(text[colon+1:])
+		switch key {
+		case "revision-id":
+			current.id = value
+		case "parent":
+			current.parents = append(current.parents, value)
+		case "committer":
+			current.committer = value
+		case "author", "authors":
+			// Only the first of several authors is kept
+			current.author = strings.SplitN(value, ", ", 2)[0]
+		case "timestamp":
+			current.timestamp = value
+		case "tags":
+			current.tags = strings.Split(value, ", ")
+		case "message":
+			inMessage = true
+		}
+	}
+	finish()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rev := range revisions {
+		if rev.id == "" {
+			return nil, errors.New("bzr log entry without a revision-id; was --show-ids given?")
+		}
+	}
+	return revisions, nil
+}
+
+// bzrAttribution renders a bzr identity and log timestamp in the
+// form newAttribution() expects.
+func bzrAttribution(who string, timestamp string) (string, error) {
+	when, err := time.Parse("Mon 2006-01-02 15:04:05 -0700", timestamp)
+	if err != nil {
+		return "", fmt.Errorf("ill-formed bzr timestamp %q", timestamp)
+	}
+	if !strings.Contains(who, "<") {
+		who += " <>"
+	}
+	return fmt.Sprintf("%s %d %s", who, when.Unix(), when.Format("-0700")), nil
+}
+
+// run executes a bzr subcommand and returns its output.
+func (be *BzrExtractor) run(args ...string) (string, error) {
+	cmd := exec.Command(be.command, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && logEnable(logSHOUT) {
+		logit("%s", strings.TrimSpace(stderr.String()))
+	}
+	return string(out), err
+}
+
+func (be *BzrExtractor) preExtract() {
+	be.command = "brz"
+	if _, err := exec.LookPath(be.command); err != nil {
+		be.command = "bzr"
+	}
+}
+
+func (be *BzrExtractor) keepHouse() error {
+	return nil
+}
+
+func (be *BzrExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	data, err := be.run("log", "-n0", "--long", "--show-ids")
+	if err != nil {
+		return fmt.Errorf("bzr's gatherRevisionIDs: %v", err)
+	}
+	revisions, err := parseBzrLog(strings.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("bzr's gatherRevisionIDs: %v", err)
+	}
+	// The log is newest first with merged revisions after their
+	// merge, so reversed it puts every parent before its children.
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		be.revisions[rev.id] = rev
+		rs.revlist = append(rs.revlist, rev.id)
+	}
+	if len(revisions) > 0 {
+		be.tip = revisions[0].id
+	}
+	for _, id := range rs.revlist {
+		// Ghost parents, revisions that are referred to but not
+		// present in the repository, are dropped.
+		parents := make([]string, 0)
+		for _, parent := range be.revisions[id].parents {
+			if _, ok := be.revisions[parent]; ok {
+				parents = append(parents, parent)
+			}
+		}
+		rs.parents[id] = parents
+	}
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (be *BzrExtractor) gatherCommitData(rs *RepoStreamer) error {
+	for id, rev := range be.revisions {
+		ci, err := bzrAttribution(rev.committer, rev.timestamp)
+		if err != nil {
+			return fmt.Errorf("bzr's gatherCommitData: %s: %v", id, err)
+		}
+		ai := ci
+		if rev.author != "" {
+			if ai, err = bzrAttribution(rev.author, rev.timestamp); err != nil {
+				return fmt.Errorf("bzr's gatherCommitData: %s: %v", id, err)
+			}
+		}
+		rs.meta[id] = &CommitMeta{ci: ci, ai: ai}
+	}
+	return nil
+}
+
+// gatherAllReferences finds the branch tip and tags
+func (be *BzrExtractor) gatherAllReferences(rs *RepoStreamer) error {
+	if be.tip == "" {
+		return nil
+	}
+	rs.refs.set("refs/heads/master", be.tip)
+	for _, id := range rs.revlist {
+		for _, tag := range be.revisions[id].tags {
+			rs.refs.set("refs/tags/"+tag, id)
+		}
+	}
+	return nil
+}
+
+// colorBranches assigns the one branch to every commit
+func (be *BzrExtractor) colorBranches(rs *RepoStreamer) error {
+	for _, id := range rs.revlist {
+		rs.meta[id].branch = "refs/heads/master"
+		rs.meta[id].why = "bzr branch"
+	}
+	return nil
+}
+
+func (be *BzrExtractor) postExtract(_repo *Repository) {
+	if be.scratch != "" {
+		os.RemoveAll(be.scratch)
+		be.scratch = ""
+	}
+}
+
+// isClean returns true if repo has no unsaved changes
+func (be *BzrExtractor) isClean() bool {
+	if be.command == "" {
+		be.preExtract()
+	}
+	data, err := be.run("status", "--short", "--versioned")
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn %s status: %v", be.command, err))
+	}
+	return data == ""
+}
+
+// manifest lists all files present as of a specified revision.
+func (be *BzrExtractor) manifest(rev string) []manifestEntry {
+	// bzr has no cheap way to list file hashes, so a scratch
+	// checkout is moved to each revision and hashed.
+	var err error
+	if be.scratch == "" {
+		be.scratch, err = ioutil.TempDir("", "rsbzr")
+		if err != nil {
+			panic(throw("extractor", "Couldn't make scratch directory: %v", err))
+		}
+		be.checkout = filepath.Join(be.scratch, "tree")
+		_, err = be.run("checkout", "--lightweight", "-q", "-r", "revid:"+rev, ".", be.checkout)
+	} else {
+		_, err = be.run("update", "-q", "-r", "revid:"+rev, be.checkout)
+	}
+	if err != nil {
+		panic(throw("extractor", "Couldn't check out %s: %v", rev, err))
+	}
+	var manifest []manifestEntry
+	err = filepath.Walk(be.checkout, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, _ := filepath.Rel(be.checkout, pathname)
+		if info.IsDir() {
+			if relpath == ".bzr" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var content []byte
+		perms := 0100644
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(pathname)
+			if err != nil {
+				return err
+			}
+			content = []byte(target)
+			perms = 0120000
+		} else {
+			if content, err = ioutil.ReadFile(pathname); err != nil {
+				return err
+			}
+			if info.Mode()&0111 != 0 {
+				perms = 0100755
+			}
+		}
+		manifest = append(manifest, manifestEntry{
+			pathname: filepath.ToSlash(relpath),
+			sig:      newSignature(gitHashString(string(content)), perms),
+		})
+		return nil
+	})
+	if err != nil {
+		panic(throw("extractor", "Couldn't walk checkout of %s: %v", rev, err))
+	}
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (be *BzrExtractor) catFile(rev string, path string, dest string) error {
+	// manifest() has already checked out rev, so copy from there.
+	// A symlink's content is its target, as in git.
+	source := filepath.Join(be.checkout, filepath.FromSlash(path))
+	var content []byte
+	target, err := os.Readlink(source)
+	if err == nil {
+		content = []byte(target)
+	} else if content, err = ioutil.ReadFile(source); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, content, userReadWriteMode)
+}
+
+// getComment returns a commit's change comment as a string.
+func (be *BzrExtractor) getComment(rev string) string {
+	return be.revisions[rev].message
+}
+
+// MtnExtractor is a repository extractor for the Monotone
+// version-control system, driven by "mtn automate" commands run in a
+// workspace.
+//
+// Monotone records the branch of each revision in a branch cert, so
+// commits are colored from those rather than by simulating git.  A
+// branch whose history has not been merged to a single head gets one
+// ref per head; the newest head takes the branch name and the others
+// have their revision ID appended.
+type MtnExtractor struct {
+	certs map[string]mtnCerts // revision ID -> certs on it
+}
+
+// mtnCerts holds the certs on a revision that the extractor uses
+type mtnCerts struct {
+	author    string
+	date      string
+	branches  []string
+	tags      []string
+	changelog string
+}
+
+// basicIOItem is one line of Monotone's basic_io format: a symbol
+// followed by string or hex-ID values.
+type basicIOItem struct {
+	key    string
+	values []string
+}
+
+// parseBasicIO splits basic_io text, as printed by many mtn automate
+// commands, into stanzas.  Stanzas are separated by blank lines;
+// strings are double-quoted with backslash escapes and may span lines,
+// hex IDs are bracketed.
+func parseBasicIO(text string) ([][]basicIOItem, error) {
+	var stanzas [][]basicIOItem
+	var stanza []basicIOItem
+	i := 0
+	for i < len(text) {
+		// Skip whitespace, noting blank lines between stanzas
+		newlines := 0
+		for i < len(text) && strings.ContainsRune(" \t\r\n", rune(text[i])) {
+			if text[i] == '\n' {
+				newlines++
+			}
+			i++
+		}
+		if i >= len(text) {
+			break
+		}
+		switch c := text[i]; {
+		case c == '"':
+			var value strings.Builder
+			i++
+			for i < len(text) && text[i] != '"' {
+				if text[i] == '\\' && i+1 < len(text) {
+					i++
+				}
+				value.WriteByte(text[i])
+				i++
+			}
+			if i >= len(text) {
+				return nil, errors.New("unterminated string in basic_io")
+			}
+			i++
+			if len(stanza) == 0 {
+				return nil, errors.New("basic_io value without a symbol")
+			}
+			stanza[len(stanza)-1].values = append(stanza[len(stanza)-1].values, value.String())
+		case c == '[':
+			end := strings.IndexByte(text[i:], ']')
+			if end == -1 {
+				return nil, errors.New("unterminated hex ID in basic_io")
+			}
+			if len(stanza) == 0 {
+				return nil, errors.New("basic_io value without a symbol")
+			}
+			stanza[len(stanza)-1].values = append(stanza[len(stanza)-1].values, text[i+1:i+end])
+			i += end + 1
+		default:
+			start := i
+			for i < len(text) && !strings.ContainsRune(" \t\r\n\"[", rune(text[i])) {
+				i++
+			}
+			if newlines > 1 && len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = nil
+			}
+			stanza = append(stanza, basicIOItem{key: text[start:i]})
+		}
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas, nil
+}
+
+// mtnAttribution renders a Monotone author cert and date cert in the
+// form newAttribution() expects.  Authors are usually bare email
+// addresses, in which case the local part stands in for the name.
+func mtnAttribution(author string, date string) string {
+	if !strings.Contains(author, "<") {
+		name := author
+		if at := strings.Index(author, "@"); at > 0 {
+			name = author[:at]
+		}
+		author = fmt.Sprintf("%s <%s>", name, author)
+	}
+	// Monotone dates are UTC without a zone designator
+	if !strings.HasSuffix(date, "Z") {
+		date += "Z"
+	}
+	return author + " " + date
+}
+
+func newMtnExtractor() *MtnExtractor {
+	me := new(MtnExtractor)
+	me.certs = make(map[string]mtnCerts)
+	return me
+}
+
+// capture runs an mtn subcommand and returns its output.
+func (me *MtnExtractor) capture(args ...string) (string, error) {
+	cmd := exec.Command("mtn", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && logEnable(logSHOUT) {
+		logit("%s", strings.TrimSpace(stderr.String()))
+	}
+	return string(out), err
+}
+
+func (me *MtnExtractor) preExtract() {
+}
+
+func (me *MtnExtractor) keepHouse() error {
+	return nil
+}
+
+// gatherRevisionIDs gets the topologically-ordered list of revisions and parents.
+func (me *MtnExtractor) gatherRevisionIDs(rs *RepoStreamer) error {
+	data, err := me.capture("automate", "graph")
+	if err != nil {
+		return fmt.Errorf("mtn's gatherRevisionIDs: %v", err)
+	}
+	// Each line is a revision followed by its parents
+	children := make(map[string][]string)
+	pending := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rs.parents[fields[0]] = fields[1:]
+		pending[fields[0]] = len(fields) - 1
+		for _, parent := range fields[1:] {
+			children[parent] = append(children[parent], fields[0])
+		}
+	}
+	for rev := range rs.parents {
+		if err := me.gatherCerts(rev); err != nil {
+			return fmt.Errorf("mtn's gatherRevisionIDs: %v", err)
+		}
+		rs.baton.twirl()
+	}
+	// The graph comes in no particular order. Sort it
+	// topologically, taking ready revisions oldest first.
+	older := func(a, b string) bool {
+		if me.certs[a].date != me.certs[b].date {
+			return me.certs[a].date < me.certs[b].date
+		}
+		return a < b
+	}
+	var ready []string
+	for rev, n := range pending {
+		if n == 0 {
+			ready = append(ready, rev)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return older(ready[i], ready[j]) })
+	for len(ready) > 0 {
+		rev := ready[0]
+		ready = ready[1:]
+		rs.revlist = append(rs.revlist, rev)
+		for _, child := range children[rev] {
+			pending[child]--
+			if pending[child] == 0 {
+				at := sort.Search(len(ready), func(i int) bool { return older(child, ready[i]) })
+				ready = append(ready, "")
+				copy(ready[at+1:], ready[at:])
+				ready[at] = child
+			}
+		}
+	}
+	return nil
+}
+
+// gatherCerts reads the certs on a revision
+func (me *MtnExtractor) gatherCerts(rev string) error {
+	data, err := me.capture("automate", "certs", rev)
+	if err != nil {
+		return err
+	}
+	stanzas, err := parseBasicIO(data)
+	if err != nil {
+		return fmt.Errorf("certs of %s: %v", rev, err)
+	}
+	var certs mtnCerts
+	var changelogs []string
+	for _, stanza := range stanzas {
+		var name, value, signature string
+		for _, item := range stanza {
+			if len(item.values) == 0 {
+				continue
+			}
+			switch item.key {
+			case "name":
+				name = item.values[0]
+			case "value":
+				value = item.values[0]
+			case "signature":
+				signature = item.values[0]
+			}
+		}
+		if signature == "bad" {
+			continue
+		}
+		switch name {
+		case "author":
+			if certs.author == "" {
+				certs.author = value
+			}
+		case "date":
+			if certs.date == "" {
+				certs.date = value
+			}
+		case "branch":
+			certs.branches = append(certs.branches, value)
+		case "tag":
+			certs.tags = append(certs.tags, value)
+		case "changelog":
+			changelogs = append(changelogs, strings.TrimRight(value, "\n"))
+		}
+	}
+	sort.Strings(certs.branches)
+	certs.changelog = strings.Join(changelogs, "\n\n") + "\n"
+	me.certs[rev] = certs
+	return nil
+}
+
+// gatherCommitData gets all other per-commit data except branch IDs
+func (me *MtnExtractor) gatherCommitData(rs *RepoStreamer) error {
+	for _, rev := range rs.revlist {
+		certs := me.certs[rev]
+		if certs.author == "" || certs.date == "" {
+			return fmt.Errorf("mtn's gatherCommitData: %s lacks an author or date cert", rev)
+		}
+		// Monotone has no separate committer
+		ci := mtnAttribution(certs.author, certs.date)
+		rs.meta[rev] = &CommitMeta{ci: ci, ai: ci}
+	}
+	return nil
+}
+
+// gatherAllReferences finds all branch heads and tags
+func (me *MtnExtractor) gatherAllReferences(rs *RepoStreamer) error {
+	onBranch := func(rev string, branch string) bool {
+		for _, b := range me.certs[rev].branches {
+			if b == branch {
+				return true
+			}
+		}
+		return false
+	}
+	children := make(map[string][]string)
+	for _, rev := range rs.revlist {
+		for _, parent := range rs.parents[rev] {
+			children[parent] = append(children[parent], rev)
+		}
+	}
+	// A head of a branch is a revision on it with no child on it.
+	// The revlist is oldest first, so the newest head is last.
+	heads := make(map[string][]string)
+	var branches []string
+	for _, rev := range rs.revlist {
+		for _, branch := range me.certs[rev].branches {
+			isHead := true
+			for _, child := range children[rev] {
+				if onBranch(child, branch) {
+					isHead = false
+					break
+				}
+			}
+			if isHead {
+				if heads[branch] == nil {
+					branches = append(branches, branch)
+				}
+				heads[branch] = append(heads[branch], rev)
+			}
+		}
+		for _, tag := range me.certs[rev].tags {
+			rs.refs.set("refs/tags/"+tag, rev)
+		}
+	}
+	for _, branch := range branches {
+		revs := heads[branch]
+		for i, rev := range revs {
+			name := "refs/heads/" + branch
+			if i < len(revs)-1 {
+				name += "-" + rev[:12]
+			}
+			rs.refs.set(name, rev)
+		}
+	}
+	return nil
+}
+
+// colorBranches assigns branches to commits from their branch certs
+func (me *MtnExtractor) colorBranches(rs *RepoStreamer) error {
+	for _, rev := range rs.revlist {
+		if branches := me.certs[rev].branches; len(branches) > 0 {
+			rs.meta[rev].branch = "refs/heads/" + branches[0]
+			rs.meta[rev].why = "mtn branch cert"
+		}
+	}
+	// A revision without a branch cert takes the branch of a
+	// child; going newest first, children are colored already.
+	for i := len(rs.revlist) - 1; i >= 0; i-- {
+		child := rs.revlist[i]
+		if rs.meta[child].branch == "" {
+			continue
+		}
+		for _, parent := range rs.parents[child] {
+			if rs.meta[parent].branch == "" {
+				rs.meta[parent].branch = rs.meta[child].branch
+				rs.meta[parent].why = "colored from child " + child
+			}
+		}
+	}
+	return nil
+}
+
+func (me *MtnExtractor) postExtract(_repo *Repository) {
+}
+
+// isClean returns true if repo has no unsaved changes
+func (me *MtnExtractor) isClean() bool {
+	data, err := me.capture("ls", "changed")
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn mtn ls changed: %v", err))
+	}
+	return data == ""
+}
+
+// manifest lists all files present as of a specified revision.
+func (me *MtnExtractor) manifest(rev string) []manifestEntry {
+	data, err := me.capture("automate", "get_manifest_of", rev)
+	if err != nil {
+		panic(throw("extractor", "Couldn't spawn mtn automate get_manifest_of: %v", err))
+	}
+	stanzas, err := parseBasicIO(data)
+	if err != nil {
+		panic(throw("extractor", "Malformed manifest of %s: %v", rev, err))
+	}
+	var manifest []manifestEntry
+	for _, stanza := range stanzas {
+		if stanza[0].key != "file" || len(stanza[0].values) == 0 {
+			continue
+		}
+		var entry manifestEntry
+		entry.pathname = stanza[0].values[0]
+		perms := 0100644
+		var hash []byte
+		for _, item := range stanza[1:] {
+			switch {
+			case item.key == "content" && len(item.values) == 1:
+				// Monotone file IDs are SHA-1 hashes of content
+				hash, err = hex.DecodeString(item.values[0])
+				if err != nil {
+					panic(throw("extractor", "Malformed file ID: %v", err))
+				}
+			case item.key == "attr" && len(item.values) == 2:
+				if item.values[0] == "mtn:execute" && item.values[1] == "true" {
+					perms = 0100755
+				}
+			}
+		}
+		entry.sig = newSignature(gitHashBytes(hash), perms)
+		manifest = append(manifest, entry)
+	}
+	return manifest
+}
+
+// catFile extracts file content into a specified destination path
+func (me *MtnExtractor) catFile(rev string, path string, dest string) error {
+	cmd := exec.Command("mtn", "automate", "get_file_of", "--revision="+rev, path)
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// getComment returns a commit's change comment as a string.
+func (me *MtnExtractor) getComment(rev string) string {
+	return me.certs[rev].changelog
+}
+
 // RepoStreamer is the repository factory driver class for all repo analyzers.
 type RepoStreamer struct {
 	revlist            []string               // commit identifiers, oldest first
@@ -1078,10 +1833,11 @@ type RepoStreamer struct {
 	tagseq             int
 	commitMap          map[string]*Commit
 	visibleFiles       map[string]map[string]signature
-	hashToMark         map[[sha1.Size]byte]markidx
+	hashToMark         map[gitHashType]markidx
 	branchesAreColored bool
 	baton              *Baton
 	extractor          Extractor
+	options            stringSet // read options, for extractor tuning
 }
 
 func newRepoStreamer(extractor Extractor, progress bool) *RepoStreamer {
@@ -1094,9 +1850,10 @@ func newRepoStreamer(extractor Extractor, progress bool) *RepoStreamer {
 	rs.tagseq = 0
 	rs.commitMap = make(map[string]*Commit)
 	rs.visibleFiles = make(map[string]map[string]signature)
-	rs.hashToMark = make(map[[sha1.Size]byte]markidx)
+	rs.hashToMark = make(map[gitHashType]markidx)
 	rs.extractor = extractor
 	rs.baton = control.baton
+	rs.options = newStringSet()
 	return rs
 }
 
@@ -1121,10 +1878,23 @@ func (rs *RepoStreamer) fileSetAt(revision string) orderedStringSet {
 	for key := range rs.visibleFiles[revision] {
 		fs.Add(key)
 	}
-	// Warning: order is nondeterministic
+	sort.Strings(fs)
 	return fs
 }
 
+// writeColoring reports the branch assigned to each extracted revision
+// and why, one revision per line. It is meant for debugging extractions
+// that fail because some revisions never got a branch.
+func (rs *RepoStreamer) writeColoring(w io.Writer) {
+	for _, rev := range rs.revlist {
+		branch, why := "-", "not reachable from any branch tip"
+		if meta := rs.meta[rev]; meta != nil && meta.branch != "" {
+			branch, why = meta.branch, meta.why
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", rev, branch, why)
+	}
+}
+
 func (rs *RepoStreamer) extract(repo *Repository, vcs *VCS) (_repo *Repository, err error) {
 	if !rs.extractor.isClean() {
 		return nil, fmt.Errorf("repository directory has unsaved changes")
@@ -0,0 +1,1122 @@
+// This module reads a git repository straight from its object
+// database, loose objects and packfiles, rather than through git
+// fast-export. It is used when the read command is given the --native
+// option on a git repository.
+//
+// Refs are taken from packed-refs and the loose files under .git/refs,
+// as "git fast-export --all" would see them; symbolic refs are
+// skipped. Commits are labeled with the ref they were first reached
+// from in a newest-first walk from all the ref tips, the way git's
+// revision walk propagates ref names, and are emitted parents first.
+// Each commit's fileops are the difference between its tree and its
+// first parent's, deletions first; a root commit adds every file.
+// Refs whose tips carry another ref's label become resets, and
+// annotated tags become tags on the commit they finally point to.
+//
+// Unlike the exporter, this reader keeps what fast-export loses.
+// Commit hashes are kept as original IDs. Commit signatures and
+// merge tags, the encoding header, and any unknown header lines become
+// commit properties named after the header. Tag signatures stay in
+// the tag comment, as with --signed-tags=verbatim. Submodule links
+// are kept as 160000 fileops naming the linked commit, and notes
+// become N fileops, as when reading a fast-export stream. File modes
+// git itself would canonicalize, such as 100664, are canonicalized
+// with a warning, since nothing downstream can represent them.
+//
+// Replace refs and grafts are honored, so the history read is the one
+// git log shows: a replaced object is read from its replacement and a
+// grafted commit takes the parents its graft gives. The replace refs
+// themselves are not walked; unless the replacements are to be baked
+// in, they are kept as resets on the replacement commits. As in git,
+// GIT_NO_REPLACE_OBJECTS in the environment turns replacement off.
+//
+// Both SHA-1 and SHA-256 repositories are handled; the object format
+// is recorded on the repository so hashes computed after surgery, and
+// the repository rebuilt, use the same one. Alternates are followed,
+// and in a shallow clone the commits at the boundary become roots.
+// Packfile formats are described in gitformat-pack(5).
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gitPackCacheLimit bounds the bytes of resolved delta bases kept per
+// packfile.
+const gitPackCacheLimit = 64 << 20
+
+// gitPackObjectTypes maps the type numbers in a packfile object header
+// to object types. 6 and 7 are deltas against an offset or a hash.
+var gitPackObjectTypes = map[byte]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+// gitPack is one packfile and the offsets of its objects.
+type gitPack struct {
+	file   *os.File
+	size   int64
+	index  map[gitHashType]int64
+	cache  map[int64]gitObject
+	cached int
+}
+
+// gitObject is an object's type and content.
+type gitObject struct {
+	kind string
+	data []byte
+}
+
+// gitObjectStore reads objects from a repository's object directory
+// and its alternates.
+type gitObjectStore struct {
+	dirs    []string
+	packs   []*gitPack
+	size    int
+	replace map[gitHashType]gitHashType
+}
+
+// gitReplaceDepth is how many replacements git will follow from one
+// object before giving up.
+const gitReplaceDepth = 5
+
+// parseHash decodes a hexadecimal object name of either format.
+func parseHash(text string) (gitHashType, error) {
+	if len(text) != 2*sha1.Size && len(text) != 2*sha256.Size {
+		return nullGitHash, fmt.Errorf("ill-formed object name %q", text)
+	}
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return nullGitHash, fmt.Errorf("ill-formed object name %q", text)
+	}
+	return gitHashBytes(raw), nil
+}
+
+// gitObjectFormat returns the object format named in the config file
+// of a repository, "sha1" if it names none.
+func gitObjectFormat(gitdir string) string {
+	config, err := ioutil.ReadFile(filepath.Join(gitdir, "config"))
+	if err != nil {
+		return "sha1"
+	}
+	for _, line := range strings.Split(string(config), "\n") {
+		key, value := splitRuneFirst(strings.TrimSpace(line), '=')
+		if strings.EqualFold(strings.TrimSpace(key), "objectformat") {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return "sha1"
+}
+
+// openPack reads the version 2 index of a packfile whose object names
+// are size bytes long.
+func openPack(idxpath string, size int) (*gitPack, error) {
+	idx, err := ioutil.ReadFile(idxpath)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte("\377tOc")) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return nil, fmt.Errorf("%s is not a version 2 pack index", idxpath)
+	}
+	count := int(binary.BigEndian.Uint32(idx[8+255*4:]))
+	names := 8 + 256*4
+	offsets := names + count*(size+4)
+	large := offsets + count*4
+	if len(idx) < large {
+		return nil, fmt.Errorf("%s is truncated", idxpath)
+	}
+	pack := &gitPack{index: make(map[gitHashType]int64, count), cache: make(map[int64]gitObject)}
+	for i := 0; i < count; i++ {
+		h := gitHashBytes(idx[names+i*size : names+(i+1)*size])
+		offset := int64(binary.BigEndian.Uint32(idx[offsets+i*4:]))
+		if offset&0x80000000 != 0 {
+			at := large + int(offset&0x7fffffff)*8
+			if len(idx) < at+8 {
+				return nil, fmt.Errorf("%s is truncated", idxpath)
+			}
+			offset = int64(binary.BigEndian.Uint64(idx[at:]))
+		}
+		pack.index[h] = offset
+	}
+	pack.file, err = os.Open(strings.TrimSuffix(idxpath, ".idx") + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	info, err := pack.file.Stat()
+	if err != nil {
+		pack.file.Close()
+		return nil, err
+	}
+	pack.size = info.Size()
+	return pack, nil
+}
+
+// newGitObjectStore opens the object database of the repository whose
+// metadata is in gitdir and whose object names are size bytes long.
+func newGitObjectStore(gitdir string, size int) (*gitObjectStore, error) {
+	store := &gitObjectStore{size: size}
+	pending := []string{filepath.Join(gitdir, "objects")}
+	seen := make(map[string]bool)
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		store.dirs = append(store.dirs, dir)
+		idxfiles, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+		if err != nil {
+			return nil, err
+		}
+		for _, idxfile := range idxfiles {
+			pack, err := openPack(idxfile, size)
+			if err != nil {
+				store.Close()
+				return nil, err
+			}
+			store.packs = append(store.packs, pack)
+		}
+		alternates, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(alternates), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dir, line)
+			}
+			pending = append(pending, line)
+		}
+	}
+	return store, nil
+}
+
+// Close releases the packfiles.
+func (store *gitObjectStore) Close() {
+	for _, pack := range store.packs {
+		if pack.file != nil {
+			pack.file.Close()
+		}
+	}
+}
+
+// replaced returns the object name an object is read from once its
+// replace refs are followed.
+func (store *gitObjectStore) replaced(h gitHashType) gitHashType {
+	for i := 0; i < gitReplaceDepth; i++ {
+		next, ok := store.replace[h]
+		if !ok {
+			break
+		}
+		h = next
+	}
+	return h
+}
+
+// read returns the type and content of an object.
+func (store *gitObjectStore) read(h gitHashType) (gitObject, error) {
+	for _, pack := range store.packs {
+		if offset, ok := pack.index[h]; ok {
+			return pack.read(store, offset)
+		}
+	}
+	name := h.hexify()
+	for _, dir := range store.dirs {
+		fp, err := os.Open(filepath.Join(dir, name[:2], name[2:]))
+		if err != nil {
+			continue
+		}
+		defer fp.Close()
+		zr, err := zlib.NewReader(fp)
+		if err != nil {
+			return gitObject{}, fmt.Errorf("loose object %s: %v", name, err)
+		}
+		raw, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return gitObject{}, fmt.Errorf("loose object %s: %v", name, err)
+		}
+		nul := bytes.IndexByte(raw, 0)
+		fields := strings.Fields(string(raw[:nul+1]))
+		if nul == -1 || len(fields) != 2 {
+			return gitObject{}, fmt.Errorf("loose object %s has an ill-formed header", name)
+		}
+		return gitObject{fields[0], raw[nul+1:]}, nil
+	}
+	return gitObject{}, fmt.Errorf("object %s not found", name)
+}
+
+// inflate decompresses size bytes of object data starting at offset.
+func (pack *gitPack) inflate(offset int64, size uint64) ([]byte, error) {
+	zr, err := zlib.NewReader(io.NewSectionReader(pack.file, offset, pack.size-offset))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// read returns the object at an offset, resolving deltas.
+func (pack *gitPack) read(store *gitObjectStore, offset int64) (gitObject, error) {
+	if object, ok := pack.cache[offset]; ok {
+		return object, nil
+	}
+	// Room for the size and a SHA-256 delta base name
+	header := make([]byte, 64)
+	n, err := pack.file.ReadAt(header, offset)
+	if err != nil && err != io.EOF {
+		return gitObject{}, err
+	}
+	header = header[:n]
+	fail := func() (gitObject, error) {
+		return gitObject{}, fmt.Errorf("ill-formed object at offset %d of %s", offset, pack.file.Name())
+	}
+	if len(header) == 0 {
+		return fail()
+	}
+	typ := (header[0] >> 4) & 7
+	size := uint64(header[0] & 15)
+	pos := 1
+	for shift := uint(4); header[pos-1]&0x80 != 0; shift += 7 {
+		if pos >= len(header) {
+			return fail()
+		}
+		size |= uint64(header[pos]&0x7f) << shift
+		pos++
+	}
+	var object gitObject
+	switch typ {
+	case 1, 2, 3, 4:
+		data, err := pack.inflate(offset+int64(pos), size)
+		if err != nil {
+			return gitObject{}, fmt.Errorf("object at offset %d of %s: %v", offset, pack.file.Name(), err)
+		}
+		object = gitObject{gitPackObjectTypes[typ], data}
+	case 6, 7:
+		var base gitObject
+		if typ == 6 {
+			if pos >= len(header) {
+				return fail()
+			}
+			c := header[pos]
+			pos++
+			back := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				if pos >= len(header) {
+					return fail()
+				}
+				c = header[pos]
+				pos++
+				back = ((back + 1) << 7) | int64(c&0x7f)
+			}
+			if back <= 0 || back > offset {
+				return fail()
+			}
+			base, err = pack.read(store, offset-back)
+		} else {
+			if pos+store.size > len(header) {
+				return fail()
+			}
+			h := gitHashBytes(header[pos : pos+store.size])
+			pos += store.size
+			base, err = store.read(h)
+		}
+		if err != nil {
+			return gitObject{}, err
+		}
+		delta, err := pack.inflate(offset+int64(pos), size)
+		if err != nil {
+			return gitObject{}, fmt.Errorf("delta at offset %d of %s: %v", offset, pack.file.Name(), err)
+		}
+		data, err := applyGitDelta(base.data, delta)
+		if err != nil {
+			return gitObject{}, fmt.Errorf("delta at offset %d of %s: %v", offset, pack.file.Name(), err)
+		}
+		object = gitObject{base.kind, data}
+	default:
+		return fail()
+	}
+	// Delta chains share bases, so keep recent results around
+	if pack.cached+len(object.data) > gitPackCacheLimit {
+		pack.cache = make(map[int64]gitObject)
+		pack.cached = 0
+	}
+	pack.cache[offset] = object
+	pack.cached += len(object.data)
+	return object, nil
+}
+
+// applyGitDelta rebuilds an object from its delta base and a delta.
+func applyGitDelta(base []byte, delta []byte) ([]byte, error) {
+	pos := 0
+	varint := func() (uint64, error) {
+		var value uint64
+		for shift := uint(0); ; shift += 7 {
+			if pos >= len(delta) {
+				return 0, errors.New("truncated delta header")
+			}
+			c := delta[pos]
+			pos++
+			value |= uint64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return value, nil
+			}
+		}
+	}
+	baseSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, errors.New("delta base has the wrong size")
+	}
+	resultSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, 0, resultSize)
+	for pos < len(delta) {
+		op := delta[pos]
+		pos++
+		if op&0x80 != 0 {
+			var offset, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if pos >= len(delta) {
+					return nil, errors.New("truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= uint64(delta[pos]) << (8 * i)
+				} else {
+					size |= uint64(delta[pos]) << (8 * (i - 4))
+				}
+				pos++
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errors.New("copy instruction outside the base")
+			}
+			result = append(result, base[offset:offset+size]...)
+		} else if op != 0 {
+			if pos+int(op) > len(delta) {
+				return nil, errors.New("truncated insert instruction")
+			}
+			result = append(result, delta[pos:pos+int(op)]...)
+			pos += int(op)
+		} else {
+			return nil, errors.New("reserved delta instruction")
+		}
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, errors.New("delta result has the wrong size")
+	}
+	return result, nil
+}
+
+// gitGrafts returns the parents the info/grafts file of a repository
+// gives commits, which git still honors though it deprecates them.
+func gitGrafts(gitdir string) (map[gitHashType][]gitHashType, error) {
+	grafts := make(map[gitHashType][]gitHashType)
+	content, err := ioutil.ReadFile(filepath.Join(gitdir, "info", "grafts"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return grafts, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var hashes []gitHashType
+		for _, field := range fields {
+			h, err := parseHash(field)
+			if err != nil {
+				return nil, fmt.Errorf("info/grafts: %v", err)
+			}
+			hashes = append(hashes, h)
+		}
+		grafts[hashes[0]] = hashes[1:]
+	}
+	return grafts, nil
+}
+
+// gitRefs returns the non-symbolic refs of a repository.
+func gitRefs(gitdir string) (map[string]gitHashType, error) {
+	refs := make(map[string]gitHashType)
+	if packed, err := os.Open(filepath.Join(gitdir, "packed-refs")); err == nil {
+		scanner := bufio.NewScanner(packed)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// Skip the header and the peeled values of tags
+			if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			h, err := parseHash(fields[0])
+			if err != nil {
+				packed.Close()
+				return nil, fmt.Errorf("packed-refs: %v", err)
+			}
+			refs[fields[1]] = h
+		}
+		packed.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	err := filepath.Walk(filepath.Join(gitdir, "refs"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text := strings.TrimSpace(string(content))
+		if strings.HasPrefix(text, "ref:") {
+			return nil
+		}
+		rel, err := filepath.Rel(gitdir, path)
+		if err != nil {
+			return err
+		}
+		h, err := parseHash(text)
+		if err != nil {
+			return fmt.Errorf("%s: %v", rel, err)
+		}
+		// Loose refs are newer than packed ones
+		refs[filepath.ToSlash(rel)] = h
+		return nil
+	})
+	return refs, err
+}
+
+// gitHeader is one header line of a commit or tag object, with any
+// continuation lines joined to its value.
+type gitHeader struct {
+	name  string
+	value string
+}
+
+// parseGitObject splits a commit or tag object into its headers and
+// message.
+func parseGitObject(data []byte) ([]gitHeader, string) {
+	var headers []gitHeader
+	text := string(data)
+	for text != "" {
+		end := strings.IndexByte(text, '\n')
+		if end == -1 {
+			end = len(text)
+		}
+		line := text[:end]
+		if end < len(text) {
+			end++
+		}
+		text = text[end:]
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, " ") && len(headers) > 0 {
+			headers[len(headers)-1].value += "\n" + line[1:]
+			continue
+		}
+		name, value := splitRuneFirst(line, ' ')
+		headers = append(headers, gitHeader{name, value})
+	}
+	return headers, text
+}
+
+// gitTreeEntry is one entry of a tree object.
+type gitTreeEntry struct {
+	mode string
+	name string
+	hash gitHashType
+}
+
+// isTree tells whether the entry is a subdirectory.
+func (entry gitTreeEntry) isTree() bool {
+	return entry.mode == "40000" || entry.mode == "040000"
+}
+
+// gitTreeReader reads tree objects, canonicalizing file modes.
+type gitTreeReader struct {
+	store  *gitObjectStore
+	cache  map[gitHashType][]gitTreeEntry
+	exotic int
+}
+
+// canonicalMode returns the mode git would record for a tree entry,
+// and whether the entry already had it.
+func canonicalMode(mode string) (string, bool) {
+	switch mode {
+	case "40000", "100644", "100755", "120000", "160000":
+		return mode, true
+	case "040000":
+		return "40000", false
+	}
+	if strings.HasPrefix(mode, "100") {
+		if bits, err := strconv.ParseUint(mode, 8, 32); err == nil {
+			if bits&0111 != 0 {
+				return "100755", false
+			}
+			return "100644", false
+		}
+	}
+	return mode, false
+}
+
+// read returns the entries of a tree.
+func (tr *gitTreeReader) read(h gitHashType) ([]gitTreeEntry, error) {
+	if entries, ok := tr.cache[h]; ok {
+		return entries, nil
+	}
+	object, err := tr.store.read(tr.store.replaced(h))
+	if err != nil {
+		return nil, err
+	}
+	if object.kind != "tree" {
+		return nil, fmt.Errorf("%s is a %s, not a tree", h.hexify(), object.kind)
+	}
+	var entries []gitTreeEntry
+	data := object.data
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		end := nul + 1 + tr.store.size
+		if space == -1 || nul < space || end > len(data) {
+			return nil, fmt.Errorf("tree %s is ill-formed", h.hexify())
+		}
+		entry := gitTreeEntry{mode: string(data[:space]), name: string(data[space+1 : nul])}
+		entry.hash = gitHashBytes(data[nul+1 : end])
+		if mode, ok := canonicalMode(entry.mode); !ok {
+			switch mode {
+			case "40000", "100644", "100755":
+				entry.mode = mode
+				tr.exotic++
+			default:
+				return nil, fmt.Errorf("tree %s has %s with unknown mode %s", h.hexify(), entry.name, entry.mode)
+			}
+		}
+		entries = append(entries, entry)
+		data = data[end:]
+	}
+	// Trees recur from commit to commit; bound the cache crudely
+	if len(tr.cache) > 100000 {
+		tr.cache = make(map[gitHashType][]gitTreeEntry)
+	}
+	tr.cache[h] = entries
+	return entries, nil
+}
+
+// gitChange is a file added, changed, or deleted between two trees.
+type gitChange struct {
+	path    string
+	entry   gitTreeEntry
+	deleted bool
+}
+
+// files lists every file under a tree as changes.
+func (tr *gitTreeReader) files(prefix string, h gitHashType, deleted bool, changes *[]gitChange) error {
+	entries, err := tr.read(h)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.isTree() {
+			if err := tr.files(prefix+entry.name+"/", entry.hash, deleted, changes); err != nil {
+				return err
+			}
+		} else {
+			*changes = append(*changes, gitChange{prefix + entry.name, entry, deleted})
+		}
+	}
+	return nil
+}
+
+// diff lists the file changes that turn one tree into another.
+func (tr *gitTreeReader) diff(prefix string, before, after gitHashType, changes *[]gitChange) error {
+	if before == after {
+		return nil
+	}
+	var old, new []gitTreeEntry
+	var err error
+	if before.isValid() {
+		if old, err = tr.read(before); err != nil {
+			return err
+		}
+	}
+	if new, err = tr.read(after); err != nil {
+		return err
+	}
+	oldEntries := make(map[string]gitTreeEntry, len(old))
+	names := newOrderedStringSet()
+	for _, entry := range old {
+		oldEntries[entry.name] = entry
+		names.Add(entry.name)
+	}
+	newEntries := make(map[string]gitTreeEntry, len(new))
+	for _, entry := range new {
+		newEntries[entry.name] = entry
+		names.Add(entry.name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, hadOld := oldEntries[name]
+		n, hasNew := newEntries[name]
+		path := prefix + name
+		if hadOld && hasNew && o.isTree() && n.isTree() {
+			if err := tr.diff(path+"/", o.hash, n.hash, changes); err != nil {
+				return err
+			}
+			continue
+		}
+		if hadOld && hasNew && !o.isTree() && !n.isTree() {
+			if o.hash != n.hash || o.mode != n.mode {
+				*changes = append(*changes, gitChange{path, n, false})
+			}
+			continue
+		}
+		if hadOld {
+			if o.isTree() {
+				err = tr.files(path+"/", o.hash, true, changes)
+			} else {
+				*changes = append(*changes, gitChange{path, o, true})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if hasNew {
+			if n.isTree() {
+				err = tr.files(path+"/", n.hash, false, changes)
+			} else {
+				*changes = append(*changes, gitChange{path, n, false})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gitCommitInfo is what the reader needs of a commit object.
+type gitCommitInfo struct {
+	hash    gitHashType
+	headers []gitHeader
+	message string
+	tree    gitHashType
+	parents []gitHashType
+	date    int64
+	source  string
+	seq     int
+}
+
+// gitWalk is a queue of commits, newest first, or oldest first if
+// reversed.
+type gitWalk struct {
+	items    []*gitCommitInfo
+	reversed bool
+}
+
+func (w *gitWalk) Len() int { return len(w.items) }
+func (w *gitWalk) Less(i, j int) bool {
+	a, b := w.items[i], w.items[j]
+	if w.reversed {
+		a, b = b, a
+	}
+	if a.date != b.date {
+		return a.date > b.date
+	}
+	return a.seq < b.seq
+}
+func (w *gitWalk) Swap(i, j int)      { w.items[i], w.items[j] = w.items[j], w.items[i] }
+func (w *gitWalk) Push(x interface{}) { w.items = append(w.items, x.(*gitCommitInfo)) }
+func (w *gitWalk) Pop() interface{} {
+	x := w.items[len(w.items)-1]
+	w.items = w.items[:len(w.items)-1]
+	return x
+}
+
+// attributionDate returns the timestamp of a git attribution line.
+func attributionDate(line string) int64 {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	date, _ := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	return date
+}
+
+// gitRefTarget is a ref peeled through any annotated tags.
+type gitRefTarget struct {
+	name   string
+	tags   []gitObject
+	commit gitHashType
+}
+
+// readGit fills the repository from the git repository in the current
+// directory without running git. If bake is set the replace refs are
+// dropped, leaving the replacements as part of the history.
+func (repo *Repository) readGit(bake bool) error {
+	gitdir := ".git"
+	if isfile(gitdir) {
+		// A worktree or submodule points to its metadata
+		content, err := ioutil.ReadFile(gitdir)
+		if err != nil {
+			return err
+		}
+		text := strings.TrimSpace(string(content))
+		if !strings.HasPrefix(text, "gitdir:") {
+			return errors.New(".git is a file without a gitdir line")
+		}
+		gitdir = strings.TrimSpace(text[len("gitdir:"):])
+	}
+	// Worktrees keep their refs apart from the shared object store
+	common := gitdir
+	if content, err := ioutil.ReadFile(filepath.Join(gitdir, "commondir")); err == nil {
+		common = strings.TrimSpace(string(content))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitdir, common)
+		}
+	}
+	format := gitObjectFormat(common)
+	size, ok := gitObjectFormats[format]
+	if !ok {
+		return fmt.Errorf("unknown git object format %q", format)
+	}
+	repo.objectFormat = format
+	store, err := newGitObjectStore(common, size)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	refmap, err := gitRefs(common)
+	if err != nil {
+		return err
+	}
+	// Replace refs name the object they replace
+	store.replace = make(map[gitHashType]gitHashType)
+	replaceRefs := make(map[string]gitHashType)
+	for name, h := range refmap {
+		if !strings.HasPrefix(name, "refs/replace/") {
+			continue
+		}
+		delete(refmap, name)
+		if os.Getenv("GIT_NO_REPLACE_OBJECTS") != "" {
+			continue
+		}
+		original, err := parseHash(strings.TrimPrefix(name, "refs/replace/"))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		store.replace[original] = h
+		replaceRefs[name] = h
+	}
+	grafts, err := gitGrafts(common)
+	if err != nil {
+		return err
+	}
+	shallow := make(map[gitHashType]bool)
+	if content, err := ioutil.ReadFile(filepath.Join(common, "shallow")); err == nil {
+		for _, line := range strings.Fields(string(content)) {
+			if h, err := parseHash(line); err == nil {
+				shallow[h] = true
+			}
+		}
+	}
+
+	refnames := make([]string, 0, len(refmap))
+	for name := range refmap {
+		refnames = append(refnames, name)
+	}
+	sort.Strings(refnames)
+	var targets []gitRefTarget
+	for _, name := range refnames {
+		target := gitRefTarget{name: name}
+		h := refmap[name]
+		for {
+			h = store.replaced(h)
+			object, err := store.read(h)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if object.kind == "commit" {
+				target.commit = h
+				break
+			}
+			if object.kind != "tag" {
+				if logEnable(logWARN) {
+					logit("%s points to a %s, not a commit, dropped", name, object.kind)
+				}
+				break
+			}
+			target.tags = append(target.tags, object)
+			headers, _ := parseGitObject(object.data)
+			next := ""
+			for _, header := range headers {
+				if header.name == "object" {
+					next = header.value
+				}
+			}
+			if h, err = parseHash(next); err != nil {
+				return fmt.Errorf("tag %s: %v", name, err)
+			}
+		}
+		if target.commit.isValid() {
+			targets = append(targets, target)
+		}
+	}
+
+	// Walk from the tips, newest first, passing ref names to parents
+	commits := make(map[gitHashType]*gitCommitInfo)
+	seq := 0
+	load := func(h gitHashType, source string) (*gitCommitInfo, error) {
+		object, err := store.read(h)
+		if err != nil {
+			return nil, err
+		}
+		if object.kind != "commit" {
+			return nil, fmt.Errorf("%s is a %s, not a commit", h.hexify(), object.kind)
+		}
+		info := &gitCommitInfo{hash: h, source: source, seq: seq}
+		seq++
+		info.headers, info.message = parseGitObject(object.data)
+		for _, header := range info.headers {
+			switch header.name {
+			case "tree":
+				info.tree, err = parseHash(header.value)
+			case "parent":
+				var parent gitHashType
+				parent, err = parseHash(header.value)
+				if !shallow[h] {
+					info.parents = append(info.parents, store.replaced(parent))
+				}
+			case "committer":
+				info.date = attributionDate(header.value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("commit %s: %v", h.hexify(), err)
+			}
+		}
+		if parents, ok := grafts[h]; ok && !shallow[h] {
+			info.parents = nil
+			for _, parent := range parents {
+				info.parents = append(info.parents, store.replaced(parent))
+			}
+		}
+		commits[h] = info
+		return info, nil
+	}
+	walk := &gitWalk{}
+	for _, target := range targets {
+		if _, ok := commits[target.commit]; !ok {
+			info, err := load(target.commit, target.name)
+			if err != nil {
+				return err
+			}
+			heap.Push(walk, info)
+		}
+	}
+	baton := control.baton
+	for walk.Len() > 0 {
+		info := heap.Pop(walk).(*gitCommitInfo)
+		for _, parent := range info.parents {
+			if _, ok := commits[parent]; !ok {
+				next, err := load(parent, info.source)
+				if err != nil {
+					return err
+				}
+				heap.Push(walk, next)
+			}
+		}
+		baton.twirl()
+	}
+
+	// Emit parents first, oldest first where there is a choice
+	pending := make(map[gitHashType]int, len(commits))
+	children := make(map[gitHashType][]*gitCommitInfo)
+	ready := &gitWalk{reversed: true}
+	for _, info := range commits {
+		pending[info.hash] = len(info.parents)
+		for _, parent := range info.parents {
+			children[parent] = append(children[parent], info)
+		}
+		if len(info.parents) == 0 {
+			heap.Push(ready, info)
+		}
+	}
+	var order []*gitCommitInfo
+	for ready.Len() > 0 {
+		info := heap.Pop(ready).(*gitCommitInfo)
+		order = append(order, info)
+		for _, child := range children[info.hash] {
+			pending[child.hash]--
+			if pending[child.hash] == 0 {
+				heap.Push(ready, child)
+			}
+		}
+	}
+
+	trees := &gitTreeReader{store: store, cache: make(map[gitHashType][]gitTreeEntry)}
+	blobmarks := make(map[gitHashType]string)
+	made := make(map[gitHashType]*Commit, len(order))
+	baton.startProgress("reading git commits", uint64(len(order)))
+	for n, info := range order {
+		var before gitHashType
+		if len(info.parents) > 0 {
+			before = commits[info.parents[0]].tree
+		}
+		var changes []gitChange
+		if err := trees.diff("", before, info.tree, &changes); err != nil {
+			return fmt.Errorf("commit %s: %v", info.hash.hexify(), err)
+		}
+		// Deletions go first so a file can replace a directory
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].deleted && !changes[j].deleted
+		})
+		commit := newCommit(repo)
+		commit.setBranch(info.source)
+		for _, header := range info.headers {
+			switch header.name {
+			case "tree", "parent":
+			case "author", "committer":
+				attr, err := newAttribution(header.value)
+				if err != nil {
+					return fmt.Errorf("commit %s: in %s field: %v", info.hash.hexify(), header.name, err)
+				}
+				repo.tzmap[attr.email] = attr.date.timestamp.Location()
+				if header.name == "author" {
+					commit.authors = append(commit.authors, *attr)
+				} else {
+					commit.committer = *attr
+				}
+			default:
+				if !commit.hasProperties() {
+					props := newOrderedMap()
+					commit.properties = &props
+				}
+				commit.properties.set(header.name, header.value)
+			}
+		}
+		commit.Comment = info.message
+		if repo.flag("canonicalize") {
+			commit.Comment = canonicalizeComment(commit.Comment)
+		}
+		var parents []CommitLike
+		for _, parent := range info.parents {
+			parents = append(parents, made[parent])
+		}
+		commit.setParents(parents)
+		for _, change := range changes {
+			op := newFileOp(repo)
+			if change.deleted {
+				op.construct(opD, change.path)
+			} else if change.entry.mode == "160000" {
+				op.construct(opM, "160000", change.entry.hash.hexify(), change.path)
+			} else {
+				mark, ok := blobmarks[change.entry.hash]
+				if !ok {
+					object, err := store.read(store.replaced(change.entry.hash))
+					if err != nil {
+						return fmt.Errorf("%s in commit %s: %v", change.path, info.hash.hexify(), err)
+					}
+					blob := newBlob(repo)
+					blob.setContent(object.data, noOffset)
+					mark = repo.newmark()
+					blob.setMark(mark)
+					blob.hash = store.replaced(change.entry.hash)
+					blob.oid = blob.hash
+					repo.addEvent(blob)
+					blobmarks[change.entry.hash] = mark
+				}
+				op.construct(opM, change.entry.mode, mark, change.path)
+			}
+			commit.appendOperation(op)
+		}
+		commit.setMark(repo.newmark())
+		repo.addEvent(commit)
+		commit.hash = info.hash
+		commit.oid = info.hash
+		made[info.hash] = commit
+		baton.percentProgress(uint64(n + 1))
+	}
+	baton.endProgress()
+	if trees.exotic > 0 && logEnable(logWARN) {
+		logit("%d tree entries had non-canonical modes, canonicalized as git would", trees.exotic)
+	}
+
+	for _, target := range targets {
+		commit := made[target.commit]
+		if len(target.tags) > 0 && strings.HasPrefix(target.name, "refs/tags/") {
+			headers, message := parseGitObject(target.tags[0].data)
+			var tagger *Attribution
+			for _, header := range headers {
+				if header.name == "tagger" {
+					if tagger, err = newAttribution(header.value); err != nil {
+						return fmt.Errorf("%s: in tagger field: %v", target.name, err)
+					}
+				}
+			}
+			tag := newTag(repo, target.name, commit.mark, tagger, message)
+			tag.oid = refmap[target.name]
+			repo.addEvent(tag)
+		} else if commit.Branch != target.name {
+			repo.addEvent(newReset(repo, target.name, commit.mark, ""))
+		}
+	}
+	if !bake {
+		names := make([]string, 0, len(replaceRefs))
+		for name := range replaceRefs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if commit, ok := made[store.replaced(replaceRefs[name])]; ok {
+				repo.addEvent(newReset(repo, name, commit.mark, ""))
+			} else if logEnable(logWARN) {
+				logit("%s does not replace a commit in the history read, dropped", name)
+			}
+		}
+	}
+	repo.liftNotes()
+	return nil
+}
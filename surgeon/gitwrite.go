@@ -0,0 +1,451 @@
+// This module builds a git repository by writing its objects and refs
+// directly, rather than through git fast-import. It is used when the
+// rebuild command is given the --native option with a git target.
+//
+// Blobs, trees, commits and annotated tags are written as loose
+// objects into the freshly initialized repository, and refs as loose
+// ref files; "git gc" will pack them. Trees are made from each
+// commit's manifest, and commit objects from its attributions and
+// comment exactly as they stand, so the time zones of the dates are
+// kept and identical histories always get identical hashes. A commit
+// with several authors gets the first one, as git keeps only one.
+//
+// What the native reader keeps as commit properties goes back into
+// the commit headers: the encoding header and merge tags always, and
+// any other header too when that reproduces the commit's original
+// hash. A signature that no longer verifies, on a commit or a tag, is
+// dealt with by the repository's signing policy. Other properties are
+// dropped, as by fast-import.
+//
+// Refs are set as fast-import would set them: each commit moves its
+// branch, a reset moves its ref or deletes it, and a tag makes an
+// annotated tag object. A commit on a notes ref gets the notes in
+// force there added to its tree, each named by the new hash of the
+// commit it annotates and split into fanout directories once there
+// are 256 or more, as fast-import does. A marks file is left in
+// .git/marks, as fast-import's --export-marks would leave it.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// gitKnownHeaders are the commit headers other than the structural
+// ones that git itself writes; they are kept whenever present.
+var gitKnownHeaders = newOrderedStringSet("encoding", "mergetag", "gpgsig", "gpgsig-sha256")
+
+// gitSignatureHeaders are the headers signing the rest of the commit.
+var gitSignatureHeaders = newOrderedStringSet("gpgsig", "gpgsig-sha256")
+
+// gitWriter writes objects into a repository's loose object store.
+type gitWriter struct {
+	repo    *Repository
+	objects string
+	format  string
+	blobs   map[string]gitHashType
+	trees   map[*PathMap]gitHashType
+	commits map[*Commit]gitHashType
+	notes   map[*Commit]map[*Commit]*FileOp
+	signer  *signer
+}
+
+// write stores an object and returns its hash. An object already
+// present is left alone.
+func (gw *gitWriter) write(kind string, data []byte) (gitHashType, error) {
+	header := fmt.Sprintf("%s %d\x00", kind, len(data))
+	var hasher hash.Hash = sha1.New()
+	if gw.format == "sha256" {
+		hasher = sha256.New()
+	}
+	hasher.Write([]byte(header))
+	hasher.Write(data)
+	h := gitHashBytes(hasher.Sum(nil))
+	hex := h.hexify()
+	dir := filepath.Join(gw.objects, hex[:2])
+	path := filepath.Join(dir, hex[2:])
+	if exists(path) {
+		return h, nil
+	}
+	if err := os.MkdirAll(dir, userReadWriteSearchMode); err != nil {
+		return h, err
+	}
+	fp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return h, err
+	}
+	zw := zlib.NewWriter(fp)
+	zw.Write([]byte(header))
+	zw.Write(data)
+	err = zw.Close()
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return h, fmt.Errorf("writing %s object %s: %v", kind, hex, err)
+	}
+	return h, nil
+}
+
+// gitMode returns the mode git records for a fileop mode, accepting
+// the short forms fast-import does.
+func gitMode(mode string) string {
+	switch mode {
+	case "644":
+		return "100644"
+	case "755":
+		return "100755"
+	}
+	canonical, _ := canonicalMode(mode)
+	return canonical
+}
+
+// entry returns the mode and hash of the object a manifest entry
+// names, writing its blob if that has not been done yet.
+func (gw *gitWriter) entry(path string, op *FileOp) (string, gitHashType, error) {
+	mode := gitMode(op.mode)
+	if mode == "160000" {
+		h, err := parseHash(op.ref)
+		if err != nil {
+			return "", h, fmt.Errorf("submodule link %s: %v", path, err)
+		}
+		return mode, h, nil
+	}
+	if op.ref == "inline" {
+		h, err := gw.write("blob", op.inline)
+		return mode, h, err
+	}
+	if h, ok := gw.blobs[op.ref]; ok {
+		return mode, h, nil
+	}
+	blob, ok := gw.repo.markToEvent(op.ref).(*Blob)
+	if !ok {
+		return "", gitHashType{}, fmt.Errorf("%s refers to nonexistent blob %s", path, op.ref)
+	}
+	h, err := gw.write("blob", blob.getContent())
+	if err != nil {
+		return "", h, err
+	}
+	gw.blobs[op.ref] = h
+	return mode, h, nil
+}
+
+// tree writes the tree for a manifest directory and returns its hash.
+// It tells whether the directory is empty, as git has no empty trees
+// but the top one.
+func (gw *gitWriter) tree(prefix string, pm *PathMap) (gitHashType, bool, error) {
+	if h, ok := gw.trees[pm]; ok {
+		return h, false, nil
+	}
+	type treeItem struct {
+		mode string
+		name string
+		key  string
+		hash gitHashType
+	}
+	var items []treeItem
+	for name, sub := range pm.dirs {
+		h, empty, err := gw.tree(prefix+name+"/", sub)
+		if err != nil {
+			return h, false, err
+		}
+		if !empty {
+			// Git sorts a tree as if its name ended in a slash
+			items = append(items, treeItem{"40000", name, name + "/", h})
+		}
+	}
+	for name, entry := range pm.blobs {
+		mode, h, err := gw.entry(prefix+name, entry.(*FileOp))
+		if err != nil {
+			return h, false, err
+		}
+		items = append(items, treeItem{mode, name, name, h})
+	}
+	if len(items) == 0 && prefix != "" {
+		return gitHashType{}, true, nil
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	var body []byte
+	for _, item := range items {
+		body = append(body, item.mode+" "+item.name+"\x00"...)
+		body = append(body, item.hash.bytes()...)
+	}
+	h, err := gw.write("tree", body)
+	if err != nil {
+		return h, false, err
+	}
+	gw.trees[pm] = h
+	return h, false, nil
+}
+
+// noteTree returns the manifest of a commit with the notes in force
+// there added, or nil if it carries no notes.
+func (gw *gitWriter) noteTree(commit *Commit) (*PathMap, error) {
+	var inherited map[*Commit]*FileOp
+	if parents := commit.parents(); len(parents) > 0 {
+		if parent, ok := parents[0].(*Commit); ok {
+			inherited = gw.notes[parent]
+		}
+	}
+	own := false
+	for _, op := range commit.operations() {
+		own = own || op.op == opN
+	}
+	if inherited == nil && !own {
+		return nil, nil
+	}
+	notes := make(map[*Commit]*FileOp, len(inherited))
+	for target, op := range inherited {
+		notes[target] = op
+	}
+	for _, op := range commit.operations() {
+		switch op.op {
+		case deleteall:
+			notes = make(map[*Commit]*FileOp)
+		case opN:
+			target, ok := gw.repo.markToEvent(op.Path).(*Commit)
+			if !ok {
+				return nil, fmt.Errorf("%s has a note on %s, which is not a commit", commit.idMe(), op.Path)
+			}
+			if op.ref == nullNoteRef {
+				delete(notes, target)
+			} else {
+				notes[target] = op
+			}
+		}
+	}
+	gw.notes[commit] = notes
+	fanout := 0
+	for n := len(notes); n >= 256; n /= 256 {
+		fanout++
+	}
+	pm := commit.manifest().PathMap.snapshot()
+	for target, op := range notes {
+		h, ok := gw.commits[target]
+		if !ok {
+			return nil, fmt.Errorf("%s has a note on %s, which comes after it", commit.idMe(), target.mark)
+		}
+		name := h.hexify()
+		var path strings.Builder
+		for i := 0; i < fanout; i++ {
+			path.WriteString(name[2*i:2*i+2] + "/")
+		}
+		path.WriteString(name[2*fanout:])
+		pm.set(path.String(), &FileOp{mode: "100644", ref: op.ref, inline: op.inline, op: opM})
+	}
+	return pm, nil
+}
+
+// commitObject renders a commit with those of its properties a filter
+// admits as headers.
+func commitObject(commit *Commit, tree gitHashType, parents []gitHashType, admit func(string) bool) []byte {
+	var sb strings.Builder
+	sb.WriteString("tree " + tree.hexify() + "\n")
+	for _, parent := range parents {
+		sb.WriteString("parent " + parent.hexify() + "\n")
+	}
+	author := commit.committer
+	if len(commit.authors) > 0 {
+		author = commit.authors[0]
+	}
+	sb.WriteString("author " + author.String() + "\n")
+	sb.WriteString("committer " + commit.committer.String() + "\n")
+	if commit.hasProperties() {
+		for _, name := range commit.properties.keys {
+			if !admit(name) || name == "" || strings.ContainsAny(name, " \n") {
+				continue
+			}
+			value := commit.properties.get(name)
+			sb.WriteString(name + " " + strings.Replace(value, "\n", "\n ", -1) + "\n")
+		}
+	}
+	sb.WriteString("\n")
+	sb.WriteString(commit.Comment)
+	return []byte(sb.String())
+}
+
+// commit writes a commit object and returns its hash.
+func (gw *gitWriter) commit(commit *Commit) (gitHashType, error) {
+	pm, err := gw.noteTree(commit)
+	if err != nil {
+		return gitHashType{}, err
+	}
+	if pm == nil {
+		pm = &commit.manifest().PathMap
+	}
+	tree, _, err := gw.tree("", pm)
+	if err != nil {
+		return tree, err
+	}
+	var parents []gitHashType
+	for _, parent := range commit.parents() {
+		p, ok := parent.(*Commit)
+		if !ok {
+			return gitHashType{}, fmt.Errorf("%s has a callout parent, which cannot be written natively", commit.idMe())
+		}
+		parents = append(parents, gw.commits[p])
+	}
+	if len(commit.authors) > 1 && logEnable(logWARN) {
+		logit("%s has %d authors, git keeps only the first", commit.idMe(), len(commit.authors))
+	}
+	original := commit.oid
+	data := commitObject(commit, tree, parents, func(string) bool { return true })
+	if !original.isValid() || objectHash(gw.format, "commit", data) != original {
+		data = commitObject(commit, tree, parents, gitKnownHeaders.Contains)
+		name, old := commit.signature()
+		if name != "" && original.isValid() && objectHash(gw.format, "commit", data) != original {
+			unsigned := commitObject(commit, tree, parents, func(name string) bool {
+				return gitKnownHeaders.Contains(name) && !gitSignatureHeaders.Contains(name)
+			})
+			sig, err := gw.signer.settle(commit.idMe(), old, unsigned)
+			if err != nil {
+				return gitHashType{}, err
+			}
+			if sig == "" {
+				data = unsigned
+			} else if sig != old {
+				data = addHeader(unsigned, name, strings.TrimSuffix(sig, "\n"))
+			}
+		}
+	}
+	h, err := gw.write("commit", data)
+	if err != nil {
+		return h, err
+	}
+	gw.commits[commit] = h
+	return h, nil
+}
+
+// buildGit writes the repository's history into the empty git
+// repository in the current directory.
+func (repo *Repository) buildGit(options stringSet) error {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--shallow=") {
+			return errors.New("the native git builder cannot make shallow rebuilds")
+		}
+	}
+	if format := gitObjectFormat(".git"); format != repo.objectFormat {
+		return fmt.Errorf("cannot write %s objects into a %s repository", repo.objectFormat, format)
+	}
+	gw := &gitWriter{
+		repo:    repo,
+		objects: filepath.Join(".git", "objects"),
+		format:  repo.objectFormat,
+		blobs:   make(map[string]gitHashType),
+		trees:   make(map[*PathMap]gitHashType),
+		commits: make(map[*Commit]gitHashType),
+		notes:   make(map[*Commit]map[*Commit]*FileOp),
+		signer:  &signer{repo: repo},
+	}
+	refs := make(map[string]gitHashType)
+	var order []string
+	setRef := func(ref string, h gitHashType) {
+		if _, ok := refs[ref]; !ok {
+			order = append(order, ref)
+		}
+		refs[ref] = h
+	}
+	commits := repo.commits(nil)
+	baton := control.baton
+	baton.startProgress("writing git commits", uint64(len(commits)))
+	built := 0
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			h, err := gw.commit(event)
+			if err != nil {
+				return err
+			}
+			setRef(event.Branch, h)
+			built++
+			baton.percentProgress(uint64(built))
+		case *Reset:
+			if target, ok := repo.markToEvent(event.committish).(*Commit); ok {
+				setRef(event.ref, gw.commits[target])
+			} else if event.committish == "" {
+				setRef(event.ref, gitHashType{})
+			}
+		case *Tag:
+			target := repo.markToEvent(event.committish)
+			commit, ok := target.(*Commit)
+			if !ok {
+				if logEnable(logWARN) {
+					logit("tag %s does not point at a commit, skipped", event.getHumanName())
+				}
+				continue
+			}
+			data := tagObject(event, gw.commits[commit], event.Comment)
+			message, old := splitSignature(event.Comment)
+			if old != "" && event.oid.isValid() && objectHash(repo.objectFormat, "tag", data) != event.oid {
+				unsigned := tagObject(event, gw.commits[commit], message)
+				sig, err := gw.signer.settle("tag "+event.getHumanName(), old, unsigned)
+				if err != nil {
+					return err
+				}
+				data = append(unsigned, sig...)
+			}
+			h, err := gw.write("tag", data)
+			if err != nil {
+				return err
+			}
+			setRef(event.name, h)
+		}
+	}
+	baton.endProgress()
+	gw.signer.report()
+
+	for _, ref := range order {
+		h := refs[ref]
+		if !h.isValid() {
+			continue
+		}
+		if !strings.HasPrefix(ref, "refs/") {
+			if logEnable(logWARN) {
+				logit("%s is not a ref name, not written", ref)
+			}
+			continue
+		}
+		path := filepath.Join(".git", filepath.FromSlash(ref))
+		if err := os.MkdirAll(filepath.Dir(path), userReadWriteSearchMode); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(h.hexify()+"\n"), userReadWriteMode); err != nil {
+			return fmt.Errorf("writing ref %s: %v", ref, err)
+		}
+	}
+
+	// Leave a marks file where git fast-import would
+	var marks strings.Builder
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Blob:
+			if h, ok := gw.blobs[event.mark]; ok {
+				fmt.Fprintf(&marks, "%s %s\n", event.mark, h.hexify())
+			}
+		case *Commit:
+			if event.mark != "" {
+				fmt.Fprintf(&marks, "%s %s\n", event.mark, gw.commits[event].hexify())
+			}
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(".git", "marks"), []byte(marks.String()), userReadWriteMode)
+}
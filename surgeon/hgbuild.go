@@ -0,0 +1,320 @@
+// This module builds a Mercurial repository by driving the stock hg
+// client, for when no fast-import method for Mercurial is installed.
+//
+// Commits are replayed in event order, which puts parents first. For
+// each one the working directory is updated to its first parent, the
+// difference between that parent's manifest and the commit's is
+// applied to the files, and the result is committed with the commit's
+// author, date, branch, and comment. A second parent is recorded with
+// debugsetparents; further parents of an octopus merge have no hg
+// equivalent and are dropped with a warning. Tags, annotated or not,
+// are then made with "hg tag" on the tip of default, each as its own
+// commit as Mercurial does it.
+//
+// The master branch becomes default, the reverse of what the hg reader
+// does. Mercurial keeps one user per changeset, so the first author is
+// used and the committer is lost; and it refuses empty comments, so
+// those become "*** empty log message ***". Gitlinks are skipped.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtinBuilders maps the builder names used in the VCS table's
+// import strategies to their implementations.
+var builtinBuilders = map[string]func(*Repository, stringSet) error{
+	"hg":  (*Repository).buildHg,
+	"git": (*Repository).buildGit,
+}
+
+// hgBuilder drives hg in the repository in the current directory.
+type hgBuilder struct {
+	scratch string
+	nodes   map[*Commit]string
+	current string
+}
+
+// run runs an hg subcommand and returns its output.
+func (hb *hgBuilder) run(args ...string) (string, error) {
+	if logEnable(logCOMMANDS) {
+		logit("%s: executing hg %s", wallclock(), strings.Join(args, " "))
+	}
+	cmd := exec.Command("hg", args...)
+	// Keep user configuration from changing the output or behavior
+	cmd.Env = append(os.Environ(), "HGPLAIN=1")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("hg %s: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// listfile writes paths to a scratch file for hg's listfile0: pattern,
+// so that any number of paths, however odd, can be passed.
+func (hb *hgBuilder) listfile(name string, paths []string) (string, error) {
+	listfile := filepath.Join(hb.scratch, name)
+	if err := ioutil.WriteFile(listfile, []byte(strings.Join(paths, "\x00")), userReadWriteMode); err != nil {
+		return "", err
+	}
+	return "listfile0:" + listfile, nil
+}
+
+// hgUser renders an attribution as an hg user and date.
+func hgUser(attr *Attribution) (string, string) {
+	_, offset := attr.date.timestamp.Zone()
+	// Mercurial counts the offset in seconds west of UTC
+	return attr.who(), fmt.Sprintf("%d %d", attr.date.timestamp.Unix(), -offset)
+}
+
+// hgBranch maps a branch to its Mercurial name.
+func hgBranch(branch string) string {
+	if branch == "refs/heads/master" {
+		return "default"
+	}
+	return branchbase(branch)
+}
+
+// writeEntry writes the content of a manifest entry to a path in the
+// working directory.
+func (repo *Repository) writeEntry(path string, entry *FileOp) error {
+	fullpath := filepath.FromSlash(path)
+	if err := os.MkdirAll(filepath.Dir(fullpath), userReadWriteSearchMode); err != nil {
+		return err
+	}
+	// What is there may be a symlink, which must not be written through
+	os.Remove(fullpath)
+	var content []byte
+	if entry.ref == "inline" {
+		content = entry.inline
+	} else {
+		blob, ok := repo.markToEvent(entry.ref).(*Blob)
+		if !ok {
+			return fmt.Errorf("%s refers to nonexistent blob %s", path, entry.ref)
+		}
+		content = blob.getContent()
+	}
+	if entry.mode == "120000" {
+		return os.Symlink(string(content), fullpath)
+	}
+	rawmode, err := strconv.ParseUint(entry.mode, 8, 32)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fullpath, content, os.FileMode(rawmode)&os.ModePerm); err != nil {
+		return err
+	}
+	// WriteFile leaves the permissions of an existing file alone
+	return os.Chmod(fullpath, os.FileMode(rawmode)&os.ModePerm)
+}
+
+// manifestEntries flattens a manifest into a map from paths to entries,
+// leaving out gitlinks.
+func manifestEntries(commit *Commit) map[string]*FileOp {
+	entries := make(map[string]*FileOp)
+	if commit == nil {
+		return entries
+	}
+	commit.manifest().iter(func(path string, pentry interface{}) {
+		if entry := pentry.(*FileOp); entry.mode != "160000" {
+			entries[path] = entry
+		}
+	})
+	return entries
+}
+
+// buildCommit replays one commit into the working directory and
+// commits it.
+func (hb *hgBuilder) buildCommit(repo *Repository, commit *Commit) error {
+	var parents []*Commit
+	for _, parent := range commit.parents() {
+		if p, ok := parent.(*Commit); ok {
+			parents = append(parents, p)
+		}
+	}
+	if len(parents) > 2 {
+		if logEnable(logWARN) {
+			logit("%s has %d parents, hg keeps only the first two", commit.idMe(), len(parents))
+		}
+		parents = parents[:2]
+	}
+	p1 := "null"
+	var first *Commit
+	if len(parents) > 0 {
+		first = parents[0]
+		p1 = hb.nodes[first]
+	}
+	if p1 != hb.current {
+		if _, err := hb.run("update", "--quiet", "--clean", "--rev", p1); err != nil {
+			return err
+		}
+	}
+	if len(parents) == 2 {
+		if _, err := hb.run("debugsetparents", p1, hb.nodes[parents[1]]); err != nil {
+			return err
+		}
+	}
+	before := manifestEntries(first)
+	after := manifestEntries(commit)
+	var removed, added []string
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	if len(removed) > 0 {
+		pattern, err := hb.listfile("removed", removed)
+		if err != nil {
+			return err
+		}
+		if _, err := hb.run("remove", "--quiet", "--force", pattern); err != nil {
+			return err
+		}
+	}
+	for path, entry := range after {
+		old, ok := before[path]
+		if ok && old.ref == entry.ref && old.mode == entry.mode && bytes.Equal(old.inline, entry.inline) {
+			continue
+		}
+		if err := repo.writeEntry(path, entry); err != nil {
+			return fmt.Errorf("writing %s at %s: %v", path, commit.idMe(), err)
+		}
+		if !ok {
+			added = append(added, path)
+		}
+	}
+	sort.Strings(added)
+	if len(added) > 0 {
+		// Naming the files explicitly overrides any .hgignore
+		pattern, err := hb.listfile("added", added)
+		if err != nil {
+			return err
+		}
+		if _, err := hb.run("add", "--quiet", pattern); err != nil {
+			return err
+		}
+	}
+	if _, err := hb.run("branch", "--quiet", "--force", hgBranch(commit.Branch)); err != nil {
+		return err
+	}
+	attr := &commit.committer
+	if len(commit.authors) > 0 {
+		attr = &commit.authors[0]
+	}
+	user, date := hgUser(attr)
+	comment := commit.Comment
+	if strings.TrimSpace(comment) == "" {
+		comment = "*** empty log message ***"
+	}
+	msgfile := filepath.Join(hb.scratch, "message")
+	if err := ioutil.WriteFile(msgfile, []byte(comment), userReadWriteMode); err != nil {
+		return err
+	}
+	if _, err := hb.run("commit", "--quiet", "--config", "ui.allowemptycommit=True",
+		"--user", user, "--date", date, "--logfile", msgfile); err != nil {
+		return fmt.Errorf("committing %s: %v", commit.idMe(), err)
+	}
+	node, err := hb.run("log", "--rev", ".", "--template", "{node}")
+	if err != nil {
+		return err
+	}
+	hb.nodes[commit] = strings.TrimSpace(node)
+	hb.current = hb.nodes[commit]
+	return nil
+}
+
+// buildHg writes the repository's history into the empty Mercurial
+// repository in the current directory.
+func (repo *Repository) buildHg(options stringSet) error {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--shallow=") {
+			return errors.New("the built-in hg builder cannot make shallow rebuilds")
+		}
+	}
+	scratch, err := ioutil.TempDir("", "rs-hgbuild")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	hb := &hgBuilder{scratch: scratch, nodes: make(map[*Commit]string), current: "null"}
+	commits := repo.commits(nil)
+	baton := control.baton
+	baton.startProgress("building hg commits", uint64(len(commits)))
+	for i, commit := range commits {
+		if err := hb.buildCommit(repo, commit); err != nil {
+			return err
+		}
+		baton.percentProgress(uint64(i + 1))
+	}
+	baton.endProgress()
+
+	type hgTag struct {
+		name   string
+		target *Commit
+		tagger *Attribution
+		text   string
+	}
+	var tags []hgTag
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Tag:
+			if target, ok := repo.markToEvent(event.committish).(*Commit); ok {
+				tagger := event.tagger
+				if tagger == nil {
+					tagger = &target.committer
+				}
+				tags = append(tags, hgTag{event.name, target, tagger, event.Comment})
+			}
+		case *Reset:
+			if strings.HasPrefix(event.ref, "refs/tags/") {
+				if target, ok := repo.markToEvent(event.committish).(*Commit); ok {
+					tags = append(tags, hgTag{branchbase(event.ref), target, &target.committer, ""})
+				}
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	// Tags are commits to .hgtags, best kept on default
+	tip := commits[len(commits)-1]
+	for _, commit := range commits {
+		if commit.Branch == "refs/heads/master" {
+			tip = commit
+		}
+	}
+	if _, err := hb.run("update", "--quiet", "--clean", "--rev", hb.nodes[tip]); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		node, ok := hb.nodes[tag.target]
+		if !ok {
+			continue
+		}
+		user, date := hgUser(tag.tagger)
+		args := []string{"tag", "--force", "--rev", node, "--user", user, "--date", date}
+		if text := strings.TrimSpace(tag.text); text != "" {
+			args = append(args, "--message", text)
+		}
+		if _, err := hb.run(append(args, tag.name)...); err != nil {
+			return fmt.Errorf("tagging %s: %v", tag.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,589 @@
+// Translate ignore patterns between the syntaxes of version-control
+// systems, by way of .gitignore syntax.
+//
+// Glob syntax is nearly the same everywhere; what differs is where a
+// pattern applies. Some systems match a pattern only against entries
+// of the directory holding it (svn:ignore, .cvsignore), others at any
+// depth below it (svn:global-ignores, and git, hg, and bzr patterns
+// without a slash). A pattern containing a slash is anchored to the
+// ignore file's directory in git and bzr, but can match below any
+// directory in hg. An ignoreDialect records these semantics, and
+// translateIgnore renders a pattern so that git applies it in the
+// same places, making the anchoring explicit with a leading slash
+// where needed. renderIgnore goes the other way, choosing for each
+// pattern a form the target dialect applies in the same places, or
+// reporting that there is none.
+//
+// Mercurial and Bazaar also accept regular expressions. Those simple
+// enough to have a glob equivalent are translated; going the other
+// way, a regular expression is how an hg pattern is anchored to the
+// top of the tree.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ignoreDialect describes how one kind of ignore file or property
+// interprets its patterns.
+type ignoreDialect struct {
+	// recursive is true if a pattern without a slash matches at any
+	// depth below its directory, false if it matches only entries of
+	// the directory itself.
+	recursive bool
+	// slashAnchors is true if a pattern containing a slash matches
+	// only relative to the ignore file's directory, false if it may
+	// match below any subdirectory.
+	slashAnchors bool
+	// rootPrefix explicitly anchors a pattern to the ignore file's
+	// directory; it is removed in translation.
+	rootPrefix string
+	// comments is true if lines beginning with # are comments.
+	comments bool
+	// negation is true if a leading ! negates a pattern.
+	negation bool
+	// escapes is true if a backslash protects a leading # or !.
+	escapes bool
+	// paths is true if a pattern may contain slashes to match
+	// entries below the ignore file's directory.
+	paths bool
+	// unsupported lists line prefixes that introduce syntax with no
+	// .gitignore equivalent.
+	unsupported []string
+	// globPrefixes mark a line as a glob pattern.
+	globPrefixes []string
+	// regexpPrefixes mark a line as a regular expression; the first
+	// is used in translations into the dialect.
+	regexpPrefixes []string
+	// regexpFull is true if a regular expression must match the whole
+	// path, false if it need only match part of it.
+	regexpFull bool
+	// syntax is true if "syntax:" lines switch between glob and
+	// regular-expression patterns; regexpDefault says which applies
+	// before the first of them.
+	syntax        bool
+	regexpDefault bool
+	// header begins each translation of a file into the dialect.
+	header string
+	// filename is the name of an ignore file in the dialect, empty
+	// if it is not kept in files.
+	filename string
+}
+
+var ignoreDialects = map[string]ignoreDialect{
+	"svn:ignore":         {recursive: false, slashAnchors: true},
+	"svn:global-ignores": {recursive: true, slashAnchors: true},
+	"cvs":                {recursive: false, slashAnchors: true, unsupported: []string{"!"}, filename: ".cvsignore"},
+	"git": {recursive: true, slashAnchors: true, rootPrefix: "/", comments: true, negation: true, paths: true,
+		escapes: true, filename: ".gitignore"},
+	"hg": {recursive: true, slashAnchors: false, comments: true, paths: true, escapes: true,
+		unsupported:  []string{"syntax:", "include:", "subinclude:", "path:", "rootglob:", "relre:"},
+		globPrefixes: []string{"glob:", "relglob:"}, regexpPrefixes: []string{"re:", "regexp:"},
+		syntax: true, regexpDefault: true, header: "syntax: glob", filename: ".hgignore"},
+	"bzr": {recursive: true, slashAnchors: true, rootPrefix: "./", comments: true, negation: true, paths: true,
+		unsupported: []string{"!!"}, regexpPrefixes: []string{"RE:"}, regexpFull: true, filename: ".bzrignore"},
+}
+
+// ignoreDialectNames returns the names of the known dialects, sorted.
+func ignoreDialectNames() []string {
+	names := make([]string, 0, len(ignoreDialects))
+	for name := range ignoreDialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ignoreTranslation records how one pattern was rendered in
+// .gitignore syntax.  If it could not be, ok is false.
+type ignoreTranslation struct {
+	pattern    string
+	translated string
+	ok         bool
+	reason     string
+}
+
+// translateIgnore renders one pattern of a dialect in .gitignore
+// syntax, for a .gitignore in the directory the pattern applied to.
+func translateIgnore(dialect string, pattern string) (ignoreTranslation, error) {
+	d, known := ignoreDialects[dialect]
+	if !known {
+		return ignoreTranslation{}, fmt.Errorf("unknown ignore dialect %q", dialect)
+	}
+	result := ignoreTranslation{pattern: pattern, ok: true}
+	body := strings.TrimRight(pattern, "\r")
+	if strings.TrimSpace(body) == "" {
+		result.reason = "blank"
+		return result, nil
+	}
+	if d.comments && strings.HasPrefix(body, "#") {
+		result.translated = body
+		result.reason = "comment"
+		return result, nil
+	}
+	for _, prefix := range d.unsupported {
+		if strings.HasPrefix(body, prefix) {
+			result.ok = false
+			result.reason = fmt.Sprintf("%q has no .gitignore equivalent", prefix)
+			return result, nil
+		}
+	}
+	negated := ""
+	if d.negation && strings.HasPrefix(body, "!") {
+		negated = "!"
+		body = body[1:]
+	}
+	var reasons []string
+	if negated != "" {
+		reasons = append(reasons, "negated")
+	}
+	for _, prefix := range d.globPrefixes {
+		if strings.HasPrefix(body, prefix) {
+			body = body[len(prefix):]
+			break
+		}
+	}
+	rooted := false
+	for _, prefix := range d.regexpPrefixes {
+		if strings.HasPrefix(body, prefix) {
+			re := body[len(prefix):]
+			if d.regexpFull {
+				re = "^" + strings.TrimPrefix(re, "^")
+				if !strings.HasSuffix(re, "$") || strings.HasSuffix(re, `\$`) {
+					re += "$"
+				}
+			}
+			glob, anchored, ok := regexpToGlob(re)
+			if !ok {
+				result.ok = false
+				result.reason = fmt.Sprintf("regular expression %q has no glob equivalent", re)
+				return result, nil
+			}
+			body, rooted = glob, anchored
+			reasons = append(reasons, "regular expression")
+			break
+		}
+	}
+	// A trailing slash only restricts a match to directories
+	inner := strings.TrimSuffix(body, "/")
+	if rooted {
+		if !strings.HasPrefix(body, "/") {
+			body = "/" + body
+		}
+		reasons = append(reasons, "anchored by ^")
+	} else if d.rootPrefix != "" && strings.HasPrefix(body, d.rootPrefix) {
+		body = "/" + body[len(d.rootPrefix):]
+		reasons = append(reasons, "anchored explicitly")
+	} else if strings.Contains(inner, "/") {
+		if d.slashAnchors {
+			reasons = append(reasons, "anchored by its slash")
+		} else {
+			body = "**/" + strings.TrimPrefix(body, "/")
+			reasons = append(reasons, "matches below any directory")
+		}
+	} else if d.recursive {
+		reasons = append(reasons, "matches at any depth")
+	} else {
+		body = "/" + body
+		reasons = append(reasons, "matches in its own directory only")
+	}
+	// Protect characters git would take as syntax
+	if negated == "" && (strings.HasPrefix(body, "#") || strings.HasPrefix(body, "!")) {
+		body = `\` + body
+		reasons = append(reasons, "escaped")
+	}
+	result.translated = negated + body
+	result.reason = strings.Join(reasons, ", ")
+	return result, nil
+}
+
+// renderIgnore renders one pattern in .gitignore syntax in a dialect,
+// for an ignore file in the directory the pattern applied to. This is
+// the inverse of translateIgnore.
+func renderIgnore(dialect string, pattern string) (ignoreTranslation, error) {
+	d, known := ignoreDialects[dialect]
+	if !known {
+		return ignoreTranslation{}, fmt.Errorf("unknown ignore dialect %q", dialect)
+	}
+	result := ignoreTranslation{pattern: pattern, ok: true}
+	fail := func(reason string) (ignoreTranslation, error) {
+		result.ok = false
+		result.reason = reason
+		return result, nil
+	}
+	body := strings.TrimRight(pattern, "\r")
+	if strings.TrimSpace(body) == "" {
+		result.reason = "blank"
+		return result, nil
+	}
+	if strings.HasPrefix(body, "#") {
+		if !d.comments {
+			return fail("comments are not supported")
+		}
+		result.translated = body
+		result.reason = "comment"
+		return result, nil
+	}
+	var reasons []string
+	negated := ""
+	if strings.HasPrefix(body, "!") {
+		if !d.negation {
+			return fail("negation is not supported")
+		}
+		negated = "!"
+		body = body[1:]
+		reasons = append(reasons, "negated")
+	}
+	if (strings.HasPrefix(body, `\#`) || strings.HasPrefix(body, `\!`)) && !d.escapes {
+		body = body[1:]
+		if (body[0] == '#' && d.comments) || (body[0] == '!' && (d.negation || negated == "")) {
+			return fail(fmt.Sprintf("a leading %c cannot be escaped", body[0]))
+		}
+		reasons = append(reasons, "unescaped")
+	}
+	for _, prefix := range append(d.unsupported, append(d.globPrefixes, d.regexpPrefixes...)...) {
+		if strings.HasPrefix(body, prefix) {
+			return fail(fmt.Sprintf("%q would be read as syntax", prefix))
+		}
+	}
+	dironly := strings.HasSuffix(body, "/")
+	inner := strings.TrimSuffix(body, "/")
+	anchored := strings.HasPrefix(inner, "/") || (strings.Contains(inner, "/") && !strings.HasPrefix(inner, "**/"))
+	inner = strings.TrimPrefix(inner, "/")
+	// anchor renders an anchored pattern as a regular expression.
+	anchor := func() (ignoreTranslation, error) {
+		if len(d.regexpPrefixes) == 0 {
+			return fail("patterns cannot be anchored to their directory")
+		}
+		re := "^" + globToRegexp(inner)
+		if dironly {
+			re += "/"
+		} else {
+			re += "(?:/|$)"
+		}
+		result.translated = negated + d.regexpPrefixes[0] + re
+		result.reason = strings.Join(append(reasons, "anchored by a regular expression"), ", ")
+		return result, nil
+	}
+	switch {
+	case anchored && !strings.Contains(inner, "/"):
+		if !d.recursive {
+			reasons = append(reasons, "matches in its own directory only")
+		} else if d.rootPrefix != "" {
+			inner = d.rootPrefix + inner
+			reasons = append(reasons, "anchored explicitly")
+		} else {
+			return anchor()
+		}
+	case anchored:
+		if !d.paths {
+			return fail("patterns cannot match below their directory")
+		} else if !d.slashAnchors {
+			return anchor()
+		}
+		reasons = append(reasons, "anchored by its slash")
+	case !strings.Contains(strings.TrimPrefix(inner, "**/"), "/"):
+		if !d.recursive {
+			return fail("patterns match in their own directory only")
+		}
+		inner = strings.TrimPrefix(inner, "**/")
+		reasons = append(reasons, "matches at any depth")
+	default:
+		if !d.paths {
+			return fail("patterns cannot match below their directory")
+		} else if !d.slashAnchors {
+			inner = strings.TrimPrefix(inner, "**/")
+		}
+		reasons = append(reasons, "matches below any directory")
+	}
+	if dironly {
+		inner += "/"
+	}
+	result.translated = negated + inner
+	result.reason = strings.Join(reasons, ", ")
+	return result, nil
+}
+
+// regexpToGlob renders a regular expression searched for in paths as
+// a glob, if it is simple enough to have one: literals, ".", ".*",
+// bracket expressions, the ^ and $ anchors, and the constructs
+// globToRegexp generates. It also reports whether the expression was
+// anchored to the top of the tree.
+func regexpToGlob(re string) (string, bool, bool) {
+	rooted := strings.HasPrefix(re, "^")
+	re = strings.TrimPrefix(re, "^")
+	if strings.HasPrefix(re, ".*") {
+		// Matching at any depth is what an unanchored glob does
+		rooted = false
+		re = strings.TrimPrefix(re, ".*")
+		re = strings.TrimPrefix(re, "/")
+	}
+	ended := false
+	var glob strings.Builder
+	wild := false
+	for i := 0; i < len(re); i++ {
+		c := re[i]
+		switch {
+		case strings.HasPrefix(re[i:], "[^/]*"):
+			glob.WriteByte('*')
+			i += 4
+		case strings.HasPrefix(re[i:], "[^/]"):
+			glob.WriteByte('?')
+			i += 3
+		case strings.HasPrefix(re[i:], "(?:.*/)?"):
+			glob.WriteString("**/")
+			i += 7
+		case re[i:] == "(?:/|$)":
+			// What globToRegexp appends to match a directory's content
+			ended = true
+			i = len(re)
+		case c == '\\':
+			if i+1 == len(re) || isAlnum(re[i+1]) {
+				return "", false, false
+			}
+			i++
+			if strings.IndexByte("*?[\\", re[i]) >= 0 {
+				glob.WriteByte('\\')
+			}
+			glob.WriteByte(re[i])
+		case c == '.' && i+1 < len(re) && re[i+1] == '*':
+			glob.WriteByte('*')
+			wild = true
+			i++
+		case c == '.':
+			glob.WriteByte('?')
+		case c == '[':
+			end := strings.IndexByte(re[i+1:], ']')
+			if end < 0 {
+				return "", false, false
+			}
+			class := re[i+1 : i+2+end]
+			if strings.HasPrefix(class, "^") {
+				class = "!" + class[1:]
+			}
+			glob.WriteString("[" + class)
+			i += 1 + end
+		case c == '$' && i == len(re)-1:
+			ended = true
+		case strings.IndexByte("^$*+?(){}|", c) >= 0:
+			return "", false, false
+		default:
+			glob.WriteByte(c)
+		}
+	}
+	out := glob.String()
+	if wild && strings.Contains(out, "/") {
+		// .* would match across directories, * does not
+		return "", false, false
+	}
+	if !rooted && !strings.HasPrefix(out, "*") && !strings.HasPrefix(out, "/") {
+		out = "*" + out
+	}
+	if !ended && !strings.HasSuffix(out, "*") && !strings.HasSuffix(out, "/") {
+		out += "*"
+	}
+	return out, rooted, out != "" && out != "*"
+}
+
+// isAlnum tells whether a byte is an ASCII letter or digit.
+func isAlnum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// globToRegexp renders a glob as a regular expression matching the
+// same paths.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+2+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class)
+			i += 1 + end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '#':
+			// Mercurial would take it for a comment
+			re.WriteString(`\#`)
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+// translateIgnoreFile translates the content of an ignore file from
+// one dialect to another, returning the new content and the patterns
+// that had to be dropped because they could not be translated.
+func translateIgnoreFile(from string, to string, content string) (string, []ignoreTranslation, error) {
+	source, known := ignoreDialects[from]
+	if !known {
+		return "", nil, fmt.Errorf("unknown ignore dialect %q", from)
+	}
+	target, known := ignoreDialects[to]
+	if !known {
+		return "", nil, fmt.Errorf("unknown ignore dialect %q", to)
+	}
+	var out strings.Builder
+	var dropped []ignoreTranslation
+	if target.header != "" && !strings.HasPrefix(content, target.header+"\n") {
+		out.WriteString(target.header + "\n")
+	}
+	useRegexp := source.regexpDefault
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "" {
+			continue
+		}
+		pattern := strings.TrimRight(line, "\r\n")
+		ending := line[len(pattern):]
+		body := strings.TrimSpace(pattern)
+		if source.syntax && strings.HasPrefix(body, "syntax:") {
+			switch strings.TrimSpace(body[len("syntax:"):]) {
+			case "glob", "relglob":
+				useRegexp = false
+			case "regexp", "re", "relre":
+				useRegexp = true
+			default:
+				dropped = append(dropped, ignoreTranslation{pattern: pattern, reason: "unknown syntax"})
+			}
+			if target.header != "" && body == target.header {
+				out.WriteString(line)
+			}
+			continue
+		}
+		translation := ignoreTranslation{pattern: pattern, translated: pattern, ok: true}
+		if from != "git" {
+			marked := pattern
+			if useRegexp && body != "" && !strings.HasPrefix(body, "#") && !hasAnyPrefix(body, source.globPrefixes) && !hasAnyPrefix(body, source.regexpPrefixes) {
+				marked = source.regexpPrefixes[0] + pattern
+			}
+			translation, _ = translateIgnore(from, marked)
+			translation.pattern = pattern
+		}
+		if translation.ok && to != "git" {
+			rendered, _ := renderIgnore(to, translation.translated)
+			translation.translated, translation.ok = rendered.translated, rendered.ok
+			if !rendered.ok {
+				translation.reason = rendered.reason
+			}
+		}
+		if !translation.ok {
+			dropped = append(dropped, translation)
+			continue
+		}
+		out.WriteString(translation.translated + ending)
+	}
+	return out.String(), dropped, nil
+}
+
+// hasAnyPrefix tells whether a string begins with any of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateIgnoreFiles translates the ignore files of one dialect in
+// the commits into another dialect, renaming them to match. Blobs
+// shared with files that are not ignore files are left alone. It
+// returns the number of files translated and a description of each
+// pattern dropped.
+func (repo *Repository) translateIgnoreFiles(commits []*Commit, from string, to string) (int, []string, error) {
+	source, target := ignoreDialects[from], ignoreDialects[to]
+	if source.filename == "" {
+		return 0, nil, fmt.Errorf("%s ignores are not kept in files", from)
+	}
+	if target.filename == "" {
+		return 0, nil, fmt.Errorf("%s ignores are not kept in files", to)
+	}
+	isIgnore := func(name string) bool {
+		return path.Base(name) == source.filename
+	}
+	var warnings []string
+	translate := func(what string, content []byte) ([]byte, error) {
+		translated, dropped, err := translateIgnoreFile(from, to, string(content))
+		for _, d := range dropped {
+			warnings = append(warnings, fmt.Sprintf("%s: dropped %q: %s", what, d.pattern, d.reason))
+		}
+		return []byte(translated), err
+	}
+	seen := make(map[*Blob]bool)
+	count := 0
+	for _, commit := range commits {
+		changed := false
+		for _, op := range commit.operations() {
+			if op.op == opM && isIgnore(op.Path) {
+				if op.ref == "inline" {
+					content, err := translate(fmt.Sprintf("%s inline %s", commit.idMe(), op.Path), op.inline)
+					if err != nil {
+						return count, warnings, err
+					}
+					op.inline = content
+					count++
+				} else if blob, ok := repo.markToEvent(op.ref).(*Blob); ok && !seen[blob] {
+					seen[blob] = true
+					shared := false
+					for other := range blob.opset {
+						if !isIgnore(other.Path) {
+							shared = true
+						}
+					}
+					if shared {
+						warnings = append(warnings, fmt.Sprintf("blob %s: shared with other files, not translated", blob.mark))
+						continue
+					}
+					content, err := translate("blob "+blob.mark, blob.getContent())
+					if err != nil {
+						return count, warnings, err
+					}
+					blob.setContent(content, noOffset)
+					blob.hash.invalidate()
+					count++
+				}
+			}
+			if source.filename == target.filename {
+				continue
+			}
+			for _, attr := range []string{"Path", "Source", "Target"} {
+				if oldpath, ok := getAttr(op, attr); ok && isIgnore(oldpath) {
+					setAttr(op, attr, path.Join(path.Dir(oldpath), target.filename))
+					changed = true
+				}
+			}
+		}
+		if changed {
+			commit.invalidateManifests()
+		}
+	}
+	return count, warnings, nil
+}
@@ -0,0 +1,234 @@
+// This module converts large files to Git LFS. LFS keeps each file's
+// content outside the repository, in an object store keyed by the
+// SHA-256 of the content, and commits a small pointer file in its
+// place; a .gitattributes entry routing the path through the lfs
+// filter tells git to swap the two on checkout and commit.
+//
+// Migration works on fileops rather than blobs, because a blob can be
+// shared between a path that is being migrated and one that is not.
+// A blob all of whose references are migrated is rewritten in place;
+// otherwise the migrated references are moved to a new pointer blob
+// and the rest are left alone.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lfsPointerVersion is the first line of every LFS pointer file.
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+// lfsAttributes are the attributes git lfs track gives a pattern.
+const lfsAttributes = "filter=lfs diff=lfs merge=lfs -text"
+
+// lfsPointer returns the text of the pointer file for content with
+// the given SHA-256 and length.
+func lfsPointer(oid string, size int64) []byte {
+	return []byte(fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, oid, size))
+}
+
+// isLfsPointer tells whether content is already an LFS pointer file.
+func isLfsPointer(content []byte) bool {
+	return len(content) < 1024 && bytes.HasPrefix(content, []byte(lfsPointerVersion+"\n"))
+}
+
+// lfsMatch tells whether a repository path matches a pattern as
+// .gitattributes would: a pattern without a slash matches the last
+// component of the path, one with a slash matches the whole path
+// relative to the top of the tree.
+func lfsMatch(pattern string, pathname string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(pathname))
+		return ok
+	}
+	ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), pathname)
+	return ok
+}
+
+// lfsStore writes content into an LFS object directory, laid out as
+// git lfs does in .git/lfs/objects, and returns its SHA-256 and length.
+// Content already in the store is not written again.
+func lfsStore(objects string, content io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(objects, userReadWriteSearchMode); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(objects, "incoming")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	oid := hex.EncodeToString(hasher.Sum(nil))
+	dir := filepath.Join(objects, oid[0:2], oid[2:4])
+	target := filepath.Join(dir, oid)
+	if _, err := os.Stat(target); err == nil {
+		return oid, size, nil
+	}
+	if err := os.MkdirAll(dir, userReadWriteSearchMode); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", 0, err
+	}
+	return oid, size, nil
+}
+
+// lfsMigrate replaces the content of the files modified in the commits
+// that match one of the patterns, or are at least minsize bytes long
+// if minsize is positive, with LFS pointers, storing the content under
+// objects. It returns the .gitattributes lines that route the migrated
+// paths through LFS, and the number of files migrated.
+func (repo *Repository) lfsMigrate(commits []*Commit, patterns []string, minsize int64, objects string) ([]string, int, error) {
+	chosen := func(op *FileOp, size int64) bool {
+		if op.op != opM || op.mode == gitlinkMode || op.mode == "120000" {
+			return false
+		}
+		for _, pattern := range patterns {
+			if lfsMatch(pattern, op.Path) {
+				return true
+			}
+		}
+		return minsize > 0 && size >= minsize
+	}
+	// Collect the references to migrate, blob by blob.
+	byBlob := make(map[*Blob][]*FileOp)
+	var blobs []*Blob
+	var inlines []*FileOp
+	owner := make(map[*FileOp]*Commit)
+	for _, commit := range commits {
+		for _, op := range commit.operations() {
+			if op.op != opM {
+				continue
+			}
+			if op.ref == "inline" {
+				if chosen(op, int64(len(op.inline))) && !isLfsPointer(op.inline) {
+					inlines = append(inlines, op)
+					owner[op] = commit
+				}
+			} else if blob, ok := repo.markToEvent(op.ref).(*Blob); ok && chosen(op, blob.size) {
+				if byBlob[blob] == nil {
+					blobs = append(blobs, blob)
+				}
+				byBlob[blob] = append(byBlob[blob], op)
+				owner[op] = commit
+			}
+		}
+	}
+	migrated := make(map[string]bool)
+	count := 0
+	control.baton.startProgress("migrating to LFS", uint64(len(blobs)+len(inlines)))
+	for i, blob := range blobs {
+		control.baton.percentProgress(uint64(i))
+		if blob.size < 1024 && isLfsPointer(blob.getContent()) {
+			continue
+		}
+		content := blob.getContentStream()
+		oid, size, err := lfsStore(objects, content)
+		content.Close()
+		if err != nil {
+			control.baton.endProgress()
+			return nil, count, err
+		}
+		ops := byBlob[blob]
+		if len(ops) == len(blob.opset) {
+			blob.setContent(lfsPointer(oid, size), noOffset)
+			blob.hash.invalidate()
+		} else {
+			pointer := newBlob(repo)
+			pointer.setContent(lfsPointer(oid, size), noOffset)
+			pointer.setMark(repo.newmark())
+			repo.insertEvent(pointer, repo.eventToIndex(blob)+1, "LFS pointer creation")
+			for _, op := range ops {
+				blob.removeOperation(op)
+				op.ref = pointer.mark
+				pointer.appendOperation(op)
+			}
+		}
+		for _, op := range ops {
+			migrated[op.Path] = true
+			owner[op].invalidateManifests()
+		}
+		count += len(ops)
+	}
+	for i, op := range inlines {
+		control.baton.percentProgress(uint64(len(blobs) + i))
+		oid, size, err := lfsStore(objects, bytes.NewReader(op.inline))
+		if err != nil {
+			control.baton.endProgress()
+			return nil, count, err
+		}
+		op.inline = lfsPointer(oid, size)
+		migrated[op.Path] = true
+		owner[op].invalidateManifests()
+		count++
+	}
+	control.baton.endProgress()
+	// Each pattern gets an entry, and so does each path migrated
+	// for its size alone.
+	var lines []string
+	for _, pattern := range patterns {
+		lines = append(lines, pattern+" "+lfsAttributes)
+	}
+	var bysize []string
+	for pathname := range migrated {
+		covered := false
+		for _, pattern := range patterns {
+			if lfsMatch(pattern, pathname) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			bysize = append(bysize, attributesPattern(pathname)+" "+lfsAttributes)
+		}
+	}
+	sort.Strings(bysize)
+	return append(lines, bysize...), count, nil
+}
+
+// parseByteSize parses a byte count with an optional k, m, or g
+// suffix multiplying it by a power of 1024.
+func parseByteSize(text string) (int64, error) {
+	multiplier := int64(1)
+	if text == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	switch strings.ToLower(text[len(text)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		text = text[:len(text)-1]
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size", text)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,149 @@
+// Estimate how the memory held by a loaded repository divides among
+// kinds of event data, to show what is worth pruning before a big job
+// and which representation changes would pay off.
+//
+// The figures are estimates built from structure sizes and the
+// lengths of the strings and slices hanging off them. Map overhead is
+// approximated per entry, and strings that happen to share storage,
+// such as branch names, are counted each time they appear. Blob
+// content is normally on disk or in the input stream rather than in
+// core, so only inline fileop content counts towards it. Manifest
+// snapshots share unchanged directories, so each directory node is
+// counted once however many manifests hold it.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"fmt"
+	"io"
+	"unsafe" // Only used for Sizeof
+)
+
+// mapEntryOverhead approximates the bookkeeping a Go map spends on
+// each entry beyond its key and value.
+const mapEntryOverhead = 16
+
+// memoryClass accumulates the estimate for one kind of event data.
+type memoryClass struct {
+	name  string
+	count int
+	bytes uintptr
+}
+
+// memoryEstimate returns estimated memory use of the repository's
+// events by class, in a fixed order.
+func (repo *Repository) memoryEstimate() []memoryClass {
+	var (
+		stringSize    = unsafe.Sizeof("")
+		pointerSize   = unsafe.Sizeof(uintptr(0))
+		interfaceSize = 2 * pointerSize
+	)
+	blobs := memoryClass{name: "blobs"}
+	inline := memoryClass{name: "inline content"}
+	commits := memoryClass{name: "commits"}
+	comments := memoryClass{name: "comment text"}
+	attributions := memoryClass{name: "attributions"}
+	fileops := memoryClass{name: "fileops"}
+	manifests := memoryClass{name: "manifests"}
+	graph := memoryClass{name: "parent/child graph"}
+	properties := memoryClass{name: "properties"}
+	others := memoryClass{name: "tags, resets, etc."}
+
+	attribution := func(attr *Attribution) uintptr {
+		return unsafe.Sizeof(*attr) + uintptr(len(attr.fullname)+len(attr.email))
+	}
+	seen := make(map[*PathMap]bool)
+	var pathmap func(pm *PathMap)
+	pathmap = func(pm *PathMap) {
+		if seen[pm] {
+			return
+		}
+		seen[pm] = true
+		manifests.bytes += unsafe.Sizeof(*pm)
+		for name, sub := range pm.dirs {
+			manifests.bytes += stringSize + uintptr(len(name)) + pointerSize + mapEntryOverhead
+			pathmap(sub)
+		}
+		for name := range pm.blobs {
+			manifests.bytes += stringSize + uintptr(len(name)) + interfaceSize + mapEntryOverhead
+		}
+	}
+
+	for _, event := range repo.events {
+		switch e := event.(type) {
+		case *Blob:
+			blobs.count++
+			blobs.bytes += unsafe.Sizeof(*e) + uintptr(len(e.mark)+len(e.abspath))
+			blobs.bytes += uintptr(len(e.opset)) * (pointerSize + 1 + mapEntryOverhead)
+		case *Commit:
+			commits.count++
+			commits.bytes += unsafe.Sizeof(*e) + uintptr(len(e.mark)+len(e.legacyID)+len(e.Branch))
+			comments.count++
+			comments.bytes += uintptr(len(e.Comment))
+			attributions.count += 1 + len(e.authors)
+			// The committer is held in the commit structure itself
+			attributions.bytes += uintptr(len(e.committer.fullname) + len(e.committer.email))
+			for i := range e.authors {
+				attributions.bytes += attribution(&e.authors[i])
+			}
+			for _, op := range e.fileops {
+				fileops.count++
+				fileops.bytes += pointerSize + unsafe.Sizeof(*op)
+				fileops.bytes += uintptr(len(op.committish) + len(op.Source) + len(op.mode) + len(op.Path) + len(op.ref))
+				if len(op.inline) > 0 {
+					inline.count++
+					inline.bytes += uintptr(len(op.inline))
+				}
+			}
+			if e._manifest != nil {
+				manifests.count++
+				pathmap(&e._manifest.PathMap)
+			}
+			graph.count += len(e._parentNodes) + len(e._childNodes)
+			graph.bytes += uintptr(cap(e._parentNodes)+cap(e._childNodes)+cap(e.attachments)) * interfaceSize
+			if e.properties != nil {
+				properties.count += len(e.properties.keys)
+				properties.bytes += unsafe.Sizeof(*e.properties)
+				for key, value := range e.properties.dict {
+					properties.bytes += 2*(stringSize+uintptr(len(key))) + stringSize + uintptr(len(value)) + mapEntryOverhead
+				}
+			}
+		case *Tag:
+			others.count++
+			others.bytes += unsafe.Sizeof(*e) + uintptr(len(e.name)+len(e.committish)+len(e.legacyID))
+			comments.count++
+			comments.bytes += uintptr(len(e.Comment))
+			if e.tagger != nil {
+				attributions.count++
+				attributions.bytes += attribution(e.tagger)
+			}
+		case *Reset:
+			others.count++
+			others.bytes += unsafe.Sizeof(*e) + uintptr(len(e.ref)+len(e.committish)+len(e.color)+len(e.legacyID))
+		case *Passthrough:
+			others.count++
+			others.bytes += unsafe.Sizeof(*e) + uintptr(len(e.text)+len(e.color))
+		case *Callout:
+			others.count++
+			others.bytes += unsafe.Sizeof(*e) + uintptr(len(e.mark)+len(e.branch))
+		}
+	}
+	// The event list itself
+	graph.bytes += uintptr(cap(repo.events)) * interfaceSize
+	return []memoryClass{blobs, inline, commits, comments, attributions,
+		fileops, manifests, graph, properties, others}
+}
+
+// memoryReport writes the estimate as a table with a total.
+func (repo *Repository) memoryReport(w io.Writer) {
+	var total uintptr
+	fmt.Fprintf(w, "%-20s %10s %14s\n", "class", "count", "bytes")
+	for _, class := range repo.memoryEstimate() {
+		fmt.Fprintf(w, "%-20s %10d %14d\n", class.name, class.count, class.bytes)
+		total += class.bytes
+	}
+	fmt.Fprintf(w, "%-20s %10s %14d (%s)\n", "total", "", total, formatMemory(uint64(total)))
+}
@@ -0,0 +1,220 @@
+// This module gives git notes a first-class representation. A note is
+// kept as an N fileop in a commit on a notes ref such as
+// refs/notes/commits, and the path of the fileop is the mark of the
+// commit the note annotates. The note therefore follows its commit
+// through renumbering and through any surgery that changes the
+// commit's hash, and a rebuild writes it against the new hash.
+//
+// Exporters do not write notes that way. git fast-export shows a notes
+// ref as an ordinary branch whose files are named by the hashes of the
+// annotated commits, perhaps split into fanout directories, and the
+// native reader sees the same tree. After a read, liftNotes turns
+// those M and D fileops into N fileops wherever the hash is the
+// original ID of an earlier commit; the rest are left alone. A note
+// is removed by an N fileop whose data is the null object name, which
+// is how fast-import spells it.
+//
+// When a commit is deleted, its notes move with its tags when the
+// commit they move to precedes the notes commit and has no note of
+// its own there; otherwise they are dropped.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// nullNoteRef is the data of an N fileop that removes a note.
+const nullNoteRef = "0000000000000000000000000000000000000000"
+
+// defaultNotesRef is where git notes keeps notes unless told otherwise.
+const defaultNotesRef = "refs/notes/commits"
+
+// isNotesRef tells whether a branch holds notes.
+func isNotesRef(branch string) bool {
+	return strings.HasPrefix(branch, "refs/notes/")
+}
+
+// liftNotes turns the fileops naming notes by commit hash on the notes
+// refs into N fileops naming them by mark, and returns their count.
+func (repo *Repository) liftNotes() int {
+	byOID := make(map[gitHashType]*Commit)
+	lifted := 0
+	for _, commit := range repo.commits(nil) {
+		if !isNotesRef(commit.Branch) {
+			if commit.oid.isValid() {
+				byOID[commit.oid] = commit
+			}
+			continue
+		}
+		for _, op := range commit.operations() {
+			if op.op != opM && op.op != opD {
+				continue
+			}
+			h, err := parseHash(strings.Replace(op.Path, "/", "", -1))
+			if err != nil {
+				continue
+			}
+			// A note can only be attached to a commit already seen
+			target, ok := byOID[h]
+			if !ok {
+				continue
+			}
+			if op.op == opD {
+				op.ref = nullNoteRef
+			}
+			op.op = opN
+			op.mode = ""
+			op.Path = target.mark
+			repo.inlines++
+			lifted++
+			commit.hash.invalidate()
+		}
+	}
+	return lifted
+}
+
+// noteContent returns the text of a note.
+func (repo *Repository) noteContent(op *FileOp) []byte {
+	if op.ref == "inline" {
+		return op.inline
+	}
+	if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+		return blob.getContent()
+	}
+	return nil
+}
+
+// noteState replays the notes commits in event order and returns, for
+// each notes ref, the N fileops holding the notes in force at its
+// tip, keyed by the marks of the commits they annotate.
+func (repo *Repository) noteState() map[string]map[string]*FileOp {
+	state := make(map[string]map[string]*FileOp)
+	for _, commit := range repo.commits(nil) {
+		if !isNotesRef(commit.Branch) {
+			continue
+		}
+		notes := state[commit.Branch]
+		if notes == nil {
+			notes = make(map[string]*FileOp)
+			state[commit.Branch] = notes
+		}
+		for _, op := range commit.operations() {
+			switch {
+			case op.op == deleteall:
+				for mark := range notes {
+					delete(notes, mark)
+				}
+			case op.op != opN:
+			case op.ref == nullNoteRef:
+				delete(notes, op.Path)
+			default:
+				notes[op.Path] = op
+			}
+		}
+	}
+	return state
+}
+
+// notesRefs returns the refs of a note state in sorted order.
+func notesRefs(state map[string]map[string]*FileOp) []string {
+	refs := make([]string, 0, len(state))
+	for ref := range state {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// annotate appends a commit to a notes ref that sets the notes on the
+// given commits to text, or removes them, and returns it.
+func (repo *Repository) annotate(ref string, targets []*Commit, text []byte, remove bool) *Commit {
+	commit := newCommit(repo)
+	attr, _ := newAttribution("")
+	commit.committer = *attr
+	commit.committer.fullname, commit.committer.email = whoami()
+	commit.committer.date, _ = newDate("")
+	if control.flagOptions["testmode"] {
+		commit.committer.date.timestamp = time.Unix(0, 0)
+		commit.committer.date.setTZ("UTC")
+	}
+	if remove {
+		commit.Comment = "Notes removed by 'reposurgeon note --remove'\n"
+	} else {
+		commit.Comment = "Notes added by 'reposurgeon note'\n"
+	}
+	commit.setBranch(ref)
+	if tip, ok := repo.markToEvent(repo.branchmap()[ref]).(*Commit); ok {
+		commit.setParents([]CommitLike{tip})
+	}
+	for _, target := range targets {
+		if remove {
+			commit.setNote(nullNoteRef, target.mark, nil)
+		} else {
+			commit.setNote("inline", target.mark, text)
+		}
+	}
+	commit.setMark(repo.newmark())
+	repo.addEvent(commit)
+	return commit
+}
+
+// retargetNotes moves the notes on deleted commits according to a map
+// from their marks to the marks of the commits that replace them, or
+// to "" for none, and returns the number of notes dropped.
+func (repo *Repository) retargetNotes(moved map[string]string) int {
+	if repo.inlines == 0 || len(moved) == 0 {
+		return 0
+	}
+	// The replacement may itself have been deleted
+	resolve := func(mark string) string {
+		for i := 0; i <= len(moved); i++ {
+			next, ok := moved[mark]
+			if !ok {
+				return mark
+			}
+			mark = next
+		}
+		return ""
+	}
+	dropped := 0
+	for _, commit := range repo.commits(nil) {
+		var kept []*FileOp
+		changed := false
+		for _, op := range commit.operations() {
+			if _, gone := moved[op.Path]; op.op != opN || !gone {
+				kept = append(kept, op)
+				continue
+			}
+			changed = true
+			target := resolve(op.Path)
+			if target != "" && repo.markToIndex(target) < commit.index() {
+				clash := false
+				for _, other := range commit.operations() {
+					clash = clash || (other.op == opN && other.Path == target)
+				}
+				if !clash {
+					op.Path = target
+					kept = append(kept, op)
+					continue
+				}
+			}
+			if logEnable(logWARN) {
+				logit("note in %s on deleted commit %s dropped", commit.idMe(), op.Path)
+			}
+			op.forget()
+			repo.inlines--
+			dropped++
+		}
+		if changed {
+			commit.fileops = kept
+			commit.hash.invalidate()
+		}
+	}
+	return dropped
+}
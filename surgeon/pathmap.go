@@ -208,6 +208,29 @@ func (pm *PathMap) get(path string) (interface{}, bool) {
 	return element, ok
 }
 
+// has reports whether the path names either a value or a directory
+// in the map.
+func (pm *PathMap) has(path string) bool {
+	if _, ok := pm.get(path); ok {
+		return true
+	}
+	return pm.subtree(path) != nil
+}
+
+// subtree returns the PathMap for the named directory, or nil if there
+// is no such directory. The result shares storage with pm and must
+// not be modified.
+func (pm *PathMap) subtree(path string) *PathMap {
+	parent := pm
+	for _, component := range strings.Split(path, svnSep) {
+		var ok bool
+		if parent, ok = parent.dirs[component]; !ok {
+			return nil
+		}
+	}
+	return parent
+}
+
 // set adds a filename to the map, with associated value.
 func (pm *PathMap) set(path string, value interface{}) {
 	parts := strings.Split(path, svnSep)
@@ -82,7 +82,10 @@ import (
 	"container/heap"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
@@ -92,6 +95,7 @@ import (
 	"math"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -110,12 +114,15 @@ import (
 	"sync"
 	"time"
 	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
 	"unsafe" // Actually safe - only uses Sizeof
 
 	shlex "github.com/anmitsu/go-shlex"
 	orderedset "github.com/emirpasic/gods/sets/linkedhashset"
 	difflib "github.com/ianbruene/go-difflib/difflib"
+	shellquote "github.com/kballard/go-shellquote"
+	zstd "github.com/klauspost/compress/zstd"
 	shutil "github.com/termie/go-shutil"
 	fqme "gitlab.com/esr/fqme"
 	kommandant "gitlab.com/ianbruene/kommandant"
@@ -329,13 +336,14 @@ func stringEscape(s string) (string, error) {
 
 // splitRuneFirst splits the string on the rune and returns the first
 // substring, but without allocating a slice of all the substrings,
-// and without iterating over the string twice
+// and without iterating over the string twice.  The separator is
+// not part of either substring.
 func splitRuneFirst(s string, sep rune) (first string, rest string) {
 	idx := strings.IndexRune(s, sep)
 	if idx == -1 {
 		return s, ""
 	}
-	return s[:idx], s[idx:]
+	return s[:idx], s[idx+utf8.RuneLen(sep):]
 }
 
 // A copy of the orderedStringSet code with the names changed to protect the innocent.
@@ -636,6 +644,18 @@ func init() {
 		engine:  newHgExtractor(),
 		basevcs: findVCS("hg"),
 	})
+	importers = append(importers, Importer{
+		name:    "bzr-extractor",
+		visible: true,
+		engine:  newBzrExtractor(),
+		basevcs: findVCS("bzr"),
+	})
+	importers = append(importers, Importer{
+		name:    "mtn-extractor",
+		visible: true,
+		engine:  newMtnExtractor(),
+		basevcs: findVCS("mtn"),
+	})
 }
 
 // No user-serviceable parts below this line
@@ -668,6 +688,7 @@ const (
 	logCOMMANDS                  // Show commands as they are executed
 	logUNITE                     // Log mark assignments in merging
 	logLEXER                     // Log selection-language parsing
+	logSTAMPS                    // Log action-stamp collisions at read time
 )
 
 var logtags = map[string]uint{
@@ -687,6 +708,7 @@ var logtags = map[string]uint{
 	"commands": logCOMMANDS,
 	"unite":    logUNITE,
 	"lexer":    logLEXER,
+	"stamps":   logSTAMPS,
 }
 
 var optionFlags = [...][2]string{
@@ -710,7 +732,17 @@ in repository read and write time in order to reduce the amount of
 disk space required while editing; this may be useful for large
 repositories. No effect if the edit input was a dump stream; in that
 case, reposurgeon doesn't make on-disk blob copies at all (it points
-into sections of the input stream instead).
+into sections of the input stream instead). The compression codec is
+gzip unless chosen with "set blobcodec". A repository takes the value in
+force when it is read; "set --repo" and "clear --repo" change it for the
+chosen repository, re-encoding its blobs.
+`},
+	{"blobstore",
+		`Keep on-disk copies of blobs in a store shared by all repositories in
+the session, so that identical content is stored once and hard-linked
+into each repository that has it, including both parts of a divided
+repository. The value in force when a repository is read applies to
+it for the rest of the session.
 `},
 	{"echo",
 		`Echo commands before executing them. Setting this in test scripts may 
@@ -738,6 +770,14 @@ screen width, and the ID of the invoking user. Use in regression-test loads.
 `},
 	{"quiet",
 		`Suppress time-varying parts of reports.
+`},
+	{"deterministic",
+		`Make two runs over the same input produce byte-identical streams and
+logs, for verification. Setting or clearing this also sets or clears
+testmode, quiet, and serial. Marks are renumbered in event order in
+each written stream, without changing them in the loaded repository;
+reports list map contents in sorted order, and wall-clock times are
+left out of log and progress messages.
 `},
 }
 
@@ -762,12 +802,36 @@ type Control struct {
 	profileNames   map[string]string
 	startTime      time.Time
 	lineSep        string
+	logcapture     *[]string
+	memoryBudget   uint64 // in bytes, 0 for no budget
+	blobCodec      *blobCodec
+	contentFilters []*contentFilter
 }
 
 func (ctx *Control) isInteractive() bool {
 	return ctx.flagOptions["interactive"]
 }
 
+// checkMemory throws an exception of the given class if the process
+// has outgrown the memory budget set with "set membudget", so that a
+// long conversion fails with a clear message rather than being ended
+// by the OOM killer.
+func (ctx *Control) checkMemory(class string, legend string) {
+	if ctx.memoryBudget == 0 {
+		return
+	}
+	used := residentSetSize()
+	if used == 0 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		used = stats.Sys
+	}
+	if used > ctx.memoryBudget {
+		panic(throw(class, "memory budget of %s exceeded (%s in use) during %s",
+			formatMemory(ctx.memoryBudget), formatMemory(used), legend))
+	}
+}
+
 type branchMapping struct {
 	match   *regexp.Regexp
 	replace string
@@ -779,6 +843,7 @@ func (b branchMapping) String() string {
 
 func (ctx *Control) init() {
 	ctx.flagOptions = make(map[string]bool)
+	ctx.blobCodec = blobCodecs[0]
 	ctx.listOptions = make(map[string]orderedStringSet)
 	ctx.mapOptions = make(map[string]map[string]string)
 	ctx.signals = make(chan os.Signal, 1)
@@ -872,6 +937,7 @@ func nuke(directory string, legend string) {
 func croak(msg string, args ...interface{}) {
 	content := fmt.Sprintf(msg, args...)
 	control.baton.printLogString("reposurgeon: " + content + control.lineSep)
+	control.capture(content)
 	if !control.flagOptions["relax"] {
 		control.setAbort(true)
 	}
@@ -880,7 +946,7 @@ func croak(msg string, args ...interface{}) {
 func logit(msg string, args ...interface{}) {
 	var leader string
 	content := fmt.Sprintf(msg, args...)
-	if _, ok := control.logfp.(*os.File); ok {
+	if _, ok := control.logfp.(*os.File); ok && !control.flagOptions["deterministic"] {
 		leader = rfc3339(time.Now())
 	} else {
 		leader = "reposurgeon"
@@ -889,6 +955,35 @@ func logit(msg string, args ...interface{}) {
 	control.logfp.Write([]byte(leader + ": " + content + control.lineSep))
 	control.logcounter++
 	control.logmutex.Unlock()
+	control.capture(content)
+}
+
+// startCapture begins saving logged messages and croaks, so that gripes
+// made during a read can be reported later.
+func (ctx *Control) startCapture() {
+	ctx.logmutex.Lock()
+	ctx.logcapture = new([]string)
+	ctx.logmutex.Unlock()
+}
+
+// endCapture stops saving messages and returns those saved.
+func (ctx *Control) endCapture() []string {
+	ctx.logmutex.Lock()
+	defer ctx.logmutex.Unlock()
+	if ctx.logcapture == nil {
+		return nil
+	}
+	saved := *ctx.logcapture
+	ctx.logcapture = nil
+	return saved
+}
+
+func (ctx *Control) capture(content string) {
+	ctx.logmutex.Lock()
+	if ctx.logcapture != nil {
+		*ctx.logcapture = append(*ctx.logcapture, content)
+	}
+	ctx.logmutex.Unlock()
 }
 
 // respond is to be used for console messages that shouldn't be logged
@@ -1233,6 +1328,15 @@ func zoneFromEmail(addr string) string {
 	return isocodeToZone[toplevel]
 }
 
+// wallclock returns the current time for a log message, or the epoch
+// in deterministic mode so that logs of two runs can be compared.
+func wallclock() string {
+	if control.flagOptions["deterministic"] {
+		return rfc3339(time.Unix(0, 0))
+	}
+	return rfc3339(time.Now())
+}
+
 // rfc3339 makes a UTC RFC3339 string from a system timestamp.
 // Go's format rules document that this will end with Z, not an 00:00 timezone.
 func rfc3339(t time.Time) string {
@@ -1271,13 +1375,78 @@ type Date struct {
 
 // GitLogFormat - which git falsely claims is RFC2822-conformant.
 // In reality RFC2822 would be "Mon, 02 Aug 2006 15:04:05 -0700",
-// which is Go's RFC1123Z format. (We're ignoring obsolete variants
-// with letter zones and two-digit years.)
-const GitLogFormat = "Mon Jan 02 15:04:05 2006 -0700"
+// which is Go's RFC1123Z format.  Note that git does not pad the day.
+const GitLogFormat = "Mon Jan 2 15:04:05 2006 -0700"
 
 // RFC1123ZNoComma is the swapped format
 const RFC1123ZNoComma = "Mon 02 Jan 2006 15:04:05 -0700"
 
+// dateLayouts are tried by newDate in order.
+var dateLayouts = []string{
+	time.RFC3339,     // because it's the presentation format I prefer
+	time.RFC3339Nano, // so we parse Subversion dates with fractional seconds
+	time.RFC1123Z,    // we use it in message-block headers
+	GitLogFormat,     // git log emits this format
+	RFC1123ZNoComma,
+	"2006-01-02 15:04:05 -0700",      // git log --date=iso
+	"20060102T150405Z0700",           // ISO 8601 basic format
+	"20060102T150405",                // ISO 8601 basic format, UTC
+	"2006/01/02 15:04:05 -0700",      // cvs log, with a zone
+	"2006/01/02 15:04:05",            // cvs log, UTC
+	"2006.01.02.15.04.05",            // RCS, since 2000
+	"Mon, 2 Jan 2006 15:04:05 -0700", // RFC2822, unpadded day
+	"2 Jan 2006 15:04:05 -0700",      // RFC2822 without day of week
+	"Mon, 2 Jan 2006 15:04 -0700",    // RFC2822 without seconds
+	"2 Jan 2006 15:04 -0700",         // RFC2822 without either
+	"Mon Jan 2 15:04:05 -0700 2006",  // date(1), zone name replaced
+}
+
+// legacyDateLayouts are layouts with two-digit years.  As RFC2822
+// says, years before 50 are taken to be in the 21st century, and the
+// rest in the 20th.
+var legacyDateLayouts = []string{
+	"06.01.02.15.04.05",            // RCS, before 2000
+	"Mon, 2 Jan 06 15:04:05 -0700", // RFC822
+	"2 Jan 06 15:04:05 -0700",
+	"Mon, 2 Jan 06 15:04 -0700",
+	"2 Jan 06 15:04 -0700",
+}
+
+// rfc2822Comment matches a comment in an RFC2822 date, such as "(PDT)".
+var rfc2822Comment = regexp.MustCompile(`\([^()]*\)`)
+
+// obsoleteZones are the zone names RFC2822 still allows readers to
+// accept.  Military single-letter zones, which were notoriously
+// misused, are read as "-0000", unknown.
+var obsoleteZones = map[string]string{
+	"UT": "+0000", "UTC": "+0000", "GMT": "+0000", "Z": "+0000",
+	"EST": "-0500", "EDT": "-0400",
+	"CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600",
+	"PST": "-0800", "PDT": "-0700",
+}
+
+// cleanDate rewrites an RFC2822 date into a form the layouts match:
+// comments are dropped, whitespace is collapsed, and obsolete zone
+// names are replaced by their offsets wherever they appear, as date(1)
+// puts the zone before the year.  Other zone names are left alone, so
+// no layout matches them and the date is rejected rather than misread.
+func cleanDate(text string) string {
+	fields := strings.Fields(rfc2822Comment.ReplaceAllString(text, " "))
+	for i, field := range fields {
+		if offset, ok := obsoleteZones[strings.ToUpper(field)]; ok {
+			fields[i] = offset
+		}
+	}
+	if len(fields) > 0 {
+		last := strings.ToUpper(fields[len(fields)-1])
+		if len(last) == 1 && last[0] >= 'A' && last[0] <= 'Z' {
+			fields[len(fields)-1] = "-0000"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
 // newDate exists mainly to wrap a parser to recognize date formats that
 // exporters or email programs might emit
 func newDate(text string) (Date, error) {
@@ -1306,17 +1475,26 @@ func newDate(text string) (Date, error) {
 		return t, nil
 
 	}
-	// RFC3339 - because it's the presentation format I prefer
-	// RFC3339Nano - so we parse Subversion dates with fractional seconds
-	// RFC1123Z - we use it in message-block headers
-	// GitLog - git log emits this format
-	for _, layout := range []string{time.RFC3339, time.RFC3339Nano, time.RFC1123Z, GitLogFormat, RFC1123ZNoComma} {
-		trial, err3 := time.Parse(layout, string(text))
-		if err3 == nil {
-			// Could be Round() rather than Truncate() - it's this way
-			// for compatibility with the ancestral Python.
-			t.timestamp = trial.Truncate(1 * time.Second)
-			return t, nil
+	for _, candidate := range []string{text, cleanDate(text)} {
+		for _, layout := range dateLayouts {
+			trial, err3 := time.Parse(layout, candidate)
+			if err3 == nil {
+				// Could be Round() rather than Truncate() - it's this way
+				// for compatibility with the ancestral Python.
+				t.timestamp = trial.Truncate(1 * time.Second)
+				return t, nil
+			}
+		}
+		for _, layout := range legacyDateLayouts {
+			trial, err3 := time.Parse(layout, candidate)
+			if err3 == nil {
+				// Go puts years 69-99 in the 20th century.
+				if trial.Year() >= 2050 {
+					trial = trial.AddDate(-100, 0, 0)
+				}
+				t.timestamp = trial
+				return t, nil
+			}
 		}
 	}
 	return t, errors.New("not a valid timestamp: " + string(text))
@@ -1359,6 +1537,9 @@ func (date Date) String() string {
 
 func (date *Date) setTZ(zone string) {
 	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		loc, err = locationFromZoneOffset(zone)
+	}
 	if err == nil {
 		date.timestamp = date.timestamp.In(loc)
 	}
@@ -1478,20 +1659,61 @@ func (attr *Attribution) who() string {
 
 // Remap changes the attribution fullname/email according to a map of author entries.
 func (attr *Attribution) remap(authors map[string]Contributor) {
-	matches := func(attr *Attribution, local string, ae Contributor) bool {
-		nlower := strings.ToLower(attr.fullname)
-		elower := strings.ToLower(attr.email)
-		return strings.HasPrefix(elower, local+"@") || elower == local || (attr.email == "" && nlower == local)
+	if ae, ok := attr.mapEntry(authors); ok {
+		attr.fullname = ae.fullname
+		attr.email = ae.email
+		if ae.timezone != "" {
+			attr.date.setTZ(ae.timezone)
+		}
 	}
+}
 
+// mapEntry returns the author-map entry that matches the attribution,
+// if there is one.
+func (attr *Attribution) mapEntry(authors map[string]Contributor) (Contributor, bool) {
+	nlower := strings.ToLower(attr.fullname)
+	elower := strings.ToLower(attr.email)
 	for local, ae := range authors {
-		if matches(attr, local, ae) {
-			attr.fullname = ae.fullname
-			attr.email = ae.email
-			if ae.timezone != "" {
-				attr.date.setTZ(ae.timezone)
-			}
+		if strings.HasPrefix(elower, local+"@") || elower == local || (attr.email == "" && nlower == local) {
+			return ae, true
+		}
+	}
+	return Contributor{}, false
+}
+
+// mailmapEntry is one line of a git .mailmap: a proper name, email, or
+// both, for attributions with the commit email and, if it is given, the
+// commit name.
+type mailmapEntry struct {
+	properName  string
+	properEmail string
+	commitName  string
+	commitEmail string
+}
+
+// unmailmap rewrites an attribution by the first of the mailmap entries
+// that matches it, those naming a commit name taking precedence, as
+// git does.  Emails are compared without regard to case.
+func (attr *Attribution) unmailmap(entries []mailmapEntry) {
+	var found *mailmapEntry
+	for i := range entries {
+		entry := &entries[i]
+		if !strings.EqualFold(attr.email, entry.commitEmail) {
+			continue
+		}
+		if entry.commitName == attr.fullname {
+			found = entry
 			break
+		} else if entry.commitName == "" && found == nil {
+			found = entry
+		}
+	}
+	if found != nil {
+		if found.properName != "" {
+			attr.fullname = found.properName
+		}
+		if found.properEmail != "" {
+			attr.email = found.properEmail
 		}
 	}
 }
@@ -1523,25 +1745,71 @@ func (attr *Attribution) remap(authors map[string]Contributor) {
  * the places where a commit is modified, and if we ever see buggy
  * behavior around hashes it would be wise to suspect that there is
  * a missing invalidation call somewhere.
+ *
+ * Git repositories come in two object formats, SHA-1 and SHA-256.
+ * A hash carries its own length, and a repository records the
+ * format it was read in so that the hashes computed for it, and
+ * the repository it is rebuilt as, match. Streams without that
+ * knowledge are taken to be SHA-1.
+ *
+ * The original-oid value itself is also kept apart from the hash
+ * slot, as the object's provenance. Surgery does not invalidate it,
+ * and it is what gets written back out as original-oid, so a later
+ * tool can map the objects it imports back to where they came from.
  */
-type gitHashType [sha1.Size]byte
+type gitHashType struct {
+	sum  [sha256.Size]byte
+	size uint8
+}
 
 var nullGitHash gitHashType // Do not modify this!
 
+// gitObjectFormats maps the object formats git knows to the length of
+// their object names in bytes.
+var gitObjectFormats = map[string]int{"sha1": sha1.Size, "sha256": sha256.Size}
+
 func newGitHash(b []byte) gitHashType {
 	var h gitHashType
-	if b != nil {
-		fmt.Sscan(string(b), "%x", &h)
+	if len(b) > 2*sha256.Size {
+		b = b[:2*sha256.Size]
 	}
+	n, _ := hex.Decode(h.sum[:], b)
+	h.size = uint8(n)
+	return h
+}
+
+// gitHashBytes makes a hash from an object name in binary.
+func gitHashBytes(b []byte) gitHashType {
+	var h gitHashType
+	h.size = uint8(copy(h.sum[:], b))
 	return h
 }
 
 func gitHashString(data string) gitHashType {
-	return sha1.Sum([]byte(data))
+	return gitHashFormat("sha1", data)
+}
+
+// gitHashFormat hashes data as a repository of the given object
+// format would.
+func gitHashFormat(format string, data string) gitHashType {
+	if format == "sha256" {
+		sum := sha256.Sum256([]byte(data))
+		return gitHashBytes(sum[:])
+	}
+	sum := sha1.Sum([]byte(data))
+	return gitHashBytes(sum[:])
+}
+
+// bytes returns the object name in binary.
+func (h gitHashType) bytes() []byte {
+	return h.sum[:h.size]
 }
 
 func (h gitHashType) hexify() string {
-	return fmt.Sprintf("%040x", h)
+	if h.size == 0 {
+		return strings.Repeat("0", 2*sha1.Size)
+	}
+	return hex.EncodeToString(h.bytes())
 }
 
 func (h gitHashType) isValid() bool {
@@ -1598,6 +1866,63 @@ func intToMarkidx(markint int) markidx {
 	return markidx(markint & int(^markidx(0)))
 }
 
+// blobCodec compresses the on-disk copies of blobs when compressblobs
+// is set.  The codecs are pluggable so that a fast one can be chosen
+// for big repositories, where blob materialization time dominates.
+type blobCodec struct {
+	name   string
+	writer func(io.Writer) (io.WriteCloser, error)
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+var blobCodecs = []*blobCodec{
+	{
+		name: "gzip",
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		// Concurrency is wasted on a stream per blob, and costs
+		// goroutines that would have to be set up for each one.
+		name: "zstd",
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			input, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return input.IOReadCloser(), nil
+		},
+	},
+}
+
+// findBlobCodec returns the codec with the given name, or nil.
+func findBlobCodec(name string) *blobCodec {
+	for _, codec := range blobCodecs {
+		if codec.name == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+// codecReader closes both a decompressor and the file under it.
+type codecReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (cr codecReader) Close() error {
+	cr.ReadCloser.Close()
+	return cr.file.Close()
+}
+
 // Blob represents a detached blob of data referenced by a mark.
 type Blob struct {
 	mark      string
@@ -1610,7 +1935,10 @@ type Blob struct {
 	size      int64 // length start if this blob refers into a dump
 	blobseq   blobidx
 	hash      gitHashType
-	colors    colorSet // Scratch space for graph-coloring algorithms
+	oid       gitHashType // Object ID in the repository it was read from
+	colors    colorSet    // Scratch space for graph-coloring algorithms
+	store     *blobStore  // Shared store the blob file is linked into
+	storeKey  string
 }
 
 const noOffset = -1
@@ -1719,16 +2047,22 @@ func (b *Blob) getContent() []byte {
 		}
 		return data
 	}
+	return b.readBlobfile(b.repo.codec)
+}
+
+// readBlobfile gets the content of the blob's file, decoding it with
+// the given codec, which need not be the one of the blob's repository.
+func (b *Blob) readBlobfile(codec *blobCodec) []byte {
 	var data []byte
 	file, err := os.Open(b.getBlobfile(false))
 	if err != nil {
 		panic(fmt.Errorf("Blob read: %v", err))
 	}
 	defer file.Close()
-	if control.flagOptions["compressblobs"] {
-		input, err2 := gzip.NewReader(file)
+	if codec != nil {
+		input, err2 := codec.reader(file)
 		if err2 != nil {
-			panic(err.Error())
+			panic(fmt.Errorf("Blob read: %v", err2))
 		}
 		defer input.Close()
 		data, err = ioutil.ReadAll(input)
@@ -1741,6 +2075,21 @@ func (b *Blob) getContent() []byte {
 	return data
 }
 
+// recode rewrites the blob's file, last written through the given
+// codec, through the codec of its repository.
+func (b *Blob) recode(codec *blobCodec) {
+	if !b.hasfile() || codec == b.repo.codec {
+		return
+	}
+	content := b.readBlobfile(codec)
+	// The file may be hard-linked into another repository that
+	// keeps the old encoding.
+	if b.store == nil {
+		os.Remove(b.getBlobfile(false))
+	}
+	b.setContent(content, noOffset)
+}
+
 type sectionReader struct {
 	*io.SectionReader
 }
@@ -1761,12 +2110,12 @@ func (b *Blob) getContentStream() io.ReadCloser {
 	if err != nil {
 		panic(fmt.Errorf("Blob read: %v", err))
 	}
-	if control.flagOptions["compressblobs"] {
-		input, err2 := gzip.NewReader(file)
+	if codec := b.repo.codec; codec != nil {
+		input, err2 := codec.reader(file)
 		if err2 != nil {
-			panic(err.Error())
+			panic(fmt.Errorf("Blob read: %v", err2))
 		}
-		return input
+		return codecReader{input, file}
 	}
 	return file
 }
@@ -1778,16 +2127,21 @@ func (b *Blob) getContentStream() io.ReadCloser {
 func (b *Blob) setContent(text []byte, tell int64) {
 	b.start = tell
 	b.size = int64(len(text))
-	if b.hasfile() {
+	if b.hasfile() && b.repo.store != nil {
+		b.storeContent(bytes.NewReader(text))
+	} else if b.hasfile() {
+		b.unstore()
 		file, err := os.OpenFile(b.getBlobfile(true),
 			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
 		if err != nil {
 			panic(fmt.Errorf("Blob write: %v", err))
 		}
 		defer file.Close()
-		if control.flagOptions["compressblobs"] {
-			output := gzip.NewWriter(file)
-
+		if codec := b.repo.codec; codec != nil {
+			output, err2 := codec.writer(file)
+			if err2 != nil {
+				panic(fmt.Errorf("Blob writer: %v", err2))
+			}
 			defer output.Close()
 			_, err = output.Write(text)
 		} else {
@@ -1804,6 +2158,12 @@ func (b *Blob) setContentFromStream(s io.ReadCloser) {
 	// maybe the caller should close it?
 	defer s.Close()
 	b.start = noOffset
+	if b.repo.store != nil {
+		b.size = b.storeContent(s)
+		b.hash.invalidate()
+		return
+	}
+	b.unstore()
 	file, err := os.OpenFile(b.getBlobfile(true),
 		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
 	if err != nil {
@@ -1811,9 +2171,11 @@ func (b *Blob) setContentFromStream(s io.ReadCloser) {
 	}
 	defer file.Close()
 	var nBytes int64
-	if control.flagOptions["compressblobs"] {
-		output := gzip.NewWriter(file)
-
+	if codec := b.repo.codec; codec != nil {
+		output, err2 := codec.writer(file)
+		if err2 != nil {
+			panic(fmt.Errorf("Blob writer: %v", err2))
+		}
 		defer output.Close()
 		nBytes, err = io.Copy(output, s)
 	} else {
@@ -1866,7 +2228,21 @@ func (b Blob) isCommit() bool {
 
 // moveto changes the repo this blob is associated with."
 func (b *Blob) moveto(repo *Repository) {
-	if b.hasfile() {
+	if b.hasfile() && b.repo.codec != repo.codec {
+		// The file is encoded for the old repository, so its
+		// content is rewritten rather than just moved.
+		oldloc := b.getBlobfile(false)
+		content := b.readBlobfile(b.repo.codec)
+		b.repo = repo
+		if logEnable(logSHUFFLE) {
+			logit("blob moveto re-encodes %s as %s", relpath(oldloc), relpath(b.getBlobfile(false)))
+		}
+		b.setContent(content, noOffset)
+		if oldloc != b.getBlobfile(false) {
+			os.Remove(oldloc)
+		}
+		b.hash.invalidate()
+	} else if b.hasfile() {
 		// the relpath calls are fir readabiliyu if we error out
 		oldloc := relpath(b.getBlobfile(false))
 		b.repo = repo
@@ -1882,20 +2258,25 @@ func (b *Blob) moveto(repo *Repository) {
 	}
 }
 
-// clone makes a fresh (uncolored) copy of this blob, pointing at the same file."
+// clone makes a fresh (uncolored) copy of this blob in a repository
+// with the same blob storage, pointing at the same file.
 func (b *Blob) clone(repo *Repository) *Blob {
-	c := b // copy scalar fields
-	c.opsetLock.Lock()
-	c.opset = make(map[*FileOp]bool, len(b.opset))
+	c := newBlob(repo)
+	c.mark = b.mark
+	c.abspath = b.abspath
+	c.cookie = b.cookie
+	c.start = b.start
+	c.size = b.size
+	c.oid = b.oid
+	b.opsetLock.Lock()
 	for op := range b.opset {
 		c.opset[op] = true
 	}
-	c.opsetLock.Unlock()
-	c.colors.Clear()
-	if b.hasfile() {
+	b.opsetLock.Unlock()
+	if b.hasfile() && b.abspath == "" {
 		// the relpath calls are fir readabiliyu if we error out
 		bpath := relpath(b.getBlobfile(false))
-		cpath := relpath(c.getBlobfile(false))
+		cpath := relpath(c.getBlobfile(true))
 		if logEnable(logSHUFFLE) {
 			logit("blob clone for %s calls os.Link(): %s -> %s", b.mark, bpath, cpath)
 		}
@@ -1903,19 +2284,22 @@ func (b *Blob) clone(repo *Repository) *Blob {
 		if err != nil {
 			panic(fmt.Errorf("Blob clone: %v", err))
 		}
+		if b.store != nil {
+			b.store.acquire(b.storeKey)
+			c.store, c.storeKey = b.store, b.storeKey
+		}
 	} else {
 		if logEnable(logSHUFFLE) {
 			logit("%s blob %s is not materialized.", repo.name, b.mark)
 		}
 	}
-	b.hash.invalidate()
 	return c
 }
 
 func (b *Blob) gitHash() gitHashType {
 	if !b.hash.isValid() {
 		content := b.getContent()
-		b.hash = gitHashString(fmt.Sprintf("blob %d\x00", len(content)) + string(content))
+		b.hash = gitHashFormat(b.repo.objectFormat, fmt.Sprintf("blob %d\x00", len(content))+string(content))
 	}
 	return b.hash
 }
@@ -1962,6 +2346,9 @@ func (b *Blob) parseCookie(content string) *Cookie {
 
 // Save this blob in import-stream format without constructing a string
 func (b *Blob) Save(w io.Writer) {
+	if b.repo != nil && b.repo.smudging && b.smudgedAway() {
+		return
+	}
 	if b.hasfile() {
 		fn := b.getBlobfile(false)
 		if !exists(fn) {
@@ -1971,8 +2358,8 @@ func (b *Blob) Save(w io.Writer) {
 	content := b.getContentStream()
 	defer content.Close()
 	fmt.Fprintf(w, "blob\nmark %s\n", b.mark)
-	if b.hash.isValid() {
-		fmt.Fprintf(w, "original-oid %s\n", b.hash.hexify())
+	if b.oid.isValid() {
+		fmt.Fprintf(w, "original-oid %s\n", b.oid.hexify())
 	}
 	fmt.Fprintf(w, "data %d\n", b.size)
 	io.Copy(w, content)
@@ -2024,6 +2411,7 @@ type Tag struct {
 	tagger     *Attribution
 	Comment    string
 	legacyID   string
+	oid        gitHashType // Object ID in the repository it was read from
 	color      colorType
 }
 
@@ -2147,6 +2535,9 @@ func (t *Tag) emailOut(modifiers orderedStringSet, eventnum int,
 	if t.legacyID != "" {
 		msg.setHeader("Legacy-ID", t.legacyID)
 	}
+	if t.oid.isValid() {
+		msg.setHeader("Original-OID", t.oid.hexify())
+	}
 	check, _ := splitRuneFirst(t.Comment, '\n')
 	if len(check) > 64 {
 		check = check[0:64]
@@ -2219,7 +2610,7 @@ func (t *Tag) emailIn(msg *MessageBlock, fill bool) bool {
 		t.legacyID = legacy
 	}
 	newcomment := msg.getPayload()
-	if control.flagOptions["canonicalize"] {
+	if t.repo.flag("canonicalize") {
 		newcomment = canonicalizeComment(newcomment)
 	}
 	if newcomment != t.Comment {
@@ -2276,10 +2667,16 @@ func (t *Tag) Save(w io.Writer) {
 		fmt.Fprintf(w, "#legacy-id %s\n", t.legacyID)
 	}
 	fmt.Fprintf(w, "from %s\n", t.committish)
+	if t.oid.isValid() {
+		fmt.Fprintf(w, "original-oid %s\n", t.oid.hexify())
+	}
 	if t.tagger != nil {
 		fmt.Fprintf(w, "tagger %s\n", t.tagger)
 	}
 	comment := t.Comment
+	if signed, ok := t.repo.signedComments[t]; ok {
+		comment = signed
+	}
 	if t.repo.writeOptions.Contains("--legacy") && t.legacyID != "" {
 		if comment != "" {
 			comment += control.lineSep
@@ -2471,6 +2868,11 @@ func (fileop *FileOp) construct(op optype, opargs ...string) *FileOp {
 	} else if op == 'N' {
 		fileop.ref = opargs[0]
 		fileop.Path = opargs[1]
+		if fileop.repo != nil && strings.HasPrefix(fileop.ref, ":") {
+			if blob, ok := fileop.repo.markToEvent(fileop.ref).(*Blob); ok {
+				blob.appendOperation(fileop)
+			}
+		}
 	} else if op == 'R' {
 		fileop.Source = opargs[0]
 		fileop.Path = opargs[1]
@@ -2484,59 +2886,167 @@ func (fileop *FileOp) construct(op optype, opargs ...string) *FileOp {
 	return fileop
 }
 
+// cQuote wraps a path in double quotes using the C-style escapes
+// git-fast-import understands. Valid UTF-8 passes through untouched;
+// control characters and bytes that are not part of a valid UTF-8
+// sequence become three-digit octal escapes, so arbitrary byte strings
+// survive a round trip.
+func cQuote(s string) string {
+	var bld strings.Builder
+	bld.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			bld.WriteByte('\\')
+			bld.WriteByte(c)
+		case '\a':
+			bld.WriteString(`\a`)
+		case '\b':
+			bld.WriteString(`\b`)
+		case '\f':
+			bld.WriteString(`\f`)
+		case '\n':
+			bld.WriteString(`\n`)
+		case '\r':
+			bld.WriteString(`\r`)
+		case '\t':
+			bld.WriteString(`\t`)
+		case '\v':
+			bld.WriteString(`\v`)
+		default:
+			if c >= utf8.RuneSelf {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if r != utf8.RuneError || size > 1 {
+					bld.WriteString(s[i : i+size])
+					i += size
+					continue
+				}
+			}
+			if c < ' ' || c >= 0x7f {
+				fmt.Fprintf(&bld, "\\%03o", c)
+			} else {
+				bld.WriteByte(c)
+			}
+		}
+		i++
+	}
+	bld.WriteByte('"')
+	return bld.String()
+}
+
+// cUnquote is the inverse of cQuote. It accepts a token with its
+// bounding double quotes and interprets the C-style escapes inside,
+// byte by byte, so the result need not be valid UTF-8.
+func cUnquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s, fmt.Errorf("missing quotes around %q", s)
+	}
+	s = s[1 : len(s)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return string(out), fmt.Errorf("trailing backslash in quoted path")
+		}
+		switch c = s[i]; c {
+		case 'a':
+			out = append(out, '\a')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case '"', '\\':
+			out = append(out, c)
+		case '0', '1', '2', '3':
+			if i+2 >= len(s) || s[i+1] < '0' || s[i+1] > '7' || s[i+2] < '0' || s[i+2] > '7' {
+				return string(out), fmt.Errorf("malformed octal escape in quoted path")
+			}
+			out = append(out, (c-'0')<<6|(s[i+1]-'0')<<3|(s[i+2]-'0'))
+			i += 2
+		default:
+			return string(out), fmt.Errorf("unknown escape \\%c in quoted path", c)
+		}
+	}
+	return string(out), nil
+}
+
+// needsQuoting tells whether a path must be quoted to survive a trip
+// through stringScan: interior or bounding whitespace, a leading
+// quote, control characters, and invalid UTF-8 all qualify.
+func needsQuoting(path string) bool {
+	if path == "" || path[0] == '"' || !utf8.ValidString(path) {
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c <= ' ' || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
 // stringScan extracts tokens from a text line.  Tokens maky be
 // "-quoted, in which the bounding quotes are stripped and C-style
 // backslashes interpreted in the interior. Meant to mimic the
-// behavior of git-fast-import.
+// behavior of git-fast-import. Only ASCII blanks separate tokens, so
+// bytes inside UTF-8 sequences are never mistaken for whitespace.
 func stringScan(input string, limit int) []string {
 	bufs := make([][]byte, 0)
 	state := 0
 	tokenStart := func() {
-		//fmt.Fprintf(os.Stderr, "New token\n")
 		bufs = append(bufs, make([]byte, 0))
 	}
 	tokenContinue := func(c byte) {
-		//fmt.Fprintf(os.Stderr, "%c: appending\n", c)
 		bufs[len(bufs)-1] = append(bufs[len(bufs)-1], c)
 	}
-	toState := func(c byte, i int) int {
-		//fmt.Fprintf(os.Stderr, "%c: %d -> %d\n", c, state, i)
-		return i
+	isBlank := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r'
 	}
-	for i := range input {
+	for i := 0; i < len(input); i++ {
 		c := input[i]
-		//fmt.Fprintf(os.Stderr, "State %d, byte %c\n", state, c)
 		switch state {
 		case 0: // ground state, in whitespace
-			if unicode.IsSpace(rune(c)) {
+			if isBlank(c) {
 				continue
 			} else if c == '"' {
-				state = toState(c, 2)
+				state = 2
 				tokenStart()
 				tokenContinue(c)
 			} else {
-				state = toState(c, 1)
+				state = 1
 				tokenStart()
 				tokenContinue(c)
 			}
 		case 1: // in token
-			if unicode.IsSpace(rune(c)) && len(bufs) < limit {
-				state = toState(c, 0)
+			if isBlank(c) && len(bufs) < limit {
+				state = 0
 			} else {
 				tokenContinue(c)
 			}
 		case 2: // in string
+			tokenContinue(c)
 			if c == '"' {
-				tokenContinue(c)
-				state = toState(c, 0)
+				state = 0
 			} else if c == '\\' {
-				state = toState(c, 3)
-			} else {
-				tokenContinue(c)
+				state = 3
 			}
-		case 3: // after \ in string
-			state = toState(c, 2)
+		case 3: // after \ in string; keep the escape for cUnquote
 			tokenContinue(c)
+			state = 2
 		}
 	}
 
@@ -2544,7 +3054,10 @@ func stringScan(input string, limit int) []string {
 	for i, tok := range bufs {
 		s := string(tok)
 		if s[0] == '"' {
-			s, _ = strconv.Unquote(s)
+			if unquoted, err := cUnquote(s); err == nil {
+				out[i] = unquoted
+				continue
+			}
 		}
 		out[i] = strings.TrimSpace(s)
 	}
@@ -2611,7 +3124,7 @@ func (fileop *FileOp) forget() {
 	if fileop.repo == nil {
 		return
 	}
-	if fileop.op == opM && fileop.ref != "inline" {
+	if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
 		if blob, ok := fileop.repo.markToEvent(fileop.ref).(*Blob); ok {
 			blob.removeOperation(fileop)
 		}
@@ -2651,11 +3164,14 @@ func (fileop *FileOp) relevant(other *FileOp) bool {
 // Save dumps this fileop in import-stream format
 func (fileop *FileOp) Save(w io.Writer) {
 	quotifyIfNeeded := func(cpath string) string {
-		if len(strings.Fields(cpath)) > 1 {
-			return strconv.Quote(cpath)
+		if needsQuoting(cpath) {
+			return cQuote(cpath)
 		}
 		return cpath
 	}
+	if fileop.repo != nil && fileop.repo.smudging && fileop.saveSmudged(w) {
+		return
+	}
 	if fileop.op == opM {
 		fmt.Fprintf(w, "M %s %s %s\n", fileop.mode, fileop.ref, quotifyIfNeeded(fileop.Path))
 		if fileop.ref == "inline" {
@@ -2671,7 +3187,7 @@ func (fileop *FileOp) Save(w io.Writer) {
 	} else if fileop.op == opD {
 		fmt.Fprintf(w, "D %s\n", quotifyIfNeeded(fileop.Path))
 	} else if fileop.op == opR || fileop.op == opC {
-		fmt.Fprintf(w, "%c \"%s\" \"%s\"\n", fileop.op, fileop.Source, fileop.Path)
+		fmt.Fprintf(w, "%c %s %s\n", fileop.op, cQuote(fileop.Source), cQuote(fileop.Path))
 	} else if fileop.op == deleteall {
 		w.Write([]byte("deleteall\n"))
 	} else if fileop.op == 0 {
@@ -2840,9 +3356,10 @@ type Commit struct {
 	_parentNodes   []CommitLike // list of parent nodes
 	_childNodes    []CommitLike // list of child nodes
 	hash           gitHashType
-	color          colorType // Scratch storage for graph-coloring
-	deleteme       bool      // Flag used during deletion operations
-	implicitParent bool      // Whether the first parent was implicit
+	oid            gitHashType // Object ID in the repository it was read from
+	color          colorType   // Scratch storage for graph-coloring
+	deleteme       bool        // Flag used during deletion operations
+	implicitParent bool        // Whether the first parent was implicit
 }
 
 func (commit Commit) getDelFlag() bool {
@@ -2927,6 +3444,15 @@ func (commit *Commit) date() Date {
 	return commit.committer.date
 }
 
+// mainAuthor returns the first author of the commit, or the committer
+// if there is none.
+func (commit *Commit) mainAuthor() *Attribution {
+	if len(commit.authors) > 0 {
+		return &commit.authors[0]
+	}
+	return &commit.committer
+}
+
 // setBranch sets the repo's branch field.
 func (commit *Commit) setBranch(branch string) {
 	commit.Branch = branch
@@ -2964,6 +3490,30 @@ func (commit *Commit) appendOperation(op *FileOp) {
 	commit.invalidateManifests()
 }
 
+// setNote attaches a note about the commit named by committish.  Notes
+// are keyed by their target, so an existing N op for the same
+// committish has its data replaced rather than being duplicated.
+func (commit *Commit) setNote(ref string, committish string, inline []byte) {
+	for _, op := range commit.operations() {
+		if op.op == opN && op.Path == committish {
+			op.forget()
+			op.construct(opN, ref, committish)
+			op.inline = nil
+			if ref == "inline" {
+				op.inline = inline
+			}
+			commit.hash.invalidate()
+			return
+		}
+	}
+	fileop := newFileOp(commit.repo).construct(opN, ref, committish)
+	if ref == "inline" {
+		fileop.inline = inline
+	}
+	commit.appendOperation(fileop)
+	commit.repo.inlines++
+}
+
 // prependOperation prepends to the set of fileops associated with this commit.
 func (commit *Commit) prependOperation(op *FileOp) {
 	commit.fileops = append([]*FileOp{op}, commit.fileops...)
@@ -2999,8 +3549,8 @@ func (commit *Commit) discardOpsBeforeLastDeleteAll() {
 func (commit *Commit) bump(i int) {
 	delta := time.Second * time.Duration(i)
 	commit.committer.date.timestamp = commit.committer.date.timestamp.Add(delta)
-	for _, author := range commit.authors {
-		author.date.timestamp = author.date.timestamp.Add(delta)
+	for i := range commit.authors {
+		commit.authors[i].date.timestamp = commit.authors[i].date.timestamp.Add(delta)
 	}
 	commit.hash.invalidate()
 }
@@ -3064,7 +3614,7 @@ func (commit *Commit) lister(_modifiers orderedStringSet, eventnum int, cols int
 // stamp enables DoStamp() to report action stamps.
 func (commit *Commit) stamp(modifiers orderedStringSet, _eventnum int, cols int) string {
 	firstLine, _ := splitRuneFirst(commit.Comment, '\n')
-	report := "<" + commit.actionStamp() + "> " + firstLine
+	report := "<" + commit.uniqueStamp() + "> " + firstLine
 	if cols > 0 && len(report) > cols {
 		report = report[:cols]
 	}
@@ -3114,12 +3664,13 @@ func (commit *Commit) emailOut(modifiers orderedStringSet,
 	if commit.legacyID != "" {
 		msg.setHeader("Legacy-ID", commit.legacyID)
 	}
+	if commit.oid.isValid() {
+		msg.setHeader("Original-OID", commit.oid.hexify())
+	}
 	if commit.hasProperties() && len(commit.properties.keys) > 0 {
 		for _, name := range commit.properties.keys {
-			hdr := ""
-			for _, s := range strings.Split(name, "-") {
-				hdr += strings.Title(s)
-			}
+			// Keep the hyphens so msgin can recover the name
+			hdr := strings.Title(name)
 			value := commit.properties.get(name)
 			value = strings.Replace(value, "\n", `\n`, -1)
 			value = strings.Replace(value, "\r", `\r`, -1)
@@ -3155,6 +3706,18 @@ func (commit *Commit) actionStamp() string {
 	return commit.committer.actionStamp()
 }
 
+// uniqueStamp is the action stamp, with an ordinal suffix when other
+// commits share it, so that it names this commit alone.
+func (commit *Commit) uniqueStamp() string {
+	stamp := commit.actionStamp()
+	if commit.repo != nil {
+		if n := commit.repo.stampOrdinal(commit); n > 0 {
+			stamp += fmt.Sprintf("#%d", n)
+		}
+	}
+	return stamp
+}
+
 func stringSliceEqual(a, b []string) bool {
 	// If one is nil, the other must also be nil.
 	if (a == nil) != (b == nil) {
@@ -3311,7 +3874,7 @@ func (commit *Commit) emailIn(msg *MessageBlock, fill bool) bool {
 		modified = true
 	}
 	newcomment := msg.getPayload()
-	if control.flagOptions["canonicalize"] {
+	if commit.repo.flag("canonicalize") {
 		newcomment = canonicalizeComment(newcomment)
 	}
 	if newcomment != commit.Comment {
@@ -3513,9 +4076,8 @@ func (commit *Commit) addParentByMark(mark string) {
 }
 
 // callout generates a callout cookie for this commit.
-func (commit Commit) callout() string {
-	result := commit.actionStamp()
-	return result
+func (commit *Commit) callout() string {
+	return commit.uniqueStamp()
 }
 
 // is_callot tells if the specified mark field a callout?"
@@ -3802,61 +4364,91 @@ func (repo *Repository) walkManifests(
 // https://www.git-scm.com/book/en/v2/Git-Internals-Git-Objects
 // https://stackoverflow.com/questions/14790681/what-is-the-internal-format-of-a-git-tree-object
 
-func (manifest *Manifest) gitHash() gitHashType {
+func (manifest *Manifest) gitHash(format string) gitHashType {
+	return treeHash(&manifest.PathMap, format)
+}
+
+// treeHash computes the git tree hash of a PathMap of FileOps, which
+// may be a subdirectory of a manifest, in the given object format.
+func treeHash(pm *PathMap, format string) gitHashType {
 	type Element struct {
 		name string
 		mode string
 		hash gitHashType
 	}
-	var innerHash func(pm *PathMap) gitHashType
-	innerHash = func(pm *PathMap) gitHashType {
-		if hash, ok := pm.info.(gitHashType); ok {
-			return hash
-		}
-		elements := []Element{}
-		for name, subdir := range pm.dirs {
+	if hash, ok := pm.info.(gitHashType); ok {
+		return hash
+	}
+	elements := []Element{}
+	for name, subdir := range pm.dirs {
+		elements = append(elements, Element{
+			mode: "40000",
+			name: name,
+			hash: treeHash(subdir, format),
+		})
+	}
+	for name, entry := range pm.blobs {
+		op := entry.(*FileOp)
+		if blob, ok := op.repo.markToEvent(op.ref).(*Blob); ok {
+			elements = append(elements, Element{
+				mode: op.mode,
+				name: name,
+				hash: blob.gitHash(),
+			})
+		} else {
+			// The ref is not a blob mark. This is probably a git link,
+			// or a hash given directly.
 			elements = append(elements, Element{
-				mode: "40000",
+				mode: op.mode,
 				name: name,
-				hash: innerHash(subdir),
+				hash: newGitHash([]byte(op.ref)),
 			})
 		}
-		for name, entry := range pm.blobs {
-			op := entry.(*FileOp)
-			if blob, ok := op.repo.markToEvent(op.ref).(*Blob); ok {
-				elements = append(elements, Element{
-					mode: op.mode,
-					name: name,
-					hash: blob.gitHash(),
-				})
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		return elements[i].name < elements[j].name
+	})
+	var sb strings.Builder
+	for _, e := range elements {
+		fmt.Fprintf(&sb, "%s %s\x00%s", e.mode, e.name, e.hash.bytes())
+	}
+	body := sb.String()
+	hash := gitHashFormat(format, fmt.Sprintf("tree %d\x00%s", len(body), body))
+	if pm.shared { // The PathMap is immutable, we can cache its hash
+		pm.info = hash
+	}
+	return hash
+}
+
+// patchID returns a hash of the change this commit makes, independent of
+// the order of its fileops and of its metadata, in the manner of
+// git patch-id.  Since fileops are relative to the first parent, two
+// commits with the same patchID make the same change to their parents.
+func (commit *Commit) patchID() gitHashType {
+	ops := make([]string, 0, len(commit.operations()))
+	for _, fileop := range commit.operations() {
+		switch fileop.op {
+		case opM:
+			var content gitHashType
+			if fileop.ref == "inline" {
+				content = gitHashString(string(fileop.inline))
+			} else if blob, ok := commit.repo.markToEvent(fileop.ref).(*Blob); ok {
+				content = blob.gitHash()
 			} else {
-				// The ref is not a blob mark. This is probably a git link,
-				// or a hash given directly.
-				hashref, _ := hex.DecodeString(op.ref)
-				hash := gitHashType{}
-				copy(hash[:], hashref)
-				elements = append(elements, Element{
-					mode: op.mode,
-					name: name,
-					hash: hash,
-				})
+				// Submodule links carry a commit hash rather than a mark
+				content = gitHashString(fileop.ref)
 			}
+			ops = append(ops, fmt.Sprintf("M %s %s %s", fileop.mode, content.hexify(), fileop.Path))
+		case opD:
+			ops = append(ops, "D "+fileop.Path)
+		case opR, opC:
+			ops = append(ops, fmt.Sprintf("%c %s\x00%s", fileop.op, fileop.Source, fileop.Path))
+		case deleteall:
+			ops = append(ops, "deleteall")
 		}
-		sort.Slice(elements, func(i, j int) bool {
-			return elements[i].name < elements[j].name
-		})
-		var sb strings.Builder
-		for _, e := range elements {
-			fmt.Fprintf(&sb, "%s %s\x00%s", e.mode, e.name, e.hash)
-		}
-		body := sb.String()
-		hash := gitHashString(fmt.Sprintf("tree %d\x00%s", len(body), body))
-		if pm.shared { // The PathMap is immutable, we can cache its hash
-			pm.info = hash
-		}
-		return hash
 	}
-	return innerHash(&manifest.PathMap)
+	sort.Strings(ops)
+	return gitHashString(strings.Join(ops, "\n"))
 }
 
 func (commit *Commit) gitHash() gitHashType {
@@ -3865,7 +4457,7 @@ func (commit *Commit) gitHash() gitHashType {
 		// Assumptin: Git running under DOS still uses plain \n as a
 		// line separator. If this isn't true these "\n"s need to be
 		// replaced by control.lineSep.
-		sb.WriteString("tree " + commit.manifest().gitHash().hexify() + "\n")
+		sb.WriteString("tree " + commit.manifest().gitHash(commit.repo.objectFormat).hexify() + "\n")
 		for _, parent := range commit.parents() {
 			switch parent.(type) {
 			case *Commit:
@@ -3886,7 +4478,7 @@ func (commit *Commit) gitHash() gitHashType {
 		sb.WriteString("\n")
 		sb.WriteString(commit.Comment)
 		body := sb.String()
-		commit.hash = gitHashString(fmt.Sprintf("commit %d\x00", len(body)) + body)
+		commit.hash = gitHashFormat(commit.repo.objectFormat, fmt.Sprintf("commit %d\x00", len(body))+body)
 	}
 	return commit.hash
 }
@@ -3991,7 +4583,8 @@ func (commit *Commit) alldeletes(killset ...optype) bool {
 }
 
 // checkout makes a directory with links to files in a specified checkout.
-func (commit *Commit) checkout(directory string) string {
+// If wanted is not nil, only paths it accepts are materialized.
+func (commit *Commit) checkout(directory string, wanted func(string) bool) string {
 	if directory == "" {
 		directory = filepath.FromSlash(commit.repo.subdir("") + "/" + commit.mark)
 	}
@@ -4008,52 +4601,49 @@ func (commit *Commit) checkout(directory string) string {
 
 	commit.manifest().iter(func(cpath string, pentry interface{}) {
 		entry := pentry.(*FileOp)
-		fullpath := filepath.FromSlash(directory +
-			"/" + cpath + "/" + entry.ref)
-		if !exists(fullpath) {
-			parts := strings.Split(fullpath, "/")
-			// os.MkdirAll is broken and rpike says they
-			// won't fix it.
-			// https://github.com/golang/go/issues/22323
-			var dpath string
-			for i := range parts[0 : len(parts)-1] {
-				dpath = filepath.FromSlash(strings.Join(parts[:i+1], "/"))
-				err := os.Mkdir(dpath, userReadWriteSearchMode)
-				if err != nil && !os.IsExist(err) {
-					panic(fmt.Errorf("Directory creation failed during checkout: %v", err))
-				}
-
-			}
-			rawmode, err2 := strconv.ParseUint(entry.mode, 8, 32)
-			if err2 != nil {
-				panic(err2)
-			}
-			mode := os.FileMode(rawmode)
+		if entry.mode == "160000" || (wanted != nil && !wanted(cpath)) {
+			return
+		}
+		fullpath := filepath.Join(directory, filepath.FromSlash(cpath))
+		if exists(fullpath) {
+			return
+		}
+		// os.MkdirAll is broken and rpike says they
+		// won't fix it.
+		// https://github.com/golang/go/issues/22323
+		parts := strings.Split(cpath, "/")
+		dpath := directory
+		for _, part := range parts[0 : len(parts)-1] {
+			dpath = filepath.Join(dpath, part)
+			err := os.Mkdir(dpath, userReadWriteSearchMode)
+			if err != nil && !os.IsExist(err) {
+				panic(fmt.Errorf("Directory creation failed during checkout: %v", err))
+			}
+		}
+		var content []byte
+		if entry.ref == "inline" {
+			content = []byte(entry.inline)
+		} else {
 			blob := commit.repo.markToEvent(entry.ref).(*Blob)
-			if entry.ref == "inline" {
-				file, err3 := os.OpenFile(blob.getBlobfile(true),
-					os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
-				if err3 != nil {
-					panic(fmt.Errorf("File creation for inline failed during checkout: %v", err3))
-				}
-				file.Write([]byte(entry.inline))
-				blob.size = int64(len(entry.inline))
-				file.Close()
-			} else {
-				if blob.hasfile() {
-					os.Link(blob.getBlobfile(false), fullpath)
-				} else {
-					file, err4 := os.OpenFile(blob.getBlobfile(true),
-						os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
-					if err4 != nil {
-						panic(fmt.Errorf("File creation failed during checkout: %v", err4))
-					}
-					content := blob.getContent()
-					file.Write(content)
-					blob.size = int64(len(content))
-					file.Close()
+			if blob.hasfile() && entry.mode != "120000" {
+				if os.Link(blob.getBlobfile(false), fullpath) == nil {
+					return
 				}
 			}
+			content = blob.getContent()
+		}
+		if entry.mode == "120000" {
+			if err := os.Symlink(string(content), fullpath); err != nil {
+				panic(fmt.Errorf("Symlink creation failed during checkout: %v", err))
+			}
+			return
+		}
+		rawmode, err := strconv.ParseUint(entry.mode, 8, 32)
+		if err != nil {
+			panic(err)
+		}
+		if err = ioutil.WriteFile(fullpath, content, os.FileMode(rawmode)&os.ModePerm); err != nil {
+			panic(fmt.Errorf("File creation failed during checkout: %v", err))
 		}
 	})
 	return directory
@@ -4193,8 +4783,8 @@ func (commit *Commit) Save(w io.Writer) {
 	if commit.mark != "" {
 		fmt.Fprintf(w, "mark %s\n", commit.mark)
 	}
-	if commit.hash.isValid() {
-		fmt.Fprintf(w, "original-oid %s\n", commit.hash.hexify())
+	if commit.oid.isValid() {
+		fmt.Fprintf(w, "original-oid %s\n", commit.oid.hexify())
 	}
 	if len(commit.authors) > 0 {
 		for _, author := range commit.authors {
@@ -4258,6 +4848,9 @@ func (commit *Commit) Save(w io.Writer) {
 		}
 	}
 	for _, op := range commit.operations() {
+		if op.op == opN && !commit.repo.notesSupported() {
+			continue
+		}
 		w.Write([]byte(op.String()))
 	}
 	if !commit.repo.exportStyle().Contains("no-nl-after-commit") {
@@ -4272,7 +4865,7 @@ func (commit Commit) String() string {
 	return bld.String()
 }
 
-//Passthrough represents a passthrough line.
+// Passthrough represents a passthrough line.
 type Passthrough struct {
 	repo     *Repository
 	text     string
@@ -4317,7 +4910,7 @@ func (p *Passthrough) idMe() string {
 	return fmt.Sprintf("passthrough@%d", p.repo.eventToIndex(p))
 }
 
-//getMark is a stub required for the Event interface
+// getMark is a stub required for the Event interface
 func (p Passthrough) getMark() string {
 	return ""
 }
@@ -4335,6 +4928,21 @@ func (p *Passthrough) Save(w io.Writer) {
 	w.Write([]byte(p.text))
 }
 
+// recognized tells whether this passthrough is a comment or one of
+// the stream commands import-stream readers are expected to accept.
+func (p *Passthrough) recognized() bool {
+	text := strings.TrimSpace(p.text)
+	if text == "done" || text == "checkpoint" || strings.HasPrefix(text, "#") {
+		return true
+	}
+	for _, prefix := range []string{"feature ", "option ", "progress "} {
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // moveto changes the repo this passthrough is associated with."
 func (p *Passthrough) moveto(*Repository) {
 	// Has no repo field
@@ -4349,7 +4957,7 @@ func (p Passthrough) isCommit() bool {
 // capture runs a specified command, capturing the output.
 func captureFromProcess(command string) (string, error) {
 	if logEnable(logCOMMANDS) {
-		logit("%s: capturing %s", rfc3339(time.Now()), command)
+		logit("%s: capturing %s", wallclock(), command)
 	}
 	cmd := exec.Command("sh", "-c", command)
 	content, err := cmd.CombinedOutput()
@@ -4379,6 +4987,7 @@ type StreamParser struct {
 	ccount      int64
 	linebuffers [][]byte
 	lastcookie  Cookie
+	imported    map[string]string
 	svnReader   // Opaque state of the Subversion dump reader
 }
 
@@ -4541,6 +5150,17 @@ func (sp *StreamParser) fiReadData(line []byte) ([]byte, int64) {
 	return data, start
 }
 
+// originalOid parses an original-oid line. A SHA-256 object name
+// tells us the stream came from a SHA-256 repository, and hashes
+// computed for it must be SHA-256 too.
+func (sp *StreamParser) originalOid(line []byte) gitHashType {
+	oid := newGitHash(bytes.Fields(line)[1])
+	if int(oid.size) == sha256.Size {
+		sp.repo.objectFormat = "sha256"
+	}
+	return oid
+}
+
 func (sp *StreamParser) fiParseFileop(fileop *FileOp) {
 	// Read a fast-import fileop
 	if fileop.ref[0] == ':' {
@@ -4553,6 +5173,17 @@ func (sp *StreamParser) fiParseFileop(fileop *FileOp) {
 	}
 }
 
+// fromEarlierRun tells whether a committish is an object name that
+// stood in for a mark from an imported marks file.
+func (sp *StreamParser) fromEarlierRun(committish string) bool {
+	for _, name := range sp.imported {
+		if name == committish {
+			return true
+		}
+	}
+	return false
+}
+
 // General helpers
 
 func parseInt(s string) int {
@@ -4567,6 +5198,41 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 	// Beginning of fast-import stream parsing
 	commitcount := 0
 	branchPosition := make(map[string]*Commit)
+	// Some exporters omit marks on commits and refer to them by
+	// ref name instead.  Resolve those names against the branch
+	// tips seen so far; marks for unmarked commits are synthesized
+	// once the whole stream is in, so they can't collide with
+	// marks that appear later.
+	resolveRef := func(committish string) *Commit {
+		ref := strings.TrimSuffix(committish, "^0")
+		for _, name := range []string{ref, "refs/heads/" + ref, "refs/tags/" + ref} {
+			if commit, ok := branchPosition[name]; ok {
+				return commit
+			}
+		}
+		return nil
+	}
+	unmarked := make([]*Commit, 0)
+	pending := make(map[Event]*Commit)
+	// An incremental stream may refer to marks made by an earlier
+	// run; with that run's marks file they resolve to object names.
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--import-marks=") {
+			marks, err := readMarks(option[len("--import-marks="):])
+			if err != nil {
+				sp.error(err.Error())
+			}
+			sp.imported = marks
+		}
+	}
+	// earlier returns the object name for a mark this stream does not
+	// define but the imported marks do, or "".
+	earlier := func(mark string) string {
+		if name, ok := sp.imported[mark]; ok && sp.repo.markToEvent(mark) == nil {
+			return name
+		}
+		return ""
+	}
 	baton.startProgress("parse fast import stream", uint64(filesize))
 	for {
 		line := sp.fiReadline()
@@ -4585,12 +5251,14 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			}
 			line = sp.fiReadline()
 			if bytes.HasPrefix(line, []byte("original-oid")) {
-				blob.hash = newGitHash(bytes.Fields(line)[1])
+				blob.oid = sp.originalOid(line)
 			} else {
 				sp.pushback(line)
 			}
 			blobcontent, blobstart := sp.fiReadData([]byte{})
 			blob.setContent(blobcontent, blobstart)
+			// Setting the content invalidates the hash, so do this after
+			blob.hash = blob.oid
 			if cookie := blob.parseCookie(string(blobcontent)); cookie != nil {
 				sp.lastcookie = *cookie
 			}
@@ -4608,7 +5276,7 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				if len(line) == 0 {
 					break
 				} else if bytes.HasPrefix(line, []byte("original-oid")) {
-					fmt.Sscan(string(bytes.Fields(line)[1]), "%x", commit.hash)
+					commit.oid = sp.originalOid(line)
 				} else if bytes.HasPrefix(line, []byte("#legacy-id")) {
 					// reposurgeon extension, expected to
 					// be immediately after "commit" if present
@@ -4681,13 +5349,17 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				} else if bytes.HasPrefix(line, []byte("data")) {
 					d, _ := sp.fiReadData(line)
 					commit.Comment = string(d)
-					if control.flagOptions["canonicalize"] {
+					if sp.repo.flag("canonicalize") {
 						commit.Comment = canonicalizeComment(commit.Comment)
 					}
 				} else if bytes.HasPrefix(line, []byte("from")) || bytes.HasPrefix(line, []byte("merge")) {
 					mark := string(bytes.Fields(line)[1])
 					if isCallout(mark) {
 						commit.addCallout(mark)
+					} else if name := earlier(mark); name != "" {
+						commit.addCallout(name)
+					} else if parent := resolveRef(mark); parent != nil && !strings.HasPrefix(mark, ":") {
+						commit.addParentCommit(parent)
 					} else {
 						commit.addParentByMark(mark)
 					}
@@ -4697,6 +5369,12 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 					commit.appendOperation(newFileOp(sp.repo).parse(string(line)))
 				} else if line[0] == opM {
 					fileop := newFileOp(sp.repo).parse(string(line))
+					if name := earlier(fileop.ref); name != "" {
+						// Content the earlier run already imported
+						fileop.ref = name
+						commit.appendOperation(fileop)
+						continue
+					}
 					if fileop.ref != "inline" {
 						ref := sp.repo.markToEvent(fileop.ref)
 						if ref != nil {
@@ -4730,6 +5408,9 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 					commit.appendOperation(fileop)
 				} else if line[0] == opN {
 					fileop := newFileOp(sp.repo).parse(string(line))
+					if blob, ok := sp.repo.markToEvent(fileop.ref).(*Blob); ok {
+						blob.appendOperation(fileop)
+					}
 					commit.appendOperation(fileop)
 					sp.fiParseFileop(fileop)
 					sp.repo.inlines++
@@ -4755,20 +5436,25 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				}
 				baton.twirl()
 			}
-			if !(commit.mark != "" && commit.committer.fullname != "") {
+			if commit.committer.fullname == "" {
 				sp.importLine = commitbegin
 				sp.error("missing required fields in commit")
 			}
 			if commit.mark == "" {
-				sp.warn("unmarked commit")
+				unmarked = append(unmarked, commit)
 			}
 			if p, ok := branchPosition[commit.Branch]; ok && !commit.hasParents() {
 				commit.addParentCommit(p)
 				commit.implicitParent = true
 			}
+			// Building the commit invalidates its hash, so restore it
+			commit.hash = commit.oid
 			sp.repo.addEvent(commit)
 			branchPosition[commit.Branch] = commit
 			commitcount++
+			if commitcount%1000 == 0 {
+				control.checkMemory("parse", "stream parsing")
+			}
 			baton.twirl()
 		} else if bytes.HasPrefix(line, []byte("reset")) {
 			reset := newReset(sp.repo, "", "", "")
@@ -4776,10 +5462,21 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			line = sp.fiReadline()
 			if bytes.HasPrefix(line, []byte("from")) {
 				committish := string(bytes.TrimSpace(line[5:]))
+				if name := earlier(committish); name != "" {
+					committish = name
+				}
+				if commit := resolveRef(committish); commit != nil && !strings.HasPrefix(committish, ":") {
+					if commit.mark == "" {
+						pending[reset] = commit
+					}
+					committish = commit.mark
+				}
 				reset.remember(sp.repo, committish)
-				if commit, ok := sp.repo.markToEvent(committish).(*Commit); ok {
+				if commit, ok := pending[reset]; ok {
 					branchPosition[reset.ref] = commit
-				} else {
+				} else if commit, ok := sp.repo.markToEvent(committish).(*Commit); ok {
+					branchPosition[reset.ref] = commit
+				} else if !sp.fromEarlierRun(committish) {
 					if logEnable(logWARN) {
 						logit("non-mark committish in reset")
 					}
@@ -4806,10 +5503,18 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 			var referent string
 			if bytes.HasPrefix(line, []byte("from")) {
 				referent = string(bytes.TrimSpace(line[5:]))
+				if name := earlier(referent); name != "" {
+					referent = name
+				}
 			} else {
 				sp.error(fmt.Sprintf("missing 'from' field in tag %s", tagname))
 			}
 			line = sp.fiReadline()
+			var oid gitHashType
+			if bytes.HasPrefix(line, []byte("original-oid")) {
+				oid = sp.originalOid(line)
+				line = sp.fiReadline()
+			}
 			if bytes.HasPrefix(line, []byte("tagger")) {
 				var err error
 				tagger, err = newAttribution(string(line[7:]))
@@ -4820,9 +5525,17 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 				sp.warn(fmt.Sprintf("missing 'tagger' field after 'from' field in tag %s", tagname))
 				sp.pushback(line)
 			}
+			var target *Commit
+			if target = resolveRef(referent); target != nil && !strings.HasPrefix(referent, ":") {
+				referent = target.mark
+			}
 			d, _ := sp.fiReadData([]byte{})
 			tag := newTag(sp.repo, tagname, referent, tagger, string(d))
 			tag.legacyID = legacyID
+			tag.oid = oid
+			if target != nil && referent == "" {
+				pending[tag] = target
+			}
 			sp.repo.addEvent(tag)
 		} else {
 			// Simply pass through any line we do not understand.
@@ -4840,24 +5553,57 @@ func (sp *StreamParser) parseFastImport(options stringSet, baton *Baton, filesiz
 	if control.readLimit > 0 && uint64(commitcount) < control.readLimit {
 		panic(throw("parse", "EOF before readlimit."))
 	}
+	if len(unmarked) > 0 {
+		highest := 0
+		for _, event := range sp.repo.events {
+			if mark := event.getMark(); strings.HasPrefix(mark, ":") {
+				if n, err := strconv.Atoi(mark[1:]); err == nil && n > highest {
+					highest = n
+				}
+			}
+		}
+		for _, commit := range unmarked {
+			highest++
+			commit.setMark(fmt.Sprintf(":%d", highest))
+		}
+		// Lookups during the parse cached the unmarked commits
+		// under no mark at all.
+		sp.repo.invalidateMarkToIndex()
+		if sp.repo.markseq < highest {
+			sp.repo.markseq = highest
+		}
+		for event, commit := range pending {
+			switch event := event.(type) {
+			case *Reset:
+				event.committish = commit.mark
+			case *Tag:
+				event.committish = commit.mark
+			}
+		}
+	}
 	for _, event := range sp.repo.events {
 		switch event.(type) {
 		case *Reset:
 			reset := event.(*Reset)
 			if reset.committish != "" {
-				commit := sp.repo.markToEvent(reset.committish).(*Commit)
-				if commit == nil {
-
-					sp.shout(fmt.Sprintf("unresolved committish in reset %s", reset.committish))
+				commit, ok := sp.repo.markToEvent(reset.committish).(*Commit)
+				if !ok {
+					if !sp.fromEarlierRun(reset.committish) {
+						sp.shout(fmt.Sprintf("unresolved committish in reset %s", reset.committish))
+					}
+					continue
 				}
 				commit.attach(reset)
 			}
 		case *Tag:
 			tag := event.(*Tag)
 			if tag.committish != "" {
-				commit := sp.repo.markToEvent(tag.committish).(*Commit)
-				if commit == nil {
-					sp.shout(fmt.Sprintf("unresolved committish in tag %s", tag.committish))
+				commit, ok := sp.repo.markToEvent(tag.committish).(*Commit)
+				if !ok {
+					if !sp.fromEarlierRun(tag.committish) {
+						sp.shout(fmt.Sprintf("unresolved committish in tag %s", tag.committish))
+					}
+					continue
 				}
 				commit.attach(tag)
 			}
@@ -4922,6 +5668,7 @@ func (sp *StreamParser) fastImport(ctx context.Context, fp io.Reader, options st
 	} else {
 		sp.pushback(line)
 		sp.parseFastImport(options, baton, filesize)
+		sp.repo.liftNotes()
 		sp.timeMark("parsing")
 		if control.flagOptions["progress"] {
 			if sp.repo.stronghint {
@@ -4939,7 +5686,7 @@ func (sp *StreamParser) fastImport(ctx context.Context, fp io.Reader, options st
 	if len(sp.repo.events) == 0 {
 		sp.error("ignoring empty repository")
 	}
-
+	sp.repo.logStampCollisions()
 }
 
 // Generic repository-manipulation code begins here
@@ -5085,28 +5832,88 @@ type Repository struct {
 	_markToIndexLock sync.Mutex
 	_namecache       map[string][]int
 	preserveSet      orderedStringSet
+	prenukeSet       orderedStringSet // Overrides the target type's prenuke list if not nil
 	basedir          string
 	uuid             string
 	writeLegacy      bool
+	dirty            bool     // Altered since it was read or last saved
 	dollarMap        sync.Map // From dollar cookies in files
 	dollarOnce       sync.Once
 	legacyMap        map[string]*Commit // From anything that doesn't survive rebuild
 	legacyCount      int
+	rebuiltHashes    map[string]string // Marks to object names, from the last rebuild
+	objectFormat     string            // Git object format, "sha1" or "sha256"
+	readCommits      int
+	readWarnings     []string
+	sharedBlobs      int   // Duplicate blobs shared at read time
+	sharedBytes      int64 // Content those would have duplicated
 	timings          []TimeMark
 	assignments      map[string]orderedIntSet
 	inlines          int
-	uniqueness       string // "committer_date", "committer_stamp", or ""
+	uniqueness       string      // "committer_date", "committer_stamp", or ""
+	splits           [][]*Commit // Mixed commits split by the Subversion reader
+	revpropBase      map[*Commit]*revpropBaseline
 	markseq          int
 	authormap        map[string]Contributor
 	tzmap            map[string]*time.Location // most recent email address to timezone
 	aliases          map[ContributorID]ContributorID
 	maplock          sync.Mutex
+	flagOptions      map[string]bool
+	codec            *blobCodec // compresses on-disk blobs, nil for none
+	store            *blobStore // shares on-disk blobs, nil for none
 	// Write control - set, if required, before each dump
 	preferred      *VCS               // overrides vcs slot for writes
+	importing      *VCS               // importer the dump is piped to, if any
 	realized       map[string]bool    // clear and remake this before each dump
 	branchPosition map[string]*Commit // clear and remake this before each dump
 	writeOptions   stringSet          // options requested on this write
 	internals      orderedStringSet   // export code computes this itself
+	signedComments map[*Tag]string    // tag comments as the signing policy left them
+	smudging       bool               // run smudge hooks over fileop content
+	// Signing policy for invalidated signatures; "" is strip
+	signPolicy string
+	signHook   string
+}
+
+// repoScopedFlags lists the option flags that set --repo and clear --repo
+// may override for a single repository.  A repository starts with the
+// compressblobs value and codec in force when it was created; changing
+// them re-encodes the blob files it already has.
+var repoScopedFlags = orderedStringSet{"canonicalize", "compressblobs"}
+
+// globalCodec is the codec the global settings give a new repository.
+func globalCodec() *blobCodec {
+	if control.flagOptions["compressblobs"] {
+		return control.blobCodec
+	}
+	return nil
+}
+
+// setCodec changes the codec that compresses the repository's on-disk
+// blobs, nil for none, and re-encodes the blob files it has.
+func (repo *Repository) setCodec(codec *blobCodec) {
+	old := repo.codec
+	repo.codec = codec
+	repo.flagOptions["compressblobs"] = codec != nil
+	if codec == old {
+		return
+	}
+	for _, event := range repo.events {
+		if blob, ok := event.(*Blob); ok {
+			blob.recode(old)
+		}
+	}
+}
+
+// flag reports the value of an option flag as it applies to this
+// repository, honoring any per-repository override of the global setting.
+func (repo *Repository) flag(name string) bool {
+	if repo != nil {
+		if val, ok := repo.flagOptions[name]; ok {
+			return val
+		}
+	}
+	return control.flagOptions[name]
 }
 
 func newRepository(name string) *Repository {
@@ -5119,13 +5926,22 @@ func newRepository(name string) *Repository {
 	repo.assignments = make(map[string]orderedIntSet)
 	repo.timings = make([]TimeMark, 0)
 	repo.authormap = make(map[string]Contributor)
+	repo.flagOptions = map[string]bool{
+		"compressblobs": control.flagOptions["compressblobs"],
+		"blobstore":     control.flagOptions["blobstore"],
+	}
+	repo.codec = globalCodec()
 	repo.tzmap = make(map[string]*time.Location)
 	repo.aliases = make(map[ContributorID]ContributorID)
+	repo.objectFormat = "sha1"
 	d, err := os.Getwd()
 	if err != nil {
 		panic(throw("command", "During repository creation: %v", err))
 	}
 	repo.basedir = d
+	if control.flagOptions["blobstore"] {
+		repo.store = sessionBlobStore(d)
+	}
 	return repo
 }
 
@@ -5142,6 +5958,11 @@ func (repo *Repository) subdir(name string) string {
 
 // cleanup releases disk storage associated with this repo
 func (repo *Repository) cleanup() {
+	for _, event := range repo.events {
+		if blob, ok := event.(*Blob); ok && blob.repo == repo {
+			blob.unstore()
+		}
+	}
 	nuke(repo.subdir(""),
 		fmt.Sprintf("reposurgeon: cleaning up %s", repo.subdir("")))
 }
@@ -5305,6 +6126,25 @@ func (repo *Repository) hint(clue1 string, clue2 string, strong bool) bool {
 	return notify
 }
 
+// sourceType names the VCS this repository was read from, or is ""
+// if that is unknown.
+func (repo *Repository) sourceType() string {
+	if repo.vcs != nil {
+		return repo.vcs.name
+	}
+	// Stream readers such as the Subversion one leave only
+	// this cookie behind.
+	for _, event := range repo.events {
+		if passthrough, ok := event.(*Passthrough); ok {
+			fields := strings.Fields(passthrough.text)
+			if len(fields) == 3 && fields[0] == "#reposurgeon" && fields[1] == "sourcetype" {
+				return fields[2]
+			}
+		}
+	}
+	return ""
+}
+
 func (repo *Repository) size() int {
 	// Return the size of this import stream, for statistics display.
 	var sz int
@@ -5357,6 +6197,49 @@ func (repo *Repository) all() orderedIntSet {
 	return s
 }
 
+// stampOrdinal returns the 1-origin position of a commit among those
+// sharing its action stamp, or 0 if no other commit has it.  This is
+// the ordinal that named() resolves in a <stamp#N> reference.
+func (repo *Repository) stampOrdinal(commit *Commit) int {
+	if repo._namecache == nil {
+		repo._buildNamecache()
+	}
+	clique := repo._namecache[commit.actionStamp()]
+	if len(clique) < 2 {
+		return 0
+	}
+	index := commit.index()
+	for i, hit := range clique {
+		if hit == index {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// logStampCollisions reports the commits that share action stamps,
+// and the suffixed stamps that tell them apart.
+func (repo *Repository) logStampCollisions() {
+	if !logEnable(logSTAMPS) {
+		return
+	}
+	bystamp := make(map[string][]string)
+	var stamps []string
+	for _, commit := range repo.commits(nil) {
+		if repo.stampOrdinal(commit) > 0 {
+			stamp := commit.actionStamp()
+			if bystamp[stamp] == nil {
+				stamps = append(stamps, stamp)
+			}
+			bystamp[stamp] = append(bystamp[stamp], commit.mark)
+		}
+	}
+	for _, stamp := range stamps {
+		logit("action stamp %s is shared by %s; use %s#1 to #%d to tell them apart",
+			stamp, strings.Join(bystamp[stamp], " "), stamp, len(bystamp[stamp]))
+	}
+}
+
 func (repo *Repository) _buildNamecache() {
 	// Avoid repeated O(n**2) lookups.
 	repo._namecache = make(map[string][]int)
@@ -5380,13 +6263,10 @@ func (repo *Repository) _buildNamecache() {
 			}
 
 			committerStamp := commit.committer.actionStamp()
-			var authorStamp string
 			if len(commit.authors) > 0 {
-				authorStamp = commit.authors[0].actionStamp()
-				if authorStamp == committerStamp {
-					continue
+				if authorStamp := commit.authors[0].actionStamp(); authorStamp != committerStamp {
+					addOrAppend(i, authorStamp)
 				}
-				addOrAppend(i, authorStamp)
 			}
 			addOrAppend(i, committerStamp)
 			// Ugh. We can't do this yet, it messes up roundtripping
@@ -5449,6 +6329,10 @@ func (repo *Repository) named(ref string) orderedIntSet {
 	if ok {
 		return lookup
 	}
+	// A range of dates?
+	if selection, ok := repo.dateRange(ref); ok {
+		return selection
+	}
 	// Might be a date or action stamp (though action stamps should
 	// be in the name cache already).  First, peel off an optional
 	// ordinal suffix.
@@ -5460,6 +6344,11 @@ func (repo *Repository) named(ref string) orderedIntSet {
 		ordinal = n
 		stamp = ref[:len(ref)-len(m)]
 	}
+	// An action stamp shared by several commits is in the name
+	// cache; its ordinal picks out one of them.
+	if v, ok := repo._namecache[stamp]; ok && ordinal > 0 && ordinal <= len(v) {
+		return newOrderedIntSet(v[ordinal-1])
+	}
 	// Now look for action stamp or date
 	dateEnd := len(stamp)
 	bang := strings.Index(stamp, "!")
@@ -5534,6 +6423,63 @@ func (repo *Repository) named(ref string) orderedIntSet {
 	return nil
 }
 
+// dateRange resolves a reference of the form DATE..DATE to the commits
+// and tags in event order whose committer or tagger dates fall in the
+// range, or with an "author@" prefix the commits with an author date in
+// it (the committer date standing in for a missing author).  Either end
+// may be left off to leave the range open on that side.  An end given
+// as a day, yyyy-mm-dd, takes in the whole of that day.
+// The second return is false if the reference is not a range at all.
+func (repo *Repository) dateRange(ref string) (orderedIntSet, bool) {
+	byAuthor := strings.HasPrefix(ref, "author@")
+	if byAuthor {
+		ref = ref[len("author@"):]
+	}
+	fields := strings.Split(ref, "..")
+	if len(fields) != 2 || (fields[0] == "" && fields[1] == "") {
+		return nil, false
+	}
+	var bounds [2]time.Time
+	for i, field := range fields {
+		if field == "" {
+			continue
+		}
+		if date, err := newDate(field); err == nil {
+			bounds[i] = date.timestamp
+		} else if day, err := time.Parse("2006-01-02", field); err == nil {
+			bounds[i] = day
+			if i == 1 {
+				bounds[i] = day.Add(24*time.Hour - time.Second)
+			}
+		} else {
+			return nil, false
+		}
+	}
+	if !bounds[0].IsZero() && !bounds[1].IsZero() && bounds[1].Before(bounds[0]) {
+		panic(throw("command", "date range %s ends before it begins", ref))
+	}
+	inRange := func(date Date) bool {
+		return (bounds[0].IsZero() || !date.timestamp.Before(bounds[0])) &&
+			(bounds[1].IsZero() || !date.timestamp.After(bounds[1]))
+	}
+	selection := newOrderedIntSet()
+	for i, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			if inRange(event.committer.date) && (!byAuthor || len(event.authors) == 0) {
+				selection.Add(i)
+			} else if byAuthor && len(event.authors) > 0 && inRange(event.authors[0].date) {
+				selection.Add(i)
+			}
+		case *Tag:
+			if !byAuthor && event.tagger != nil && inRange(event.tagger.date) {
+				selection.Add(i)
+			}
+		}
+	}
+	return selection, true
+}
+
 func (repo *Repository) invalidateObjectMap() {
 	repo.invalidateMarkToIndex()
 }
@@ -5629,8 +6575,256 @@ func (repo *Repository) readAuthorMap(selection orderedIntSet, fp io.Reader) err
 	return nil
 }
 
-// List the identities we know.
-func (repo *Repository) writeAuthorMap(selection orderedIntSet, fp io.Writer) error {
+var mailmapRE = regexp.MustCompile(`^([^<]*)<([^>]*)>\s*(?:([^<]*)<([^>]*)>)?`)
+
+// readMailmap reads a git .mailmap and applies it to the attributions
+// of the selection.  Entries that give both commit name and proper
+// identity are also recorded as contributor aliases, as the '+' lines
+// of an author map are.
+func (repo *Repository) readMailmap(selection orderedIntSet, fp io.Reader) error {
+	scanner := bufio.NewScanner(fp)
+	var currentLineNumber uint64
+	complain := func(msg string, args ...interface{}) {
+		if logEnable(logSHOUT) {
+			logit("in readMailmap, while parsing line %d: "+msg,
+				append([]interface{}{currentLineNumber}, args...)...)
+		}
+	}
+	var entries []mailmapEntry
+	for scanner.Scan() {
+		currentLineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := mailmapRE.FindStringSubmatch(line)
+		if m == nil {
+			complain("can't recognize an address in '%s'", line)
+			continue
+		}
+		var entry mailmapEntry
+		if m[4] == "" {
+			// Proper Name <commit@email>
+			entry.properName = strings.TrimSpace(m[1])
+			entry.commitEmail = strings.TrimSpace(m[2])
+		} else {
+			entry.properName = strings.TrimSpace(m[1])
+			entry.properEmail = strings.TrimSpace(m[2])
+			entry.commitName = strings.TrimSpace(m[3])
+			entry.commitEmail = strings.TrimSpace(m[4])
+		}
+		if entry.commitEmail == "" || (entry.properName == "" && entry.properEmail == "") {
+			complain("nothing to map in '%s'", line)
+			continue
+		}
+		entries = append(entries, entry)
+		if entry.commitName != "" && entry.properName != "" {
+			principal := ContributorID{entry.properName, entry.properEmail}
+			if principal.email == "" {
+				principal.email = entry.commitEmail
+			}
+			repo.aliases[ContributorID{entry.commitName, entry.commitEmail}] = principal
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	repo.walkEvents(selection, func(idx int, event Event) {
+		switch event.(type) {
+		case *Commit:
+			c := event.(*Commit)
+			c.committer.unmailmap(entries)
+			for ai := range c.authors {
+				c.authors[ai].unmailmap(entries)
+			}
+		case *Tag:
+			if tagger := event.(*Tag).tagger; tagger != nil {
+				tagger.unmailmap(entries)
+			}
+		}
+	})
+	// Email addresses have changed.
+	// Force rebuild of action-stamp mapping on next lookup
+	repo.invalidateNamecache()
+
+	return nil
+}
+
+// identityCache remembers what identity resolvers have said about each
+// identity they were asked about, keyed by resolver and then by the
+// identity as given to it, so no resolver is asked twice in a session.
+// A nil entry means the identity could not be resolved.
+var identityCache struct {
+	sync.Mutex
+	answers map[string]map[string]*Contributor
+}
+
+// queryResolver asks an identity resolver for the canonical identity of
+// a local ID, name, and email.  A resolver beginning with http:// or
+// https:// is a REST endpoint, sent a GET request with local, name, and
+// email query parameters; anything else is a shell command, fed a line
+// in author-map form on standard input.  Either answers with a line
+// giving name, email, and optionally timezone; an empty answer, or a
+// 404 from an endpoint, means the identity is unknown to it.
+func queryResolver(resolver string, local string, name string, email string) (*Contributor, error) {
+	var answer string
+	if strings.HasPrefix(resolver, "http://") || strings.HasPrefix(resolver, "https://") {
+		endpoint, err := url.Parse(resolver)
+		if err != nil {
+			return nil, err
+		}
+		query := endpoint.Query()
+		query.Set("local", local)
+		query.Set("name", name)
+		query.Set("email", email)
+		endpoint.RawQuery = query.Encode()
+		response, err := http.Get(endpoint.String())
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, nil
+		} else if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s answered %s", resolver, response.Status)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		answer = string(body)
+	} else {
+		cmd := exec.Command("sh", "-c", resolver)
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("%s = %s <%s>\n", local, name, email))
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %v", resolver, err)
+		}
+		answer = string(out)
+	}
+	answer, _ = splitRuneFirst(strings.TrimSpace(answer), '\n')
+	if answer == "" {
+		return nil, nil
+	}
+	fullname, mail, timezone, err := parseAttributionLine(answer)
+	if err != nil {
+		return nil, err
+	}
+	return &Contributor{local, fullname, mail, timezone}, nil
+}
+
+// resolveAuthors asks an identity resolver about each local ID in the
+// selection's attributions that no author-map entry matches, adds the
+// identities it resolves to the author map, and remaps the selection.
+// Returns the numbers of identities resolved and left unresolved.
+func (repo *Repository) resolveAuthors(selection orderedIntSet, resolver string) (int, int, error) {
+	unknown := make(map[string]*Attribution)
+	var locals []string
+	consider := func(attr *Attribution) {
+		if _, ok := attr.mapEntry(repo.authormap); ok {
+			return
+		}
+		local := strings.ToLower(attr.userid())
+		if local == "" {
+			local = strings.ToLower(attr.fullname)
+		}
+		if _, ok := unknown[local]; !ok && local != "" {
+			unknown[local] = attr
+			locals = append(locals, local)
+		}
+	}
+	for _, ei := range selection {
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			consider(&event.committer)
+			for i := range event.authors {
+				consider(&event.authors[i])
+			}
+		case *Tag:
+			if event.tagger != nil {
+				consider(event.tagger)
+			}
+		}
+	}
+	sort.Strings(locals)
+	identityCache.Lock()
+	defer identityCache.Unlock()
+	if identityCache.answers == nil {
+		identityCache.answers = make(map[string]map[string]*Contributor)
+	}
+	answers, ok := identityCache.answers[resolver]
+	if !ok {
+		answers = make(map[string]*Contributor)
+		identityCache.answers[resolver] = answers
+	}
+	resolved, unresolved := 0, 0
+	control.baton.startProgress("resolving identities", uint64(len(locals)))
+	defer control.baton.endProgress()
+	for i, local := range locals {
+		attr := unknown[local]
+		key := local + " = " + attr.who()
+		answer, ok := answers[key]
+		if !ok {
+			var err error
+			answer, err = queryResolver(resolver, attr.userid(), attr.fullname, attr.email)
+			if err != nil {
+				return resolved, unresolved, err
+			}
+			answers[key] = answer
+		}
+		control.baton.percentProgress(uint64(i + 1))
+		if answer == nil {
+			unresolved++
+			continue
+		}
+		resolved++
+		entry := *answer
+		entry.local = local
+		if entry.timezone != "" {
+			loc, err := time.LoadLocation(entry.timezone)
+			if err != nil {
+				loc, err = locationFromZoneOffset(entry.timezone)
+			}
+			if err != nil {
+				if logEnable(logWARN) {
+					logit("resolver gave %s a bad timezone: %v", local, err)
+				}
+				entry.timezone = ""
+			} else {
+				repo.tzmap[entry.email] = loc
+			}
+		}
+		repo.authormap[local] = entry
+	}
+	repo.walkEvents(selection, func(idx int, event Event) {
+		switch event := event.(type) {
+		case *Commit:
+			event.committer.remap(repo.authormap)
+			for ai := range event.authors {
+				event.authors[ai].remap(repo.authormap)
+			}
+		case *Tag:
+			if event.tagger != nil {
+				event.tagger.remap(repo.authormap)
+			}
+		}
+	})
+	repo.invalidateNamecache()
+	return resolved, unresolved, nil
+}
+
+// Line formats for exported author maps, keyed by the consuming tool.
+// Each takes a local user ID and a full "Name <email>" identity.
+var authorMapFormats = map[string]string{
+	"reposurgeon": "%s = %s\n",
+	"cvsimport":   "%s=%s\n",
+	"svn2git":     "%s = %s\n",
+	"hgconvert":   "%s = %s\n",
+}
+
+// Write an author map for the selection in the specified format.
+func (repo *Repository) writeAuthorMap(selection orderedIntSet, fp io.Writer, format string) error {
 	contributors := make(map[string]string)
 	for _, ei := range selection {
 		event := repo.events[ei]
@@ -5652,12 +6846,111 @@ func (repo *Repository) writeAuthorMap(selection orderedIntSet, fp io.Writer) er
 			}
 		}
 	}
-	for userid, cid := range contributors {
-		_, err := fmt.Fprintf(fp, "%s = %s\n", userid, cid)
+	userids := make([]string, 0, len(contributors))
+	for userid := range contributors {
+		userids = append(userids, userid)
+	}
+	sort.Strings(userids)
+	for _, userid := range userids {
+		var err error
+		if format == "mailmap" {
+			// A .mailmap has no notion of local IDs; emitting
+			// the canonical identity for each address is what
+			// lets downstream tools coalesce variant names.
+			_, err = fmt.Fprintf(fp, "%s\n", contributors[userid])
+		} else {
+			_, err = fmt.Fprintf(fp, authorMapFormats[format], userid, contributors[userid])
+		}
 		if err != nil {
 			return fmt.Errorf("in writeAuthorMap: %v", err)
 		}
 	}
+	if format == "mailmap" {
+		// Contributor aliases become entries mapping the alias
+		// to the principal's identity.
+		aliases := make([]string, 0, len(repo.aliases))
+		for alias, principal := range repo.aliases {
+			aliases = append(aliases, fmt.Sprintf("%s <%s> %s <%s>\n", principal.fullname, principal.email, alias.fullname, alias.email))
+		}
+		sort.Strings(aliases)
+		for _, line := range aliases {
+			if _, err := io.WriteString(fp, line); err != nil {
+				return fmt.Errorf("in writeAuthorMap: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// authorCensus is what writeAuthorCensus learns about a local ID.
+type authorCensus struct {
+	who   string
+	count int
+	first Date
+	last  Date
+	zones map[string]int
+}
+
+// Write a skeleton author map for the selection, giving each local ID
+// the zone offset its attributions most often have, preceded by a
+// comment saying how many there are and when the first and last were.
+func (repo *Repository) writeAuthorCensus(selection orderedIntSet, fp io.Writer) error {
+	census := make(map[string]*authorCensus)
+	tally := func(attr *Attribution) {
+		entry, ok := census[attr.userid()]
+		if !ok {
+			entry = &authorCensus{first: attr.date, last: attr.date, zones: make(map[string]int)}
+			census[attr.userid()] = entry
+		}
+		entry.who = attr.who()
+		entry.count++
+		if attr.date.Before(entry.first) {
+			entry.first = attr.date
+		}
+		if attr.date.After(entry.last) {
+			entry.last = attr.date
+		}
+		entry.zones[attr.date.timestamp.Format("-0700")]++
+	}
+	for _, ei := range selection {
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			tally(&event.committer)
+			for i := range event.authors {
+				tally(&event.authors[i])
+			}
+		case *Tag:
+			if event.tagger != nil {
+				tally(event.tagger)
+			}
+		}
+	}
+	userids := make([]string, 0, len(census))
+	for userid := range census {
+		userids = append(userids, userid)
+	}
+	sort.Strings(userids)
+	for _, userid := range userids {
+		entry := census[userid]
+		zone := ""
+		for candidate, count := range entry.zones {
+			if count > entry.zones[zone] || (count == entry.zones[zone] && candidate < zone) {
+				zone = candidate
+			}
+		}
+		plural := "s"
+		if entry.count == 1 {
+			plural = ""
+		}
+		_, err := fmt.Fprintf(fp, "# %d attribution%s, %s to %s\n%s = %s %s\n",
+			entry.count, plural,
+			entry.first.timestamp.UTC().Format("2006-01-02"),
+			entry.last.timestamp.UTC().Format("2006-01-02"),
+			userid, entry.who, zone)
+		if err != nil {
+			return fmt.Errorf("in writeAuthorCensus: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -5695,7 +6988,7 @@ func (repo *Repository) readLegacyMap(fp io.Reader) error {
 		line := scanner.Text()
 
 		lineError := func(legend string) error {
-			return fmt.Errorf(legend+": line %d %q\n", linecount, line)
+			return fmt.Errorf(legend+": line %d %q", linecount, line)
 		}
 
 		if strings.HasPrefix(line, "#") {
@@ -5732,7 +7025,7 @@ func (repo *Repository) readLegacyMap(fp io.Reader) error {
 			return lineError(err2.Error())
 		}
 		whenWho := dyad{when.timestamp.String(), person}
-		if _, ok := commitMap[whenWho]; ok {
+		if _, ok := commitMap[whenWho]; ok && seq >= 0 && seq < len(commitMap[whenWho]) {
 			repo.legacyMap[legacy] = commitMap[whenWho][seq]
 			if strings.HasPrefix(legacy, "SVN:") {
 				commitMap[whenWho][seq].legacyID = legacy[4:]
@@ -5816,6 +7109,30 @@ func (repo *Repository) writeLegacyMap(fp io.Writer) error {
 	return nil
 }
 
+// writeHashMap writes, for each selected commit the last rebuild
+// recorded, a line of its mark, the object name it got, and its
+// legacy ID or "-" if it has none, separated by tabs.
+func (repo *Repository) writeHashMap(fp io.Writer, selection orderedIntSet) {
+	if selection == nil {
+		selection = repo.all()
+	}
+	for _, idx := range selection {
+		commit, ok := repo.events[idx].(*Commit)
+		if !ok {
+			continue
+		}
+		name, ok := repo.rebuiltHashes[commit.mark]
+		if !ok {
+			continue
+		}
+		legacy := commit.showlegacy()
+		if legacy == "" {
+			legacy = "-"
+		}
+		fmt.Fprintf(fp, "%s\t%s\t%s\n", commit.mark, name, legacy)
+	}
+}
+
 // Turn a commit into a tag.
 func (repo *Repository) tagifyNoCheck(commit *Commit, name string, target string, legend string, delete bool) {
 	if logEnable(logEXTRACT) {
@@ -6034,7 +7351,71 @@ func (repo *Repository) parseDollarCookies() {
 	})
 }
 
-// Audit the repository for uniqueness properties.
+// checkFileops replays the fileops of each selected commit against the
+// manifest of its first parent and reports those that are invalid or
+// no-ops. Such operations otherwise tend to show up only as importer
+// failures at rebuild time.
+func (repo *Repository) checkFileops(selection orderedIntSet, report func(string)) {
+	wanted := make(map[int]bool, len(selection))
+	for _, ei := range selection {
+		wanted[ei] = true
+	}
+	repo.walkManifests(func(idx int, commit *Commit, _ int, firstParent *Commit) {
+		if !wanted[idx] {
+			return
+		}
+		var pm *PathMap
+		if firstParent != nil {
+			pm = firstParent.manifest().snapshot()
+		} else {
+			pm = newPathMap()
+		}
+		complain := func(fileop *FileOp, msg string, args ...interface{}) {
+			report(fmt.Sprintf("%s %s: %s", commit.idMe(),
+				strings.TrimSpace(fileop.String()), fmt.Sprintf(msg, args...)))
+		}
+		for _, fileop := range commit.operations() {
+			switch fileop.op {
+			case deleteall:
+				pm.clear()
+			case opM:
+				if strings.HasPrefix(fileop.ref, ":") {
+					if _, ok := repo.markToEvent(fileop.ref).(*Blob); !ok {
+						complain(fileop, "undefined blob mark %s", fileop.ref)
+					}
+				}
+				if prev, ok := pm.get(fileop.Path); ok {
+					prevop := prev.(*FileOp)
+					if fileop.ref != "inline" && prevop.ref == fileop.ref && prevop.mode == fileop.mode {
+						complain(fileop, "no-op modification")
+					}
+				}
+				pm.set(fileop.Path, fileop)
+			case opD:
+				if pm.has(fileop.Path) {
+					pm.remove(fileop.Path)
+				} else {
+					complain(fileop, "deletion of nonexistent path")
+				}
+			case opC, opR:
+				if !pm.has(fileop.Source) {
+					complain(fileop, "missing source %s", fileop.Source)
+					continue
+				}
+				if fileop.Source == fileop.Path {
+					complain(fileop, "no-op %s", string(fileop.op))
+					continue
+				}
+				pm.copyFrom(fileop.Path, pm, fileop.Source)
+				if fileop.op == opR {
+					pm.remove(fileop.Source)
+				}
+			}
+		}
+	})
+}
+
+// Audit the repository for uniqueness properties.
 func (repo *Repository) checkUniqueness(chatty bool, logHook func(string)) {
 	repo.uniqueness = ""
 	timecheck := make(map[string]Event)
@@ -6065,23 +7446,14 @@ func (repo *Repository) checkUniqueness(chatty bool, logHook func(string)) {
 		for k := range timeCollisions {
 			reps = append(reps, k)
 		}
+		sort.Strings(reps)
 		logHook("These timestamps have multiple commits: " +
 			strings.Join(reps, " "))
 	}
 	stampCollisions := newOrderedStringSet()
-	for _, clique := range timeCollisions {
-		stampcheck := make(map[string]string)
-		for _, event := range clique {
-			commit, ok := event.(*Commit)
-			if !ok {
-				continue
-			}
-			stamp, ok := stampcheck[commit.actionStamp()]
-			if ok {
-				stampCollisions.Add(stamp)
-				//stampCollisions.Add(commit.mark)
-			}
-			stampcheck[stamp] = commit.mark
+	for _, commit := range commits {
+		if repo.stampOrdinal(commit) > 0 {
+			stampCollisions.Add(commit.mark)
 		}
 	}
 	if len(stampCollisions) == 0 {
@@ -6092,6 +7464,7 @@ func (repo *Repository) checkUniqueness(chatty bool, logHook func(string)) {
 		return
 	}
 	if logHook != nil {
+		sort.Strings(stampCollisions)
 		logHook("These marks are in stamp collisions: " +
 			strings.Join(stampCollisions, " "))
 	}
@@ -6106,12 +7479,49 @@ func (repo *Repository) exportStyle() orderedStringSet {
 	return orderedStringSet{"nl-after-commit"}
 }
 
+// notesSupported tells whether N fileops can be shipped to the current
+// write target.  Plain import streams always carry them; only a dump
+// piped to an importer that lacks notes drops them.
+func (repo *Repository) notesSupported() bool {
+	return repo.importing == nil || repo.importing.extensions.Contains("notes")
+}
+
 // Dump the repo object in Subversion dump or fast-export format.
 func (repo *Repository) fastExport(selection orderedIntSet,
 	fp io.Writer, options stringSet, target *VCS) error {
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--shallow=") {
+			return repo.shallowExport(option[len("--shallow="):], fp, options, target)
+		}
+	}
+	return repo.resumeExport(selection, 0, fp, options, target)
+}
+
+// Export the selection, but write only events from index resume
+// onwards; earlier ones are assumed to have been imported already.
+// Passthroughs are always written, so the stream's feature and option
+// declarations are repeated for the importer.
+func (repo *Repository) resumeExport(selection orderedIntSet, resume int,
+	fp io.Writer, options stringSet, target *VCS) error {
+	slice := options.Contains("--slice") && selection != nil
+	if slice {
+		// A slice stands alone: parents outside it are written as
+		// callouts rather than as incremental-dump cookies.
+		options = options.Union(newStringSet("--callout", "--noincremental"))
+	}
 	repo.writeOptions = options
 	repo.preferred = target
 	repo.internals = nil
+	repo.smudging = len(control.contentFilters) > 0
+	defer func() { repo.smudging = false }()
+	if target == nil || target.name == "git" {
+		comments, err := repo.settleTagSignatures()
+		if err != nil {
+			return err
+		}
+		repo.signedComments = comments
+		defer func() { repo.signedComments = nil }()
+	}
 	// Select all blobs implied by the commits in the range. If we ever
 	// go to a representation where fileops are inline this logic will need
 	// to be modified.
@@ -6126,7 +7536,7 @@ func (repo *Repository) fastExport(selection orderedIntSet,
 			}
 			if commit, ok := event.(*Commit); ok {
 				for _, fileop := range commit.operations() {
-					if fileop.op == opM {
+					if fileop.op == opM || fileop.op == opN {
 						idx := repo.markToIndex(fileop.ref)
 						if fileop.ref != "inline" {
 							selection.Add(idx)
@@ -6141,6 +7551,47 @@ func (repo *Repository) fastExport(selection orderedIntSet,
 		}
 		selection.Sort()
 	}
+	dropUnknown := options.Contains("--passthrough=drop")
+	if options.Contains("--passthrough=fail") {
+		for _, ei := range selection {
+			if passthrough, ok := repo.events[ei].(*Passthrough); ok && !passthrough.recognized() {
+				return fmt.Errorf("unrecognized passthrough at event %d: %q", ei+1, passthrough.text)
+			}
+		}
+	}
+	// Optional framing: "feature done" and a final "done" let the
+	// importer detect a truncated stream, and periodic checkpoints
+	// make it flush its work during very long imports.
+	done := options.Contains("--done")
+	checkpoint := 0
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--checkpoint=") {
+			n, err := strconv.Atoi(option[len("--checkpoint="):])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("--checkpoint needs a positive commit count")
+			}
+			checkpoint = n
+		}
+	}
+	declaredDone, sawDone := false, false
+	if done {
+		for _, ei := range selection {
+			if passthrough, ok := repo.events[ei].(*Passthrough); ok {
+				switch strings.TrimSpace(passthrough.text) {
+				case "feature done":
+					// Only counts if the feature filter
+					// below will let it through.
+					declaredDone = target == nil || target.extensions.Contains("done")
+				case "done":
+					sawDone = true
+				}
+			}
+		}
+		if !declaredDone {
+			io.WriteString(fp, "feature done\n")
+		}
+	}
+	written := 0
 	repo.realized = make(map[string]bool)          // Track what branches are made
 	repo.branchPosition = make(map[string]*Commit) // Track what branches are made
 	baton := control.baton
@@ -6148,12 +7599,27 @@ func (repo *Repository) fastExport(selection orderedIntSet,
 	for idx, ei := range selection {
 		baton.twirl()
 		event := repo.events[ei]
+		if ei < resume {
+			// Replay commits and resets without output so the
+			// branch state used to emit resets and parents is
+			// what the importer saw.
+			switch event.(type) {
+			case *Commit, *Reset:
+				event.Save(ioutil.Discard)
+			}
+			if _, ok := event.(*Passthrough); !ok {
+				continue
+			}
+		}
 		if passthrough, ok := event.(*Passthrough); ok {
 			// Support writing bzr repos to plain git if they don't
 			// actually have the extension features their export
 			// streams declare.  Without this check git fast-import
 			// barfs on declarations for unused features.
-			if strings.HasPrefix(passthrough.text, "feature") && !target.extensions.Contains(strings.Fields(passthrough.text)[1]) {
+			if strings.HasPrefix(passthrough.text, "feature") && target != nil && !target.extensions.Contains(strings.Fields(passthrough.text)[1]) {
+				continue
+			}
+			if dropUnknown && !passthrough.recognized() {
 				continue
 			}
 		}
@@ -6165,14 +7631,193 @@ func (repo *Repository) fastExport(selection orderedIntSet,
 			}
 		}
 		event.Save(fp)
+		if _, ok := event.(*Commit); ok && checkpoint > 0 {
+			written++
+			if written%checkpoint == 0 {
+				io.WriteString(fp, "checkpoint\n")
+			}
+		}
 		baton.percentProgress(uint64(idx) + 1)
 	}
 	baton.endProgress()
+	if done && !sawDone {
+		io.WriteString(fp, "done\n")
+	}
 	repo.realized = nil
 	repo.branchPosition = nil
 	return nil
 }
 
+// Export a history truncated according to a --shallow specification,
+// which is either a count of trailing commits to keep or a date
+// before which commits are dropped. Descendants of kept commits are
+// always kept. A kept commit whose first parent was cut away becomes
+// a snapshot root carrying its entire tree.
+func (repo *Repository) shallowExport(spec string,
+	fp io.Writer, options stringSet, target *VCS) error {
+	commits := repo.commits(nil)
+	roots := newFastOrderedIntSet()
+	if count, err := strconv.Atoi(spec); err == nil {
+		if count <= 0 {
+			return fmt.Errorf("shallow commit count must be positive")
+		}
+		for i := max(len(commits)-count, 0); i < len(commits); i++ {
+			roots.Add(repo.eventToIndex(commits[i]))
+		}
+	} else {
+		cutoff, err := newDate(spec)
+		if err != nil {
+			return fmt.Errorf("shallow cutoff is neither a commit count nor a date: %v", err)
+		}
+		for _, commit := range commits {
+			if !commit.committer.date.Before(cutoff) {
+				roots.Add(repo.eventToIndex(commit))
+			}
+		}
+	}
+	kept := repo.accumulateCommits(roots,
+		func(c *Commit) []CommitLike { return c.children() }, true)
+	selection := newOrderedIntSet()
+	type swap struct {
+		commit  *Commit
+		fileops []*FileOp
+	}
+	swaps := make([]swap, 0)
+	for ei, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			if !kept.Contains(ei) {
+				continue
+			}
+			selection.Add(ei)
+			if !event.hasParents() || kept.Contains(repo.eventToIndex(event.parents()[0])) {
+				continue
+			}
+			snapshot := make([]*FileOp, 0)
+			event.manifest().iter(func(path string, pentry interface{}) {
+				// Manifest entries may come from copies or
+				// renames, so their paths can't be trusted.
+				op := *pentry.(*FileOp)
+				op.Path = path
+				snapshot = append(snapshot, &op)
+			})
+			sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Path < snapshot[j].Path })
+			swaps = append(swaps, swap{event, event.fileops})
+			event.fileops = snapshot
+		case *Reset:
+			if e := repo.markToEvent(event.committish); e != nil && kept.Contains(repo.eventToIndex(e)) {
+				selection.Add(ei)
+			}
+		case *Passthrough:
+			selection.Add(ei)
+		}
+	}
+	defer func() {
+		for _, s := range swaps {
+			s.commit.fileops = s.fileops
+		}
+	}()
+	// Parents outside the kept set must be dropped, not turned into
+	// incremental-dump cookies.
+	shallowOptions := newStringSet("--noincremental")
+	for option := range options.Iterate() {
+		if !strings.HasPrefix(option, "--shallow=") {
+			shallowOptions.Add(option)
+		}
+	}
+	return repo.fastExport(selection, fp, shallowOptions, target)
+}
+
+// exportLosses describes content that an export to the target type
+// will drop or that its importer will reject.  Notes are lost only
+// when piped says the export feeds the target's importer directly.
+func (repo *Repository) exportLosses(target *VCS, piped bool) []string {
+	if target == nil {
+		return nil
+	}
+	var properties, multiauthor, signed int
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			if event.hasProperties() && len(event.properties.keys) > 0 {
+				properties++
+			}
+			if len(event.authors) > 1 {
+				multiauthor++
+			}
+		case *Tag:
+			if _, sig := splitSignature(event.Comment); sig != "" {
+				signed++
+			}
+		}
+	}
+	losses := make([]string, 0)
+	if piped && repo.inlines > 0 && !target.extensions.Contains("notes") {
+		losses = append(losses, fmt.Sprintf("%s does not support notes, %d N fileop(s) will be dropped", target.name, repo.inlines))
+	}
+	if properties > 0 && !target.extensions.Contains("commit-properties") {
+		losses = append(losses, fmt.Sprintf("%s does not support commit properties, they will be dropped from %d commit(s)", target.name, properties))
+	}
+	if multiauthor > 0 && !target.extensions.Contains("multiple-authors") {
+		losses = append(losses, fmt.Sprintf("%s does not support multiple authors, %d commit(s) will be rejected by its importer", target.name, multiauthor))
+	}
+	// Only git's exporter is run so signatures survive verbatim.
+	if signed > 0 && target.name != "git" {
+		losses = append(losses, fmt.Sprintf("%s does not support signed tags, %d tag signature(s) will no longer verify", target.name, signed))
+	}
+	return losses
+}
+
+// probeCommand checks that an import command and its prober work.
+func probeCommand(importer string, prober string) error {
+	command := strings.Fields(importer)[0]
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("importer %q is not installed", command)
+	}
+	if prober != "" {
+		err := exec.Command("sh", "-c", prober+" >/dev/null 2>&1").Run()
+		if err != nil {
+			return fmt.Errorf("importer is not usable (%q failed), is a plugin missing?", prober)
+		}
+	}
+	return nil
+}
+
+// probeImporter checks, before a rebuild touches anything, that the
+// importer for the target type is installed and usable, and warns
+// about content it will not preserve. If it is not usable and the
+// fallback policy allows, the first working fallback strategy is
+// chosen instead. Returns the import strategy to use.
+func (repo *Repository) probeImporter(vcs *VCS, policy string) (importStrategy, error) {
+	strategy := importStrategy{importer: vcs.importer, prober: vcs.prober}
+	err := probeCommand(vcs.importer, vcs.prober)
+	if err != nil {
+		err = fmt.Errorf("%s %v", vcs.name, err)
+		if policy == "never" || len(vcs.fallbacks) == 0 {
+			return strategy, err
+		}
+		usable := false
+		for _, fallback := range vcs.fallbacks {
+			if probeCommand(fallback.importer, fallback.prober) == nil {
+				strategy, usable = fallback, true
+				if logEnable(logWARN) {
+					logit("%v; falling back to %s", err, fallback.legend)
+				}
+				break
+			}
+		}
+		if !usable {
+			return strategy, fmt.Errorf("%v, and no fallback strategy is usable", err)
+		}
+	}
+	if logEnable(logWARN) {
+		for _, loss := range repo.exportLosses(vcs, true) {
+			logit(loss)
+		}
+	}
+	return strategy, nil
+}
+
 // Add a path to the preserve set, to be copied back on rebuild.
 func (repo *Repository) preserve(filename string) error {
 	if exists(filename) {
@@ -6198,6 +7843,18 @@ func (repo *Repository) preservable() orderedStringSet {
 	return repo.preserveSet
 }
 
+// Return the paths to be removed from a fresh repository of type vcs
+// before preserved files are copied back into it.
+func (repo *Repository) prenukable(vcs *VCS) orderedStringSet {
+	if repo.prenukeSet != nil {
+		return repo.prenukeSet
+	}
+	if vcs != nil {
+		return vcs.prenuke
+	}
+	return newOrderedStringSet()
+}
+
 // Rename the repo.
 func (repo *Repository) rename(newname string) error {
 	// Can fail if the target directory exists.
@@ -6282,7 +7939,7 @@ func (repo *Repository) filterAssignments(f func(Event) bool) {
 // Mark the repo event sequence modified.
 func (repo *Repository) declareSequenceMutation(warning string) {
 	repo.invalidateMarkToIndex()
-	repo._namecache = nil
+	repo.invalidateNamecache()
 	if len(repo.assignments) > 0 && warning != "" {
 		repo.assignments = nil
 		croak("assignments invalidated by " + warning)
@@ -6324,7 +7981,6 @@ func (repo *Repository) ancestors(ei int) orderedIntSet {
 	return trail
 }
 
-//
 // Delete machinery begins here
 //
 // Count modifications of a path in this commit && its ancestors.
@@ -6593,6 +8249,8 @@ func (repo *Repository) squash(selected orderedIntSet, policy orderedStringSet)
 		event.setDelFlag(false)
 	}
 	var delCount int
+	// Notes on deleted commits go where their tags go
+	noteMoves := make(map[string]string)
 	for _, ei := range selected {
 		var newTarget *Commit
 		event := repo.events[ei]
@@ -6623,6 +8281,9 @@ func (repo *Repository) squash(selected orderedIntSet, policy orderedStringSet)
 				if logEnable(logDELETE) {
 					logit("new target for tags and resets is %s", newTarget.getMark())
 				}
+				noteMoves[commit.mark] = newTarget.mark
+			} else {
+				noteMoves[commit.mark] = ""
 			}
 			// Reparent each child.  Concatenate comments,
 			// ignoring empty-log-message markers.
@@ -6840,6 +8501,7 @@ func (repo *Repository) squash(selected orderedIntSet, policy orderedStringSet)
 	}
 	repo.events = survivors
 	repo.declareSequenceMutation("squash/delete")
+	repo.retargetNotes(noteMoves)
 	// Canonicalize all the commits that got ops pushed to them
 	if coalesce {
 		for _, commit := range altered {
@@ -6901,7 +8563,7 @@ func (repo *Repository) gcBlobs() {
 	backreferences := make(map[string]bool)
 	for _, commit := range repo.commits(nil) {
 		for _, fileop := range commit.operations() {
-			if fileop.op == opM {
+			if fileop.op == opM || fileop.op == opN {
 				backreferences[fileop.ref] = true
 			}
 		}
@@ -7024,8 +8686,10 @@ func (repo *Repository) resort() {
 				if o.op == opM {
 					handle(n, o.ref)
 				} else if o.op == opN {
-					handle(n, o.ref)
-					handle(n, o.committish)
+					if o.ref != nullNoteRef {
+						handle(n, o.ref)
+					}
+					handle(n, o.Path)
 				}
 			}
 		case *Blob:
@@ -7104,8 +8768,168 @@ func (repo *Repository) resort() {
 	}
 }
 
+// fileopResolver decides what to do with a fileop that references a
+// path missing from its commit's ancestry after DAG surgery: 'd' drops
+// it, 'r' retains it as-is, and 's' synthesizes a replacement from the
+// tree the commit saw before the surgery.
+type fileopResolver func(commit *Commit, op *FileOp, path string) byte
+
+// newFileopResolver returns a resolver that prompts for each conflict
+// and reads answers, one per line, from the given input.  End of input
+// selects the default action, which is to drop the op.
+func newFileopResolver(in io.Reader, out io.Writer) fileopResolver {
+	reader := bufio.NewReader(in)
+	echo := true
+	if f, ok := in.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		echo = false
+	}
+	return func(commit *Commit, op *FileOp, path string) byte {
+		choices := "drs"
+		legend := "[d]rop, [r]etain, or [s]ynthesize"
+		if op.op == opD {
+			// Nothing to synthesize for a delete of a missing path
+			choices = "dr"
+			legend = "[d]rop or [r]etain"
+		}
+		for {
+			fmt.Fprintf(out, "%s '%c' fileop references non-existent '%s'; %s? ",
+				commit.idMe(), op.op, path, legend)
+			answer, err := reader.ReadString('\n')
+			answer = strings.TrimSpace(answer)
+			if echo {
+				fmt.Fprintf(out, "%s%s", answer, control.lineSep)
+			}
+			if answer != "" && strings.IndexByte(choices, answer[0]) != -1 {
+				return answer[0]
+			}
+			if err != nil {
+				return 'd'
+			}
+		}
+	}
+}
+
+// resolveFileopConflicts checks a commit's D, R, and C fileops against
+// its ancestry after the DAG around it has been modified.  oldTree is
+// the manifest of the commit's first parent before the modification,
+// used when synthesizing replacement ops.  With a nil resolver,
+// conflicting ops are dropped with a complaint unless bequiet is set.
+func (commit *Commit) resolveFileopConflicts(oldTree *Manifest, resolve fileopResolver, legend string, bequiet bool) {
+	changed := false
+	ops := make([]*FileOp, 0)
+	for _, op := range commit.operations() {
+		var path string
+		if op.op == opD {
+			path = op.Path
+		} else if op.op == opR || op.op == opC {
+			path = op.Source
+		}
+		if path == "" || commit.visible(path) != nil {
+			ops = append(ops, op)
+			continue
+		}
+		action := byte('d')
+		if resolve != nil {
+			action = resolve(commit, op, path)
+		} else if !bequiet {
+			croak("%s '%c' fileop references non-existent '%s' after %s", commit.idMe(), op.op, path, legend)
+		}
+		switch action {
+		case 'r':
+			ops = append(ops, op)
+			continue
+		case 's':
+			// Recreate the target from the old content of the source,
+			// so the commit still yields the tree it did before.
+			if oldTree != nil {
+				if entry, ok := oldTree.get(path); ok {
+					old := entry.(*FileOp)
+					newop := newFileOp(commit.repo)
+					newop.construct(opM, old.mode, old.ref, op.Path)
+					if old.ref == "inline" {
+						newop.inline = old.inline
+					}
+					ops = append(ops, newop)
+					changed = true
+					continue
+				}
+			}
+			if logEnable(logWARN) {
+				logit("%s has no earlier content for '%s', dropping '%c' fileop", commit.idMe(), path, op.op)
+			}
+		}
+		changed = true
+	}
+	if changed {
+		commit.setOperations(ops)
+		if !bequiet && len(ops) == 0 {
+			if logEnable(logWARN) {
+				logit("%s no fileops remain after %s", commit.idMe(), legend)
+			}
+		}
+	}
+}
+
+// firstParentManifest returns the manifest of a commit's first parent,
+// or nil if the commit is a root or its first parent is a callout.
+func (commit *Commit) firstParentManifest() *Manifest {
+	if commit.hasParents() {
+		if parent, ok := commit.parents()[0].(*Commit); ok {
+			return parent.manifest()
+		}
+	}
+	return nil
+}
+
+// moveRange returns the order that moves a contiguous run of commits
+// a number of commits earlier or later along its linear history, as
+// a reorder selection.
+func (repo *Repository) moveRange(selection orderedIntSet, count int, earlier bool) (orderedIntSet, error) {
+	run := repo.commits(selection)
+	sort.Slice(run, func(i, j int) bool { return run[i].index() < run[j].index() })
+	var passed []*Commit
+	if earlier {
+		for current := run[0]; len(passed) < count; {
+			parents := current.parents()
+			if len(parents) == 0 {
+				return nil, fmt.Errorf("no commits before %s to move past", current.idMe())
+			}
+			parent, ok := parents[0].(*Commit)
+			if !ok || len(parents) > 1 || len(parent.children()) != 1 {
+				return nil, fmt.Errorf("non-linear history before %s", current.idMe())
+			}
+			passed = append([]*Commit{parent}, passed...)
+			current = parent
+		}
+	} else {
+		for current := run[len(run)-1]; len(passed) < count; {
+			children := current.children()
+			if len(children) == 0 {
+				return nil, fmt.Errorf("no commits after %s to move past", current.idMe())
+			}
+			child, ok := children[0].(*Commit)
+			if !ok || len(children) > 1 || len(child.parents()) != 1 {
+				return nil, fmt.Errorf("non-linear history after %s", current.idMe())
+			}
+			passed = append(passed, child)
+			current = child
+		}
+	}
+	var order []*Commit
+	if earlier {
+		order = append(append(order, run...), passed...)
+	} else {
+		order = append(append(order, passed...), run...)
+	}
+	out := newOrderedIntSet()
+	for _, commit := range order {
+		out.Add(commit.index())
+	}
+	return out, nil
+}
+
 // Re-order a contiguous range of commits.
-func (repo *Repository) reorderCommits(v []int, bequiet bool) {
+func (repo *Repository) reorderCommits(v []int, bequiet bool, resolve fileopResolver, compensate bool) {
 	if len(v) <= 1 {
 		return
 	}
@@ -7165,7 +8989,12 @@ func (repo *Repository) reorderCommits(v []int, bequiet bool) {
 		croak("commits already in desired order")
 		return
 	}
+	oldTrees := make(map[*Commit]*Manifest)
+	for _, c := range events {
+		oldTrees[c] = c.firstParentManifest()
+	}
 	lastEvent := sortedEvents[len(sortedEvents)-1]
+	oldEnd := lastEvent.manifest()
 	events[0].setParents(sortedEvents[0].parents())
 	// replaceParent modifies the list that we're iterating over, so we walk backwards
 	children := lastEvent.children()
@@ -7175,42 +9004,25 @@ func (repo *Repository) reorderCommits(v []int, bequiet bool) {
 	for i, e := range events[:len(events)-1] {
 		events[i+1].setParents([]CommitLike{e})
 	}
-	fileopSliceEqual := func(a, b []*FileOp) bool {
-		if len(a) != len(b) {
-			return false
-		}
-		for i := range a {
-			if a[i].String() != b[i].String() {
-				return false
-			}
-		}
-		return true
-	}
 	// Check if fileops still make sense after re-ordering events.
 	for _, c := range events {
-		ops := make([]*FileOp, 0)
-		for _, op := range c.operations() {
-			var path string
-			if op.op == opD {
-				path = op.Path
-			} else if op.op == opR || op.op == opC {
-				path = op.Source
-			}
-			if path != "" && c.visible(path) == nil {
-				if !bequiet {
-					croak("%s '%c' fileop references non-existent '%s' after re-order", c.idMe(), op.op, path)
-				}
-				continue
+		c.resolveFileopConflicts(oldTrees[c], resolve, "re-order", bequiet)
+	}
+	// The range should still end with the tree it ended with before,
+	// or the change will show up in every commit after it.
+	newLast := events[len(events)-1]
+	if delta := repo.treeDelta(newLast.manifest(), oldEnd); len(delta) > 0 {
+		if compensate {
+			for _, op := range delta {
+				op.adopt(repo)
 			}
-			ops = append(ops, op)
-		}
-		if !fileopSliceEqual(ops, c.operations()) {
-			c.setOperations(ops)
-			if !bequiet && len(ops) == 0 {
-				if logEnable(logWARN) {
-					logit("%s no fileops remain after re-order", c.idMe())
-				}
+			newLast.setOperations(append(newLast.operations(), delta...))
+		} else if !bequiet {
+			var paths []string
+			for _, op := range delta {
+				paths = append(paths, op.Path)
 			}
+			croak("%s tree differs after re-order at %s", newLast.idMe(), strings.Join(paths, ", "))
 		}
 	}
 	repo.resort()
@@ -7307,13 +9119,21 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 	}
 	for _, commit := range repo.commits(nil) {
 		for i, fileop := range commit.operations() {
-			if fileop.op == opM && strings.HasPrefix(fileop.ref, ":") {
+			if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
 				newmark = remark(fileop.ref, "fileop")
 				if logEnable(logUNITE) {
 					logit(fmt.Sprintf("renumbering %s -> %s in fileop", fileop.ref, newmark))
 				}
 				commit.fileops[i].ref = newmark
 			}
+			// The path of a note op is the committish it annotates
+			if fileop.op == opN && strings.HasPrefix(fileop.Path, ":") {
+				newmark = remark(fileop.Path, "note")
+				if logEnable(logUNITE) {
+					logit(fmt.Sprintf("renumbering %s -> %s in note", fileop.Path, newmark))
+				}
+				commit.fileops[i].Path = newmark
+			}
 		}
 		if baton != nil {
 			baton.bumpcounter()
@@ -7341,6 +9161,59 @@ func (repo *Repository) renumber(origin int, baton *Baton) {
 	}
 }
 
+// saveMarks records the marks that renumber() rewrites and returns a
+// function that puts them back, so a renumbering can be confined to
+// one export.
+func (repo *Repository) saveMarks() func() {
+	type fileopRefs struct {
+		ref  string
+		path string
+	}
+	markseq := repo.markseq
+	marks := make(map[Event]string)
+	refs := make(map[*Commit][]fileopRefs)
+	for _, event := range repo.events {
+		switch event.(type) {
+		case *Blob:
+			marks[event] = event.(*Blob).mark
+		case *Commit:
+			commit := event.(*Commit)
+			marks[event] = commit.mark
+			saved := make([]fileopRefs, len(commit.operations()))
+			for i, fileop := range commit.operations() {
+				saved[i] = fileopRefs{fileop.ref, fileop.Path}
+			}
+			refs[commit] = saved
+		case *Tag:
+			marks[event] = event.(*Tag).committish
+		case *Reset:
+			marks[event] = event.(*Reset).committish
+		}
+	}
+	return func() {
+		for event, mark := range marks {
+			switch event.(type) {
+			case *Blob:
+				event.(*Blob).mark = mark
+			case *Commit:
+				event.(*Commit).mark = mark
+			case *Tag:
+				event.(*Tag).committish = mark
+			case *Reset:
+				event.(*Reset).committish = mark
+			}
+		}
+		for commit, saved := range refs {
+			for i, fileop := range commit.operations() {
+				fileop.ref, fileop.Path = saved[i].ref, saved[i].path
+			}
+		}
+		repo.markseq = markseq
+		repo.invalidateObjectMap()
+		repo.invalidateMarkToIndex()
+	}
+}
+
 // Disambiguate branches, tags, and marks using the specified label.
 func (repo *Repository) uniquify(color string, persist map[string]string) map[string]string {
 	makename := func(oldname string, obj string, fld string, reverse bool) string {
@@ -7452,16 +9325,75 @@ func (repo *Repository) absorb(other *Repository) {
 	other.cleanup()
 }
 
-const invalidGraftIndex = -1
-
-// Graft a repo on to this one at a specified point.
-func (repo *Repository) graft(graftRepo *Repository, graftPoint int, options stringSet) error {
-	var persist map[string]string
-	var anchor *Commit
-	var ok bool
-	if graftPoint == invalidGraftIndex {
-		persist = make(map[string]string)
-	} else {
+// treeDelta returns the fileops that turn one tree into another:
+// deletions of the paths the second lacks, then modifications for the
+// paths it has with a different mode or content. The fileops belong
+// to no repository until adopted.
+func (repo *Repository) treeDelta(before *Manifest, after *Manifest) []*FileOp {
+	content := func(op *FileOp) []byte {
+		if op.ref == "inline" {
+			return op.inline
+		}
+		if blob, ok := repo.markToEvent(op.ref).(*Blob); ok {
+			return blob.getContent()
+		}
+		return nil
+	}
+	same := func(a *FileOp, b *FileOp) bool {
+		if a.mode != b.mode {
+			return false
+		}
+		if a.ref == b.ref {
+			return a.ref != "inline" || bytes.Equal(a.inline, b.inline)
+		}
+		return a.ref != "inline" && b.ref != "inline" && bytes.Equal(content(a), content(b))
+	}
+	var ops []*FileOp
+	for _, pathname := range before.pathnames() {
+		if !after.has(pathname) {
+			ops = append(ops, newFileOp(nil).construct(opD, pathname))
+		}
+	}
+	for _, pathname := range after.pathnames() {
+		value, _ := after.get(pathname)
+		op := value.(*FileOp)
+		if old, ok := before.get(pathname); ok && same(old.(*FileOp), op) {
+			continue
+		}
+		newop := newFileOp(nil).construct(opM, op.mode, op.ref, pathname)
+		if op.ref == "inline" {
+			newop.inline = append([]byte(nil), op.inline...)
+		}
+		ops = append(ops, newop)
+	}
+	return ops
+}
+
+// diffOperations replaces the fileops of a commit with those that turn
+// the tree of its parent into a given tree. Notes are kept.
+func (commit *Commit) diffOperations(before *Manifest, after *Manifest) {
+	ops := commit.repo.treeDelta(before, after)
+	for _, op := range ops {
+		op.adopt(commit.repo)
+	}
+	for _, op := range commit.operations() {
+		if op.op == opN {
+			ops = append(ops, op)
+		}
+	}
+	commit.setOperations(ops)
+}
+
+const invalidGraftIndex = -1
+
+// Graft a repo on to this one at a specified point.
+func (repo *Repository) graft(graftRepo *Repository, graftPoint int, options stringSet) error {
+	var persist map[string]string
+	var anchor *Commit
+	var ok bool
+	if graftPoint == invalidGraftIndex {
+		persist = make(map[string]string)
+	} else {
 		persist = nil
 		where := repo.events[graftPoint]
 		anchor, ok = where.(*Commit)
@@ -7472,22 +9404,34 @@ func (repo *Repository) graft(graftRepo *Repository, graftPoint int, options str
 	}
 	// Errors aren't recoverable after this
 	graftRepo.uniquify(graftRepo.name, persist)
-	var graftroot *Commit
+	var graftroots []*Commit
+	trees := make(map[*Commit]*Manifest)
 	if graftPoint != invalidGraftIndex {
-		graftroot = graftRepo.earliestCommit()
+		for _, commit := range graftRepo.commits(nil) {
+			if !commit.hasParents() {
+				graftroots = append(graftroots, commit)
+				trees[commit] = commit.manifest()
+			}
+		}
 	}
 	repo.absorb(graftRepo)
-	if graftPoint != invalidGraftIndex {
+	for _, graftroot := range graftroots {
 		graftroot.addParentByMark(anchor.mark)
-
-	}
-	if options.Contains("--prune") {
-		// Prepend a deleteall. Roots have nothing upline to preserve.
-		delop := newFileOp(repo)
-		delop.construct(deleteall)
-		graftroot.prependOperation(delop)
+		if options.Contains("--prune") {
+			// Prepend a deleteall. Roots have nothing upline to preserve.
+			delop := newFileOp(repo)
+			delop.construct(deleteall)
+			graftroot.prependOperation(delop)
+		}
 	}
 	repo.renumber(1, nil)
+	if options.Contains("--consistent") && len(graftroots) > 0 {
+		for _, graftroot := range graftroots {
+			graftroot.diffOperations(anchor.manifest(), trees[graftroot])
+		}
+		repo.gcBlobs()
+		repo.renumber(1, nil)
+	}
 	// Resolve all callouts
 	unresolved := make([]string, 0)
 	for _, commit := range repo.commits(nil) {
@@ -7511,6 +9455,101 @@ func (repo *Repository) graft(graftRepo *Repository, graftPoint int, options str
 	return nil
 }
 
+// calloutTarget returns the index of the one commit a callout cookie
+// names, or -1 if it names none or several.
+func (repo *Repository) calloutTarget(cookie string) (target int) {
+	defer func() {
+		if e := catch("command", recover()); e != nil {
+			target = -1
+		}
+	}()
+	if attach := repo.named(cookie); len(attach) == 1 {
+		if _, ok := repo.events[attach[0]].(*Commit); ok {
+			return attach[0]
+		}
+	}
+	return -1
+}
+
+// resolveCallouts rewrites callout parents into real parent links.
+// A callout is resolved when its cookie names exactly one commit
+// earlier in the event sequence; callouts that do not are left in
+// place and their cookies returned.
+//
+// If base is not nil it is the history a segment was cut from: its
+// events are spliced in ahead of this repository's and base is left
+// empty. Unlike graft, this keeps branch and tag names as they are,
+// so that branches cut through continue across the join. It is an
+// error for none of the callouts to match a commit in base.
+func (repo *Repository) resolveCallouts(base *Repository) (int, []string, error) {
+	if base != nil {
+		matched := false
+		for _, commit := range repo.commits(nil) {
+			for _, parent := range commit.parents() {
+				if isCallout(parent.getMark()) && base.calloutTarget(parent.getMark()) != -1 {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return 0, nil, fmt.Errorf("no callouts in %s match commits in %s", repo.name, base.name)
+		}
+		// Make the two mark sequences disjoint before splicing
+		base.renumber(1, nil)
+		repo.renumber(base.markseq+1, nil)
+		// Feature passthroughs have to stay in front
+		front := len(base.frontEvents())
+		features := make(map[string]bool)
+		events := make([]Event, 0, len(base.events)+len(repo.events))
+		for _, event := range base.events {
+			if passthrough, ok := event.(*Passthrough); ok && passthrough.text == "done\n" {
+				continue
+			}
+			if passthrough, ok := event.(*Passthrough); ok && len(events) < front {
+				features[passthrough.text] = true
+			}
+			event.moveto(repo)
+			events = append(events, event)
+		}
+		mine := repo.frontEvents()
+		for _, event := range mine {
+			if passthrough := event.(*Passthrough); !features[passthrough.text] {
+				events = append(events[:front], append([]Event{event}, events[front:]...)...)
+				front++
+			}
+		}
+		repo.events = append(events, repo.events[len(mine):]...)
+		repo.preserveSet = repo.preserveSet.Union(base.preserveSet)
+		for key, commit := range base.legacyMap {
+			repo.legacyMap[key] = commit
+		}
+		repo.declareSequenceMutation("callout resolution")
+		base.events = nil
+	}
+	resolved := 0
+	unresolved := make([]string, 0)
+	for _, commit := range repo.commits(nil) {
+		here := repo.markToIndex(commit.mark)
+		for idx, parent := range commit.parents() {
+			cookie := parent.getMark()
+			if !isCallout(cookie) {
+				continue
+			}
+			if target := repo.calloutTarget(cookie); target != -1 && target < here {
+				commit.removeParent(parent)
+				commit.insertParent(idx, repo.events[target].getMark())
+				resolved++
+			} else {
+				unresolved = append(unresolved, cookie)
+			}
+		}
+	}
+	if base != nil {
+		repo.renumber(1, nil)
+	}
+	return resolved, unresolved, nil
+}
+
 // Apply a hook to all paths, returning the set of modified paths.
 func (repo *Repository) pathWalk(selection orderedIntSet, hook func(string) string) orderedStringSet {
 	if hook == nil {
@@ -7612,6 +9651,166 @@ func (repo *Repository) splitCommitByPrefix(where int, prefix string) error {
 		})
 }
 
+// splitCommitInto splits a commit into as many commits as there are
+// pieces, each piece being the fileops one of them gets.  The original
+// commit keeps the first piece; each later piece goes to a new commit
+// inserted after the one before it.  Returns the commits, in order.
+func (repo *Repository) splitCommitInto(where int, pieces [][]*FileOp) ([]*Commit, error) {
+	commit, ok := repo.events[where].(*Commit)
+	if !ok {
+		return nil, fmt.Errorf("split location %s is not a commit", repo.events[where].idMe())
+	}
+	if len(pieces) < 2 {
+		return nil, errors.New("no-op commit split, repo unchanged")
+	}
+	for i, piece := range pieces {
+		if len(piece) == 0 {
+			return nil, fmt.Errorf("piece %d of the split would have no fileops", i+1)
+		}
+	}
+	if err := splitOrderCheck(commit.operations(), pieces); err != nil {
+		return nil, err
+	}
+	legacyID := commit.legacyID
+	split := []*Commit{commit}
+	for k := 1; k < len(pieces); k++ {
+		head, rest := pieces[k-1], pieces[k:]
+		err := repo.splitCommit(where+k-1,
+			func(ops []*FileOp) ([]*FileOp, []*FileOp, error) {
+				var tail []*FileOp
+				for _, piece := range rest {
+					tail = append(tail, piece...)
+				}
+				return head, tail, nil
+			})
+		if err != nil {
+			return split, err
+		}
+		piece := repo.events[where+k].(*Commit)
+		if legacyID != "" && k > 1 {
+			piece.legacyID = fmt.Sprintf("%s.split%d", legacyID, k)
+		}
+		split = append(split, piece)
+	}
+	commit.invalidateManifests()
+	return split, nil
+}
+
+// splitOrderCheck makes sure every fileop of a commit is in exactly one
+// piece of a split, and that none would be split off ahead of an
+// earlier fileop touching the same path, which would change the order
+// in which they take effect.  A deleteall touches every path.
+func splitOrderCheck(ops []*FileOp, pieces [][]*FileOp) error {
+	pieceOf := make(map[*FileOp]int)
+	for n, piece := range pieces {
+		for _, op := range piece {
+			if _, ok := pieceOf[op]; ok {
+				return errors.New("a fileop is in more than one piece of the split")
+			}
+			pieceOf[op] = n
+		}
+	}
+	if len(pieceOf) != len(ops) {
+		return errors.New("pieces of the split do not match the fileops of the commit")
+	}
+	latest := make(map[string]int) // Index of last fileop touching each path
+	barrier, highest := -1, -1     // Indices of last deleteall and last fileop in the furthest piece
+	follows := func(i int, j int) error {
+		if j >= 0 && pieceOf[ops[i]] < pieceOf[ops[j]] {
+			return fmt.Errorf("fileop %d would be split off ahead of fileop %d, which it follows", i+1, j+1)
+		}
+		return nil
+	}
+	for i, op := range ops {
+		if _, ok := pieceOf[op]; !ok {
+			return fmt.Errorf("fileop %d is in no piece of the split", i+1)
+		}
+		if err := follows(i, barrier); err != nil {
+			return err
+		}
+		if op.op == deleteall {
+			if err := follows(i, highest); err != nil {
+				return err
+			}
+			barrier = i
+		} else {
+			paths := []string{op.Path}
+			if op.op == opR || op.op == opC {
+				paths = append(paths, op.Source)
+			}
+			for _, path := range paths {
+				if j, ok := latest[path]; ok {
+					if err := follows(i, j); err != nil {
+						return err
+					}
+				}
+				latest[path] = i
+			}
+		}
+		if highest < 0 || pieceOf[op] >= pieceOf[ops[highest]] {
+			highest = i
+		}
+	}
+	return nil
+}
+
+// splitByPatterns groups fileops by the first of the patterns that
+// matches their path, or the source of a rename or copy.  Fileops
+// matching none of them make up the first group, if there are any.
+func splitByPatterns(ops []*FileOp, patterns []*regexp.Regexp) ([][]*FileOp, error) {
+	groups := make([][]*FileOp, len(patterns)+1)
+	for _, op := range ops {
+		n := 0
+		for i, pattern := range patterns {
+			if pattern.MatchString(op.Path) || ((op.op == opR || op.op == opC) && pattern.MatchString(op.Source)) {
+				n = i + 1
+				break
+			}
+		}
+		groups[n] = append(groups[n], op)
+	}
+	for i, pattern := range patterns {
+		if len(groups[i+1]) == 0 {
+			return nil, fmt.Errorf("couldn't find '%s' in a fileop path", pattern)
+		}
+	}
+	if len(groups[0]) == 0 {
+		groups = groups[1:]
+	}
+	return groups, nil
+}
+
+// splitByIndices groups fileops by comma-separated lists of their
+// 1-origin indices, each fileop appearing in exactly one list.
+func splitByIndices(ops []*FileOp, lists []string) ([][]*FileOp, error) {
+	groups := make([][]*FileOp, 0, len(lists))
+	seen := make(map[int]bool)
+	for _, list := range lists {
+		var group []*FileOp
+		for _, field := range strings.Split(list, ",") {
+			index, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("expected integer fileop index (1-origin), got %q", field)
+			}
+			if index < 1 || index > len(ops) {
+				return nil, fmt.Errorf("fileop index %d out of range", index)
+			}
+			if seen[index] {
+				return nil, fmt.Errorf("fileop index %d given more than once", index)
+			}
+			seen[index] = true
+			group = append(group, ops[index-1])
+		}
+		groups = append(groups, group)
+	}
+	for i := range ops {
+		if !seen[i+1] {
+			return nil, fmt.Errorf("fileop index %d is in no list", i+1)
+		}
+	}
+	return groups, nil
+}
+
 // Return blob for the nearest ancestor to COMMIT of the specified PATH.
 func (repo *Repository) blobAncestor(commit *Commit, path string) *Blob {
 	var ok bool
@@ -7669,6 +9868,40 @@ func (repo *Repository) dumptimes(w io.Writer) {
 		total)
 }
 
+// keepReplaceRefs adds a reset for each replace ref of the git
+// repository in the current directory, on the commit that replaces,
+// so the replacements survive a rebuild as replacements.
+func (repo *Repository) keepReplaceRefs() error {
+	out, err := captureFromProcess("git for-each-ref --format='%(refname) %(objectname)' refs/replace/")
+	if err != nil {
+		return fmt.Errorf("listing replace refs: %v", err)
+	}
+	byOid := make(map[gitHashType]*Commit)
+	for _, commit := range repo.commits(nil) {
+		if commit.oid.isValid() {
+			byOid[commit.oid] = commit
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// The exporter gives a replaced commit the name of the
+		// commit it stands in for
+		commit, ok := byOid[newGitHash([]byte(strings.TrimPrefix(fields[0], "refs/replace/")))]
+		if !ok {
+			commit, ok = byOid[newGitHash([]byte(fields[1]))]
+		}
+		if ok {
+			repo.addEvent(newReset(repo, fields[0], commit.mark, ""))
+		} else if logEnable(logWARN) {
+			logit("%s does not replace a commit in the history read, dropped", fields[0])
+		}
+	}
+	return nil
+}
+
 // Read a repository using fast-import.
 func readRepo(source string, options stringSet, preferred *VCS, extractor Extractor, quiet bool) (*Repository, error) {
 	if logEnable(logSHUFFLE) {
@@ -7707,8 +9940,10 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 		} else if hitcount > 1 {
 			return nil, fmt.Errorf("too many repos (%d) under %s", hitcount, abspath(source))
 		}
-		// There's only one base match, and vcs is set.  Forward to a matching extractor if need be
-		if vcs.exporter == "" {
+		// There's only one base match, and vcs is set.  Forward to a matching extractor if need be.
+		// The bzr exporter is a plugin that is often missing, so probe for it.
+		// TFVC and VSS have neither; they are read by readTFVC and readVSS.
+		if (vcs.exporter == "" && vcs.name != "tfvc" && vcs.name != "vss") || (vcs.name == "bzr" && probeCommand(vcs.exporter, vcs.prober) != nil) {
 			for _, possible := range importers {
 				if possible.basevcs.manages(source) {
 					extractor = possible.engine
@@ -7749,13 +9984,31 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 	if extractor != nil {
 		repo.stronghint = true
 		streamer := newRepoStreamer(extractor, control.flagOptions["progress"])
+		streamer.options = options
 		repo, err := streamer.extract(repo, vcs)
+		for option := range options.Iterate() {
+			if !strings.HasPrefix(option, "--coloring=") {
+				continue
+			}
+			// Written even if extraction failed; that is when
+			// it is most useful.
+			report := option[len("--coloring="):]
+			if !filepath.IsAbs(report) {
+				report = filepath.Join(here, report)
+			}
+			fp, werr := os.Create(report)
+			if werr != nil {
+				return nil, werr
+			}
+			streamer.writeColoring(fp)
+			fp.Close()
+		}
 		return repo, err
 	}
 	// We found a matching VCS type
 	if vcs != nil {
 		repo.hint("", vcs.name, true)
-		repo.preserveSet = vcs.preserve
+		repo.preserveSet = newOrderedStringSet(vcs.preserve...)
 		suppressBaton := control.flagOptions["progress"] && repo.exportStyle().Contains("export-progress")
 		commandControl := map[string]string{"basename": filepath.Base(repo.sourcedir)}
 		mapper := func(sub string) string {
@@ -7765,13 +10018,53 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 			}
 			return sub
 		}
-		cmd := os.Expand(repo.vcs.exporter, mapper)
-		tp, _, err := readFromProcess(cmd)
-		if err != nil {
-			return nil, err
+		cvsNative := false
+		if vcs.name == "cvs" || vcs.name == "rcs" {
+			_, lookErr := exec.LookPath("cvs-fast-export")
+			cvsNative = options.Contains("--native") || lookErr != nil
+		}
+		if cvsNative {
+			// No cvs-fast-export here, or not wanted; read the masters ourselves
+			if err := repo.readCVS(); err != nil {
+				return nil, err
+			}
+			repo.readtime = time.Now()
+		} else if vcs.name == "git" && options.Contains("--native") {
+			// Read the object database without running git
+			if err := repo.readGit(options.Contains("--bake-replacements")); err != nil {
+				return nil, err
+			}
+			repo.readtime = time.Now()
+		} else if vcs.name == "tfvc" {
+			if err := repo.readTFVC(); err != nil {
+				return nil, err
+			}
+			repo.readtime = time.Now()
+		} else if vcs.name == "vss" {
+			if err := repo.readVSS(); err != nil {
+				return nil, err
+			}
+			repo.readtime = time.Now()
+		} else {
+			cmd := os.Expand(repo.vcs.exporter, mapper)
+			if vcs.name == "git" {
+				// The exporter honors replacements already, but
+				// walking the replace refs would duplicate the
+				// replacement commits
+				cmd = strings.Replace(cmd, " --all", " --exclude='refs/replace/*' --all", 1)
+			}
+			tp, _, err := readFromProcess(cmd)
+			if err != nil {
+				return nil, err
+			}
+			repo.fastImport(context.TODO(), tp, options, source)
+			tp.Close()
+			if vcs.name == "git" && !options.Contains("--bake-replacements") {
+				if err := repo.keepReplaceRefs(); err != nil {
+					return nil, err
+				}
+			}
 		}
-		repo.fastImport(context.TODO(), tp, options, source)
-		tp.Close()
 		if suppressBaton {
 			control.flagOptions["progress"] = true
 		}
@@ -7922,6 +10215,104 @@ func readRepo(source string, options stringSet, preferred *VCS, extractor Extrac
 	return repo, nil
 }
 
+// Read a git bundle by unbundling it into a scratch repository and
+// running the ordinary git exporter there.
+func readBundle(bundle string, options stringSet, quiet bool) (*Repository, error) {
+	bundle, err := filepath.Abs(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("while locating bundle: %v", err)
+	}
+	scratch, err := ioutil.TempDir("", "rsbundle")
+	if err != nil {
+		return nil, fmt.Errorf("while making unbundling directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+	err = runProcess(fmt.Sprintf("git init --quiet %q", scratch), "unbundling")
+	if err != nil {
+		return nil, err
+	}
+	// --update-head-ok is required because the scratch repository's
+	// unborn HEAD names a branch the bundle is likely to carry.
+	err = runProcess(fmt.Sprintf("git -C %q fetch --quiet --update-head-ok %q 'refs/*:refs/*'", scratch, bundle), "unbundling")
+	if err != nil {
+		return nil, err
+	}
+	repo, err := readRepo(scratch, options, findVCS("git"), nil, quiet)
+	if err != nil {
+		return nil, err
+	}
+	// The scratch directory is about to vanish, so it must not
+	// become the default rebuild target.
+	repo.sourcedir = ""
+	return repo, nil
+}
+
+// Write a Mercurial bundle of the repository by rebuilding it as hg
+// in a scratch directory and bundling the result.
+func (repo *Repository) writeHgBundle(fp io.Writer, options stringSet) error {
+	scratch, err := ioutil.TempDir("", "rsbundle")
+	if err != nil {
+		return fmt.Errorf("while making bundling directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+	target := filepath.Join(scratch, "repo")
+	err = repo.rebuildRepo(target, options, findVCS("hg"))
+	if err != nil {
+		return err
+	}
+	bundle := filepath.Join(scratch, "repo.hg")
+	err = runProcess(fmt.Sprintf("hg --quiet -R %q bundle --all %q", target, bundle), "bundling")
+	if err != nil {
+		return err
+	}
+	rfp, err := os.Open(bundle)
+	if err != nil {
+		return err
+	}
+	defer rfp.Close()
+	_, err = io.Copy(fp, rfp)
+	return err
+}
+
+// Locates the marks file an importer is told to export.
+var exportMarksRE = regexp.MustCompile(`--export-marks=(\S+)`)
+
+// readMarks reads a marks file as git fast-import and fast-export
+// write it, one mark and object name per line.
+func readMarks(marksfile string) (map[string]string, error) {
+	fp, err := os.Open(marksfile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	marks := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], ":") {
+			return nil, fmt.Errorf("ill-formed line %q in marks file %s", scanner.Text(), marksfile)
+		}
+		marks[fields[0]] = fields[1]
+	}
+	return marks, scanner.Err()
+}
+
+// Find the index of the first event an interrupted import still needs,
+// by locating the last event whose mark the importer recorded.
+func (repo *Repository) resumePoint(marksfile string) (int, error) {
+	marks, err := readMarks(marksfile)
+	if err != nil {
+		return 0, err
+	}
+	resume := 0
+	for mark := range marks {
+		if idx := repo.markToIndex(mark); idx >= resume {
+			resume = idx + 1
+		}
+	}
+	return resume, nil
+}
+
 // Rebuild a repository from the captured state.
 func (repo *Repository) rebuildRepo(target string, options stringSet,
 	preferred *VCS) error {
@@ -7949,6 +10340,64 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 			vcs.name)
 
 	}
+	policy := "auto"
+	exportMarks := ""
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--fallback=") {
+			policy = option[len("--fallback="):]
+			if policy != "auto" && policy != "never" {
+				return errors.New("fallback policy must be auto or never")
+			}
+		} else if strings.HasPrefix(option, "--export-marks=") {
+			exportMarks = option[len("--export-marks="):]
+		}
+	}
+	var strategy importStrategy
+	if options.Contains("--native") {
+		if vcs.name != "git" {
+			return fmt.Errorf("%s repositories cannot be rebuilt natively", vcs.name)
+		}
+		if options.Contains("--resume") {
+			return errors.New("a native rebuild cannot be resumed")
+		}
+		strategy = importStrategy{builder: "git"}
+	} else {
+		var err error
+		strategy, err = repo.probeImporter(vcs, policy)
+		if err != nil {
+			return err
+		}
+	}
+	importer := strategy.importer
+	marksfile := ""
+	if m := exportMarksRE.FindStringSubmatch(importer); m != nil && strategy.builder == "" {
+		marksfile = m[1]
+	} else if strategy.builder == "git" {
+		marksfile = filepath.Join(".git", "marks")
+	}
+	if exportMarks != "" {
+		if marksfile == "" {
+			return fmt.Errorf("%s importer keeps no marks file to export", vcs.name)
+		}
+		var err error
+		if exportMarks, err = filepath.Abs(exportMarks); err != nil {
+			return err
+		}
+	}
+	resuming := options.Contains("--resume")
+	if resuming {
+		if marksfile == "" {
+			return fmt.Errorf("%s importer keeps no marks file, so its rebuilds cannot be resumed", vcs.name)
+		}
+		for option := range options.Iterate() {
+			if strings.HasPrefix(option, "--shallow=") {
+				return errors.New("a shallow rebuild cannot be resumed")
+			}
+		}
+		if !exists(filepath.Join(target, marksfile)) {
+			return fmt.Errorf("no marks file %s under %s to resume from", marksfile, target)
+		}
+	}
 	chdir := func(directory string, legend string) {
 		os.Chdir(directory)
 		if logEnable(logSHUFFLE) {
@@ -7957,7 +10406,9 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 	}
 	// Create a new empty directory to do the rebuild in
 	var staging string
-	if !exists(target) {
+	if resuming {
+		staging = target
+	} else if !exists(target) {
 		staging = target
 		err := os.Mkdir(target, userReadWriteSearchMode)
 		if err != nil {
@@ -7979,15 +10430,22 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 		return fmt.Errorf("buildRepo is disoriented: %v", err2)
 	}
 	chdir(staging, "staging")
+	keepStaging := false
 	defer func() {
 		chdir(here, "original")
-		if staging != target {
+		if staging != target && !keepStaging {
 			nuke(staging, "reposurgeon: removing staging directory")
 		}
 	}()
 
-	if vcs.initializer != "" {
-		runProcess(vcs.initializer, "repository initialization")
+	if vcs.initializer != "" && !resuming {
+		initializer := vcs.initializer
+		if vcs.name == "git" && repo.objectFormat == "sha256" {
+			// Object names carried over, such as gitlinks, only
+			// make sense in a repository of the same format
+			initializer += " --object-format=sha256"
+		}
+		runProcess(initializer, "repository initialization")
 	}
 	params := map[string]string{"basename": filepath.Base(target)}
 	mapper := func(sub string) string {
@@ -7997,21 +10455,78 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 		}
 		return sub
 	}
-	cmd := os.Expand(vcs.importer, mapper)
-	tp, cls, err := writeToProcess(cmd)
-	if err != nil {
-		return err
-	}
-	repo.fastExport(nil, tp, options, preferred)
-	tp.Close()
-	cls.Wait()
-	if repo.writeLegacy {
-		legacyfile := filepath.FromSlash(vcs.subdirectory + "/legacy-map")
-		wfp, err := os.OpenFile(legacyfile,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
-		if err != nil {
-			return fmt.Errorf("legacy-map file %s could not be written: %v",
-				legacyfile, err)
+	if strategy.builder != "" {
+		if err := builtinBuilders[strategy.builder](repo, options); err != nil {
+			return err
+		}
+	} else {
+		cmd := os.Expand(importer, mapper)
+		resume := 0
+		if resuming {
+			resume, err2 = repo.resumePoint(marksfile)
+			if err2 != nil {
+				return err2
+			}
+			respond("resuming import after event %d.", resume)
+			cmd += " --import-marks=" + marksfile
+		}
+		tp, cls, err := writeToProcess(cmd)
+		if err != nil {
+			return err
+		}
+		repo.importing = preferred
+		if resuming {
+			err = repo.resumeExport(nil, resume, tp, options, preferred)
+		} else {
+			err = repo.fastExport(nil, tp, options, preferred)
+		}
+		repo.importing = nil
+		tp.Close()
+		if werr := cls.Wait(); werr != nil && err == nil {
+			if marksfile == "" {
+				return fmt.Errorf("importer failed: %v", werr)
+			}
+			// The importer dumps its marks as it dies, so keep
+			// what it managed to import for a later resumption.
+			keepStaging = true
+			return fmt.Errorf("importer failed: %v; partial rebuild kept in %s, use 'rebuild --resume %s' to continue it", werr, staging, staging)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if exportMarks != "" {
+		marks, err := ioutil.ReadFile(marksfile)
+		if err == nil {
+			err = ioutil.WriteFile(exportMarks, marks, userReadWriteMode)
+		}
+		if err != nil {
+			return fmt.Errorf("marks could not be exported: %v", err)
+		}
+	}
+	if marksfile != "" {
+		marks, err := readMarks(marksfile)
+		if err != nil {
+			return fmt.Errorf("marks could not be read back: %v", err)
+		}
+		repo.rebuiltHashes = marks
+		hashfile := filepath.FromSlash(vcs.subdirectory + "/hash-map")
+		wfp, err := os.OpenFile(hashfile,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
+		if err != nil {
+			return fmt.Errorf("hash-map file %s could not be written: %v",
+				hashfile, err)
+		}
+		repo.writeHashMap(wfp, nil)
+		wfp.Close()
+	}
+	if repo.writeLegacy {
+		legacyfile := filepath.FromSlash(vcs.subdirectory + "/legacy-map")
+		wfp, err := os.OpenFile(legacyfile,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, userReadWriteMode)
+		if err != nil {
+			return fmt.Errorf("legacy-map file %s could not be written: %v",
+				legacyfile, err)
 		}
 		defer wfp.Close()
 		err = repo.writeLegacyMap(wfp)
@@ -8052,13 +10567,16 @@ func (repo *Repository) rebuildRepo(target string, options stringSet,
 	var savedir string
 	// This is how we clear away hooks directories in
 	// newly-created repos. May not be strictly necessary.
+	prenuke := repo.prenukable(vcs)
 	if logEnable(logSHUFFLE) {
-		logit("Nuking %v from staging %s", vcs.prenuke, staging)
+		logit("Nuking %v from staging %s", prenuke, staging)
 	}
-	if vcs.prenuke != nil {
-		for _, path := range vcs.prenuke {
-			os.RemoveAll(ljoin(staging, path))
+	for _, path := range prenuke {
+		if vcs.name == "git" && repo.objectFormat == "sha256" && path == ".git/config" {
+			// Without its config a SHA-256 repository reads as SHA-1
+			continue
 		}
+		os.RemoveAll(ljoin(staging, path))
 	}
 	if staging == target {
 		// For preservation purposes
@@ -8185,7 +10703,7 @@ func readFromProcess(command string) (io.ReadCloser, *exec.Cmd, error) {
 	}
 	if logEnable(logCOMMANDS) {
 		croak("%s: reading from '%s'\n",
-			rfc3339(time.Now()), command)
+			wallclock(), command)
 	}
 	err = cmd.Start()
 	if err != nil {
@@ -8205,7 +10723,7 @@ func writeToProcess(command string) (io.WriteCloser, *exec.Cmd, error) {
 	}
 	if logEnable(logCOMMANDS) {
 		croak("%s: writing to '%s'\n",
-			rfc3339(time.Now()), command)
+			wallclock(), command)
 	}
 	err = cmd.Start()
 	if err != nil {
@@ -8415,6 +10933,13 @@ func (rl *RepositoryList) cut(early *Commit, late *Commit) bool {
 	os.Mkdir(earlyPart.subdir(""), userReadWriteSearchMode)
 	latePart := newRepository(rl.repo.name + "-late")
 	os.Mkdir(latePart.subdir(""), userReadWriteSearchMode)
+	// The parts share the blob files, or the stream they point into.
+	for _, part := range []*Repository{earlyPart, latePart} {
+		part.seekstream = rl.repo.seekstream
+		part.codec, part.store = rl.repo.codec, rl.repo.store
+		part.flagOptions["compressblobs"] = rl.repo.flagOptions["compressblobs"]
+		part.flagOptions["blobstore"] = rl.repo.flagOptions["blobstore"]
+	}
 	for _, event := range rl.repo.events {
 		if reset, ok := event.(*Reset); ok {
 			if earlyBranches.Contains(reset.ref) {
@@ -8471,6 +10996,7 @@ func (rl *RepositoryList) cut(early *Commit, late *Commit) bool {
 	latePart.events = append(earlyPart.frontEvents(), latePart.events...)
 	latePart.declareSequenceMutation("cut operation")
 	// Add the split results to the repo list.
+	earlyPart.dirty, latePart.dirty = true, true
 	rl.repolist = append(rl.repolist, earlyPart)
 	rl.repolist = append(rl.repolist, latePart)
 	rl.repo.cleanup()
@@ -8478,14 +11004,165 @@ func (rl *RepositoryList) cut(early *Commit, late *Commit) bool {
 	return true
 }
 
+// uniteCollisions finds the paths that the fileops of more than one
+// of the factors of a union touch, either as the same path or as a
+// file in one and a directory in another. It returns them sorted,
+// with the factors touching each, and for each factor the time each
+// of its paths was last touched.
+func uniteCollisions(factors []*Repository) ([]string, map[string][]*Repository, []map[string]time.Time) {
+	touched := make([]map[string]time.Time, len(factors))
+	dirs := make([]map[string]bool, len(factors))
+	fileops := orderedStringSet{string(opM), string(opD), string(opR), string(opC)}
+	for i, factor := range factors {
+		touched[i] = make(map[string]time.Time)
+		dirs[i] = make(map[string]bool)
+		for _, commit := range factor.commits(nil) {
+			for _, op := range commit.operations() {
+				for _, p := range op.paths(fileops) {
+					touched[i][p] = commit.when()
+					for d := path.Dir(p); d != "."; d = path.Dir(d) {
+						dirs[i][d] = true
+					}
+				}
+			}
+		}
+	}
+	owners := make(map[string][]*Repository)
+	claim := func(p string, factor *Repository) {
+		for _, owner := range owners[p] {
+			if owner == factor {
+				return
+			}
+		}
+		owners[p] = append(owners[p], factor)
+	}
+	for i := range factors {
+		for p := range touched[i] {
+			for j := range factors {
+				if j != i && (!touched[j][p].IsZero() || dirs[j][p]) {
+					claim(p, factors[i])
+					claim(p, factors[j])
+				}
+			}
+		}
+	}
+	keys := make([]string, 0, len(owners))
+	for p := range owners {
+		keys = append(keys, p)
+	}
+	sort.Strings(keys)
+	return keys, owners, touched
+}
+
+// movePaths moves the paths touched by the fileops of a repository
+// that are at or under one of a set of paths into a directory. A
+// deleteall becomes a deletion of the directory if everything is moved.
+func (repo *Repository) movePaths(dir string, under []string) {
+	moved := func(p string) bool {
+		if under == nil {
+			return true
+		}
+		for _, key := range under {
+			if p == key || strings.HasPrefix(p, key+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, commit := range repo.commits(nil) {
+		for _, op := range commit.operations() {
+			switch op.op {
+			case opM, opD, opR, opC:
+				if op.Source != "" && moved(op.Source) {
+					op.Source = dir + "/" + op.Source
+				}
+				if moved(op.Path) {
+					op.Path = dir + "/" + op.Path
+				}
+			case deleteall:
+				if under == nil {
+					op.construct(opD, dir)
+				}
+			}
+		}
+		commit.invalidateManifests()
+	}
+}
+
+// uniteResolve deals with path collisions between the factors of a
+// union according to a strategy: "merge" lets their histories touch
+// the same paths, "prefix" moves each factor's content into a
+// directory named after it, "fail" refuses to unite factors that
+// collide, and "newest" leaves each colliding path to the factor that
+// touched it last and moves it into a directory named after the
+// factor in the others.
+func uniteResolve(factors []*Repository, strategy string) error {
+	if strategy == "prefix" {
+		for _, factor := range factors {
+			factor.movePaths(factor.name, nil)
+		}
+		return nil
+	}
+	keys, owners, touched := uniteCollisions(factors)
+	if len(keys) == 0 {
+		return nil
+	}
+	switch strategy {
+	case "merge":
+		if logEnable(logWARN) {
+			logit("united repositories collide at %s", strings.Join(keys, ", "))
+		}
+	case "fail":
+		return fmt.Errorf("united repositories collide at %s", strings.Join(keys, ", "))
+	case "newest":
+		index := make(map[*Repository]int)
+		for i, factor := range factors {
+			index[factor] = i
+		}
+		lastTouch := func(factor *Repository, key string) time.Time {
+			var last time.Time
+			for p, when := range touched[index[factor]] {
+				if (p == key || strings.HasPrefix(p, key+"/")) && when.After(last) {
+					last = when
+				}
+			}
+			return last
+		}
+		losing := make(map[*Repository][]string)
+		for _, key := range keys {
+			winner := owners[key][0]
+			for _, factor := range owners[key][1:] {
+				if lastTouch(factor, key).After(lastTouch(winner, key)) {
+					winner = factor
+				}
+			}
+			for _, factor := range owners[key] {
+				if factor != winner {
+					losing[factor] = append(losing[factor], key)
+				}
+			}
+		}
+		for _, factor := range factors {
+			if len(losing[factor]) > 0 {
+				factor.movePaths(factor.name, losing[factor])
+			}
+		}
+	}
+	return nil
+}
+
 // Unite multiple repos into a union repo.
-func (rl *RepositoryList) unite(factors []*Repository, options stringSet) {
+func (rl *RepositoryList) unite(factors []*Repository, options stringSet, strategy string) {
 	for _, x := range factors {
 		if len(x.commits(nil)) == 0 {
 			croak(fmt.Sprintf("empty factor %s", x.name))
 			return
 		}
 	}
+	if err := uniteResolve(factors, strategy); err != nil {
+		croak(err.Error())
+		return
+	}
 	// Forward time order
 	sort.Slice(factors, func(i, j int) bool {
 		return factors[i].earliest().Before(factors[j].earliest())
@@ -8567,10 +11244,122 @@ func (rl *RepositoryList) unite(factors []*Repository, options stringSet) {
 		}
 	}
 	// Put the result on the load list
+	union.dirty = true
 	rl.repolist = append(rl.repolist, union)
 	rl.choose(union)
 }
 
+// pathPartition describes one of the repositories a partition makes.
+type pathPartition struct {
+	prefix string // Directory that becomes the top of the new tree
+	name   string // Name of the new repository
+	empty  string // What to do with empty commits: prune, tagify, or keep
+}
+
+// partition makes a new repository from the content under each of a
+// set of directories of the selected repo, in one pass over its events.
+// The new repositories share blob files with the original, which is
+// left unchanged. Commits left with no fileops in a new repository are
+// dealt with according to its empty-commit policy.
+func (rl *RepositoryList) partition(specs []pathPartition) []*Repository {
+	repo := rl.repo
+	// Plan every part's fileops first; this only reads the original.
+	commits := repo.commits(nil)
+	rewrites := make([]map[*Commit][]*FileOp, len(specs))
+	needed := make([]map[string]bool, len(specs))
+	for i, spec := range specs {
+		rewrites[i] = make(map[*Commit][]*FileOp)
+		needed[i] = make(map[string]bool)
+		for _, commit := range commits {
+			ops, _ := commit.rerootOps(spec.prefix)
+			rewrites[i][commit] = ops
+			for _, op := range ops {
+				if (op.op == opM || op.op == opN) && strings.HasPrefix(op.ref, ":") {
+					needed[i][op.ref] = true
+				}
+			}
+			control.baton.twirl()
+		}
+	}
+	parts := make([]*Repository, len(specs))
+	copies := make([]map[*Commit]*Commit, len(specs))
+	for i, spec := range specs {
+		part := newRepository(spec.name)
+		os.Mkdir(part.subdir(""), userReadWriteSearchMode)
+		// The parts share the blob files, or the stream they point into.
+		part.seekstream = repo.seekstream
+		part.codec, part.store = repo.codec, repo.store
+		part.flagOptions["compressblobs"] = repo.flagOptions["compressblobs"]
+		part.flagOptions["blobstore"] = repo.flagOptions["blobstore"]
+		part.markseq = repo.markseq
+		parts[i] = part
+		copies[i] = make(map[*Commit]*Commit)
+	}
+	for _, event := range repo.events {
+		for i, part := range parts {
+			switch event := event.(type) {
+			case *Blob:
+				if needed[i][event.mark] {
+					blob := event.clone(part)
+					blob.opset = make(map[*FileOp]bool)
+					part.addEvent(blob)
+				}
+			case *Commit:
+				commit := event.clone(part)
+				if event.hasProperties() {
+					commit.properties = copyOrderedMap(event.properties)
+				}
+				var parents []CommitLike
+				for _, parent := range event.parents() {
+					if original, ok := parent.(*Commit); ok {
+						parents = append(parents, copies[i][original])
+					} else {
+						parents = append(parents, parent)
+					}
+				}
+				commit.setParents(parents)
+				part.addEvent(commit)
+				copies[i][event] = commit
+				for _, op := range rewrites[i][event] {
+					op.adopt(part)
+				}
+				commit.setOperations(rewrites[i][event])
+			case *Tag:
+				var tagger *Attribution
+				if event.tagger != nil {
+					tagger = event.tagger.clone()
+				}
+				tag := newTag(part, event.name, event.committish, tagger, event.Comment)
+				tag.legacyID = event.legacyID
+				part.addEvent(tag)
+			case *Reset:
+				part.addEvent(newReset(part, event.ref, event.committish, event.legacyID))
+			case *Passthrough:
+				part.addEvent(newPassthrough(part, event.text))
+			}
+		}
+	}
+	for i, part := range parts {
+		part.declareSequenceMutation("partition")
+		part.emptyPolicy(specs[i].empty)
+		part.dirty = true
+		rl.repolist = append(rl.repolist, part)
+	}
+	return parts
+}
+
+// graft splices a loaded repository onto the chosen one, at a commit
+// or through callouts, and removes it from the list. A graft that
+// fails before absorbing the repository leaves both untouched.
+func (rl *RepositoryList) graft(graftRepo *Repository, graftPoint int, options stringSet) error {
+	err := rl.repo.graft(graftRepo, graftPoint, options)
+	if graftRepo.events == nil {
+		rl.repo.dirty = true
+		rl.removeByName(graftRepo.name)
+	}
+	return err
+}
+
 // Expunge a set of files from the commits in the selection set.
 func (rl *RepositoryList) expunge(selection orderedIntSet, matchers []string) error {
 	digest := func(toklist []string) (*regexp.Regexp, bool) {
@@ -8791,10 +11580,12 @@ func (rl *RepositoryList) newLineParse(line string, capabilities orderedStringSe
 		lp.outfile = lp.line[match[2*2+0]:match[2*2+1]]
 		if lp.outfile != "" && lp.outfile != "-" {
 			info, err := os.Stat(lp.outfile)
+			regular := false
 			if err == nil {
 				if info.Mode().IsDir() {
 					panic(throw("command", "can't redirect output to %s, which is a directory", lp.outfile))
 				}
+				regular = info.Mode().IsRegular()
 			}
 			// flush the outfile, if it happens to be a file
 			// that Reposurgeon has already opened
@@ -8813,7 +11604,13 @@ func (rl *RepositoryList) newLineParse(line string, capabilities orderedStringSe
 				// already exists we ennsure that any
 				// seekstreams pointing to it will
 				// continue to get valid data.
-				os.Remove(lp.outfile)
+				// Devices such as /dev/null are
+				// opened in place, never unlinked.
+				if regular {
+					os.Remove(lp.outfile)
+				} else {
+					mode |= os.O_TRUNC
+				}
 			}
 			lp.stdout, err = os.OpenFile(lp.outfile, mode, userReadWriteMode)
 			if err != nil {
@@ -8857,12 +11654,10 @@ func (lp *LineParse) Tokens() []string {
 func (lp *LineParse) OptVal(opt string) (val string, present bool) {
 	for _, option := range lp.options {
 		if strings.Contains(option, "=") {
-			parts := strings.SplitN(option, "=", 3)
-			if len(parts) > 1 && parts[0] == opt {
+			parts := strings.SplitN(option, "=", 2)
+			if parts[0] == opt {
 				return parts[1], true
 			}
-			return "", true
-
 		} else if option == opt {
 			return "", true
 		}
@@ -8963,10 +11758,15 @@ func (rs *Reposurgeon) inScript() bool {
 // Command implementation begins here
 //
 
-// DoEOF is the handler for end of command input.
+// DoEOF is the handler for end of command input.  An end-of-file
+// typed at the terminal is refused, like quit, while there is unsaved
+// surgery; piped input cannot be retried, so it always ends the session.
 func (rs *Reposurgeon) DoEOF(lineIn string) bool {
 	if rs.inputIsStdin {
 		respond(control.lineSep)
+		if terminal.IsTerminal(0) && rs.keepsUnsaved("quit", false) {
+			return false
+		}
 	}
 	return true
 }
@@ -8974,20 +11774,45 @@ func (rs *Reposurgeon) DoEOF(lineIn string) bool {
 // HelpQuit says "Shut up, golint!"
 func (rs *Reposurgeon) HelpQuit() {
 	rs.helpOutput(`
-quit
+quit [--force]
 
 Terminate reposurgeon cleanly.
+
+In interactive mode, quit refuses to discard repos altered since they
+were read or last saved, as drop does, unless given --force.
 `)
 }
 
 // DoQuit is the handler for the "quit" command.
 func (rs *Reposurgeon) DoQuit(lineIn string) bool {
-	return true
+	return !rs.keepsUnsaved("quit", strings.TrimSpace(lineIn) == "--force")
 }
 
 //
 // Housekeeping hooks.
 //
+
+// keepsUnsaved complains and returns true if a command leaving
+// reposurgeon would discard surgery that has not been written or
+// rebuilt. Only interactive sessions are protected; a script can
+// simply be run again.
+func (rs *Reposurgeon) keepsUnsaved(verb string, force bool) bool {
+	if !control.isInteractive() || force {
+		return false
+	}
+	var names []string
+	for _, repo := range rs.repolist {
+		if repo.dirty {
+			names = append(names, repo.name)
+		}
+	}
+	if len(names) == 0 {
+		return false
+	}
+	croak("unsaved surgery in %s; use %s --force to discard it", strings.Join(names, ", "), verb)
+	return true
+}
+
 var inlineCommentRE = regexp.MustCompile(`\s+#`)
 
 func (rs *Reposurgeon) buildPrompt() {
@@ -9126,34 +11951,66 @@ func (rs *Reposurgeon) accumulateCommits(subarg *fastOrderedIntSet,
 
 func (repo *Repository) accumulateCommits(subarg *fastOrderedIntSet,
 	operation func(*Commit) []CommitLike, recurse bool) *fastOrderedIntSet {
-	commits := repo.commits(newOrderedIntSet(subarg.Values()...))
 	if !recurse {
 		result := newFastOrderedIntSet()
-		for _, commit := range commits {
+		for _, commit := range repo.commits(newOrderedIntSet(subarg.Values()...)) {
 			for _, x := range operation(commit) {
 				result.Add(repo.eventToIndex(x))
 			}
 		}
 		return result
 	}
+	return repo.walkCommits(subarg, operation, -1)
+}
+
+// walkCommits returns the selection set together with the commits
+// reached from it by repeated application of operation, stopping after
+// depth steps unless depth is negative. Tags and resets in the set
+// stand for the commits they point at, so everything reachable from a
+// tag can be had without chasing its mark.
+func (repo *Repository) walkCommits(subarg *fastOrderedIntSet,
+	operation func(*Commit) []CommitLike, depth int) *fastOrderedIntSet {
 	result := newFastOrderedIntSet(subarg.Values()...)
 	// Populate the queue with selected commits
-	var queue []CommitLike
-	for _, c := range commits {
-		queue = append(queue, c)
-	}
-	// Breadth-first traversal of the graph
-	for len(queue) != 0 {
-		popped := queue[0].(*Commit)
-		queue = queue[1:]
-		for _, commit := range operation(popped) {
-			ind := repo.eventToIndex(commit)
-			if !result.Contains(ind) {
+	var queue []*Commit
+	for _, ei := range subarg.Values() {
+		committish := ""
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			queue = append(queue, event)
+		case *Tag:
+			committish = event.committish
+		case *Reset:
+			committish = event.committish
+		}
+		if committish == "" {
+			continue
+		}
+		if commit, ok := repo.markToEvent(committish).(*Commit); ok {
+			if ind := repo.eventToIndex(commit); !result.Contains(ind) {
 				result.Add(ind)
 				queue = append(queue, commit)
 			}
 		}
 	}
+	// Breadth-first traversal of the graph, a level at a time
+	for level := 0; len(queue) != 0 && (depth < 0 || level < depth); level++ {
+		var next []*Commit
+		for _, popped := range queue {
+			for _, parent := range operation(popped) {
+				commit, ok := parent.(*Commit)
+				if !ok {
+					continue // Can't walk through a callout
+				}
+				ind := repo.eventToIndex(commit)
+				if !result.Contains(ind) {
+					result.Add(ind)
+					next = append(next, commit)
+				}
+			}
+		}
+		queue = next
+	}
 	return result
 }
 
@@ -9356,18 +12213,71 @@ func (rs *Reposurgeon) edit(selection orderedIntSet, line string) {
 					}
 				}
 			}
-			runProcess(editor+" "+blob.materialize(), "editing")
+			blob.materialize()
+			blob.unshare()
+			runProcess(editor+" "+blob.getBlobfile(false), "editing")
 			// recalculate blob.size
 			blob.setBlobfile(blob.getBlobfile(false))
+			rs.chosen().dirty = true
 			return
 		}
 		// Fall through
 	}
 
+	// In incremental mode the selection is fed to the editor a
+	// batch at a time, and each batch is applied as soon as the
+	// editor exits, so no colossal mailbox is ever built.
+	blobs := parse.options.Contains("--blobs")
+	var messages orderedIntSet
+	for _, i := range selection {
+		switch rs.chosen().events[i].(type) {
+		case *Commit, *Tag:
+			messages = append(messages, i)
+		case *Blob:
+			if blobs {
+				messages = append(messages, i)
+			}
+		}
+	}
+	selection = messages
+	batchsize := len(selection)
+	if val, present := parse.OptVal("--incremental"); present {
+		batchsize = 100
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				croak("--incremental batch size must be a positive integer")
+				return
+			}
+			batchsize = n
+		}
+	}
+	for start := 0; start < len(selection); start += batchsize {
+		end := start + batchsize
+		if end > len(selection) {
+			end = len(selection)
+		}
+		if !rs.editBatch(editor, selection[start:end]) {
+			return
+		}
+		if end < len(selection) {
+			if control.getAbort() {
+				respond("edit interrupted after %d of %d messages", end, len(selection))
+				return
+			}
+			respond("%d of %d messages edited", end, len(selection))
+		}
+	}
+}
+
+// editBatch runs the editor on a mailbox of the given events and applies
+// the result.  It returns false if the editor failed or the user emptied
+// the mailbox, either of which ends an incremental session.
+func (rs *Reposurgeon) editBatch(editor string, selection orderedIntSet) bool {
 	file, err1 := ioutil.TempFile(".", "rse")
 	if err1 != nil {
 		croak("creating tempfile for edit: %v", err1)
-		return
+		return false
 	}
 	defer os.Remove(file.Name())
 	for _, i := range selection {
@@ -9378,9 +12288,7 @@ func (rs *Reposurgeon) edit(selection orderedIntSet, line string) {
 		case *Tag:
 			file.WriteString(event.(*Tag).emailOut(nil, i, nil))
 		case *Blob:
-			if parse.options.Contains("--blobs") {
-				file.WriteString(event.(*Blob).emailOut(nil, i, nil))
-			}
+			file.WriteString(event.(*Blob).emailOut(nil, i, nil))
 		}
 	}
 	file.Close()
@@ -9392,9 +12300,14 @@ func (rs *Reposurgeon) edit(selection orderedIntSet, line string) {
 	err := cmd.Run()
 	if err != nil {
 		croak("running editor: %v", err)
-		return
+		return false
+	}
+	if st, err := os.Stat(file.Name()); err == nil && st.Size() == 0 {
+		respond("empty mailbox, edit session ended")
+		return false
 	}
 	rs.DoMsgin("<" + file.Name())
+	return true
 }
 
 // Filter commit metadata (and possibly blobs) through a specified hook.
@@ -9609,8 +12522,13 @@ func (rs *Reposurgeon) DoAssign(line string) bool {
 			croak("No selection")
 			return false
 		}
-		for n, v := range repo.assignments {
-			parse.respond(fmt.Sprintf("%s = %v", n, v))
+		names := make([]string, 0, len(repo.assignments))
+		for n := range repo.assignments {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			parse.respond(fmt.Sprintf("%s = %v", n, repo.assignments[n]))
 		}
 		return false
 	}
@@ -10000,11 +12918,21 @@ func (rs *Reposurgeon) DoTiming(line string) bool {
 // HelpMemory says "Shut up, golint!"
 func (rs *Reposurgeon) HelpMemory() {
 	rs.helpOutput(`
-memory [>OUTFILE]
+memory [--events] [>OUTFILE]
 
 Report memory usage.  Runs a garbage-collect before reporting so the figure will better reflect
 storage currently held in loaded repositories; this will not affect the reported high-water
 mark.
+
+With --events, instead estimate how the memory held by the chosen
+repository divides among kinds of event data: blob structures, inline
+fileop content, commit structures, comment text, attributions,
+fileops, cached manifests, the parent/child graph, commit properties,
+and other events such as tags and resets. Each line gives a count and
+an estimated byte total. The estimate is built from structure sizes
+and the lengths of the data hanging off them, so it shows where memory
+goes rather than matching the heap figure. Blob content is normally
+kept on disk, so it counts only when held inline.
 `)
 }
 
@@ -10012,6 +12940,15 @@ mark.
 func (rs *Reposurgeon) DoMemory(line string) bool {
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
+	if parse.options.Contains("--events") {
+		repo := rs.chosen()
+		if repo == nil {
+			croak("no repo has been chosen.")
+			return false
+		}
+		repo.memoryReport(parse.stdout)
+		return false
+	}
 	var memStats runtime.MemStats
 	debug.FreeOSMemory()
 	runtime.ReadMemStats(&memStats)
@@ -10057,7 +12994,10 @@ func (rs *Reposurgeon) HelpStats() {
 sizes [>OUTFILE]
 
 Report size statistics and import/export method information of the
-currently chosen repository. Supports > redirection.
+currently chosen repository. For a Subversion dump, also report how
+many file copies with identical content were read into a shared blob
+rather than stored again. With the quiet flag on, the time the
+repository was read is omitted. Supports > redirection.
 `)
 }
 
@@ -10093,19 +13033,133 @@ func (rs *Reposurgeon) DoStats(line string) bool {
 				commits++
 			}
 		}
-		fmt.Fprintf(parse.stdout, "%s: %.0fK, %d events, %d blobs, %d commits, %d tags, %d resets, %s.\n",
+		readtime := ""
+		if !control.flagOptions["quiet"] {
+			readtime = ", " + rfc3339(repo.readtime)
+		}
+		fmt.Fprintf(parse.stdout, "%s: %.0fK, %d events, %d blobs, %d commits, %d tags, %d resets%s.\n",
 			repo.name, float64(repo.size())/1000.0, len(repo.events),
-			blobs, commits, tags, resets,
-			rfc3339(repo.readtime))
+			blobs, commits, tags, resets, readtime)
 		if repo.sourcedir != "" {
 			fmt.Fprintf(parse.stdout, "  Loaded from %s\n", repo.sourcedir)
 		}
+		if repo.sharedBlobs > 0 {
+			fmt.Fprintf(parse.stdout, "  %d duplicate blobs shared at read time, saving %d bytes\n",
+				repo.sharedBlobs, repo.sharedBytes)
+		}
 		//if repo.vcs {
 		//    parse.stdout.WriteString(polystr(repo.vcs) + control.lineSep)
 	}
 	return false
 }
 
+// HelpSummary says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSummary() {
+	rs.helpOutput(`
+summary [--json] [>OUTFILE]
+
+Report a summary of the conversion of the currently chosen repository,
+suitable for attaching to a migration ticket: the source type, the
+number of revisions read and commits now present, the branches and tags
+that a write or rebuild would create, the messages logged while reading
+it (its warnings, unless you have enabled more logging than that), and
+the results of a default lint.  Run it after a write or rebuild so the
+counts describe what was written.
+
+With --json the report is a JSON object with the keys "repository",
+"source_type", "revisions_read", "commits", "branches", "tags",
+"read_warnings", and "lint".  Supports > redirection.
+`)
+}
+
+// conversionSummary is the content of the summary report.
+type conversionSummary struct {
+	Repository    string   `json:"repository"`
+	SourceType    string   `json:"source_type"`
+	RevisionsRead int      `json:"revisions_read"`
+	Commits       int      `json:"commits"`
+	Branches      []string `json:"branches"`
+	Tags          []string `json:"tags"`
+	ReadWarnings  []string `json:"read_warnings"`
+	Lint          []string `json:"lint"`
+}
+
+// DoSummary reports a summary of a conversion.
+func (rs *Reposurgeon) DoSummary(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	summary := conversionSummary{
+		Repository:    repo.name,
+		SourceType:    "unknown",
+		RevisionsRead: repo.legacyCount,
+		Commits:       len(repo.commits(nil)),
+		Branches:      make([]string, 0),
+		Tags:          make([]string, 0),
+		ReadWarnings:  make([]string, 0),
+		Lint:          make([]string, 0),
+	}
+	summary.SourceType = repo.sourceType()
+	if summary.RevisionsRead <= 0 {
+		summary.RevisionsRead = repo.readCommits
+	}
+	for ref := range repo.branchmap() {
+		if strings.HasPrefix(ref, "refs/tags/") {
+			summary.Tags = append(summary.Tags, ref)
+		} else {
+			summary.Branches = append(summary.Branches, ref)
+		}
+	}
+	for _, event := range repo.events {
+		if tag, ok := event.(*Tag); ok {
+			summary.Tags = append(summary.Tags, tag.name)
+		}
+	}
+	sort.Strings(summary.Branches)
+	sort.Strings(summary.Tags)
+	summary.ReadWarnings = append(summary.ReadWarnings, repo.readWarnings...)
+	// The default lint checks, less the chatty form of the
+	// uniqueness check.
+	var lintout strings.Builder
+	repo.lint(repo.all(), orderedStringSet{"--connected", "--roots", "--names", "--fileops"}, &lintout)
+	for _, item := range strings.Split(lintout.String(), "\n") {
+		if item != "" {
+			summary.Lint = append(summary.Lint, item)
+		}
+	}
+	repo.checkUniqueness(false, func(s string) {
+		summary.Lint = append(summary.Lint, s)
+	})
+	if parse.options.Contains("--json") {
+		encoder := json.NewEncoder(parse.stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summary); err != nil {
+			croak("while encoding summary: %v", err)
+		}
+		return false
+	}
+	list := func(legend string, items []string) {
+		fmt.Fprintf(parse.stdout, "%s: %d\n", legend, len(items))
+		for _, item := range items {
+			fmt.Fprintf(parse.stdout, "  %s\n", item)
+		}
+	}
+	fmt.Fprintf(parse.stdout, "Repository: %s\n", summary.Repository)
+	fmt.Fprintf(parse.stdout, "Source type: %s\n", summary.SourceType)
+	fmt.Fprintf(parse.stdout, "Revisions read: %d\n", summary.RevisionsRead)
+	fmt.Fprintf(parse.stdout, "Commits: %d\n", summary.Commits)
+	list("Branches", summary.Branches)
+	list("Tags", summary.Tags)
+	list("Read warnings", summary.ReadWarnings)
+	list("Lint problems", summary.Lint)
+	return false
+}
+
 // HelpCount says "Shut up, golint!"
 func (rs *Reposurgeon) HelpCount() {
 	rs.helpOutput(`
@@ -10132,30 +13186,385 @@ func (rs *Reposurgeon) DoCount(lineIn string) bool {
 	return false
 }
 
-// HelpList says "Shut up, golint!"
-func (rs *Reposurgeon) HelpList() {
+// HelpPassthroughs says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPassthroughs() {
 	rs.helpOutput(`
-[SELECTION] list [>OUTFILE]
-
-Display commits in a human-friendly format; the first column is raw
-event numbers, the second a timestamp in local time. If the repository
-has legacy IDs, they will be displayed in the third column. The
-leading portion of the comment follows. Supports > redirection.
+[SELECTION] passthroughs [>OUTFILE]
+
+List passthrough lines in the selection set (defaulting to all) that
+are neither comments nor stream commands import-stream readers are
+expected to accept (done, feature, option, progress, checkpoint).
+Such lines usually come from exotic exporters and may be rejected by
+importers; see the --passthrough option of write for how to handle
+them.  Each line of the report is an event number followed by the
+quoted passthrough text.  Supports > redirection.
 `)
 }
 
-// DoList generates a human-friendly listing of objects.
-func (rs *Reposurgeon) DoList(lineIn string) bool {
-	parse := rs.newLineParse(lineIn, orderedStringSet{"stdout"})
-	defer parse.Closem()
-	w := screenwidth()
-	modifiers := orderedStringSet{}
-	f := func(p *LineParse, i int, e Event) string {
-		c, ok := e.(*Commit)
-		if ok {
-			return c.lister(modifiers, i, w)
-		}
-		return ""
+// DoPassthroughs reports unrecognized passthrough lines.
+func (rs *Reposurgeon) DoPassthroughs(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	for _, ei := range selection {
+		if passthrough, ok := repo.events[ei].(*Passthrough); ok && !passthrough.recognized() {
+			fmt.Fprintf(parse.stdout, "%d %q\n", ei+1, passthrough.text)
+		}
+	}
+	return false
+}
+
+// revpropBaseline is the revision metadata of a commit as the Subversion
+// reader made it, kept so later edits can be written back as revprops.
+type revpropBaseline struct {
+	comment    [sha1.Size]byte
+	committer  Attribution
+	properties *OrderedMap
+}
+
+func newRevpropBaseline(commit *Commit) *revpropBaseline {
+	base := new(revpropBaseline)
+	base.comment = sha1.Sum([]byte(commit.Comment))
+	base.committer = *commit.committer.clone()
+	if commit.hasProperties() {
+		base.properties = copyOrderedMap(commit.properties)
+	}
+	return base
+}
+
+// writeRevprops emits a shell script that applies to a Subversion
+// repository the revprop changes needed to match edits made to the
+// selected commits since they were read.
+func (repo *Repository) writeRevprops(selection orderedIntSet, w io.Writer) {
+	fmt.Fprint(w, "#!/bin/sh\n# Write edited revision metadata back to a Subversion repository.\n")
+	fmt.Fprint(w, "repo=\"${1:?usage: $0 REPOSITORY}\"\n")
+	setrevprop := func(rev string, name string, value string) {
+		fmt.Fprintf(w, "printf '%%s' %s | svnadmin setrevprop \"$repo\" -r %s %s /dev/stdin\n",
+			shellquote.Join(value), rev, shellquote.Join(name))
+	}
+	done := make(map[int]bool)
+	for _, ei := range selection {
+		commit, ok := repo.events[ei].(*Commit)
+		if !ok {
+			continue
+		}
+		base, ok := repo.revpropBase[commit]
+		if !ok || commit.legacyID == "" {
+			continue
+		}
+		// All parts of a split revision share its revprops;
+		// the first one selected speaks for them.
+		revision := legacyRevision(commit.legacyID)
+		if done[revision] {
+			continue
+		}
+		done[revision] = true
+		rev := strconv.Itoa(revision)
+		if sha1.Sum([]byte(commit.Comment)) != base.comment {
+			setrevprop(rev, "svn:log", commit.Comment)
+		}
+		if commit.committer.fullname != base.committer.fullname || commit.committer.email != base.committer.email {
+			setrevprop(rev, "svn:author", commit.committer.userid())
+		}
+		if !commit.committer.date.timestamp.Equal(base.committer.date.timestamp) {
+			setrevprop(rev, "svn:date", commit.committer.date.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"))
+		}
+		// Custom revprops travel as commit properties. Values
+		// that came back through msgin are Go-quoted.
+		props := newOrderedMap()
+		if commit.hasProperties() {
+			props = *commit.properties
+		}
+		for _, name := range props.keys {
+			value := props.get(name)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			if base.properties == nil || !base.properties.has(name) || base.properties.get(name) != value {
+				setrevprop(rev, name, value)
+			}
+		}
+		if base.properties != nil {
+			for _, name := range base.properties.keys {
+				if !props.has(name) {
+					fmt.Fprintf(w, "svnadmin delrevprop \"$repo\" -r %s %s\n", rev, shellquote.Join(name))
+				}
+			}
+		}
+	}
+}
+
+// HelpRevprops says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRevprops() {
+	rs.helpOutput(`
+[SELECTION] revprops [>OUTFILE]
+
+Emit a shell script that writes metadata edits back to the Subversion
+repository this one was read from, for svn-to-svn history cleanup.
+The script takes the path of the repository as its argument.
+
+For each selected commit (defaulting to all) whose metadata differs
+from what the Subversion reader made, the script uses 'svnadmin
+setrevprop' to set svn:log from the comment, svn:author from the user
+part of the committer address, and svn:date from the commit date -
+each only if that field was changed.  Other revprops are carried as
+commit properties, which can be added, changed, or removed with
+Property- headers in msgout/msgin; those edits become setrevprop and
+delrevprop commands.  All parts of a split mixed-branch revision share
+one set of revprops, and the first part selected determines them.
+Commits not read from a Subversion dump are ignored.
+
+Supports > redirection.
+`)
+}
+
+// DoRevprops writes a script that pushes metadata edits back to Subversion.
+func (rs *Reposurgeon) DoRevprops(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if repo.revpropBase == nil {
+		croak("repository was not read from Subversion")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	repo.writeRevprops(selection, parse.stdout)
+	return false
+}
+
+// HelpSplits says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSplits() {
+	rs.helpOutput(`
+splits [>OUTFILE]
+
+List the commits made when the Subversion reader split mixed-branch
+revisions, one per line: event number, legacy ID, and branch. The
+fragments of each revision are listed together, base commit first.
+Fragments since removed by surgery are omitted. The read options that
+control how splits are made are described under "Reading Subversion
+repositories" in the manual. Supports > redirection.
+`)
+}
+
+// DoSplits reports the commits made by splitting mixed Subversion revisions.
+func (rs *Reposurgeon) DoSplits(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if rs.selection != nil {
+		croak("splits does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	for _, fragments := range repo.splits {
+		for _, commit := range fragments {
+			if ei := repo.markToIndex(commit.mark); ei >= 0 && repo.events[ei] == commit {
+				fmt.Fprintf(parse.stdout, "%d %s %s\n", ei+1, commit.legacyID, commit.Branch)
+			}
+		}
+	}
+	return false
+}
+
+// HelpVendored says "Shut up, golint!"
+func (rs *Reposurgeon) HelpVendored() {
+	rs.helpOutput(`
+[SELECTION] vendored [--threshold=PERCENT] [--hashes=FILE] [>OUTFILE]
+
+Flag directory subtrees that look like vendored third-party code, to
+guide decisions about stripping vendor drops before publishing a
+conversion.  Only the selected commits (defaulting to all) are examined.
+
+A directory is reported if it was touched by at least two commits and
+every one of them replaced it wholesale - that is, had fileops on at
+least PERCENT (default 75) of the files in it.  Directories with fewer
+than four files are ignored, and only the smallest directory holding
+each such tree is listed.
+
+With --hashes, FILE lists git tree hashes of known upstream releases,
+one per line followed by a name; blank lines and lines beginning with
+# are ignored.  Such a hash can be made by unpacking a release tarball
+into an empty git repository and running 'git add -A && git write-tree'.
+Any touched directory whose content matches one is reported along with
+the first event at which it matches.
+
+Supports > redirection.
+`)
+}
+
+// DoVendored reports directories that look like vendor drops.
+func (rs *Reposurgeon) DoVendored(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	threshold := 75
+	if val, present := parse.OptVal("--threshold"); present {
+		var err error
+		threshold, err = strconv.Atoi(val)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			croak("--threshold must be a percentage between 1 and 100")
+			return false
+		}
+	}
+	known := make(map[gitHashType]string)
+	if val, present := parse.OptVal("--hashes"); present {
+		data, err := ioutil.ReadFile(val)
+		if err != nil {
+			croak("while reading hashes: %v", err)
+			return false
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			hashref, err := hex.DecodeString(fields[0])
+			if err != nil || len(hashref) != gitObjectFormats[repo.objectFormat] {
+				croak("ill-formed tree hash %q", fields[0])
+				return false
+			}
+			known[gitHashBytes(hashref)] = strings.Join(fields[1:], " ")
+		}
+	}
+	const minimumFiles = 4
+	type dirStats struct {
+		events    []int
+		wholesale int
+		maxsize   int
+	}
+	stats := make(map[string]*dirStats)
+	matched := make(map[string]bool)
+	wanted := make(map[int]bool, len(selection))
+	for _, ei := range selection {
+		wanted[ei] = true
+	}
+	repo.walkManifests(func(idx int, commit *Commit, _ int, _ *Commit) {
+		if !wanted[idx] {
+			return
+		}
+		// Count the fileops falling under each directory
+		touched := make(map[string]int)
+		for _, fileop := range commit.operations() {
+			for _, path := range []string{fileop.Path, fileop.Source} {
+				for dir := filepath.Dir(path); path != "" && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+					touched[dir]++
+				}
+			}
+		}
+		manifest := commit.manifest()
+		for dir, count := range touched {
+			sub := manifest.subtree(dir)
+			size := 0
+			if sub != nil {
+				size = sub.size()
+			}
+			st, ok := stats[dir]
+			if !ok {
+				st = new(dirStats)
+				stats[dir] = st
+			}
+			st.events = append(st.events, idx)
+			if size > 0 && count*100 >= threshold*size {
+				st.wholesale++
+			}
+			if size > st.maxsize {
+				st.maxsize = size
+			}
+			if sub != nil && len(known) > 0 {
+				if name, ok := known[treeHash(sub, repo.objectFormat)]; ok && !matched[dir+"\x00"+name] {
+					matched[dir+"\x00"+name] = true
+					fmt.Fprintf(parse.stdout, "%s\tmatches %s at event %d\n", dir, name, idx+1)
+				}
+			}
+		}
+	})
+	candidates := newOrderedStringSet()
+	for dir, st := range stats {
+		if len(st.events) >= 2 && st.wholesale == len(st.events) && st.maxsize >= minimumFiles {
+			candidates.Add(dir)
+		}
+	}
+	sort.Strings(candidates)
+	for _, dir := range candidates {
+		// Report the smallest tree holding each vendor drop: skip
+		// directories inside a larger candidate, and directories
+		// whose only content is a candidate subdirectory.
+		st := stats[dir]
+		shadowed := false
+		for _, other := range candidates {
+			if other == dir {
+				continue
+			}
+			if strings.HasPrefix(dir, other+"/") && stats[other].maxsize > st.maxsize {
+				shadowed = true
+			} else if strings.HasPrefix(other, dir+"/") && stats[other].maxsize == st.maxsize {
+				shadowed = true
+			}
+		}
+		if shadowed {
+			continue
+		}
+		sort.Ints(st.events)
+		events := make([]string, len(st.events))
+		for i, ei := range st.events {
+			events[i] = strconv.Itoa(ei + 1)
+		}
+		fmt.Fprintf(parse.stdout, "%s\treplaced wholesale by every commit touching it: %s\n",
+			dir, strings.Join(events, ","))
+	}
+	return false
+}
+
+// HelpList says "Shut up, golint!"
+func (rs *Reposurgeon) HelpList() {
+	rs.helpOutput(`
+[SELECTION] list [>OUTFILE]
+
+Display commits in a human-friendly format; the first column is raw
+event numbers, the second a timestamp in local time. If the repository
+has legacy IDs, they will be displayed in the third column. The
+leading portion of the comment follows. Supports > redirection.
+`)
+}
+
+// DoList generates a human-friendly listing of objects.
+func (rs *Reposurgeon) DoList(lineIn string) bool {
+	parse := rs.newLineParse(lineIn, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	w := screenwidth()
+	modifiers := orderedStringSet{}
+	f := func(p *LineParse, i int, e Event) string {
+		c, ok := e.(*Commit)
+		if ok {
+			return c.lister(modifiers, i, w)
+		}
+		return ""
 	}
 	rs.reportSelect(parse, f)
 	return false
@@ -10355,7 +13764,27 @@ disconnected commits, (3) parentless commits, (4) the existence of
 multiple roots, (5) committer and author IDs that don't look
 well-formed as DVCS IDs, (6) multiple child links with identical
 branch labels descending from the same commit, (7) time and
-action-stamp collisions.
+action-stamp collisions, (8) fileops that are invalid or no-ops when
+replayed against the manifest of the commit's first parent - deletes
+of nonexistent paths, copies and renames with a missing source, and
+modifications that reference an undefined blob mark.
+
+With --comments=POLICYFILE, commit comments are checked against the
+rules in the policy file instead of the default checks, one rule per
+line:
+
+subject-length N
+    The first line of a comment may be at most N characters long.
+require REGEXP
+    Every comment must contain a match for REGEXP, e.g. a ticket
+    reference such as [A-Z]+-[0-9]+.
+forbid WORD
+    No comment may contain WORD (case is ignored).
+
+Blank lines and lines beginning with # are ignored. Each violated rule
+is reported with a comma-separated list of the offending event numbers,
+which can be used as the selection of an editing command such as
+msgout.
 
 Give it the -? option for a list of available options.
 
@@ -10374,6 +13803,8 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 --roots         -r     report on multiple roots
 --attributions  -a     report on anomalies in usernames and attributions
 --uniqueness    -u     report on collisions among action stamps
+--fileops       -f     report invalid and no-op fileops
+--comments=FILE        check comments against the policy in FILE
 --options       -?     list available options
 `[1:])
 		return false
@@ -10386,8 +13817,32 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 	if selection == nil {
 		selection = rs.chosen().all()
 	}
+	if policy, present := parse.OptVal("--comments"); present {
+		fp, err := os.Open(policy)
+		if err != nil {
+			croak("can't open policy file: %v", err)
+			return false
+		}
+		rules, err := readCommentPolicy(fp)
+		fp.Close()
+		if err != nil {
+			croak("in %s: %v", policy, err)
+			return false
+		}
+		rs.chosen().checkComments(selection, rules, func(s string) {
+			fmt.Fprintf(parse.stdout, "comment policy %s\n", s)
+		})
+	}
+	rs.chosen().lint(selection, parse.options, parse.stdout)
+	return false
+}
+
+// lint writes a report of suspicious DAG and metadata configurations in
+// the selection.  The options are those of the lint command; an empty
+// set requests the default checks.
+func (repo *Repository) lint(selection orderedIntSet, options orderedStringSet, w io.Writer) {
 	var lintmutex sync.Mutex
-	unmapped := regexp.MustCompile("^[^@]*$|^[^@]*@" + rs.chosen().uuid + "$")
+	unmapped := regexp.MustCompile("^[^@]*$|^[^@]*@" + repo.uuid + "$")
 	shortset := newOrderedStringSet()
 	deletealls := newOrderedStringSet()
 	disconnected := newOrderedStringSet()
@@ -10395,7 +13850,7 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 	emptyaddr := newOrderedStringSet()
 	emptyname := newOrderedStringSet()
 	badaddress := newOrderedStringSet()
-	rs.chosen().walkEvents(selection, func(idx int, event Event) {
+	repo.walkEvents(selection, func(idx int, event Event) {
 		commit, iscommit := event.(*Commit)
 		if !iscommit {
 			return
@@ -10449,59 +13904,64 @@ func (rs *Reposurgeon) DoLint(line string) (StopOut bool) {
 		if commit.committer.fullname == "" {
 			lintmutex.Lock()
 			emptyname.Add(commit.idMe())
+			lintmutex.Unlock()
 		}
 		for _, author := range commit.authors {
 			if author.fullname == "" {
 				lintmutex.Lock()
 				emptyname.Add(commit.idMe())
-
+				lintmutex.Unlock()
 			}
 		}
 	})
 	// This check isn't done by default because these are common in Subverrsion repos
 	// and do not necessarily indicate a problem.
-	if parse.options.Contains("--deletealls") || parse.options.Contains("-d") {
+	if options.Contains("--deletealls") || options.Contains("-d") {
 		sort.Strings(deletealls)
 		for _, item := range deletealls {
-			fmt.Fprintf(parse.stdout, "mid-branch delete: %s\n", item)
+			fmt.Fprintf(w, "mid-branch delete: %s\n", item)
 		}
 	}
-	if parse.options.Empty() || parse.options.Contains("--connected") || parse.options.Contains("-c") {
+	if options.Empty() || options.Contains("--connected") || options.Contains("-c") {
 		sort.Strings(disconnected)
 		for _, item := range disconnected {
-			fmt.Fprintf(parse.stdout, "disconnected commit: %s\n", item)
+			fmt.Fprintf(w, "disconnected commit: %s\n", item)
 		}
 	}
-	if parse.options.Empty() || parse.options.Contains("--roots") || parse.options.Contains("-r") {
+	if options.Empty() || options.Contains("--roots") || options.Contains("-r") {
 		if len(roots) > 1 {
 			sort.Strings(roots)
-			fmt.Fprintf(parse.stdout, "multiple root commits: %v\n", roots)
+			fmt.Fprintf(w, "multiple root commits: %v\n", roots)
 		}
 	}
-	if parse.options.Empty() || parse.options.Contains("--names") || parse.options.Contains("-n") {
+	if options.Empty() || options.Contains("--names") || options.Contains("-n") {
 		sort.Strings(shortset)
 		for _, item := range shortset {
-			fmt.Fprintf(parse.stdout, "unknown shortname: %s\n", item)
+			fmt.Fprintf(w, "unknown shortname: %s\n", item)
 		}
 		sort.Strings(emptyaddr)
 		for _, item := range emptyaddr {
-			fmt.Fprintf(parse.stdout, "empty committer address: %s\n", item)
+			fmt.Fprintf(w, "empty committer address: %s\n", item)
 		}
 		sort.Strings(emptyname)
 		for _, item := range emptyname {
-			fmt.Fprintf(parse.stdout, "empty committer name: %s\n", item)
+			fmt.Fprintf(w, "empty committer name: %s\n", item)
 		}
 		sort.Strings(badaddress)
 		for _, item := range badaddress {
-			fmt.Fprintf(parse.stdout, "email address missing @: %s\n", item)
+			fmt.Fprintf(w, "email address missing @: %s\n", item)
 		}
 	}
-	if parse.options.Empty() || parse.options.Contains("--uniqueness") || parse.options.Contains("-u") {
-		rs.chosen().checkUniqueness(true, func(s string) {
-			fmt.Fprint(parse.stdout, "reposurgeon: "+s+control.lineSep)
+	if options.Empty() || options.Contains("--uniqueness") || options.Contains("-u") {
+		repo.checkUniqueness(true, func(s string) {
+			fmt.Fprint(w, "reposurgeon: "+s+control.lineSep)
+		})
+	}
+	if options.Empty() || options.Contains("--fileops") || options.Contains("-f") {
+		repo.checkFileops(selection, func(s string) {
+			fmt.Fprintf(w, "bad fileop: %s\n", s)
 		})
 	}
-	return false
 }
 
 //
@@ -10756,11 +14216,15 @@ func (rs *Reposurgeon) DoChoose(line string) bool {
 // HelpDrop says "Shut up, golint!"
 func (rs *Reposurgeon) HelpDrop() {
 	rs.helpOutput(`
-drop [REPO-NAME]
+drop [--force] [REPO-NAME]
 
 Drop a repo named by the argument from reposurgeon's list, freeing the memory
 used for its metadata and deleting on-disk blobs. With no argument, drops the
 currently chosen repo. Tab-completes on the list of loaded repositories.
+
+In interactive mode, a repo that has been altered since it was read or
+last saved by a whole-repository write to a file or pipe, or by a
+rebuild, is not dropped without --force.
 `)
 }
 
@@ -10781,6 +14245,9 @@ func (rs *Reposurgeon) DoDrop(line string) bool {
 		croak("drop does not take a selection set")
 		return false
 	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	line = parse.line
 	if line == "" {
 		if rs.chosen() == nil {
 			croak("no repo has been chosen.")
@@ -10789,6 +14256,10 @@ func (rs *Reposurgeon) DoDrop(line string) bool {
 		line = rs.chosen().name
 	}
 	if rs.reponames().Contains(line) {
+		if control.isInteractive() && rs.repoByName(line).dirty && !parse.options.Contains("--force") {
+			croak("%s has unsaved surgery; use drop --force to discard it", line)
+			return false
+		}
 		if rs.chosen() != nil && line == rs.chosen().name {
 			rs.unchoose()
 		}
@@ -10835,16 +14306,28 @@ func (rs *Reposurgeon) DoRename(line string) bool {
 // HelpPreserve says "Shut up, golint!"
 func (rs *Reposurgeon) HelpPreserve() {
 	rs.helpOutput(`
-preserve [PATH...]
-
-Add (presumably untracked) files or directories to the repo's list of
-paths to be restored from the backup directory after a rebuild. Each
-argument, if any, is interpreted as a pathname.  The current preserve
-list is displayed afterwards.
+preserve [--prenuke] [list] [>OUTFILE]
+preserve [--prenuke] [add] PATH...
+preserve [--prenuke] remove PATH...
+
+Manage the repo's list of paths to be restored from the backup
+directory after a rebuild, such as site-specific hooks, CI
+configuration, or large untracked test fixtures.  Its default depends
+on the repository type.
+
+With 'add', or with no verb at all, each argument is added to the
+list; each must name an existing file or directory.  With 'remove'
+each argument is taken off the list.  With 'list', or with no verb
+and no arguments, the list is reported one path per line.
+
+With --prenuke, the same verbs operate instead on the list of paths
+deleted from the freshly made repository before preserved files are
+copied back, so that an old copy can replace the new one.  Its
+default is that of the preferred type, or of the type read.
 `)
 }
 
-// DoPreserve adds files and subdirectories to the preserve set.
+// DoPreserve manages the preserve and prenuke sets.
 func (rs *Reposurgeon) DoPreserve(line string) bool {
 	if rs.selection != nil {
 		croak("preserve does not take a selection set")
@@ -10854,10 +14337,67 @@ func (rs *Reposurgeon) DoPreserve(line string) bool {
 		croak("no repo has been chosen.")
 		return false
 	}
-	for _, filename := range strings.Fields(line) {
-		rs.chosen().preserve(filename)
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	prenuke := parse.options.Contains("--prenuke")
+	args := strings.Fields(parse.line)
+	verb := "add"
+	if len(args) == 0 {
+		verb = "list"
+	} else if args[0] == "add" || args[0] == "remove" || args[0] == "list" {
+		verb, args = args[0], args[1:]
+	}
+	if prenuke && verb != "list" && repo.prenukeSet == nil {
+		vcs := rs.preferred
+		if vcs == nil {
+			vcs = repo.vcs
+		}
+		repo.prenukeSet = newOrderedStringSet(repo.prenukable(vcs)...)
+	}
+	switch verb {
+	case "add":
+		for _, path := range args {
+			if prenuke {
+				repo.prenukeSet.Add(path)
+			} else if err := repo.preserve(path); err != nil {
+				croak(err.Error())
+				return false
+			}
+		}
+	case "remove":
+		for _, path := range args {
+			if prenuke {
+				if !repo.prenukeSet.Contains(path) {
+					croak("%s is not prenuked", path)
+					return false
+				}
+				repo.prenukeSet.Remove(path)
+			} else if err := repo.unpreserve(path); err != nil {
+				croak(err.Error())
+				return false
+			}
+		}
+	case "list":
+		paths := repo.preservable()
+		if prenuke {
+			vcs := rs.preferred
+			if vcs == nil {
+				vcs = repo.vcs
+			}
+			paths = repo.prenukable(vcs)
+		}
+		for _, path := range paths {
+			fmt.Fprintln(parse.stdout, path)
+		}
+		return false
+	}
+	repo.dirty = true
+	if prenuke {
+		respond("prenuking %s.", repo.prenukeSet)
+	} else {
+		respond("preserving %s.", repo.preservable())
 	}
-	respond("preserving %s.", rs.chosen().preservable())
 	return false
 }
 
@@ -10869,7 +14409,8 @@ unpreserve [PATH...]
 Remove (presumably untracked) files or directories to the repo's list
 of paths to be restored from the backup directory after a
 rebuild. Each argument, if any, is interpreted as a pathname.  The
-current preserve list is displayed afterwards.
+current preserve list is displayed afterwards. This is the same as
+'preserve remove'.
 `)
 }
 
@@ -10886,6 +14427,7 @@ func (rs *Reposurgeon) DoUnpreserve(line string) bool {
 	for _, filename := range strings.Fields(line) {
 		rs.chosen().unpreserve(filename)
 	}
+	rs.chosen().dirty = true
 	respond("preserving %s.", rs.chosen().preservable())
 	return false
 }
@@ -10897,7 +14439,7 @@ func (rs *Reposurgeon) DoUnpreserve(line string) bool {
 // HelpRead says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRead() {
 	rs.helpOutput(`
-read  [--OPTION...] [<INFILE | DIRECTORY]
+read  [--OPTION...] [<INFILE | DIRECTORY | BUNDLE]
 
 A read command with no arguments is treated as 'read .', operating on the
 current directory.
@@ -10913,8 +14455,58 @@ With an argument of '-', this command reads a fast-import stream or
 Subversion dump from standard input (this will be useful in filters
 constructed with command-line arguments).
 
+With the name of a file ending in '.bundle', this command reads a git
+bundle by unbundling it into a scratch repository and exporting that.
+All refs in the bundle become branches and tags of the result.
+
 The --format option can be used to read in binary repository dump files.
 For a list of supported types, invoke the 'prefer' command.
+
+When a repository is read through one of reposurgeon's own extractors
+(for example hg), the --coloring=FILE option writes a report to FILE
+giving, for each extracted revision, the branch it was assigned and
+why: as a branch tip, by coloring back from a child, from hg branch
+metadata, or not at all. This is the place to look when a read fails
+with "some branches do not have local ref names".
+
+By default, when a Mercurial repository has tags or bookmarks the hg
+extractor simulates git's branch-coloring algorithm so the result
+matches what a git conversion would produce. The --hg-branches option
+skips the simulation and uses Mercurial's named-branch assignments
+for every commit.
+
+CVS and RCS collections are read through cvs-fast-export when it is
+installed, and otherwise by reposurgeon's own parser for ,v master
+files. The --native option uses the built-in parser even when
+cvs-fast-export is available.
+
+On a git repository, the --native option reads the object database,
+packfiles and loose objects, directly instead of running git
+fast-export. Commit hashes are kept as original IDs, and commit
+signatures and other headers the exporter drops are kept as commit
+properties. SHA-256 repositories are read as well as SHA-1 ones, and
+a repository read from one is rebuilt in the same object format.
+
+Reading a git repository honors its replace refs and info/grafts file,
+so the history read is the one git log shows. The replace refs become
+resets on the replacing commits; with --bake-replacements they are
+dropped, making the replacements a permanent part of the history.
+
+With --import-marks=FILE, a stream that continues an earlier
+conversion may refer to marks made by that conversion, such as an
+incremental "git fast-export --import-marks" stream. FILE is the marks
+file the earlier rebuild exported (see 'rebuild'), and references to
+marks it holds and the stream does not define are replaced by the
+object names it gives them: parents become callouts, and file content
+refers to the existing blob. The result can be written as a stream
+for git fast-import to apply to the earlier conversion.
+
+A TFVC project is read through the tf client from a local workspace
+mapping it; the tf command must be on your path.
+
+A Visual SourceSafe database is read through the ss client, run in
+the database directory (the one holding srcsafe.ini); the ss command
+must be on your path, and SSUSER set if the default login won't do.
 `)
 }
 
@@ -10928,6 +14520,15 @@ func (rs *Reposurgeon) DoRead(line string) bool {
 	// Don't do parse.Closem() here - you'll nuke the seaakstream that
 	// we use to get content out of dump streams.
 	var repo *Repository
+	// Keep the gripes made while reading for the summary report
+	control.startCapture()
+	defer func() {
+		warnings := control.endCapture()
+		if repo != nil {
+			repo.readWarnings = warnings
+			repo.readCommits = len(repo.commits(nil))
+		}
+	}()
 	if parse.redirected {
 		repo = newRepository("")
 		for _, option := range parse.options {
@@ -10980,10 +14581,25 @@ func (rs *Reposurgeon) DoRead(line string) bool {
 			croak(err2.Error())
 			return false
 		}
+	} else if isfile(parse.line) && strings.HasSuffix(parse.line, ".bundle") {
+		var err2 error
+		repo, err2 = readBundle(parse.line, parse.options.toStringSet(), control.flagOptions["quiet"])
+		if err2 != nil {
+			croak(err2.Error())
+			return false
+		}
+		parse.infile = strings.TrimSuffix(parse.line, ".bundle")
 	} else {
 		croak("read no longer takes a filename argument - use < redirection instead")
 		return false
 	}
+	if len(control.contentFilters) > 0 {
+		if count := repo.cleanContent(repo.commits(nil)); count > 0 {
+			// The repository no longer matches what was read.
+			repo.dirty = true
+			respond("%d files cleaned on read.", count)
+		}
+	}
 	rs.repolist = append(rs.repolist, repo)
 	rs.choose(repo)
 	if rs.chosen() != nil {
@@ -11008,7 +14624,7 @@ func (rs *Reposurgeon) DoRead(line string) bool {
 // HelpWrite says "Shut up, golint!"
 func (rs *Reposurgeon) HelpWrite() {
 	rs.helpOutput(`
-[SELECTION] write [--legacy] [--format=fossil] [--noincremental] [--callout]  [>OUTFILE|-]
+[SELECTION] write [--legacy] [--format=fossil|hgbundle|svn] [--shallow=COUNT|DATE] [--passthrough=POLICY] [--slice] [--noincremental] [--callout] [--done] [--checkpoint=N] [>OUTFILE|-]
 
 Dump a fast-import stream representing selected events to standard
 output (if second argument is empty or '-') or via > redirect to a file.
@@ -11020,8 +14636,40 @@ nonempty its contents are backed up to a save directory.
 Property extensions will be omitted if the importer for the
 preferred repository type cannot digest them.
 
-The --fossil option can be used to write out binary repository dump files.
+The --format option can be used to write out binary repository dump files.
 For a list of supported types, invoke the 'prefer' command.
+
+With --format=hgbundle, the repository is rebuilt as Mercurial in a
+scratch directory and written out as a single 'hg bundle --all' file;
+as with a rebuild, any selection set is ignored.
+
+With --format=svn, the whole repository is written as a Subversion
+dumpfile that 'svnadmin load' can digest: master becomes trunk, other
+branches go under branches/, tags become copies under tags/, merges
+are recorded as svn:mergeinfo, and .gitignore files become svn:ignore
+and svn:global-ignores properties. Any selection set is ignored.
+
+With --shallow, history is truncated: only the last COUNT commits, or
+the commits made at or after DATE, are written, together with all
+their descendants. Each kept commit whose first parent was cut away
+becomes a snapshot root carrying its whole tree. Any selection set is
+ignored. This also works on a rebuild into a directory.
+
+The --passthrough option sets the policy for passthrough lines that
+are not recognized stream commands (see 'help passthroughs'): 'preserve'
+writes them verbatim (the default), 'drop' omits them, and 'fail'
+refuses to write anything if any are selected.
+
+With --slice, the selected events are written as a self-contained
+slice for review: referenced blobs and attached tags and resets are
+included as usual, and parents outside the selection are written as
+callouts rather than as incremental-dump cookies.  It is equivalent to
+--callout --noincremental.
+
+With --done, the stream begins with 'feature done' and ends with 'done',
+so that git fast-import can tell a truncated stream from a complete one.
+With --checkpoint=N, a 'checkpoint' command follows every N commits,
+making the importer flush its work to disk during a very long import.
 `)
 }
 
@@ -11040,12 +14688,50 @@ func (rs *Reposurgeon) DoWrite(line string) bool {
 	}
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
+	if policy, present := parse.OptVal("--passthrough"); present {
+		if policy != "preserve" && policy != "drop" && policy != "fail" {
+			croak("passthrough policy must be preserve, drop, or fail")
+			return false
+		}
+	}
+	// Surgery leaves gaps and disorder in the marks that would
+	// otherwise differ between runs taking different paths.  The
+	// renumbering is for this write only; the loaded repository
+	// keeps its marks.
+	if control.flagOptions["deterministic"] {
+		defer rs.chosen().saveMarks()()
+		rs.chosen().renumber(1, nil)
+	}
+	// A whole stream sent to a file or pipe is saved; one shown on
+	// the terminal is not.
+	saved := func() {
+		if rs.selection == nil && (parse.outfile != "" && parse.outfile != "-" || !control.isInteractive()) {
+			rs.chosen().dirty = false
+		}
+	}
 	// This is slightly asymmetrical with the read side, which
 	// interprets an empty argument list as '.'
 	if parse.redirected || parse.line == "" {
 		for _, option := range parse.options {
 			if strings.HasPrefix(option, "--format=") {
 				_, vcs := splitRuneFirst(option, '=')
+				if vcs == "hgbundle" {
+					err := rs.chosen().writeHgBundle(parse.stdout, parse.options.toStringSet())
+					if err != nil {
+						croak(err.Error())
+					} else {
+						saved()
+					}
+					return false
+				}
+				if vcs == "svn" {
+					if err := rs.chosen().svnDump(parse.stdout); err != nil {
+						croak(err.Error())
+					} else {
+						saved()
+					}
+					return false
+				}
 				outfilter, ok := fileFilters[vcs]
 				if !ok {
 					croak("unrecognized --format")
@@ -11071,11 +14757,23 @@ func (rs *Reposurgeon) DoWrite(line string) bool {
 				break
 			}
 		}
-		rs.chosen().fastExport(rs.selection, parse.stdout, parse.options.toStringSet(), rs.preferred)
+		if logEnable(logWARN) {
+			for _, loss := range rs.chosen().exportLosses(rs.preferred, false) {
+				logit(loss)
+			}
+		}
+		err := rs.chosen().fastExport(rs.selection, parse.stdout, parse.options.toStringSet(), rs.preferred)
+		if err != nil {
+			croak(err.Error())
+		} else {
+			saved()
+		}
 	} else if isdir(parse.line) {
 		err := rs.chosen().rebuildRepo(parse.line, parse.options.toStringSet(), rs.preferred)
 		if err != nil {
 			croak(err.Error())
+		} else {
+			rs.chosen().dirty = false
 		}
 	} else {
 		croak("write no longer takes a filename argument - use > redirection instead")
@@ -11216,6 +14914,7 @@ func (rs *Reposurgeon) DoStrip(line string) bool {
 		repo.delete(deletia, nil)
 		respond("From %d to %d events.", oldlen, len(repo.events))
 	}
+	repo.dirty = true
 	return false
 }
 
@@ -11303,13 +15002,42 @@ func (rs *Reposurgeon) DoGraph(line string) bool {
 // HelpRebuild says "Shut up, golint!"
 func (rs *Reposurgeon) HelpRebuild() {
 	rs.helpOutput(`
-rebuild {DIRECTORY}
+rebuild [--resume] [--fallback=auto|never] [--native] [--export-marks=FILE] {DIRECTORY}
 
 Rebuild a repository from the state held by reposurgeon.  The argument
 specifies the target directory in which to do the rebuild; if the
 repository read was from a repo directory (and not a git-import stream), it
 defaults to that directory.  If the target directory is nonempty
 its contents are backed up to a save directory.
+
+Before anything is touched, the importer for the target type is probed;
+if it or a plugin it needs is missing the rebuild is refused unless a
+fallback (see below) is usable, and warnings are issued for content it
+will not preserve, such as notes, commit properties, multiple authors,
+or tag signatures.
+
+Some types have fallback strategies for when the preferred importer
+is missing; for hg, the hg-fastimport extension, a scratch git
+import run through 'hg convert', or a built-in builder driving stock
+hg commit by commit, and for bzr, Breezy's fast-import.
+With the default --fallback=auto, the first usable fallback is taken
+with a warning saying why; with --fallback=never the rebuild is refused
+instead. The 'prefer' command lists each type's fallbacks.
+
+If the importer dies partway through, and it keeps a marks file (as
+git's does), the partially imported repository is kept and
+'rebuild --resume DIRECTORY' continues the import from the last
+event the importer recorded instead of starting over.
+
+With --native, a git repository is built by writing its objects and
+refs directly rather than through git fast-import. Unaltered commits
+keep their hashes, time zones and encodings, and commit signatures
+are kept on commits that still hash to what was signed.
+
+With --export-marks=FILE, the importer's marks, mapping the marks of
+blobs and commits to the git object names they were given, are
+written to FILE for a later 'read --import-marks' to continue from.
+The native git builder writes marks too.
 `)
 }
 
@@ -11328,13 +15056,325 @@ func (rs *Reposurgeon) DoRebuild(line string) bool {
 	err := rs.chosen().rebuildRepo(parse.line, parse.options.toStringSet(), rs.preferred)
 	if err != nil {
 		croak(err.Error())
+	} else {
+		rs.chosen().dirty = false
 	}
 	return false
 }
 
-//
-// Editing commands
-//
+// HelpExport says "Shut up, golint!"
+func (rs *Reposurgeon) HelpExport() {
+	rs.helpOutput(`
+export [--OPTION...] [DIRECTORY] [>OUTFILE]
+
+One-shot export: read the repository in DIRECTORY (the current
+directory if none is given) and write it as a fast-import stream to
+standard output or a > redirect. The repository is not added to the
+repository list and is discarded afterwards. Options are passed to
+both the read and the write, so that, for example, --no-implicit and
+--done can be combined.
+
+This is meant to be used as a subcommand on the reposurgeon invocation
+line, where all the arguments after 'export' are taken as a single
+command:
+
+    reposurgeon export --done myrepo >myrepo.fi
+`)
+}
+
+// DoExport reads a repository and writes it as a stream in one step.
+func (rs *Reposurgeon) DoExport(line string) bool {
+	if rs.selection != nil {
+		croak("export does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	source := parse.line
+	if source == "" {
+		source = "."
+	}
+	if !isdir(source) {
+		croak("export needs a repository directory, not %q", source)
+		return false
+	}
+	options := parse.options.toStringSet()
+	repo, err := readRepo(source, options, rs.preferred, rs.extractor, control.flagOptions["quiet"])
+	if err != nil {
+		croak(err.Error())
+		return false
+	}
+	defer repo.cleanup()
+	target := rs.preferred
+	if target == nil {
+		target = repo.vcs
+	}
+	if err = repo.fastExport(nil, parse.stdout, options, target); err != nil {
+		croak(err.Error())
+	}
+	return false
+}
+
+// HelpImport says "Shut up, golint!"
+func (rs *Reposurgeon) HelpImport() {
+	rs.helpOutput(`
+import [--type=VCS] [--OPTION...] {STREAM|-} DIRECTORY
+
+One-shot import: read a fast-import stream or Subversion dump from the
+file STREAM ('-' for standard input) and rebuild it as a repository in
+DIRECTORY, exactly as a read followed by a rebuild would. The
+repository is not added to the repository list and is discarded
+afterwards. The target type is given by --type, defaulting to the
+preferred type and then to git. Other options are passed to both the
+read and the rebuild.
+
+This is meant to be used as a subcommand on the reposurgeon invocation
+line, where all the arguments after 'import' are taken as a single
+command:
+
+    reposurgeon import --type=hg project.fi project-hg
+`)
+}
+
+// CompleteImport is a completion hook across VCS names
+func (rs *Reposurgeon) CompleteImport(text string) []string {
+	out := make([]string, 0)
+	for _, x := range rs.CompletePrefer("") {
+		if strings.HasPrefix("--type="+x, text) {
+			out = append(out, "--type="+x)
+		}
+	}
+	return out
+}
+
+// DoImport reads a stream and rebuilds it as a repository in one step.
+func (rs *Reposurgeon) DoImport(line string) bool {
+	if rs.selection != nil {
+		croak("import does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) != 2 {
+		croak("import requires a stream and a target directory")
+		return false
+	}
+	vcs := rs.preferred
+	if name, present := parse.OptVal("--type"); present {
+		vcs = nil
+		for _, repotype := range importers {
+			if repotype.basevcs != nil && repotype.name == strings.ToLower(name) {
+				vcs = repotype.basevcs
+				break
+			}
+		}
+		if vcs == nil {
+			croak("unknown repository type %q", name)
+			return false
+		}
+	} else if vcs == nil {
+		vcs = findVCS("git")
+	}
+	var fp io.ReadCloser = os.Stdin
+	if args[0] != "-" {
+		var err error
+		fp, err = os.Open(args[0])
+		if err != nil {
+			croak("can't open %s for read", args[0])
+			return false
+		}
+		defer fp.Close()
+	}
+	options := parse.options.toStringSet()
+	repo := newRepository("")
+	defer repo.cleanup()
+	repo.fastImport(context.TODO(), fp, options, "")
+	if err := repo.rebuildRepo(args[1], options, vcs); err != nil {
+		croak(err.Error())
+	}
+	return false
+}
+
+// HelpWatch says "Shut up, golint!"
+func (rs *Reposurgeon) HelpWatch() {
+	rs.helpOutput(`
+watch [--type=VCS] [--interval=SECONDS] [--count=N] [--script=FILE] [--OPTION...] SOURCE TARGET
+
+Keep a one-way mirror of the repository in directory SOURCE in
+directory TARGET, for use during a long migration in which the old
+repository stays live. SOURCE is polled every --interval seconds
+(default 60) with a cheap command that shows whether it has new
+history - for example the youngest revision of a Subversion
+repository or the ref hashes of a git one. Whenever that changes, and
+once at startup, SOURCE is read and rebuilt in TARGET exactly as a
+read followed by a rebuild would.
+
+If --script is given, the freshly read repository is chosen and FILE
+is run on it before each rebuild, so a lift recipe (authormaps,
+branch renames, and so on) is applied every time. The target type is
+given by --type, defaulting to the preferred type and then to the
+type of SOURCE. Other options are passed to both the read and the
+rebuild.
+
+Each cycle reads the whole history again, so it takes as long as a
+one-shot conversion; the backup directory each rebuild leaves beside
+TARGET is removed. A failed read or rebuild is reported and retried
+at the next change. The watch runs until interrupted or, with
+--count, until it has mirrored N times. A line is written to standard
+output, or a > redirect, after each mirroring.
+
+Like import and export, watch takes all the arguments after it on the
+reposurgeon invocation line as a single command, so a mirror can be
+run as a service:
+
+    reposurgeon watch --script=lift.rs --type=git /srv/svn/project /srv/git/project
+`)
+}
+
+// DoWatch mirrors a live repository whenever it changes.
+func (rs *Reposurgeon) DoWatch(ctx context.Context, line string) bool {
+	if rs.selection != nil {
+		croak("watch does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) != 2 {
+		croak("watch requires a source and a target directory")
+		return false
+	}
+	source, target := args[0], args[1]
+	var vcs *VCS
+	for i, possible := range vcstypes {
+		if possible.manages(source) {
+			vcs = &vcstypes[i]
+		}
+	}
+	if vcs == nil {
+		croak("couldn't find a repo under %s", source)
+		return false
+	}
+	if vcs.watcher == "" {
+		croak("watch does not know how to poll %s repositories", vcs.name)
+		return false
+	}
+	preferred := rs.preferred
+	if name, present := parse.OptVal("--type"); present {
+		preferred = nil
+		for _, repotype := range importers {
+			if repotype.basevcs != nil && repotype.name == strings.ToLower(name) {
+				preferred = repotype.basevcs
+				break
+			}
+		}
+		if preferred == nil {
+			croak("unknown repository type %q", name)
+			return false
+		}
+	}
+	interval := 60
+	if val, present := parse.OptVal("--interval"); present {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			croak("--interval must be a positive number of seconds")
+			return false
+		}
+		interval = n
+	}
+	count := 0
+	if val, present := parse.OptVal("--count"); present {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 {
+			croak("--count must be a positive integer")
+			return false
+		}
+		count = n
+	}
+	script, _ := parse.OptVal("--script")
+	options := parse.options.toStringSet()
+	// Backups left by earlier rebuilds are the user's; only those
+	// made while watching are removed.
+	backups := func() orderedStringSet {
+		found, _ := filepath.Glob(target + ".~*~")
+		return newOrderedStringSet(found...)
+	}
+	oldBackups := backups()
+	last := ""
+	mirrored := 0
+	for {
+		poll := exec.Command("sh", "-c", vcs.watcher)
+		poll.Dir = source
+		state, err := poll.Output()
+		if err != nil {
+			croak("while polling %s: %v", source, err)
+			return false
+		}
+		if string(state) != last {
+			mirrored++
+			if err := rs.mirror(ctx, source, target, script, options, preferred); err != nil {
+				if logEnable(logWARN) {
+					logit("mirroring %s to %s failed: %v", source, target, err)
+				}
+			} else {
+				last = string(state)
+				for _, backup := range backups() {
+					if !oldBackups.Contains(backup) {
+						os.RemoveAll(backup)
+					}
+				}
+				stamp := ""
+				if !control.flagOptions["quiet"] {
+					stamp = rfc3339(time.Now()) + " "
+				}
+				fmt.Fprintf(parse.stdout, "%smirrored %s to %s\n", stamp, source, target)
+			}
+			if count != 0 && mirrored >= count {
+				break
+			}
+		}
+		// Sleep in short steps so an interrupt is noticed promptly
+		for waited := 0; waited < interval && !control.getAbort(); waited++ {
+			time.Sleep(time.Second)
+		}
+		if control.getAbort() {
+			break
+		}
+	}
+	return false
+}
+
+// mirror reads the repository in source, runs a lift script on it if
+// there is one, and rebuilds it in target.
+func (rs *Reposurgeon) mirror(ctx context.Context, source string, target string, script string, options stringSet, preferred *VCS) error {
+	repo, err := readRepo(source, options, nil, nil, control.flagOptions["quiet"])
+	if err != nil {
+		return err
+	}
+	defer repo.cleanup()
+	if preferred == nil {
+		preferred = repo.vcs
+	}
+	if script != "" {
+		repo.rename(rs.uniquify(filepath.Base(source)))
+		rs.repolist = append(rs.repolist, repo)
+		rs.choose(repo)
+		defer func() {
+			rs.unchoose()
+			rs.removeByName(repo.name)
+		}()
+		rs.DoScript(ctx, script)
+		if control.getAbort() {
+			return fmt.Errorf("script %s failed", script)
+		}
+	}
+	return repo.rebuildRepo(target, options, preferred)
+}
+
+//
+// Editing commands
+//
 
 // HelpMsgout says "Shut up, golint!"
 func (rs *Reposurgeon) HelpMsgout() {
@@ -11351,6 +15391,10 @@ If this is given, only headers with names matching it are emitted.  In this
 control the name of the header includes its trailing colon.
 
 Blobs may be included in the output with the option --blobs.
+
+Commits and tags read with an original object ID, as from git
+fast-export --show-original-ids, get an Original-OID header giving
+it. The header is informational; msgin ignores it.
 `)
 }
 
@@ -11537,6 +15581,7 @@ func (rs *Reposurgeon) DoMsgin(line string) bool {
 			}
 		}
 		repo.declareSequenceMutation("event creation")
+		repo.dirty = true
 		return false
 	}
 	// Normal case - no --create
@@ -11685,6 +15730,9 @@ func (rs *Reposurgeon) DoMsgin(line string) bool {
 			}
 		}
 	}
+	if len(changers) > 0 {
+		repo.dirty = true
+	}
 	if control.isInteractive() {
 		if len(changers) == 0 {
 			respond("no events modified by msgin.")
@@ -11705,7 +15753,7 @@ func (rs *Reposurgeon) DoMsgin(line string) bool {
 // HelpEdit says "Shut up, golint!"
 func (rs *Reposurgeon) HelpEdit() {
 	rs.helpOutput(`
-[SELECTION] edit [<INFILE] [>OUTFILE]
+[SELECTION] edit [--blobs|--not-last|--incremental[=N]] [EDITOR] [<INFILE] [>OUTFILE]
 
 Report the selection set of events to a tempfile as msgout does,
 call an editor on it, and update from the result as msgin does.
@@ -11720,6 +15768,13 @@ However, if you specify a selection set consisting of a single
 blob, your editor will be called on the blob file; alternatively,
 as with msgout, the --blobs option will include blobs in the file.
 
+With --incremental, the editor is called on message blocks in batches
+of N (default 100), and the edits in each batch are applied as
+soon as the editor exits. This avoids building one colossal mailbox
+for repositories with hundreds of thousands of commits. Saving a
+batch as an empty file, or having the editor exit with an error, ends
+the session; batches already saved keep their edits.
+
 Supports < and > redirection.
 `)
 }
@@ -11739,7 +15794,7 @@ func (rs *Reposurgeon) DoEdit(line string) bool {
 }
 
 // HelpFilter says "Shut up, golint!"
-//FIXME: Move dedos to transcode?
+// FIXME: Move dedos to transcode?
 func (rs *Reposurgeon) HelpFilter() {
 	rs.helpOutput(`
 [SELECTION] filter [--dedos|--shell|--regexp|--replace] [TEXT-OR-REGEXP]
@@ -11940,7 +15995,93 @@ func (rs *Reposurgeon) DoFilter(line string) (StopOut bool) {
 			filterhook.attributes,
 			!strings.HasPrefix(line, "--dedos"),
 			rs.inScript())
+		rs.chosen().dirty = true
+	}
+	return false
+}
+
+// HelpContentfilter says "Shut up, golint!"
+func (rs *Reposurgeon) HelpContentfilter() {
+	rs.helpOutput(`
+contentfilter {clean|smudge} PATTERN {--dedos|--shell|--regexp|--replace} [TEXT-OR-REGEXP]
+contentfilter clear [clean|smudge]
+contentfilter [>OUTFILE]
+
+Declare a content filter hook, after git's clean and smudge filters.
+The content of each file whose path matches PATTERN is run through
+the filter: by a clean hook as each repository is read in, and by a
+smudge hook as each repository is written out. The filter is
+specified as for the filter command; with --shell, '%PATHS%' is
+replaced by the paths the content is being filtered for. Patterns
+are globs matched as in .gitattributes: a pattern without a slash
+matches the last component of a path, one with a slash the whole
+path. Symlinks and submodule links are not filtered.
+
+Hooks run in the order they were declared, and last for the rest of
+the session. A blob shared between paths that get different hooks is
+split on read. Smudge hooks leave the repository in memory alone;
+the filtered content is written inline with each fileop, and a blob
+every path of which is smudged is not written at all.
+
+For example, 'contentfilter clean *.txt --dedos' strips CRLF line
+endings from text files as they are read, and 'contentfilter smudge
+config/* --regex /password=.*/password=REDACTED/g' redacts passwords
+on the way out.
+
+'contentfilter clear' drops all hooks, or those of one phase. With
+no arguments, list the hooks in force.
+`)
+}
+
+// DoContentfilter declares content filter hooks.
+func (rs *Reposurgeon) DoContentfilter(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], ">") {
+		parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		for _, cf := range control.contentFilters {
+			fmt.Fprintln(parse.stdout, cf.String())
+		}
+		return false
+	}
+	if fields[0] == "clear" {
+		if len(fields) > 2 || (len(fields) == 2 && fields[1] != "clean" && fields[1] != "smudge") {
+			croak("contentfilter clear takes only a phase, clean or smudge")
+			return false
+		}
+		var kept []*contentFilter
+		for _, cf := range control.contentFilters {
+			if len(fields) == 2 && cf.phase != fields[1] {
+				kept = append(kept, cf)
+			}
+		}
+		control.contentFilters = kept
+		return false
+	}
+	if fields[0] != "clean" && fields[0] != "smudge" {
+		croak("contentfilter requires clean, smudge, or clear")
+		return false
+	}
+	if len(fields) < 3 {
+		croak("contentfilter %s requires a pattern and a filter", fields[0])
+		return false
+	}
+	pattern := fields[1]
+	if _, err := path.Match(strings.TrimPrefix(pattern, "/"), ""); err != nil {
+		croak("bad pattern %q: %v", pattern, err)
+		return false
 	}
+	// The filter specification is the rest of the line verbatim,
+	// since a shell command may contain options.
+	rest := strings.TrimSpace(line)
+	rest = strings.TrimSpace(rest[len(fields[0]):])
+	spec := strings.TrimSpace(rest[len(pattern):])
+	filter := newFilterCommand(rs.chosen(), spec)
+	if filter == nil {
+		return false
+	}
+	control.contentFilters = append(control.contentFilters,
+		&contentFilter{phase: fields[0], pattern: pattern, spec: spec, filter: filter})
 	return false
 }
 
@@ -11980,6 +16121,7 @@ func (rs *Reposurgeon) DoTranscode(line string) bool {
 		return false
 	}
 	decoder := enc.NewDecoder()
+	repo := rs.chosen()
 
 	transcode := func(txt string, _ map[string]string) string {
 		out, err := decoder.Bytes([]byte(txt))
@@ -11995,6 +16137,106 @@ func (rs *Reposurgeon) DoTranscode(line string) bool {
 		transcode,
 		newOrderedStringSet("c", "a", "C"),
 		true, !rs.inScript())
+	repo.dirty = true
+	return false
+}
+
+// guessEncoding makes a probable identification of the character
+// encoding of text that is not valid UTF-8. It can only tell apart
+// the cases that matter most often in old repositories: Windows
+// code page 1252 (which uses the 0x80-0x9f range for printables),
+// ISO-8859-1, and "mixed" text that contains both UTF-8 multibyte
+// sequences and bytes that cannot be UTF-8. Valid UTF-8 is reported
+// as "UTF-8".
+func guessEncoding(text string) string {
+	if utf8.ValidString(text) {
+		return "UTF-8"
+	}
+	sawMultibyte := false
+	sawC1 := false
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			if text[i] >= 0x80 && text[i] <= 0x9f {
+				sawC1 = true
+			}
+		} else if size > 1 {
+			sawMultibyte = true
+		}
+		i += size
+	}
+	if sawMultibyte {
+		return "mixed"
+	} else if sawC1 {
+		return "windows-1252"
+	}
+	return "ISO-8859-1"
+}
+
+// HelpEncodings says "Shut up, golint!"
+func (rs *Reposurgeon) HelpEncodings() {
+	rs.helpOutput(`
+[SELECTION] encodings [>OUTFILE]
+
+Report commits and tags in the selection set (defaulting to all) whose
+comments or attributions are not valid UTF-8, grouped by a guess at
+their character set.  Each output line is a guessed encoding followed
+by a selection of event numbers, suitable for composing transcode
+commands that target each span accurately.  Supports > redirection.
+
+The guesses are 'windows-1252', 'ISO-8859-1', and 'mixed', the last
+meaning text with both UTF-8 sequences and bytes that cannot be UTF-8;
+mixed events need to be inspected and fixed by hand.
+`)
+}
+
+// DoEncodings reports probable encodings of undecodable metadata.
+func (rs *Reposurgeon) DoEncodings(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	groups := make(map[string][]string)
+	for _, ei := range selection {
+		var text string
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			if event.decodable() {
+				continue
+			}
+			text = event.Comment + event.committer.fullname + event.committer.email
+			for _, author := range event.authors {
+				text += author.fullname + author.email
+			}
+		case *Tag:
+			if event.decodable() {
+				continue
+			}
+			text = event.name + event.Comment
+			if event.tagger != nil {
+				text += event.tagger.fullname + event.tagger.email
+			}
+		default:
+			continue
+		}
+		guess := guessEncoding(text)
+		groups[guess] = append(groups[guess], strconv.Itoa(ei+1))
+	}
+	guesses := make([]string, 0, len(groups))
+	for guess := range groups {
+		guesses = append(guesses, guess)
+	}
+	sort.Strings(guesses)
+	for _, guess := range guesses {
+		fmt.Fprintf(parse.stdout, "%s\t%s\n", guess, strings.Join(groups[guess], ","))
+	}
 	return false
 }
 
@@ -12019,6 +16261,11 @@ dates. The former sets the author's name and email address (assuming
 the value can be parsed for both), copying the committer
 timestamp. The author's timezone may be deduced from the email
 address.
+
+The special fieldnames 'authorname', 'authoremail', 'committername'
+and 'committeremail' set one part of a commit attribution, and
+'taggername' and 'taggeremail' do the same for tags.  To apply many
+such edits at once, see "setfields".
 `)
 }
 
@@ -12046,57 +16293,217 @@ func (rs *Reposurgeon) DoSetfield(line string) bool {
 		return false
 	}
 	for _, ei := range rs.selection {
-		event := repo.events[ei]
-		if _, ok := getAttr(event, field); ok {
-			setAttr(event, field, value)
-			if event.isCommit() {
-				event.(*Commit).hash.invalidate()
+		if err := setEventField(repo.events[ei], field, value); err != nil {
+			croak(err.Error())
+			return false
+		}
+		repo.dirty = true
+	}
+	return false
+}
+
+// setEventField sets a named field of an event from a string, as the
+// setfield command does.  Fields that don't apply to the event are
+// silently ignored.
+func setEventField(event Event, field string, value string) error {
+	if _, ok := getAttr(event, field); ok {
+		setAttr(event, field, value)
+		if event.isCommit() {
+			event.(*Commit).hash.invalidate()
+		}
+		return nil
+	}
+	// Name and email edits apply to the first author, who
+	// defaults to the committer when the commit has none.
+	firstAuthor := func(commit *Commit) *Attribution {
+		if len(commit.authors) == 0 {
+			commit.authors = append(commit.authors, commit.committer)
+		}
+		return &commit.authors[0]
+	}
+	switch event := event.(type) {
+	case *Commit:
+		switch field {
+		case "Author":
+			newattr, err := newAttribution(value + " " + event.committer.date.String())
+			if err != nil {
+				return err
+			}
+			*firstAuthor(event) = *newattr
+		case "Authorname":
+			firstAuthor(event).fullname = value
+		case "Authoremail":
+			firstAuthor(event).email = value
+		case "Committername":
+			event.committer.fullname = value
+		case "Committeremail":
+			event.committer.email = value
+		case "Commitdate":
+			newdate, err := newDate(value)
+			if err != nil {
+				return err
 			}
-		} else if commit, ok := event.(*Commit); ok {
-			if field == "Author" {
-				attr := value
-				attr += " " + commit.committer.date.String()
-				newattr, _ := newAttribution("")
-				commit.authors = append(commit.authors, *newattr)
-			} else if field == "Commitdate" {
-				newdate, err := newDate(value)
-				if err != nil {
-					croak(err.Error())
-					return false
-				}
-				commit.committer.date = newdate
-			} else if field == "Authdate" {
-				newdate, err := newDate(value)
-				if err != nil {
-					croak(err.Error())
-					return false
-				}
-				commit.authors[0].date = newdate
+			event.committer.date = newdate
+		case "Authdate":
+			newdate, err := newDate(value)
+			if err != nil {
+				return err
 			}
-			commit.hash.invalidate()
+			firstAuthor(event).date = newdate
+		}
+		event.hash.invalidate()
+	case *Tag:
+		if event.tagger == nil {
+			return nil
+		}
+		switch field {
+		case "Taggername":
+			event.tagger.fullname = value
+		case "Taggeremail":
+			event.tagger.email = value
 		}
 	}
-	return false
+	return nil
 }
 
-// HelpSetperm says "Shut up, golint!"
-func (rs *Reposurgeon) HelpSetperm() {
+// HelpSetfields says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSetfields() {
 	rs.helpOutput(`
-[SELECTION] setperm {PERM} [PATH...]
+setfields [--tsv] [<INFILE]
 
-For the selected objects (defaulting to none) take the first argument as an
-octal literal describing permissions.  All subsequent arguments are paths.
-For each M fileop in the selection set and exactly matching one of the
-paths, patch the permission field to the first argument value.
+Apply a batch of field edits read from CSV, one edit per row, for
+metadata corrections prepared in a spreadsheet.  Each row has three
+columns: a selection expression such as :42 or <1234>, a field name
+as accepted by "setfield", and the new value.  With --tsv, the
+columns are tab-separated instead.
+
+A first row reading selector, field, value is taken as a header and
+skipped, as are rows whose first cell begins with #.  Values are
+used exactly as they appear in the cell; no backslash escapes are
+interpreted.
+
+Besides the fields setfield knows, commits accept authorname,
+authoremail, committername, and committeremail, and tags accept
+taggername and taggeremail.  For example:
+
+    :42,committeremail,jrh@example.com
+    <1234>,authorname,J. Random Hacker
+
+Every row is checked before any is applied; if any selector fails to
+parse or selects nothing, the errors are reported with their row
+numbers and the repository is left unchanged.
 `)
 }
 
-// DoSetperm alters permissions on M fileops matching a path list.
-func (rs *Reposurgeon) DoSetperm(line string) bool {
-	if rs.chosen() == nil {
-		croak("no repo is loaded")
-		return false
-	}
+// DoSetfields applies field edits read from a CSV or TSV file.
+func (rs *Reposurgeon) DoSetfields(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	if parse.line != "" {
+		croak("too many arguments for setfields.")
+		return false
+	}
+	reader := csv.NewReader(parse.stdin)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if parse.options.Contains("--tsv") {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		croak("while reading field edits: %v", err)
+		return false
+	}
+	// First, a validation pass.  Rows are numbered as in the
+	// spreadsheet, counting the header and comments.
+	type fieldEdit struct {
+		row       int
+		field     string
+		value     string
+		selection []int
+	}
+	edits := make([]fieldEdit, 0, len(records))
+	bad := 0
+	for i, row := range records {
+		if len(row) > 0 && strings.HasPrefix(row[0], "#") {
+			continue
+		}
+		if len(row) != 3 {
+			croak("row %d: expected 3 fields, found %d", i+1, len(row))
+			bad++
+			continue
+		}
+		if i == 0 && strings.EqualFold(row[0], "selector") &&
+			strings.EqualFold(row[1], "field") && strings.EqualFold(row[2], "value") {
+			continue
+		}
+		selection, err := func() (selection []int, err error) {
+			defer func() {
+				if e := catch("command", recover()); e != nil {
+					err = errors.New(e.message)
+				}
+			}()
+			machine, rest := rs.parseSelectionSet(row[0])
+			if machine == nil || strings.TrimSpace(rest) != "" {
+				return nil, fmt.Errorf("%q is not a selection", row[0])
+			}
+			return rs.evalSelectionSet(machine, repo), nil
+		}()
+		if err == nil && len(selection) == 0 {
+			err = fmt.Errorf("%q selects nothing", row[0])
+		}
+		if err != nil {
+			croak("row %d: %v", i+1, err)
+			bad++
+			continue
+		}
+		edits = append(edits, fieldEdit{i + 1, strings.Title(row[1]), row[2], selection})
+	}
+	if bad > 0 {
+		croak("%d bad rows, no edits applied.", bad)
+		return false
+	}
+	changed := 0
+	for _, edit := range edits {
+		for _, ei := range edit.selection {
+			if err := setEventField(repo.events[ei], edit.field, edit.value); err != nil {
+				croak("row %d: %v", edit.row, err)
+				continue
+			}
+			changed++
+		}
+	}
+	if changed > 0 {
+		repo.dirty = true
+	}
+	respond("%d field edits applied from %d rows.", changed, len(edits))
+	return false
+}
+
+// HelpSetperm says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSetperm() {
+	rs.helpOutput(`
+[SELECTION] setperm {PERM} [PATH...]
+
+For the selected objects (defaulting to none) take the first argument as an
+octal literal describing permissions.  All subsequent arguments are paths.
+For each M fileop in the selection set and exactly matching one of the
+paths, patch the permission field to the first argument value.
+`)
+}
+
+// DoSetperm alters permissions on M fileops matching a path list.
+func (rs *Reposurgeon) DoSetperm(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo is loaded")
+		return false
+	}
 	if rs.selection == nil {
 		croak("no selection")
 		return false
@@ -12129,6 +16536,7 @@ func (rs *Reposurgeon) DoSetperm(line string) bool {
 		}
 	}
 	//baton.endProcess()
+	rs.chosen().dirty = true
 	return false
 }
 
@@ -12196,6 +16604,7 @@ func (rs *Reposurgeon) DoAppend(line string) bool {
 			tag.Comment += line
 		}
 	}
+	rs.chosen().dirty = true
 	return false
 }
 
@@ -12225,7 +16634,11 @@ func (rs *Reposurgeon) DoSquash(line string) bool {
 	}
 	parse := rs.newLineParse(line, nil)
 	defer parse.Closem()
-	rs.chosen().squash(rs.selection, parse.options)
+	if err := rs.chosen().squash(rs.selection, parse.options); err != nil {
+		croak(err.Error())
+		return false
+	}
+	rs.chosen().dirty = true
 	return false
 }
 
@@ -12257,14 +16670,84 @@ func (rs *Reposurgeon) DoDelete(line string) bool {
 	parse := rs.newLineParse(line, nil)
 	defer parse.Closem()
 	parse.options.Add("--delete")
-	rs.chosen().squash(rs.selection, parse.options)
+	if err := rs.chosen().squash(rs.selection, parse.options); err != nil {
+		croak(err.Error())
+		return false
+	}
+	rs.chosen().dirty = true
 	return false
 }
 
+// coalesce squashes runs of consecutive commits on the same branch that
+// pass the match test into the last commit of each run, returning the
+// number of runs squashed.  The surviving commit keeps the comment of
+// the first in its run, or with concatenate the comments of all of
+// them, in order and without repeats.
+func (repo *Repository) coalesce(selection orderedIntSet, coalesceMatch func(*Commit, *Commit) bool, concatenate bool) int {
+	eligible := make(map[string][]string)
+	squashes := make([][]string, 0)
+	for _, commit := range repo.commits(selection) {
+		trial, ok := eligible[commit.Branch]
+		if !ok {
+			// No active commit span for this branch - start one
+			// with the mark of this commit
+			eligible[commit.Branch] = []string{commit.mark}
+		} else if coalesceMatch(
+			repo.markToEvent(trial[len(trial)-1]).(*Commit),
+			commit) {
+			// This commit matches the one at the
+			// end of its branch span.  Append its
+			// mark to the span.
+			eligible[commit.Branch] = append(eligible[commit.Branch], commit.mark)
+		} else {
+			// This commit doesn't match the one
+			// at the end of its span.  Coalesce
+			// the span and start a new one with
+			// this commit.
+			if len(eligible[commit.Branch]) > 1 {
+				squashes = append(squashes, eligible[commit.Branch])
+			}
+			eligible[commit.Branch] = []string{commit.mark}
+		}
+	}
+	for _, endspan := range eligible {
+		if len(endspan) > 1 {
+			squashes = append(squashes, endspan)
+		}
+	}
+	for _, span := range squashes {
+		last := repo.markToEvent(span[len(span)-1]).(*Commit)
+		if concatenate {
+			// Gather the comments onto the last commit, so
+			// that squashing has nothing to append to it.
+			seen := make(map[string]bool)
+			var comments []string
+			for _, mark := range span {
+				commit := repo.markToEvent(mark).(*Commit)
+				if !emptyComment(commit.Comment) && !seen[commit.Comment] {
+					comments = append(comments, commit.Comment)
+					seen[commit.Comment] = true
+				}
+				commit.Comment = ""
+			}
+			last.Comment = strings.Join(comments, control.lineSep)
+		} else {
+			// Prevent lossage when last is a ChangeLog commit
+			last.Comment = repo.markToEvent(span[0]).(*Commit).Comment
+		}
+		squashable := make([]int, 0)
+		for _, mark := range span[:len(span)-1] {
+			squashable = append(squashable, repo.markToIndex(mark))
+		}
+		repo.squash(squashable, orderedStringSet{})
+	}
+	return len(squashes)
+}
+
 // HelpCoalesce says "Shut up, golint!"
 func (rs *Reposurgeon) HelpCoalesce() {
 	rs.helpOutput(`
-[SELECTION] coalesce [--debug]
+[SELECTION] coalesce [--debug] [--changelog] [--pattern=REGEXP] [--author] [TIMEFUZZ]
 
 Scan the selection set (defaulting to all) for runs of commits with
 identical comments close to each other in time (this is a common form
@@ -12283,6 +16766,20 @@ commit before them by content, and will coalesce with it if the committer
 matches and the commit separation is small enough.  This option handles
 a convention used by Free Software Foundation projects.
 
+With the --pattern option, comments need not be identical; instead
+commits whose comments all match the regular expression are coalesced.
+This is useful for cleaning up auto-commit noise such as "checkpoint"
+or "wip" commits left by IDE auto-save plugins.  The surviving commit
+keeps the comment of the first commit in each run.
+
+With the --author option, comments need not match either; instead
+commits by the same author (the first author, or the committer if
+there is none) whose author dates are close enough are coalesced, and
+the surviving commit gets all their distinct comments, in order.  This
+cleans up conversions from CVS and other file-oriented systems in which
+one change was recorded as a run of per-file commits with differing
+comments.  Combined with --pattern, the comments must also match.
+
 With  the --debug option, show messages about mismatches.
 `)
 }
@@ -12302,6 +16799,15 @@ func (rs *Reposurgeon) DoCoalesce(line string) bool {
 	defer parse.Closem()
 	timefuzz := 90
 	changelog := parse.options.Contains("--changelog")
+	var pattern *regexp.Regexp
+	if val, present := parse.OptVal("--pattern"); present {
+		var err error
+		pattern, err = regexp.Compile(val)
+		if err != nil {
+			croak("coalesce pattern is not a valid regular expression: %v", err)
+			return false
+		}
+	}
 	if parse.line != "" {
 		var err error
 		timefuzz, err = strconv.Atoi(parse.line)
@@ -12313,8 +16819,31 @@ func (rs *Reposurgeon) DoCoalesce(line string) bool {
 	isChangelog := func(commit *Commit) bool {
 		return strings.Contains(commit.Comment, "empty log message") && len(commit.operations()) == 1 && commit.operations()[0].op == opM && strings.HasSuffix(commit.operations()[0].Path, "ChangeLog")
 	}
+	byAuthor := parse.options.Contains("--author")
 	coalesceMatch := func(cthis *Commit, cnext *Commit) bool {
 		croakOnFail := logEnable(logDELETE) || parse.options.Contains("--debug")
+		if byAuthor {
+			athis, anext := cthis.mainAuthor(), cnext.mainAuthor()
+			if athis.email != anext.email {
+				if croakOnFail {
+					croak("author email mismatch at %s", cnext.idMe())
+				}
+				return false
+			}
+			if athis.date.delta(anext.date) >= time.Duration(timefuzz)*time.Second {
+				if croakOnFail {
+					croak("time fuzz exceeded at %s", cnext.idMe())
+				}
+				return false
+			}
+			if pattern != nil && (!pattern.MatchString(cthis.Comment) || !pattern.MatchString(cnext.Comment)) {
+				if croakOnFail {
+					croak("comment pattern mismatch at %s", cnext.idMe())
+				}
+				return false
+			}
+			return true
+		}
 		if cthis.committer.email != cnext.committer.email {
 			if croakOnFail {
 				croak("committer email mismatch at %s", cnext.idMe())
@@ -12330,7 +16859,14 @@ func (rs *Reposurgeon) DoCoalesce(line string) bool {
 		if changelog && !isChangelog(cthis) && isChangelog(cnext) {
 			return true
 		}
-		if cthis.Comment != cnext.Comment {
+		if pattern != nil {
+			if !pattern.MatchString(cthis.Comment) || !pattern.MatchString(cnext.Comment) {
+				if croakOnFail {
+					croak("comment pattern mismatch at %s", cnext.idMe())
+				}
+				return false
+			}
+		} else if cthis.Comment != cnext.Comment {
 			if croakOnFail {
 				croak("comment mismatch at %s", cnext.idMe())
 			}
@@ -12338,47 +16874,11 @@ func (rs *Reposurgeon) DoCoalesce(line string) bool {
 		}
 		return true
 	}
-	eligible := make(map[string][]string)
-	squashes := make([][]string, 0)
-	for _, commit := range repo.commits(selection) {
-		trial, ok := eligible[commit.Branch]
-		if !ok {
-			// No active commit span for this branch - start one
-			// with the mark of this commit
-			eligible[commit.Branch] = []string{commit.mark}
-		} else if coalesceMatch(
-			repo.markToEvent(trial[len(trial)-1]).(*Commit),
-			commit) {
-			// This commit matches the one at the
-			// end of its branch span.  Append its
-			// mark to the span.
-			eligible[commit.Branch] = append(eligible[commit.Branch], commit.mark)
-		} else {
-			// This commit doesn't match the one
-			// at the end of its span.  Coalesce
-			// the span and start a new one with
-			// this commit.
-			if len(eligible[commit.Branch]) > 1 {
-				squashes = append(squashes, eligible[commit.Branch])
-			}
-			eligible[commit.Branch] = []string{commit.mark}
-		}
-	}
-	for _, endspan := range eligible {
-		if len(endspan) > 1 {
-			squashes = append(squashes, endspan)
-		}
-	}
-	for _, span := range squashes {
-		// Prevent lossage when last is a ChangeLog commit
-		repo.markToEvent(span[len(span)-1]).(*Commit).Comment = repo.markToEvent(span[0]).(*Commit).Comment
-		squashable := make([]int, 0)
-		for _, mark := range span[:len(span)-1] {
-			squashable = append(squashable, repo.markToIndex(mark))
-		}
-		repo.squash(squashable, orderedStringSet{})
+	spans := repo.coalesce(selection, coalesceMatch, byAuthor)
+	if spans > 0 {
+		repo.dirty = true
 	}
-	respond("%d spans coalesced.", len(squashes))
+	respond("%d spans coalesced.", spans)
 	return false
 }
 
@@ -12393,6 +16893,8 @@ func (rs *Reposurgeon) HelpAdd() {
 
 {SELECTION} add C {SOURCE} {TARGET}
 
+{SELECTION} add N {MARK|inline} {COMMITTISH} [<INFILE]
+
 From a specified commit, add a specified fileop.
 
 For a D operation to be valid there must be an M operation for the path
@@ -12402,6 +16904,19 @@ refer to a blob that precedes the commit location.  For an R or C
 operation to be valid, there must be an M operation for the source
 in the commit's ancestry.
 
+An N operation attaches a note to the commit named by the committish,
+which must be a commit mark. The note text is either a blob that
+precedes the commit location or, with 'inline', data read from
+standard input (which may be a here-doc).  If the selected commit
+already has an N operation for the same committish, that operation's
+data is replaced; this is how notes are modified.  Use 'remove N' with
+the committish to delete a note.
+
+N operations normally live in commits on a notes branch such as
+refs/notes/commits.  They are written verbatim to import streams and
+to targets that support notes (git); for other targets they are
+dropped with a warning.
+
 `)
 }
 
@@ -12412,8 +16927,16 @@ func (rs *Reposurgeon) DoAdd(line string) bool {
 		return false
 	}
 	repo := rs.chosen()
+	var parse *LineParse
+	if strings.HasPrefix(line, "N ") {
+		// Only note ops take inline data; other ops may have
+		// paths that would confuse the redirection parse.
+		parse = rs.newLineParse(line, orderedStringSet{"stdin"})
+		defer parse.Closem()
+		line = parse.line
+	}
 	fields, err := shlex.Split(line, true)
-	if err != nil && len(fields) < 2 {
+	if err != nil || len(fields) < 2 {
 		croak("add requires an operation type and arguments")
 		return false
 	}
@@ -12467,6 +16990,39 @@ func (rs *Reposurgeon) DoAdd(line string) bool {
 				return false
 			}
 		}
+	} else if optype == opN {
+		if len(fields) != 3 {
+			croak("wrong field count in add command")
+			return false
+		}
+		mark = fields[1]
+		if mark != "inline" {
+			if !strings.HasPrefix(mark, ":") {
+				croak("garbled mark %s in add command", mark)
+				return false
+			}
+			blob, ok := repo.markToEvent(mark).(*Blob)
+			if !ok {
+				croak("mark %s in add command does not refer to a blob", mark)
+				return false
+			} else if repo.eventToIndex(blob) >= rs.selection.Min() {
+				croak("mark %s in add command is after add location", mark)
+				return false
+			}
+		}
+		argpath = fields[2]
+		if _, ok := repo.markToEvent(argpath).(*Commit); !ok {
+			croak("%s in add command does not refer to a commit", argpath)
+			return false
+		}
+		if mark == "inline" {
+			content, err := ioutil.ReadAll(parse.stdin)
+			if err != nil {
+				croak("while reading note content: %v", err)
+				return false
+			}
+			source = string(content)
+		}
 	} else if optype == opR || optype == opC {
 		if len(fields) < 3 {
 			croak("too few arguments in add %c", optype)
@@ -12490,6 +17046,10 @@ func (rs *Reposurgeon) DoAdd(line string) bool {
 		return false
 	}
 	for _, commit := range repo.commits(rs.selection) {
+		if optype == opN {
+			commit.setNote(mark, argpath, []byte(source))
+			continue
+		}
 		fileop := newFileOp(rs.chosen())
 		if optype == opD {
 			fileop.construct(opD, argpath)
@@ -12500,6 +17060,7 @@ func (rs *Reposurgeon) DoAdd(line string) bool {
 		}
 		commit.appendOperation(fileop)
 	}
+	repo.dirty = true
 	return false
 }
 
@@ -12525,6 +17086,7 @@ func (rs *Reposurgeon) DoBlob(line string) bool {
 	blob := newBlob(repo)
 	blob.setMark(":1")
 	repo.insertEvent(blob, len(repo.frontEvents()), "adding blob")
+	repo.dirty = true
 	parse := rs.newLineParse(line, orderedStringSet{"stdin"})
 	defer parse.Closem()
 	content, err := ioutil.ReadAll(parse.stdin)
@@ -12595,6 +17157,7 @@ func (rs *Reposurgeon) DoRemove(line string) bool {
 				}
 			}
 			event.setOperations(ops)
+			repo.dirty = true
 			return false
 		}
 		ind := -1
@@ -12639,9 +17202,13 @@ func (rs *Reposurgeon) DoRemove(line string) bool {
 		}
 		removed := ops[ind]
 		event.fileops = append(ops[:ind], ops[ind+1:]...)
+		repo.dirty = true
 		if target == -1 {
-			if removed.op == opM {
+			if removed.op == opM && removed.ref != "inline" {
 				repo.markToEvent(removed.ref).(*Blob).removeOperation(removed)
+			} else if removed.op == opN {
+				removed.forget()
+				repo.inlines--
 			}
 		} else {
 			present := target >= 0 && target < len(repo.events)
@@ -12658,7 +17225,7 @@ func (rs *Reposurgeon) DoRemove(line string) bool {
 			// Blob might have to move, too - we need to keep the
 			// relocated op from having an unresolvable forward
 			// mark reference.
-			if removed.ref != "" && target < ie {
+			if strings.HasPrefix(removed.ref, ":") && target < ie {
 				i := repo.markToIndex(removed.ref)
 				blob := repo.events[i]
 				repo.events = append(repo.events[:i], repo.events[i+1:]...)
@@ -12670,50 +17237,324 @@ func (rs *Reposurgeon) DoRemove(line string) bool {
 	return false
 }
 
-// HelpRenumber says "Shut up, golint!"
-func (rs *Reposurgeon) HelpRenumber() {
-	rs.helpOutput(`
-renumber
+// notesRefOption returns the notes ref named by a --ref option,
+// filling in refs/notes/ as git notes does.
+func notesRefOption(parse *LineParse) (string, bool) {
+	ref, present := parse.OptVal("--ref")
+	if !present {
+		return defaultNotesRef, true
+	}
+	if ref != "" && !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/notes/" + ref
+	}
+	return ref, isNotesRef(ref)
+}
 
-Renumber the marks in a repository, from :1 up to <n> where <n> is the
-count of the last mark. Just in case an importer ever cares about mark
-ordering or gaps in the sequence.
+// HelpNote says "Shut up, golint!"
+func (rs *Reposurgeon) HelpNote() {
+	rs.helpOutput(`
+{SELECTION} note [--ref=NOTESREF] [--remove] [<INFILE]
+
+Attach a git note to each selected commit, replacing any note it
+already has, with text read from standard input (which may be a
+here-doc). With --remove, remove the notes of the selected commits
+instead. Notes go on refs/notes/commits unless --ref names another
+ref under refs/notes/; a bare name is taken to be under refs/notes/.
+
+The change is made as git notes makes it, by a commit on the notes
+ref appended to the repository; its N fileops carry the notes, and
+you are its committer. Notes read from git are kept the same way, so
+they follow their commits through surgery and are rewritten against
+the new commit hashes on rebuild. A note on a deleted commit moves
+where its tags go, if that commit has no note of its own there, and
+is otherwise dropped.
 `)
 }
 
-// DoRenumber is he handler for the "renumber" command.
-func (rs *Reposurgeon) DoRenumber(line string) bool {
-	// Renumber the marks in the selected repo.
+// DoNote attaches or removes notes on the selected commits.
+func (rs *Reposurgeon) DoNote(line string) bool {
 	if rs.chosen() == nil {
-		croak("no repo has been chosen.")
+		croak("no repo is loaded")
 		return false
 	}
-	rs.repo.renumber(1, nil)
+	if rs.selection == nil {
+		croak("no selection")
+		return false
+	}
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	if len(parse.Tokens()) > 0 {
+		croak("note does not take arguments")
+		return false
+	}
+	ref, ok := notesRefOption(parse)
+	if !ok {
+		croak("%q is not a notes ref", ref)
+		return false
+	}
+	var targets []*Commit
+	for _, commit := range repo.commits(rs.selection) {
+		if !isNotesRef(commit.Branch) {
+			targets = append(targets, commit)
+		}
+	}
+	remove := parse.options.Contains("--remove")
+	var text []byte
+	if remove {
+		notes := repo.noteState()[ref]
+		annotated := targets[:0]
+		for _, commit := range targets {
+			if _, ok := notes[commit.mark]; ok {
+				annotated = append(annotated, commit)
+			}
+		}
+		targets = annotated
+		if len(targets) == 0 {
+			croak("the selected commits have no notes on %s", ref)
+			return false
+		}
+	} else {
+		var err error
+		text, err = ioutil.ReadAll(parse.stdin)
+		if err != nil {
+			croak("while reading note text: %v", err)
+			return false
+		}
+	}
+	if len(targets) == 0 {
+		croak("no commits in the selection to attach notes to")
+		return false
+	}
+	repo.annotate(ref, targets, text, remove)
+	repo.dirty = true
 	return false
 }
 
-// HelpDedup says "Shut up, golint!"
-func (rs *Reposurgeon) HelpDedup() {
+// HelpNotes says "Shut up, golint!"
+func (rs *Reposurgeon) HelpNotes() {
 	rs.helpOutput(`
-[SELECTION] dedup
+[SELECTION] notes [--ref=NOTESREF] [>OUTFILE]
 
-Deduplicate blobs in the selection set.  If multiple blobs in the selection
-set have the same SHA1, throw away all but the first, and change fileops
-referencing them to instead reference the (kept) first blob.
+List the git notes on the selected commits, defaulting to all commits:
+for each note the event number and mark of the commit, the notes ref,
+and the first line of the note. Notes on every notes ref are listed
+unless --ref names one. Supports > redirection.
 `)
 }
 
-// DoDedup deduplicates identical (up to hash) blobs within the selection set
-func (rs *Reposurgeon) DoDedup(line string) bool {
+// DoNotes lists the notes on the selected commits.
+func (rs *Reposurgeon) DoNotes(line string) bool {
 	if rs.chosen() == nil {
-		croak("no repo has been chosen.")
+		croak("no repo is loaded")
+		return false
+	}
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) > 0 {
+		croak("notes does not take arguments")
 		return false
 	}
+	state := repo.noteState()
+	refs := notesRefs(state)
+	if _, present := parse.OptVal("--ref"); present {
+		ref, ok := notesRefOption(parse)
+		if !ok {
+			croak("%q is not a notes ref", ref)
+			return false
+		}
+		refs = []string{ref}
+	}
 	selection := rs.selection
 	if selection == nil {
-		selection = rs.chosen().all()
+		selection = repo.all()
 	}
-	blobMap := make(map[string]string) // hash -> mark
+	w := screenwidth()
+	for _, idx := range selection {
+		commit, ok := repo.events[idx].(*Commit)
+		if !ok {
+			continue
+		}
+		for _, ref := range refs {
+			op, ok := state[ref][commit.mark]
+			if !ok {
+				continue
+			}
+			topline, _ := splitRuneFirst(string(repo.noteContent(op)), '\n')
+			report := fmt.Sprintf("%6d %6s %s %s", idx+1, commit.mark, ref, topline)
+			if len(report) > w {
+				report = report[:w]
+			}
+			fmt.Fprintln(parse.stdout, report)
+		}
+	}
+	return false
+}
+
+// HelpSign says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSign() {
+	rs.helpOutput(`
+sign [strip|keep|resign COMMAND]
+
+Set what is done, when the repository is written to git, with the
+signatures of commits and tags that surgery has invalidated. A
+signature is invalidated when the object it is on would no longer be
+written with the object ID it was read with; objects read without
+one are not checked. With no argument, report the policy in force.
+
+strip::
+    Drop the invalidated signatures, with a warning for each. This
+    is the default.
+
+keep::
+    Write the signatures as they were; they will fail to verify.
+
+resign::
+    Run COMMAND through the shell for each invalidated object, with
+    the object as it will be written, unsigned, on standard input.
+    Its output must be a detached armored signature, as from "gpg
+    -bsa", and replaces the old one.
+
+A commit signature is a gpgsig header, which only the native git
+reader keeps and only "rebuild --native" writes back; through git
+fast-import, signed commits lose their signatures regardless. Tag
+signatures are kept at the end of the tag comment either way.
+`)
+}
+
+// DoSign sets the policy for invalidated signatures.
+func (rs *Reposurgeon) DoSign(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo is loaded")
+		return false
+	}
+	repo := rs.chosen()
+	policy, hook := splitRuneFirst(strings.TrimSpace(line), ' ')
+	if policy == "" {
+		report := repo.signPolicy
+		if report == "" {
+			report = "strip"
+		} else if repo.signHook != "" {
+			report += " " + repo.signHook
+		}
+		control.baton.printLogString(report + control.lineSep)
+		return false
+	}
+	if err := repo.setSignPolicy(policy, strings.TrimSpace(hook)); err != nil {
+		croak("%v", err)
+		return false
+	}
+	repo.dirty = true
+	return false
+}
+
+// HelpSignatures says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSignatures() {
+	rs.helpOutput(`
+[SELECTION] signatures [--stream] [>OUTFILE]
+
+List the signed commits and tags in the selection, defaulting to all
+events: for each the event number, mark or tag name, and whether its
+signature is intact, invalidated by surgery, or unknown because it
+was read without an object ID. The check is made for a native
+rebuild, or with --stream for a write through git fast-import.
+Supports > redirection.
+`)
+}
+
+// DoSignatures reports which signatures surgery has invalidated.
+func (rs *Reposurgeon) DoSignatures(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo is loaded")
+		return false
+	}
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) > 0 {
+		croak("signatures does not take arguments")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	if !repo.hasSignatures() {
+		return false
+	}
+	states, _ := repo.signatureStates(!parse.options.Contains("--stream"))
+	status := func(event Event) string {
+		intact, known := states[event]
+		switch {
+		case !known:
+			return "unknown"
+		case intact:
+			return "intact"
+		default:
+			return "invalidated"
+		}
+	}
+	for _, idx := range selection {
+		switch event := repo.events[idx].(type) {
+		case *Commit:
+			if name, _ := event.signature(); name != "" {
+				fmt.Fprintf(parse.stdout, "%6d %6s %s %s\n", idx+1, event.mark, name, status(event))
+			}
+		case *Tag:
+			if _, sig := splitSignature(event.Comment); sig != "" {
+				fmt.Fprintf(parse.stdout, "%6d %6s %s %s\n", idx+1, event.getHumanName(), "tag", status(event))
+			}
+		}
+	}
+	return false
+}
+
+// HelpRenumber says "Shut up, golint!"
+func (rs *Reposurgeon) HelpRenumber() {
+	rs.helpOutput(`
+renumber
+
+Renumber the marks in a repository, from :1 up to <n> where <n> is the
+count of the last mark. Just in case an importer ever cares about mark
+ordering or gaps in the sequence.
+`)
+}
+
+// DoRenumber is he handler for the "renumber" command.
+func (rs *Reposurgeon) DoRenumber(line string) bool {
+	// Renumber the marks in the selected repo.
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	rs.repo.renumber(1, nil)
+	rs.repo.dirty = true
+	return false
+}
+
+// HelpDedup says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDedup() {
+	rs.helpOutput(`
+[SELECTION] dedup
+
+Deduplicate blobs in the selection set.  If multiple blobs in the selection
+set have the same SHA1, throw away all but the first, and change fileops
+referencing them to instead reference the (kept) first blob.
+`)
+}
+
+// DoDedup deduplicates identical (up to hash) blobs within the selection set
+func (rs *Reposurgeon) DoDedup(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = rs.chosen().all()
+	}
+	blobMap := make(map[string]string) // hash -> mark
 	dupMap := make(map[string]string)  // duplicate mark -> canonical mark
 	for _, ei := range selection {
 		event := rs.chosen().events[ei]
@@ -12728,6 +17569,102 @@ func (rs *Reposurgeon) DoDedup(line string) bool {
 		control.baton.twirl()
 	}
 	rs.chosen().dedup(dupMap)
+	if len(dupMap) > 0 {
+		rs.chosen().dirty = true
+	}
+	return false
+}
+
+// timefix bumps the committer dates of commits in the selection that
+// are earlier than a parent's to one second after the latest parent,
+// carrying their author dates along. Commits are visited in event
+// order, so a repair propagates to descendants. It returns the indices
+// of the commits changed and how far each was moved.
+func (repo *Repository) timefix(selection orderedIntSet, dryrun bool) ([]int, []time.Duration) {
+	var fixed []int
+	var deltas []time.Duration
+	moved := make(map[*Commit]time.Duration)
+	for _, ei := range selection {
+		commit, ok := repo.events[ei].(*Commit)
+		if !ok {
+			continue
+		}
+		var latest time.Time
+		for _, parent := range commit.parents() {
+			if pc, ok := parent.(*Commit); ok {
+				// In a dry run nothing moves, so shift the parent
+				// by whatever it would have been moved.
+				stamp := pc.committer.date.timestamp.Add(moved[pc])
+				if stamp.After(latest) {
+					latest = stamp
+				}
+			}
+		}
+		if latest.IsZero() || !commit.committer.date.timestamp.Before(latest) {
+			continue
+		}
+		delta := latest.Sub(commit.committer.date.timestamp) + time.Second
+		fixed = append(fixed, ei)
+		deltas = append(deltas, delta)
+		if dryrun {
+			moved[commit] = delta
+		} else {
+			commit.bump(int(delta / time.Second))
+		}
+	}
+	return fixed, deltas
+}
+
+// HelpTimefix says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTimefix() {
+	rs.helpOutput(`
+[SELECTION] timefix [--dry-run] [>OUTFILE]
+
+Repair non-monotonic timestamps in the selected commits (default all).
+A commit whose committer date is earlier than that of one of its
+parents, as clock skew between clients often left in CVS and Subversion
+repositories, has its committer and author dates moved forward to one
+second after its latest parent's.  Commits are checked in ascending
+order, so the repair carries on through descendants that would
+otherwise fall behind in turn.
+
+A report line is written for each adjusted commit, giving its event
+number, mark, old and new committer dates, and the shift.  With
+--dry-run the report is made but nothing is changed.
+`)
+}
+
+// DoTimefix bumps commits dated before their parents.
+func (rs *Reposurgeon) DoTimefix(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	dryrun := parse.options.Contains("--dry-run")
+	fixed, deltas := repo.timefix(selection, dryrun)
+	for i, ei := range fixed {
+		commit := repo.events[ei].(*Commit)
+		after := commit.committer.date.timestamp
+		if dryrun {
+			after = after.Add(deltas[i])
+		}
+		fmt.Fprintf(parse.stdout, "%d %s\t%s -> %s\t+%s\n",
+			ei+1, commit.mark,
+			after.Add(-deltas[i]).UTC().Format(time.RFC3339),
+			after.UTC().Format(time.RFC3339), deltas[i])
+	}
+	if !dryrun && len(fixed) > 0 {
+		repo.invalidateNamecache()
+		repo.dirty = true
+	}
+	respond("%d commits adjusted.", len(fixed))
 	return false
 }
 
@@ -12840,6 +17777,262 @@ func (rs *Reposurgeon) DoTimeoffset(line string) bool {
 			}
 		}
 	}
+	rs.chosen().dirty = true
+	return false
+}
+
+// Confidence levels of timezone inferences, weakest first.
+const (
+	zoneNone = iota
+	zoneLow
+	zoneMedium
+	zoneHigh
+)
+
+var zoneConfidenceNames = []string{"none", "low", "medium", "high"}
+
+// zoneHistogramMinimum is how many zero-offset stamps a contributor must
+// have before the hours they fall at are taken as evidence of a zone.
+const zoneHistogramMinimum = 20
+
+// zoneInference is what inferZones concludes about one contributor.
+type zoneInference struct {
+	email      string
+	zone       string // IANA zone name or [+-]hhmm offset
+	loc        *time.Location
+	confidence int
+	evidence   string
+	zeroes     int // Stamps with a zero offset
+	total      int
+}
+
+// inferZones guesses the timezone of each contributor to the selection.
+// In order of preference the evidence is: a zone from the author map;
+// the offset most often found in the contributor's stamps that have a
+// nonzero one; the country-code domain of their address; and the shift
+// that puts most of their zero-offset stamps in working hours.
+func (repo *Repository) inferZones(selection orderedIntSet) []*zoneInference {
+	type evidence struct {
+		email   string
+		offsets map[string]int
+		hours   [24]int
+		zeroes  int
+		total   int
+	}
+	byEmail := make(map[string]*evidence)
+	var keys []string
+	gather := func(attr *Attribution) {
+		key := strings.ToLower(attr.email)
+		e, ok := byEmail[key]
+		if !ok {
+			e = &evidence{email: attr.email, offsets: make(map[string]int)}
+			byEmail[key] = e
+			keys = append(keys, key)
+		}
+		e.total++
+		if _, offset := attr.date.timestamp.Zone(); offset == 0 {
+			e.zeroes++
+			e.hours[attr.date.timestamp.UTC().Hour()]++
+		} else {
+			e.offsets[attr.date.timestamp.Format("-0700")]++
+		}
+	}
+	for _, ei := range selection {
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			gather(&event.committer)
+			for i := range event.authors {
+				gather(&event.authors[i])
+			}
+		case *Tag:
+			if event.tagger != nil {
+				gather(event.tagger)
+			}
+		}
+	}
+	sort.Strings(keys)
+	inferences := make([]*zoneInference, 0, len(keys))
+	for _, key := range keys {
+		e := byEmail[key]
+		inference := &zoneInference{email: e.email, zeroes: e.zeroes, total: e.total}
+		inferences = append(inferences, inference)
+		mapped := false
+		for _, entry := range repo.authormap {
+			if entry.timezone == "" || !strings.EqualFold(entry.email, e.email) {
+				continue
+			}
+			loc, err := time.LoadLocation(entry.timezone)
+			if err != nil {
+				loc, err = locationFromZoneOffset(entry.timezone)
+			}
+			if err == nil {
+				inference.zone, inference.loc = entry.timezone, loc
+				inference.confidence = zoneHigh
+				inference.evidence = "author map"
+				mapped = true
+				break
+			}
+		}
+		if mapped {
+			continue
+		}
+		if len(e.offsets) > 0 {
+			best := ""
+			for offset, count := range e.offsets {
+				if count > e.offsets[best] || (count == e.offsets[best] && offset < best) {
+					best = offset
+				}
+			}
+			if loc, err := locationFromZoneOffset(best); err == nil {
+				inference.zone, inference.loc = best, loc
+				inference.confidence = zoneHigh
+				inference.evidence = fmt.Sprintf("%d of %d stamps carry it", e.offsets[best], e.total)
+				continue
+			}
+		}
+		if zone := zoneFromEmail(e.email); zone != "" {
+			if loc, err := time.LoadLocation(zone); err == nil {
+				inference.zone, inference.loc = zone, loc
+				inference.confidence = zoneMedium
+				inference.evidence = "country-code domain"
+				continue
+			}
+		}
+		if e.zeroes >= zoneHistogramMinimum {
+			// Ties go to the shift that centers the stamps
+			// best on 14:00 local time.
+			best, bestCount, bestSpread := 0, -1, 0
+			for shift := -11; shift <= 12; shift++ {
+				count, spread := 0, 0
+				for hour, n := range e.hours {
+					local := (hour + shift + 24) % 24
+					if local >= 9 && local < 19 {
+						count += n
+					}
+					spread += n * (local - 14) * (local - 14)
+				}
+				if count > bestCount || (count == bestCount && spread < bestSpread) {
+					best, bestCount, bestSpread = shift, count, spread
+				}
+			}
+			if bestCount*2 >= e.zeroes {
+				inference.zone = fmt.Sprintf("%+03d00", best)
+				inference.loc = time.FixedZone(inference.zone, best*3600)
+				inference.confidence = zoneLow
+				inference.evidence = fmt.Sprintf("%d of %d zero-offset stamps fall in working hours", bestCount, e.zeroes)
+				continue
+			}
+		}
+		inference.evidence = "no evidence"
+	}
+	return inferences
+}
+
+// HelpTimezones says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTimezones() {
+	rs.helpOutput(`
+[SELECTION] timezones [--confidence=LEVEL] [--dry-run] [>OUTFILE]
+
+Infer the timezone of each contributor to the selected events
+(default all), and give their stamps with a zero offset, such as
+conversions from CVS are full of, that zone.  The times themselves are
+not changed, only the offsets they are shown with.
+
+The evidence used, strongest first, is: a zone given for the
+contributor by the author map; the offset most often found in their
+stamps that have a nonzero one (high confidence); the country-code
+domain of their address, when the country has only one zone (medium
+confidence); and the whole-hour shift that puts most of their
+zero-offset stamps between 09:00 and 19:00 local time, and centers them
+best on 14:00, when they have at least 20 of them (low confidence).
+
+A report is written with a line for each contributor: address, zone,
+confidence, evidence, and the number of zero-offset stamps.  Only
+inferences with at least the confidence given by --confidence (low,
+medium, or high; default medium) are applied, and with --dry-run none
+are.
+`)
+}
+
+// DoTimezones infers contributor timezones and applies them to stamps.
+func (rs *Reposurgeon) DoTimezones(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	threshold := zoneMedium
+	if val, present := parse.OptVal("--confidence"); present {
+		threshold = -1
+		for level, name := range zoneConfidenceNames {
+			if level > zoneNone && name == val {
+				threshold = level
+			}
+		}
+		if threshold < 0 {
+			croak("confidence level must be low, medium, or high")
+			return false
+		}
+	}
+	inferences := repo.inferZones(selection)
+	applied := make(map[string]*time.Location)
+	for _, inference := range inferences {
+		zone := inference.zone
+		if zone == "" {
+			zone = "-"
+		}
+		fmt.Fprintf(parse.stdout, "%s\t%s\t%s\t%s\t%d of %d stamps zero-offset\n",
+			inference.email, zone, zoneConfidenceNames[inference.confidence],
+			inference.evidence, inference.zeroes, inference.total)
+		if inference.confidence >= threshold && inference.zeroes > 0 {
+			applied[strings.ToLower(inference.email)] = inference.loc
+		}
+	}
+	if parse.options.Contains("--dry-run") {
+		return false
+	}
+	changed := 0
+	rezone := func(attr *Attribution) bool {
+		loc, ok := applied[strings.ToLower(attr.email)]
+		if !ok {
+			return false
+		}
+		if _, offset := attr.date.timestamp.Zone(); offset != 0 {
+			return false
+		}
+		attr.date.timestamp = attr.date.timestamp.In(loc)
+		changed++
+		return true
+	}
+	for _, ei := range selection {
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			touched := rezone(&event.committer)
+			for i := range event.authors {
+				if rezone(&event.authors[i]) {
+					touched = true
+				}
+			}
+			if touched {
+				event.hash.invalidate()
+			}
+		case *Tag:
+			if event.tagger != nil {
+				rezone(event.tagger)
+			}
+		}
+	}
+	repo.invalidateNamecache()
+	if changed > 0 {
+		repo.dirty = true
+	}
+	respond("%d stamps given inferred zones.", changed)
 	return false
 }
 
@@ -12948,6 +18141,7 @@ func (rs *Reposurgeon) DoDivide(_line string) bool {
 	} else {
 		// If that failed, cut anyway and rename the branch segments
 		lateCommit.removeParent(earlyCommit)
+		rs.chosen().dirty = true
 		if earlyCommit.Branch != lateCommit.Branch {
 			respond("no branch renames were required")
 		} else {
@@ -12971,36 +18165,141 @@ func (rs *Reposurgeon) DoDivide(_line string) bool {
 	return false
 }
 
-// HelpExpunge says "Shut up, golint!"
-func (rs *Reposurgeon) HelpExpunge() {
+// HelpPartition says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPartition() {
 	rs.helpOutput(`
-[SELECTION] expunge [~] [/PATTERN/...]
+partition [--empty=prune|tagify|keep] DIRECTORY=NAME[:POLICY]...
 
-Expunge files from the selected portion of the repo history; the
-default is the entire history.  The arguments to this command may be
-paths or regular expressions matching paths (regexps must
-be marked by being surrounded with //).  String quotes and backslash
-escapes are interpreted when parsing the command line.
+Break up the chosen repository by directory, as when splitting a
+monorepo, making a new repository from each DIRECTORY in one pass.
+Each gets the history of the content under its directory, which
+becomes the top of its tree, as the subdirectory command would leave
+it, and is named NAME.  Commits, tags, and resets are copied into every
+new repository; blobs only into those that refer to them, and their
+content is shared rather than copied.  The chosen repository is left
+unchanged and stays chosen.  This command does not take a selection
+set.
 
-Exceptionally, the first argument may be the token "~" which chooses
-all file paths other than those selected by the remaining arguments to
-ne expunged.  You may use this to sift out all file operations
-matching a pattern set rather than expunging them.
+Commits left with no fileops in a new repository are dealt with
+according to the --empty policy, which may be overridden for one
+repository by giving a POLICY after its name:
 
-All filemodify (M) operations and delete (D) operations involving a
-matched file in the selected set of events are disconnected from the
-repo and put in a removal set.  Renames are followed as the tool walks
-forward in the selection set; each triggers a warning message. If a
-selected file is a copy (C) target, the copy will be deleted and a
-warning message issued. If a selected file is a copy source, the copy
-target will be added to the list of paths to be deleted and a warning
-issued.
+prune:: The default. Delete them as the prune command does; branch
+refs and tags on them move back to their parents, and merge commits
+are kept.
 
-After file expunges have been performed, any commits with no
-remaining file operations will be deleted, and any tags pointing to
-them. By default each deleted commit is replaced with a tag of the form
-emptycommit-<ident> on the preceding commit unless --notagify is
-specified as an argument.  Commits with deleted fileops pointing both
+tagify:: Turn them into annotated tags as the tagify command does.
+
+keep:: Leave them alone.
+
+Example:
+
+----
+partition --empty=prune src/frontend=frontend src/backend=backend:tagify
+----
+`)
+}
+
+// DoPartition breaks up a repository by directory.
+func (rs *Reposurgeon) DoPartition(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if rs.selection != nil {
+		croak("partition does not take a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	validPolicy := func(policy string) bool {
+		return policy == "prune" || policy == "tagify" || policy == "keep"
+	}
+	policy := "prune"
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--empty=") {
+			policy = strings.TrimPrefix(option, "--empty=")
+			if !validPolicy(policy) {
+				croak("unknown --empty policy %q", policy)
+				return false
+			}
+		} else {
+			croak("unknown option %s in partition line", option)
+			return false
+		}
+	}
+	args := parse.Tokens()
+	if len(args) == 0 {
+		croak("partition requires at least one DIRECTORY=NAME argument")
+		return false
+	}
+	var specs []pathPartition
+	names := newOrderedStringSet()
+	for _, arg := range args {
+		fields := strings.SplitN(arg, "=", 2)
+		if len(fields) != 2 {
+			croak("partition argument %q is not of the form DIRECTORY=NAME", arg)
+			return false
+		}
+		spec := pathPartition{prefix: strings.Trim(fields[0], "/"), name: fields[1], empty: policy}
+		if colon := strings.LastIndex(spec.name, ":"); colon != -1 {
+			spec.name, spec.empty = spec.name[:colon], spec.name[colon+1:]
+			if !validPolicy(spec.empty) {
+				croak("unknown empty-commit policy %q for %s", spec.empty, spec.name)
+				return false
+			}
+		}
+		if spec.prefix == "" {
+			croak("partition requires directories below the top of the tree")
+			return false
+		}
+		if spec.name == "" {
+			croak("partition argument %q has no repository name", arg)
+			return false
+		}
+		if rs.reponames().Contains(spec.name) || names.Contains(spec.name) {
+			croak("there is already a repo named %s.", spec.name)
+			return false
+		}
+		names.Add(spec.name)
+		specs = append(specs, spec)
+	}
+	for i, part := range rs.partition(specs) {
+		respond("%s: %d commits from %s.", part.name, len(part.commits(nil)), specs[i].prefix)
+	}
+	return false
+}
+
+// HelpExpunge says "Shut up, golint!"
+func (rs *Reposurgeon) HelpExpunge() {
+	rs.helpOutput(`
+[SELECTION] expunge [~] [/PATTERN/...]
+
+Expunge files from the selected portion of the repo history; the
+default is the entire history.  The arguments to this command may be
+paths or regular expressions matching paths (regexps must
+be marked by being surrounded with //).  String quotes and backslash
+escapes are interpreted when parsing the command line.
+
+Exceptionally, the first argument may be the token "~" which chooses
+all file paths other than those selected by the remaining arguments to
+ne expunged.  You may use this to sift out all file operations
+matching a pattern set rather than expunging them.
+
+All filemodify (M) operations and delete (D) operations involving a
+matched file in the selected set of events are disconnected from the
+repo and put in a removal set.  Renames are followed as the tool walks
+forward in the selection set; each triggers a warning message. If a
+selected file is a copy (C) target, the copy will be deleted and a
+warning message issued. If a selected file is a copy source, the copy
+target will be added to the list of paths to be deleted and a warning
+issued.
+
+After file expunges have been performed, any commits with no
+remaining file operations will be deleted, and any tags pointing to
+them. By default each deleted commit is replaced with a tag of the form
+emptycommit-<ident> on the preceding commit unless --notagify is
+specified as an argument.  Commits with deleted fileops pointing both
 in and outside the path set are not deleted, but are cloned into the
 removal set.
 `)
@@ -13026,18 +18325,23 @@ func (rs *Reposurgeon) DoExpunge(line string) bool {
 	if err != nil {
 		respond(err.Error())
 	}
+	rs.chosen().dirty = true
 	return false
 }
 
 // HelpSplit says "Shut up, golint!"
-//FIXME: Odd syntax
+// FIXME: Odd syntax
 func (rs *Reposurgeon) HelpSplit() {
 	rs.helpOutput(`
-[SELECTION] split at {M}
+[SELECTION] split at {M} [comment TEMPLATE] [author NAME EMAIL]
 
-[SELECTION] split by {PREFIX}
+[SELECTION] split by {PREFIX} [comment TEMPLATE] [author NAME EMAIL]
 
-Split a specified commit in two, the opposite of squash.
+[SELECTION] split matching {/REGEXP/}... [comment TEMPLATE] [author NAME EMAIL]
+
+[SELECTION] split into {INDICES}... [comment TEMPLATE] [author NAME EMAIL]
+
+Split a specified commit in two or more, the opposite of squash.
 
 The selection set is required to be a commit location; the modifier is
 a preposition which indicates which splitting method to use. If the
@@ -13056,6 +18360,24 @@ Finally, some file operations - starting at the one matched or indexed
 by the split argument - are moved forward from the original commit
 into the new one.  Legal indices are 2-n, where n is the number of
 file operations in the original commit.
+
+The 'matching' and 'into' forms split a commit into as many pieces as
+they are given arguments, in a chain of commits each the child of the
+one before.  With 'matching', each argument is a delimited regular
+expression, and each fileop goes to the piece of the first expression
+that matches its path (or the source of a rename or copy); fileops
+matching none of them stay in the original commit, ahead of the
+others.  With 'into', each argument is a comma-separated list of
+1-origin fileop indices, such as "1,3 2,4"; every fileop must be in
+exactly one list.  A split that would move a fileop ahead of an earlier
+one touching the same path is refused.  Pieces after the second get
+legacy ID suffixes '.split2', '.split3', and so on.
+
+After any form, 'comment' replaces the comment of every piece with a
+template, in which {n} is the piece number, {count} the number of
+pieces, and {comment} the original comment; 'author' likewise sets the
+name and email of the first author of every piece, and the templates
+may use {n} and {count}.  Quote templates containing spaces.
 `)
 }
 
@@ -13069,54 +18391,421 @@ func (rs *Reposurgeon) DoSplit(line string) bool {
 		croak("selection of a single commit required for this command")
 		return false
 	}
+	repo := rs.chosen()
 	where := rs.selection[0]
-	event := rs.chosen().events[where]
+	event := repo.events[where]
 	commit, ok := event.(*Commit)
 	if !ok {
 		croak("selection doesn't point at a commit")
 		return false
 	}
-	fields := strings.Fields(line)
-	prep := fields[0]
-	obj := fields[1]
-	if len(fields) != 2 {
+	fields, err := shlex.Split(line, true)
+	if err != nil {
+		croak("split parse failed: %v", err)
+		return false
+	}
+	// Peel off the templates, which follow the split arguments.
+	var comment, name, email string
+	var hasComment, hasAuthor bool
+	for i := 1; i < len(fields); i++ {
+		if fields[i] == "comment" && i+1 < len(fields) {
+			comment, hasComment = fields[i+1], true
+			fields = append(fields[:i], fields[i+2:]...)
+			i--
+		} else if fields[i] == "author" && i+2 < len(fields) {
+			name, email, hasAuthor = fields[i+1], fields[i+2], true
+			fields = append(fields[:i], fields[i+3:]...)
+			i--
+		}
+	}
+	if len(fields) < 2 {
 		croak("ill-formed split command")
 		return false
 	}
-	if prep == "at" {
-		splitpoint, err := strconv.Atoi(obj)
-		if err != nil {
-			croak("expected integer fileop index (1-origin)")
+	prep := fields[0]
+	original := commit.Comment
+	var split []*Commit
+	switch prep {
+	case "at", "by":
+		if len(fields) != 2 {
+			croak("ill-formed split command")
 			return false
 		}
-		splitpoint--
-		if splitpoint > len(commit.operations()) {
-			croak("fileop index %d out of range", splitpoint)
-			return false
+		obj := fields[1]
+		if prep == "at" {
+			splitpoint, err := strconv.Atoi(obj)
+			if err != nil {
+				croak("expected integer fileop index (1-origin)")
+				return false
+			}
+			splitpoint--
+			if splitpoint > len(commit.operations()) {
+				croak("fileop index %d out of range", splitpoint)
+				return false
+			}
+			err = repo.splitCommitByIndex(where, splitpoint)
+		} else {
+			err = repo.splitCommitByPrefix(where, obj)
 		}
-		err = rs.chosen().splitCommitByIndex(where, splitpoint)
 		if err != nil {
 			croak(err.Error())
 			return false
 		}
-	} else if prep == "by" {
-		err := rs.chosen().splitCommitByPrefix(where, obj)
+		split = []*Commit{commit, repo.events[where+1].(*Commit)}
+	case "matching", "into":
+		var pieces [][]*FileOp
+		if prep == "matching" {
+			patterns := make([]*regexp.Regexp, 0, len(fields)-1)
+			for _, field := range fields[1:] {
+				pattern, err := delimitedRegexp(field)
+				if err != nil {
+					croak(err.Error())
+					return false
+				}
+				patterns = append(patterns, pattern)
+			}
+			pieces, err = splitByPatterns(commit.operations(), patterns)
+		} else {
+			pieces, err = splitByIndices(commit.operations(), fields[1:])
+		}
+		if err == nil {
+			split, err = repo.splitCommitInto(where, pieces)
+		}
 		if err != nil {
 			croak(err.Error())
 			return false
 		}
-	} else {
+	default:
 		croak("don't know what to do for preposition %s", prep)
 		return false
 	}
-	respond("new commits are events %d and %d.", where+1, where+2)
+	count := strconv.Itoa(len(split))
+	for i, piece := range split {
+		replacer := strings.NewReplacer("{n}", strconv.Itoa(i+1), "{count}", count,
+			"{comment}", strings.TrimRight(original, "\n"))
+		if hasComment {
+			piece.Comment = replacer.Replace(comment) + "\n"
+		}
+		if hasAuthor {
+			if len(piece.authors) == 0 {
+				piece.authors = append(piece.authors, Attribution{date: piece.committer.date})
+			}
+			piece.authors[0].fullname = replacer.Replace(name)
+			piece.authors[0].email = replacer.Replace(email)
+		}
+		piece.hash.invalidate()
+	}
+	repo.dirty = true
+	if len(split) == 2 {
+		respond("new commits are events %d and %d.", where+1, where+2)
+	} else {
+		respond("new commits are events %d to %d.", where+1, where+len(split))
+	}
+	return false
+}
+
+// cherries pairs the selected commits with commits in another
+// repository that make the same change, matching by patchID.  The
+// returned map takes each matched commit here to its equivalent there;
+// each commit is paired at most once, in event order.  Commits that
+// change nothing are left out of the comparison.
+func (repo *Repository) cherries(selection orderedIntSet, other *Repository) map[*Commit]*Commit {
+	candidates := make(map[gitHashType][]*Commit)
+	for _, commit := range other.commits(nil) {
+		if len(commit.operations()) > 0 {
+			id := commit.patchID()
+			candidates[id] = append(candidates[id], commit)
+		}
+	}
+	pairs := make(map[*Commit]*Commit)
+	for _, commit := range repo.commits(selection) {
+		if len(commit.operations()) == 0 {
+			continue
+		}
+		id := commit.patchID()
+		if matches := candidates[id]; len(matches) > 0 {
+			pairs[commit] = matches[0]
+			candidates[id] = matches[1:]
+		}
+	}
+	return pairs
+}
+
+// transplant copies commits onto the tip of a branch of another
+// repository, oldest first, each becoming the parent of the next. A
+// commit brings the change it makes to its first parent; its blobs are
+// matched by content against the blobs of the target, and copied there
+// only if no match is found. A "(cherry picked from commit HASH)" line
+// is appended to the comment of each copy. Branch refs left by resets
+// on the old tip move to the new one. It returns the copies.
+func (repo *Repository) transplant(commits []*Commit, target *Repository, branch string) ([]*Commit, error) {
+	var tip *Commit
+	for _, commit := range target.commits(nil) {
+		if commit.Branch == branch {
+			tip = commit
+		}
+	}
+	if tip == nil {
+		return nil, fmt.Errorf("no branch %s in %s", branch, target.name)
+	}
+	// Hashes depend on ancestry, so take them before anything changes.
+	origins := make([]string, len(commits))
+	for i, commit := range commits {
+		origins[i] = commit.gitHash().hexify()
+	}
+	bySize := make(map[int64][]*Blob)
+	for _, event := range target.events {
+		if blob, ok := event.(*Blob); ok {
+			bySize[blob.size] = append(bySize[blob.size], blob)
+		}
+	}
+	copied := make(map[string]string)
+	blobFor := func(mark string) string {
+		if ref, ok := copied[mark]; ok {
+			return ref
+		}
+		blob, ok := repo.markToEvent(mark).(*Blob)
+		if !ok {
+			return mark
+		}
+		for _, candidate := range bySize[blob.size] {
+			if candidate.gitHash() == blob.gitHash() {
+				copied[mark] = candidate.mark
+				return candidate.mark
+			}
+		}
+		newblob := newBlob(target)
+		newblob.setContentFromStream(blob.getContentStream())
+		newblob.setMark(target.newmark())
+		target.addEvent(newblob)
+		bySize[newblob.size] = append(bySize[newblob.size], newblob)
+		copied[mark] = newblob.mark
+		return newblob.mark
+	}
+	oldtip := tip
+	copies := make([]*Commit, 0, len(commits))
+	for i, commit := range commits {
+		var ops []*FileOp
+		for _, op := range commit.operations() {
+			newop := newFileOp(target)
+			switch op.op {
+			case opM, opN:
+				ref := op.ref
+				if strings.HasPrefix(ref, ":") {
+					ref = blobFor(ref)
+				}
+				if op.op == opM {
+					newop.construct(opM, op.mode, ref, op.Path)
+				} else {
+					newop.construct(opN, ref, op.Path)
+				}
+				newop.inline = append([]byte(nil), op.inline...)
+			case opD:
+				newop.construct(opD, op.Path)
+			case opR, opC:
+				newop.construct(op.op, op.Source, op.Path)
+			case deleteall:
+				newop.construct(deleteall)
+			}
+			ops = append(ops, newop)
+		}
+		twin := commit.clone(target)
+		twin.setParents([]CommitLike{tip})
+		if commit.hasProperties() {
+			twin.properties = copyOrderedMap(commit.properties)
+		}
+		twin.mark = target.newmark()
+		twin.Branch = branch
+		twin.legacyID = ""
+		twin.oid = gitHashType{}
+		twin.Comment = fmt.Sprintf("%s\n\n(cherry picked from commit %s)\n",
+			strings.TrimRight(commit.Comment, "\n"), origins[i])
+		twin.setOperations(ops)
+		target.addEvent(twin)
+		copies = append(copies, twin)
+		tip = twin
+	}
+	// A reset must follow the commit it points at.
+	var moved []*Reset
+	kept := target.events[:0]
+	for _, event := range target.events {
+		if reset, ok := event.(*Reset); ok && reset.ref == branch && reset.committish == oldtip.mark {
+			reset.forget()
+			moved = append(moved, reset)
+			continue
+		}
+		kept = append(kept, event)
+	}
+	target.events = kept
+	target.declareSequenceMutation("transplant")
+	for _, reset := range moved {
+		target.addEvent(reset)
+		reset.remember(target, tip.mark)
+	}
+	return copies, nil
+}
+
+// HelpCherry says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCherry() {
+	rs.helpOutput(`
+[SELECTION] cherry REPO-NAME [>OUTFILE]
+
+Compare the selected commits (default all) of the chosen repository
+with the commits of another loaded repository, such as a vendor fork
+and its upstream, to find the changes they have in common. Commits
+are matched by a hash of the change they make to their first parent -
+paths, modes, and file content - in the manner of git patch-id, so
+commits match even when their metadata differs. Commits that change
+nothing are not compared.
+
+Each selected commit is reported on one line, starting with '=' and
+the event numbers here and in the other repository if it has an
+equivalent there, or with '+' and its event number if it exists only
+here. Then each unmatched commit of the other repository is reported
+with '-' and its event number. Every line ends with the first line of
+the commit comment. A final line gives the counts.
+
+This is useful for deciding which history to keep before a unite.
+Tab-completes on the list of loaded repositories.
+
+Supports > redirection.
+`)
+}
+
+// CompleteCherry is a completion hook across the set of repository names
+func (rs *Reposurgeon) CompleteCherry(text string) []string {
+	return rs.CompleteChoose(text)
+}
+
+// DoCherry reports commits equivalent across two repositories.
+func (rs *Reposurgeon) DoCherry(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if parse.line == "" {
+		croak("cherry requires a repo name argument")
+		return false
+	}
+	other := rs.repoByName(parse.line)
+	if other == repo {
+		croak("cannot compare a repository with itself")
+		return false
+	}
+	pairs := repo.cherries(selection, other)
+	matched := make(map[*Commit]bool, len(pairs))
+	for _, commit := range pairs {
+		matched[commit] = true
+	}
+	topline := func(commit *Commit) string {
+		line, _ := splitRuneFirst(commit.Comment, '\n')
+		return line
+	}
+	mine := 0
+	for _, commit := range repo.commits(selection) {
+		if len(commit.operations()) == 0 {
+			continue
+		}
+		if twin, ok := pairs[commit]; ok {
+			fmt.Fprintf(parse.stdout, "= %d %d\t%s\n",
+				repo.markToIndex(commit.mark)+1, other.markToIndex(twin.mark)+1, topline(commit))
+		} else {
+			fmt.Fprintf(parse.stdout, "+ %d\t%s\n", repo.markToIndex(commit.mark)+1, topline(commit))
+			mine++
+		}
+	}
+	theirs := 0
+	for _, commit := range other.commits(nil) {
+		if len(commit.operations()) > 0 && !matched[commit] {
+			fmt.Fprintf(parse.stdout, "- %d\t%s\n", other.markToIndex(commit.mark)+1, topline(commit))
+			theirs++
+		}
+	}
+	fmt.Fprintf(parse.stdout, "%d in both, %d only in %s, %d only in %s\n",
+		len(pairs), mine, repo.name, theirs, other.name)
+	return false
+}
+
+// HelpTransplant says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTransplant() {
+	rs.helpOutput(`
+{SELECTION} transplant REPO-NAME BRANCH
+
+Copy the selected commits of the chosen repository onto the tip of a
+branch of another loaded repository, as 'git cherry-pick -x' would.
+The copies are appended to the other repository oldest first, each the
+child of the one before, and each brings the change its original makes
+to its first parent.  A merge commit is copied as its first-parent
+change, without its other parents.
+
+Blobs are matched by content: a copy refers to a blob of the other
+repository with the same content when there is one, and the blob is
+copied there with a new mark when there is not.  A line of the form
+"(cherry picked from commit HASH)" is appended to the comment of each
+copy, where HASH is the git hash of the original as the chosen
+repository stands now.  Resets on the old tip of the branch move to
+the new one.  The chosen repository is not changed.
+
+BRANCH may be given with or without its refs/heads/ prefix.
+`)
+}
+
+// DoTransplant copies commits onto a branch of another repository.
+func (rs *Reposurgeon) DoTransplant(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if rs.selection == nil {
+		croak("transplant requires a selection set")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) != 2 {
+		croak("transplant requires a repo name and a branch")
+		return false
+	}
+	target := rs.repoByName(args[0])
+	if target == nil {
+		croak("no such repo as %s", args[0])
+		return false
+	} else if target == repo {
+		croak("cannot transplant commits into the repository they come from")
+		return false
+	}
+	branch := args[1]
+	if !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+	commits := repo.commits(rs.selection)
+	if len(commits) == 0 {
+		croak("no commits selected")
+		return false
+	}
+	copies, err := repo.transplant(commits, target, branch)
+	if err != nil {
+		croak(err.Error())
+		return false
+	}
+	target.dirty = true
+	respond("%d commits transplanted onto %s in %s.", len(copies), branch, target.name)
 	return false
 }
 
 // HelpUnite says "Shut up, golint!"
 func (rs *Reposurgeon) HelpUnite() {
 	rs.helpOutput(`
-unite [--prune] [REPO-NAME...]
+unite [--prune] [--paths=merge|prefix|fail|newest] [REPO-NAME...]
 
 Unite repositories. Name any number of loaded repositories; they will
 be united into one union repo and removed from the load list.  The
@@ -13137,6 +18826,23 @@ type.
 With the option --prune, at each join generate D ops for every
 file that doesn't have a modify operation in the root commit of the
 branch being grafted on.
+
+The --paths option says what to do when the histories of the parts
+touch the same paths, as the same file or as a file in one and a
+directory in another:
+
+merge:: The default. Unite them anyway, warning of the collisions;
+the grafted branches will see each other's files.
+
+prefix:: Move the content of each part into a directory named after
+it, so that no collision is possible.  A deleteall becomes a deletion
+of that directory.
+
+fail:: Report the colliding paths and leave the repositories as they
+were.
+
+newest:: Leave each colliding path to the part that changed it last,
+and move it into a directory named after the part in the others.
 `)
 }
 
@@ -13158,7 +18864,20 @@ func (rs *Reposurgeon) DoUnite(line string) bool {
 		croak("unite requires two or more repo name arguments")
 		return false
 	}
-	rs.unite(factors, parse.options.toStringSet())
+	strategy := "merge"
+	options := newStringSet()
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--paths=") {
+			strategy = strings.TrimPrefix(option, "--paths=")
+			if strategy != "merge" && strategy != "prefix" && strategy != "fail" && strategy != "newest" {
+				croak("unknown --paths strategy %q", strategy)
+				return false
+			}
+		} else {
+			options.Add(option)
+		}
+	}
+	rs.unite(factors, options, strategy)
 	if control.isInteractive() && !control.flagOptions["quiet"] {
 		rs.DoChoose("")
 	}
@@ -13168,15 +18887,15 @@ func (rs *Reposurgeon) DoUnite(line string) bool {
 // HelpGraft says "Shut up, golint!"
 func (rs *Reposurgeon) HelpGraft() {
 	rs.helpOutput(`
-[SELECTION] graft [--prune] REPO-NAME
+[SELECTION] graft [--prune] [--consistent] REPO-NAME
 
 For when unite doesn't give you enough control. This command may have
 either of two forms, selected by the size of the selection set.  The
 first argument is always required to be the name of a loaded repo.
 
 If the selection set is of size 1, it must identify a single commit in
-the currently chosen repo; in this case the named repo's root will
-become a child of the specified commit. If the selection set is
+the currently chosen repo; in this case the named repo's roots will
+become children of the specified commit. If the selection set is
 empty, the named repo must contain one or more callouts matching a
 commits in the currently chosen repo.
 
@@ -13185,8 +18904,15 @@ it is grafted to the selected one. Any other callouts in the named repo are also
 resolved in the control of the currently chosen one. Finally, the
 named repo is removed from the load list.
 
-With the option --prune, prepend a deleteall operation into the root
+With the option --prune, prepend a deleteall operation into each root
 of the grafted repository.
+
+With the option --consistent, rewrite the fileops of each grafted root
+so that its tree stays what it was before the graft: files of the
+specified commit that the root lacks are deleted, and only files the
+root adds or changes are modified.  This is the usual way to stitch
+pre-history, such as a series of imported release tarballs, onto the
+history that followed it.  Blobs no longer referred to are removed.
 `)
 }
 
@@ -13203,6 +18929,13 @@ func (rs *Reposurgeon) DoGraft(line string) bool {
 	parse := rs.newLineParse(line, nil)
 	defer parse.Closem()
 	graftRepo := rs.repoByName(parse.line)
+	if graftRepo == nil {
+		croak("no such repo as %s", parse.line)
+		return false
+	} else if graftRepo == rs.chosen() {
+		croak("cannot graft a repo onto itself")
+		return false
+	}
 	requireGraftPoint := true
 	var graftPoint int
 	if rs.selection != nil && len(rs.selection) == 1 {
@@ -13223,49 +18956,142 @@ func (rs *Reposurgeon) DoGraft(line string) bool {
 		}
 	}
 	// OK, we've got the two repos and the graft point.  Do it.
-	rs.chosen().graft(graftRepo, graftPoint, parse.options.toStringSet())
-	rs.removeByName(graftRepo.name)
+	if err := rs.graft(graftRepo, graftPoint, parse.options.toStringSet()); err != nil {
+		croak(err.Error())
+	}
 	return false
 }
 
-// HelpDebranch says "Shut up, golint!"
-func (rs *Reposurgeon) HelpDebranch() {
+// HelpCallouts says "Shut up, golint!"
+func (rs *Reposurgeon) HelpCallouts() {
 	rs.helpOutput(`
-debranch {SOURCE-BRANCH} [TARGET-BRANCH]
-
-Takes one or two arguments which must be the names of source and target
-branches; if the second (target) argument is omitted it defaults to 'master'.
-The history of the source branch is merged into the history of the target
-branch, becoming the history of a subdirectory with the name of the source
-branch. Any trailing segment of a branch name is accepted as a synonym for
-it; thus 'master' is the same as 'refs/heads/master'.  Any resets of the
-source branch are removed.
+[SELECTION] callouts [list] [>OUTFILE]
+callouts resolve [REPO-NAME]
+
+Callouts are the parent references, in the form of action stamps,
+that 'write --callout' and 'write --slice' leave in place of parents
+outside the written segment.
+
+With no verb or the verb 'list', report each callout parent of the
+selected commits (defaulting to all), one per line: the commit's
+event number and mark, the callout cookie, and the mark of the
+commit it would resolve to in the chosen repository, or '-' if
+there is none.
+
+With the verb 'resolve', rewrite callouts in the chosen repository
+into real parent links. A callout is resolved when its cookie matches
+the action stamp of exactly one earlier commit.  If a repository name
+is given, it should hold the history the chosen segment was cut
+from; its events are spliced in ahead of the segment's, marks are
+renumbered, and the named repository is removed from the load list.
+Unlike graft, this leaves branch and tag names unchanged, so branches
+cut by the segmenting continue across the join. It is an error for
+none of the callouts to match a commit in the named repository.
+
+Callouts that cannot be resolved are left in place and reported, so
+that segments can be rejoined one at a time.
 `)
 }
 
-// DoDebranch turns a branch into a subdirectory.
-func (rs *Reposurgeon) DoDebranch(line string) bool {
+// DoCallouts lists or resolves callouts.
+func (rs *Reposurgeon) DoCallouts(line string) bool {
 	if rs.chosen() == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	args := strings.Fields(line)
-	if len(args) == 0 {
-		croak("debranch command requires at least one argument")
-		return false
-	}
-	target := "refs/heads/master"
-	source := args[0]
-	if len(args) == 2 {
-		target = args[1]
-	}
 	repo := rs.chosen()
-	branches := repo.branchmap()
-	if branches[source] == "" {
-		for candidate := range branches {
-			if strings.HasSuffix(candidate, string(os.PathSeparator)+source) {
-				source = candidate
-				goto found1
+	verb, line := popToken(line)
+	switch verb {
+	case "", "list":
+		parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+		defer parse.Closem()
+		selection := rs.selection
+		if selection == nil {
+			selection = repo.all()
+		}
+		for _, ei := range selection {
+			commit, ok := repo.events[ei].(*Commit)
+			if !ok {
+				continue
+			}
+			for _, parent := range commit.parents() {
+				cookie := parent.getMark()
+				if !isCallout(cookie) {
+					continue
+				}
+				target := "-"
+				if ti := repo.calloutTarget(cookie); ti != -1 && ti < ei {
+					target = repo.events[ti].getMark()
+				}
+				fmt.Fprintf(parse.stdout, "%d\t%s\t%s\t%s\n", ei+1, commit.mark, cookie, target)
+			}
+		}
+	case "resolve":
+		var base *Repository
+		if name := strings.TrimSpace(line); name != "" {
+			if base = rs.repoByName(name); base == repo {
+				base = nil
+			}
+		}
+		resolved, unresolved, err := repo.resolveCallouts(base)
+		if err != nil {
+			croak(err.Error())
+			return false
+		}
+		if base != nil {
+			rs.removeByName(base.name)
+		}
+		if base != nil || resolved > 0 {
+			repo.dirty = true
+		}
+		respond("%d callouts resolved, %d unresolved.", resolved, len(unresolved))
+		if len(unresolved) > 0 && logEnable(logWARN) {
+			logit("unresolved callouts: %v", unresolved)
+		}
+	default:
+		croak("unknown verb '%s' in callouts command.", verb)
+	}
+	return false
+}
+
+// HelpDebranch says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDebranch() {
+	rs.helpOutput(`
+debranch {SOURCE-BRANCH} [TARGET-BRANCH]
+
+Takes one or two arguments which must be the names of source and target
+branches; if the second (target) argument is omitted it defaults to 'master'.
+The history of the source branch is merged into the history of the target
+branch, becoming the history of a subdirectory with the name of the source
+branch. Any trailing segment of a branch name is accepted as a synonym for
+it; thus 'master' is the same as 'refs/heads/master'.  Any resets of the
+source branch are removed.
+`)
+}
+
+// DoDebranch turns a branch into a subdirectory.
+func (rs *Reposurgeon) DoDebranch(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		croak("debranch command requires at least one argument")
+		return false
+	}
+	target := "refs/heads/master"
+	source := args[0]
+	if len(args) == 2 {
+		target = args[1]
+	}
+	repo := rs.chosen()
+	branches := repo.branchmap()
+	if branches[source] == "" {
+		for candidate := range branches {
+			if strings.HasSuffix(candidate, string(os.PathSeparator)+source) {
+				source = candidate
+				goto found1
 			}
 		}
 		croak("no branch matches source %s", source)
@@ -13331,6 +19157,7 @@ func (rs *Reposurgeon) DoDebranch(line string) bool {
 		repo.delete([]int{sourceReset}, nil)
 	}
 	repo.declareSequenceMutation("debranch operation")
+	repo.dirty = true
 	return false
 }
 
@@ -13348,9 +19175,100 @@ back-reference syntax.
 Ordinarily, if the target path already exists in the fileops, or is visible
 in the ancestry of the commit, this command throws an error.  With the
 --force option, these checks are skipped.
+
+path {SOURCE} move {TARGET}
+
+Record a directory reorganization as renames.  In each selected commit,
+a D of a file or directory matching SOURCE, paired with M ops creating
+the same content at the path (or, for a directory, every path under it)
+given by TARGET, is replaced by a single R op.  M ops whose content
+differs from what was deleted are kept, after the R.  Unlike rename,
+this does not touch history before the reorganization; it only makes
+'git log --follow' and blame work across it in the converted repository.
+Deletions without a complete set of matching M ops are left alone.
 `)
 }
 
+// recordMoves replaces D/M pairs that move content from paths matching
+// sourceRE to the corresponding target paths with R ops, returning the
+// number of R ops made.
+func (repo *Repository) recordMoves(selection orderedIntSet, sourceRE *regexp.Regexp, targetPattern string) int {
+	moves := 0
+	for _, commit := range repo.commits(selection) {
+		if !commit.hasParents() {
+			continue
+		}
+		parent, ok := commit.parents()[0].(*Commit)
+		if !ok {
+			continue
+		}
+		before := parent.manifest()
+		modifications := make(map[string]*FileOp)
+		for _, fileop := range commit.operations() {
+			if fileop.op == opM {
+				modifications[fileop.Path] = fileop
+			}
+		}
+		// For each qualifying D, the M ops it absorbs and the
+		// ones that must follow it because their content changed
+		absorbed := make(map[*FileOp]bool)
+		following := make(map[*FileOp][]*FileOp)
+		targets := make(map[*FileOp]string)
+		for _, fileop := range commit.operations() {
+			if fileop.op != opD || !sourceRE.MatchString(fileop.Path) {
+				continue
+			}
+			target := GoReplacer(sourceRE, fileop.Path, targetPattern)
+			if target == fileop.Path {
+				continue
+			}
+			prefix := fileop.Path + svnSep
+			complete := true
+			var moved, changed []*FileOp
+			before.iter(func(path string, item interface{}) {
+				if path != fileop.Path && !strings.HasPrefix(path, prefix) {
+					return
+				}
+				old := item.(*FileOp)
+				mod, ok := modifications[target+path[len(fileop.Path):]]
+				if !ok || absorbed[mod] {
+					complete = false
+				} else if mod.ref == old.ref && mod.mode == old.mode && mod.ref != "inline" {
+					moved = append(moved, mod)
+				} else {
+					changed = append(changed, mod)
+				}
+			})
+			if !complete || len(moved)+len(changed) == 0 {
+				continue
+			}
+			for _, mod := range moved {
+				absorbed[mod] = true
+			}
+			for _, mod := range changed {
+				absorbed[mod] = true
+			}
+			following[fileop] = changed
+			targets[fileop] = target
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		newops := make([]*FileOp, 0, len(commit.fileops))
+		for _, fileop := range commit.operations() {
+			if target, ok := targets[fileop]; ok {
+				newops = append(newops, newFileOp(repo).construct(opR, fileop.Path, target))
+				newops = append(newops, following[fileop]...)
+				moves++
+			} else if !absorbed[fileop] {
+				newops = append(newops, fileop)
+			}
+		}
+		commit.setOperations(newops)
+	}
+	return moves
+}
+
 type pathAction struct {
 	fileop  *FileOp
 	commit  *Commit // Only used for debug dump
@@ -13370,6 +19288,59 @@ func (pa pathAction) String() string {
 	return fmt.Sprintf("[%s(%d) %s=%s]", pa.commit.idMe(), i, pa.attr, pa.newpath)
 }
 
+// planPathRenames works out how the paths of the fileops in the commits
+// matching sourceRE would be rewritten by targetPattern. Unless force is
+// on, it fails if a new path already exists in a commit or is visible
+// in its ancestry, or if two paths in a commit would be given the same
+// new one.
+func (repo *Repository) planPathRenames(commits []*Commit, sourceRE *regexp.Regexp, targetPattern string, force bool) ([]pathAction, error) {
+	actions := make([]pathAction, 0)
+	for _, commit := range commits {
+		claimed := make(map[string]string)
+		for idx := range commit.fileops {
+			for _, attr := range []string{"Path", "Source", "Target"} {
+				fileop := commit.fileops[idx]
+				oldpath, ok := getAttr(fileop, attr)
+				if !ok || oldpath == "" || !sourceRE.MatchString(oldpath) {
+					continue
+				}
+				newpath := GoReplacer(sourceRE, oldpath, targetPattern)
+				if newpath == oldpath {
+					continue
+				}
+				if !force {
+					if commit.visible(newpath) != nil {
+						return nil, fmt.Errorf("rename of %s at %s failed, %s visible in ancestry", oldpath, commit.idMe(), newpath)
+					} else if commit.paths(nil).Contains(newpath) {
+						return nil, fmt.Errorf("rename of %s at %s failed, %s exists there", oldpath, commit.idMe(), newpath)
+					} else if other, ok := claimed[newpath]; ok && other != oldpath {
+						return nil, fmt.Errorf("rename of %s at %s failed, %s is also renamed to %s", oldpath, commit.idMe(), other, newpath)
+					}
+				}
+				claimed[newpath] = oldpath
+				actions = append(actions, pathAction{fileop, commit, attr, newpath})
+			}
+		}
+	}
+	return actions, nil
+}
+
+// applyPathRenames performs renames planned by planPathRenames, carrying
+// renamed submodules along in .gitmodules.
+func (repo *Repository) applyPathRenames(commits []*Commit, actions []pathAction) {
+	gitlinks := make(map[string]string)
+	for _, action := range actions {
+		if action.attr == "Path" && action.fileop.op == opM && action.fileop.mode == gitlinkMode {
+			gitlinks[action.fileop.Path] = action.newpath
+		}
+		setAttr(action.fileop, action.attr, action.newpath)
+		action.commit.invalidateManifests()
+	}
+	if len(gitlinks) > 0 {
+		repo.renameSubmodules(commits, gitlinks)
+	}
+}
+
 // DoPath rename paths in the history.
 func (rs *Reposurgeon) DoPath(line string) bool {
 	if rs.chosen() == nil {
@@ -13403,36 +19374,30 @@ func (rs *Reposurgeon) DoPath(line string) bool {
 			}
 			return false
 		}
-		actions := make([]pathAction, 0)
-		for _, commit := range repo.commits(selection) {
-			for idx := range commit.fileops {
-				for _, attr := range []string{"Path", "Source", "Target"} {
-					fileop := commit.fileops[idx]
-					if oldpath, ok := getAttr(fileop, attr); ok {
-						if ok && oldpath != "" && sourceRE.MatchString(oldpath) {
-							newpath := GoReplacer(sourceRE, oldpath, targetPattern)
-							if !force && commit.visible(newpath) != nil {
-								if logEnable(logWARN) {
-									logit("rename of %s at %s failed, %s visible in ancestry", oldpath, commit.idMe(), newpath)
-								}
-								return false
-							} else if !force && commit.paths(nil).Contains(newpath) {
-								if logEnable(logWARN) {
-									logit("rename of %s at %s failed, %s exists there", oldpath, commit.idMe(), newpath)
-								}
-								return false
-							} else {
-								actions = append(actions, pathAction{fileop, commit, attr, newpath})
-							}
-						}
-					}
-				}
+		actions, err := repo.planPathRenames(repo.commits(selection), sourceRE, targetPattern, force)
+		if err != nil {
+			if logEnable(logWARN) {
+				logit("%v", err)
 			}
+			return false
 		}
-		// All checks must pass before any renames
-		for _, action := range actions {
-			setAttr(action.fileop, action.attr, action.newpath)
+		repo.applyPathRenames(repo.commits(selection), actions)
+		if len(actions) > 0 {
+			repo.dirty = true
+		}
+	} else if verb == "move" {
+		targetPattern, _ := popToken(parse.line)
+		if targetPattern == "" {
+			if logEnable(logWARN) {
+				logit("no target specified in move")
+			}
+			return false
 		}
+		moves := repo.recordMoves(selection, sourceRE, targetPattern)
+		if moves > 0 {
+			repo.dirty = true
+		}
+		respond("%d moves recorded as renames.", moves)
 	} else {
 		if logEnable(logWARN) {
 			logit("unknown verb '%s' in path command.", verb)
@@ -13441,1230 +19406,3664 @@ func (rs *Reposurgeon) DoPath(line string) bool {
 	return false
 }
 
-// HelpPaths says "Shut up, golint!"
-func (rs *Reposurgeon) HelpPaths() {
-	rs.helpOutput(`
-paths [sub|sup] [DIRECTORY] [>OUTFILE]
-
-Without a modifier, list all paths touched by fileops in
-the selection set (which defaults to the entire repo). This
-variant does > redirection.
+// delimitedRegexp compiles a regular expression written between a
+// pair of delimiters, e.g. /foo/ or |a/b|.
+func delimitedRegexp(text string) (*regexp.Regexp, error) {
+	if len(text) < 2 || text[0] != text[len(text)-1] {
+		return nil, fmt.Errorf("regular expression requires matching start and end delimiters")
+	}
+	re, err := regexp.Compile(text[1 : len(text)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return re, nil
+}
 
-With the 'sub' modifier, take a second argument that is a directory
-name and prepend it to every path. With the 'sup' modifier, strip
-any directory argument from the start of the path if it appears there;
-with no argument, strip the first directory component from every path.
+// HelpPathrename says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPathrename() {
+	rs.helpOutput(`
+[SELECTION] pathrename [--force] [--dry-run] /REGEXP/ /REPLACEMENT/ [>OUTFILE]
+
+Rewrite the paths of fileops in the selected commits (default all).
+Every source or target path matching the Go regular expression is
+replaced by the replacement, which may refer to capture groups as
+\1 through \9. Any non-space character may serve as the delimiter in
+place of /, but each argument must begin and end with the same one;
+neither may contain whitespace.
+
+The rewrite is all or nothing. It fails, changing nothing, if a new
+path already exists in a commit or is visible in its ancestry, or if
+two paths in one commit would be rewritten to the same new one. With
+--force these checks are skipped.
+
+With --dry-run nothing is changed; instead each rewrite that would be
+made is reported as the event number and mark of the commit, followed
+by the old and new path, separated by tabs.
+
+This is the same operation as 'path REGEXP rename TARGET' with the
+arguments delimited, so that the replacement is easy to tell from the
+regular expression.
 `)
 }
 
-// DoPaths is the command handler for the "paths" command.
-func (rs *Reposurgeon) DoPaths(line string) bool {
-	if rs.chosen() == nil {
+// DoPathrename rewrites paths across a selection.
+func (rs *Reposurgeon) DoPathrename(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
 	selection := rs.selection
 	if selection == nil {
-		selection = rs.chosen().all()
+		selection = repo.all()
 	}
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	if !strings.HasPrefix(line, "sub") && !strings.HasPrefix(line, "sup") {
-		allpaths := newOrderedStringSet()
-		for _, commit := range rs.chosen().commits(rs.selection) {
-			allpaths = allpaths.Union(commit.paths(nil))
+	for _, option := range parse.options {
+		if option != "--force" && option != "--dry-run" {
+			croak("unknown option %s in pathrename line", option)
+			return false
 		}
-		sort.Strings(allpaths)
-		fmt.Fprint(parse.stdout, strings.Join(allpaths, control.lineSep)+control.lineSep)
+	}
+	args := parse.Tokens()
+	if len(args) != 2 {
+		croak("pathrename requires a regular expression and a replacement")
 		return false
 	}
-	fields := strings.Fields(line)
-	if fields[0] == "sub" {
-		if len(fields) < 2 {
-			croak("Error paths sub needs a directory name argument")
-			return false
-		}
-		prefix := fields[1]
-		modified := rs.chosen().pathWalk(selection,
-			func(f string) string { return prefix + string(os.PathSeparator) + f })
-		fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
-	} else if fields[0] == "sup" {
-		if len(fields) == 1 {
-			modified := rs.chosen().pathWalk(selection,
-				func(f string) string {
-					slash := strings.Index(f, "/")
-					if slash == -1 {
-						return f
-					}
-					return f[slash+1:]
-				})
-			sort.Strings(modified)
-			fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
-		} else {
-			prefix := fields[1]
-			if !strings.HasSuffix(prefix, "/") {
-				prefix += "/"
-			}
-			modified := rs.chosen().pathWalk(selection,
-				func(f string) string {
-					if strings.HasPrefix(f, prefix) {
-						return f[len(prefix):]
-					}
-					return f
-				})
-			sort.Strings(modified)
-			fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
-			return false
+	sourceRE, err := delimitedRegexp(args[0])
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	replacement := args[1]
+	if len(replacement) < 2 || replacement[0] != replacement[len(replacement)-1] {
+		croak("replacement requires matching start and end delimiters")
+		return false
+	}
+	replacement = replacement[1 : len(replacement)-1]
+	commits := repo.commits(selection)
+	actions, err := repo.planPathRenames(commits, sourceRE, replacement, parse.options.Contains("--force"))
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	if parse.options.Contains("--dry-run") {
+		for _, action := range actions {
+			oldpath, _ := getAttr(action.fileop, action.attr)
+			fmt.Fprintf(parse.stdout, "%d\t%s\t%s\t%s\n",
+				repo.eventToIndex(action.commit)+1, action.commit.mark, oldpath, action.newpath)
 		}
+		return false
 	}
-	//rs.chosen().invalidateManifests()
+	repo.applyPathRenames(commits, actions)
+	if len(actions) > 0 {
+		repo.dirty = true
+	}
+	touched := make(map[*Commit]bool)
+	for _, action := range actions {
+		touched[action.commit] = true
+	}
+	respond("%d paths rewritten in %d commits.", len(actions), len(touched))
 	return false
 }
 
-// HelpManifest says "Shut up, golint!"
-func (rs *Reposurgeon) HelpManifest() {
+// HelpSubmodule says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSubmodule() {
 	rs.helpOutput(`
-[SELECTION] manifest [/REGEXP/] [>OUTFILE]
-
-Print commit path lists. Takes an optional selection set argument
-defaulting to all commits, and an optional delimited Go regular
-expression.  For each commit in the selection set, print the mapping
-of all paths in that commit tree to the corresponding blob marks,
-mirroring what files would be created in a checkout of the commit. If
-a regular expression is given, only print "path -> mark" lines for
-paths matching it.  This command supports > redirection.
+[SELECTION] submodule [list] [>OUTFILE]
+{SELECTION} submodule add [--name=NAME] [--branch=BRANCH] PATH URL HASH
+[SELECTION] submodule remove PATH
+[SELECTION] submodule retarget [--url=URL] [--map=FILE] PATH [HASH]
+
+Manage git submodules: gitlinks, which are M fileops of mode 160000
+naming a commit in another repository, and the .gitmodules file that
+says where that repository is. Each verb but list keeps .gitmodules
+consistent with the gitlinks it changes, editing it in the selected
+commits that need it; so does renaming a gitlink with 'path rename'.
+The selection defaults to all commits except for add.
+
+The list verb, the default, reports each gitlink set or deleted in
+the selected commits: the event number and mark of the commit, the
+path, the commit linked to or "deleted", and the URL .gitmodules
+gives for it there, if any. Supports > redirection.
+
+The add verb links PATH in each selected commit to HASH, a commit of
+the repository at URL, and adds a section for it to .gitmodules,
+named PATH unless --name says otherwise and with a branch key if
+--branch is given. Later commits inherit the link as usual, so
+selecting the commit the submodule should first appear in is enough.
+
+The remove verb takes the gitlink at PATH out of the trees of the
+selected commits, deleting it where they inherit it, and its section
+out of .gitmodules.
+
+The retarget verb changes the commit each gitlink at PATH set in the
+selected commits names: to HASH, or with --map to the new name of
+the old one, as given by FILE, which holds an old and a new object
+name on each line as git filter-repo's commit-map does. Gitlinks
+naming commits not in the map are left alone with a warning. With
+--url, the URL in .gitmodules is changed too.
 `)
 }
 
-// DoManifest prints all files (matching the regex) in the selected commits trees.
-func (rs *Reposurgeon) DoManifest(line string) bool {
+// DoSubmodule manages gitlinks and .gitmodules.
+func (rs *Reposurgeon) DoSubmodule(line string) bool {
 	if rs.chosen() == nil {
-		if logEnable(logWARN) {
-			logit("no repo has been chosen")
-		}
+		croak("no repo is loaded")
 		return false
 	}
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	args := parse.Tokens()
+	verb := "list"
+	if len(args) > 0 {
+		verb, args = args[0], args[1:]
+	}
 	selection := rs.selection
 	if selection == nil {
-		selection = rs.chosen().all()
+		if verb == "add" {
+			croak("submodule add requires a selection")
+			return false
+		}
+		selection = repo.all()
 	}
-	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
-	defer parse.Closem()
-	var filterFunc = func(s string) bool { return true }
-	line = strings.TrimSpace(parse.line)
-	if line != "" {
-		if len(line) >= 2 && line[0] != line[len(line)-1] {
-			croak("regular expression requires matching start and end delimiters")
+	commits := repo.commits(selection)
+	switch verb {
+	case "list":
+		if len(args) > 0 {
+			croak("submodule list does not take arguments")
 			return false
 		}
-		filterRE, err := regexp.Compile(line[1 : len(line)-1])
-		if err != nil {
-			if logEnable(logWARN) {
-				logit("invalid regular expression: %v", err)
+		for _, commit := range commits {
+			var parent *Commit
+			if parents := commit.parents(); len(parents) > 0 {
+				parent, _ = parents[0].(*Commit)
+			}
+			for _, op := range commit.operations() {
+				target := op.ref
+				if op.op == opD && parent != nil {
+					if _, ok := gitlinkAt(parent, op.Path); !ok {
+						continue
+					}
+					target = "deleted"
+				} else if op.op != opM || op.mode != gitlinkMode {
+					continue
+				}
+				report := fmt.Sprintf("%6d %6s %s %s", commit.index()+1, commit.mark, op.Path, target)
+				if section := gitmodulesAt(commit).byPath(op.Path); section != nil && target != "deleted" {
+					report += " " + section.get("url")
+				}
+				fmt.Fprintln(parse.stdout, report)
 			}
-			return false
 		}
-		filterFunc = func(s string) bool {
-			return filterRE.MatchString(s)
+	case "add":
+		if len(args) != 3 {
+			croak("submodule add needs a path, a URL, and an object name")
+			return false
 		}
-	}
-	events := rs.chosen().events
-	for _, ei := range selection {
-		commit, ok := events[ei].(*Commit)
-		if !ok {
-			continue
+		name, _ := parse.OptVal("--name")
+		branch, _ := parse.OptVal("--branch")
+		if err := repo.addSubmodule(commits, args[0], args[1], args[2], name, branch); err != nil {
+			croak("%v", err)
+			return false
 		}
-		header := fmt.Sprintf("Event %d, ", ei+1)
-		header = header[:len(header)-2]
-		header += " " + strings.Repeat("=", 72-len(header)) + control.lineSep
-		fmt.Fprint(parse.stdout, header)
-		if commit.legacyID != "" {
-			fmt.Fprintf(parse.stdout, "# Legacy-ID: %s\n", commit.legacyID)
+		repo.dirty = true
+	case "remove":
+		if len(args) != 1 {
+			croak("submodule remove needs a path")
+			return false
 		}
-		fmt.Fprintf(parse.stdout, "commit %s\n", commit.Branch)
-		if commit.mark != "" {
-			fmt.Fprintf(parse.stdout, "mark %s\n", commit.mark)
+		if repo.removeSubmodule(commits, args[0]) == 0 {
+			croak("no selected commit has a submodule at %s", args[0])
+			return false
 		}
-		fmt.Fprint(parse.stdout, control.lineSep)
-		type ManifestItem struct {
-			path  string
-			entry *FileOp
+		repo.dirty = true
+	case "retarget":
+		url, _ := parse.OptVal("--url")
+		mapfile, present := parse.OptVal("--map")
+		if len(args) != 1 && len(args) != 2 || present == (len(args) == 2) {
+			croak("submodule retarget needs a path and either an object name or --map")
+			return false
 		}
-		manifestItems := make([]ManifestItem, 0)
-		commit.manifest().iter(func(path string, pentry interface{}) {
-			entry := pentry.(*FileOp)
-			if filterFunc(path) {
-				manifestItems = append(manifestItems, ManifestItem{path, entry})
+		var target string
+		var mapping map[string]string
+		if present {
+			fp, err := os.Open(mapfile)
+			if err != nil {
+				croak("%v", err)
+				return false
+			}
+			mapping, err = readGitlinkMap(fp)
+			fp.Close()
+			if err != nil {
+				croak("%s: %v", mapfile, err)
+				return false
+			}
+		} else {
+			target = args[1]
+			if _, err := parseHash(target); err != nil {
+				croak("%v", err)
+				return false
 			}
-		})
-		sort.Slice(manifestItems, func(i, j int) bool { return manifestItems[i].path < manifestItems[j].path })
-		for _, item := range manifestItems {
-			fmt.Fprintf(parse.stdout, "%s -> %s\n", item.path, item.entry.ref)
 		}
+		changed := repo.retargetSubmodule(commits, args[0], target, mapping, url)
+		if changed > 0 {
+			repo.dirty = true
+		}
+		respond("%d gitlinks retargeted.", changed)
+	default:
+		croak("unknown verb %q in submodule command", verb)
 	}
 	return false
 }
 
-// HelpTagify says "Shut up, golint!"
-func (rs *Reposurgeon) HelpTagify() {
+// HelpOps says "Shut up, golint!"
+func (rs *Reposurgeon) HelpOps() {
 	rs.helpOutput(`
-[SELECTION] tagify [--tagify-merges|--canonicalize|--tipdeletes]
-
-Search for empty commits and turn them into tags. Takes an optional selection
-set argument defaulting to all commits. For each commit in the selection set,
-turn it into a tag with the same message and author information if it has no
-fileops. By default merge commits are not considered, even if they have no
-fileops (thus no tree differences with their first parent). To change that, see
-the '--tagify-merges' option.
-
-The name of the generated tag will be 'emptycommit-<ident>', where <ident>
-is generated from the legacy ID of the deleted commit, or from its
-mark, or from its index in the repository, with a disambiguation
-suffix if needed.
+[SELECTION] ops [/REGEXP/] [--type=LETTERS] [list] [>OUTFILE]
+[SELECTION] ops [/REGEXP/] [--type=LETTERS] delete
+[SELECTION] ops [/REGEXP/] [--type=LETTERS] retarget {TARGET}
+[SELECTION] ops [/REGEXP/] [--type=LETTERS] mode {PERM}
+
+Operate on individual fileops rather than whole commits.  The fileops
+chosen are those in the selected commits (defaulting to all) whose path,
+or for R and C ops whose source or target path, matches the delimited
+Go regular expression.  With --type, only ops whose type letter (M, D,
+R, C, or N) is among LETTERS are chosen.  Deleteall ops are never chosen.
+
+The list verb, the default, prints each chosen op preceded by the event
+number of its commit and its 1-origin position in the commit's op list.
+Supports > redirection.
 
-tagify currently recognizes three options: first is '--canonicalize' which
-makes tagify try harder to detect trivial commits by first ensuring that all
-fileops of selected commits will have an actual effect when processed by
-fast-import.
+The delete verb removes the chosen ops.  This can leave later ops
+referring to paths that no longer exist; 'lint --fileops' will find
+them.
 
-The second option is '--tipdeletes' which makes tagify also consider branch
-tips with only deleteall fileops to be candidates for tagification. The
-corresponding tags get names of the form 'tipdelete-<branchname>' rather than
-the default 'emptycommit-<ident>'.
+The retarget verb changes the path of each chosen op (for R and C ops,
+the target path).  TARGET may contain Go back-reference syntax referring
+to the regular expression.  It is an error for the new path to collide
+with another op in the same commit; all checks are made before any op
+is changed.
 
-The third option is '--tagify-merges' that makes reposurgeon also
-tagify merge commits that have no fileops.  When this is done the
-merge link is moved to the tagified commit's parent.
+The mode verb sets the permission of each chosen M op to PERM, which
+must be one of 100644, 100755, or 120000.
 `)
 }
 
-// DoTagify searches for empty commits and turn them into tags.
-func (rs *Reposurgeon) DoTagify(line string) bool {
+// DoOps performs surgery on individual fileops.
+func (rs *Reposurgeon) DoOps(line string) bool {
 	repo := rs.chosen()
 	if repo == nil {
-		croak("no repo has been chosen")
+		croak("no repo has been chosen.")
 		return false
 	}
 	selection := rs.selection
 	if selection == nil {
 		selection = repo.all()
 	}
-	parse := rs.newLineParse(line, nil)
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	if parse.line != "" {
-		croak("too many arguments for tagify.")
-		return false
+	line = strings.TrimSpace(parse.line)
+	var pathRE *regexp.Regexp
+	if strings.HasPrefix(line, "/") {
+		end := strings.Index(line[1:], "/")
+		for end != -1 && line[end] == '\\' {
+			next := strings.Index(line[end+2:], "/")
+			if next == -1 {
+				end = -1
+			} else {
+				end += next + 1
+			}
+		}
+		if end == -1 {
+			croak("regular expression requires matching start and end delimiters")
+			return false
+		}
+		var err error
+		pathRE, err = regexp.Compile(line[1 : end+1])
+		if err != nil {
+			croak("invalid regular expression: %v", err)
+			return false
+		}
+		line = strings.TrimSpace(line[end+2:])
 	}
-	before := len(repo.commits(nil))
-	err := repo.tagifyEmpty(
-		selection,
-		parse.options.Contains("--tipdeletes"),
-		parse.options.Contains("--tagify-merges"),
-		parse.options.Contains("--canonicalize"),
-		nil,
-		nil,
-		true)
-	if err != nil {
-		control.baton.printLogString(err.Error())
+	types := "MDRCN"
+	if val, present := parse.OptVal("--type"); present {
+		if val == "" || strings.Trim(val, "MDRCN") != "" {
+			croak("--type takes a string of fileop letters from MDRCN")
+			return false
+		}
+		types = val
+	}
+	chosen := func(fileop *FileOp) bool {
+		if fileop.op == deleteall || !strings.ContainsRune(types, rune(fileop.op)) {
+			return false
+		}
+		if pathRE == nil {
+			return true
+		}
+		return pathRE.MatchString(fileop.Path) ||
+			((fileop.op == opR || fileop.op == opC) && pathRE.MatchString(fileop.Source))
+	}
+	verb, line := popToken(line)
+	arg, _ := popToken(line)
+	switch verb {
+	case "", "list":
+		for _, ei := range selection {
+			commit, ok := repo.events[ei].(*Commit)
+			if !ok {
+				continue
+			}
+			for i, fileop := range commit.operations() {
+				if chosen(fileop) {
+					opline := strings.SplitN(fileop.String(), "\n", 2)[0]
+					fmt.Fprintf(parse.stdout, "%d\t%d\t%s\n", ei+1, i+1, opline)
+				}
+			}
+		}
+	case "delete":
+		deleted := 0
+		for _, commit := range repo.commits(selection) {
+			survivors := make([]*FileOp, 0, len(commit.operations()))
+			for _, fileop := range commit.operations() {
+				if chosen(fileop) {
+					deleted++
+				} else {
+					survivors = append(survivors, fileop)
+				}
+			}
+			if len(survivors) != len(commit.operations()) {
+				commit.setOperations(survivors)
+			}
+		}
+		if deleted > 0 {
+			repo.dirty = true
+		}
+		respond("%d fileops deleted.", deleted)
+	case "retarget":
+		if arg == "" {
+			croak("no target specified in retarget")
+			return false
+		}
+		if pathRE == nil {
+			croak("retarget requires a path regular expression")
+			return false
+		}
+		actions := make([]pathAction, 0)
+		for _, commit := range repo.commits(selection) {
+			targets := make(map[string]bool)
+			for _, fileop := range commit.operations() {
+				if !chosen(fileop) || !pathRE.MatchString(fileop.Path) {
+					continue
+				}
+				newpath := GoReplacer(pathRE, fileop.Path, arg)
+				if newpath == fileop.Path {
+					continue
+				}
+				collision := targets[newpath]
+				for _, other := range commit.operations() {
+					if other != fileop && other.op != opN && other.Path == newpath {
+						collision = true
+					}
+				}
+				if collision {
+					croak("retarget of %s at %s failed, %s exists there", fileop.Path, commit.idMe(), newpath)
+					return false
+				}
+				targets[newpath] = true
+				actions = append(actions, pathAction{fileop, commit, "Path", newpath})
+			}
+		}
+		// All checks must pass before any op is changed
+		for _, action := range actions {
+			setAttr(action.fileop, action.attr, action.newpath)
+			action.commit.invalidateManifests()
+		}
+		if len(actions) > 0 {
+			repo.dirty = true
+		}
+		respond("%d fileops retargeted.", len(actions))
+	case "mode":
+		if !newOrderedStringSet("100644", "100755", "120000").Contains(arg) {
+			croak("unexpected permission literal %q", arg)
+			return false
+		}
+		changed := 0
+		for _, commit := range repo.commits(selection) {
+			for _, fileop := range commit.operations() {
+				if fileop.op == opM && chosen(fileop) && fileop.mode != arg {
+					fileop.mode = arg
+					commit.hash.invalidate()
+					changed++
+				}
+			}
+		}
+		if changed > 0 {
+			repo.dirty = true
+		}
+		respond("%d fileop modes changed.", changed)
+	default:
+		croak("unknown verb '%s' in ops command.", verb)
 	}
-	after := len(repo.commits(nil))
-	respond("%d commits tagified.", before-after)
 	return false
 }
 
-// HelpMerge says "Shut up, golint!"
-func (rs *Reposurgeon) HelpMerge() {
+// twins returns groups of commits that appear to be the same change
+// committed separately to different branches: same author, author date,
+// comment, and patch content.  Each group is in committer-date order, and
+// the first member is taken to be the original.
+func (repo *Repository) twins(selection orderedIntSet) [][]*Commit {
+	type twinKey struct {
+		author  string
+		date    string
+		comment string
+		patch   gitHashType
+	}
+	groups := make(map[twinKey][]*Commit)
+	keys := make([]twinKey, 0)
+	for _, commit := range repo.commits(selection) {
+		attribution := commit.committer
+		if len(commit.authors) > 0 {
+			attribution = commit.authors[0]
+		}
+		key := twinKey{attribution.fullname + " <" + attribution.email + ">",
+			attribution.date.rfc3339(), commit.Comment, commit.patchID()}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], commit)
+	}
+	result := make([][]*Commit, 0)
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		// Duplicates on the same branch are not double commits
+		branches := newOrderedStringSet()
+		kept := make([]*Commit, 0, len(group))
+		for _, commit := range group {
+			if !branches.Contains(commit.Branch) {
+				branches.Add(commit.Branch)
+				kept = append(kept, commit)
+			}
+		}
+		if len(kept) > 1 {
+			sort.SliceStable(kept, func(i, j int) bool {
+				return kept[i].committer.date.timestamp.Before(kept[j].committer.date.timestamp)
+			})
+			result = append(result, kept)
+		}
+	}
+	return result
+}
+
+// HelpTwins says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTwins() {
 	rs.helpOutput(`
-{SELECTION} merge
+[SELECTION] twins [--trailer|--merge] [>OUTFILE]
+
+Find commits on different branches with identical author, author date,
+comment, and patch content, as left behind by old workflows in which a
+change was committed separately to each branch it applied to.  Only the
+selected commits (default all) are considered.
+
+Each group of twins is reported on one line: the event numbers and
+branches of its members, earliest committed first, followed by the
+first line of the shared comment.  The earliest committed member is
+taken to be the original.
+
+With --trailer, a "(cherry picked from commit HASH)" line is appended to
+the comment of each later twin, as 'git cherry-pick -x' would, where HASH
+is the git hash the original would have if the repository were written
+now.  Do this as the last step before writing, since any surgery that
+changes the original or its ancestry changes its hash.
+
+With --merge, the original is instead added as a parent of each later
+twin, so git records the change as merged.  Beware that this also makes
+the twin's branch include all history leading to the original.  A twin
+that precedes its original in the event stream cannot be given it as a
+parent and is skipped with a warning.
 
-Create a merge link. Takes a selection set argument, ignoring all but
-the lowest (source) and highest (target) members.  Creates a merge link
-from the highest member (child) to the lowest (parent).
+Supports > redirection.
 `)
 }
 
-// DoMerge is the command handler for the "merge" command.
-func (rs *Reposurgeon) DoMerge(_line string) bool {
-	if rs.chosen() == nil {
+// DoTwins finds commits duplicated across branches.
+func (rs *Reposurgeon) DoTwins(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	commits := rs.chosen().commits(rs.selection)
-	if len(commits) < 2 {
-		croak("merge requires a selection set with at least two commits.")
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	trailer := parse.options.Contains("--trailer")
+	merge := parse.options.Contains("--merge")
+	if trailer && merge {
+		croak("--trailer and --merge are mutually exclusive")
 		return false
 	}
-	early := commits[0]
-	late := commits[len(commits)-1]
-	if late.mark < early.mark {
-		late, early = early, late
+	groups := repo.twins(selection)
+	for _, group := range groups {
+		members := make([]string, len(group))
+		for i, commit := range group {
+			members[i] = fmt.Sprintf("%d %s", repo.markToIndex(commit.mark)+1, commit.Branch)
+		}
+		topline, _ := splitRuneFirst(group[0].Comment, '\n')
+		fmt.Fprintf(parse.stdout, "%s\t%s\n", strings.Join(members, ", "), topline)
+	}
+	for _, group := range groups {
+		original := group[0]
+		for _, twin := range group[1:] {
+			if trailer {
+				comment := strings.TrimRight(twin.Comment, "\n")
+				twin.Comment = fmt.Sprintf("%s\n\n(cherry picked from commit %s)\n",
+					comment, original.gitHash().hexify())
+				twin.hash.invalidate()
+				repo.dirty = true
+			} else if merge && !newOrderedStringSet(twin.parentMarks()...).Contains(original.mark) {
+				if repo.markToIndex(original.mark) > repo.markToIndex(twin.mark) {
+					if logEnable(logWARN) {
+						logit("%s precedes its original %s, not merged", twin.idMe(), original.idMe())
+					}
+					continue
+				}
+				twin.addParentCommit(original)
+				repo.dirty = true
+			}
+		}
 	}
-	late.addParentCommit(early)
-	//earlyID = fmt.Sprintf("%s (%s)", early.mark, early.Branch)
-	//lateID = fmt.Sprintf("%s (%s)", late.mark, late.Branch)
-	//respond("%s added as a parent of %s", earlyID, lateID)
 	return false
 }
 
-// HelpUnmerge says "Shut up, golint!"
-func (rs *Reposurgeon) HelpUnmerge() {
+// HelpPaths says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPaths() {
 	rs.helpOutput(`
-{SELECTION} unmerge
+paths [sub|sup] [DIRECTORY] [>OUTFILE]
 
-Linearizes a commit. Takes a selection set argument, which must resolve to a
-single commit, and removes all its parents except for the first. It is
-equivalent to reparent --rebase {first parent},{commit}, where {commit} is the
-selection set given to unmerge and {first parent} is a set resolving to that
-commit's first parent, but doesn't need you to find the first parent yourself.
+Without a modifier, list all paths touched by fileops in
+the selection set (which defaults to the entire repo). This
+variant does > redirection.
+
+With the 'sub' modifier, take a second argument that is a directory
+name and prepend it to every path. With the 'sup' modifier, strip
+any directory argument from the start of the path if it appears there;
+with no argument, strip the first directory component from every path.
 `)
 }
 
-// DoUnmerge says "Shut up, golint!"
-func (rs *Reposurgeon) DoUnmerge(_line string) bool {
+// DoPaths is the command handler for the "paths" command.
+func (rs *Reposurgeon) DoPaths(line string) bool {
 	if rs.chosen() == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	if len(rs.selection) != 1 {
-		croak("unmerge requires a single commit.")
-		return false
+	selection := rs.selection
+	if selection == nil {
+		selection = rs.chosen().all()
 	}
-	event := rs.chosen().events[rs.selection[0]]
-	if commit, ok := event.(*Commit); !ok {
-		croak("unmerge target is not a commit.")
-	} else {
-		commit.setParents(commit.parents()[:1])
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if !strings.HasPrefix(line, "sub") && !strings.HasPrefix(line, "sup") {
+		allpaths := newOrderedStringSet()
+		for _, commit := range rs.chosen().commits(rs.selection) {
+			allpaths = allpaths.Union(commit.paths(nil))
+		}
+		sort.Strings(allpaths)
+		fmt.Fprint(parse.stdout, strings.Join(allpaths, control.lineSep)+control.lineSep)
+		return false
+	}
+	fields := strings.Fields(line)
+	if fields[0] == "sub" {
+		if len(fields) < 2 {
+			croak("Error paths sub needs a directory name argument")
+			return false
+		}
+		prefix := fields[1]
+		modified := rs.chosen().pathWalk(selection,
+			func(f string) string { return prefix + string(os.PathSeparator) + f })
+		fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
+	} else if fields[0] == "sup" {
+		if len(fields) == 1 {
+			modified := rs.chosen().pathWalk(selection,
+				func(f string) string {
+					slash := strings.Index(f, "/")
+					if slash == -1 {
+						return f
+					}
+					return f[slash+1:]
+				})
+			sort.Strings(modified)
+			fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
+		} else {
+			prefix := fields[1]
+			if !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			modified := rs.chosen().pathWalk(selection,
+				func(f string) string {
+					if strings.HasPrefix(f, prefix) {
+						return f[len(prefix):]
+					}
+					return f
+				})
+			sort.Strings(modified)
+			fmt.Fprint(parse.stdout, strings.Join(modified, control.lineSep)+control.lineSep)
+			return false
+		}
 	}
+	//rs.chosen().invalidateManifests()
 	return false
-
 }
 
-// HelpReparent says "Shut up, golint!"
-func (rs *Reposurgeon) HelpReparent() {
+// HelpManifest says "Shut up, golint!"
+func (rs *Reposurgeon) HelpManifest() {
 	rs.helpOutput(`
-{SELECTION} reparent [--user-order] [--rebase]
-
-Changes the parent list of a commit.  Takes a selection set, zero or
-more option arguments, and an optional policy argument.
-
-Selection set:
-
-    The selection set must resolve to one or more commits.  The
-    selected commit with the highest event number (not necessarily the
-    last one selected) is the commit to modify.  The remainder of the
-    selected commits, if any, become its parents:  the selected commit
-    with the lowest event number (which is not necessarily the first
-    one selected) becomes the first parent, the selected commit with
-    second lowest event number becomes the second parent, and so on.
-    All original parent links are removed.  Examples:
-
-        # this makes 17 the parent of 33
-        17,33 reparent
-
-        # this also makes 17 the parent of 33
-        33,17 reparent
-
-        # this makes 33 a root (parentless) commit
-        33 reparent
-
-        # this makes 33 an octopus merge commit.  its first parent
-        # is commit 15, second parent is 17, and third parent is 22
-        22,33,15,17 reparent
-
-Options:
-
-    --use-order
-
-        Use the selection order to determine which selected commit is
-        the commit to modify and which are the parents (and if there
-        are multiple parents, their order).  The last selected commit
-        (not necessarily the one with the highest event number) is the
-        commit to modify, the first selected commit (not necessarily
-        the one with the lowest event number) becomes the first
-        parent, the second selected commit becomes the second parent,
-        and so on.  Examples:
-
-            # this makes 33 the parent of 17
-            33|17 reparent --use-order
-
-            # this makes 17 an octopus merge commit.  its first parent
-            # is commit 22, second parent is 33, and third parent is 15
-            22,33,15|17 reparent --use-order
-
-        Because ancestor commit events must appear before their
-        descendants, giving a commit with a low event number a parent
-        with a high event number triggers a re-sort of the events.  A
-        re-sort assigns different event numbers to some or all of the
-        events.  Re-sorting only works if the reparenting does not
-        introduce any cycles.  To swap the order of two commits that
-        have an ancestor-descendant relationship without introducing a
-        cycle during the process, you must reparent the descendant
-        commit first.
+[SELECTION] manifest [/REGEXP/] [>OUTFILE]
 
-    --rebase
+Print commit path lists. Takes an optional selection set argument
+defaulting to all commits, and an optional delimited Go regular
+expression.  For each commit in the selection set, print the mapping
+of all paths in that commit tree to the corresponding blob marks,
+mirroring what files would be created in a checkout of the commit. If
+a regular expression is given, only print "path -> mark" lines for
+paths matching it.  This command supports > redirection.
+`)
+}
 
-	By default, the manifest of the reparented commit is computed
-	before modifying it; a 'deleteall' and some fileops are prepended
-	so that the manifest stays unchanged even when the first parent
-	has been changed.  This behavior can be changed by specifying a
-	policy flag:
+// DoManifest prints all files (matching the regex) in the selected commits trees.
+func (rs *Reposurgeon) DoManifest(line string) bool {
+	if rs.chosen() == nil {
+		if logEnable(logWARN) {
+			logit("no repo has been chosen")
+		}
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = rs.chosen().all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	var filterFunc = func(s string) bool { return true }
+	line = strings.TrimSpace(parse.line)
+	if line != "" {
+		if len(line) >= 2 && line[0] != line[len(line)-1] {
+			croak("regular expression requires matching start and end delimiters")
+			return false
+		}
+		filterRE, err := regexp.Compile(line[1 : len(line)-1])
+		if err != nil {
+			if logEnable(logWARN) {
+				logit("invalid regular expression: %v", err)
+			}
+			return false
+		}
+		filterFunc = func(s string) bool {
+			return filterRE.MatchString(s)
+		}
+	}
+	events := rs.chosen().events
+	for _, ei := range selection {
+		commit, ok := events[ei].(*Commit)
+		if !ok {
+			continue
+		}
+		header := fmt.Sprintf("Event %d, ", ei+1)
+		header = header[:len(header)-2]
+		header += " " + strings.Repeat("=", 72-len(header)) + control.lineSep
+		fmt.Fprint(parse.stdout, header)
+		if commit.legacyID != "" {
+			fmt.Fprintf(parse.stdout, "# Legacy-ID: %s\n", commit.legacyID)
+		}
+		fmt.Fprintf(parse.stdout, "commit %s\n", commit.Branch)
+		if commit.mark != "" {
+			fmt.Fprintf(parse.stdout, "mark %s\n", commit.mark)
+		}
+		fmt.Fprint(parse.stdout, control.lineSep)
+		type ManifestItem struct {
+			path  string
+			entry *FileOp
+		}
+		manifestItems := make([]ManifestItem, 0)
+		commit.manifest().iter(func(path string, pentry interface{}) {
+			entry := pentry.(*FileOp)
+			if filterFunc(path) {
+				manifestItems = append(manifestItems, ManifestItem{path, entry})
+			}
+		})
+		sort.Slice(manifestItems, func(i, j int) bool { return manifestItems[i].path < manifestItems[j].path })
+		for _, item := range manifestItems {
+			fmt.Fprintf(parse.stdout, "%s -> %s\n", item.path, item.entry.ref)
+		}
+	}
+	return false
+}
 
-        Inhibits the default behavior -- no 'deleteall' is issued and
-        the tree contents of all descendants can be modified as a
-        result.
+// HelpGrep says "Shut up, golint!"
+func (rs *Reposurgeon) HelpGrep() {
+	rs.helpOutput(`
+[SELECTION] grep [--comments] [--path=/REGEXP/] /REGEXP/ [>OUTFILE]
+
+Search the content of files modified by commits in the selection set
+(defaulting to all commits) for lines matching a delimited Go regular
+expression.  Only the files each commit sets are searched, not its
+whole tree, so the earliest commit reported for a path is the one
+that brought the text into it.  Content with a NUL in its first 8000 bytes is
+taken to be binary and skipped.
+
+Each matching line is reported as the event number and mark of the
+commit, then the path, line number, and line separated by colons, as
+grep -n does.  With --path, only files whose paths match the second
+regular expression are searched.  With --comments, the comments of
+selected commits and tags are searched too; their matches are
+reported with "(comment)" as the path, and a tag's name in place of
+the mark.  Supports > redirection.
 `)
 }
 
-// DoReparent is rthe ommand handler for the "reparent" command.
-func (rs *Reposurgeon) DoReparent(line string) bool {
+// DoGrep searches blob content for a regular expression.
+func (rs *Reposurgeon) DoGrep(line string) bool {
 	repo := rs.chosen()
 	if repo == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	for _, commit := range repo.commits(nil) {
-		commit.invalidateManifests()
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
 	}
-	parse := rs.newLineParse(line, nil)
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	useOrder := parse.options.Contains("--use-order")
-	// Determine whether an event resort might be needed.  it is
-	// assumed that ancestor commits already have a lower event
-	// index before this function is called, which should be true
-	// as long as every function that modifies the DAG calls
-	// Repository.resort() when needed.  thus, a call to resort()
-	// should only be necessary if --use-order is passed and a
-	// parent will have an index higher than the modified commit.
-	var doResort bool
-	if useOrder {
-		for _, idx := range rs.selection[:len(rs.selection)-1] {
-			if idx > rs.selection[len(rs.selection)-1] {
-				doResort = true
+	delimited := func(text string) (*regexp.Regexp, bool) {
+		re, err := delimitedRegexp(text)
+		if err != nil {
+			croak("%v", err)
+			return nil, false
+		}
+		return re, true
+	}
+	var pathRE *regexp.Regexp
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--path=") {
+			var ok bool
+			if pathRE, ok = delimited(strings.TrimPrefix(option, "--path=")); !ok {
+				return false
+			}
+		} else if option != "--comments" {
+			croak("unknown option %s in grep line", option)
+			return false
+		}
+	}
+	searchRE, ok := delimited(strings.TrimSpace(parse.line))
+	if !ok {
+		return false
+	}
+	// Content shared by several fileops is only searched once.
+	type match struct {
+		lineno int
+		text   string
+	}
+	search := func(content []byte) []match {
+		head := content
+		if len(head) > sniffLength {
+			head = head[:sniffLength]
+		}
+		if bytes.IndexByte(head, 0) >= 0 {
+			return nil
+		}
+		var matches []match
+		for i, text := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			if searchRE.MatchString(text) {
+				matches = append(matches, match{i + 1, text})
+			}
+		}
+		return matches
+	}
+	searched := make(map[*Blob][]match)
+	comments := parse.options.Contains("--comments")
+	for _, ei := range selection {
+		switch event := repo.events[ei].(type) {
+		case *Commit:
+			if comments {
+				for _, m := range search([]byte(event.Comment)) {
+					fmt.Fprintf(parse.stdout, "%d\t%s\t(comment):%d:%s\n", ei+1, event.mark, m.lineno, m.text)
+				}
+			}
+			for _, fileop := range event.operations() {
+				if fileop.op != opM || fileop.mode == "160000" || (pathRE != nil && !pathRE.MatchString(fileop.Path)) {
+					continue
+				}
+				var matches []match
+				if fileop.ref == "inline" {
+					matches = search(fileop.inline)
+				} else if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+					var seen bool
+					if matches, seen = searched[blob]; !seen {
+						matches = search(blob.getContent())
+						searched[blob] = matches
+					}
+				}
+				for _, m := range matches {
+					fmt.Fprintf(parse.stdout, "%d\t%s\t%s:%d:%s\n", ei+1, event.mark, fileop.Path, m.lineno, m.text)
+				}
+			}
+		case *Tag:
+			if comments {
+				for _, m := range search([]byte(event.Comment)) {
+					fmt.Fprintf(parse.stdout, "%d\t%s\t(comment):%d:%s\n", ei+1, event.name, m.lineno, m.text)
+				}
 			}
 		}
-	} else {
-		sort.Ints(rs.selection)
-	}
-	selected := repo.commits(rs.selection)
-	if len(selected) == 0 || len(rs.selection) != len(selected) {
-		if logEnable(logWARN) {
-			logit("reparent requires one or more selected commits")
+	}
+	return false
+}
+
+// HelpTagify says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTagify() {
+	rs.helpOutput(`
+[SELECTION] tagify [--tagify-merges|--canonicalize|--tipdeletes]
+
+Search for empty commits and turn them into tags. Takes an optional selection
+set argument defaulting to all commits. For each commit in the selection set,
+turn it into a tag with the same message and author information if it has no
+fileops. By default merge commits are not considered, even if they have no
+fileops (thus no tree differences with their first parent). To change that, see
+the '--tagify-merges' option.
+
+The name of the generated tag will be 'emptycommit-<ident>', where <ident>
+is generated from the legacy ID of the deleted commit, or from its
+mark, or from its index in the repository, with a disambiguation
+suffix if needed.
+
+tagify currently recognizes three options: first is '--canonicalize' which
+makes tagify try harder to detect trivial commits by first ensuring that all
+fileops of selected commits will have an actual effect when processed by
+fast-import.
+
+The second option is '--tipdeletes' which makes tagify also consider branch
+tips with only deleteall fileops to be candidates for tagification. The
+corresponding tags get names of the form 'tipdelete-<branchname>' rather than
+the default 'emptycommit-<ident>'.
+
+The third option is '--tagify-merges' that makes reposurgeon also
+tagify merge commits that have no fileops.  When this is done the
+merge link is moved to the tagified commit's parent.
+`)
+}
+
+// DoTagify searches for empty commits and turn them into tags.
+func (rs *Reposurgeon) DoTagify(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	if parse.line != "" {
+		croak("too many arguments for tagify.")
+		return false
+	}
+	before := len(repo.commits(nil))
+	err := repo.tagifyEmpty(
+		selection,
+		parse.options.Contains("--tipdeletes"),
+		parse.options.Contains("--tagify-merges"),
+		parse.options.Contains("--canonicalize"),
+		nil,
+		nil,
+		true)
+	if err != nil {
+		control.baton.printLogString(err.Error())
+	}
+	after := len(repo.commits(nil))
+	if after != before || parse.options.Contains("--canonicalize") {
+		repo.dirty = true
+	}
+	respond("%d commits tagified.", before-after)
+	return false
+}
+
+// prune deletes the commits in the selection left with no fileops, as
+// the prune command does, returning the numbers of commits pruned and
+// tags created.  The options are those of the command; with --dry-run
+// the commits are only listed on fp.
+func (repo *Repository) prune(selection orderedIntSet, options orderedStringSet, fp io.Writer) (int, int) {
+	selected := make(map[*Commit]bool)
+	for _, commit := range repo.commits(selection) {
+		selected[commit] = true
+	}
+	// With --canonicalize, fileops that leave the tree of the
+	// first parent as it was count as none.
+	noEffect := func(commit *Commit) bool {
+		if !options.Contains("--canonicalize") || !commit.hasParents() {
+			return false
+		}
+		parent, ok := commit.parents()[0].(*Commit)
+		if !ok {
+			return false
+		}
+		before, after := parent.manifest(), commit.manifest()
+		if before.size() != after.size() {
+			return false
+		}
+		same := true
+		after.iter(func(pathname string, value interface{}) {
+			if old, ok := before.get(pathname); !ok || !old.(*FileOp).Equals(value.(*FileOp)) {
+				same = false
+			}
+		})
+		return same
+	}
+	candidate := func(commit *Commit) bool {
+		if !selected[commit] {
+			return false
+		}
+		if len(commit.parents()) > 1 && !options.Contains("--merges") {
+			return false
+		}
+		if options.Contains("--keep-tagged") && commit.carriesTags() {
+			return false
+		}
+		return len(commit.operations()) == 0 || noEffect(commit)
+	}
+	indices := func(commits []*Commit) orderedIntSet {
+		out := newOrderedIntSet()
+		for _, commit := range commits {
+			out.Add(commit.index())
+		}
+		return out
+	}
+	if options.Contains("--dry-run") {
+		found := 0
+		for _, commit := range repo.commits(nil) {
+			if !candidate(commit) || (!commit.hasParents() && len(commit.children()) == 0) {
+				continue
+			}
+			topline, _ := splitRuneFirst(commit.Comment, '\n')
+			fmt.Fprintf(fp, "%d %s\t%s\t%s\n",
+				commit.index()+1, commit.mark, commit.Branch, topline)
+			found++
+		}
+		return found, 0
+	}
+	pruned, tagged := 0, 0
+	// Tags on deleted commits move with the deletion, so runs of
+	// empty commits can go in one pass.  The exception is a root
+	// whose first child is also empty; it waits for a later pass so
+	// the tag made from it points at a commit that survives.
+	for {
+		backward := make([]*Commit, 0)
+		forward := make([]*Commit, 0)
+		heirs := make([]*Commit, 0)
+		for _, commit := range repo.commits(nil) {
+			if !candidate(commit) {
+				continue
+			}
+			if commit.hasParents() {
+				// Fileops with no effect can go without
+				// changing any tree.
+				commit.setOperations(nil)
+				if commit.carriesTags() || options.Contains("--tagify") {
+					repo.tagify(commit, defaultEmptyTagName(commit), commit.parents()[0].getMark(), "", false)
+					tagged++
+				}
+				backward = append(backward, commit)
+				continue
+			}
+			children := commit.children()
+			if len(children) == 0 {
+				if logEnable(logWARN) {
+					logit("%s is an empty branch root with no children; not pruned.", commit.idMe())
+				}
+				delete(selected, commit)
+				continue
+			}
+			child, ok := children[0].(*Commit)
+			if !ok || candidate(child) {
+				continue
+			}
+			heirs = append(heirs, child)
+			repo.tagify(commit, defaultEmptyTagName(commit), child.getMark(), "", false)
+			tagged++
+			forward = append(forward, commit)
+			control.baton.twirl()
+		}
+		if len(forward)+len(backward) == 0 {
+			break
+		}
+		if len(forward) > 0 {
+			repo.delete(indices(forward), orderedStringSet{"--tagforward"})
+			// Deletion gives a new root a deleteall so it
+			// won't inherit a tree; the tree it would have
+			// inherited was empty anyway.
+			for _, heir := range heirs {
+				ops := heir.operations()
+				if !heir.hasParents() && len(ops) > 0 && ops[0].op == deleteall {
+					heir.setOperations(ops[1:])
+				}
+			}
+		}
+		if len(backward) > 0 {
+			repo.delete(indices(backward), orderedStringSet{"--tagback"})
+		}
+		pruned += len(forward) + len(backward)
+	}
+	return pruned, tagged
+}
+
+// HelpPrune says "Shut up, golint!"
+func (rs *Reposurgeon) HelpPrune() {
+	rs.helpOutput(`
+[SELECTION] prune [--canonicalize] [--tagify] [--merges] [--keep-tagged] [--dry-run] [>OUTFILE]
+
+Delete commits that have been left with no fileops by earlier surgery,
+in one pass.  Takes an optional selection set argument defaulting to all
+commits; merge commits are not pruned unless --merges is given, since
+their parent links carry information even when they change no files.
+
+Children of a pruned commit are reattached to its parent; the children
+of a pruned merge inherit all its parents.  Branch refs and tags on a
+pruned commit move back to its parent.  Two kinds of empty commit get
+special treatment so that nothing they record is lost:
+
+* A commit carrying tags is also turned into an annotated tag on its
+parent, with the commit's message and committer, named as by tagify.
+
+* A branch root is turned into an annotated tag on its first child, and
+its tags move forward to that child, which becomes the new root.  A root
+with no children is the whole branch; it is left alone with a warning.
+
+--canonicalize:: Also prune commits whose fileops have no effect, which
+canonicalizing would leave with none.
+
+--tagify:: Turn every pruned commit into an annotated tag, not just
+those carrying tags.
+
+--merges:: Prune merge commits too.
+
+--keep-tagged:: Leave commits that carry tags alone.
+
+--dry-run:: List the commits that would be pruned, one per line: the
+event number and mark, the branch, and the first line of the comment.
+Nothing is changed.  Supports > redirection.
+`)
+}
+
+// DoPrune deletes empty commits, turning those that carry tags or root
+// a branch into annotated tags.
+func (rs *Reposurgeon) DoPrune(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	for _, option := range parse.options {
+		switch option {
+		case "--canonicalize", "--tagify", "--merges", "--keep-tagged", "--dry-run":
+		default:
+			croak("unknown option %s in prune line", option)
+			return false
+		}
+	}
+	if parse.line != "" {
+		croak("too many arguments for prune.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	pruned, tagged := repo.prune(selection, parse.options, parse.stdout)
+	if parse.options.Contains("--dry-run") {
+		respond("%d empty commits found.", pruned)
+	} else {
+		if pruned > 0 || parse.options.Contains("--canonicalize") {
+			repo.dirty = true
+		}
+		respond("%d empty commits pruned, %d tags created.", pruned, tagged)
+	}
+	return false
+}
+
+// carriesTags tells whether a commit has a tag, or a reset of a tag
+// ref, attached to it.
+func (commit *Commit) carriesTags() bool {
+	for _, event := range commit.attachments {
+		switch event := event.(type) {
+		case *Tag:
+			return true
+		case *Reset:
+			if strings.HasPrefix(event.ref, "refs/tags/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adopt makes a fileop belong to a repository, registering it with
+// the blob it refers to there.
+func (fileop *FileOp) adopt(repo *Repository) {
+	fileop.repo = repo
+	if (fileop.op == opM || fileop.op == opN) && strings.HasPrefix(fileop.ref, ":") {
+		if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+			blob.appendOperation(fileop)
+		}
+	}
+}
+
+// rerootOps returns the fileops a commit would have if history were
+// restricted to the content of one directory, which becomes the top of
+// the tree, and the number of its fileops left out. The commit is not
+// changed; the returned fileops are new and belong to no repository
+// until adopted. Content renamed or copied in from outside the
+// directory is looked up in the first parent's manifest.
+func (commit *Commit) rerootOps(dir string) ([]*FileOp, int) {
+	prefix := dir + "/"
+	inside := func(p string) bool {
+		return strings.HasPrefix(p, prefix)
+	}
+	copyOp := func(op *FileOp) *FileOp {
+		newop := *op
+		newop.repo = nil
+		newop.inline = append([]byte(nil), op.inline...)
+		return &newop
+	}
+	copyIn := func(source string, target string) []*FileOp {
+		var ops []*FileOp
+		if !commit.hasParents() {
+			return ops
+		}
+		parent, ok := commit.parents()[0].(*Commit)
+		if !ok {
+			return ops
+		}
+		manifest := parent.manifest()
+		add := func(from string, to string) {
+			value, ok := manifest.get(from)
+			if !ok {
+				return
+			}
+			op := copyOp(value.(*FileOp))
+			op.op, op.Source, op.Path = opM, "", to
+			ops = append(ops, op)
+		}
+		if manifest.has(source) {
+			add(source, target)
+		} else {
+			for _, name := range manifest.pathnames() {
+				if strings.HasPrefix(name, source+"/") {
+					add(name, target+name[len(source):])
+				}
+			}
+		}
+		return ops
+	}
+	var ops []*FileOp
+	dropped := 0
+	for _, op := range commit.operations() {
+		switch op.op {
+		case opM, opD:
+			if inside(op.Path) {
+				newop := copyOp(op)
+				newop.Path = op.Path[len(prefix):]
+				ops = append(ops, newop)
+			} else if op.op == opD && op.Path == dir {
+				ops = append(ops, newFileOp(nil).construct(deleteall))
+				dropped++
+			} else {
+				dropped++
+			}
+		case opR, opC:
+			from, to := inside(op.Source), inside(op.Path)
+			if from && to {
+				newop := copyOp(op)
+				newop.Source, newop.Path = op.Source[len(prefix):], op.Path[len(prefix):]
+				ops = append(ops, newop)
+				continue
+			}
+			dropped++
+			if from && op.op == opR {
+				ops = append(ops, newFileOp(nil).construct(opD, op.Source[len(prefix):]))
+			} else if op.Source == dir && op.op == opR {
+				ops = append(ops, newFileOp(nil).construct(deleteall))
+			} else if to {
+				ops = append(ops, copyIn(op.Source, op.Path[len(prefix):])...)
+			}
+		default:
+			ops = append(ops, copyOp(op))
+		}
+	}
+	return ops, dropped
+}
+
+// subdirectory restricts the history to the content of one directory,
+// which becomes the top of the tree. It returns the number of fileops
+// dropped. Commits left empty are not removed.
+func (repo *Repository) subdirectory(dir string) int {
+	// Plan every commit's new fileops before changing any, since
+	// content renamed or copied in from outside the directory is
+	// looked up in the parent's manifest.
+	commits := repo.commits(nil)
+	rewrites := make([][]*FileOp, len(commits))
+	dropped := 0
+	for i, commit := range commits {
+		ops, n := commit.rerootOps(dir)
+		rewrites[i] = ops
+		dropped += n
+		control.baton.twirl()
+	}
+	for i, commit := range commits {
+		for _, op := range rewrites[i] {
+			op.adopt(repo)
+		}
+		commit.setOperations(rewrites[i])
+	}
+	repo.gcBlobs()
+	return dropped
+}
+
+// emptyPolicy deals with the commits left with no fileops by surgery
+// that drops content: "prune" deletes them as the prune command does,
+// "tagify" turns them into annotated tags, and "keep" leaves them
+// alone. It returns the number of commits removed.
+func (repo *Repository) emptyPolicy(policy string) int {
+	before := len(repo.commits(nil))
+	switch policy {
+	case "prune":
+		repo.prune(repo.all(), nil, nil)
+	case "tagify":
+		if err := repo.tagifyEmpty(nil, false, false, false, nil, nil, true); err != nil {
+			control.baton.printLogString(err.Error())
+		}
+	}
+	return before - len(repo.commits(nil))
+}
+
+// HelpSubdirectory says "Shut up, golint!"
+func (rs *Reposurgeon) HelpSubdirectory() {
+	rs.helpOutput(`
+subdirectory [--empty=prune|tagify|keep] DIRECTORY
+
+Restrict the history of the repository to one directory, which becomes
+the top of the tree, like git filter-branch --subdirectory-filter.
+Fileops outside the directory are dropped, and the directory prefix is
+removed from the paths of the rest.  A deletion of the directory
+itself becomes a deleteall.  A rename out of the directory becomes a
+deletion; content renamed or copied into it from outside becomes
+modifications.  Blobs no longer referred to are removed.  This command
+does not take a selection set.
+
+Commits left with no fileops are then dealt with according to the
+--empty policy:
+
+prune:: The default. Delete them as the prune command does; branch
+refs and tags on them move back to their parents, and merge commits
+are kept.
+
+tagify:: Turn them into annotated tags as the tagify command does.
+
+keep:: Leave them alone.
+`)
+}
+
+// DoSubdirectory restricts history to a subdirectory.
+func (rs *Reposurgeon) DoSubdirectory(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	policy := "prune"
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--empty=") {
+			policy = strings.TrimPrefix(option, "--empty=")
+			if policy != "prune" && policy != "tagify" && policy != "keep" {
+				croak("unknown --empty policy %q", policy)
+				return false
+			}
+		} else {
+			croak("unknown option %s in subdirectory line", option)
+			return false
+		}
+	}
+	args := parse.Tokens()
+	if len(args) != 1 {
+		croak("subdirectory requires exactly one directory")
+		return false
+	}
+	dir := strings.Trim(args[0], "/")
+	if dir == "" {
+		croak("subdirectory requires a directory below the top of the tree")
+		return false
+	}
+	dropped := repo.subdirectory(dir)
+	removed := repo.emptyPolicy(policy)
+	if dropped > 0 || removed > 0 {
+		repo.dirty = true
+	}
+	respond("%d fileops outside %s dropped, %d commits removed.", dropped, dir, removed)
+	return false
+}
+
+// HelpMerge says "Shut up, golint!"
+func (rs *Reposurgeon) HelpMerge() {
+	rs.helpOutput(`
+{SELECTION} merge
+
+Create a merge link. Takes a selection set argument, ignoring all but
+the lowest (source) and highest (target) members.  Creates a merge link
+from the highest member (child) to the lowest (parent).
+`)
+}
+
+// DoMerge is the command handler for the "merge" command.
+func (rs *Reposurgeon) DoMerge(_line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	commits := rs.chosen().commits(rs.selection)
+	if len(commits) < 2 {
+		croak("merge requires a selection set with at least two commits.")
+		return false
+	}
+	early := commits[0]
+	late := commits[len(commits)-1]
+	if late.mark < early.mark {
+		late, early = early, late
+	}
+	late.addParentCommit(early)
+	rs.chosen().dirty = true
+	//earlyID = fmt.Sprintf("%s (%s)", early.mark, early.Branch)
+	//lateID = fmt.Sprintf("%s (%s)", late.mark, late.Branch)
+	//respond("%s added as a parent of %s", earlyID, lateID)
+	return false
+}
+
+// HelpUnmerge says "Shut up, golint!"
+func (rs *Reposurgeon) HelpUnmerge() {
+	rs.helpOutput(`
+{SELECTION} unmerge
+
+Linearizes a commit. Takes a selection set argument, which must resolve to a
+single commit, and removes all its parents except for the first. It is
+equivalent to reparent --rebase {first parent},{commit}, where {commit} is the
+selection set given to unmerge and {first parent} is a set resolving to that
+commit's first parent, but doesn't need you to find the first parent yourself.
+`)
+}
+
+// DoUnmerge says "Shut up, golint!"
+func (rs *Reposurgeon) DoUnmerge(_line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	if len(rs.selection) != 1 {
+		croak("unmerge requires a single commit.")
+		return false
+	}
+	event := rs.chosen().events[rs.selection[0]]
+	if commit, ok := event.(*Commit); !ok {
+		croak("unmerge target is not a commit.")
+	} else {
+		commit.setParents(commit.parents()[:1])
+		rs.chosen().dirty = true
+	}
+	return false
+
+}
+
+// descendsFrom tells whether a commit is another or has it among its
+// ancestors. Parents precede their children in the event list, so the
+// search never goes below the other commit's index.
+func (commit *Commit) descendsFrom(other *Commit) bool {
+	repo := commit.repo
+	floor := repo.markToIndex(other.mark)
+	seen := make(map[*Commit]bool)
+	stack := []*Commit{commit}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == other {
+			return true
+		}
+		for _, parent := range current.parents() {
+			if ancestor, ok := parent.(*Commit); ok && !seen[ancestor] && repo.markToIndex(ancestor.mark) >= floor {
+				seen[ancestor] = true
+				stack = append(stack, ancestor)
+			}
+		}
+	}
+	return false
+}
+
+// debubble removes the parent links of the selected merge commits that
+// bring in no history: links to a parent that is also an ancestor of
+// another parent, as cvs2svn leaves when it merges a branch on which
+// nothing was committed, and repeated links to the same parent. A
+// commit whose first parent is dropped has its fileops regenerated
+// against its new first parent, so its tree does not change. It
+// returns the merges simplified, in order, with their dropped parents.
+func (repo *Repository) debubble(selection orderedIntSet) ([]*Commit, map[*Commit][]*Commit) {
+	var simplified []*Commit
+	dropped := make(map[*Commit][]*Commit)
+	for _, commit := range repo.commits(selection) {
+		parents := commit.parents()
+		if len(parents) < 2 {
+			continue
+		}
+		gone := make([]bool, len(parents))
+		for i, parent := range parents {
+			mine, ok := parent.(*Commit)
+			if !ok {
+				continue
+			}
+			for j, other := range parents {
+				theirs, ok := other.(*Commit)
+				if !ok || j == i || gone[j] || (theirs == mine && j > i) {
+					continue
+				}
+				if theirs.descendsFrom(mine) {
+					gone[i] = true
+					break
+				}
+			}
+		}
+		var kept []CommitLike
+		for i, parent := range parents {
+			if gone[i] {
+				dropped[commit] = append(dropped[commit], parent.(*Commit))
+			} else {
+				kept = append(kept, parent)
+			}
+		}
+		if len(dropped[commit]) == 0 {
+			continue
+		}
+		simplified = append(simplified, commit)
+		if !gone[0] {
+			commit.setParents(kept)
+			continue
+		}
+		tree := commit.manifest()
+		commit.setParents(kept)
+		if first, ok := kept[0].(*Commit); ok {
+			commit.diffOperations(first.manifest(), tree)
+		}
+	}
+	return simplified, dropped
+}
+
+// HelpDebubble says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDebubble() {
+	rs.helpOutput(`
+[SELECTION] debubble [>OUTFILE]
+
+Remove merge bubbles: parent links of the selected merge commits
+(default all) that bring in no history, because the parent is also an
+ancestor of another parent of the merge.  cvs2svn leaves many of these
+behind, merging branches on which nothing was committed; links that
+repeat a parent are removed too.  A merge left with one parent becomes
+an ordinary commit.  When it is the first parent that goes, the fileops
+of the commit are regenerated against its new first parent, so that its
+tree does not change.
+
+Each simplified merge is reported on one line: its event number and
+mark, the marks of the parents dropped, and the first line of its
+comment.  Supports > redirection.
+`)
+}
+
+// DoDebubble removes merge bubbles.
+func (rs *Reposurgeon) DoDebubble(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if parse.line != "" {
+		croak("too many arguments for debubble.")
+		return false
+	}
+	simplified, dropped := repo.debubble(selection)
+	for _, commit := range simplified {
+		var marks []string
+		for _, parent := range dropped[commit] {
+			marks = append(marks, parent.mark)
+		}
+		topline, _ := splitRuneFirst(commit.Comment, '\n')
+		fmt.Fprintf(parse.stdout, "%d %s\t%s\t%s\n",
+			repo.markToIndex(commit.mark)+1, commit.mark, strings.Join(marks, " "), topline)
+	}
+	if len(simplified) > 0 {
+		repo.dirty = true
+	}
+	respond("%d merge bubbles removed.", len(simplified))
+	return false
+}
+
+// HelpReparent says "Shut up, golint!"
+func (rs *Reposurgeon) HelpReparent() {
+	rs.helpOutput(`
+{SELECTION} reparent [--user-order] [--rebase] [<INFILE]
+
+Changes the parent list of a commit.  Takes a selection set, zero or
+more option arguments, and an optional policy argument.
+
+Selection set:
+
+    The selection set must resolve to one or more commits.  The
+    selected commit with the highest event number (not necessarily the
+    last one selected) is the commit to modify.  The remainder of the
+    selected commits, if any, become its parents:  the selected commit
+    with the lowest event number (which is not necessarily the first
+    one selected) becomes the first parent, the selected commit with
+    second lowest event number becomes the second parent, and so on.
+    All original parent links are removed.  Examples:
+
+        # this makes 17 the parent of 33
+        17,33 reparent
+
+        # this also makes 17 the parent of 33
+        33,17 reparent
+
+        # this makes 33 a root (parentless) commit
+        33 reparent
+
+        # this makes 33 an octopus merge commit.  its first parent
+        # is commit 15, second parent is 17, and third parent is 22
+        22,33,15,17 reparent
+
+Options:
+
+    --use-order
+
+        Use the selection order to determine which selected commit is
+        the commit to modify and which are the parents (and if there
+        are multiple parents, their order).  The last selected commit
+        (not necessarily the one with the highest event number) is the
+        commit to modify, the first selected commit (not necessarily
+        the one with the lowest event number) becomes the first
+        parent, the second selected commit becomes the second parent,
+        and so on.  Examples:
+
+            # this makes 33 the parent of 17
+            33|17 reparent --use-order
+
+            # this makes 17 an octopus merge commit.  its first parent
+            # is commit 22, second parent is 33, and third parent is 15
+            22,33,15|17 reparent --use-order
+
+        Because ancestor commit events must appear before their
+        descendants, giving a commit with a low event number a parent
+        with a high event number triggers a re-sort of the events.  A
+        re-sort assigns different event numbers to some or all of the
+        events.  Re-sorting only works if the reparenting does not
+        introduce any cycles.  To swap the order of two commits that
+        have an ancestor-descendant relationship without introducing a
+        cycle during the process, you must reparent the descendant
+        commit first.
+
+    --rebase
+
+	By default, the manifest of the reparented commit is computed
+	before modifying it; a 'deleteall' and some fileops are prepended
+	so that the manifest stays unchanged even when the first parent
+	has been changed.  This behavior can be changed by specifying a
+	policy flag:
+
+        Inhibits the default behavior -- no 'deleteall' is issued and
+        the tree contents of all descendants can be modified as a
+        result.
+
+        D, R, and C fileops that refer to paths absent from the new
+        ancestry are dropped with a warning.  If the command's input
+        is redirected, or when running interactively at a terminal,
+        each is resolved by prompting as described for 'reorder'.
+`)
+}
+
+// DoReparent is rthe ommand handler for the "reparent" command.
+func (rs *Reposurgeon) DoReparent(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	for _, commit := range repo.commits(nil) {
+		commit.invalidateManifests()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	useOrder := parse.options.Contains("--use-order")
+	// Determine whether an event resort might be needed.  it is
+	// assumed that ancestor commits already have a lower event
+	// index before this function is called, which should be true
+	// as long as every function that modifies the DAG calls
+	// Repository.resort() when needed.  thus, a call to resort()
+	// should only be necessary if --use-order is passed and a
+	// parent will have an index higher than the modified commit.
+	var doResort bool
+	if useOrder {
+		for _, idx := range rs.selection[:len(rs.selection)-1] {
+			if idx > rs.selection[len(rs.selection)-1] {
+				doResort = true
+			}
+		}
+	} else {
+		sort.Ints(rs.selection)
+	}
+	selected := repo.commits(rs.selection)
+	if len(selected) == 0 || len(rs.selection) != len(selected) {
+		if logEnable(logWARN) {
+			logit("reparent requires one or more selected commits")
+		}
+	}
+	child := selected[len(selected)-1]
+	parents := make([]CommitLike, len(rs.selection)-1)
+	for i, c := range selected[:len(selected)-1] {
+		parents[i] = c
+	}
+	if doResort {
+		for _, p := range parents {
+			if p.(*Commit).descendedFrom(child) {
+				if logEnable(logWARN) {
+					logit("reparenting a commit to its own descendant would introduce a cycle")
+				}
+				return false
+			}
+		}
+	}
+	if !parse.options.Contains("--rebase") {
+		// Recreate the state of the tree
+		f := newFileOp(repo)
+		f.construct(deleteall)
+		newops := []*FileOp{f}
+		child.manifest().iter(func(path string, pentry interface{}) {
+			entry := pentry.(*FileOp)
+			f = newFileOp(repo)
+			f.construct(opM, entry.mode, entry.ref, path)
+			if entry.ref == "inline" {
+				f.inline = entry.inline
+			}
+			newops = append(newops, f)
+		})
+		child.setOperations(newops)
+		child.simplify()
+	}
+	oldTree := child.firstParentManifest()
+	child.setParents(parents)
+	// With --rebase the fileops are kept as they are, so they may now
+	// refer to paths the new ancestry never had.
+	if parse.options.Contains("--rebase") {
+		child.resolveFileopConflicts(oldTree, rs.conflictResolver(parse), "reparenting", false)
+	}
+	// Restore this when we have toposort working identically in Go and Python.
+	if doResort {
+		repo.resort()
+	}
+	repo.dirty = true
+	return false
+}
+
+// HelpReorder says "Shut up, golint!"
+func (rs *Reposurgeon) HelpReorder() {
+	rs.helpOutput(`
+[SELECTION] reorder [--quiet] [--fix] [--earlier=N|--later=N] [<INFILE]
+
+Re-order a contiguous range of commits.
+
+Older revision control systems tracked change history on a per-file basis,
+rather than as a series of atomic "changesets", which often made it difficult
+to determine the relationships between changes. Some tools which convert a
+history from one revision control system to another attempt to infer
+changesets by comparing file commit comment and time-stamp against those of
+other nearby commits, but such inference is a heuristic and can easily fail.
+
+In the best case, when inference fails, a range of commits in the resulting
+conversion which should have been coalesced into a single changeset instead
+end up as a contiguous range of separate commits. This situation typically can
+be repaired easily enough with the 'coalesce' or 'squash' commands. However,
+in the worst case, numerous commits from several different "topics", each of
+which should have been one or more distinct changesets, may end up interleaved
+in an apparently chaotic fashion. To deal with such cases, the commits need to
+be re-ordered, so that those pertaining to each particular topic are clumped
+together, and then possibly squashed into one or more changesets pertaining to
+each topic. This command, 'reorder', can help with the first task; the
+'squash' command with the second.
+
+Selected commits are re-arranged in the order specified; for instance:
+":7,:5,:9,:3 reorder". The specified commit range must be contiguous; each
+commit must be accounted for after re-ordering. Thus, for example, ':5' can
+not be omitted from ":7,:5,:9,:3 reorder". (To drop a commit, use the 'delete'
+or 'squash' command.) The selected commits must represent a linear history,
+however, the lowest numbered commit being re-ordered may have multiple
+parents, and the highest numbered may have multiple children.
+
+Re-ordered commits and their immediate descendants are inspected for
+rudimentary fileops inconsistencies. Warns if re-ordering results in a commit
+trying to delete, rename, or copy a file before it was ever created. Likewise,
+warns if all of a commit's fileops become no-ops after re-ordering. Other
+fileops inconsistencies may arise from re-ordering, both within the range of
+affected commits and beyond; for instance, moving a commit which renames a
+file ahead of a commit which references the original name. Such anomalies can
+be discovered via manual inspection and repaired with the 'add' and 'remove'
+(and possibly 'path') commands. Warnings can be suppressed with '--quiet'.
+
+When the command's input is redirected, or when running interactively at
+a terminal, each such inconsistency is resolved by prompting instead.
+An answer of 'd' drops the fileop, 'r' retains it as-is, and 's'
+synthesizes a replacement: a rename or copy whose source has vanished
+becomes an M fileop creating the target with the content the source had
+before the re-order.  One answer is read per line; end of input drops
+the remaining fileops.
+
+With --earlier=N or --later=N the selection need not be re-ordered by
+hand: it is moved past the N commits just before or just after it on its
+branch, which must be linear.  The selection may then be a single commit.
+
+After re-ordering, the tree at the end of the range is checked against
+the tree before; if they differ, some fileop lost or changed its effect,
+and a warning is issued unless --quiet is given.  With --fix, conflicts
+are resolved without prompting, deletes of absent files being dropped
+and everything else synthesized, and compensating fileops are then
+appended to the last commit of the range so that the tree at its end is
+what it was before.
+
+In addition to adjusting their parent/child relationships, re-ordering commits
+also re-orders the underlying events since ancestors must appear before
+descendants, and blobs must appear before commits which reference them. This
+means that events within the specified range will have different event numbers
+after the operation.
+`)
+}
+
+// conflictResolver returns a prompting resolver for fileop conflicts if
+// there is someone to ask: either input has been redirected, or we are
+// interactive at a terminal and not running a script.  Otherwise it
+// returns nil and conflicting fileops are dropped.
+func (rs *Reposurgeon) conflictResolver(parse *LineParse) fileopResolver {
+	if parse.redirected || (control.isInteractive() && !rs.inScript() && terminal.IsTerminal(0)) {
+		return newFileopResolver(parse.stdin, control.baton)
+	}
+	return nil
+}
+
+// DoReorder re-orders a contiguous range of commits.
+func (rs *Reposurgeon) DoReorder(lineIn string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	sel := rs.selection
+	if sel == nil {
+		croak("no selection")
+		return false
+	}
+	parse := rs.newLineParse(lineIn, orderedStringSet{"stdin"})
+	defer parse.Closem()
+	if parse.line != "" {
+		croak("'reorder' takes no arguments")
+		return false
+	}
+	_, quiet := parse.OptVal("--quiet")
+	_, fix := parse.OptVal("--fix")
+	earlier, moveEarlier := parse.OptVal("--earlier")
+	later, moveLater := parse.OptVal("--later")
+	commits := repo.commits(sel)
+	if len(commits) == 0 {
+		croak("no commits in selection")
+		return false
+	} else if len(commits) == 1 && !moveEarlier && !moveLater {
+		croak("only 1 commit selected; nothing to re-order")
+		return false
+	} else if len(commits) != len(sel) {
+		croak("selection set must be all commits")
+		return false
+	}
+	if moveEarlier || moveLater {
+		if moveEarlier && moveLater {
+			croak("--earlier and --later are mutually exclusive")
+			return false
+		}
+		count, err := strconv.Atoi(earlier + later)
+		if err != nil || count <= 0 {
+			croak("reorder needs a positive count of commits to move past")
+			return false
+		}
+		sel, err = repo.moveRange(sel, count, moveEarlier)
+		if err != nil {
+			croak(err.Error())
+			return false
+		}
+	}
+	resolve := rs.conflictResolver(parse)
+	if fix {
+		resolve = func(_ *Commit, op *FileOp, _ string) byte {
+			if op.op == opD {
+				return 'd'
+			}
+			return 's'
+		}
+	}
+	repo.reorderCommits(sel, quiet, resolve, fix)
+	repo.dirty = true
+	return false
+}
+
+// HelpBranch says "Shut up, golint!"
+func (rs *Reposurgeon) HelpBranch() {
+	rs.helpOutput(`
+branch {BRANCH-NAME|/PATTERN/} {rename|delete|totag} [ARG]
+
+Rename or delete a branch (and any associated resets), or turn it into
+a tag.  First argument must be an existing branch name; second argument
+must one of the verbs 'rename', 'delete', or 'totag'.
+
+For a 'rename', the third argument may be any token that is a syntactically
+valid branch name (but not the name of an existing branch).  If it does not
+contain a '/' the prefix 'heads/' is prepended.  If it does not begin with
+'refs/', then 'refs/' is prepended.
+
+For a 'delete', the name may optionally be a regular expression wrapped in //;
+if so, all objects of the specified type with names matching the regexp are
+deleted.  This is useful for mass deletion of branches.  Such deletions can be
+restricted by a selection set in the normal way.  No third argument is
+required.
+
+A 'totag' turns a branch that is a single line of development, with no
+merges and nothing else descending from it, into an annotated tag at
+its tip; this normalizes Subversion tags that were committed to after
+creation.  The branch's commits are relabeled as belonging to the tag,
+its resets are deleted, and the tag's tagger and comment are copied
+from the tip commit.  The optional third argument names the tag; it
+defaults to the basename of the branch.  The inverse is 'tag tobranch'.`)
+}
+
+func branchNameMatches(name string, regex *regexp.Regexp) bool {
+	return strings.HasPrefix(name, "refs/heads/") && regex.MatchString(name[11:])
+}
+
+func tagNameMatches(name string, regex *regexp.Regexp) bool {
+	return strings.HasPrefix(name, "refs/tags/") && regex.MatchString(name[10:])
+}
+
+// DoBranch renames a branch or deletes it.
+func (rs *Reposurgeon) DoBranch(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	repo := rs.chosen()
+	branchname, line := popToken(line)
+	var err error
+	branchname, err = stringEscape(branchname)
+	if err != nil {
+		croak("while selecting branch: %v", err)
+		return false
+	}
+	var verb string
+	verb, line = popToken(line)
+	if verb == "rename" {
+		if !strings.Contains(branchname, "/") {
+			branchname = "refs/heads/" + branchname
+		}
+		if !repo.branchset().Contains(branchname) {
+			croak("no such branch as %s", branchname)
+			return false
+		}
+		var newname string
+		newname, line = popToken(line)
+		if newname == "" {
+			croak("new branch name must be nonempty.")
+			return false
+		}
+		if !strings.Contains(newname, "/") {
+			newname = "refs/heads/" + newname
+		}
+		if repo.branchset().Contains(newname) {
+			croak("there is already a branch named '%s'.", newname)
+			return false
+		}
+		for _, event := range repo.events {
+			if commit, ok := event.(*Commit); ok {
+				if commit.Branch == branchname {
+					commit.setBranch(newname)
+				}
+			} else if reset, ok := event.(*Reset); ok {
+				if reset.ref == branchname {
+					reset.ref = newname
+				}
+			}
+		}
+	} else if verb == "delete" {
+		selection := rs.selection
+		if selection == nil {
+			selection = repo.all()
+		}
+		var shouldDelete func(string) bool
+		if branchname[0] == '/' && branchname[len(branchname)-1] == '/' {
+			// Regexp - can refer to a list of branchs matched
+			branchre, err := regexp.Compile(branchname[1 : len(branchname)-1])
+			if err != nil {
+				croak("in branch command: %v", err)
+				return false
+			}
+			shouldDelete = func(branch string) bool {
+				return branchNameMatches(branch, branchre)
+			}
+		} else {
+			theref := "refs/heads/" + branchname
+			if !repo.branchset().Contains(theref) {
+				croak("no such branch as %s", branchname)
+				return false
+			}
+			shouldDelete = func(branch string) bool {
+				return branch == theref
+			}
+		}
+		repo.deleteBranch(selection, shouldDelete)
+	} else if verb == "totag" {
+		if !strings.Contains(branchname, "/") {
+			branchname = "refs/heads/" + branchname
+		}
+		if !repo.branchset().Contains(branchname) {
+			croak("no such branch as %s", branchname)
+			return false
+		}
+		var tagname string
+		tagname, line = popToken(line)
+		if tagname == "" {
+			tagname = path.Base(branchname)
+		}
+		fulltagname := "refs/tags/" + strings.TrimPrefix(tagname, "refs/tags/")
+		for _, event := range repo.events {
+			if tag, ok := event.(*Tag); ok && tag.name == fulltagname {
+				croak("there is already a tag named %s", tagname)
+				return false
+			}
+		}
+		if repo.branchset().Contains(fulltagname) {
+			croak("there is already a tag named %s", tagname)
+			return false
+		}
+		// The branch must be a single line of development that
+		// nothing else descends from.
+		var onBranch []*Commit
+		for _, commit := range repo.commits(nil) {
+			if commit.Branch == branchname {
+				onBranch = append(onBranch, commit)
+			}
+		}
+		for i, commit := range onBranch {
+			if len(commit.parents()) > 1 {
+				croak("branch %s is not linear: %s is a merge", branchname, commit.idMe())
+				return false
+			}
+			if i > 0 && (!commit.hasParents() || commit.parents()[0] != onBranch[i-1]) {
+				croak("branch %s is not linear at %s", branchname, commit.idMe())
+				return false
+			}
+			children := commit.children()
+			if i < len(onBranch)-1 && (len(children) != 1 || children[0] != onBranch[i+1]) ||
+				i == len(onBranch)-1 && len(children) > 0 {
+				croak("branch %s is not frozen: %s has other descendants", branchname, commit.idMe())
+				return false
+			}
+		}
+		tip := onBranch[len(onBranch)-1]
+		for _, commit := range onBranch {
+			commit.setBranch(fulltagname)
+		}
+		var resets []int
+		for i, event := range repo.events {
+			if reset, ok := event.(*Reset); ok && reset.ref == branchname {
+				reset.forget()
+				resets = append(resets, i)
+			}
+		}
+		if len(resets) > 0 {
+			repo.delete(resets, nil)
+			repo.declareSequenceMutation("reset deletion")
+		}
+		repo.addTagFor(tagname, tip)
+	} else {
+		croak("unknown verb '%s' in branch command.", verb)
+		return false
+	}
+	repo.dirty = true
+	return false
+}
+
+// addTagFor creates a tag object pointing to a commit, with the
+// tagger and comment copied from it, and inserts it just after the
+// last tag in the repo (or just after the last commit if there are
+// no tags).
+func (repo *Repository) addTagFor(tagname string, target *Commit) *Tag {
+	tag := newTag(repo, tagname, target.mark,
+		target.committer.clone(),
+		target.Comment)
+	tag.tagger.date.timestamp = tag.tagger.date.timestamp.Add(time.Second) // So it is unique
+	var lasttag int
+	var lastcommit int
+	for i, event := range repo.events {
+		if _, ok := event.(*Tag); ok {
+			lasttag = i
+		} else if _, ok := event.(*Commit); ok {
+			lastcommit = i
+		}
+		control.baton.twirl()
+	}
+	if lasttag == 0 {
+		lasttag = lastcommit
+	}
+	repo.insertEvent(tag, lasttag+1, "tag creation")
+	control.baton.twirl()
+	return tag
+}
+
+// HelpTag says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTag() {
+	rs.helpOutput(`
+[SELECTION] tag {TAG-NAME} {create|move|rename|delete|tobranch} [ARG]
+
+Create, move, rename, delete, or expand a tag.
+
+Creation is a special case.  First argument is a name, which must not
+be an existing tag. Takes a singleton event second argument which must
+point to a commit.  A tag object pointing to the commit is created and
+inserted just after the last tag in the repo (or just after the last
+commit if there are no tags).  The tagger, committish, and comment
+fields are copied from the commit's committer, mark, and comment
+fields.
+
+Otherwise, the first argument must be an existing name referring to a
+tag object, lightweight tag, or reset; second argument must be one of
+the verbs 'move', 'rename', 'delete', or 'tobranch'.
+
+For a 'move', a third argument must be a singleton selection set. For
+a 'rename', the third argument may be any token that is a
+syntactically valid tag name (but not the name of an existing
+tag).
+
+A 'tobranch' expands a tag object into a branch holding a single new
+commit, a child of the tagged commit with no fileops whose committer
+and comment are the tagger and comment of the tag.  The tag is
+deleted, and any commits and resets labeled with its name move to the
+branch.  The optional third argument names the branch; it defaults to
+the basename of the tag.  This is the inverse of 'branch totag'.
+
+For a 'delete', no third argument is required.  The name portion of a
+delete may be a regexp wrapped in //; if so, all objects of the
+specified type with names matching the regexp are deleted.  This is
+useful for mass deletion of junk tags such as CVS branch-root tags.
+Such deletions can be restricted by a selection set in the normal way.
+
+Tag names may use backslash escapes interpreted by the Python
+string-escape codec, such as \s.
+
+The behavior of this command is complex because features which present
+as tags may be any of three things: (1) true tag objects, (2)
+lightweight tags, actually sequences of commits with a common
+branchname beginning with 'refs/tags' - in this case the tag is
+considered to point to the last commit in the sequence, (3) Reset
+objects.  These may occur in combination; in fact, stream exporters
+from systems with annotation tags commonly express each of these as a
+true tag object (1) pointing at the tip commit of a sequence (2) in
+which the basename of the common branch field is identical to the tag
+name.  An exporter that generates lightweight-tagged commit sequences (2)
+may or may not generate resets pointing at their tip commits.
+
+This command tries to handle all combinations in a natural way by
+doing up to three operations on any true tag, commit sequence, and
+reset matching the source name. In a rename, all are renamed together.
+In a delete, any matching tag or reset is deleted; then matching
+branch fields are changed to match the branch of the unique descendant
+of the tagged commit, if there is one.  When a tag is moved, no branch
+fields are changed and a warning is issued.
+`)
+}
+
+// DoTag moves a tag to point to a specified commit, or renames it, or deletes it.
+func (rs *Reposurgeon) DoTag(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	repo := rs.chosen()
+	// A tag name can refer to one of the following things {
+	// (1) A tag object, by name
+	// (2) A reset object having a name in the tags/ namespace
+	// (3) The tip commit of a branch with branch fields
+	// These things often occur in combination. Notably, git-fast-export
+	// generates for each tag object corresponding branch labels on
+	// some ancestor commits - the rule for where this stops is unclear.
+	var tagname string
+	tagname, line = popToken(line)
+	if len(tagname) == 0 {
+		croak("missing tag name")
+		return false
+	}
+	var err error
+	tagname, err = stringEscape(tagname)
+	if err != nil {
+		croak("in tag command: %v", err)
+		return false
+	}
+	var verb string
+	verb, line = popToken(line)
+	if verb == "create" {
+		var ok bool
+		var target *Commit
+		if repo.named(tagname) != nil {
+			croak("something is already named %s", tagname)
+			return false
+		}
+		rs.setSelectionSet(line)
+		if rs.selection == nil {
+			croak("usage: tag <name> create <singleton-selection>")
+			return false
+		} else if len(rs.selection) != 1 {
+			croak("tag create requires a singleton commit set.")
+			return false
+		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
+			croak("create target is not a commit.")
+			return false
+		}
+		repo.addTagFor(tagname, target)
+		repo.dirty = true
+		return false
+	}
+	tags := make([]*Tag, 0)
+	resets := make([]*Reset, 0)
+	commits := make([]*Commit, 0)
+	var refMatches func(string) bool
+	if tagname[0] == '/' && tagname[len(tagname)-1] == '/' {
+		// Regexp - can refer to a list of tags matched
+		tagre, err := regexp.Compile(tagname[1 : len(tagname)-1])
+		if err != nil {
+			croak("in tag command: %v", err)
+			return false
+		}
+		refMatches = func(branch string) bool {
+			return tagNameMatches(branch, tagre)
+		}
+	} else {
+		// Non-regexp - can only refer to a single tag
+		fulltagname := branchname(tagname)
+		refMatches = func(branch string) bool {
+			return branch == fulltagname
+		}
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	for _, idx := range selection {
+		event := repo.events[idx]
+		if tag, ok := event.(*Tag); ok && refMatches(tag.name) {
+			tags = append(tags, tag)
+		} else if reset, ok := event.(*Reset); ok && refMatches(reset.ref) {
+			resets = append(resets, reset)
+		} else if commit, ok := event.(*Commit); ok && refMatches(commit.Branch) {
+			commits = append(commits, commit)
+		}
+		control.baton.twirl()
+	}
+	if len(tags) == 0 && len(resets) == 0 && len(commits) == 0 {
+		croak("no tags matching %s", tagname)
+		return false
+	}
+	if verb == "move" {
+		var target *Commit
+		var ok bool
+		rs.setSelectionSet(line)
+		if len(rs.selection) != 1 {
+			croak("tag move requires a singleton commit set.")
+			return false
+		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
+			croak("move target is not a commit.")
+			return false
+		}
+		if len(tags) > 0 {
+			for _, tag := range tags {
+				tag.forget()
+				tag.remember(repo, target.mark)
+				control.baton.twirl()
+			}
+		}
+		if len(resets) > 0 {
+			if len(resets) == 1 {
+				resets[0].committish = target.mark
+			} else {
+				croak("cannot move multiple tags.")
+			}
+			control.baton.twirl()
+		}
+		if len(commits) > 0 {
+			// Delete everything only reachable from the old tag position,
+			// and change the Branch of every commit that happened on that
+			// old tag but is still reachable from elsewhere.
+			repo.deleteBranch(selection, refMatches)
+		}
+	} else if verb == "rename" {
+		if len(tags) > 1 {
+			croak("exactly one tag is required for rename")
+			return false
+		}
+		var newname string
+		newname, line = popToken(line)
+		if newname == "" {
+			croak("new tag name must be nonempty.")
+			return false
+		}
+		if len(tags) == 1 {
+			for _, event := range repo.events {
+				if tag, ok := event.(*Tag); ok && tag != tags[0] && tag.name == tags[0].name {
+					croak("tag name collision, not renaming.")
+					return false
+				}
+			}
+			tags[0].setHumanName(newname)
+
+			control.baton.twirl()
+		}
+		fullnewname := branchname(newname)
+		for _, reset := range resets {
+			reset.ref = fullnewname
+		}
+		for _, event := range commits {
+			event.Branch = fullnewname
+		}
+	} else if verb == "tobranch" {
+		if len(tags) != 1 {
+			croak("exactly one tag object is required for tobranch")
+			return false
+		}
+		tag := tags[0]
+		target, ok := repo.markToEvent(tag.committish).(*Commit)
+		if !ok {
+			croak("tag %s does not point to a commit", tag.name)
+			return false
+		}
+		var newname string
+		newname, line = popToken(line)
+		if newname == "" {
+			newname = path.Base(tag.name)
+		}
+		if !strings.Contains(newname, "/") {
+			newname = "refs/heads/" + newname
+		}
+		if repo.branchset().Contains(newname) {
+			croak("there is already a branch named '%s'.", newname)
+			return false
+		}
+		commit := newCommit(repo)
+		if tag.tagger != nil {
+			commit.committer = *tag.tagger.clone()
+		} else {
+			commit.committer = *target.committer.clone()
+		}
+		commit.Comment = tag.Comment
+		commit.legacyID = tag.legacyID
+		commit.setMark(repo.newmark())
+		commit.setBranch(newname)
+		commit.addParentCommit(target)
+		where := tag.index()
+		repo.delete([]int{where}, nil)
+		tag.forget()
+		repo.insertEvent(commit, where, "tag expansion")
+		for _, reset := range resets {
+			reset.forget()
+			repo.delete([]int{repo.eventToIndex(reset)}, nil)
+		}
+		for _, event := range commits {
+			event.setBranch(newname)
+		}
+		repo.declareSequenceMutation("tag expansion")
+	} else if verb == "delete" {
+		for _, tag := range tags {
+			// the order here in important
+			repo.delete([]int{tag.index()}, nil)
+			tag.forget()
+			control.baton.twirl()
+		}
+		if len(tags) > 0 {
+			repo.declareSequenceMutation("tag deletion")
 		}
-	}
-	child := selected[len(selected)-1]
-	parents := make([]CommitLike, len(rs.selection)-1)
-	for i, c := range selected[:len(selected)-1] {
-		parents[i] = c
-	}
-	if doResort {
-		for _, p := range parents {
-			if p.(*Commit).descendedFrom(child) {
-				if logEnable(logWARN) {
-					logit("reparenting a commit to its own descendant would introduce a cycle")
-				}
-				return false
-			}
+		for _, reset := range resets {
+			reset.forget()
+			repo.delete([]int{repo.eventToIndex(reset)}, nil)
 		}
+		if len(resets) > 0 {
+			repo.declareSequenceMutation("reset deletion")
+		}
+		if len(commits) > 0 {
+			repo.deleteBranch(selection, refMatches)
+		}
+	} else {
+		croak("unknown verb '%s' in tag command.", verb)
+		return false
 	}
-	if !parse.options.Contains("--rebase") {
-		// Recreate the state of the tree
-		f := newFileOp(repo)
-		f.construct(deleteall)
-		newops := []*FileOp{f}
-		child.manifest().iter(func(path string, pentry interface{}) {
-			entry := pentry.(*FileOp)
-			f = newFileOp(repo)
-			f.construct(opM, entry.mode, entry.ref, path)
-			if entry.ref == "inline" {
-				f.inline = entry.inline
-			}
-			newops = append(newops, f)
-		})
-		child.setOperations(newops)
-		child.simplify()
-	}
-	child.setParents(parents)
-	// Restore this when we have toposort working identically in Go and Python.
-	if doResort {
-		repo.resort()
-	}
+	repo.dirty = true
 	return false
 }
 
-// HelpReorder says "Shut up, golint!"
-func (rs *Reposurgeon) HelpReorder() {
+// HelpTagcommits says "Shut up, golint!"
+func (rs *Reposurgeon) HelpTagcommits() {
 	rs.helpOutput(`
-[SELECTION] reorder [--quiet]
-
-Re-order a contiguous range of commits.
+[SELECTION] tagcommits [--branch|--fold|--keep] [>OUTFILE]
 
-Older revision control systems tracked change history on a per-file basis,
-rather than as a series of atomic "changesets", which often made it difficult
-to determine the relationships between changes. Some tools which convert a
-history from one revision control system to another attempt to infer
-changesets by comparing file commit comment and time-stamp against those of
-other nearby commits, but such inference is a heuristic and can easily fail.
+Find commits made to Subversion tags after the tag copy.  A Subversion
+tag is just a directory, so nothing stops people committing to one;
+a conversion then yields a lightweight tag with trailing commits, and
+an annotated '-root' tag marking the copy.  Only commits in the
+selection set (defaulting to all) are considered.  This command only
+applies to repositories read from Subversion.
 
-In the best case, when inference fails, a range of commits in the resulting
-conversion which should have been coalesced into a single changeset instead
-end up as a contiguous range of separate commits. This situation typically can
-be repaired easily enough with the 'coalesce' or 'squash' commands. However,
-in the worst case, numerous commits from several different "topics", each of
-which should have been one or more distinct changesets, may end up interleaved
-in an apparently chaotic fashion. To deal with such cases, the commits need to
-be re-ordered, so that those pertaining to each particular topic are clumped
-together, and then possibly squashed into one or more changesets pertaining to
-each topic. This command, 'reorder', can help with the first task; the
-'squash' command with the second.
+With no option, each tag that was committed to is reported as its
+name, the number of commits made to it, and their event numbers.
+Supports > redirection.
 
-Selected commits are re-arranged in the order specified; for instance:
-":7,:5,:9,:3 reorder". The specified commit range must be contiguous; each
-commit must be accounted for after re-ordering. Thus, for example, ':5' can
-not be omitted from ":7,:5,:9,:3 reorder". (To drop a commit, use the 'delete'
-or 'squash' command.) The selected commits must represent a linear history,
-however, the lowest numbered commit being re-ordered may have multiple
-parents, and the highest numbered may have multiple children.
+With --branch, the commits move onto a branch named after the tag, as
+though the tag had been a branch all along; the '-root' tag stays
+on the copy point, as it does for branches.
 
-Re-ordered commits and their immediate descendants are inspected for
-rudimentary fileops inconsistencies. Warns if re-ordering results in a commit
-trying to delete, rename, or copy a file before it was ever created. Likewise,
-warns if all of a commit's fileops become no-ops after re-ordering. Other
-fileops inconsistencies may arise from re-ordering, both within the range of
-affected commits and beyond; for instance, moving a commit which renames a
-file ahead of a commit which references the original name. Such anomalies can
-be discovered via manual inspection and repaired with the 'add' and 'remove'
-(and possibly 'path') commands. Warnings can be suppressed with '--quiet'.
+With --fold, the commits are squashed into a single commit at the tip
+of the tag, and the '-root' tag is renamed to the tag name and moved
+to that commit, so it carries the metadata of the tag creation.
 
-In addition to adjusting their parent/child relationships, re-ordering commits
-also re-orders the underlying events since ancestors must appear before
-descendants, and blobs must appear before commits which reference them. This
-means that events within the specified range will have different event numbers
-after the operation.
+With --keep, the commits are left alone but the '-root' tag is still
+renamed and moved to the tip of the tag, and a warning is issued for
+each tag so treated.
 `)
 }
 
-// DoReorder re-orders a contiguous range of commits.
-func (rs *Reposurgeon) DoReorder(lineIn string) bool {
+// DoTagcommits finds and remediates commits to Subversion tags.
+func (rs *Reposurgeon) DoTagcommits(line string) bool {
 	repo := rs.chosen()
 	if repo == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	sel := rs.selection
-	if sel == nil {
-		croak("no selection")
+	if repo.sourceType() != "svn" {
+		croak("tagcommits only applies to repositories read from Subversion.")
 		return false
 	}
-	parse := rs.newLineParse(lineIn, nil)
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
-	if parse.line != "" {
-		croak("'reorder' takes no arguments")
-		return false
+	policy := ""
+	for _, option := range parse.options {
+		if option != "--branch" && option != "--fold" && option != "--keep" {
+			croak("unknown option %s in tagcommits line", option)
+			return false
+		} else if policy != "" {
+			croak("only one of --branch, --fold, and --keep may be given")
+			return false
+		}
+		policy = option
 	}
-	commits := repo.commits(sel)
-	if len(commits) == 0 {
-		croak("no commits in selection")
-		return false
-	} else if len(commits) == 1 {
-		croak("only 1 commit selected; nothing to re-order")
-		return false
-	} else if len(commits) != len(sel) {
-		croak("selection set must be all commits")
+	// Gather the commits with content on each tag.
+	var tagnames []string
+	trailing := make(map[string][]*Commit)
+	for _, ei := range selection {
+		commit, ok := repo.events[ei].(*Commit)
+		if !ok || !strings.HasPrefix(commit.Branch, "refs/tags/") || len(commit.operations()) == 0 {
+			continue
+		}
+		if _, seen := trailing[commit.Branch]; !seen {
+			tagnames = append(tagnames, commit.Branch)
+		}
+		trailing[commit.Branch] = append(trailing[commit.Branch], commit)
+	}
+	if policy == "" {
+		for _, name := range tagnames {
+			events := make([]string, 0, len(trailing[name]))
+			for _, commit := range trailing[name] {
+				events = append(events, strconv.Itoa(commit.index()+1))
+			}
+			fmt.Fprintf(parse.stdout, "%s\t%d\t%s\n",
+				branchbase(name), len(trailing[name]), strings.Join(events, ","))
+		}
 		return false
 	}
-	_, quiet := parse.OptVal("--quiet")
-
-	repo.reorderCommits(sel, quiet)
+	for _, name := range tagnames {
+		commits := trailing[name]
+		base := branchbase(name)
+		linear := true
+		for i, commit := range commits {
+			if len(commit.parents()) > 1 || (i > 0 && commit.parents()[0] != commits[i-1]) {
+				linear = false
+			}
+		}
+		if !linear && policy != "--branch" {
+			croak("commits to tag %s are not a single line of development; skipping it", base)
+			continue
+		}
+		if policy == "--branch" {
+			branch := "refs/heads/" + base
+			if repo.branchset().Contains(branch) {
+				croak("there is already a branch named %s; skipping tag %s", branch, base)
+				continue
+			}
+			for _, commit := range repo.commits(nil) {
+				if commit.Branch == name {
+					commit.setBranch(branch)
+				}
+			}
+			for _, event := range repo.events {
+				if reset, ok := event.(*Reset); ok && reset.ref == name {
+					reset.ref = branch
+				}
+			}
+			repo.dirty = true
+			continue
+		}
+		tip := commits[len(commits)-1]
+		if policy == "--fold" && len(commits) > 1 {
+			var folded []int
+			for _, commit := range commits[:len(commits)-1] {
+				folded = append(folded, commit.index())
+			}
+			if err := repo.squash(folded, orderedStringSet{"--pushforward", "--quiet"}); err != nil {
+				croak("while folding commits to tag %s: %v", base, err)
+				return false
+			}
+		} else if policy == "--keep" {
+			if logEnable(logWARN) {
+				logit("tag %s has %d commit(s) made after its creation; kept", base, len(commits))
+			}
+		}
+		// Give the copy's annotation to the tip.
+		var root *Tag
+		for _, event := range repo.events {
+			if tag, ok := event.(*Tag); ok && tag.name == name+"-root" {
+				root = tag
+			}
+		}
+		repo.dirty = true
+		if root == nil {
+			repo.addTagFor(base, tip)
+			continue
+		}
+		root.forget()
+		root.remember(repo, tip.mark)
+		root.setHumanName(base)
+	}
 	return false
 }
 
-// HelpBranch says "Shut up, golint!"
-func (rs *Reposurgeon) HelpBranch() {
+// HelpReset says "Shut up, golint!"
+func (rs *Reposurgeon) HelpReset() {
 	rs.helpOutput(`
-branch {BRANCH-NAME|/PATTERN/} {rename|delete} [ARG]
+[SELECTION] reset {RESET-NAME} {create|move|rename|delete} [ARG]
 
-Rename or delete a branch (and any associated resets).  First argument
-must be an existing branch name; second argument must one of the verbs
-'rename' or 'delete'.
+Create, move, rename, or delete a reset. Create is a special case; it
+requires a singleton selection which is the associated commit for the
+reset, takes as a first argument the name of the reset (which must not
+exist), and ends with the keyword create.
 
-For a 'rename', the third argument may be any token that is a syntactically
-valid branch name (but not the name of an existing branch).  If it does not
-contain a '/' the prefix 'heads/' is prepended.  If it does not begin with
-'refs/', then 'refs/' is prepended.
+In the other modes, the first argument must match an existing reset
+name with the selection; second argument must be one of the verbs
+'move', 'rename', or 'delete'. The default selection is all events.
 
-For a 'delete', the name may optionally be a regular expression wrapped in //;
-if so, all objects of the specified type with names matching the regexp are
-deleted.  This is useful for mass deletion of branches.  Such deletions can be
-restricted by a selection set in the normal way.  No third argument is
-required.`)
-}
+For a 'move', a third argument must be a singleton selection set. For
+a 'rename', the third argument may be any token that can be interpreted
+as a valid reset name (but not the name of an existing
+reset). For a 'delete', no third argument is required.
 
-func branchNameMatches(name string, regex *regexp.Regexp) bool {
-	return strings.HasPrefix(name, "refs/heads/") && regex.MatchString(name[11:])
-}
+Reset names may use backslash escapes interpreted by the Go
+string-escape codec, such as \s.
 
-func tagNameMatches(name string, regex *regexp.Regexp) bool {
-	return strings.HasPrefix(name, "refs/tags/") && regex.MatchString(name[10:])
+An argument matches a reset's name if it is either the entire
+reference (refs/heads/FOO or refs/tags/FOO for some some value of FOO)
+or the basename (e.g. FOO), or a suffix of the form heads/FOO or tags/FOO.
+An unqualified basename is assumed to refer to a head.
+
+When a reset is renamed, commit branch fields matching the tag are
+renamed with it to match.  When a reset is deleted, matching branch
+fields are changed to match the branch of the unique descendant of the
+tip commit of the associated branch, if there is one.  When a reset is
+moved, no branch fields are changed.
+`)
 }
 
-// DoBranch renames a branch or deletes it.
-func (rs *Reposurgeon) DoBranch(line string) bool {
+// DoReset moves a reset to point to a specified commit, or renames it, or deletes it.
+func (rs *Reposurgeon) DoReset(line string) bool {
 	if rs.chosen() == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
 	repo := rs.chosen()
-	branchname, line := popToken(line)
+	var resetname string
 	var err error
-	branchname, err = stringEscape(branchname)
+	resetname, line = popToken(line)
+	resetname, err = stringEscape(resetname)
 	if err != nil {
-		croak("while selecting branch: %v", err)
+		croak("in reset command: %v", err)
 		return false
 	}
+	if !strings.Contains(resetname, "/") {
+		resetname = "heads/" + resetname
+	}
+	if !strings.HasPrefix(resetname, "refs/") {
+		resetname = "refs/" + resetname
+	}
+	resets := make([]*Reset, 0)
+	selection := rs.selection
+	if selection == nil {
+		selection = rs.repo.all()
+	}
+	for _, ei := range selection {
+		reset, ok := repo.events[ei].(*Reset)
+		if ok && reset.ref == resetname {
+			resets = append(resets, reset)
+		}
+	}
 	var verb string
 	verb, line = popToken(line)
-	if verb == "rename" {
-		if !strings.Contains(branchname, "/") {
-			branchname = "refs/heads/" + branchname
+	if verb == "create" {
+		var target *Commit
+		var ok bool
+		if len(resets) > 0 {
+			croak("one or more resets match %s", resetname)
+			return false
+		}
+		if len(rs.selection) != 1 {
+			croak("reset create requires a singleton commit set.")
+			return false
+		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
+			croak("create target is not a commit.")
+			return false
+		}
+		reset := newReset(repo, resetname, target.mark, target.legacyID)
+		repo.addEvent(reset)
+		repo.declareSequenceMutation("reset create")
+	} else if verb == "move" {
+		var reset *Reset
+		var target *Commit
+		var ok bool
+		if len(resets) == 0 {
+			croak("no such reset as %s", resetname)
 		}
-		if !repo.branchset().Contains(branchname) {
-			croak("no such branch as %s", branchname)
+		if len(resets) == 1 {
+			reset = resets[0]
+		} else {
+			croak("can't move multiple resets")
+			return false
+		}
+		rs.setSelectionSet(line)
+		if len(rs.selection) != 1 {
+			croak("reset move requires a singleton commit set.")
+			return false
+		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
+			croak("move target is not a commit.")
 			return false
 		}
+		reset.forget()
+		reset.remember(repo, target.mark)
+		repo.declareSequenceMutation("reset move")
+	} else if verb == "rename" {
 		var newname string
+		if len(resets) == 0 {
+			croak("no such reset as %s", resetname)
+			return false
+		}
 		newname, line = popToken(line)
 		if newname == "" {
-			croak("new branch name must be nonempty.")
+			croak("new reset name must be nonempty.")
 			return false
 		}
-		if !strings.Contains(newname, "/") {
-			newname = "refs/heads/" + newname
-		}
-		if repo.branchset().Contains(newname) {
-			croak("there is already a branch named '%s'.", newname)
-			return false
+		if strings.Count(newname, "/") == 0 {
+			newname = "heads/" + newname
 		}
-		for _, event := range repo.events {
-			if commit, ok := event.(*Commit); ok {
-				if commit.Branch == branchname {
-					commit.setBranch(newname)
-				}
-			} else if reset, ok := event.(*Reset); ok {
-				if reset.ref == branchname {
-					reset.ref = newname
-				}
-			}
+		if !strings.HasPrefix(newname, "refs/") {
+			newname = "refs/" + newname
 		}
-	} else if verb == "delete" {
 		selection := rs.selection
 		if selection == nil {
 			selection = repo.all()
 		}
-		var shouldDelete func(string) bool
-		if branchname[0] == '/' && branchname[len(branchname)-1] == '/' {
-			// Regexp - can refer to a list of branchs matched
-			branchre, err := regexp.Compile(branchname[1 : len(branchname)-1])
-			if err != nil {
-				croak("in branch command: %v", err)
+		for _, ei := range selection {
+			reset, ok := repo.events[ei].(*Reset)
+			if ok && reset.ref == newname {
+				croak("reset reference collision, not renaming.")
 				return false
 			}
-			shouldDelete = func(branch string) bool {
-				return branchNameMatches(branch, branchre)
-			}
-		} else {
-			theref := "refs/heads/" + branchname
-			if !repo.branchset().Contains(theref) {
-				croak("no such branch as %s", branchname)
+		}
+		for _, commit := range repo.commits(nil) {
+			if commit.Branch == newname {
+				croak("commit branch collision, not renaming.")
 				return false
 			}
-			shouldDelete = func(branch string) bool {
-				return branch == theref
+		}
+
+		for _, reset := range resets {
+			reset.ref = newname
+		}
+		for _, commit := range repo.commits(nil) {
+			if commit.Branch == resetname {
+				commit.Branch = newname
 			}
 		}
-		repo.deleteBranch(selection, shouldDelete)
+	} else if verb == "delete" {
+		if len(resets) == 0 {
+			croak("no such reset as %s", resetname)
+			return false
+		}
+		var tip *Commit
+		for _, commit := range repo.commits(nil) {
+			if commit.Branch == resetname {
+				tip = commit
+			}
+		}
+		if tip != nil && len(tip.children()) == 1 {
+			successor := tip.children()[0]
+			if cSuccessor, ok := successor.(*Commit); ok {
+				for _, commit := range repo.commits(nil) {
+					if commit.Branch == resetname {
+						commit.Branch = cSuccessor.Branch
+					}
+				}
+			}
+		}
+		for _, reset := range resets {
+			reset.forget()
+			repo.delete([]int{repo.eventToIndex(reset)}, nil)
+		}
+		repo.declareSequenceMutation("reset delete")
 	} else {
-		croak("unknown verb '%s' in branch command.", verb)
+		croak("unknown verb '%s' in reset command.", verb)
 		return false
 	}
+	repo.dirty = true
 	return false
 }
 
-// HelpTag says "Shut up, golint!"
-func (rs *Reposurgeon) HelpTag() {
+// HelpIgnores says "Shut up, golint!"
+func (rs *Reposurgeon) HelpIgnores() {
 	rs.helpOutput(`
-[SELECTION] tag {TAG-NAME} {create|move|rename|delete} [ARG]
+ignores [--rename] [--translate] [--defaults]
+ignores translate FROM TO
 
-Create, move, rename, or delete a tag.
+Intelligent handling of ignore-pattern files.
 
-Creation is a special case.  First argument is a name, which must not
-be an existing tag. Takes a singleton event second argument which must
-point to a commit.  A tag object pointing to the commit is created and
-inserted just after the last tag in the repo (or just after the last
-commit if there are no tags).  The tagger, committish, and comment
-fields are copied from the commit's committer, mark, and comment
-fields.
+This command fails if no repository has been selected or no preferred write
+type has been set for the repository.  It does not take a selection set.
 
-Otherwise, the first argument must be an existing name referring to a
-tag object, lightweight tag, or reset; second argument must be one of
-the verbs 'move', 'rename', or 'delete'.
+If --rename is present, this command attempts to rename all
+ignore-pattern files to whatever is appropriate for the preferred type
+- e.g. .gitignore for git, .hgignore for hg, etc.  This option does
+not cause any translation of the ignore files it renames.
 
-For a 'move', a third argument must be a singleton selection set. For
-a 'rename', the third argument may be any token that is a
-syntactically valid tag name (but not the name of an existing
-tag).
+If --translate is present, syntax translation of each ignore file is
+attempted. At present, the only transformation the code knows is to
+prepend a 'syntax: glob' header if the preferred type is hg.
 
-For a 'delete', no third argument is required.  The name portion of a
-delete may be a regexp wrapped in //; if so, all objects of the
-specified type with names matching the regexp are deleted.  This is
-useful for mass deletion of junk tags such as CVS branch-root tags.
-Such deletions can be restricted by a selection set in the normal way.
+If --defaults is present, the command attempts to prepend these
+default patterns to all ignore files. If no ignore file is created by
+the first commit, it will be modified to create one containing the
+defaults.  This command will error out on prefer types that have no
+default ignore patterns (git and hg, in particular).  It will also
+error out when it knows the import tool has already set default
+patterns.
 
-Tag names may use backslash escapes interpreted by the Python
-string-escape codec, such as \s.
+The translate form rewrites the ignore files of one version-control
+system as those of another, and renames them to match - e.g. from
+.cvsignore to .gitignore, or back. It needs no preferred type, and
+takes a selection set, defaulting to all commits. FROM and TO may be
+cvs, git, hg, or bzr.
+
+Each pattern is rewritten so that it applies in the same places. A
+.cvsignore pattern matches only in its own directory, so it gets a
+leading slash in a .gitignore; going the other way, only patterns so
+anchored can be expressed in a .cvsignore. Mercurial patterns are
+regular expressions unless a 'syntax: glob' line says otherwise, and
+bzr patterns may be marked 'RE:'; those simple enough to be globs are
+translated. A translated .hgignore begins with 'syntax: glob', and a
+pattern anchored to its directory becomes a 're:' regular expression.
+Patterns with no equivalent in the target dialect, such as negations
+in a .cvsignore, are dropped with a warning. Use "debug ignores" to
+see how single patterns are read.
+`)
+}
 
-The behavior of this command is complex because features which present
-as tags may be any of three things: (1) true tag objects, (2)
-lightweight tags, actually sequences of commits with a common
-branchname beginning with 'refs/tags' - in this case the tag is
-considered to point to the last commit in the sequence, (3) Reset
-objects.  These may occur in combination; in fact, stream exporters
-from systems with annotation tags commonly express each of these as a
-true tag object (1) pointing at the tip commit of a sequence (2) in
-which the basename of the common branch field is identical to the tag
-name.  An exporter that generates lightweight-tagged commit sequences (2)
-may or may not generate resets pointing at their tip commits.
+// DoIgnores manipulates ignore patterns in the repo.
+func (rs *Reposurgeon) DoIgnores(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	repo := rs.chosen()
+	if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "translate" {
+		if len(fields) != 3 {
+			croak("ignores translate requires source and target dialects")
+			return false
+		}
+		for _, dialect := range fields[1:] {
+			if _, ok := ignoreDialects[dialect]; !ok {
+				croak("unknown ignore dialect %q", dialect)
+				return false
+			}
+		}
+		selection := rs.selection
+		if selection == nil {
+			selection = repo.all()
+		}
+		count, warnings, err := repo.translateIgnoreFiles(repo.commits(selection), fields[1], fields[2])
+		if err != nil {
+			croak("%v", err)
+			return false
+		}
+		if logEnable(logWARN) {
+			for _, warning := range warnings {
+				logit("%s", warning)
+			}
+		}
+		if count > 0 {
+			repo.dirty = true
+		}
+		respond("%d ignore files translated (%s -> %s).", count, fields[1], fields[2])
+		return false
+	}
+	if rs.preferred != nil && rs.ignorename == "" {
+		rs.ignorename = rs.preferred.ignorename
+	}
+	if rs.preferred == nil {
+		croak("preferred repository type has not been set")
+		return false
+	}
+	if rs.ignorename == "" {
+		croak("preferred repository type has no declared ignorename")
+		return false
+	}
+	isIgnore := func(blob *Blob) bool {
+		if len(blob.opset) == 0 {
+			return false
+		}
+		for fop := range blob.opset {
+			if !strings.HasSuffix(fop.Path, rs.ignorename) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, verb := range strings.Fields(line) {
+		if verb == "--defaults" {
+			if rs.preferred.styleflags.Contains("import-defaults") {
+				croak("importer already set default ignores")
+				return false
+			} else if len(rs.preferred.dfltignores) == 0 {
+				croak("no default ignores in %s", rs.preferred.name)
+				return false
+			} else {
+				changecount := 0
+				// Modify existing ignore files
+				for _, event := range repo.events {
+					if blob, ok := event.(*Blob); ok && isIgnore(blob) {
+						blob.setContent([]byte(rs.preferred.dfltignores+string(blob.getContent())), -1)
+						changecount++
+					}
+				}
+				// Create an early ignore file if required.
+				// Do not move this before the modification pass!
+				earliest := repo.earliestCommit()
+				hasIgnoreBlob := false
+				for _, fileop := range earliest.operations() {
+					if fileop.op == opM && strings.HasSuffix(fileop.Path, rs.ignorename) {
+						hasIgnoreBlob = true
+					}
+				}
+				if !hasIgnoreBlob {
+					blob := newBlob(repo)
+					blob.setContent([]byte(rs.preferred.dfltignores), noOffset)
+					blob.mark = ":insert"
+					repo.insertEvent(blob, repo.eventToIndex(earliest), "ignore-blob creation")
+					repo.declareSequenceMutation("ignore creation")
+					newop := newFileOp(rs.chosen())
+					newop.construct(opM, "100644", ":insert", rs.ignorename)
+					earliest.appendOperation(newop)
+					repo.renumber(1, nil)
+					respond(fmt.Sprintf("initial %s created.", rs.ignorename))
+				}
+				repo.dirty = true
+				respond(fmt.Sprintf("%d %s blobs modified.", changecount, rs.ignorename))
+			}
+		} else if verb == "--rename" {
+			changecount := 0
+			for _, commit := range repo.commits(nil) {
+				for idx, fileop := range commit.operations() {
+					for _, attr := range []string{"Path", "Source", "Target"} {
+						oldpath, ok := getAttr(fileop, attr)
+						if ok {
+							if ok && strings.HasSuffix(oldpath, rs.ignorename) {
+								newpath := filepath.Join(filepath.Dir(oldpath),
+									rs.preferred.ignorename)
+								setAttr(commit.fileops[idx], attr, newpath)
+								changecount++
+							}
+						}
+					}
+				}
+			}
+			if changecount > 0 {
+				repo.dirty = true
+			}
+			respond("%d ignore files renamed (%s -> %s).",
+				changecount, rs.ignorename, rs.preferred.ignorename)
+			rs.ignorename = rs.preferred.ignorename
+		} else if verb == "--translate" {
+			changecount := 0
+			for _, event := range repo.events {
+				if blob, ok := event.(*Blob); ok && isIgnore(blob) {
+					if rs.preferred.name == "hg" {
+						if !bytes.HasPrefix(blob.getContent(), []byte("syntax: glob\n")) {
+							blob.setContent([]byte("syntax: glob\n"+string(blob.getContent())), noOffset)
+							changecount++
+						}
+					}
+				}
+			}
+			if changecount > 0 {
+				repo.dirty = true
+			}
+			respond(fmt.Sprintf("%d %s blobs modified.", changecount, rs.ignorename))
+		} else {
+			croak("unknown option %s in ignores line", verb)
+			return false
+		}
+	}
+	return false
+}
 
-This command tries to handle all combinations in a natural way by
-doing up to three operations on any true tag, commit sequence, and
-reset matching the source name. In a rename, all are renamed together.
-In a delete, any matching tag or reset is deleted; then matching
-branch fields are changed to match the branch of the unique descendant
-of the tagged commit, if there is one.  When a tag is moved, no branch
-fields are changed and a warning is issued.
+// HelpDebug says "Shut up, golint!"
+func (rs *Reposurgeon) HelpDebug() {
+	rs.helpOutput(`
+debug ignores [DIALECT] [<INFILE] [>OUTFILE]
+
+Show exactly how ignore patterns are translated into .gitignore syntax
+when a repository is read. Patterns are read one per line from
+standard input and reported one per line: the pattern, its
+translation, and why it was translated that way, separated by tabs.
+A pattern with no .gitignore equivalent is reported with a
+translation of '-'. With no dialect, list the known dialects.
+
+Dialects differ in where a pattern applies. svn:ignore and .cvsignore
+(dialect 'cvs') patterns match only in their own directory, and get
+a leading slash; svn:global-ignores patterns and slashless git, hg,
+and bzr patterns match at any depth. A pattern containing a slash is
+anchored in git and bzr, but an hg glob pattern can match below any
+directory and gets a leading '**/'.  The bzr './' prefix becomes a
+leading slash.
 `)
 }
 
-// DoTag moves a tag to point to a specified commit, or renames it, or deletes it.
-func (rs *Reposurgeon) DoTag(line string) bool {
-	if rs.chosen() == nil {
-		croak("no repo has been chosen.")
+// DoDebug reports on reposurgeon's internal translations.
+func (rs *Reposurgeon) DoDebug(line string) bool {
+	parse := rs.newLineParse(line, orderedStringSet{"stdin", "stdout"})
+	defer parse.Closem()
+	fields := strings.Fields(parse.line)
+	if len(fields) == 0 || fields[0] != "ignores" {
+		croak("debug requires the 'ignores' keyword")
 		return false
 	}
-	repo := rs.chosen()
-	// A tag name can refer to one of the following things {
-	// (1) A tag object, by name
-	// (2) A reset object having a name in the tags/ namespace
-	// (3) The tip commit of a branch with branch fields
-	// These things often occur in combination. Notably, git-fast-export
-	// generates for each tag object corresponding branch labels on
-	// some ancestor commits - the rule for where this stops is unclear.
-	var tagname string
-	tagname, line = popToken(line)
-	if len(tagname) == 0 {
-		croak("missing tag name")
+	if len(fields) == 1 {
+		fmt.Fprintln(parse.stdout, strings.Join(ignoreDialectNames(), " "))
 		return false
 	}
-	var err error
-	tagname, err = stringEscape(tagname)
-	if err != nil {
-		croak("in tag command: %v", err)
+	if _, ok := ignoreDialects[fields[1]]; !ok {
+		croak("unknown ignore dialect %q", fields[1])
 		return false
 	}
-	var verb string
-	verb, line = popToken(line)
-	if verb == "create" {
-		var ok bool
-		var target *Commit
-		if repo.named(tagname) != nil {
-			croak("something is already named %s", tagname)
-			return false
-		}
-		rs.setSelectionSet(line)
-		if rs.selection == nil {
-			croak("usage: tag <name> create <singleton-selection>")
-			return false
-		} else if len(rs.selection) != 1 {
-			croak("tag create requires a singleton commit set.")
-			return false
-		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
-			croak("create target is not a commit.")
-			return false
+	scanner := bufio.NewScanner(parse.stdin)
+	for scanner.Scan() {
+		translation, _ := translateIgnore(fields[1], scanner.Text())
+		translated := translation.translated
+		if !translation.ok {
+			translated = "-"
 		}
-		tag := newTag(repo, tagname, target.mark,
-			target.committer.clone(),
-			target.Comment)
-		tag.tagger.date.timestamp = tag.tagger.date.timestamp.Add(time.Second) // So it is unique
-		var lasttag int
-		var lastcommit int
-		for i, event := range repo.events {
-			if _, ok := event.(*Tag); ok {
-				lasttag = i
-			} else if _, ok := event.(*Commit); ok {
-				lastcommit = i
-			}
-			control.baton.twirl()
+		fmt.Fprintf(parse.stdout, "%s\t%s\t%s\n", translation.pattern, translated, translation.reason)
+	}
+	return false
+}
+
+// contentMagic pairs the leading bytes of common binary formats with
+// a description of the format.  Signatures shorter than four bytes
+// are easily matched by accident in text, so sniffContent trusts them
+// only when the content also contains a NUL.
+var contentMagic = []struct {
+	magic  string
+	format string
+}{
+	{"\x89PNG\r\n\x1a\n", "PNG image"},
+	{"\xff\xd8\xff", "JPEG image"},
+	{"GIF87a", "GIF image"},
+	{"GIF89a", "GIF image"},
+	{"II*\x00", "TIFF image"},
+	{"MM\x00*", "TIFF image"},
+	{"BM", "BMP image"},
+	{"\x00\x00\x01\x00", "Windows icon"},
+	{"%PDF-", "PDF document"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "OLE2 compound document"},
+	{"PK\x03\x04", "zip archive"},
+	{"\x1f\x8b", "gzip archive"},
+	{"BZh", "bzip2 archive"},
+	{"\xfd7zXZ\x00", "xz archive"},
+	{"7z\xbc\xaf\x27\x1c", "7-zip archive"},
+	{"\x7fELF", "ELF executable"},
+	{"MZ", "Windows executable"},
+	{"\xca\xfe\xba\xbe", "Java class file"},
+	{"SQLite format 3\x00", "SQLite database"},
+	{"ID3", "MP3 audio"},
+	{"OggS", "Ogg media"},
+	{"RIFF", "RIFF media"},
+	{"wOFF", "WOFF font"},
+	{"\x00\x01\x00\x00", "TrueType font"},
+}
+
+// Formats sniffContent reports for UTF-16 text with a byte-order mark
+const (
+	formatUTF16LE = "UTF-16LE text"
+	formatUTF16BE = "UTF-16BE text"
+)
+
+// sniffLength is how much of the content sniffContent looks at when
+// checking for NULs; it matches the heuristic git itself uses.
+const sniffLength = 8000
+
+// decodeUTF16 turns UTF-16 text with a byte-order mark into UTF-8
+// without one.  The boolean is false if the content does not
+// round-trip, in which case it is not really UTF-16 text.
+func decodeUTF16(content []byte, bigEndian bool) ([]byte, bool) {
+	if len(content)%2 != 0 {
+		return nil, false
+	}
+	units := make([]uint16, 0, len(content)/2-1)
+	for i := 2; i < len(content); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(content[i])<<8|uint16(content[i+1]))
+		} else {
+			units = append(units, uint16(content[i+1])<<8|uint16(content[i]))
 		}
-		if lasttag == 0 {
-			lasttag = lastcommit
+	}
+	runes := utf16.Decode(units)
+	for i, unit := range utf16.Encode(runes) {
+		if unit != units[i] {
+			return nil, false
 		}
-		repo.insertEvent(tag, lasttag+1, "tag creation")
-		control.baton.twirl()
-		return false
 	}
-	tags := make([]*Tag, 0)
-	resets := make([]*Reset, 0)
-	commits := make([]*Commit, 0)
-	var refMatches func(string) bool
-	if tagname[0] == '/' && tagname[len(tagname)-1] == '/' {
-		// Regexp - can refer to a list of tags matched
-		tagre, err := regexp.Compile(tagname[1 : len(tagname)-1])
-		if err != nil {
-			croak("in tag command: %v", err)
-			return false
+	return []byte(string(runes)), true
+}
+
+// sniffContent classifies content by its leading bytes.  It returns
+// "" for text, formatUTF16LE or formatUTF16BE for UTF-16 text with a
+// byte-order mark, and otherwise a description of the binary format.
+func sniffContent(content []byte) string {
+	head := content
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	if bytes.HasPrefix(head, []byte("\xff\xfe")) && !bytes.HasPrefix(head, []byte("\xff\xfe\x00\x00")) {
+		if _, ok := decodeUTF16(content, false); ok {
+			return formatUTF16LE
 		}
-		refMatches = func(branch string) bool {
-			return tagNameMatches(branch, tagre)
+	} else if bytes.HasPrefix(head, []byte("\xfe\xff")) {
+		if _, ok := decodeUTF16(content, true); ok {
+			return formatUTF16BE
 		}
-	} else {
-		// Non-regexp - can only refer to a single tag
-		fulltagname := branchname(tagname)
-		refMatches = func(branch string) bool {
-			return branch == fulltagname
+	}
+	hasNUL := bytes.IndexByte(head, 0) != -1
+	for _, entry := range contentMagic {
+		if bytes.HasPrefix(head, []byte(entry.magic)) && (len(entry.magic) >= 4 || hasNUL) {
+			return entry.format
 		}
 	}
-	selection := rs.selection
-	if selection == nil {
-		selection = repo.all()
+	if hasNUL {
+		return "binary data"
 	}
-	for _, idx := range selection {
-		event := repo.events[idx]
-		if tag, ok := event.(*Tag); ok && refMatches(tag.name) {
-			tags = append(tags, tag)
-		} else if reset, ok := event.(*Reset); ok && refMatches(reset.ref) {
-			resets = append(resets, reset)
-		} else if commit, ok := event.(*Commit); ok && refMatches(commit.Branch) {
-			commits = append(commits, commit)
+	return ""
+}
+
+// contentAttributes returns the gitattributes settings appropriate
+// to a format reported by sniffContent.
+func contentAttributes(format string) string {
+	switch format {
+	case "":
+		return ""
+	case formatUTF16LE:
+		return "text working-tree-encoding=UTF-16LE-BOM"
+	case formatUTF16BE:
+		return "text working-tree-encoding=UTF-16"
+	default:
+		return "-diff -merge -text"
+	}
+}
+
+// attributesPattern quotes a repository path as a .gitattributes
+// pattern matching only that path.
+func attributesPattern(pathname string) string {
+	var sb strings.Builder
+	sb.WriteByte('/')
+	for _, c := range pathname {
+		if strings.ContainsRune(`\*?[`, c) {
+			sb.WriteByte('\\')
 		}
-		control.baton.twirl()
+		sb.WriteRune(c)
 	}
-	if len(tags) == 0 && len(resets) == 0 && len(commits) == 0 {
-		croak("no tags matching %s", tagname)
-		return false
+	if strings.ContainsAny(pathname, " \t\"") {
+		return strconv.Quote(sb.String())
 	}
-	if verb == "move" {
-		var target *Commit
-		var ok bool
-		rs.setSelectionSet(line)
-		if len(rs.selection) != 1 {
-			croak("tag move requires a singleton commit set.")
-			return false
-		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
-			croak("move target is not a commit.")
+	return sb.String()
+}
+
+// addAttributes adds lines to every .gitattributes file at the top of
+// the tree, and creates a .gitattributes file holding them at each root
+// commit (one with no parents or that begins with a deleteall) that
+// lacks one. It returns the numbers of files created and modified.
+func (repo *Repository) addAttributes(lines []string) (int, int) {
+	isAttributes := func(blob *Blob) bool {
+		if len(blob.opset) == 0 {
 			return false
 		}
-		if len(tags) > 0 {
-			for _, tag := range tags {
-				tag.forget()
-				tag.remember(repo, target.mark)
-				control.baton.twirl()
-			}
-		}
-		if len(resets) > 0 {
-			if len(resets) == 1 {
-				resets[0].committish = target.mark
-			} else {
-				croak("cannot move multiple tags.")
+		for fileop := range blob.opset {
+			if fileop.Path != ".gitattributes" {
+				return false
 			}
-			control.baton.twirl()
-		}
-		if len(commits) > 0 {
-			// Delete everything only reachable from the old tag position,
-			// and change the Branch of every commit that happened on that
-			// old tag but is still reachable from elsewhere.
-			repo.deleteBranch(selection, refMatches)
 		}
-	} else if verb == "rename" {
-		if len(tags) > 1 {
-			croak("exactly one tag is required for rename")
-			return false
+		return true
+	}
+	merge := func(content []byte) []byte {
+		present := make(map[string]bool)
+		for _, text := range strings.Split(string(content), "\n") {
+			present[text] = true
 		}
-		var newname string
-		newname, line = popToken(line)
-		if newname == "" {
-			croak("new tag name must be nonempty.")
-			return false
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			content = append(content, '\n')
 		}
-		if len(tags) == 1 {
-			for _, event := range repo.events {
-				if tag, ok := event.(*Tag); ok && tag != tags[0] && tag.name == tags[0].name {
-					croak("tag name collision, not renaming.")
-					return false
-				}
+		for _, text := range lines {
+			if !present[text] {
+				content = append(content, []byte(text+"\n")...)
 			}
-			tags[0].setHumanName(newname)
-
-			control.baton.twirl()
-		}
-		fullnewname := branchname(newname)
-		for _, reset := range resets {
-			reset.ref = fullnewname
-		}
-		for _, event := range commits {
-			event.Branch = fullnewname
-		}
-	} else if verb == "delete" {
-		for _, tag := range tags {
-			// the order here in important
-			repo.delete([]int{tag.index()}, nil)
-			tag.forget()
-			control.baton.twirl()
-		}
-		if len(tags) > 0 {
-			repo.declareSequenceMutation("tag deletion")
-		}
-		for _, reset := range resets {
-			reset.forget()
-			repo.delete([]int{repo.eventToIndex(reset)}, nil)
 		}
-		if len(resets) > 0 {
-			repo.declareSequenceMutation("reset deletion")
-		}
-		if len(commits) > 0 {
-			repo.deleteBranch(selection, refMatches)
+		return content
+	}
+	modified := 0
+	for _, event := range repo.events {
+		if blob, ok := event.(*Blob); ok && isAttributes(blob) {
+			blob.setContent(merge(blob.getContent()), noOffset)
+			modified++
 		}
-	} else {
-		croak("unknown verb '%s' in tag command.", verb)
-		return false
 	}
-	return false
-}
-
-// HelpReset says "Shut up, golint!"
-func (rs *Reposurgeon) HelpReset() {
-	rs.helpOutput(`
-[SELECTION] reset {RESET-NAME} {create|move|rename|delete} [ARG]
-
-Create, move, rename, or delete a reset. Create is a special case; it
-requires a singleton selection which is the associated commit for the
-reset, takes as a first argument the name of the reset (which must not
-exist), and ends with the keyword create.
-
-In the other modes, the first argument must match an existing reset
-name with the selection; second argument must be one of the verbs
-'move', 'rename', or 'delete'. The default selection is all events.
-
-For a 'move', a third argument must be a singleton selection set. For
-a 'rename', the third argument may be any token that can be interpreted
-as a valid reset name (but not the name of an existing
-reset). For a 'delete', no third argument is required.
-
-Reset names may use backslash escapes interpreted by the Go
-string-escape codec, such as \s.
-
-An argument matches a reset's name if it is either the entire
-reference (refs/heads/FOO or refs/tags/FOO for some some value of FOO)
-or the basename (e.g. FOO), or a suffix of the form heads/FOO or tags/FOO.
-An unqualified basename is assumed to refer to a head.
+	// Create a .gitattributes at each root commit lacking one.  They
+	// can all share a single blob.
+	var shared *Blob
+	created := 0
+	for _, commit := range repo.commits(nil) {
+		ops := commit.operations()
+		if commit.hasParents() && !(len(ops) > 0 && ops[0].op == deleteall) {
+			continue
+		}
+		hasAttributes := false
+		for _, fileop := range ops {
+			if fileop.op == opM && fileop.Path == ".gitattributes" {
+				hasAttributes = true
+			}
+		}
+		if hasAttributes {
+			continue
+		}
+		if shared == nil {
+			shared = newBlob(repo)
+			shared.setContent(merge(nil), noOffset)
+			shared.setMark(repo.newmark())
+			repo.insertEvent(shared, repo.eventToIndex(commit), "gitattributes creation")
+		}
+		newop := newFileOp(repo)
+		newop.construct(opM, "100644", shared.mark, ".gitattributes")
+		commit.appendOperation(newop)
+		created++
+	}
+	return created, modified
+}
 
-When a reset is renamed, commit branch fields matching the tag are
-renamed with it to match.  When a reset is deleted, matching branch
-fields are changed to match the branch of the unique descendant of the
-tip commit of the associated branch, if there is one.  When a reset is
-moved, no branch fields are changed.
+// HelpGitattributes says "Shut up, golint!"
+func (rs *Reposurgeon) HelpGitattributes() {
+	rs.helpOutput(`
+[SELECTION] gitattributes [--list] [>OUTFILE]
+
+Sniff the content of the files modified by commits in the selection
+set (defaulting to all commits) and generate .gitattributes entries
+for the binary formats found, so that git in the converted repository
+neither diffs nor merges them.  Formats are recognized by their magic
+numbers; content with a NUL in its first 8000 bytes that matches no
+known format is treated as generic binary data.
+
+Text in UTF-16 with a byte-order mark is transcoded to UTF-8, and
+given a working-tree-encoding attribute that makes git check it out
+in its original encoding.
+
+Paths are grouped into an extension pattern such as '*.png' when every
+file with that extension gets the same attributes; otherwise each
+path gets its own anchored entry.  Paths that hold text in some
+revisions and binary content in others get no entry.
+
+The entries are added to every .gitattributes file at the top of the
+tree, and a .gitattributes file is created at each root commit (one
+with no parents or that begins with a deleteall) that lacks one.
+With --list, the entries are reported and the repository is not
+modified.  Supports > redirection.
 `)
 }
 
-// DoReset moves a reset to point to a specified commit, or renames it, or deletes it.
-func (rs *Reposurgeon) DoReset(line string) bool {
-	if rs.chosen() == nil {
+// DoGitattributes generates .gitattributes entries from file content.
+func (rs *Reposurgeon) DoGitattributes(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
 		croak("no repo has been chosen.")
 		return false
 	}
-	repo := rs.chosen()
-	var resetname string
-	var err error
-	resetname, line = popToken(line)
-	resetname, err = stringEscape(resetname)
-	if err != nil {
-		croak("in reset command: %v", err)
-		return false
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
 	}
-	if !strings.Contains(resetname, "/") {
-		resetname = "heads/" + resetname
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	for _, option := range parse.options {
+		if option != "--list" {
+			croak("unknown option %s in gitattributes line", option)
+			return false
+		}
 	}
-	if !strings.HasPrefix(resetname, "refs/") {
-		resetname = "refs/" + resetname
+	// Classify every blob and inline modification in the selection,
+	// collecting the formats seen at each path.
+	sniffed := make(map[*Blob]string)
+	pathFormats := make(map[string]map[string]bool)
+	var inlines []*FileOp
+	control.baton.startProgress("sniffing content", uint64(len(selection)))
+	for i, ei := range selection {
+		commit, ok := repo.events[ei].(*Commit)
+		if !ok {
+			continue
+		}
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || fileop.mode == "160000" || fileop.mode == "120000" {
+				continue
+			}
+			var format string
+			if fileop.ref == "inline" {
+				format = sniffContent(fileop.inline)
+				inlines = append(inlines, fileop)
+			} else if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+				if f, seen := sniffed[blob]; seen {
+					format = f
+				} else {
+					format = sniffContent(blob.getContent())
+					sniffed[blob] = format
+				}
+			} else {
+				continue
+			}
+			if pathFormats[fileop.Path] == nil {
+				pathFormats[fileop.Path] = make(map[string]bool)
+			}
+			pathFormats[fileop.Path][format] = true
+		}
+		control.baton.percentProgress(uint64(i) + 1)
 	}
-	resets := make([]*Reset, 0)
-	selection := rs.selection
-	if selection == nil {
-		selection = rs.repo.all()
+	control.baton.endProgress()
+	// Settle on one format per path.  Paths of mixed binary formats
+	// are just binary data; paths mixing binary content with text
+	// are left alone.
+	pathFormat := make(map[string]string, len(pathFormats))
+	pathnames := make([]string, 0, len(pathFormats))
+	for pathname := range pathFormats {
+		pathnames = append(pathnames, pathname)
+	}
+	sort.Strings(pathnames)
+	for _, pathname := range pathnames {
+		formats := pathFormats[pathname]
+		if len(formats) == 1 {
+			for format := range formats {
+				pathFormat[pathname] = format
+			}
+		} else if formats[""] || formats[formatUTF16LE] || formats[formatUTF16BE] {
+			if logEnable(logWARN) {
+				logit("%s holds both text and binary content; no attributes generated", pathname)
+			}
+			pathFormat[pathname] = ""
+		} else {
+			pathFormat[pathname] = "binary data"
+		}
 	}
-	for _, ei := range selection {
-		reset, ok := repo.events[ei].(*Reset)
-		if ok && reset.ref == resetname {
-			resets = append(resets, reset)
+	// Transcoding UTF-16 content is only safe if every path the
+	// content appears at gets the working-tree-encoding attribute.
+	isUTF16 := func(format string) bool {
+		return format == formatUTF16LE || format == formatUTF16BE
+	}
+	for blob, format := range sniffed {
+		if !isUTF16(format) {
+			continue
+		}
+		for fileop := range blob.opset {
+			if pathFormat[fileop.Path] != format {
+				for other := range blob.opset {
+					if pathFormat[other.Path] == format {
+						pathFormat[other.Path] = ""
+					}
+				}
+				break
+			}
 		}
 	}
-	var verb string
-	verb, line = popToken(line)
-	if verb == "create" {
-		var target *Commit
-		var ok bool
-		if len(resets) > 0 {
-			croak("one or more resets match %s", resetname)
-			return false
+	// Group paths by extension where all the paths with an extension
+	// agree, and build the entries.
+	type attrEntry struct {
+		format  string
+		pattern string
+	}
+	extFormat := make(map[string]string)
+	extUsable := make(map[string]bool)
+	for pathname, format := range pathFormat {
+		ext := path.Ext(pathname)
+		if ext == "" || ext == path.Base(pathname) || strings.ContainsAny(ext, " \t\"\\*?[") {
+			continue
 		}
-		if len(rs.selection) != 1 {
-			croak("reset create requires a singleton commit set.")
-			return false
-		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
-			croak("create target is not a commit.")
-			return false
+		if prev, ok := extFormat[ext]; !ok {
+			extFormat[ext] = format
+			extUsable[ext] = format != ""
+		} else if contentAttributes(prev) != contentAttributes(format) {
+			extUsable[ext] = false
+		} else if prev != format {
+			extFormat[ext] = "binary data"
 		}
-		reset := newReset(repo, resetname, target.mark, target.legacyID)
-		repo.addEvent(reset)
-		repo.declareSequenceMutation("reset create")
-	} else if verb == "move" {
-		var reset *Reset
-		var target *Commit
-		var ok bool
-		if len(resets) == 0 {
-			croak("no such reset as %s", resetname)
+	}
+	var entries []attrEntry
+	for ext, usable := range extUsable {
+		if usable {
+			entries = append(entries, attrEntry{extFormat[ext], "*" + ext})
 		}
-		if len(resets) == 1 {
-			reset = resets[0]
-		} else {
-			croak("can't move multiple resets")
-			return false
+	}
+	for pathname, format := range pathFormat {
+		if format != "" && !extUsable[path.Ext(pathname)] {
+			entries = append(entries, attrEntry{format, attributesPattern(pathname)})
 		}
-		rs.setSelectionSet(line)
-		if len(rs.selection) != 1 {
-			croak("reset move requires a singleton commit set.")
-			return false
-		} else if target, ok = repo.events[rs.selection[0]].(*Commit); !ok {
-			croak("move target is not a commit.")
-			return false
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].format < entries[j].format ||
+			(entries[i].format == entries[j].format && entries[i].pattern < entries[j].pattern)
+	})
+	var lines []string
+	for i, entry := range entries {
+		if i == 0 || entry.format != entries[i-1].format {
+			lines = append(lines, "# "+entry.format)
 		}
-		reset.forget()
-		reset.remember(repo, target.mark)
-		repo.declareSequenceMutation("reset move")
-	} else if verb == "rename" {
-		var newname string
-		if len(resets) == 0 {
-			croak("no such reset as %s", resetname)
-			return false
+		lines = append(lines, entry.pattern+" "+contentAttributes(entry.format))
+	}
+	if parse.options.Contains("--list") {
+		for _, text := range lines {
+			fmt.Fprintln(parse.stdout, text)
 		}
-		newname, line = popToken(line)
-		if newname == "" {
-			croak("new reset name must be nonempty.")
-			return false
+		return false
+	}
+	if len(entries) == 0 {
+		respond("no binary content found.")
+		return false
+	}
+	// Transcode UTF-16 content that kept its attribute.
+	transcoded := 0
+	for blob, format := range sniffed {
+		if !isUTF16(format) || len(blob.opset) == 0 {
+			continue
 		}
-		if strings.Count(newname, "/") == 0 {
-			newname = "heads/" + newname
+		var fileop *FileOp
+		for fileop = range blob.opset {
+			break
 		}
-		if !strings.HasPrefix(newname, "refs/") {
-			newname = "refs/" + newname
+		if pathFormat[fileop.Path] == format {
+			text, _ := decodeUTF16(blob.getContent(), format == formatUTF16BE)
+			blob.setContent(text, noOffset)
+			transcoded++
 		}
-		selection := rs.selection
-		if selection == nil {
-			selection = repo.all()
+	}
+	for _, fileop := range inlines {
+		if format := pathFormat[fileop.Path]; isUTF16(format) && sniffContent(fileop.inline) == format {
+			fileop.inline, _ = decodeUTF16(fileop.inline, format == formatUTF16BE)
+			transcoded++
 		}
-		for _, ei := range selection {
-			reset, ok := repo.events[ei].(*Reset)
-			if ok && reset.ref == newname {
-				croak("reset reference collision, not renaming.")
-				return false
+	}
+	created, modified := repo.addAttributes(lines)
+	repo.dirty = true
+	respond("%d entries; %d .gitattributes created, %d modified; %d files transcoded.",
+		len(entries), created, modified, transcoded)
+	return false
+}
+
+// contentClass classifies content for the binaries report: binary
+// content by its sniffed format, text by the name of its probable
+// character encoding, as transcode accepts it.  The boolean is true
+// for binary content.
+func contentClass(content []byte) (string, bool) {
+	var guess string
+	switch format := sniffContent(content); format {
+	case "":
+		guess = "US-ASCII"
+		for _, c := range content {
+			if c >= 0x80 {
+				guess = guessEncoding(string(content))
+				break
 			}
 		}
-		for _, commit := range repo.commits(nil) {
-			if commit.Branch == newname {
-				croak("commit branch collision, not renaming.")
+	case formatUTF16LE:
+		guess = "UTF-16LE"
+	case formatUTF16BE:
+		guess = "UTF-16BE"
+	default:
+		return format, true
+	}
+	if enc, err := ianaindex.IANA.Encoding(guess); err == nil && enc != nil {
+		if name, err := ianaindex.MIME.Name(enc); err == nil {
+			guess = name
+		}
+	}
+	return guess, false
+}
+
+// HelpBinaries says "Shut up, golint!"
+func (rs *Reposurgeon) HelpBinaries() {
+	rs.helpOutput(`
+[SELECTION] binaries [--top=N] [>OUTFILE]
+
+Audit the content of the files modified by commits in the selection
+set (defaulting to all commits), as a guide to choosing between LFS
+migration, expunging, and leaving things alone.  Each distinct blob is
+counted once; inline content counts once per fileop.
+
+The report has three parts.  The first gives the number of blobs and
+bytes in each class of content: binary content by the format its
+magic number shows, as the gitattributes command sniffs it, and text
+by a guess at its character encoding.  Encodings are named as the
+transcode command accepts them; "mixed" means text with both UTF-8
+sequences and bytes that cannot be UTF-8.
+
+The second part lists each path that holds binary content in some
+revision, largest binary total first, with the numbers of text and
+binary revisions and the binary bytes.  The third lists the N largest
+binary blobs (10 unless --top says otherwise) with their sizes,
+marks, formats, and paths.  Supports > redirection.
+`)
+}
+
+// DoBinaries reports on text and binary content.
+func (rs *Reposurgeon) DoBinaries(line string) bool {
+	repo := rs.chosen()
+	if repo == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	top := 10
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--top=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(option, "--top="))
+			if err != nil || n < 0 {
+				croak("--top needs a count")
 				return false
 			}
+			top = n
+		} else {
+			croak("unknown option %s in binaries line", option)
+			return false
 		}
-
-		for _, reset := range resets {
-			reset.ref = newname
+	}
+	type classTotal struct {
+		count int
+		bytes int64
+	}
+	type pathTotal struct {
+		text   int
+		binary int
+		bytes  int64
+	}
+	type bigBlob struct {
+		mark   string
+		size   int64
+		format string
+	}
+	classes := make(map[string]*classTotal)
+	paths := make(map[string]*pathTotal)
+	type blobClass struct {
+		class  string
+		binary bool
+	}
+	classified := make(map[*Blob]blobClass)
+	var binaries []*bigBlob
+	tally := func(class string, binary bool, size int64) {
+		key := "text\t" + class
+		if binary {
+			key = "binary\t" + class
 		}
-		for _, commit := range repo.commits(nil) {
-			if commit.Branch == resetname {
-				commit.Branch = newname
-			}
+		if classes[key] == nil {
+			classes[key] = new(classTotal)
 		}
-	} else if verb == "delete" {
-		if len(resets) == 0 {
-			croak("no such reset as %s", resetname)
-			return false
+		classes[key].count++
+		classes[key].bytes += size
+	}
+	control.baton.startProgress("classifying content", uint64(len(selection)))
+	for i, ei := range selection {
+		control.baton.percentProgress(uint64(i))
+		commit, ok := repo.events[ei].(*Commit)
+		if !ok {
+			continue
 		}
-		var tip *Commit
-		for _, commit := range repo.commits(nil) {
-			if commit.Branch == resetname {
-				tip = commit
+		for _, fileop := range commit.operations() {
+			if fileop.op != opM || fileop.mode == "160000" || fileop.mode == "120000" {
+				continue
 			}
-		}
-		if tip != nil && len(tip.children()) == 1 {
-			successor := tip.children()[0]
-			if cSuccessor, ok := successor.(*Commit); ok {
-				for _, commit := range repo.commits(nil) {
-					if commit.Branch == resetname {
-						commit.Branch = cSuccessor.Branch
+			var class string
+			var binary bool
+			var size int64
+			if fileop.ref == "inline" {
+				size = int64(len(fileop.inline))
+				class, binary = contentClass(fileop.inline)
+				tally(class, binary, size)
+			} else if blob, ok := repo.markToEvent(fileop.ref).(*Blob); ok {
+				size = blob.size
+				if c, seen := classified[blob]; seen {
+					class, binary = c.class, c.binary
+				} else {
+					class, binary = contentClass(blob.getContent())
+					classified[blob] = blobClass{class, binary}
+					tally(class, binary, size)
+					if binary {
+						binaries = append(binaries, &bigBlob{blob.mark, size, class})
 					}
 				}
+			} else {
+				continue
+			}
+			if paths[fileop.Path] == nil {
+				paths[fileop.Path] = new(pathTotal)
+			}
+			if binary {
+				paths[fileop.Path].binary++
+				paths[fileop.Path].bytes += size
+			} else {
+				paths[fileop.Path].text++
 			}
 		}
-		for _, reset := range resets {
-			reset.forget()
-			repo.delete([]int{repo.eventToIndex(reset)}, nil)
+	}
+	control.baton.endProgress()
+	keys := make([]string, 0, len(classes))
+	for key := range classes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(parse.stdout, "%s\t%d\t%d\n", key, classes[key].count, classes[key].bytes)
+	}
+	var binaryPaths []string
+	for pathname, total := range paths {
+		if total.binary > 0 {
+			binaryPaths = append(binaryPaths, pathname)
 		}
-		repo.declareSequenceMutation("reset delete")
-	} else {
-		croak("unknown verb '%s' in reset command.", verb)
+	}
+	sort.Slice(binaryPaths, func(i, j int) bool {
+		a, b := paths[binaryPaths[i]], paths[binaryPaths[j]]
+		return a.bytes > b.bytes || (a.bytes == b.bytes && binaryPaths[i] < binaryPaths[j])
+	})
+	if len(binaryPaths) > 0 {
+		fmt.Fprintln(parse.stdout)
+	}
+	for _, pathname := range binaryPaths {
+		total := paths[pathname]
+		fmt.Fprintf(parse.stdout, "%s\t%d\t%d\t%d\n", pathname, total.text, total.binary, total.bytes)
+	}
+	sort.SliceStable(binaries, func(i, j int) bool {
+		return binaries[i].size > binaries[j].size
+	})
+	if len(binaries) > top {
+		binaries = binaries[:top]
+	}
+	if len(binaries) > 0 {
+		fmt.Fprintln(parse.stdout)
+	}
+	for _, big := range binaries {
+		blob := repo.markToEvent(big.mark).(*Blob)
+		fmt.Fprintf(parse.stdout, "%d\t%s\t%s\t%s\n", big.size, big.mark, big.format, strings.Join(blob.paths(nil), " "))
 	}
 	return false
 }
 
-// HelpIgnores says "Shut up, golint!"
-func (rs *Reposurgeon) HelpIgnores() {
-	rs.helpOutput(`
-ignores [--rename] [--translate] [--defaults]
-
-Intelligent handling of ignore-pattern files.
-
-This command fails if no repository has been selected or no preferred write
-type has been set for the repository.  It does not take a selection set.
-
-If --rename is present, this command attempts to rename all
-ignore-pattern files to whatever is appropriate for the preferred type
-- e.g. .gitignore for git, .hgignore for hg, etc.  This option does
-not cause any translation of the ignore files it renames.
-
-If --translate is present, syntax translation of each ignore file is
-attempted. At present, the only transformation the code knows is to
-prepend a 'syntax: glob' header if the preferred type is hg.
-
-If --defaults is present, the command attempts to prepend these
-default patterns to all ignore files. If no ignore file is created by
-the first commit, it will be modified to create one containing the
-defaults.  This command will error out on prefer types that have no
-default ignore patterns (git and hg, in particular).  It will also
-error out when it knows the import tool has already set default
-patterns.
+// HelpLfs says "Shut up, golint!"
+func (rs *Reposurgeon) HelpLfs() {
+	rs.helpOutput(`
+[SELECTION] lfs migrate [--size=N] [--objects=DIR] [PATTERN...]
+
+Convert large files to Git LFS.  The files modified by commits in the
+selection set (defaulting to all commits) whose paths match one of the
+PATTERNs, or that are at least N bytes long, have their content
+replaced by LFS pointer files.  N may end in k, m, or g to multiply it
+by 1024, 1024 squared, or 1024 cubed.  At least one of the criteria is
+required.  Symlinks, gitlinks, and files that are already LFS pointers
+are not touched.
+
+The PATTERNs are shell globs as in .gitattributes: one with no slash
+matches the last component of a path, one with a slash matches the
+whole path from the top of the tree.
+
+The content is written into DIR, by default lfs/objects in the
+current directory, laid out as git lfs lays out .git/lfs/objects;
+copy it there in the rebuilt repository, or push it to an LFS server
+with 'git lfs push --all'.  A blob migrated under some paths but not
+others is split, so only the migrated paths see the pointer.
+
+An entry routing each PATTERN, and each path migrated for its size
+alone, through the lfs filter is added to every .gitattributes file
+at the top of the tree, and a .gitattributes file is created at each
+root commit that lacks one, as the gitattributes command does.
 `)
 }
 
-// DoIgnores manipulates ignore patterns in the repo.
-func (rs *Reposurgeon) DoIgnores(line string) bool {
-	if rs.chosen() == nil {
-		croak("no repo has been chosen.")
-		return false
-	}
+// DoLfs converts large files to Git LFS.
+func (rs *Reposurgeon) DoLfs(line string) bool {
 	repo := rs.chosen()
-	if rs.preferred != nil && rs.ignorename == "" {
-		rs.ignorename = rs.preferred.ignorename
-	}
-	if rs.preferred == nil {
-		croak("preferred repository type has not been set")
+	if repo == nil {
+		croak("no repo has been chosen.")
 		return false
 	}
-	if rs.ignorename == "" {
-		croak("preferred repository type has no declared ignorename")
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	args := parse.Tokens()
+	if len(args) == 0 || args[0] != "migrate" {
+		croak("lfs requires the migrate verb")
 		return false
 	}
-	isIgnore := func(blob *Blob) bool {
-		if len(blob.opset) == 0 {
-			return false
-		}
-		for fop := range blob.opset {
-			if !strings.HasSuffix(fop.Path, rs.ignorename) {
+	patterns := args[1:]
+	var minsize int64
+	objects := filepath.Join("lfs", "objects")
+	for _, option := range parse.options {
+		if strings.HasPrefix(option, "--size=") {
+			var err error
+			if minsize, err = parseByteSize(strings.TrimPrefix(option, "--size=")); err != nil {
+				croak("%v", err)
 				return false
 			}
+		} else if strings.HasPrefix(option, "--objects=") {
+			objects = strings.TrimPrefix(option, "--objects=")
+		} else {
+			croak("unknown option %s in lfs line", option)
+			return false
 		}
-		return true
 	}
-	for _, verb := range strings.Fields(line) {
-		if verb == "--defaults" {
-			if rs.preferred.styleflags.Contains("import-defaults") {
-				croak("importer already set default ignores")
-				return false
-			} else if len(rs.preferred.dfltignores) == 0 {
-				croak("no default ignores in %s", rs.preferred.name)
-				return false
-			} else {
-				changecount := 0
-				// Modify existing ignore files
-				for _, event := range repo.events {
-					if blob, ok := event.(*Blob); ok && isIgnore(blob) {
-						blob.setContent([]byte(rs.preferred.dfltignores+string(blob.getContent())), -1)
-						changecount++
-					}
-				}
-				// Create an early ignore file if required.
-				// Do not move this before the modification pass!
-				earliest := repo.earliestCommit()
-				hasIgnoreBlob := false
-				for _, fileop := range earliest.operations() {
-					if fileop.op == opM && strings.HasSuffix(fileop.Path, rs.ignorename) {
-						hasIgnoreBlob = true
-					}
-				}
-				if !hasIgnoreBlob {
-					blob := newBlob(repo)
-					blob.setContent([]byte(rs.preferred.dfltignores), noOffset)
-					blob.mark = ":insert"
-					repo.insertEvent(blob, repo.eventToIndex(earliest), "ignore-blob creation")
-					repo.declareSequenceMutation("ignore creation")
-					newop := newFileOp(rs.chosen())
-					newop.construct(opM, "100644", ":insert", rs.ignorename)
-					earliest.appendOperation(newop)
-					repo.renumber(1, nil)
-					respond(fmt.Sprintf("initial %s created.", rs.ignorename))
-				}
-				respond(fmt.Sprintf("%d %s blobs modified.", changecount, rs.ignorename))
-			}
-		} else if verb == "--rename" {
-			changecount := 0
-			for _, commit := range repo.commits(nil) {
-				for idx, fileop := range commit.operations() {
-					for _, attr := range []string{"Path", "Source", "Target"} {
-						oldpath, ok := getAttr(fileop, attr)
-						if ok {
-							if ok && strings.HasSuffix(oldpath, rs.ignorename) {
-								newpath := filepath.Join(filepath.Dir(oldpath),
-									rs.preferred.ignorename)
-								setAttr(commit.fileops[idx], attr, newpath)
-								changecount++
-							}
-						}
-					}
-				}
-			}
-			respond("%d ignore files renamed (%s -> %s).",
-				changecount, rs.ignorename, rs.preferred.ignorename)
-			rs.ignorename = rs.preferred.ignorename
-		} else if verb == "--translate" {
-			changecount := 0
-			for _, event := range repo.events {
-				if blob, ok := event.(*Blob); ok && isIgnore(blob) {
-					if rs.preferred.name == "hg" {
-						if !bytes.HasPrefix(blob.getContent(), []byte("syntax: glob\n")) {
-							blob.setContent([]byte("syntax: glob\n"+string(blob.getContent())), noOffset)
-							changecount++
-						}
-					}
-				}
-			}
-			respond(fmt.Sprintf("%d %s blobs modified.", changecount, rs.ignorename))
-		} else {
-			croak("unknown option %s in ignores line", verb)
+	if len(patterns) == 0 && minsize == 0 {
+		croak("lfs migrate needs a pattern or a --size")
+		return false
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			croak("bad pattern %q: %v", pattern, err)
 			return false
 		}
 	}
+	selection := rs.selection
+	if selection == nil {
+		selection = repo.all()
+	}
+	lines, count, err := repo.lfsMigrate(repo.commits(selection), patterns, minsize, objects)
+	if count > 0 {
+		repo.declareSequenceMutation("LFS migration")
+		repo.invalidateNamecache()
+		repo.dirty = true
+	}
+	if err != nil {
+		croak("%v", err)
+		return false
+	}
+	if count == 0 {
+		respond("no files migrated.")
+		return false
+	}
+	created, modified := repo.addAttributes(lines)
+	respond("%d files migrated; %d .gitattributes created, %d modified.", count, created, modified)
 	return false
 }
 
 // HelpAttribution says "Shut up, golint!"
-//FIXME: Odd syntax
+// FIXME: Odd syntax
 func (rs *Reposurgeon) HelpAttribution() {
 	rs.helpOutput(`
 [SELECTION] attribution {SUBCOMMAND}
@@ -14818,12 +23217,14 @@ func (rs *Reposurgeon) DoAttribution(line string) bool {
 			return false
 		}
 		ed.remove()
+		repo.dirty = true
 	} else if action == "set" {
 		if len(args) < 1 || len(args) > 3 {
 			croak("'set' requires at least one of: name, email, date")
 			return false
 		}
 		ed.assign(args)
+		repo.dirty = true
 	} else if action == "prepend" || action == "append" {
 		if len(args) < 1 || len(args) > 3 {
 			croak("'%s' requires at least one of: name, email; date is optional", action)
@@ -14834,6 +23235,7 @@ func (rs *Reposurgeon) DoAttribution(line string) bool {
 		} else if action == "append" {
 			ed.insert(args, true)
 		}
+		repo.dirty = true
 	} else if action == "resolve" {
 		ed.resolve(parse.stdout, strings.Join(args, " "))
 	} else {
@@ -14850,9 +23252,11 @@ func (rs *Reposurgeon) DoAttribution(line string) bool {
 // HelpAuthors says "Shut up, golint!"
 func (rs *Reposurgeon) HelpAuthors() {
 	rs.helpOutput(`
-authors read {<INFILE}
+authors read [--format=FORMAT] {<INFILE}
+
+authors write [--format=FORMAT] [--stats] {>OUTFILE}
 
-authors write {>OUTFILE}
+authors resolve {COMMAND|URL}
 
 Apply or dump author-map information for the specified selection
 set, defaulting to all events.
@@ -14882,6 +23286,41 @@ interpreted by 'authors read', with entries for each unique committer,
 author, and tagger (to standard output or a >-redirected file). This
 may be helpful as a start on building an authors file, though each
 part to the right of an equals sign will need editing.
+
+With --stats, 'authors write' makes a fuller skeleton: each entry gets
+the zone offset most of its attributions have, and is preceded by a
+comment giving how many attributions it covers and the dates of the
+first and last.  The comments are ignored by 'authors read'.
+
+With the 'resolve' modifier, each local ID in the selection's
+attributions that no author-map entry matches is looked up with an
+external resolver, such as a front end to LDAP or an HR system.  If the
+argument begins with http:// or https:// it is a REST endpoint, sent a
+GET request with 'local', 'name', and 'email' query parameters;
+otherwise it is a shell command, run once per identity with a line of
+the form 'local = Name <email>' on standard input.  Either answers with
+a line giving the canonical name and email, optionally followed by a
+timezone; an empty answer, or a 404 from an endpoint, leaves the
+identity unresolved.  Resolved identities are added to the author map,
+so 'authors write' shows them, and the selection is remapped.  Answers
+are cached, so no resolver is asked about an identity twice in a
+session.
+
+The --format option of 'authors write' selects a map format for other
+conversion tools, so the same curated identity data can feed them too.
+The formats are 'reposurgeon' (the default), 'cvsimport' (for
+git-cvsimport -A), 'svn2git' (also read by git-svn), 'hgconvert' (for
+the --authormap option of hg convert), and 'mailmap' (a git .mailmap
+giving the canonical name for each address, followed by an entry for
+each contributor alias mapping it to its principal).
+
+'authors read --format=mailmap' applies a git .mailmap instead of an
+author map.  Each attribution whose address, and name if the entry gives
+one, matches an entry gets the proper name and address it gives; as in
+git, addresses match regardless of case, and entries naming a commit
+name win over those that do not.  Entries giving both a commit name and
+a proper name are also recorded as contributor aliases, as the '+' lines
+of an author map are.
 `)
 }
 
@@ -14895,7 +23334,23 @@ func (rs *Reposurgeon) DoAuthors(line string) bool {
 	if selection == nil {
 		selection = rs.chosen().all()
 	}
-	if strings.HasPrefix(line, "write") {
+	if strings.HasPrefix(line, "resolve") {
+		// Must not use LineParse here as it would try to strip
+		// options in shell commands.
+		resolver := strings.TrimSpace(line[7:])
+		if resolver == "" {
+			croak("authors resolve needs a command or URL")
+			return false
+		}
+		resolved, unresolved, err := rs.chosen().resolveAuthors(selection, resolver)
+		if err != nil {
+			croak("while resolving identities: %v", err)
+		}
+		if resolved > 0 {
+			rs.chosen().dirty = true
+		}
+		respond("resolved %d of %d unmapped identities.", resolved, resolved+unresolved)
+	} else if strings.HasPrefix(line, "write") {
 		line = strings.TrimSpace(line[5:])
 		parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 		defer parse.Closem()
@@ -14903,7 +23358,22 @@ func (rs *Reposurgeon) DoAuthors(line string) bool {
 			croak("authors write no longer takes a filename argument - use > redirection instead")
 			return false
 		}
-		rs.chosen().writeAuthorMap(selection, parse.stdout)
+		format, present := parse.OptVal("--format")
+		if !present {
+			format = "reposurgeon"
+		} else if _, ok := authorMapFormats[format]; !ok && format != "mailmap" {
+			croak("unknown author map format %q", format)
+			return false
+		}
+		if parse.options.Contains("--stats") {
+			if format != "reposurgeon" {
+				croak("--stats is only available in the reposurgeon format")
+				return false
+			}
+			rs.chosen().writeAuthorCensus(selection, parse.stdout)
+		} else {
+			rs.chosen().writeAuthorMap(selection, parse.stdout, format)
+		}
 	} else {
 		if strings.HasPrefix(line, "read") {
 			line = strings.TrimSpace(line[4:])
@@ -14914,7 +23384,19 @@ func (rs *Reposurgeon) DoAuthors(line string) bool {
 			croak("authors read no longer takes a filename argument - use < redirection instead")
 			return false
 		}
-		rs.chosen().readAuthorMap(selection, parse.stdin)
+		switch format, _ := parse.OptVal("--format"); format {
+		case "", "reposurgeon":
+			rs.chosen().readAuthorMap(selection, parse.stdin)
+		case "mailmap":
+			if err := rs.chosen().readMailmap(selection, parse.stdin); err != nil {
+				croak("while reading mailmap: %v", err)
+				return false
+			}
+		default:
+			croak("can't read author maps in format %q", format)
+			return false
+		}
+		rs.chosen().dirty = true
 	}
 	return false
 }
@@ -14962,8 +23444,55 @@ func (rs *Reposurgeon) DoLegacy(line string) bool {
 			croak("legacy read does not take a filename argument - use < redirection instead")
 			return false
 		}
-		rs.chosen().readLegacyMap(parse.stdin)
+		if err := rs.chosen().readLegacyMap(parse.stdin); err != nil {
+			croak("while reading legacy map: %v", err)
+			return false
+		}
+		rs.chosen().dirty = true
+	}
+	return false
+}
+
+// HelpHashmap says "Shut up, golint!"
+func (rs *Reposurgeon) HelpHashmap() {
+	rs.helpOutput(`
+[SELECTION] hashmap [>OUTFILE]
+
+List the object names the last rebuild gave the selected commits, all
+commits by default. Each line has three tab-separated fields: the
+commit's mark, its object name, and its legacy ID, or "-" if it has
+none. Select by legacy ID, as in '<2317> hashmap', to look up one
+commit. Supports > redirection.
+
+The names come from the importer's marks file, so only types whose
+importer keeps one, such as git, record them. Each such rebuild also
+leaves the whole table in the file hash-map under the repository
+subdirectory. If the repository has been altered since the rebuild,
+the names may be stale, and a warning says so.
+`)
+}
+
+// DoHashmap reports the object names a rebuild gave commits.
+func (rs *Reposurgeon) DoHashmap(line string) bool {
+	if rs.chosen() == nil {
+		croak("no repo has been chosen.")
+		return false
+	}
+	repo := rs.chosen()
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	if len(parse.Tokens()) > 0 {
+		croak("hashmap does not take arguments")
+		return false
+	}
+	if repo.rebuiltHashes == nil {
+		croak("%s has not been rebuilt with an importer that keeps marks", repo.name)
+		return false
+	}
+	if repo.dirty && logEnable(logWARN) {
+		logit("%s has been altered since it was rebuilt; names may be stale", repo.name)
 	}
+	repo.writeHashMap(parse.stdout, rs.selection)
 	return false
 }
 
@@ -15013,7 +23542,7 @@ func (rs *Reposurgeon) DoReferences(line string) bool {
 				}
 				return legend // no replacement
 			}
-			text := commit.actionStamp()
+			text := commit.uniqueStamp()
 			hits++
 			return text
 		}
@@ -15074,6 +23603,7 @@ func (rs *Reposurgeon) DoReferences(line string) bool {
 		}
 		respond("%d references resolved.", hits)
 		repo.writeLegacy = true
+		repo.dirty = true
 	} else {
 		selection = make([]int, 0)
 		for idx, commit := range repo.commits(nil) {
@@ -15170,6 +23700,7 @@ func (rs *Reposurgeon) DoGitify(_line string) bool {
 		control.baton.percentProgress(uint64(idx))
 	})
 	control.baton.endProgress()
+	rs.chosen().dirty = true
 	return false
 }
 
@@ -15180,13 +23711,57 @@ func (rs *Reposurgeon) DoGitify(_line string) bool {
 // HelpCheckout says "Shut up, golint!"
 func (rs *Reposurgeon) HelpCheckout() {
 	rs.helpOutput(`
-{SELECTION} checkout
+{SELECTION} checkout DIRECTORY [PATTERN...]
 
 Check out files for a specified commit into a directory.  The selection
 set must resolve to a singleton commit.
+
+If any PATTERNs are given, the checkout is sparse: only files matching
+one of them are materialized.  A pattern is either a /-delimited Go
+regular expression matched against the whole path, or a shell glob
+matched against the path or any of its leading directories, so that
+"src/lib" or "src/*/include" selects everything beneath the matching
+directories.  This makes it practical to inspect part of a huge
+commit's tree.
 `)
 }
 
+// checkoutFilter compiles sparse-checkout patterns into a path predicate.
+func checkoutFilter(patterns []string) (func(string) bool, error) {
+	var regexps []*regexp.Regexp
+	var globs []string
+	for _, pattern := range patterns {
+		if len(pattern) > 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			regexps = append(regexps, re)
+			continue
+		}
+		pattern = strings.Trim(pattern, "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ill-formed glob %q", pattern)
+		}
+		globs = append(globs, pattern)
+	}
+	return func(cpath string) bool {
+		for _, re := range regexps {
+			if re.MatchString(cpath) {
+				return true
+			}
+		}
+		for _, glob := range globs {
+			for prefix := cpath; prefix != "."; prefix = path.Dir(prefix) {
+				if ok, _ := path.Match(glob, prefix); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
 // DoCheckout checks out files for a specified commit into a directory.
 func (rs *Reposurgeon) DoCheckout(line string) bool {
 	if rs.chosen() == nil {
@@ -15198,12 +23773,22 @@ func (rs *Reposurgeon) DoCheckout(line string) bool {
 	if selection == nil {
 		selection = rs.chosen().all()
 	}
-	if line == "" {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
 		croak("no target directory specified.")
 	} else if len(selection) == 1 {
+		var wanted func(string) bool
+		if len(fields) > 1 {
+			var err error
+			wanted, err = checkoutFilter(fields[1:])
+			if err != nil {
+				croak("in checkout pattern: %v", err)
+				return false
+			}
+		}
 		event := repo.events[selection[0]]
 		if commit, ok := event.(*Commit); ok {
-			commit.checkout(line)
+			commit.checkout(fields[0], wanted)
 		} else {
 			croak("not a commit.")
 		}
@@ -15439,11 +24024,41 @@ func (rs *Reposurgeon) HelpOptions() {
 // HelpSet says "Shut up, golint!"
 func (rs *Reposurgeon) HelpSet() {
 	rs.helpOutput(`
-set [OPTION]
+set [--repo|--inherit] [OPTION]
+set membudget GIGABYTES
+set blobcodec {gzip|zstd}
 
 Set a (tab-completed) boolean option to control reposurgeon's
 behavior.  With no arguments, displays the state of all flags and
-options. The following flags and options are defined:
+options, followed by any overrides in the chosen repository.
+
+"set membudget" gives reposurgeon a memory budget in gigabytes,
+fractions allowed.  Stream and dump reads check it as they go, and
+selection evaluation checks it afterwards; once resident memory
+exceeds it, the operation fails with a message saying where, instead
+of running on until the kernel's OOM killer ends the session.  The
+budget does not make reposurgeon spill anything to disk; it only
+turns a kill into an early, explained failure.  "clear membudget"
+removes the budget.  Where the platform reports it, the
+progress display shows resident memory whether or not a budget is set.
+
+"set blobcodec" chooses how compressblobs compresses on-disk blobs:
+gzip, the default, or zstd, which is much faster at about the same
+ratio and pays off on big repositories.  "clear blobcodec" goes back
+to gzip.
+
+With --repo, the setting applies only to the chosen repository and
+overrides the global value there; --inherit drops such an override so
+the repository follows the global value again.  Only canonicalize,
+compressblobs, and blobcodec can be scoped this way.  A repository
+starts with the compressblobs value and codec in force when it was
+read, so a session can read one huge repository with compressblobs set
+and then clear it before reading a small one; changing them with
+--repo later re-encodes the blobs it has.  blobstore is fixed for each
+repository when it is read.  Blobs moved between repositories with
+different codecs, as by unite, are re-encoded for their new home.
+
+The following flags and options are defined:
 
 `)
 	for _, opt := range optionFlags {
@@ -15467,23 +24082,125 @@ func performOptionSideEffect(opt string, val bool) {
 	if opt == "progress" {
 		control.baton.setInteractivity(val)
 	}
+	if opt == "deterministic" {
+		for _, implied := range []string{"testmode", "quiet", "serial"} {
+			control.flagOptions[implied] = val
+		}
+		control.baton.setTimeless(val)
+	}
 	if opt == "crlf" {
 		control.lineSep = "\r\n"
 	}
 }
 
-func tweakFlagOptions(line string, val bool) {
+func (rs *Reposurgeon) tweakFlagOptions(line string, val bool) {
+	parse := rs.newLineParse(line, nil)
+	defer parse.Closem()
+	var repo *Repository
+	scoped := parse.options.Contains("--repo") || parse.options.Contains("--inherit")
+	if scoped {
+		if repo = rs.chosen(); repo == nil {
+			croak("no repo has been chosen.")
+			return
+		}
+	}
+	line = parse.line
 	if strings.TrimSpace(line) == "" {
 		for _, opt := range optionFlags {
 			fmt.Printf("\t%s = %v\n", opt[0], control.flagOptions[opt[0]])
 		}
+		if control.memoryBudget == 0 {
+			fmt.Printf("\tmembudget = none\n")
+		} else {
+			fmt.Printf("\tmembudget = %s\n", formatMemory(control.memoryBudget))
+		}
+		fmt.Printf("\tblobcodec = %s\n", control.blobCodec.name)
+		if repo := rs.chosen(); repo != nil {
+			for _, opt := range optionFlags {
+				if override, ok := repo.flagOptions[opt[0]]; ok && override != control.flagOptions[opt[0]] {
+					fmt.Printf("\t%s = %v (in %s)\n", opt[0], override, repo.name)
+				}
+			}
+			if repo.codec != nil && repo.codec != control.blobCodec {
+				fmt.Printf("\tblobcodec = %s (in %s)\n", repo.codec.name, repo.name)
+			}
+		}
 	} else {
 		line = strings.Replace(line, ",", " ", -1)
-		for _, name := range strings.Fields(line) {
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			name := fields[i]
+			if name == "membudget" && !scoped {
+				if !val {
+					control.memoryBudget = 0
+					continue
+				}
+				i++
+				var gb float64
+				var err error
+				if i < len(fields) {
+					gb, err = strconv.ParseFloat(fields[i], 64)
+				}
+				if i >= len(fields) || err != nil || gb <= 0 {
+					croak("membudget needs a positive size in gigabytes")
+					return
+				}
+				control.memoryBudget = uint64(gb * (1 << 30))
+				continue
+			}
+			if name == "blobcodec" {
+				var codec *blobCodec
+				if parse.options.Contains("--inherit") {
+					repo.setCodec(globalCodec())
+					continue
+				} else if !val {
+					codec = blobCodecs[0]
+				} else {
+					i++
+					if i < len(fields) {
+						codec = findBlobCodec(fields[i])
+					}
+					if codec == nil {
+						var names []string
+						for _, codec := range blobCodecs {
+							names = append(names, codec.name)
+						}
+						croak("blobcodec needs one of %s", strings.Join(names, ", "))
+						return
+					}
+				}
+				if !scoped {
+					control.blobCodec = codec
+				} else if val || repo.codec != nil {
+					repo.setCodec(codec)
+				}
+				continue
+			}
+			if name == "compressblobs" && scoped {
+				if parse.options.Contains("--inherit") {
+					repo.setCodec(globalCodec())
+				} else if !val {
+					repo.setCodec(nil)
+				} else if repo.codec == nil {
+					repo.setCodec(control.blobCodec)
+				}
+				continue
+			}
 			for _, opt := range optionFlags {
 				if name == opt[0] {
-					control.flagOptions[opt[0]] = val
-					performOptionSideEffect(opt[0], val)
+					if !scoped {
+						control.flagOptions[opt[0]] = val
+						performOptionSideEffect(opt[0], val)
+					} else if !repoScopedFlags.Contains(name) {
+						croak("option flag '%s' cannot be set per repository", name)
+					} else if parse.options.Contains("--inherit") {
+						delete(repo.flagOptions, name)
+					} else {
+						if repo.flagOptions == nil {
+							repo.flagOptions = make(map[string]bool)
+						}
+						repo.flagOptions[name] = val
+					}
 					goto good
 				}
 			}
@@ -15495,17 +24212,18 @@ func tweakFlagOptions(line string, val bool) {
 
 // DoSet is the handler for the "set" command.
 func (rs *Reposurgeon) DoSet(line string) bool {
-	tweakFlagOptions(line, true)
+	rs.tweakFlagOptions(line, true)
 	return false
 }
 
 // HelpClear says "Shut up, golint!"
 func (rs *Reposurgeon) HelpClear() {
 	rs.helpOutput(`
-clear [OPTION]
+clear [--repo|--inherit] [OPTION]
 
 Clear a (tab-completed) boolean option to control reposurgeon's
 behavior.  With no arguments, displays the state of all flags. The
+--repo and --inherit options work as they do for "set". The
 following flags and options are defined:
 
 `)
@@ -15528,7 +24246,7 @@ func (rs *Reposurgeon) CompleteClear(text string) []string {
 
 // DoClear is the handler for the "clear" command.
 func (rs *Reposurgeon) DoClear(line string) bool {
-	tweakFlagOptions(line, false)
+	rs.tweakFlagOptions(line, false)
 	return false
 }
 
@@ -15620,7 +24338,13 @@ func (rs *Reposurgeon) DoDefine(lineIn string) bool {
 			rs.definitions[name] = []string{body}
 		}
 	} else {
-		for name, body := range rs.definitions {
+		names := make([]string, 0, len(rs.definitions))
+		for name := range rs.definitions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			body := rs.definitions[name]
 			if len(body) == 1 {
 				respond("define %s %s\n", name, body[0])
 			} else {
@@ -15791,6 +24515,9 @@ func (rs *Reposurgeon) DoTimequake(line string) bool {
 	//baton.endProcess()
 	respond("%d events modified", modified)
 	repo.invalidateNamecache()
+	if modified > 0 {
+		repo.dirty = true
+	}
 	return false
 }
 
@@ -15801,7 +24528,7 @@ func (rs *Reposurgeon) DoTimequake(line string) bool {
 // HelpChangelogs says "Shut up, golint!"
 func (rs *Reposurgeon) HelpChangelogs() {
 	rs.helpOutput(`
-[SELECTION] changelogs
+[SELECTION] changelogs [--unresolved] [/REGEXP/] [>OUTFILE]
 
 Mine ChangeLog files for authorship data.
 
@@ -15829,6 +24556,13 @@ In accordance with FSF policy for ChangeLogs, any date in an
 attribution header is discarded and the committer date is used.
 However, if the name is an author-map alias with an associated timezone,
 that zone is used.
+
+With --unresolved, list the commits whose ChangeLog changes could not be
+turned into an author: those adding entries under more than one
+attribution, those whose attribution is garbled or not a valid name and
+address, and, when an author map has been read, those whose address is
+in none of its entries.  Each is reported on one line: its event number
+and mark, then the reason.
 `)
 }
 
@@ -15895,10 +24629,15 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 	if selection == nil {
 		selection = rs.chosen().all()
 	}
+	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
+	defer parse.Closem()
+	line = parse.line
 
 	cm, cd := 0, 0
 	var errLock sync.Mutex
 	errlines := make([]string, 0)
+	unresolved := make([]string, len(selection))
+	garbled := make(map[*Commit]string)
 
 	// Machinery for recognizing and skipping dates in
 	// ChangeLog attribution lines. To add more date formats,
@@ -15942,6 +24681,9 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 			errlines = append(errlines,
 				fmt.Sprintf("%s at %s has garbled attribution %q",
 					filepath, id, line))
+			if _, ok := garbled[commit]; !ok {
+				garbled[commit] = line
+			}
 			errLock.Unlock()
 		}
 		ok, pre, email, post := canonicalizeInlineAddress(line)
@@ -16098,6 +24840,7 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 								if foundAttribution != "" &&
 									foundAttribution != attribution {
 									// there is more than one active, skip the commit
+									unresolved[eventRank] = fmt.Sprintf("ambiguous attribution: %q and %q", foundAttribution, attribution)
 									return
 								}
 								foundAttribution = attribution
@@ -16118,6 +24861,13 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 			}
 		}
 		attributions[eventRank] = foundAttribution
+		if foundAttribution == "" {
+			errLock.Lock()
+			if line, ok := garbled[commit]; ok {
+				unresolved[eventRank] = fmt.Sprintf("garbled attribution %q", line)
+			}
+			errLock.Unlock()
+		}
 		sorted := make([]string, len(coAuthors))
 		k := 0
 		for coAuthor := range coAuthors {
@@ -16141,6 +24891,7 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 			if logEnable(logSHOUT) {
 				logit("invalid attribution %q in commit %s <%s>", attribution, commit.mark, commit.legacyID)
 			}
+			unresolved[eventRank] = fmt.Sprintf("invalid attribution %q", attribution)
 			continue
 		}
 		cm++
@@ -16152,14 +24903,19 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 		// We could get wacky results if two people with different
 		// human names but identicall email addresses were run through
 		// this code, but that outcome seems wildly unlikely.
-		if newattr.fullname == "" {
-			for _, mapentry := range repo.authormap {
-				if newattr.email == mapentry.email {
+		mapped := false
+		for _, mapentry := range repo.authormap {
+			if newattr.email == mapentry.email {
+				if newattr.fullname == "" {
 					newattr.fullname = mapentry.fullname
-					break
 				}
+				mapped = true
+				break
 			}
 		}
+		if !mapped && len(repo.authormap) > 0 {
+			unresolved[eventRank] = fmt.Sprintf("address of %s <%s> is not in the author map", newattr.fullname, newattr.email)
+		}
 		if tz, ok := repo.tzmap[newattr.email]; ok { //&& unicode.IsLetter(rune(tz.String()[0])) {
 			newattr.date.timestamp = newattr.date.timestamp.In(tz)
 		} else if zone := zoneFromEmail(newattr.email); zone != "" {
@@ -16204,13 +24960,21 @@ func (rs *Reposurgeon) DoChangelogs(line string) bool {
 			logit(line)
 		}
 	}
+	if parse.options.Contains("--unresolved") {
+		for eventRank, eventID := range selection {
+			if unresolved[eventRank] != "" {
+				fmt.Fprintf(parse.stdout, "%d %s\t%s\n", eventID+1, repo.events[eventID].getMark(), unresolved[eventRank])
+			}
+		}
+	}
+	if cm > 0 {
+		repo.dirty = true
+	}
 	respond("fills %d of %d authorships, changing %d, from %d ChangeLogs.", cm, cc.value, cd, cl.value)
 	return false
 }
 
-//
 // Tarball incorporation
-//
 func extractTar(dst string, r io.Reader) ([]tar.Header, error) {
 	files := make([]tar.Header, 0)
 	tr := tar.NewReader(r)
@@ -16474,6 +25238,7 @@ func (rs *Reposurgeon) DoIncorporate(line string) bool {
 	}
 	repo.declareSequenceMutation("")
 	repo.invalidateObjectMap()
+	repo.dirty = true
 
 	return false
 }
@@ -16551,6 +25316,9 @@ Display elapsed time since start. Accepts output redirection.
 func (rs *Reposurgeon) DoElapsed(line string) bool {
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
+	if control.flagOptions["deterministic"] {
+		return false
+	}
 	parse.respond("elapsed time %v.", time.Now().Sub(rs.startTime))
 	return false
 }
@@ -16558,9 +25326,11 @@ func (rs *Reposurgeon) DoElapsed(line string) bool {
 // HelpExit says "Shut up, golint!"
 func (rs *Reposurgeon) HelpExit() {
 	rs.helpOutput(`
-exit [>OUTFILE]
+exit [--force] [>OUTFILE]
 
 Exit cleanly, emitting a goodbye message. Accepts output redirection.
+Like quit, refuses in interactive mode to discard unsaved surgery
+without --force.
 
 Typing EOT (usually Ctrl-D) will exit quietly.
 `)
@@ -16570,6 +25340,13 @@ Typing EOT (usually Ctrl-D) will exit quietly.
 func (rs *Reposurgeon) DoExit(line string) bool {
 	parse := rs.newLineParse(line, orderedStringSet{"stdout"})
 	defer parse.Closem()
+	if rs.keepsUnsaved("exit", parse.options.Contains("--force")) {
+		return false
+	}
+	if control.flagOptions["deterministic"] {
+		parse.respond("exiting.")
+		return true
+	}
 	parse.respond("exiting, elapsed time %v.", time.Now().Sub(rs.startTime))
 	return true
 }
@@ -16606,13 +25383,17 @@ You can select commits and tags by date, or by date and committer:
 <2011-05-25T07:30:37Z>        all commits and tags with this date and time
 <2011-05-25T07:30:37Z!esr>    all with this date and time and committer
 <2011-05-25T07:30:37Z!esr#2>  event #2 (1-origin) in the above set
+<2011-01-01..2011-06-30>      all commits and tags dated in the first half of 2011
+<2011-05-25..>                all dated on or after 2011-05-25
+<author@..2010-12-31>         all commits authored before 2011
 
 More ways to construct event sets:
 
 /foo/      all commits and tags containing the string 'foo' in text or metadata
            suffix letters: a=author, b=branch, c=comment in commit or tag,
                            C=committer, r=committish, p=text, t=tagger, n=name,
-                           B=blob content in blobs.
+                           B=blob content in blobs, k=property key in
+                           commit, v=property value in commit.
            A 'b' search also finds blobs and tags attached to commits on
            matching branches.
 [foo]      all commits and blobs touching the file named 'foo'.
@@ -16694,9 +25475,15 @@ The following functions are available:
 @chn()  all children of commits in the argument set
 @dsc()  all commits descended from the argument set (argument set included)
 @anc()  all commits whom the argument set is descended from (set included)
+@tsm()  all commits with a tree identical to one in the argument set (set included)
 @pre()  events before the argument set
 @suc()  events after the argument set
 @srt()  sort the argument set by event number.
+
+A number between the name of @anc() or @dsc() and its argument limits
+the walk to that many generations: @anc2(:55) is :55, its parents, and
+their parents.  Tags and resets in the argument set of @anc() and
+@dsc() stand for the commits they point at.
 `)
 }
 
@@ -16992,6 +25779,8 @@ Report Git object hashes.  This command simulates Git hash generation.
 Takes a selection set, defaulting to all.  For each eligible object in the set,
 returns its index  and the same hash that Git would generate for its
 representation of the object. Eligible objects are blobs and commits.
+Hashes are SHA-256 if the repository was read from a SHA-256 git
+repository, and SHA-1 otherwise.
 
 With the option --bare, omit the event number; list only the hash.
 
@@ -17024,7 +25813,7 @@ func (rs *Reposurgeon) DoHash(lineIn string) bool {
 			hashrep = event.(*Blob).gitHash().hexify()
 		case *Commit:
 			if parse.options.Contains("--tree") {
-				hashrep = event.(*Commit).manifest().gitHash().hexify()
+				hashrep = event.(*Commit).manifest().gitHash(repo.objectFormat).hexify()
 			} else {
 				hashrep = event.(*Commit).gitHash().hexify()
 			}
@@ -17127,6 +25916,11 @@ func main() {
 	if len(os.Args[1:]) == 0 {
 		os.Args = append(os.Args, "-")
 	}
+	// The one-shot subcommands and watch take the rest of the
+	// invocation line as their arguments rather than as further commands.
+	if len(os.Args) > 2 && (os.Args[1] == "export" || os.Args[1] == "import" || os.Args[1] == "watch") {
+		os.Args = []string{os.Args[0], strings.Join(os.Args[1:], " ")}
+	}
 
 	r := trace.StartRegion(ctx, "process-args")
 	interpreter.PreLoop(ctx)
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
@@ -59,6 +64,18 @@ func TestBackreferences(t *testing.T) {
 	assertEqual(t, string(result), expected)
 }
 
+func TestSplitRuneFirst(t *testing.T) {
+	first, rest := splitRuneFirst("--format=fossil", '=')
+	assertEqual(t, first, "--format")
+	assertEqual(t, rest, "fossil")
+	first, rest = splitRuneFirst("left→right→more", '→')
+	assertEqual(t, first, "left")
+	assertEqual(t, rest, "right→more")
+	first, rest = splitRuneFirst("nosep", '=')
+	assertEqual(t, first, "nosep")
+	assertEqual(t, rest, "")
+}
+
 func TestOrderedStringSet(t *testing.T) {
 	ts := newOrderedStringSet("a", "b", "c")
 
@@ -543,6 +560,59 @@ func TestDateFormats(t *testing.T) {
 	}
 }
 
+func TestDateParsing(t *testing.T) {
+	type harness struct {
+		from     string
+		expected string
+	}
+	testTable := []harness{
+		// git log, day unpadded and padded
+		{"Tue Mar 1 09:05:07 2011 -0500", "1298988307 -0500"},
+		{"Tue Mar 01 09:05:07 2011 -0500", "1298988307 -0500"},
+		{"2011-03-01 09:05:07 -0500", "1298988307 -0500"},
+		// RFC2822, with the variations it allows
+		{"Tue, 01 Mar 2011 09:05:07 -0500", "1298988307 -0500"},
+		{"Tue, 1 Mar 2011 09:05:07 -0500", "1298988307 -0500"},
+		{"1 Mar 2011 09:05:07 -0500", "1298988307 -0500"},
+		{"Tue, 1 Mar 2011 09:05 -0500", "1298988300 -0500"},
+		{"Tue,  1 Mar 2011  09:05:07 -0500 (EST)", "1298988307 -0500"},
+		{"Tue, 1 Mar 2011 09:05:07 EST", "1298988307 -0500"},
+		{"Tue, 1 Mar 2011 14:05:07 GMT", "1298988307 +0000"},
+		{"Tue, 1 Mar 2011 14:05:07 Z", "1298988307 +0000"},
+		// ISO 8601 basic format
+		{"20110301T090507-0500", "1298988307 -0500"},
+		{"20110301T140507Z", "1298988307 +0000"},
+		{"20110301T140507", "1298988307 +0000"},
+		// date(1), zone name before the year
+		{"Thu Jun 30 05:00:00 PDT 2011", "1309435200 -0700"},
+		{"Thu Jun 30 05:00:00 UTC 2011", "1309410000 +0000"},
+		// CVS and RCS
+		{"2011/03/01 14:05:07", "1298988307 +0000"},
+		{"2011.03.01.14.05.07", "1298988307 +0000"},
+		// Two-digit years
+		{"97.03.01.14.05.07", "857225107 +0000"},
+		{"Sat, 1 Mar 97 09:05:07 -0500", "857225107 -0500"},
+		{"1 Mar 11 09:05:07 -0500", "1298988307 -0500"},
+	}
+	for _, item := range testTable {
+		d, err := newDate(item.from)
+		if err != nil {
+			t.Errorf("ill-formed date %q error %v", item.from, err)
+			continue
+		}
+		if d.String() != item.expected {
+			t.Errorf("date parse of %q: expected %s saw %s",
+				item.from, item.expected, d.String())
+		}
+	}
+	for _, bad := range []string{"Tuesday", "2011-03-01", "1 Mar 2011",
+		"Thu Jun 30 05:00:00 CEST 2011"} {
+		if _, err := newDate(bad); err == nil {
+			t.Errorf("date parse of %q unexpectedly succeeded", bad)
+		}
+	}
+}
+
 func TestDateRoundtrip(t *testing.T) {
 	// Test round-tripping of git-style dates
 	type harness struct {
@@ -790,6 +860,11 @@ func TestStringScan(t *testing.T) {
 		{"\"xy zzy\" zorkmid", []string{"xy zzy", "zorkmid"}},
 		{"xyzzy \"zorkmid\"", []string{"xyzzy", "zorkmid"}},
 		{"\"bubble\" \"squeak\"", []string{"bubble", "squeak"}},
+		{`"say \"hi\"" x`, []string{`say "hi"`, "x"}},
+		{`"line\nbreak" "back\\slash"`, []string{"line\nbreak", `back\slash`}},
+		{`"\303\251t\351"`, []string{"\xc3\xa9t\xe9"}},
+		{"caf\xc3\xa0 bar", []string{"caf\xc3\xa0", "bar"}},
+		{`" padded "`, []string{" padded "}},
 	}
 
 	for _, item := range testTable {
@@ -899,6 +974,20 @@ func TestFileOp(t *testing.T) {
 	assertEqual(t, "EATME", fileop13.Path)
 	assertEqual(t, line13+"\n", fileop13.String())
 
+	for _, path := range []string{`quote"d`, "new\nline", "tab\tbed", "bad\xffbyte",
+		"\"leading", " padded ", `back\slash`, "caf\xc3\xa0 \xe9"} {
+		for _, op := range []*FileOp{
+			newFileOp(nil).construct('M', "100644", ":1", path),
+			newFileOp(nil).construct('D', path),
+			newFileOp(nil).construct('R', path, "target"),
+		} {
+			reparsed := newFileOp(nil).parse(strings.TrimSuffix(op.String(), "\n"))
+			if reparsed.Path != op.Path || reparsed.Source != op.Source {
+				t.Errorf("%q did not round-trip through %q", path, op.String())
+			}
+		}
+	}
+
 	line14 := "deleteall"
 	fileop14 := newFileOp(nil).parse(line14)
 	assertOpEqual(t, 'd', fileop14.op)
@@ -1548,16 +1637,26 @@ data 0
 
 	var b strings.Builder
 	mapped := orderedIntSet{repo.eventToIndex(commit1)}
-	if err = repo.writeAuthorMap(mapped, &b); err != nil {
+	if err = repo.writeAuthorMap(mapped, &b, "reposurgeon"); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	expect := "esr = Eric S. Raymond <esr@thyrsus.com>\n"
 	assertEqual(t, expect, b.String())
-	if err = repo.writeAuthorMap(repo.all(), &b); err != nil {
+	if err = repo.writeAuthorMap(repo.all(), &b, "reposurgeon"); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	expect = "esr = Eric S. Raymond <esr@thyrsus.com>\nesr = esr <esr>\n"
 	assertEqual(t, expect, b.String())
+	b.Reset()
+	if err = repo.writeAuthorMap(mapped, &b, "cvsimport"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEqual(t, "esr=Eric S. Raymond <esr@thyrsus.com>\n", b.String())
+	b.Reset()
+	if err = repo.writeAuthorMap(mapped, &b, "mailmap"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEqual(t, "Eric S. Raymond <esr@thyrsus.com>\n", b.String())
 
 	// Test appending a done marker
 	assertIntEqual(t, len(repo.events), 11)
@@ -1581,6 +1680,53 @@ data 0
 	assertBool(t, ancestors.Equal(orderedIntSet{4, 2}), true)
 }
 
+func TestStampCollisions(t *testing.T) {
+	repo := newRepository("test")
+	defer repo.cleanup()
+	sp := newStreamParser(repo)
+	r := strings.NewReader(`blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer esr <esr> 1322671432 +0000
+data 6
+First.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer esr <esr> 1322671432 +0000
+data 7
+Second.
+from :2
+M 100644 :1 COPYING
+
+commit refs/heads/master
+mark :4
+committer esr <esr> 1322671433 +0000
+data 6
+Third.
+from :3
+M 100644 :1 NEWS
+
+`)
+	sp.fastImport(context.TODO(), r, nullStringSet, "synthetic test load")
+	second := repo.markToEvent(":3").(*Commit)
+	third := repo.markToEvent(":4").(*Commit)
+	assertEqual(t, second.uniqueStamp(), "2011-11-30T16:43:52Z!esr#2")
+	assertEqual(t, second.callout(), "2011-11-30T16:43:52Z!esr#2")
+	assertEqual(t, third.uniqueStamp(), "2011-11-30T16:43:53Z!esr")
+	assertBool(t, repo.named("2011-11-30T16:43:52Z!esr").Equal(orderedIntSet{1, 2}), true)
+	assertBool(t, repo.named("2011-11-30T16:43:52Z!esr#1").Equal(orderedIntSet{1}), true)
+	assertBool(t, repo.named("2011-11-30T16:43:52Z!esr#2").Equal(orderedIntSet{2}), true)
+	assertIntEqual(t, repo.calloutTarget(second.callout()), 2)
+	repo.checkUniqueness(false, nil)
+	assertEqual(t, repo.uniqueness, "")
+}
+
 func TestDelete(t *testing.T) {
 	repo := newRepository("test")
 	defer repo.cleanup()
@@ -1962,6 +2108,34 @@ func TestContainingDir(t *testing.T) {
 	}
 }
 
+func TestCheckoutFilter(t *testing.T) {
+	wanted, err := checkoutFilter([]string{"src/lib", "doc/*/images/", `/\.h$/`})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	type testcase struct {
+		path string
+		want bool
+	}
+	var testcases = []testcase{
+		{"src/lib/foo.c", true},
+		{"src/lib", true},
+		{"src/libfoo.c", false},
+		{"src/main.c", false},
+		{"doc/manual/images/a.png", true},
+		{"doc/manual/index.html", false},
+		{"include/foo.h", true},
+	}
+	for _, test := range testcases {
+		if wanted(test.path) != test.want {
+			t.Errorf("checkout filter on %q: expected %v", test.path, test.want)
+		}
+	}
+	if _, err = checkoutFilter([]string{"src/[a"}); err == nil {
+		t.Errorf("ill-formed glob was accepted")
+	}
+}
+
 func TestChangelogParse(t *testing.T) {
 	type testcase struct {
 		line  string
@@ -2238,3 +2412,687 @@ TAG o123-o123
 		})
 	}
 }
+
+func TestGuessEncoding(t *testing.T) {
+	type testcase struct {
+		text  string
+		guess string
+	}
+	var testcases = []testcase{
+		{"Plain ASCII", "UTF-8"},
+		{"Naïve", "UTF-8"},
+		{"Caf\xe9", "ISO-8859-1"},
+		{"\x93Smart\x94", "windows-1252"},
+		{"Naïve caf\xe9", "mixed"},
+	}
+	for idx, test := range testcases {
+		test := test
+		t.Run(fmt.Sprint(idx), func(t *testing.T) {
+			t.Parallel()
+			assertEqual(t, guessEncoding(test.text), test.guess)
+		})
+	}
+}
+
+func TestSniffContent(t *testing.T) {
+	type testcase struct {
+		content string
+		format  string
+	}
+	var testcases = []testcase{
+		{"Plain text\n", ""},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "PNG image"},
+		{"BZh is text without a NUL", ""},
+		{"BZh91AY&SY\x00", "bzip2 archive"},
+		{"\xff\xfeH\x00i\x00", formatUTF16LE},
+		{"\xfe\xff\x00H\x00i", formatUTF16BE},
+		{"\xff\xfeH\x00i", "binary data"},
+		{"stray\x00NUL", "binary data"},
+	}
+	for idx, test := range testcases {
+		test := test
+		t.Run(fmt.Sprint(idx), func(t *testing.T) {
+			t.Parallel()
+			assertEqual(t, sniffContent([]byte(test.content)), test.format)
+		})
+	}
+	text, ok := decodeUTF16([]byte("\xff\xfeH\x00\xe9\x00"), false)
+	assertBool(t, ok, true)
+	assertEqual(t, string(text), "Hé")
+}
+
+func TestApplyRCSDiff(t *testing.T) {
+	type testcase struct {
+		base   string
+		diff   string
+		result string
+	}
+	var testcases = []testcase{
+		{"a\nb\nc\n", "", "a\nb\nc\n"},
+		{"a\nb\nc\n", "d2 1\n", "a\nc\n"},
+		{"a\nb\nc\n", "a0 1\nz\n", "z\na\nb\nc\n"},
+		{"a\nb\nc\n", "d2 1\na2 2\nx\ny\n", "a\nx\ny\nc\n"},
+		{"a\nb", "a2 1\nc", "a\nbc"},
+	}
+	for idx, test := range testcases {
+		test := test
+		t.Run(fmt.Sprint(idx), func(t *testing.T) {
+			t.Parallel()
+			result, err := applyRCSDiff([]byte(test.base), []byte(test.diff))
+			assertBool(t, err == nil, true)
+			assertEqual(t, string(result), test.result)
+		})
+	}
+	_, err := applyRCSDiff([]byte("a\n"), []byte("d3 1\n"))
+	assertBool(t, err != nil, true)
+	assertEqual(t, rcsWorkingPath("./src/Attic/foo.c,v"), "src/foo.c")
+	assertEqual(t, rcsWorkingPath("RCS/bar,v"), "bar")
+}
+
+func TestCommentPolicy(t *testing.T) {
+	rules, err := readCommentPolicy(strings.NewReader("# policy\nsubject-length 10\n\nrequire [A-Z]+-[0-9]+\nforbid wip\n"))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(rules), 3)
+	type testcase struct {
+		rule    int
+		comment string
+		bad     bool
+	}
+	var testcases = []testcase{
+		{0, "Short.\nA much longer body line.\n", false},
+		{0, "Far too long a subject.\n", true},
+		{1, "Fix crash (PROJ-17).\n", false},
+		{1, "Fix crash.\n", true},
+		{2, "WIP: fix crash.\n", true},
+		{2, "Wipe the cache.\n", false},
+	}
+	for _, test := range testcases {
+		assertBool(t, rules[test.rule].violatedBy(test.comment), test.bad)
+	}
+	_, err = readCommentPolicy(strings.NewReader("maxlen 72\n"))
+	assertBool(t, err != nil, true)
+	_, err = readCommentPolicy(strings.NewReader("require\n"))
+	assertBool(t, err != nil, true)
+}
+
+func TestTranslateIgnore(t *testing.T) {
+	type testcase struct {
+		dialect    string
+		pattern    string
+		translated string
+		ok         bool
+	}
+	var testcases = []testcase{
+		{"svn:ignore", "*.o", "/*.o", true},
+		{"svn:global-ignores", "*.o", "*.o", true},
+		{"svn:global-ignores", "#x", `\#x`, true},
+		{"cvs", "core", "/core", true},
+		{"cvs", "!", "", false},
+		{"hg", "build/*.o", "**/build/*.o", true},
+		{"hg", "re:^foo$", "/foo", true},
+		{"hg", `re:\.o$`, "*.o", true},
+		{"hg", "re:fo(o|x)", "", false},
+		{"bzr", `RE:.*\.pyc`, "*.pyc", true},
+		{"bzr", "./config.h", "/config.h", true},
+		{"bzr", "!keep", "!keep", true},
+		{"git", "doc/*.html", "doc/*.html", true},
+	}
+	for idx, test := range testcases {
+		test := test
+		t.Run(fmt.Sprint(idx), func(t *testing.T) {
+			t.Parallel()
+			translation, err := translateIgnore(test.dialect, test.pattern)
+			assertBool(t, err == nil, true)
+			assertEqual(t, translation.translated, test.translated)
+			assertBool(t, translation.ok, test.ok)
+		})
+	}
+	_, err := translateIgnore("darcs", "x")
+	assertBool(t, err != nil, true)
+}
+
+func TestRenderIgnore(t *testing.T) {
+	type testcase struct {
+		dialect  string
+		pattern  string
+		rendered string
+		ok       bool
+	}
+	var testcases = []testcase{
+		{"cvs", "/core", "core", true},
+		{"cvs", "*.o", "", false},
+		{"cvs", "!keep", "", false},
+		{"cvs", "# comment", "", false},
+		{"svn:global-ignores", "*.o", "*.o", true},
+		{"svn:global-ignores", "doc/*.html", "", false},
+		{"bzr", "/config.h", "./config.h", true},
+		{"bzr", "doc/*.html", "doc/*.html", true},
+		{"bzr", "!keep", "!keep", true},
+		{"hg", "*.o", "*.o", true},
+		{"hg", "**/build/*.o", "build/*.o", true},
+		{"hg", "/top", "re:^top(?:/|$)", true},
+		{"hg", "doc/*.html", `re:^doc/[^/]*\.html(?:/|$)`, true},
+		{"hg", "/build/", "re:^build/", true},
+		{"git", `\#x`, `\#x`, true},
+	}
+	for idx, test := range testcases {
+		test := test
+		t.Run(fmt.Sprint(idx), func(t *testing.T) {
+			t.Parallel()
+			rendered, err := renderIgnore(test.dialect, test.pattern)
+			assertBool(t, err == nil, true)
+			assertEqual(t, rendered.translated, test.rendered)
+			assertBool(t, rendered.ok, test.ok)
+		})
+	}
+}
+
+func TestTranslateIgnoreFile(t *testing.T) {
+	out, dropped, err := translateIgnoreFile("cvs", "git", "core\n*.o\n")
+	assertBool(t, err == nil, true)
+	assertEqual(t, out, "/core\n/*.o\n")
+	assertIntEqual(t, len(dropped), 0)
+	out, dropped, _ = translateIgnoreFile("git", "cvs", out+"*.pyc\n")
+	assertEqual(t, out, "core\n*.o\n")
+	assertIntEqual(t, len(dropped), 1)
+	// hg patterns are regular expressions until a syntax line
+	out, _, _ = translateIgnoreFile("hg", "git", "\\.orig$\nsyntax: glob\n*.rej\n")
+	assertEqual(t, out, "*.orig\n*.rej\n")
+	out, _, _ = translateIgnoreFile("git", "hg", "*.o\n")
+	assertEqual(t, out, "syntax: glob\n*.o\n")
+	_, _, err = translateIgnoreFile("git", "darcs", "")
+	assertBool(t, err != nil, true)
+}
+
+func TestExportLosses(t *testing.T) {
+	rs := newReposurgeon()
+	rs.DoRead("<../test/notes.fi")
+	repo := rs.chosen()
+	assertIntEqual(t, len(repo.exportLosses(nil, true)), 0)
+	assertIntEqual(t, len(repo.exportLosses(findVCS("git"), true)), 0)
+	// A plain stream keeps its notes whatever type is preferred.
+	assertIntEqual(t, len(repo.exportLosses(findVCS("hg"), false)), 0)
+	losses := repo.exportLosses(findVCS("hg"), true)
+	assertIntEqual(t, len(losses), 1)
+	assertEqual(t, losses[0], "hg does not support notes, 1 N fileop(s) will be dropped")
+}
+
+func TestResumePoint(t *testing.T) {
+	rs := newReposurgeon()
+	rs.DoRead("<../test/min.fi")
+	repo := rs.chosen()
+	dir, err := ioutil.TempDir("", "rs-resume")
+	assertBool(t, err == nil, true)
+	defer os.RemoveAll(dir)
+	marksfile := filepath.Join(dir, "marks")
+	// Importers need not write marks in order, and may record
+	// marks the repository no longer has.
+	ioutil.WriteFile(marksfile, []byte(":2 a77286ec1c4761901648263d801ea2eb1bf6a1ac\n:99 8e2a8b736ab536dba90ff754607a22d44de168af\n:1 071dd066f652937e28227b8e9e7de311d65bacef\n"), 0644)
+	resume, err := repo.resumePoint(marksfile)
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, resume, repo.markToIndex(":2")+1)
+	ioutil.WriteFile(marksfile, nil, 0644)
+	resume, err = repo.resumePoint(marksfile)
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, resume, 0)
+	ioutil.WriteFile(marksfile, []byte("not a marks line\n"), 0644)
+	_, err = repo.resumePoint(marksfile)
+	assertBool(t, err != nil, true)
+}
+
+func TestImporterFallback(t *testing.T) {
+	repo := newRepository("fallback")
+	vcs := VCS{
+		name:     "fake",
+		importer: "nonexistent-importer-xyzzy",
+		fallbacks: []importStrategy{
+			{"cat", "false", "a strategy that cannot work", ""},
+			{"cat -", "true", "a strategy that can", ""},
+		},
+	}
+	if _, err := repo.probeImporter(&vcs, "never"); err == nil {
+		t.Error("fallback taken under the never policy")
+	}
+	strategy, err := repo.probeImporter(&vcs, "auto")
+	if err != nil {
+		t.Errorf("unexpected probe failure: %v", err)
+	}
+	assertEqual(t, strategy.importer, "cat -")
+	vcs.fallbacks = vcs.fallbacks[:1]
+	if _, err := repo.probeImporter(&vcs, "auto"); err == nil {
+		t.Error("unusable fallback accepted")
+	}
+}
+
+func TestParseBzrLog(t *testing.T) {
+	log := `------------------------------------------------------------
+revno: 2 [merge]
+tags: v1.0
+revision-id: joe@example.com-20200103100000-aaaa
+parent: joe@example.com-20200101100000-bbbb
+parent: sue@example.com-20200102100000-cccc
+committer: Joe Example <joe@example.com>
+branch nick: trunk
+timestamp: Fri 2020-01-03 10:00:00 +0100
+message:
+  Merge Sue's work.
+  
+  With a second paragraph.
+    ------------------------------------------------------------
+    revno: 1.1.1
+    revision-id: sue@example.com-20200102100000-cccc
+    parent: joe@example.com-20200101100000-bbbb
+    committer: Joe Example <joe@example.com>
+    author: Sue Example <sue@example.com>, Ann Example <ann@example.com>
+    branch nick: feature
+    timestamp: Thu 2020-01-02 10:00:00 +0000
+    message:
+      Sue's change.
+------------------------------------------------------------
+revno: 1
+revision-id: joe@example.com-20200101100000-bbbb
+committer: joe
+branch nick: trunk
+timestamp: Wed 2020-01-01 10:00:00 +0000
+message:
+  Initial.
+`
+	revisions, err := parseBzrLog(strings.NewReader(log))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(revisions), 3)
+	assertEqual(t, revisions[0].message, "Merge Sue's work.\n\nWith a second paragraph.\n")
+	assertEqual(t, strings.Join(revisions[0].tags, ","), "v1.0")
+	assertIntEqual(t, len(revisions[0].parents), 2)
+	assertIntEqual(t, revisions[1].depth, 1)
+	assertEqual(t, revisions[1].author, "Sue Example <sue@example.com>")
+	assertEqual(t, revisions[1].message, "Sue's change.\n")
+	assertIntEqual(t, len(revisions[2].parents), 0)
+	attr, err := bzrAttribution(revisions[0].committer, revisions[0].timestamp)
+	assertBool(t, err == nil, true)
+	assertEqual(t, attr, "Joe Example <joe@example.com> 1578042000 +0100")
+	attr, err = bzrAttribution(revisions[2].committer, revisions[2].timestamp)
+	assertBool(t, err == nil, true)
+	assertEqual(t, attr, "joe <> 1577872800 +0000")
+	_, err = parseBzrLog(strings.NewReader(bzrLogSeparator + "\nrevno: 1\n"))
+	assertBool(t, err != nil, true)
+}
+
+func TestParseBasicIO(t *testing.T) {
+	certs := `      key [0123456789abcdef0123456789abcdef01234567]
+signature "ok"
+     name "changelog"
+    value "Fix the \"frobnicator\".
+
+Second paragraph.
+"
+    trust "trusted"
+
+      key [0123456789abcdef0123456789abcdef01234567]
+signature "ok"
+     name "branch"
+    value "net.example.project"
+    trust "trusted"
+`
+	stanzas, err := parseBasicIO(certs)
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(stanzas), 2)
+	assertEqual(t, stanzas[0][0].values[0], "0123456789abcdef0123456789abcdef01234567")
+	assertEqual(t, stanzas[0][3].values[0], "Fix the \"frobnicator\".\n\nSecond paragraph.\n")
+	assertEqual(t, stanzas[1][3].values[0], "net.example.project")
+	manifest := "format_version \"1\"\n\ndir \"\"\n\n   file \"run.sh\"\ncontent [da39a3ee5e6b4b0d3255bfef95601890afd80709]\n   attr \"mtn:execute\" \"true\"\n"
+	stanzas, err = parseBasicIO(manifest)
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(stanzas), 3)
+	assertEqual(t, strings.Join(stanzas[2][2].values, " "), "mtn:execute true")
+	_, err = parseBasicIO("name \"unterminated")
+	assertBool(t, err != nil, true)
+	assertEqual(t, mtnAttribution("joe@example.com", "2007-03-01T12:00:00"),
+		"joe <joe@example.com> 2007-03-01T12:00:00Z")
+	assertEqual(t, mtnAttribution("Joe <joe@example.com>", "2007-03-01T12:00:00"),
+		"Joe <joe@example.com> 2007-03-01T12:00:00Z")
+}
+
+func TestParseTFVC(t *testing.T) {
+	history := `-------------------------------------------------------------------------------
+Changeset: 12
+User: CORP\sue
+Checked in by: CORP\build
+Date: 2015-06-02 10:00:00
+
+Comment:
+  Branch for release.
+
+  Second paragraph.
+
+Items:
+  branch $/Project/Release
+  branch $/Project/Release/main.c
+  delete $/Project/Main/old.c;X7
+
+-------------------------------------------------------------------------------
+Changeset: 11
+User: CORP\joe
+Date: 1/5/2015 3:04:05 PM
+
+Comment:
+  Initial import.
+
+Items:
+  add $/Project/Main
+  merge, edit $/Project/Main/main.c
+`
+	changesets, err := parseTFVCHistory(strings.NewReader(history))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(changesets), 2)
+	assertIntEqual(t, changesets[0].id, 12)
+	assertEqual(t, changesets[0].user, `CORP\sue`)
+	assertEqual(t, changesets[0].committer, `CORP\build`)
+	assertEqual(t, changesets[0].comment, "Branch for release.\n\nSecond paragraph.\n")
+	assertIntEqual(t, len(changesets[0].changes), 3)
+	assertEqual(t, changesets[0].changes[2].path, "$/Project/Main/old.c")
+	assertEqual(t, strings.Join(changesets[1].changes[1].kinds, "+"), "merge+edit")
+	assertEqual(t, changesets[1].date.Format("2006-01-02 15:04:05"), "2015-01-05 15:04:05")
+	_, err = parseTFVCHistory(strings.NewReader("Changeset: twelve\n"))
+	assertBool(t, err != nil, true)
+
+	labels := `Label  : v1.0@$/Project
+Scope  : $/Project
+Owner  : CORP\joe
+Date   : 2015-06-03 09:00:00
+Comment: First release
+
+Changeset Item
+--------- ------------------------------
+12        $/Project/Release/main.c
+11        $/Project/Release/a file.txt
+`
+	parsed, err := parseTFVCLabels(strings.NewReader(labels))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(parsed), 1)
+	assertEqual(t, parsed[0].name, "v1.0")
+	assertEqual(t, parsed[0].comment, "First release")
+	assertIntEqual(t, parsed[0].items["$/Project/Release/a file.txt"], 11)
+
+	listing := "$/Project:\n$Main\n\n$/Project/Main:\nmain.c\nREADME\n\n3 item(s)\n"
+	files, err := parseTFVCDir(strings.NewReader(listing))
+	assertBool(t, err == nil, true)
+	assertEqual(t, strings.Join(files, " "), "$/Project/Main/main.c $/Project/Main/README")
+	assertEqual(t, parseTFVCWorkfold("Workspace : ws (joe)\nCollection: http://tfs:8080/\n $/Project: /home/joe/project\n"), "$/Project")
+	assertEqual(t, tfvcBranchRef("Main"), "refs/heads/master")
+	assertEqual(t, tfvcBranchRef("Release"), "refs/heads/Release")
+}
+
+func TestParseVSSHistory(t *testing.T) {
+	history := `History of $/project/foo.c ...
+
+**********************
+Label: "Release 1.0"
+User: Admin        Date:  3/15/05   Time:  9:00a
+Labeled
+Label comment: First release
+
+*****************  Version 2   *****************
+User: Joe          Date:  3/14/05   Time:  2:30p
+Checked in $/project
+Comment: Fix the frobnicator.
+Second line.
+
+*****************  Version 1   *****************
+User: Joe          Date: 14.03.05   Time: 09:15
+Created
+`
+	entries, err := parseVSSHistory(strings.NewReader(history))
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(entries), 3)
+	assertBool(t, entries[0].isContent(), false)
+	assertEqual(t, entries[0].label, "Release 1.0")
+	assertEqual(t, entries[0].comment, "First release\n")
+	assertBool(t, entries[1].isContent(), true)
+	assertIntEqual(t, entries[1].version, 2)
+	assertEqual(t, entries[1].user, "Joe")
+	assertEqual(t, entries[1].action, "Checked in $/project")
+	assertEqual(t, entries[1].comment, "Fix the frobnicator.\nSecond line.\n")
+	assertEqual(t, entries[1].date.Format("2006-01-02 15:04"), "2005-03-14 14:30")
+	assertEqual(t, entries[2].date.Format("2006-01-02 15:04"), "2005-03-14 09:15")
+	assertEqual(t, entries[2].comment, "")
+	_, err = parseVSSHistory(strings.NewReader("*****************  Version 1   *****************\nUser: Joe Date: someday Time: noon\n"))
+	assertBool(t, err != nil, true)
+	files, err := parseTFVCDir(strings.NewReader("$/:\n$project\nreadme.txt\n\n$/project:\nfoo.c\n\n3 item(s)\n"))
+	assertBool(t, err == nil, true)
+	assertEqual(t, strings.Join(files, " "), "$/readme.txt $/project/foo.c")
+}
+
+func TestHgBuilderNames(t *testing.T) {
+	assertEqual(t, hgBranch("refs/heads/master"), "default")
+	assertEqual(t, hgBranch("refs/heads/stable"), "stable")
+	attr, err := newAttribution("J. Random Hacker <jrh@example.com> 1392414427 +0100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, date := hgUser(attr)
+	assertEqual(t, user, "J. Random Hacker <jrh@example.com>")
+	assertEqual(t, date, "1392414427 -3600")
+}
+
+func TestGitObjectParsing(t *testing.T) {
+	// Copy "hello " from the base, then insert "there"
+	delta := []byte{11, 11, 0x90, 6, 5, 't', 'h', 'e', 'r', 'e'}
+	result, err := applyGitDelta([]byte("hello world"), delta)
+	assertBool(t, err == nil, true)
+	assertEqual(t, string(result), "hello there")
+	_, err = applyGitDelta([]byte("hello"), delta)
+	assertBool(t, err != nil, true)
+	for mode, want := range map[string]string{"100644": "100644", "100664": "100644", "100775": "100755", "040000": "40000"} {
+		got, _ := canonicalMode(mode)
+		assertEqual(t, got, want)
+	}
+	headers, message := parseGitObject([]byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\ngpgsig -----BEGIN-----\n abc\n -----END-----\n\nSigned.\n"))
+	assertIntEqual(t, len(headers), 2)
+	assertEqual(t, headers[1].name, "gpgsig")
+	assertEqual(t, headers[1].value, "-----BEGIN-----\nabc\n-----END-----")
+	assertEqual(t, message, "Signed.\n")
+}
+
+func TestGitObjectWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rs-gitwrite")
+	assertBool(t, err == nil, true)
+	defer os.RemoveAll(dir)
+	gw := &gitWriter{objects: dir, trees: make(map[*PathMap]gitHashType)}
+	h, err := gw.write("blob", []byte("hello\n"))
+	assertBool(t, err == nil, true)
+	assertEqual(t, h.hexify(), "ce013625030ba8dba906f756967f9e9ca394464a")
+	assertBool(t, exists(filepath.Join(dir, "ce", "013625030ba8dba906f756967f9e9ca394464a")), true)
+	// A directory sorts as if its name ended in a slash, after a.txt,
+	// and an empty one is left out
+	pm := newPathMap()
+	for _, path := range []string{"a/b", "a.txt"} {
+		op := newFileOp(nil)
+		op.construct(opM, "644", "inline", path)
+		op.inline = []byte("hello\n")
+		pm.set(path, op)
+	}
+	pm.dirs["empty"] = newPathMap()
+	h, _, err = gw.tree("", pm)
+	assertBool(t, err == nil, true)
+	assertEqual(t, h.hexify(), "165480a8ee00d9b2e7f603ad75e7357811d78720")
+}
+
+func TestNewGitHash(t *testing.T) {
+	h := newGitHash([]byte("ce013625030ba8dba906f756967f9e9ca394464a"))
+	assertBool(t, h.isValid(), true)
+	assertEqual(t, h.hexify(), "ce013625030ba8dba906f756967f9e9ca394464a")
+	assertBool(t, newGitHash(nil).isValid(), false)
+}
+
+func TestSplitSignature(t *testing.T) {
+	sig := "-----BEGIN PGP SIGNATURE-----\n\nx\n-----END PGP SIGNATURE-----\n"
+	msg, got := splitSignature("release\n" + sig)
+	assertEqual(t, msg, "release\n")
+	assertEqual(t, got, sig)
+	// The armor must start a line
+	_, got = splitSignature("quoting -----BEGIN PGP SIGNATURE-----\n")
+	assertEqual(t, got, "")
+	data := addHeader([]byte("tree t\nauthor a\n\nmessage\n"), "gpgsig", "line1\nline2")
+	assertEqual(t, string(data), "tree t\nauthor a\ngpgsig line1\n line2\n\nmessage\n")
+}
+
+func TestGitmodules(t *testing.T) {
+	text := "# kept\n[submodule \"a\"]\n\tpath = a\n\turl = \"https://example.com/a\"\n[core]\n\tx = y\n"
+	gm := parseGitmodules([]byte(text))
+	assertEqual(t, string(gm.render()), text)
+	assertEqual(t, gm.byPath("a").get("URL"), "https://example.com/a")
+	assertBool(t, gm.byPath("a").set("url", "https://example.com/a"), false)
+	gm.add("b", "lib/b", "https://example.com/b")
+	assertBool(t, gm.remove("a"), true)
+	assertEqual(t, string(gm.render()), "# kept\n[core]\n\tx = y\n[submodule \"b\"]\n\tpath = lib/b\n\turl = https://example.com/b\n")
+	assertBool(t, gm.remove("a"), false)
+	// A file with no sections is to be deleted
+	assertBool(t, parseGitmodules(nil).render() == nil, true)
+}
+
+func TestBlobCodecs(t *testing.T) {
+	content := bytes.Repeat([]byte("All work and no play makes Jack a dull boy.\n"), 100)
+	for _, codec := range blobCodecs {
+		var buf bytes.Buffer
+		w, err := codec.writer(&buf)
+		assertBool(t, err == nil, true)
+		w.Write(content)
+		w.Close()
+		assertBool(t, buf.Len() < len(content), true)
+		r, err := codec.reader(&buf)
+		assertBool(t, err == nil, true)
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		assertBool(t, err == nil, true)
+		assertEqual(t, string(got), string(content))
+		assertBool(t, findBlobCodec(codec.name) == codec, true)
+	}
+	assertBool(t, findBlobCodec("lzma") == nil, true)
+}
+
+func TestBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := sessionBlobStore(dir)
+	assertBool(t, sessionBlobStore(dir) == store, true)
+	key1, size, err := store.put(strings.NewReader("shared content\n"), nil)
+	assertBool(t, err == nil, true)
+	assertEqual(t, fmt.Sprint(size), "15")
+	key2, _, _ := store.put(strings.NewReader("shared content\n"), nil)
+	assertEqual(t, key2, key1)
+	key3, _, _ := store.put(strings.NewReader("shared content\n"), blobCodecs[0])
+	assertBool(t, key3 != key1, true)
+	target := filepath.Join(dir, "linked")
+	assertBool(t, store.link(key1, target) == nil, true)
+	data, _ := ioutil.ReadFile(target)
+	assertEqual(t, string(data), "shared content\n")
+	store.release(key1)
+	assertBool(t, exists(store.path(key1)), true)
+	store.release(key1)
+	assertBool(t, exists(store.path(key1)), false)
+	assertBool(t, exists(target), true)
+	store.release(key3)
+	assertBool(t, exists(store.path(key3)), false)
+}
+
+func TestContentClass(t *testing.T) {
+	for _, item := range []struct {
+		content string
+		class   string
+		binary  bool
+	}{
+		{"plain text\n", "US-ASCII", false},
+		{"caf\xc3\xa9\n", "UTF-8", false},
+		{"caf\xe9\n", "ISO-8859-1", false},
+		{"\x93quoted\x94\n", "windows-1252", false},
+		{"\xff\xfeh\x00i\x00", "UTF-16LE", false},
+		{"\x89PNG\r\n\x1a\nxx", "PNG image", true},
+		{"a\x00b", "binary data", true},
+	} {
+		class, binary := contentClass([]byte(item.content))
+		assertEqual(t, class, item.class)
+		assertBool(t, binary, item.binary)
+	}
+}
+
+func TestLfsHelpers(t *testing.T) {
+	assertBool(t, lfsMatch("*.png", "art/logo.png"), true)
+	assertBool(t, lfsMatch("*.png", "logo.png"), true)
+	assertBool(t, lfsMatch("art/*.png", "art/logo.png"), true)
+	assertBool(t, lfsMatch("/art/*.png", "art/logo.png"), true)
+	assertBool(t, lfsMatch("art/*.png", "src/art/logo.png"), false)
+	pointer := lfsPointer("4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393", 12345)
+	assertEqual(t, string(pointer), "version https://git-lfs.github.com/spec/v1\noid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\nsize 12345\n")
+	assertBool(t, isLfsPointer(pointer), true)
+	assertBool(t, isLfsPointer([]byte("version 1\n")), false)
+	for text, want := range map[string]int64{"100": 100, "2k": 2048, "3M": 3 << 20, "1g": 1 << 30} {
+		got, err := parseByteSize(text)
+		assertBool(t, err == nil, true)
+		assertEqual(t, fmt.Sprint(got), fmt.Sprint(want))
+	}
+	_, err := parseByteSize("k")
+	assertBool(t, err != nil, true)
+}
+
+func TestGitReplacements(t *testing.T) {
+	a := newGitHash([]byte("1111111111111111111111111111111111111111"))
+	b := newGitHash([]byte("2222222222222222222222222222222222222222"))
+	c := newGitHash([]byte("3333333333333333333333333333333333333333"))
+	store := &gitObjectStore{replace: map[gitHashType]gitHashType{a: b, b: c}}
+	assertEqual(t, store.replaced(a).hexify(), c.hexify())
+	assertEqual(t, store.replaced(c).hexify(), c.hexify())
+	// A replacement loop gives up rather than spinning
+	store.replace[c] = a
+	assertBool(t, store.replaced(a).isValid(), true)
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "info"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "info", "grafts"), []byte("# comment\n"+a.hexify()+" "+b.hexify()+" "+c.hexify()+"\n"+c.hexify()+"\n"), 0644)
+	grafts, err := gitGrafts(dir)
+	assertBool(t, err == nil, true)
+	assertIntEqual(t, len(grafts[a]), 2)
+	assertEqual(t, grafts[a][1].hexify(), c.hexify())
+	parents, ok := grafts[c]
+	assertBool(t, ok && len(parents) == 0, true)
+}
+
+func TestGitObjectFormats(t *testing.T) {
+	long := "2ae10840131f90a5262c274dd42766f2ca01da57eda67dd2c65f3f5d1ef81449"
+	h := newGitHash([]byte(long))
+	assertIntEqual(t, int(h.size), 32)
+	assertEqual(t, h.hexify(), long)
+	assertBool(t, h != newGitHash([]byte(long[:40])), true)
+	assertEqual(t, nullGitHash.hexify(), "0000000000000000000000000000000000000000")
+	blob := "blob 6\x00hello\n"
+	assertEqual(t, gitHashFormat("sha1", blob).hexify(), "ce013625030ba8dba906f756967f9e9ca394464a")
+	assertEqual(t, gitHashFormat("sha256", blob).hexify(), "2cf8d83d9ee29543b34a87727421fdecb7e3f3a183d337639025de576db9ebb4")
+	_, err := parseHash(long[:50])
+	assertBool(t, err != nil, true)
+}
+
+func TestQueryResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("local") != "fred" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "Fred J. Foonly <fred@foonly.org> America/New_York\n")
+	}))
+	defer server.Close()
+	who, err := queryResolver(server.URL+"?realm=eng", "fred", "fred", "fred@localhost")
+	assertBool(t, err == nil, true)
+	assertEqual(t, who.fullname, "Fred J. Foonly")
+	assertEqual(t, who.email, "fred@foonly.org")
+	assertEqual(t, who.timezone, "America/New_York")
+	who, err = queryResolver(server.URL, "hilda", "hilda", "hilda@localhost")
+	assertBool(t, err == nil && who == nil, true)
+	who, err = queryResolver("sed -n 's/^hilda = .*/Hilda <hilda@foonly.org>/p'", "hilda", "hilda", "hilda@localhost")
+	assertBool(t, err == nil, true)
+	assertEqual(t, who.email, "hilda@foonly.org")
+	who, err = queryResolver("true", "fred", "fred", "fred@localhost")
+	assertBool(t, err == nil && who == nil, true)
+	_, err = queryResolver("false", "fred", "fred", "fred@localhost")
+	assertBool(t, err != nil, true)
+}
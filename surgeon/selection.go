@@ -35,7 +35,9 @@ func (rs *Reposurgeon) parseSelectionSet(line string) (machine selEvaluator, res
 func (rs *Reposurgeon) evalSelectionSet(machine selEvaluator, repo *Repository) []int {
 	state := rs.evalState(len(repo.events))
 	defer state.release()
-	return rs.imp().evaluate(machine, state)
+	selection := rs.imp().evaluate(machine, state)
+	control.checkMemory("command", "selection evaluation")
+	return selection
 }
 
 func (rs *Reposurgeon) setSelectionSet(line string) (rest string) {
@@ -479,6 +481,8 @@ func (rs *Reposurgeon) evalTextSearch(state selEvalState,
 	checkAuthors := false
 	checkBlobs := false
 	checkBranch := false
+	checkPropKeys := false
+	checkPropValues := false
 	if len(modifiers) != 0 {
 		searchIn = []string{}
 		for _, m := range modifiers {
@@ -486,6 +490,10 @@ func (rs *Reposurgeon) evalTextSearch(state selEvalState,
 				checkAuthors = true
 			} else if m == 'B' {
 				checkBlobs = true
+			} else if m == 'k' {
+				checkPropKeys = true
+			} else if m == 'v' {
+				checkPropValues = true
 			} else if _, ok := searchableAttrs[m]; ok {
 				searchIn = append(searchIn, searchableAttrs[m])
 				if m == 'b' {
@@ -523,6 +531,17 @@ func (rs *Reposurgeon) evalTextSearch(state selEvalState,
 				matchers.Add(it.Value())
 			}
 		}
+		if checkPropKeys || checkPropValues {
+			if c, ok := e.(*Commit); ok && c.properties != nil {
+				for _, key := range c.properties.keys {
+					if (checkPropKeys && search.MatchString(key)) ||
+						(checkPropValues && search.MatchString(c.properties.get(key))) {
+						matchers.Add(it.Value())
+						break
+					}
+				}
+			}
+		}
 	}
 	for it.Next() {
 		e := events[it.Value()]
@@ -558,6 +577,9 @@ func (rs *Reposurgeon) functions() map[string]selEvaluator {
 		"anc": func(state selEvalState, subarg *fastOrderedIntSet) *fastOrderedIntSet {
 			return rs.ancHandler(state, subarg)
 		},
+		"tsm": func(state selEvalState, subarg *fastOrderedIntSet) *fastOrderedIntSet {
+			return rs.tsmHandler(state, subarg)
+		},
 	}
 }
 
@@ -585,6 +607,42 @@ func (rs *Reposurgeon) ancHandler(state selEvalState, subarg *fastOrderedIntSet)
 		func(c *Commit) []CommitLike { return c.parents() }, true)
 }
 
+// limitedFunction returns the form of a graph-walking function that
+// stops after depth steps, or nil if the function has none.
+func (rs *Reposurgeon) limitedFunction(name string, depth int) selEvaluator {
+	var operation func(c *Commit) []CommitLike
+	switch name {
+	case "anc":
+		operation = func(c *Commit) []CommitLike { return c.parents() }
+	case "dsc":
+		operation = func(c *Commit) []CommitLike { return c.children() }
+	default:
+		return nil
+	}
+	return func(state selEvalState, subarg *fastOrderedIntSet) *fastOrderedIntSet {
+		return rs.chosen().walkCommits(subarg, operation, depth)
+	}
+}
+
+// All commits with a tree identical to that of a commit in the selection set.
+func (rs *Reposurgeon) tsmHandler(state selEvalState, subarg *fastOrderedIntSet) *fastOrderedIntSet {
+	repo := rs.chosen()
+	trees := make(map[gitHashType]bool)
+	for _, commit := range repo.commits(newOrderedIntSet(subarg.Values()...)) {
+		trees[commit.manifest().gitHash(repo.objectFormat)] = true
+	}
+	result := newFastOrderedIntSet()
+	if len(trees) == 0 {
+		return result
+	}
+	repo.walkManifests(func(idx int, commit *Commit, _ int, _ *Commit) {
+		if trees[commit.manifest().gitHash(repo.objectFormat)] {
+			result.Add(idx)
+		}
+	})
+	return result
+}
+
 type selEvalState interface {
 	nItems() int
 	allItems() *fastOrderedIntSet
@@ -1071,6 +1129,15 @@ func (p *SelectionParser) parseFuncall() selEvaluator {
 	for p.peek() == '_' || unicode.IsLetter(p.peek()) {
 		funname.WriteRune(p.pop())
 	}
+	// A number after the name limits how far a graph walk goes
+	depth := -1
+	var digits strings.Builder
+	for unicode.IsDigit(p.peek()) {
+		digits.WriteRune(p.pop())
+	}
+	if digits.Len() > 0 {
+		depth, _ = strconv.Atoi(digits.String())
+	}
 	if funname.Len() == 0 || p.peek() != '(' {
 		return nil
 	}
@@ -1097,6 +1164,9 @@ func (p *SelectionParser) parseFuncall() selEvaluator {
 	type extraFuncs interface {
 		functions() map[string]selEvaluator
 	}
+	type limitedFuncs interface {
+		limitedFunction(name string, depth int) selEvaluator
+	}
 	var op selEvaluator
 	if q, ok := p.subclass.(extraFuncs); ok {
 		op = q.functions()[funname.String()]
@@ -1107,6 +1177,15 @@ func (p *SelectionParser) parseFuncall() selEvaluator {
 	if op == nil {
 		panic(throw("command", "no such function @%s()", funname.String()))
 	}
+	if depth >= 0 {
+		op = nil
+		if q, ok := p.subclass.(limitedFuncs); ok {
+			op = q.limitedFunction(funname.String(), depth)
+		}
+		if op == nil {
+			panic(throw("command", "function @%s() takes no depth limit", funname.String()))
+		}
+	}
 	return func(x selEvalState, s *fastOrderedIntSet) *fastOrderedIntSet {
 		return op(x, subarg(x, s))
 	}
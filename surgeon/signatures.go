@@ -0,0 +1,266 @@
+// This module finds the signatures on commits and tags, tells which of
+// them surgery has invalidated, and applies the repository's signing
+// policy to those when it is written.
+//
+// A commit signature is the gpgsig (or gpgsig-sha256) header, kept as
+// a commit property by the native git reader; git fast-export drops
+// it. A tag signature is the armored block ending the tag comment, as
+// git fast-export --signed-tags=verbatim leaves it.
+//
+// A signature is intact while the object it is on would still be
+// written with the object name it was read with, since that name is a
+// hash of everything signed. Both the commit and all its ancestors
+// must be untouched for that, and for a tag the commit it points at
+// too. Objects read without an original object ID cannot be checked,
+// and their signatures are written as they stand. The check can be
+// made for a native rebuild, which writes commit headers back, or for
+// git fast-import, which drops them; in the latter case no commit
+// signature survives, and every commit descended from a signed one
+// gets a new name.
+//
+// An invalidated signature is stripped by default. The policy can be
+// to keep it, so that it fails to verify, or to re-sign the object by
+// running a command given the object as it will be written, which is
+// expected to print a detached armored signature as "gpg -bsa" does.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// signatureArmors begin the signature blocks git writes.
+var signatureArmors = []string{
+	"-----BEGIN PGP SIGNATURE-----",
+	"-----BEGIN SSH SIGNATURE-----",
+	"-----BEGIN SIGNED MESSAGE-----",
+}
+
+// signPolicies are the things that can be done with an invalidated
+// signature.
+var signPolicies = newOrderedStringSet("strip", "keep", "resign")
+
+// splitSignature splits a tag comment into its message and the
+// signature block ending it, which is empty if there is none.
+func splitSignature(comment string) (string, string) {
+	start := -1
+	for _, armor := range signatureArmors {
+		if i := strings.LastIndex(comment, armor); i > start && (i == 0 || comment[i-1] == '\n') {
+			start = i
+		}
+	}
+	if start < 0 {
+		return comment, ""
+	}
+	return comment[:start], comment[start:]
+}
+
+// signature returns the name and value of a commit's signature
+// header, or empty strings if it is unsigned.
+func (commit *Commit) signature() (string, string) {
+	if commit.hasProperties() {
+		for _, name := range gitSignatureHeaders {
+			if commit.properties.has(name) {
+				return name, commit.properties.get(name)
+			}
+		}
+	}
+	return "", ""
+}
+
+// tagObject renders a tag object pointing at a commit.
+func tagObject(tag *Tag, target gitHashType, comment string) []byte {
+	var sb strings.Builder
+	sb.WriteString("object " + target.hexify() + "\n")
+	sb.WriteString("type commit\n")
+	sb.WriteString("tag " + tag.getHumanName() + "\n")
+	if tag.tagger != nil {
+		sb.WriteString("tagger " + tag.tagger.String() + "\n")
+	}
+	sb.WriteString("\n")
+	sb.WriteString(comment)
+	return []byte(sb.String())
+}
+
+// objectHash returns the name git gives an object in a repository of
+// the given object format.
+func objectHash(format string, kind string, data []byte) gitHashType {
+	return gitHashFormat(format, fmt.Sprintf("%s %d\x00", kind, len(data))+string(data))
+}
+
+// addHeader adds a header, continuation lines and all, to the end of
+// the headers of a commit object.
+func addHeader(data []byte, name string, value string) []byte {
+	end := bytes.Index(data, []byte("\n\n")) + 1
+	header := name + " " + strings.Replace(value, "\n", "\n ", -1) + "\n"
+	var out []byte
+	out = append(out, data[:end]...)
+	out = append(out, header...)
+	return append(out, data[end:]...)
+}
+
+// hasSignatures tells whether any commit or tag is signed.
+func (repo *Repository) hasSignatures() bool {
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			if name, _ := event.signature(); name != "" {
+				return true
+			}
+		case *Tag:
+			if _, sig := splitSignature(event.Comment); sig != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signatureStates tells, for each signed commit and tag with an
+// original object ID, whether it would still be written with that
+// name, natively or through fast-import. It also returns the name
+// each commit would get with its signature left alone.
+func (repo *Repository) signatureStates(native bool) (map[Event]bool, map[*Commit]gitHashType) {
+	states := make(map[Event]bool)
+	hashes := make(map[*Commit]gitHashType)
+	all := func(string) bool { return true }
+	none := func(string) bool { return false }
+	for _, event := range repo.events {
+		switch event := event.(type) {
+		case *Commit:
+			tree := event.manifest().gitHash(repo.objectFormat)
+			var parents []gitHashType
+			for _, parent := range event.parents() {
+				if p, ok := parent.(*Commit); ok {
+					parents = append(parents, hashes[p])
+				}
+			}
+			var h gitHashType
+			if native {
+				h = objectHash(repo.objectFormat, "commit", commitObject(event, tree, parents, all))
+				if h != event.oid {
+					h = objectHash(repo.objectFormat, "commit", commitObject(event, tree, parents, gitKnownHeaders.Contains))
+				}
+			} else {
+				h = objectHash(repo.objectFormat, "commit", commitObject(event, tree, parents, none))
+			}
+			hashes[event] = h
+			if name, _ := event.signature(); name != "" && event.oid.isValid() {
+				states[event] = h == event.oid
+			}
+		case *Tag:
+			target, ok := repo.markToEvent(event.committish).(*Commit)
+			if _, sig := splitSignature(event.Comment); sig != "" && event.oid.isValid() && ok {
+				states[event] = objectHash(repo.objectFormat, "tag", tagObject(event, hashes[target], event.Comment)) == event.oid
+			}
+		}
+	}
+	return states, hashes
+}
+
+// signer applies a repository's signing policy during one write and
+// counts what it did.
+type signer struct {
+	repo     *Repository
+	stripped int
+	resigned int
+	kept     int
+}
+
+// settle decides what becomes of an invalidated signature: it returns
+// the old one, none, or a new one made over payload, the object as it
+// will be written without a signature.
+func (s *signer) settle(what string, old string, payload []byte) (string, error) {
+	switch s.repo.signPolicy {
+	case "keep":
+		s.kept++
+		return old, nil
+	case "resign":
+		cmd := exec.Command("sh", "-c", s.repo.signHook)
+		cmd.Stdin = bytes.NewReader(payload)
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("re-signing %s: %v %s", what, err, strings.TrimSpace(stderr.String()))
+		}
+		if _, sig := splitSignature(string(out)); sig == "" {
+			return "", fmt.Errorf("re-signing %s: %q printed no signature", what, s.repo.signHook)
+		}
+		s.resigned++
+		return string(out), nil
+	default:
+		s.stripped++
+		if logEnable(logWARN) {
+			logit("%s has been altered since it was signed; signature stripped", what)
+		}
+		return "", nil
+	}
+}
+
+// report logs what the signer did.
+func (s *signer) report() {
+	if !logEnable(logWARN) {
+		return
+	}
+	if s.stripped > 0 {
+		logit("%d invalidated signatures were stripped", s.stripped)
+	}
+	if s.kept > 0 {
+		logit("%d invalidated signatures were kept and will not verify", s.kept)
+	}
+	if s.resigned > 0 {
+		logit("%d objects were re-signed", s.resigned)
+	}
+}
+
+// settleTagSignatures returns the comments that tags with invalidated
+// signatures are to be written to a fast-import stream with.
+func (repo *Repository) settleTagSignatures() (map[*Tag]string, error) {
+	if !repo.hasSignatures() {
+		return nil, nil
+	}
+	states, hashes := repo.signatureStates(false)
+	s := &signer{repo: repo}
+	comments := make(map[*Tag]string)
+	for _, event := range repo.events {
+		tag, ok := event.(*Tag)
+		if !ok {
+			continue
+		}
+		if intact, known := states[tag]; !known || intact {
+			continue
+		}
+		message, old := splitSignature(tag.Comment)
+		target := repo.markToEvent(tag.committish).(*Commit)
+		sig, err := s.settle("tag "+tag.getHumanName(), old, tagObject(tag, hashes[target], message))
+		if err != nil {
+			return nil, err
+		}
+		comments[tag] = message + sig
+	}
+	s.report()
+	return comments, nil
+}
+
+// setSignPolicy sets what is done with invalidated signatures.
+func (repo *Repository) setSignPolicy(policy string, hook string) error {
+	if !signPolicies.Contains(policy) {
+		return fmt.Errorf("no such signing policy as %q", policy)
+	}
+	if policy == "resign" && hook == "" {
+		return errors.New("resign needs a signing command")
+	}
+	if policy != "resign" && hook != "" {
+		return fmt.Errorf("%s takes no command", policy)
+	}
+	repo.signPolicy, repo.signHook = policy, hook
+	return nil
+}
@@ -0,0 +1,370 @@
+// This module gives git submodules first-class treatment. A submodule
+// is a gitlink, an M fileop of mode 160000 whose data is the object
+// name of a commit in another repository, together with a section of
+// the top-level .gitmodules file naming its path and URL. The commands
+// that add, remove, retarget, and rename submodules change both, so
+// that the .gitmodules each commit sees goes on describing the
+// gitlinks in its tree.
+//
+// .gitmodules is edited a section at a time, in each selected commit
+// whose view of it needs the edit; a commit inheriting an edited file
+// from its parent is left alone. Sections that are not touched keep
+// their text, comments included, and a file left with no sections is
+// deleted.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// gitmodulesPath is where git looks for submodule definitions.
+const gitmodulesPath = ".gitmodules"
+
+// gitlinkMode is the mode of a fileop naming a submodule commit.
+const gitlinkMode = "160000"
+
+// gitmoduleHeaderRE matches the header of a submodule section.
+var gitmoduleHeaderRE = regexp.MustCompile(`^\s*\[\s*submodule\s+"((?:[^"\\]|\\.)*)"\s*\]`)
+
+// gitmoduleSection is one section of a .gitmodules file.
+type gitmoduleSection struct {
+	name  string   // Submodule name, empty for sections of other kinds
+	lines []string // Header first
+}
+
+// gitmodules is a parsed .gitmodules file.
+type gitmodules struct {
+	preamble []string
+	sections []*gitmoduleSection
+}
+
+// parseGitmodules parses the text of a .gitmodules file.
+func parseGitmodules(data []byte) *gitmodules {
+	gm := new(gitmodules)
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return gm
+	}
+	var current *gitmoduleSection
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			current = &gitmoduleSection{lines: []string{line}}
+			if m := gitmoduleHeaderRE.FindStringSubmatch(line); m != nil {
+				current.name = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(m[1])
+			}
+			gm.sections = append(gm.sections, current)
+		} else if current != nil {
+			current.lines = append(current.lines, line)
+		} else {
+			gm.preamble = append(gm.preamble, line)
+		}
+	}
+	return gm
+}
+
+// render returns the text of a .gitmodules file, or nil if it has no
+// sections.
+func (gm *gitmodules) render() []byte {
+	if len(gm.sections) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, line := range gm.preamble {
+		sb.WriteString(line + "\n")
+	}
+	for _, section := range gm.sections {
+		for _, line := range section.lines {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return []byte(sb.String())
+}
+
+// get returns the value of a key in a section, or "" if it is unset.
+// As in git config, keys ignore case and the last setting wins.
+func (s *gitmoduleSection) get(key string) string {
+	value := ""
+	for _, line := range s.lines[1:] {
+		k, v, ok := splitGitmoduleLine(line)
+		if ok && strings.EqualFold(k, key) {
+			value = v
+		}
+	}
+	return value
+}
+
+// set gives a key in a section a value, replacing its last setting or
+// adding one, and tells whether that changed anything.
+func (s *gitmoduleSection) set(key string, value string) bool {
+	for i := len(s.lines) - 1; i > 0; i-- {
+		k, v, ok := splitGitmoduleLine(s.lines[i])
+		if ok && strings.EqualFold(k, key) {
+			if v == value {
+				return false
+			}
+			s.lines[i] = "\t" + key + " = " + value
+			return true
+		}
+	}
+	s.lines = append(s.lines, "\t"+key+" = "+value)
+	return true
+}
+
+// splitGitmoduleLine splits a key-value line, dropping any quotes
+// around the value.
+func splitGitmoduleLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == ';' {
+		return "", "", false
+	}
+	eq := strings.Index(line, "=")
+	if eq < 0 {
+		return "", "", false
+	}
+	value := strings.TrimSpace(line[eq+1:])
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.TrimSpace(line[:eq]), value, true
+}
+
+// byPath returns the submodule section for a path, or nil.
+func (gm *gitmodules) byPath(path string) *gitmoduleSection {
+	for _, section := range gm.sections {
+		if section.name != "" && section.get("path") == path {
+			return section
+		}
+	}
+	return nil
+}
+
+// add appends a submodule section.
+func (gm *gitmodules) add(name string, path string, url string) *gitmoduleSection {
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name)
+	section := &gitmoduleSection{
+		name:  name,
+		lines: []string{fmt.Sprintf("[submodule \"%s\"]", quoted)},
+	}
+	section.set("path", path)
+	section.set("url", url)
+	gm.sections = append(gm.sections, section)
+	return section
+}
+
+// remove drops the submodule section for a path and tells whether
+// there was one.
+func (gm *gitmodules) remove(path string) bool {
+	for i, section := range gm.sections {
+		if section.name != "" && section.get("path") == path {
+			gm.sections = append(gm.sections[:i], gm.sections[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// gitlinkAt returns the object name a commit's tree has a gitlink to
+// at a path, and whether there is one.
+func gitlinkAt(commit *Commit, path string) (string, bool) {
+	if entry, ok := commit.manifest().get(path); ok {
+		if op := entry.(*FileOp); op.mode == gitlinkMode {
+			return op.ref, true
+		}
+	}
+	return "", false
+}
+
+// gitmodulesAt returns the .gitmodules file a commit sees.
+func gitmodulesAt(commit *Commit) *gitmodules {
+	if entry, ok := commit.manifest().get(gitmodulesPath); ok && entry.(*FileOp).mode != gitlinkMode {
+		data, _ := commit.blobByName(gitmodulesPath)
+		return parseGitmodules(data)
+	}
+	return new(gitmodules)
+}
+
+// editGitmodules applies an edit to the .gitmodules file each of the
+// commits sees, in order, and writes the result into each commit the
+// edit changed. It returns the number of commits changed.
+func (repo *Repository) editGitmodules(commits []*Commit, edit func(*gitmodules) bool) int {
+	changed := 0
+	for _, commit := range commits {
+		gm := gitmodulesAt(commit)
+		if !edit(gm) {
+			continue
+		}
+		changed++
+		var kept []*FileOp
+		for _, op := range commit.operations() {
+			if (op.op == opM || op.op == opD) && op.Path == gitmodulesPath {
+				continue
+			}
+			kept = append(kept, op)
+		}
+		commit.setOperations(kept)
+		if data := gm.render(); data != nil {
+			op := newFileOp(repo).construct(opM, "100644", "inline", gitmodulesPath)
+			op.inline = data
+			commit.appendOperation(op)
+		} else if commit.manifest().has(gitmodulesPath) {
+			commit.appendOperation(newFileOp(repo).construct(opD, gitmodulesPath))
+		}
+	}
+	return changed
+}
+
+// addSubmodule links a path in each of the commits to a commit of
+// the repository at url, and describes it in .gitmodules.
+func (repo *Repository) addSubmodule(commits []*Commit, path string, url string, target string, name string, branch string) error {
+	if _, err := parseHash(target); err != nil {
+		return err
+	}
+	if path == gitmodulesPath {
+		return fmt.Errorf("%s cannot be a submodule", gitmodulesPath)
+	}
+	for _, commit := range commits {
+		if _, isLink := gitlinkAt(commit, path); !isLink && commit.manifest().has(path) {
+			return fmt.Errorf("%s already exists at %s", path, commit.idMe())
+		}
+	}
+	for _, commit := range commits {
+		if ref, _ := gitlinkAt(commit, path); ref != target {
+			commit.appendOperation(newFileOp(repo).construct(opM, gitlinkMode, target, path))
+		}
+	}
+	if name == "" {
+		name = path
+	}
+	repo.editGitmodules(commits, func(gm *gitmodules) bool {
+		section := gm.byPath(path)
+		changed := false
+		if section == nil {
+			section = gm.add(name, path, url)
+			changed = true
+		} else {
+			changed = section.set("url", url)
+		}
+		if branch != "" {
+			changed = section.set("branch", branch) || changed
+		}
+		return changed
+	})
+	return nil
+}
+
+// removeSubmodule takes the gitlink at a path out of the trees of the
+// commits, and its section out of .gitmodules. It returns the number
+// of commits that had it.
+func (repo *Repository) removeSubmodule(commits []*Commit, path string) int {
+	removed := 0
+	for _, commit := range commits {
+		var kept []*FileOp
+		had := false
+		for _, op := range commit.operations() {
+			if op.op == opM && op.mode == gitlinkMode && op.Path == path {
+				had = true
+				continue
+			}
+			kept = append(kept, op)
+		}
+		if had {
+			commit.setOperations(kept)
+		}
+		if _, ok := gitlinkAt(commit, path); ok {
+			commit.appendOperation(newFileOp(repo).construct(opD, path))
+			had = true
+		}
+		if had {
+			removed++
+		}
+	}
+	repo.editGitmodules(commits, func(gm *gitmodules) bool {
+		return gm.remove(path)
+	})
+	return removed
+}
+
+// retargetSubmodule changes the commits the gitlinks at a path set in
+// the commits name, either to target or through a map from old names
+// to new ones, and sets the URL in .gitmodules if url is nonempty.
+// It returns the number of gitlinks changed.
+func (repo *Repository) retargetSubmodule(commits []*Commit, path string, target string, mapping map[string]string, url string) int {
+	retargeted := 0
+	for _, commit := range commits {
+		for _, op := range commit.operations() {
+			if op.op != opM || op.mode != gitlinkMode || op.Path != path {
+				continue
+			}
+			newref := target
+			if mapping != nil {
+				var ok bool
+				if newref, ok = mapping[op.ref]; !ok {
+					if logEnable(logWARN) {
+						logit("gitlink %s at %s names %s, which is not in the map", path, commit.idMe(), op.ref)
+					}
+					continue
+				}
+			}
+			if newref != op.ref {
+				op.ref = newref
+				commit.invalidateManifests()
+				retargeted++
+			}
+		}
+	}
+	if url != "" {
+		repo.editGitmodules(commits, func(gm *gitmodules) bool {
+			section := gm.byPath(path)
+			return section != nil && section.set("url", url)
+		})
+	}
+	return retargeted
+}
+
+// renameSubmodules follows gitlinks renamed in the commits, given as
+// a map from old paths to new, with the paths in .gitmodules.
+func (repo *Repository) renameSubmodules(commits []*Commit, renamed map[string]string) {
+	repo.editGitmodules(commits, func(gm *gitmodules) bool {
+		changed := false
+		for _, section := range gm.sections {
+			if newpath, ok := renamed[section.get("path")]; ok && section.name != "" {
+				changed = section.set("path", newpath) || changed
+			}
+		}
+		return changed
+	})
+}
+
+// readGitlinkMap reads a map from old commit names to new ones, one
+// pair to a line, such as git filter-repo leaves in commit-map.
+func readGitlinkMap(r io.Reader) (map[string]string, error) {
+	mapping := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) == 2 && fields[0] == "old" && fields[1] == "new" {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of the map is malformed", lineno)
+		}
+		for _, field := range fields {
+			if _, err := parseHash(field); err != nil {
+				return nil, fmt.Errorf("line %d of the map: %v", lineno, err)
+			}
+		}
+		mapping[fields[0]] = fields[1]
+	}
+	return mapping, scanner.Err()
+}
@@ -53,6 +53,7 @@ type svnReader struct {
 	backfrom   map[revidx]revidx      // Phases 1 to 5
 	streamview []*NodeAction          // Phases 1 to 2. All nodes in stream order
 	hashmap    map[string]*NodeAction // Phases 1 to 5
+	blobByHash map[string]*Blob       // Phase 1
 	history    *History               // Phases 3 to 4.
 	// Filled in svnSplitResolve
 	markToSVNBranch map[string]string // Phases 6 to B
@@ -64,6 +65,10 @@ type svnReader struct {
 	// of branch deletions since the commit recreating the branch is also root)
 	// Filled in svnSplitResolve
 	branchRoots map[string][]*Commit // Phases 6 to C
+	// Revisions eligible for storm coalescing, nil if all are
+	stormRevisions map[revidx]bool // Phases 1 to D
+	// Revisions that only change properties, nil unless asked to squash them
+	propertyRevisions map[revidx]bool // Phases 1 to C
 }
 
 func (sp *svnReader) maxRev() revidx {
@@ -404,6 +409,7 @@ func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet,
 	sp.revmap = make(map[revidx]revidx)
 	sp.backfrom = make(map[revidx]revidx)
 	sp.hashmap = make(map[string]*NodeAction)
+	sp.blobByHash = make(map[string]*Blob)
 
 	trackSymlinks := newOrderedStringSet()
 	propertyStash := make(map[string]*OrderedMap)
@@ -466,8 +472,24 @@ func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet,
 						if tlen > -1 {
 							start := sp.tell()
 							text := sp.sdReadBlob(tlen)
-							node.blob = newBlob(sp.repo)
-							node.blob.setContent(text, start)
+							// Content identical to a blob already read, as in the
+							// file copies cvs2svn generates by the thousand, shares
+							// that Blob rather than storing another copy. Phase 6
+							// then finds the earlier node through the hashmap and
+							// gives this one its mark.  Symlinks are excluded
+							// because their content gets rewritten below.
+							isLink := bytes.HasPrefix(text, []byte("link "))
+							if shared, ok := sp.blobByHash[node.contentHash]; ok && !isLink {
+								node.blob = shared
+								sp.repo.sharedBlobs++
+								sp.repo.sharedBytes += int64(len(text))
+							} else {
+								node.blob = newBlob(sp.repo)
+								node.blob.setContent(text, start)
+								if node.contentHash != "" && !isLink {
+									sp.blobByHash[node.contentHash] = node.blob
+								}
+							}
 							// Ugh - cope with strange undocumented Subversion
 							// format for storing links.  On a symlink add, the dumper
 							// uses the link source as the node path; the link target
@@ -478,7 +500,7 @@ func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet,
 							// which paths are currently symlinks, and take off
 							// that mark when a path is deleted in case it
 							// later gets recreated as a non-sym link.
-							if bytes.HasPrefix(text, []byte("link ")) {
+							if isLink {
 								if node.hasProperties() && node.props.has("svn:special") {
 									trackSymlinks.Add(node.path)
 								}
@@ -642,6 +664,10 @@ func (sp *StreamParser) parseSubversion(ctx context.Context, options *stringSet,
 	if logEnable(logSVNPARSE) {
 		logit("revision parsing, line %d: ends with %d records", sp.importLine, sp.repo.legacyCount)
 	}
+	if logEnable(logEXTRACT) {
+		logit("%d duplicate blobs (%d bytes) shared while parsing", sp.repo.sharedBlobs, sp.repo.sharedBytes)
+	}
+	sp.blobByHash = nil
 	sp.timeMark("parsing")
 	sp.svnProcess(ctx, *options, baton)
 }
@@ -830,6 +856,17 @@ var blankline = regexp.MustCompile(`(?m:^\s*\n)`)
 // Separator used for split part in a processed Subversion ID.
 const splitSep = "."
 
+// legacyRevision returns the Subversion revision number a processed
+// Subversion ID was made from, ignoring any split-part suffix.
+func legacyRevision(legacyID string) int {
+	end := 0
+	for end < len(legacyID) && legacyID[end] >= '0' && legacyID[end] <= '9' {
+		end++
+	}
+	rev, _ := strconv.Atoi(legacyID[:end])
+	return rev
+}
+
 // Path separator as found in Subversion dump files. Isolated because
 // it might be "\" on OSes not to be mentioned in polite company.
 var svnSep = string([]byte{os.PathSeparator})
@@ -916,6 +953,7 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 	timeit := func(tag string) {
 		runtime.GC()
 		sp.timeMark(tag)
+		control.checkMemory("parse", "Subversion phase "+tag)
 		if control.flagOptions["bigprofile"] {
 			e := len(sp.repo.timings) - 1
 			fmt.Fprintf(baton, "%s:%v...", tag, sp.repo.timings[e].stamp.Sub(sp.repo.timings[e-1].stamp))
@@ -925,6 +963,8 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 	}
 
 	sp.initBranchify()
+	sp.findStormRevisions(options)
+	sp.findPropertyRevisions(options)
 
 	sp.repo.addEvent(newPassthrough(sp.repo, "#reposurgeon sourcetype svn\n"))
 
@@ -946,13 +986,26 @@ func (sp *StreamParser) svnProcess(ctx context.Context, options stringSet, baton
 	timeit("links")
 	svnProcessMergeinfos(ctx, sp, options, baton)
 	timeit("mergeinfo")
+	svnProcessExternals(ctx, sp, options, baton)
+	timeit("externals")
 	svnProcessIgnores(ctx, sp, options, baton)
 	timeit("ignores")
 	svnProcessJunk(ctx, sp, options, baton)
 	timeit("dejunk")
+	svnCoalesceStorms(ctx, sp, options, baton)
+	timeit("storms")
 	svnProcessRenumber(ctx, sp, options, baton)
 	timeit("renumbering")
 
+	// Remember the revision metadata as read, so that edits to it
+	// can later be written back as revprop changes.
+	sp.repo.revpropBase = make(map[*Commit]*revpropBaseline)
+	for _, event := range sp.repo.events {
+		if commit, ok := event.(*Commit); ok {
+			sp.repo.revpropBase[commit] = newRevpropBaseline(commit)
+		}
+	}
+
 	// Treat this in-core state as though it was read from an SVN repo
 	sp.repo.hint("svn", "", true)
 }
@@ -1296,6 +1349,12 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 	if logEnable(logEXTRACT) {
 		logit("SVN Phase 5: build commits")
 	}
+	var anonymous string
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--anonymous-author=") {
+			anonymous = option[len("--anonymous-author="):]
+		}
+	}
 	baton.startProgress("SVN phase 5: build commits", uint64(len(sp.revisions)))
 
 	var lastcommit *Commit
@@ -1321,6 +1380,9 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 		var au string
 		if record.author != "" {
 			au = record.author
+		} else if anonymous != "" {
+			// DAV autoversioning commits carry no svn:author
+			au = anonymous
 		} else {
 			au = "no-author"
 		}
@@ -1363,7 +1425,7 @@ func svnGenerateCommits(ctx context.Context, sp *StreamParser, options stringSet
 			commit.committer.date.setTZ("UTC")
 		}
 		if record.props.Len() > 0 {
-			commit.properties = &record.props
+			commit.properties = copyOrderedMap(&record.props)
 			record.props.Clear()
 		}
 
@@ -1646,6 +1708,32 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 		logit("SVN Phase 6: split resolution")
 	}
 
+	// Options controlling how the splits are made and labeled
+	splitwarn := "\n[[Split portion of a mixed commit.]]\n"
+	splitfmt := splitSep + "%d"
+	trunkFirst := options.Contains("--split-trunk-first")
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--split-comment=") {
+			text, err := stringEscape(option[len("--split-comment="):])
+			if err != nil {
+				panic(throw("parse", "ill-formed --split-comment: %v", err))
+			}
+			if text == "" {
+				splitwarn = ""
+			} else {
+				splitwarn = "\n" + text + "\n"
+			}
+		} else if strings.HasPrefix(option, "--split-suffix=") {
+			splitfmt = option[len("--split-suffix="):]
+			// The suffix must not look like part of the revision
+			// number, or later phases could not recover it.
+			if strings.Count(splitfmt, "%") != 1 || !strings.Contains(splitfmt, "%d") ||
+				splitfmt[0] >= '0' && splitfmt[0] <= '9' {
+				panic(throw("parse", "--split-suffix needs exactly one %%d and must not begin with a digit"))
+			}
+		}
+	}
+
 	type clique struct {
 		start  int
 		branch string
@@ -1660,12 +1748,33 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 	baton.startProgress("SVN phase 6a: split detection", uint64(len(sp.repo.events)))
 	walkEvents(sp.repo.events, func(i int, event Event) {
 		if commit, ok := event.(*Commit); ok {
-			var oldbranch, newbranch string
+			var oldbranch string
 			cliques := make([]clique, 0)
 			// We only generated M and D ops, or special deleteall ops with
 			// their path set, therefore we only care about the Path member.
+			branches := make([]string, len(commit.fileops))
 			for j, fileop := range commit.fileops {
-				newbranch, commit.fileops[j].Path = sp.splitSVNBranchPath(fileop.Path)
+				branches[j], commit.fileops[j].Path = sp.splitSVNBranchPath(fileop.Path)
+			}
+			if trunkFirst {
+				// Ops on different branches are independent, so
+				// moving the trunk ones to the front to keep them on
+				// the base commit is safe.
+				var trunkops, otherops []*FileOp
+				var trunkbranches, otherbranches []string
+				for j, fileop := range commit.fileops {
+					if branches[j] == "trunk" {
+						trunkops = append(trunkops, fileop)
+						trunkbranches = append(trunkbranches, branches[j])
+					} else {
+						otherops = append(otherops, fileop)
+						otherbranches = append(otherbranches, branches[j])
+					}
+				}
+				commit.fileops = append(trunkops, otherops...)
+				branches = append(trunkbranches, otherbranches...)
+			}
+			for j, newbranch := range branches {
 				if j == 0 || newbranch != oldbranch {
 					cliques = append([]clique{clique{j, newbranch}}, cliques...)
 					oldbranch = newbranch
@@ -1694,7 +1803,6 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 	// The previous parallel loop generated splits in random order.
 	// Sort them back to front so that when we process them we never have to
 	// worry about a commit index changing due to insertion.
-	const splitwarn = "\n[[Split portion of a mixed commit.]]\n"
 	sort.Slice(splits, func(i, j int) bool { return splits[i].loc > splits[j].loc })
 	for i, split := range splits {
 		base := sp.repo.events[split.loc].(*Commit)
@@ -1706,18 +1814,22 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 			sp.repo.splitCommitByIndex(split.loc, clique.start)
 		}
 		baseID := base.legacyID
+		fragments := []*Commit{base}
 		base.Comment += splitwarn
-		base.legacyID += ".1"
+		base.legacyID += fmt.Sprintf(splitfmt, 1)
 		sp.repo.legacyMap["SVN:"+base.legacyID] = base
 		delete(sp.repo.legacyMap, "SVN:"+baseID)
 		for j := 1; j <= len(split.cliques); j++ {
 			fragment := sp.repo.events[split.loc+j].(*Commit)
-			fragment.legacyID = baseID + "." + strconv.Itoa(j+1)
+			fragment.legacyID = baseID + fmt.Sprintf(splitfmt, j+1)
 			sp.repo.legacyMap["SVN:"+fragment.legacyID] = fragment
 			fragment.Comment += splitwarn
 			fragment.Branch = split.cliques[j-1].branch
+			fragments = append(fragments, fragment)
 			baton.twirl()
 		}
+		// Back to front, so prepend to keep the record in order
+		sp.repo.splits = append([][]*Commit{fragments}, sp.repo.splits...)
 		baton.percentProgress(uint64(i) + 1)
 	}
 	baton.endProgress()
@@ -1730,7 +1842,7 @@ func svnSplitResolve(ctx context.Context, sp *StreamParser, options stringSet, b
 	for index, event := range sp.repo.events {
 		if commit, ok := event.(*Commit); ok {
 			// Remember the last commit on every branch at each revision
-			rev, _ := strconv.Atoi(strings.Split(commit.legacyID, ".")[0])
+			rev := legacyRevision(commit.legacyID)
 			list, found := sp.lastCommitOnBranchAt[commit.Branch]
 			lastrev := -1
 			var prev *Commit
@@ -2024,7 +2136,7 @@ func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, bat
 	count := 0
 	for branch, roots := range sp.branchRoots {
 		for _, commit := range roots {
-			rev, _ := strconv.Atoi(strings.Split(commit.legacyID, ".")[0])
+			rev := legacyRevision(commit.legacyID)
 			record := sp.revision(intToRevidx(rev))
 			if record != nil {
 				for _, node := range record.nodes {
@@ -2039,7 +2151,7 @@ func svnLinkFixups(ctx context.Context, sp *StreamParser, options stringSet, bat
 							if logEnable(logTOPOLOGY) {
 								logit("Link from %s <%s> to %s <%s> found by copy-from",
 									parent.mark, parent.legacyID, commit.mark, commit.legacyID)
-								if strings.Split(parent.legacyID, ".")[0] != fmt.Sprintf("%d", node.fromRev) {
+								if legacyRevision(parent.legacyID) != int(node.fromRev) {
 									logit("(fromRev was r%d)", node.fromRev)
 								}
 							}
@@ -2153,6 +2265,24 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 	// to deal with the newer style of mergeinfo that has a trunk part, not the older style
 	// without one.
 	//
+	// The --mergeinfo option sets how aggressively this is done:
+	// "none" ignores mergeinfo, "complete" (the default) only turns
+	// ranges covering a source branch from its fork point into
+	// merges, and "all" makes a merge of every range, partial
+	// and non-inheritable ones included.
+	policy := "complete"
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--mergeinfo=") {
+			policy = option[len("--mergeinfo="):]
+			if policy != "none" && policy != "complete" && policy != "all" {
+				panic(throw("parse", "--mergeinfo must be none, complete, or all"))
+			}
+		}
+	}
+	if policy == "none" {
+		return
+	}
+	aggressive := policy == "all"
 	defer trace.StartRegion(ctx, "SVN Phase A: mergeinfo processing").End()
 	if logEnable(logEXTRACT) {
 		logit("SVN Phase A: mergeinfo processing")
@@ -2179,7 +2309,10 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 				// Ignore non-inheritable merges, they represent
 				// partial merges or cherry-picks.
 				if strings.HasSuffix(span, "*") {
-					continue
+					if !aggressive {
+						continue
+					}
+					span = span[:len(span)-1]
 				}
 				fields = strings.Split(span, "-")
 				if len(fields) == 1 {
@@ -2293,7 +2426,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 				}
 				continue
 			}
-			realrev, _ := strconv.Atoi(strings.Split(commit.legacyID, ".")[0])
+			realrev := legacyRevision(commit.legacyID)
 			if realrev != revision {
 				if logEnable(logWARN) {
 					logit("Resolving mergeinfo targeting r%d on %s <%s> instead",
@@ -2317,7 +2450,13 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 			forks := forkIndices(commit)
 			// Start of the loop over the mergeinfo
 			minIndex := int(^uint(0) >> 2)
-			for fromPath, revs := range newMerges {
+			fromPaths := make([]string, 0, len(newMerges))
+			for fromPath := range newMerges {
+				fromPaths = append(fromPaths, fromPath)
+			}
+			sort.Strings(fromPaths)
+			for _, fromPath := range fromPaths {
+				revs := newMerges[fromPath]
 				baton.twirl()
 				fromPath = trimSep(fromPath)
 				if !sp.isDeclaredBranch(fromPath) {
@@ -2355,7 +2494,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 					//    revisions following the fork point are
 					//    merged (SVN sometimes omits revisions prior
 					//    to the merge base).
-					for ; i < count; i++ {
+					for ; i < count && !aggressive; i++ {
 						baton.twirl()
 						// Find the last commit just before the range
 						before := lastRelevantCommit(sp, revidx(revs[i].min-1), fromPath)
@@ -2415,7 +2554,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 						revs[lastGood].max = revs[i].max
 					}
 				}
-				revs := revs[:lastGood+1]
+				revs = revs[:lastGood+1]
 				// Now we process the merges
 				for _, rng := range revs {
 					baton.twirl()
@@ -2428,7 +2567,7 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 					if last == nil {
 						continue
 					}
-					lastrev, _ := strconv.Atoi(strings.Split(last.legacyID, ".")[0])
+					lastrev := legacyRevision(last.legacyID)
 					if lastrev < rng.min {
 						// Snapping the revisions to existing commits
 						// went past the minimum revision in the range
@@ -2520,6 +2659,260 @@ func svnProcessMergeinfos(ctx context.Context, sp *StreamParser, options stringS
 		baton.percentProgress(uint64(revision) + 1)
 	}
 	baton.endProgress()
+}
+
+// gitlinkPlaceholder is the hash given to gitlinks made from
+// svn:externals.  There is no way to know what commit an external
+// will correspond to once its own repository has been converted.
+const gitlinkPlaceholder = "0000000000000000000000000000000000000000"
+
+// svnExternal is one definition from an svn:externals property.
+type svnExternal struct {
+	path     string // Relative to the directory bearing the property
+	url      string
+	revision string // Pinned revision, empty if the external follows its head
+}
+
+// parseSVNExternals parses the value of an svn:externals property,
+// in either the pre-1.5 'DIR [-r REV] URL' format or the later
+// '[-r REV] URL[@PEG] DIR' one.  Definitions that cannot become git
+// submodules are returned separately as complaints; that includes
+// those with relative URLs, as git has no equivalent for them.
+func parseSVNExternals(value string) ([]svnExternal, []string) {
+	var externals []svnExternal
+	var complaints []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var ext svnExternal
+		var words []string
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if fields[i] == "-r" && i+1 < len(fields) {
+				ext.revision = fields[i+1]
+				i++
+			} else if strings.HasPrefix(fields[i], "-r") && len(fields[i]) > 2 {
+				ext.revision = fields[i][2:]
+			} else {
+				words = append(words, fields[i])
+			}
+		}
+		if len(words) != 2 {
+			complaints = append(complaints, fmt.Sprintf("%q is malformed", line))
+			continue
+		}
+		isURL := func(s string) bool {
+			return strings.Contains(s, "://") || strings.HasPrefix(s, "^/") ||
+				strings.HasPrefix(s, "/") || strings.HasPrefix(s, "../")
+		}
+		if isURL(words[0]) {
+			ext.url, ext.path = words[0], words[1]
+			if at := strings.LastIndex(ext.url, "@"); at > strings.Index(ext.url, "://")+2 {
+				if ext.revision == "" {
+					ext.revision = ext.url[at+1:]
+				}
+				ext.url = ext.url[:at]
+			}
+		} else {
+			ext.path, ext.url = words[0], words[1]
+		}
+		ext.path = filepath.Clean(ext.path)
+		if !strings.Contains(ext.url, "://") {
+			complaints = append(complaints, fmt.Sprintf("%q has a relative URL", line))
+		} else if filepath.IsAbs(ext.path) || ext.path == "." || strings.HasPrefix(ext.path, "..") {
+			complaints = append(complaints, fmt.Sprintf("%q has a path outside its directory", line))
+		} else {
+			externals = append(externals, ext)
+		}
+	}
+	return externals, complaints
+}
+
+func svnProcessExternals(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+	// Phase A2:
+	// Convert svn:externals properties on directory nodes to gitlinks
+	// and a top-level .gitmodules describing them.
+	defer trace.StartRegion(ctx, "SVN Phase A2: Conversion from svn:externals to .gitmodules").End()
+	if logEnable(logEXTRACT) {
+		logit("SVN Phase A2: Conversion from svn:externals to .gitmodules.")
+	}
+
+	isRoot := func(commit *Commit) bool {
+		branch := sp.markToSVNBranch[commit.mark]
+		for _, root := range sp.branchRoots[branch] {
+			if root == commit {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The externals in force at each commit, as a map from the
+	// branch-relative directory bearing the property to its value.
+	flowmap := make(map[int]map[string]string)
+	submodules := func(externals map[string]string) []svnExternal {
+		var all []svnExternal
+		for dir, value := range externals {
+			parsed, _ := parseSVNExternals(value)
+			for _, ext := range parsed {
+				ext.path = filepath.Join(dir, ext.path)
+				all = append(all, ext)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].path < all[j].path })
+		return all
+	}
+	gitmodulesOp := func(all []svnExternal) *FileOp {
+		op := newFileOp(sp.repo)
+		if len(all) == 0 {
+			op.construct(opD, ".gitmodules")
+			return op
+		}
+		var buf bytes.Buffer
+		for _, ext := range all {
+			fmt.Fprintf(&buf, "[submodule %q]\n\tpath = %s\n\turl = %s\n", ext.path, ext.path, ext.url)
+			if ext.revision != "" {
+				fmt.Fprintf(&buf, "\t# svn:externals pinned this to r%s\n", ext.revision)
+			}
+		}
+		op.construct(opM, "100644", "inline", ".gitmodules")
+		op.inline = buf.Bytes()
+		return op
+	}
+
+	baton.startProgress("SVN phase A2: Conversion of svn:externals",
+		uint64(len(sp.repo.events)))
+	for index, event := range sp.repo.events {
+		commit, ok := event.(*Commit)
+		if !ok {
+			continue
+		}
+		revision := legacyRevision(commit.legacyID)
+		record := sp.revision(intToRevidx(revision))
+		var current map[string]string
+		if commit.hasParents() {
+			if parent, ok := commit.parents()[0].(*Commit); ok {
+				current = flowmap[sp.repo.eventToIndex(parent)]
+			}
+		}
+		if record == nil {
+			flowmap[index] = current
+			continue
+		}
+		mybranch := sp.markToSVNBranch[commit.mark]
+		old := current
+		changed := false
+		update := func(dir string, value string) {
+			if !changed {
+				current = make(map[string]string, len(old))
+				for k, v := range old {
+					current[k] = v
+				}
+				changed = true
+			}
+			if value == "" {
+				delete(current, dir)
+			} else {
+				current[dir] = value
+			}
+		}
+		for _, node := range record.nodes {
+			if node.kind != sdDIR {
+				continue
+			}
+			branch, dir := sp.splitSVNBranchPath(filepath.Join(trimSep(node.path), ".gitmodules"))
+			if branch != mybranch {
+				continue
+			}
+			dir = filepath.Dir(dir)
+			if dir == "." {
+				dir = ""
+			}
+			beneath := func(externals map[string]string, top string, hook func(string, string)) {
+				for other, value := range externals {
+					if other == top || top == "" || strings.HasPrefix(other, top+svnSep) {
+						hook(other, value)
+					}
+				}
+			}
+			if node.action == sdDELETE || node.action == sdREPLACE {
+				beneath(current, dir, func(other string, _ string) { update(other, "") })
+				if node.action == sdDELETE {
+					continue
+				}
+			}
+			// A copy brings along the externals of everything
+			// under its source, and those of the source itself
+			// unless it has a property section of its own.
+			if node.fromPath != "" {
+				srcBranch, srcDir := sp.splitSVNBranchPath(filepath.Join(trimSep(node.fromPath), ".gitmodules"))
+				srcDir = filepath.Dir(srcDir)
+				if srcDir == "." {
+					srcDir = ""
+				}
+				if source := lastRelevantCommit(sp, node.fromRev, srcBranch); source != nil {
+					beneath(flowmap[sp.repo.eventToIndex(source)], srcDir, func(other string, value string) {
+						if other != srcDir || !node.propchange {
+							update(filepath.Join(dir, strings.TrimPrefix(other[len(srcDir):], svnSep)), value)
+						}
+					})
+				}
+			}
+			if !node.propchange {
+				continue
+			}
+			newvalue := ""
+			if node.hasProperties() && node.props.has("svn:externals") {
+				newvalue = node.props.get("svn:externals")
+			}
+			if current[dir] == newvalue {
+				continue
+			}
+			if newvalue != "" {
+				_, complaints := parseSVNExternals(newvalue)
+				for _, complaint := range complaints {
+					if logEnable(logWARN) {
+						logit("r%d~%s: svn:externals definition %s, not mapped.",
+							node.revision, node.path, complaint)
+					}
+				}
+			}
+			update(dir, newvalue)
+		}
+		if changed || (isRoot(commit) && len(current) > 0) {
+			before := submodules(old)
+			after := submodules(current)
+			if isRoot(commit) {
+				before = nil
+			}
+			kept := make(map[string]bool)
+			for _, ext := range after {
+				kept[ext.path] = true
+			}
+			for _, ext := range before {
+				if !kept[ext.path] {
+					op := newFileOp(sp.repo)
+					op.construct(opD, ext.path)
+					commit.fileops = append(commit.fileops, op)
+				}
+			}
+			for _, ext := range after {
+				op := newFileOp(sp.repo)
+				op.construct(opM, "160000", gitlinkPlaceholder, ext.path)
+				commit.fileops = append(commit.fileops, op)
+			}
+			if len(before) > 0 || len(after) > 0 {
+				commit.fileops = append(commit.fileops, gitmodulesOp(after))
+			}
+			commit.invalidateManifests()
+			commit.simplify()
+		}
+		flowmap[index] = current
+		baton.percentProgress(uint64(index) + 1)
+	}
+	baton.endProgress()
 
 	sp.lastCommitOnBranchAt = nil
 }
@@ -2553,12 +2946,18 @@ func svnProcessIgnores(ctx context.Context, sp *StreamParser, options stringSet,
 		if nodepath == ".gitignore" {
 			buf.WriteString(subversionDefaultIgnores)
 		}
+		dialect := "svn:ignore"
+		if global {
+			dialect = "svn:global-ignores"
+		}
 		for _, line := range strings.SplitAfter(explicit, control.lineSep) {
 			if line != "" {
-				if !global {
-					buf.WriteByte(svnSep[0])
+				pattern := strings.TrimSuffix(line, control.lineSep)
+				translation, _ := translateIgnore(dialect, pattern)
+				if translation.ok && translation.translated != "" {
+					buf.WriteString(translation.translated)
+					buf.WriteString(line[len(pattern):])
 				}
-				buf.WriteString(line)
 			}
 		}
 		ignores := buf.Bytes()
@@ -2606,7 +3005,7 @@ func svnProcessIgnores(ctx context.Context, sp *StreamParser, options stringSet,
 		if !ok {
 			continue
 		}
-		revision, _ := strconv.Atoi(strings.Split(commit.legacyID, ".")[0])
+		revision := legacyRevision(commit.legacyID)
 		record := sp.revision(intToRevidx(revision))
 		if record == nil {
 			continue
@@ -2883,7 +3282,10 @@ func svnProcessJunk(ctx context.Context, sp *StreamParser, options stringSet, ba
 			if logEnable(logEXTRACT) {
 				logit("%s might be tag-eligible", commit.idMe())
 			}
-			if cvs2svnTagBranchRE.MatchString(commit.Comment) {
+			if commit.hasParents() && sp.propertyRevisions[revidx(legacyRevision(commit.legacyID))] {
+				// A pure-property revision we were asked to
+				// squash; it would only make a noise tag.
+			} else if cvs2svnTagBranchRE.MatchString(commit.Comment) {
 				// Nothing to do, but we don't want to create an annotated tag
 				// because messages from cvs2svn are not useful.
 			} else if commit.hasParents() {
@@ -2921,14 +3323,114 @@ func svnProcessJunk(ctx context.Context, sp *StreamParser, options stringSet, ba
 	baton.endProgress()
 
 	sp.branchRoots = nil
+	sp.propertyRevisions = nil
 }
 
-func svnProcessRenumber(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+// findStormRevisions records which revisions touch only paths under the
+// prefixes given by --coalesce-prefix options, so storm coalescing can
+// be limited to them after the paths have been mapped onto branches.
+func (sp *StreamParser) findStormRevisions(options stringSet) {
+	prefixes := make([]string, 0)
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--coalesce-prefix=") {
+			prefixes = append(prefixes, trimSep(option[len("--coalesce-prefix="):]))
+		}
+	}
+	if len(prefixes) == 0 {
+		return
+	}
+	under := func(path string) bool {
+		for _, prefix := range prefixes {
+			if path == prefix || strings.HasPrefix(path, prefix+svnSep) {
+				return true
+			}
+		}
+		return false
+	}
+	sp.stormRevisions = make(map[revidx]bool)
+	for _, record := range sp.revisions {
+		eligible := len(record.nodes) > 0
+		for _, node := range record.nodes {
+			if !under(node.path) {
+				eligible = false
+				break
+			}
+		}
+		if eligible {
+			sp.stormRevisions[record.revision] = true
+		}
+	}
+}
+
+// findPropertyRevisions records, if asked to, which revisions change
+// nothing but node properties.  DAV autoversioning produces many of
+// these, each setting svn:mime-type or a DAV property on a file that
+// the previous revision wrote.
+func (sp *StreamParser) findPropertyRevisions(options stringSet) {
+	if !options.Contains("--squash-property-revisions") {
+		return
+	}
+	sp.propertyRevisions = make(map[revidx]bool)
+	for _, record := range sp.revisions {
+		eligible := len(record.nodes) > 0
+		for _, node := range record.nodes {
+			if node.action != sdCHANGE || node.blob != nil || node.isCopy() || !node.hasProperties() {
+				eligible = false
+				break
+			}
+		}
+		if eligible {
+			sp.propertyRevisions[record.revision] = true
+		}
+	}
+}
+
+func svnCoalesceStorms(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
 	// Phase D:
+	// Some automated Subversion clients committed one file per
+	// revision.  If asked to, merge consecutive commits on a branch
+	// by the same author with identical log messages, each within a
+	// time window of the last, into single commits.
+	var window int
+	for option := range options.Iterate() {
+		if strings.HasPrefix(option, "--coalesce-window=") {
+			var err error
+			window, err = strconv.Atoi(option[len("--coalesce-window="):])
+			if err != nil || window <= 0 {
+				panic(throw("parse", "--coalesce-window needs a positive number of seconds"))
+			}
+		}
+	}
+	if window == 0 {
+		return
+	}
+	defer trace.StartRegion(ctx, "SVN Phase D: coalesce commit storms").End()
+	if logEnable(logEXTRACT) {
+		logit("SVN Phase D: coalesce commit storms")
+	}
+	eligible := func(commit *Commit) bool {
+		return sp.stormRevisions == nil || sp.stormRevisions[revidx(legacyRevision(commit.legacyID))]
+	}
+	stormMatch := func(cthis *Commit, cnext *Commit) bool {
+		return eligible(cthis) && eligible(cnext) &&
+			cthis.committer.email == cnext.committer.email &&
+			cthis.Comment == cnext.Comment &&
+			cthis.committer.date.delta(cnext.committer.date) < time.Duration(window)*time.Second &&
+			len(cnext.parents()) == 1 && cnext.parents()[0] == CommitLike(cthis)
+	}
+	spans := sp.repo.coalesce(sp.repo.all(), stormMatch, false)
+	if logEnable(logEXTRACT) {
+		logit("%d commit storms coalesced", spans)
+	}
+	sp.stormRevisions = nil
+}
+
+func svnProcessRenumber(ctx context.Context, sp *StreamParser, options stringSet, baton *Baton) {
+	// Phase E:
 	// Renumber all commits and add an end event.
-	defer trace.StartRegion(ctx, "SVN Phase D: renumber").End()
+	defer trace.StartRegion(ctx, "SVN Phase E: renumber").End()
 	if logEnable(logEXTRACT) {
-		logit("SVN Phase D: renumber")
+		logit("SVN Phase E: renumber")
 	}
 	sp.repo.renumber(1, baton)
 	//sp.repo.events = append(sp.repo.events, newPassthrough(sp.repo, "done\n"))
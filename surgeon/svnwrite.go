@@ -0,0 +1,518 @@
+// This module writes a repository out as a Subversion dumpfile, the
+// inverse of what svnread.go does. It makes it possible to carry a
+// conversion into Subversion without an external fast-import tool;
+// the result can be loaded with "svnadmin load".
+//
+// The mapping is the conventional one. Commits on refs/heads/master
+// go to trunk, other refs/heads branches to branches/, and annotated
+// or lightweight tags become copies under tags/. Each commit is one
+// revision. A branch is created by copying the directory of its
+// first parent's branch at that parent's revision, and a merge is
+// recorded as svn:mergeinfo on the branch directory. The contents of
+// .gitignore files is turned back into svn:ignore (anchored patterns)
+// and svn:global-ignores (the rest) properties, with the simulated
+// Subversion default ignores the reader adds left out; patterns
+// Subversion cannot express are dropped.
+//
+// The dumpfile format is documented at
+//
+// https://svn.apache.org/repos/asf/subversion/trunk/notes/dump-load-format.txt
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// svnDumper holds the state of a dumpfile being written.
+type svnDumper struct {
+	repo      *Repository
+	fp        io.Writer
+	revision  int
+	revs      map[*Commit]int              // Revision each commit became
+	dirs      map[*Commit]string           // Branch directory of each commit
+	mergeinfo map[*Commit]map[string][]int // Branch mergeinfo after each commit
+	tips      map[string]*Commit           // Commit whose tree each branch directory holds
+	made      map[string]bool              // Directories outside branches, and branch roots
+	starts    map[string]int               // Revision each branch directory was created in
+}
+
+// svnBranchDir maps a git ref to the Subversion directory holding it.
+func svnBranchDir(ref string) string {
+	if ref == "refs/heads/master" {
+		return "trunk"
+	} else if strings.HasPrefix(ref, "refs/heads/") {
+		return "branches/" + ref[len("refs/heads/"):]
+	} else if strings.HasPrefix(ref, "refs/tags/") {
+		return "tags/" + ref[len("refs/tags/"):]
+	}
+	return ""
+}
+
+// svnProps renders a property block, keys in sorted order.
+func svnProps(props map[string]string) []byte {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "K %d\n%s\nV %d\n%s\n", len(k), k, len(props[k]), props[k])
+	}
+	buf.WriteString("PROPS-END\n")
+	return buf.Bytes()
+}
+
+// svnDirs returns the directories implied by a manifest, the
+// empty string standing for the branch root.
+func svnDirs(manifest *Manifest) map[string]bool {
+	dirs := map[string]bool{"": true}
+	manifest.iter(func(name string, _ interface{}) {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	})
+	return dirs
+}
+
+// svnIgnores turns the .gitignore files in a manifest into the
+// svn:ignore and svn:global-ignores properties of their directories.
+func (sd *svnDumper) svnIgnores(manifest *Manifest) map[string]map[string]string {
+	props := make(map[string]map[string]string)
+	manifest.iter(func(name string, value interface{}) {
+		if path.Base(name) != ".gitignore" {
+			return
+		}
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		content := string(sd.content(value.(*FileOp)))
+		content = strings.TrimPrefix(content, subversionDefaultIgnores)
+		var anchored, global strings.Builder
+		for _, line := range strings.Split(content, "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if translation, _ := renderIgnore("svn:ignore", line); translation.ok {
+				anchored.WriteString(translation.translated + "\n")
+			} else if translation, _ := renderIgnore("svn:global-ignores", line); translation.ok {
+				global.WriteString(translation.translated + "\n")
+			} else if logEnable(logWARN) {
+				logit("%s: %q has no Subversion equivalent: %s", name, line, translation.reason)
+			}
+		}
+		props[dir] = make(map[string]string)
+		if anchored.Len() > 0 {
+			props[dir]["svn:ignore"] = anchored.String()
+		}
+		if global.Len() > 0 {
+			props[dir]["svn:global-ignores"] = global.String()
+		}
+	})
+	return props
+}
+
+// content returns the content a fileop refers to.
+// Smudge hooks are run over it as they would be in an import stream.
+func (sd *svnDumper) content(op *FileOp) []byte {
+	content := op.inline
+	if op.ref != "inline" {
+		blob, ok := sd.repo.markToEvent(op.ref).(*Blob)
+		if !ok {
+			return nil
+		}
+		content = blob.getContent()
+	}
+	if hooks := contentFiltersFor("smudge", op.Path); len(hooks) > 0 && filterable(op) {
+		content = runContentFilters(hooks, content, []string{op.Path})
+	}
+	return content
+}
+
+func (sd *svnDumper) writeRevision(attr *Attribution, comment string, extra *OrderedMap) {
+	sd.revision++
+	props := map[string]string{
+		"svn:date": attr.date.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"svn:log":  comment,
+	}
+	if userid := attr.userid(); userid != "" {
+		props["svn:author"] = userid
+	}
+	if extra != nil {
+		for _, name := range extra.keys {
+			value := extra.get(name)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			props[name] = value
+		}
+	}
+	block := svnProps(props)
+	fmt.Fprintf(sd.fp, "Revision-number: %d\nProp-content-length: %d\nContent-length: %d\n\n",
+		sd.revision, len(block), len(block))
+	sd.fp.Write(block)
+	io.WriteString(sd.fp, "\n")
+}
+
+func (sd *svnDumper) writeDelete(nodepath string) {
+	fmt.Fprintf(sd.fp, "Node-path: %s\nNode-action: delete\n\n\n", nodepath)
+}
+
+// writeNode emits a file or directory node. A nil props map omits
+// the property section, leaving existing properties alone on a change.
+func (sd *svnDumper) writeNode(nodepath string, kind string, action string,
+	copyfrom string, copyrev int, props map[string]string, text []byte) {
+	fmt.Fprintf(sd.fp, "Node-path: %s\nNode-kind: %s\nNode-action: %s\n", nodepath, kind, action)
+	if copyfrom != "" {
+		fmt.Fprintf(sd.fp, "Node-copyfrom-rev: %d\nNode-copyfrom-path: %s\n", copyrev, copyfrom)
+	}
+	var block []byte
+	if props != nil {
+		block = svnProps(props)
+		fmt.Fprintf(sd.fp, "Prop-content-length: %d\n", len(block))
+	}
+	if text != nil {
+		fmt.Fprintf(sd.fp, "Text-content-length: %d\nText-content-md5: %x\n", len(text), md5.Sum(text))
+	}
+	if props != nil || text != nil {
+		fmt.Fprintf(sd.fp, "Content-length: %d\n", len(block)+len(text))
+	}
+	io.WriteString(sd.fp, "\n")
+	if props != nil || text != nil {
+		sd.fp.Write(block)
+		sd.fp.Write(text)
+		io.WriteString(sd.fp, "\n")
+	}
+	io.WriteString(sd.fp, "\n")
+}
+
+// ensureParents creates the directories above a branch or tag
+// directory that do not exist yet.
+func (sd *svnDumper) ensureParents(dir string) {
+	parents := make([]string, 0)
+	for p := path.Dir(dir); p != "."; p = path.Dir(p) {
+		parents = append([]string{p}, parents...)
+	}
+	for _, p := range parents {
+		if !sd.made[p] {
+			sd.writeNode(p, "dir", "add", "", 0, map[string]string{}, nil)
+			sd.made[p] = true
+		}
+	}
+}
+
+// fileProps gives the properties expressing a git file mode.
+func fileProps(mode string) map[string]string {
+	props := make(map[string]string)
+	if mode == "100755" {
+		props["svn:executable"] = "*"
+	} else if mode == "120000" {
+		props["svn:special"] = "*"
+	}
+	return props
+}
+
+// formatMergeinfo renders mergeinfo ranges in svn:mergeinfo syntax.
+func formatMergeinfo(mergeinfo map[string][]int) string {
+	sources := make([]string, 0, len(mergeinfo))
+	for source := range mergeinfo {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	var buf strings.Builder
+	for _, source := range sources {
+		span := mergeinfo[source]
+		if span[0] == span[1] {
+			fmt.Fprintf(&buf, "%s:%d\n", source, span[0])
+		} else {
+			fmt.Fprintf(&buf, "%s:%d-%d\n", source, span[0], span[1])
+		}
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (sd *svnDumper) dumpCommit(commit *Commit) error {
+	dir := svnBranchDir(commit.Branch)
+	if dir == "" {
+		if logEnable(logWARN) {
+			logit("commit %s on %s has no Subversion equivalent and is skipped", commit.mark, commit.Branch)
+		}
+		return nil
+	}
+	var parent *Commit
+	if commit.hasParents() {
+		var ok bool
+		if parent, ok = commit.parents()[0].(*Commit); !ok {
+			return fmt.Errorf("commit %s has a callout parent", commit.mark)
+		}
+		if _, ok = sd.revs[parent]; !ok {
+			return fmt.Errorf("parent of commit %s was not dumped", commit.mark)
+		}
+	}
+	sd.writeRevision(&commit.committer, commit.Comment, commit.properties)
+
+	// Work out what the branch directory holds before this commit.
+	before := newManifest()
+	mergeinfo := make(map[string][]int)
+	fromdir := ""
+	if parent != nil {
+		fromdir = sd.dirs[parent]
+		for source, span := range sd.mergeinfo[parent] {
+			mergeinfo[source] = span
+		}
+	}
+	beforeProps := make(map[string]map[string]string)
+	fresh := false
+	if parent != nil && sd.tips[dir] == parent {
+		before = parent.manifest()
+		beforeProps = sd.svnIgnores(before)
+	} else {
+		if sd.made[dir] {
+			sd.writeDelete(dir)
+		} else {
+			sd.ensureParents(dir)
+		}
+		sd.made[dir] = true
+		sd.starts[dir] = sd.revision
+		if parent == nil {
+			// Added below, with its properties
+			fresh = true
+		} else {
+			before = parent.manifest()
+			beforeProps = sd.svnIgnores(before)
+			sd.writeNode(dir, "dir", "add", fromdir, sd.revs[parent], nil, nil)
+		}
+	}
+	oldMergeinfo := formatMergeinfo(mergeinfo)
+	for i, p := range commit.parents() {
+		other, ok := p.(*Commit)
+		if i == 0 || !ok {
+			continue
+		}
+		if source := sd.dirs[other]; source != "" && source != dir {
+			start := sd.starts[source]
+			if span, ok := mergeinfo["/"+source]; ok && span[0] < start {
+				start = span[0]
+			}
+			mergeinfo["/"+source] = []int{start, sd.revs[other]}
+		}
+	}
+	after := commit.manifest()
+	afterProps := sd.svnIgnores(after)
+
+	// Directory deletions, topmost only.
+	beforeDirs, afterDirs := svnDirs(before), svnDirs(after)
+	if fresh {
+		delete(beforeDirs, "")
+	}
+	gone := make([]string, 0)
+	for d := range beforeDirs {
+		if !afterDirs[d] {
+			gone = append(gone, d)
+		}
+	}
+	sort.Strings(gone)
+	deleted := func(name string) bool {
+		for _, d := range gone {
+			if strings.HasPrefix(name, d+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range gone {
+		if !deleted(d) {
+			sd.writeDelete(dir + "/" + d)
+		}
+	}
+	// File deletions, including files replaced by directories.
+	for _, name := range before.pathnames() {
+		if path.Base(name) == ".gitignore" || deleted(name) {
+			continue
+		}
+		if _, ok := after.get(name); !ok || afterDirs[name] {
+			sd.writeDelete(dir + "/" + name)
+		}
+	}
+	// Directory additions, parents first.
+	made := make([]string, 0)
+	for d := range afterDirs {
+		if !beforeDirs[d] {
+			made = append(made, d)
+		}
+	}
+	sort.Strings(made)
+	newMergeinfo := formatMergeinfo(mergeinfo)
+	for _, d := range made {
+		props := afterProps[d]
+		if props == nil {
+			props = map[string]string{}
+		}
+		if d == "" && newMergeinfo != "" {
+			props["svn:mergeinfo"] = newMergeinfo
+		}
+		sd.writeNode(strings.TrimSuffix(dir+"/"+d, "/"), "dir", "add", "", 0, props, nil)
+	}
+	// File additions and changes. Renamed and copied files whose
+	// content is unchanged are written as Subversion copies, so their
+	// history is kept.
+	copies := make(map[string]string)
+	for _, op := range commit.operations() {
+		if op.op == opR || op.op == opC {
+			copies[op.Path] = op.Source
+		}
+	}
+	for _, name := range after.pathnames() {
+		if path.Base(name) == ".gitignore" {
+			continue
+		}
+		value, _ := after.get(name)
+		op := value.(*FileOp)
+		props := fileProps(op.mode)
+		text := sd.content(op)
+		if op.mode == "120000" {
+			text = append([]byte("link "), text...)
+		}
+		if old, present := before.get(name); present {
+			oldop := old.(*FileOp)
+			if oldop.mode == op.mode && oldop.ref == op.ref && bytes.Equal(oldop.inline, op.inline) {
+				continue
+			}
+			sd.writeNode(dir+"/"+name, "file", "change", "", 0, props, text)
+			continue
+		}
+		if source, ok := copies[name]; ok && parent != nil {
+			if srcop, ok := before.get(source); ok && srcop.(*FileOp).ref == op.ref && srcop.(*FileOp).mode == op.mode && op.ref != "inline" {
+				sd.writeNode(dir+"/"+name, "file", "add", fromdir+"/"+source, sd.revs[parent], nil, nil)
+				continue
+			}
+		}
+		sd.writeNode(dir+"/"+name, "file", "add", "", 0, props, text)
+	}
+	// Property changes on directories that survived.
+	survivors := make([]string, 0)
+	for d := range afterDirs {
+		if beforeDirs[d] {
+			survivors = append(survivors, d)
+		}
+	}
+	sort.Strings(survivors)
+	for _, d := range survivors {
+		props := afterProps[d]
+		if props == nil {
+			props = map[string]string{}
+		}
+		changed := !sameProps(props, beforeProps[d])
+		if d == "" {
+			if newMergeinfo != "" {
+				props["svn:mergeinfo"] = newMergeinfo
+			}
+			changed = changed || newMergeinfo != oldMergeinfo
+		}
+		if changed {
+			sd.writeNode(strings.TrimSuffix(dir+"/"+d, "/"), "dir", "change", "", 0, props, nil)
+		}
+	}
+	sd.revs[commit] = sd.revision
+	sd.dirs[commit] = dir
+	sd.mergeinfo[commit] = mergeinfo
+	sd.tips[dir] = commit
+	return nil
+}
+
+// sameProps compares property maps, treating nil as empty.
+func sameProps(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// dumpTag makes a tag directory copied from the tagged commit.
+func (sd *svnDumper) dumpTag(name string, commit *Commit, attr *Attribution, comment string) {
+	if _, ok := sd.revs[commit]; !ok {
+		if logEnable(logWARN) {
+			logit("tag %s points at an undumped commit and is skipped", name)
+		}
+		return
+	}
+	dir := "tags/" + name
+	sd.writeRevision(attr, comment, nil)
+	if sd.made[dir] {
+		sd.writeDelete(dir)
+	} else {
+		sd.ensureParents(dir)
+	}
+	sd.made[dir] = true
+	sd.writeNode(dir, "dir", "add", sd.dirs[commit], sd.revs[commit], nil, nil)
+	sd.tips[dir] = nil
+}
+
+// svnDump writes the repository as a Subversion dumpfile.
+func (repo *Repository) svnDump(fp io.Writer) error {
+	sd := svnDumper{
+		repo:      repo,
+		fp:        fp,
+		revs:      make(map[*Commit]int),
+		dirs:      make(map[*Commit]string),
+		mergeinfo: make(map[*Commit]map[string][]int),
+		tips:      make(map[string]*Commit),
+		made:      make(map[string]bool),
+		starts:    make(map[string]int),
+	}
+	io.WriteString(fp, "SVN-fs-dump-format-version: 2\n\n")
+	commits := repo.commits(nil)
+	if len(commits) == 0 {
+		return nil
+	}
+	block := svnProps(map[string]string{
+		"svn:date": commits[0].committer.date.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+	})
+	fmt.Fprintf(fp, "Revision-number: 0\nProp-content-length: %d\nContent-length: %d\n\n",
+		len(block), len(block))
+	fp.Write(block)
+	io.WriteString(fp, "\n")
+	baton := control.baton
+	baton.startProgress("svn dump", uint64(len(repo.events)))
+	defer baton.endProgress()
+	for i, event := range repo.events {
+		switch e := event.(type) {
+		case *Commit:
+			if err := sd.dumpCommit(e); err != nil {
+				return err
+			}
+		case *Tag:
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				sd.dumpTag(strings.TrimPrefix(e.name, "refs/tags/"), commit, e.tagger, e.Comment)
+			}
+		case *Reset:
+			if !strings.HasPrefix(e.ref, "refs/tags/") || e.committish == "" {
+				continue
+			}
+			if commit, ok := repo.markToEvent(e.committish).(*Commit); ok {
+				sd.dumpTag(e.ref[len("refs/tags/"):], commit, &commit.committer, "")
+			}
+		}
+		baton.percentProgress(uint64(i) + 1)
+	}
+	return nil
+}
+
+// end
@@ -0,0 +1,623 @@
+// This module reads a Team Foundation Version Control (TFVC) project
+// through the tf command-line client, run in a local workspace that
+// maps the project's server path.
+//
+// "tf history -format:detailed" lists the changesets, newest first,
+// with the items each one touched, and "tf view" supplies the content
+// of a file as of a changeset. History does not tell files from
+// folders, nor name the source of a rename, so for each changeset that
+// does more than edit files the whole tree is listed with "tf dir";
+// files that vanish from the listing become deletions and files that
+// appear are fetched.
+//
+// TFVC branches are folders. If any changeset branches, or the root
+// holds a folder named Main or Trunk, each top-level folder is taken
+// to be a branch, Main or Trunk becoming master; otherwise the whole
+// root is one branch. A changeset touching several branches becomes
+// one commit per branch. The first commit on a branch other than
+// master has the latest commit on master as its parent. A label
+// becomes an annotated tag on the latest commit, on the branch of its
+// items, no later than the newest changeset it pins.
+//
+// TFVC keeps no executable bits, so every file is read as mode 100644.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tfvcChange is one item of a changeset: its kinds of change, such
+// as "add" or "merge, edit", and its server path.
+type tfvcChange struct {
+	kinds []string
+	path  string
+}
+
+// tfvcChangeset is one changeset as reported by tf history.
+type tfvcChangeset struct {
+	id        int
+	user      string
+	committer string
+	date      time.Time
+	comment   string
+	changes   []tfvcChange
+}
+
+// tfvcLabel is one label as reported by tf labels.
+type tfvcLabel struct {
+	name    string
+	owner   string
+	date    time.Time
+	comment string
+	items   map[string]int // server path -> changeset pinned
+}
+
+// tfvcDateLayouts are the date formats tf has been seen to print;
+// which one appears depends on the client and the locale.
+var tfvcDateLayouts = []string{
+	"Monday, January 2, 2006 3:04:05 PM",
+	"January 2, 2006 3:04:05 PM",
+	"Jan 2, 2006 3:04:05 PM",
+	"Jan 2, 2006, 3:04:05 PM",
+	"1/2/2006 3:04:05 PM",
+	"1/2/2006 3:04 PM",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05Z07:00",
+	"Mon Jan 2 15:04:05 MST 2006",
+}
+
+// parseTFVCDate parses a date from tf output, in local time.
+func parseTFVCDate(s string) (time.Time, error) {
+	for _, layout := range tfvcDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+// tfvcSeparator tells whether a line is the row of dashes between
+// entries of detailed tf output.
+func tfvcSeparator(line string) bool {
+	return len(line) >= 10 && strings.Trim(line, "-") == ""
+}
+
+// tfvcHeader splits a "Name: value" line of detailed tf output.
+// Headers are unindented; indented lines belong to the section above.
+func tfvcHeader(line string) (key string, value string, ok bool) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(line, "$/") {
+		return "", "", false
+	}
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+// tfvcBody turns the indented lines of a comment section into comment
+// text, dropping the indentation and surrounding blank lines.
+func tfvcBody(lines []string) string {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	for _, line := range lines {
+		text.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, " "), " "))
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+// tfvcDeletionID matches the ;X suffix tf puts on deleted items.
+var tfvcDeletionID = regexp.MustCompile(`;X[0-9]+$`)
+
+// parseTFVCItem parses one line of the Items section of a changeset,
+// such as "merge, edit $/Project/Main/file.c".
+func parseTFVCItem(item string) (tfvcChange, error) {
+	i := strings.Index(item, "$/")
+	if i <= 0 {
+		return tfvcChange{}, fmt.Errorf("ill-formed changeset item %q", item)
+	}
+	var change tfvcChange
+	for _, kind := range strings.Split(item[:i], ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			change.kinds = append(change.kinds, kind)
+		}
+	}
+	change.path = tfvcDeletionID.ReplaceAllString(item[i:], "")
+	return change, nil
+}
+
+// parseTFVCHistory parses the output of "tf history -format:detailed"
+// into changesets, in the order tf printed them.
+func parseTFVCHistory(r io.Reader) ([]*tfvcChangeset, error) {
+	var changesets []*tfvcChangeset
+	var cs *tfvcChangeset
+	var comment []string
+	section := ""
+	finish := func() {
+		if cs != nil {
+			cs.comment = tfvcBody(comment)
+			changesets = append(changesets, cs)
+		}
+		cs, comment, section = nil, nil, ""
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if tfvcSeparator(line) {
+			finish()
+			continue
+		}
+		if key, value, ok := tfvcHeader(line); ok {
+			if key == "Changeset" {
+				finish()
+				id, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("ill-formed changeset number %q", value)
+				}
+				cs = &tfvcChangeset{id: id}
+				continue
+			}
+			if cs == nil {
+				continue
+			}
+			section = key
+			switch key {
+			case "User":
+				cs.user = value
+			case "Checked in by":
+				cs.committer = value
+			case "Date":
+				date, err := parseTFVCDate(value)
+				if err != nil {
+					return nil, fmt.Errorf("changeset %d: %v", cs.id, err)
+				}
+				cs.date = date
+			case "Comment":
+				if value != "" {
+					comment = append(comment, value)
+				}
+			}
+			continue
+		}
+		if cs == nil {
+			continue
+		}
+		switch section {
+		case "Comment":
+			comment = append(comment, line)
+		case "Items":
+			if item := strings.TrimSpace(line); item != "" {
+				change, err := parseTFVCItem(item)
+				if err != nil {
+					return nil, fmt.Errorf("changeset %d: %v", cs.id, err)
+				}
+				cs.changes = append(cs.changes, change)
+			}
+		}
+	}
+	finish()
+	return changesets, scanner.Err()
+}
+
+// parseTFVCLabels parses the output of "tf labels -format:detailed".
+func parseTFVCLabels(r io.Reader) ([]*tfvcLabel, error) {
+	var labels []*tfvcLabel
+	var label *tfvcLabel
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if tfvcSeparator(line) {
+			label = nil
+			continue
+		}
+		if key, value, ok := tfvcHeader(line); ok {
+			if key == "Label" {
+				// Names are qualified by their scope, as in v1.0@$/Project
+				if i := strings.Index(value, "@"); i >= 0 {
+					value = value[:i]
+				}
+				label = &tfvcLabel{name: value, items: make(map[string]int)}
+				labels = append(labels, label)
+				continue
+			}
+			if label == nil {
+				continue
+			}
+			switch key {
+			case "Owner":
+				label.owner = value
+			case "Date":
+				date, err := parseTFVCDate(value)
+				if err != nil {
+					return nil, fmt.Errorf("label %s: %v", label.name, err)
+				}
+				label.date = date
+			case "Comment":
+				label.comment = value
+			}
+			continue
+		}
+		if label == nil {
+			continue
+		}
+		// Item rows are a changeset number and a server path
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		path := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		if strings.HasPrefix(path, "$/") {
+			label.items[path] = id
+		}
+	}
+	return labels, scanner.Err()
+}
+
+// tfvcItemCount matches the summary line that ends tf dir output.
+var tfvcItemCount = regexp.MustCompile(`^[0-9]+ item\(s\)$`)
+
+// parseTFVCDir parses the output of "tf dir -recursive" into the
+// server paths of the files it lists. Folders are headed by their
+// path and a colon; subfolders within them are marked with a $.
+// Visual SourceSafe's "ss Dir -R", whose layout tf inherited, is
+// parsed with this too.
+func parseTFVCDir(r io.Reader) ([]string, error) {
+	var files []string
+	folder := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "" || tfvcItemCount.MatchString(line):
+		case strings.HasPrefix(line, "$/") && strings.HasSuffix(line, ":"):
+			folder = strings.TrimSuffix(line, ":")
+		case strings.HasPrefix(line, "$"):
+		case folder != "":
+			files = append(files, strings.TrimSuffix(folder, "/")+"/"+line)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// parseTFVCWorkfold returns the server path mapped to a local folder
+// in the output of "tf workfold". If several are mapped, the
+// shortest, which is the one closest to the project root, wins.
+func parseTFVCWorkfold(text string) string {
+	root := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "$/") {
+			continue
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		if path := strings.TrimSuffix(line[:i], "/"); root == "" || len(path) < len(root) {
+			root = path
+		}
+	}
+	return root
+}
+
+// tfvcBranchRef returns the ref for a TFVC branch folder.
+func tfvcBranchRef(folder string) string {
+	switch strings.ToLower(folder) {
+	case "", "main", "trunk":
+		return "refs/heads/master"
+	}
+	return "refs/heads/" + folder
+}
+
+// tfvcAttribution renders a TFVC user, who is often qualified by a
+// Windows domain, as an attribution.
+func tfvcAttribution(user string, date time.Time) (*Attribution, error) {
+	if i := strings.LastIndex(user, `\`); i >= 0 {
+		user = user[i+1:]
+	}
+	attribution := fmt.Sprintf("%s <%s> %d +0000", user, user, date.Unix())
+	newattr, err := newAttribution(attribution)
+	if err != nil {
+		return nil, fmt.Errorf("ill-formed attribution %q", attribution)
+	}
+	return newattr, nil
+}
+
+// tfvcCapture runs a tf subcommand and returns its output.
+func tfvcCapture(args ...string) ([]byte, error) {
+	if logEnable(logCOMMANDS) {
+		logit("%s: capturing tf %s", wallclock(), strings.Join(args, " "))
+	}
+	cmd := exec.Command("tf", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("tf %s: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// readTFVC fills the repository from the TFVC project mapped to the
+// workspace in the current directory.
+func (repo *Repository) readTFVC() error {
+	out, err := tfvcCapture("workfold", ".")
+	if err != nil {
+		return err
+	}
+	root := parseTFVCWorkfold(string(out))
+	if root == "" {
+		return errors.New("no server path is mapped to this workspace")
+	}
+	out, err = tfvcCapture("history", root, "-recursive", "-format:detailed", "-noprompt")
+	if err != nil {
+		return err
+	}
+	changesets, err := parseTFVCHistory(strings.NewReader(string(out)))
+	if err != nil {
+		return err
+	}
+	if len(changesets) == 0 {
+		return fmt.Errorf("no changesets found under %s", root)
+	}
+	sort.SliceStable(changesets, func(i, j int) bool {
+		return changesets[i].id < changesets[j].id
+	})
+
+	// relative returns a server path relative to the root, and
+	// whether it is below the root at all.
+	relative := func(path string) (string, bool) {
+		if !strings.HasPrefix(path, root+"/") {
+			return "", false
+		}
+		return path[len(root)+1:], true
+	}
+	layout := false
+	for _, cs := range changesets {
+		for _, change := range cs.changes {
+			rel, ok := relative(change.path)
+			if !ok {
+				continue
+			}
+			top := strings.SplitN(rel, "/", 2)[0]
+			if tfvcBranchRef(top) == "refs/heads/master" {
+				layout = true
+			}
+			for _, kind := range change.kinds {
+				if kind == "branch" {
+					layout = true
+				}
+			}
+		}
+	}
+	// branchOf returns the ref a file belongs to and its path within
+	// that branch. Files outside any branch get an empty ref.
+	branchOf := func(path string) (string, string) {
+		rel, ok := relative(path)
+		if !ok {
+			return "", ""
+		}
+		if !layout {
+			return "refs/heads/master", rel
+		}
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) < 2 {
+			return "", ""
+		}
+		return tfvcBranchRef(parts[0]), parts[1]
+	}
+
+	type branchChanges struct {
+		fetch   []string
+		deletes []string
+	}
+	files := make(map[string]bool)
+	tips := make(map[string]*Commit)
+	type landmark struct {
+		id     int
+		commit *Commit
+	}
+	history := make(map[string][]landmark)
+	baton := control.baton
+	baton.startProgress("reading TFVC changesets", uint64(len(changesets)))
+	for n, cs := range changesets {
+		fetch := make(map[string]bool)
+		var deletes []string
+		editsOnly := true
+		for _, change := range cs.changes {
+			for _, kind := range change.kinds {
+				if kind != "edit" && kind != "merge" && kind != "encoding" {
+					editsOnly = false
+				}
+			}
+		}
+		if editsOnly {
+			for _, change := range cs.changes {
+				fetch[change.path] = true
+				files[change.path] = true
+			}
+		} else {
+			out, err := tfvcCapture("dir", root, "-recursive", fmt.Sprintf("-version:C%d", cs.id))
+			if err != nil {
+				return err
+			}
+			listing, err := parseTFVCDir(strings.NewReader(string(out)))
+			if err != nil {
+				return err
+			}
+			present := make(map[string]bool)
+			for _, path := range listing {
+				present[path] = true
+				if !files[path] {
+					fetch[path] = true
+				}
+			}
+			for path := range files {
+				if !present[path] {
+					deletes = append(deletes, path)
+				}
+			}
+			for _, change := range cs.changes {
+				if present[change.path] {
+					fetch[change.path] = true
+				}
+			}
+			files = present
+		}
+
+		byBranch := make(map[string]*branchChanges)
+		group := func(path string) *branchChanges {
+			ref, _ := branchOf(path)
+			if ref == "" {
+				if logEnable(logWARN) {
+					logit("changeset %d: %s is outside any branch, ignored", cs.id, path)
+				}
+				return nil
+			}
+			if byBranch[ref] == nil {
+				byBranch[ref] = new(branchChanges)
+			}
+			return byBranch[ref]
+		}
+		for path := range fetch {
+			if bc := group(path); bc != nil {
+				bc.fetch = append(bc.fetch, path)
+			}
+		}
+		for _, path := range deletes {
+			if bc := group(path); bc != nil {
+				bc.deletes = append(bc.deletes, path)
+			}
+		}
+		refs := make([]string, 0, len(byBranch))
+		for ref := range byBranch {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for i, ref := range refs {
+			bc := byBranch[ref]
+			commit := newCommit(repo)
+			committer := cs.committer
+			if committer == "" {
+				committer = cs.user
+			}
+			attr, err := tfvcAttribution(committer, cs.date)
+			if err != nil {
+				return err
+			}
+			commit.committer = *attr
+			if cs.user != "" && cs.user != committer {
+				attr, err := tfvcAttribution(cs.user, cs.date)
+				if err != nil {
+					return err
+				}
+				commit.authors = append(commit.authors, *attr)
+			}
+			commit.Comment = cs.comment
+			commit.setBranch(ref)
+			if tip := tips[ref]; tip != nil {
+				commit.setParents([]CommitLike{tip})
+			} else if tip := tips["refs/heads/master"]; tip != nil {
+				commit.setParents([]CommitLike{tip})
+			}
+			sort.Strings(bc.deletes)
+			for _, path := range bc.deletes {
+				_, within := branchOf(path)
+				op := newFileOp(repo)
+				op.construct(opD, within)
+				commit.appendOperation(op)
+			}
+			sort.Strings(bc.fetch)
+			for _, path := range bc.fetch {
+				_, within := branchOf(path)
+				content, err := tfvcCapture("view", "-console", "-noprompt", fmt.Sprintf("-version:C%d", cs.id), path)
+				if err != nil {
+					return err
+				}
+				blob := newBlob(repo)
+				blob.setContent(content, noOffset)
+				blob.setMark(repo.newmark())
+				repo.addEvent(blob)
+				op := newFileOp(repo)
+				op.construct(opM, "100644", blob.getMark(), within)
+				commit.appendOperation(op)
+			}
+			commit.legacyID = strconv.Itoa(cs.id)
+			if len(refs) > 1 {
+				commit.legacyID += fmt.Sprintf(".%d", i+1)
+			}
+			repo.legacyMap["TFVC:"+commit.legacyID] = commit
+			commit.setMark(repo.newmark())
+			repo.addEvent(commit)
+			tips[ref] = commit
+			history[ref] = append(history[ref], landmark{cs.id, commit})
+		}
+		baton.percentProgress(uint64(n + 1))
+	}
+	baton.endProgress()
+
+	out, err = tfvcCapture("labels", "-owner:*", "-format:detailed", root)
+	if err != nil {
+		return err
+	}
+	labels, err := parseTFVCLabels(strings.NewReader(string(out)))
+	if err != nil {
+		return err
+	}
+	for _, label := range labels {
+		ref, newest := "", 0
+		for path, id := range label.items {
+			if r, _ := branchOf(path); r != "" && id >= newest {
+				ref, newest = r, id
+			}
+		}
+		var target *Commit
+		for _, mark := range history[ref] {
+			if mark.id <= newest {
+				target = mark.commit
+			}
+		}
+		if target == nil {
+			if logEnable(logWARN) {
+				logit("label %s has no changeset to attach to, ignored", label.name)
+			}
+			continue
+		}
+		tagger, err := tfvcAttribution(label.owner, label.date)
+		if err != nil {
+			return err
+		}
+		comment := label.comment
+		if comment != "" && !strings.HasSuffix(comment, "\n") {
+			comment += "\n"
+		}
+		repo.addEvent(newTag(repo, label.name, target.mark, tagger, comment))
+	}
+	return nil
+}
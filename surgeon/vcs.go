@@ -29,15 +29,19 @@ import (
 //     "export-progress" = exporter generates its own progress messages,
 //                         no need for baton prompt.
 //     "import-defaults" = Import sets default ignores
-// * Flag specifying whether it handles per-commit properties on import
+// * Import extensions: "commit-properties", "empty-directories",
+//   "multiple-authors", "notes" (N fileops on a notes ref).
 // * Command to initialize a new repo
 // * Command to import from the interchange format
+// * Command whose success shows a plugin importer is installed
+// * Fallback import strategies, tried in order if the importer is unusable
 // * Command to check out working copies of the repo files.
 // * Default preserve set (e.g. config & hook files; parts can be directories).
 // * Likely location for an importer to drop an authormap file
 // * Command to list files under repository control.
 // * Command to list tags defined in the repository.
 // * Command to list branches defined in the repository.
+// * Command whose output changes when the repository gets new history.
 //
 // Note that some of the commands used here are plugins or extensions
 // that are not part of the basic VCS. Thus these may fail when called;
@@ -57,7 +61,10 @@ type VCS struct {
 	pathlister   string
 	taglister    string
 	branchlister string
+	watcher      string
 	importer     string
+	prober       string
+	fallbacks    []importStrategy
 	checkout     string
 	preserve     orderedStringSet
 	prenuke      orderedStringSet
@@ -71,6 +78,18 @@ type VCS struct {
 	checkignore string
 }
 
+// importStrategy is an alternative way of feeding an import stream
+// to a VCS, for use when its preferred importer is missing.
+type importStrategy struct {
+	importer string // Command reading a stream on standard input
+	prober   string // Command whose success shows the strategy will work
+	legend   string // Description for the fallback notice
+	// If not empty, names a built-in builder that makes the
+	// repository in the current directory itself, and importer only
+	// names the program it needs
+	builder string
+}
+
 // Constants needed in VCS class methods
 const suffixNumeric = `[0-9]+(\s|[.]\n)`
 const tokenNumeric = `\s` + suffixNumeric
@@ -78,6 +97,14 @@ const dottedNumeric = `\s[0-9]+(\.[0-9]+)`
 
 // manages tells us if a directory might be managed by theis VCS
 func (vcs VCS) manages(dirname string) bool {
+	// A data directory alone is too common to mark a VSS database
+	if vcs.name == "vss" {
+		return isfile(filepath.Join(dirname, "srcsafe.ini"))
+	}
+	// A colocated jj workspace is also a git repository, and read as one
+	if vcs.name == "jj" && isdir(filepath.Join(dirname, ".git")) {
+		return false
+	}
 	if vcs.subdirectory != "" {
 		subdir := filepath.Join(dirname, vcs.subdirectory)
 		subdir = filepath.FromSlash(subdir)
@@ -85,6 +112,9 @@ func (vcs VCS) manages(dirname string) bool {
 			return true
 		}
 	}
+	if vcs.name == "tfvc" && isdir(filepath.Join(dirname, "$tf")) {
+		return true
+	}
 	// Could be a CVS repository without CVSROOT
 	if vcs.name == "cvs" {
 		files, err := ioutil.ReadDir(dirname)
@@ -109,6 +139,10 @@ func (vcs VCS) String() string {
 		}
 	}
 	notes := strings.Trim(vcs.notes, "\t ")
+	fallbacks := ""
+	for _, fallback := range vcs.fallbacks {
+		fallbacks += fmt.Sprintf("     Fallback: %s\n", fallback.legend)
+	}
 
 	return fmt.Sprintf("         Name: %s\n", vcs.name) +
 		fmt.Sprintf(" Subdirectory: %s\n", vcs.subdirectory) +
@@ -120,6 +154,7 @@ func (vcs VCS) String() string {
 		fmt.Sprintf("    Taglister: %s\n", vcs.taglister) +
 		fmt.Sprintf(" Branchlister: %s\n", vcs.branchlister) +
 		fmt.Sprintf("     Importer: %s\n", vcs.importer) +
+		fallbacks +
 		fmt.Sprintf("     Checkout: %s\n", vcs.checkout) +
 		fmt.Sprintf("      Prenuke: %s\n", vcs.prenuke.String()) +
 		fmt.Sprintf("     Preserve: %s\n", vcs.preserve.String()) +
@@ -180,19 +215,20 @@ func vcsInit() {
 			exporter:     "git fast-export --show-original-ids --signed-tags=verbatim --tag-of-filtered-object=drop --use-done-feature --all",
 			quieter:      "",
 			styleflags:   newOrderedStringSet(),
-			extensions:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet("notes"),
 			initializer:  "git init --quiet",
 			importer:     "git fast-import --quiet --export-marks=.git/marks",
 			checkout:     "git checkout",
 			pathlister:   "git ls-files",
 			taglister:    "git tag -l",
 			branchlister: "git branch -q --list 2>&1 | cut -c 3- | egrep -v 'detached|^master$' || exit 0",
+			watcher:      "git for-each-ref --format='%(objectname) %(refname)'",
 			prenuke:      newOrderedStringSet(".git/config", ".git/hooks"),
 			preserve:     newOrderedStringSet(".git/config", ".git/hooks"),
 			authormap:    ".git/cvs-authors",
 			ignorename:   ".gitignore",
 			dfltignores:  "",
-			cookies:      reMake(`\b[0-9a-f]{6}\b`, `\b[0-9a-f]{40}\b`),
+			cookies:      reMake(`\b[0-9a-f]{6}\b`, `\b[0-9a-f]{40}\b`, `\b[0-9a-f]{64}\b`),
 			project:      "http://git-scm.com/",
 			notes:        "The authormap is not required, but will be used if present.",
 		},
@@ -212,7 +248,9 @@ func vcsInit() {
 			pathlister:   "",
 			taglister:    "bzr tags",
 			branchlister: "bzr branches | cut -c 3-",
+			watcher:      "bzr revision-info",
 			importer:     "bzr fast-import -",
+			prober:       "bzr fast-import --help",
 			checkout:     "bzr checkout",
 			prenuke:      newOrderedStringSet(".bzr/plugins"),
 			preserve:     newOrderedStringSet(),
@@ -234,7 +272,10 @@ bzr-orphans
 # Simulated bzr default ignores end here
 `,
 			cookies: reMake(tokenNumeric),
-			notes:   "Requires the bzr-fast-import plugin.",
+			notes:   "Writing requires the bzr-fast-import plugin; without it, reading falls back to an extractor.",
+			fallbacks: []importStrategy{
+				{"brz fast-import -", "brz fast-import --help", "Breezy's fast-import", ""},
+			},
 		},
 		{
 			name:         "hg",
@@ -249,6 +290,7 @@ bzr-orphans
 			pathlister:   "hg status -macn",
 			taglister:    "hg tags --quiet",
 			branchlister: "hg branches --template '{branch}\n' | grep -v '^default$'",
+			watcher:      "hg heads --template '{node}\n'",
 			importer:     "hg-git-fast-import",
 			checkout:     "hg checkout",
 			prenuke:      newOrderedStringSet(".hg/hgrc"),
@@ -263,6 +305,16 @@ bzr-orphans
 If there is no branch named 'master' in a repo when it is read, the hg 'default'
 branch is renamed to 'master'.
 `,
+			fallbacks: []importStrategy{
+				{"hg --config extensions.fastimport= fastimport /dev/stdin",
+					"hg --config extensions.fastimport= help fastimport",
+					"the hg-fastimport extension", ""},
+				{"git init --quiet --bare .rs-import && git --git-dir=.rs-import fast-import --quiet && hg --config extensions.convert= convert --quiet .rs-import . && rm -fr .rs-import",
+					"git --version && hg --config extensions.convert= help convert",
+					"a scratch git import converted with hg convert", ""},
+				{"hg", "hg version",
+					"the built-in builder driving hg", "hg"},
+			},
 		},
 		{
 			// Styleflags may need tweaking for round-tripping
@@ -277,6 +329,7 @@ branch is renamed to 'master'.
 			taglister:    "darcs show tags",
 			branchlister: "",
 			importer:     "darcs fastconvert import",
+			prober:       "darcs fastconvert --help",
 			checkout:     "",
 			prenuke:      newOrderedStringSet(),
 			preserve:     newOrderedStringSet(),
@@ -389,7 +442,7 @@ core
 		{
 			name:         "mtn",
 			subdirectory: "_MTN",
-			exporter:     "mtn git_export",
+			exporter:     "",
 			quieter:      "",
 			styleflags:   newOrderedStringSet(),
 			extensions:   newOrderedStringSet(),
@@ -443,7 +496,7 @@ _darcs
 `,
 			cookies: reMake(),
 			project: "http://www.monotone.ca/",
-			notes:   "Exporter is buggy, occasionally emitting negative timestamps.",
+			notes:   "Read with an extractor; mtn git_export was buggy, occasionally emitting negative timestamps.",
 		},
 		{
 			name:         "svn",
@@ -458,6 +511,7 @@ _darcs
 			pathlister:   "",
 			taglister:    "svn ls 'file://${pwd}/tags' | sed 's|/$||'",
 			branchlister: "svn ls 'file://${pwd}/branches' | sed 's|/$||'",
+			watcher:      "svnlook youngest .",
 			prenuke:      newOrderedStringSet(),
 			preserve:     newOrderedStringSet("hooks"),
 			authormap:    "",
@@ -520,7 +574,7 @@ core
 `,
 			cookies:     reMake(dottedNumeric, dottedNumeric+`\w`),
 			project:     "http://www.catb.org/~esr/cvs-fast-export",
-			notes:       "Requires cvs-fast-export.",
+			notes:       "Uses cvs-fast-export if installed, else a built-in reader.",
 			checkignore: "CVS",
 		},
 		{
@@ -540,7 +594,7 @@ core
 			dfltignores:  "", // Has none
 			cookies:      reMake(dottedNumeric),
 			project:      "http://www.catb.org/~esr/cvs-fast-export",
-			notes:        "Requires cvs-fast-export.",
+			notes:        "Uses cvs-fast-export if installed, else a built-in reader.",
 		},
 		{
 			name:         "src",
@@ -586,6 +640,125 @@ core
 			// No tag support, and a tendency to core-dump
 			notes: "Bitkeeper's importer is flaky and incomplete as of 7.3.1ce.",
 		},
+		{
+			name:         "pijul",
+			subdirectory: ".pijul",
+			exporter:     "",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			initializer:  "pijul init",
+			// Pijul has no fast-import, but can convert a git repository
+			importer:     "git init --quiet && git fast-import --quiet && pijul git && rm -fr .git",
+			prober:       "git --version && pijul git --help",
+			checkout:     "pijul reset",
+			pathlister:   "pijul list",
+			taglister:    "",
+			branchlister: "pijul channel | cut -c 3- | grep -v '^main$' || exit 0",
+			prenuke:      newOrderedStringSet(".pijul/config"),
+			preserve:     newOrderedStringSet(".pijul/config"),
+			authormap:    "",
+			ignorename:   ".ignore",
+			dfltignores:  "",
+			cookies:      reMake(`\b[A-Z2-7]{53}\b`),
+			project:      "https://pijul.org/",
+			notes: `Write only; pijul has no fast-export. The stream is imported into a
+scratch git repository and converted with pijul git, which requires
+pijul to have been built with its git feature. Tags are not carried over.
+`,
+		},
+		{
+			name:         "jj",
+			subdirectory: ".jj",
+			exporter:     "",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			// Colocated, so the workspace is also a git repository
+			initializer:  "jj git init --colocate",
+			importer:     "git fast-import --quiet --export-marks=.git/marks && jj git import",
+			prober:       "git --version && jj git --help",
+			checkout:     "jj new master",
+			pathlister:   "jj file list",
+			taglister:    "jj tag list | cut -d: -f1",
+			branchlister: "jj bookmark list | grep -v '^ ' | cut -d: -f1 | grep -v '^master$' || exit 0",
+			prenuke:      newOrderedStringSet(".git/config", ".git/hooks", ".jj/repo/config.toml"),
+			preserve:     newOrderedStringSet(".git/config", ".git/hooks", ".jj/repo/config.toml"),
+			authormap:    "",
+			ignorename:   ".gitignore",
+			dfltignores:  "",
+			cookies:      reMake(`\b[0-9a-f]{6}\b`, `\b[0-9a-f]{40}\b`, `\b[0-9a-f]{64}\b`, `\b[k-z]{12}\b`),
+			project:      "https://jj-vcs.github.io/jj/",
+			notes:        "Write only; a colocated workspace is read through its git repository.",
+		},
+		{
+			name:         "got",
+			subdirectory: ".got",
+			// Got repositories are in git format; a work tree records where its repository is
+			exporter:     "git --git-dir=\"$(cat .got/repository)\" fast-export --show-original-ids --signed-tags=verbatim --tag-of-filtered-object=drop --use-done-feature --all",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			initializer:  "gotadmin init -b master .got/repo.git",
+			importer:     "git --git-dir=.got/repo.git fast-import --quiet --export-marks=.got/marks",
+			prober:       "got -V && git --version",
+			checkout:     "",
+			pathlister:   "",
+			taglister:    `got tag -l | sed -n 's/^tag \([^ ]*\) .*/\1/p'`,
+			branchlister: "got branch -l | cut -c 3- | cut -d: -f1 | grep -v '^master$' || exit 0",
+			prenuke:      newOrderedStringSet(".got/repo.git/config", ".got/repo.git/got.conf"),
+			preserve:     newOrderedStringSet(".got/repo.git/config", ".got/repo.git/got.conf"),
+			authormap:    "",
+			ignorename:   ".gitignore",
+			dfltignores:  "",
+			cookies:      reMake(`\b[0-9a-f]{6}\b`, `\b[0-9a-f]{40}\b`, `\b[0-9a-f]{64}\b`),
+			project:      "https://gameoftrees.org/",
+			notes:        "A rebuild leaves the repository in .got/repo.git; check out a work tree with got checkout.",
+		},
+		{
+			name:         "tfvc",
+			subdirectory: ".tf", // Local workspaces made on Windows use $tf
+			exporter:     "",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			initializer:  "",
+			pathlister:   "",
+			taglister:    "",
+			branchlister: "",
+			importer:     "",
+			checkout:     "",
+			prenuke:      newOrderedStringSet(),
+			preserve:     newOrderedStringSet(),
+			authormap:    "",
+			ignorename:   ".tfignore",
+			dfltignores:  "",
+			cookies:      reMake(`\bC[0-9]+\b`),
+			project:      "https://learn.microsoft.com/azure/devops/repos/tfvc/",
+			notes:        "Read from a local workspace with a built-in reader driven by the tf client.",
+		},
+		{
+			name:         "vss",
+			subdirectory: "data",
+			exporter:     "",
+			quieter:      "",
+			styleflags:   newOrderedStringSet(),
+			extensions:   newOrderedStringSet(),
+			initializer:  "",
+			pathlister:   "",
+			taglister:    "",
+			branchlister: "",
+			importer:     "",
+			checkout:     "",
+			prenuke:      newOrderedStringSet(),
+			preserve:     newOrderedStringSet(),
+			authormap:    "",
+			ignorename:   "",
+			dfltignores:  "",
+			cookies:      reMake(),
+			project:      "https://en.wikipedia.org/wiki/Microsoft_Visual_SourceSafe",
+			notes:        "Read from the database directory with a built-in reader driven by the ss client.",
+		},
 	}
 }
 
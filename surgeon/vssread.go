@@ -0,0 +1,369 @@
+// This module reads a Visual SourceSafe database by driving the ss
+// command-line client, for migrations off that long-dead system.
+// Run it in the database directory, the one holding srcsafe.ini;
+// ss is pointed there through SSDIR, and logs in as SSUSER.
+//
+// "ss Dir -R" lists the files, "ss History" lists the versions and
+// labels of each file, newest first, and "ss Get -V" fetches the
+// content of each version. File versions are then coalesced into
+// commits the way the CVS reader does it: versions with the same
+// user and comment, no more than vssCommitWindow apart, and touching
+// each file at most once.
+//
+// VSS records times to the minute in the client's local time, so
+// timestamps are a best effort: commits sharing a minute, or whose
+// clocks ran backwards, are spaced a second apart so that commit
+// order and time order agree. Everything goes on master, as VSS has
+// no branches in the git sense. A label becomes an annotated tag on
+// the latest commit holding one of the file versions it marks, with
+// any spaces in its name turned into underscores.
+//
+// Deleted files cannot be read through ss without recovering them
+// first, so they are missing from the result; and a renamed file's
+// whole history appears under its final name.
+
+package main
+
+// Copyright by Eric S. Raymond
+// SPDX-License-Identifier: BSD-2-Clause
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vssCommitWindow is the largest gap between two file versions that
+// still allows them to be coalesced into one commit.
+const vssCommitWindow = 300 * time.Second
+
+// vssEntry is one entry of an ss History report: a version of the
+// item, or a label on it.
+type vssEntry struct {
+	version int
+	label   string
+	user    string
+	date    time.Time
+	action  string
+	comment string
+}
+
+// isContent tells whether an entry is a version with content of its
+// own rather than a label.
+func (e *vssEntry) isContent() bool {
+	return e.version > 0 && e.label == ""
+}
+
+// vssDateLayouts are the date formats ss prints, which follow the
+// client's locale.
+var vssDateLayouts = []string{"1/2/06", "1/2/2006", "2.1.06", "2.1.2006", "2006-01-02"}
+
+// parseVSSDate parses the Date and Time fields of a history entry,
+// in local time. Times may be 12-hour with an a or p suffix.
+func parseVSSDate(date string, clock string) (time.Time, error) {
+	clockLayout := "15:04"
+	clock = strings.ToUpper(clock)
+	if strings.HasSuffix(clock, "A") || strings.HasSuffix(clock, "P") {
+		clock += "M"
+		clockLayout = "3:04PM"
+	}
+	for _, layout := range vssDateLayouts {
+		if t, err := time.ParseInLocation(layout+" "+clockLayout, date+" "+clock, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q %q", date, clock)
+}
+
+var vssVersionHeader = regexp.MustCompile(`^\*+\s+Version\s+([0-9]+)\s+\*+$`)
+var vssUserLine = regexp.MustCompile(`^User:\s*(.*?)\s+Date:\s*(\S+)\s+Time:\s*(\S+)`)
+
+// parseVSSHistory parses the output of "ss History" on a file into
+// its entries, newest first as ss prints them.
+func parseVSSHistory(r io.Reader) ([]*vssEntry, error) {
+	var entries []*vssEntry
+	var entry *vssEntry
+	var comment []string
+	inComment := false
+	finish := func() {
+		if entry != nil {
+			entry.comment = strings.TrimSpace(strings.Join(comment, "\n"))
+			if entry.comment != "" {
+				entry.comment += "\n"
+			}
+		}
+		comment, inComment = nil, false
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := vssVersionHeader.FindStringSubmatch(line); m != nil {
+			finish()
+			version, _ := strconv.Atoi(m[1])
+			entry = &vssEntry{version: version}
+			entries = append(entries, entry)
+			continue
+		}
+		if len(line) >= 10 && strings.Trim(line, "*") == "" {
+			finish()
+			entry = &vssEntry{}
+			entries = append(entries, entry)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		if inComment {
+			if line == "" {
+				inComment = false
+			} else {
+				comment = append(comment, line)
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "Label:"):
+			entry.label = strings.Trim(strings.TrimSpace(line[len("Label:"):]), `"`)
+		case strings.HasPrefix(line, "User:"):
+			m := vssUserLine.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("ill-formed history line %q", line)
+			}
+			date, err := parseVSSDate(m[2], m[3])
+			if err != nil {
+				return nil, err
+			}
+			entry.user, entry.date = m[1], date
+		case strings.HasPrefix(line, "Comment:") || strings.HasPrefix(line, "Label comment:"):
+			inComment = true
+			if text := strings.TrimSpace(line[strings.Index(line, ":")+1:]); text != "" {
+				comment = append(comment, text)
+			}
+		case line != "" && entry.action == "":
+			entry.action = line
+		}
+	}
+	finish()
+	return entries, scanner.Err()
+}
+
+// vssFileVersion is one version of one file.
+type vssFileVersion struct {
+	path    string
+	entry   *vssEntry
+	content []byte
+}
+
+// vssClient runs ss against one database.
+type vssClient struct {
+	ssdir   string
+	scratch string
+}
+
+// capture runs an ss subcommand and returns its output.
+func (ss *vssClient) capture(args ...string) ([]byte, error) {
+	if logEnable(logCOMMANDS) {
+		logit("%s: capturing ss %s", wallclock(), strings.Join(args, " "))
+	}
+	cmd := exec.Command("ss", append(args, "-I-")...)
+	cmd.Env = append(os.Environ(), "SSDIR="+ss.ssdir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ss %s: %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// get returns the content of a version of a file.
+func (ss *vssClient) get(item string, version int) ([]byte, error) {
+	if _, err := ss.capture("Get", item, fmt.Sprintf("-V%d", version), "-GL"+ss.scratch); err != nil {
+		return nil, err
+	}
+	local := filepath.Join(ss.scratch, path.Base(item))
+	defer os.Remove(local)
+	return ioutil.ReadFile(local)
+}
+
+// readVSS fills the repository from the SourceSafe database in the
+// current directory.
+func (repo *Repository) readVSS() error {
+	here, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	scratch, err := ioutil.TempDir("", "rs-vss")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	ss := &vssClient{ssdir: here, scratch: scratch}
+	out, err := ss.capture("Dir", "$/", "-R")
+	if err != nil {
+		return err
+	}
+	items, err := parseTFVCDir(strings.NewReader(string(out)))
+	if err != nil {
+		return err
+	}
+	sort.Strings(items)
+
+	type labelInfo struct {
+		entry    *vssEntry
+		versions []*vssFileVersion
+	}
+	labels := make(map[string]*labelInfo)
+	var versions []*vssFileVersion
+	baton := control.baton
+	baton.startProgress("reading SourceSafe files", uint64(len(items)))
+	for n, item := range items {
+		out, err := ss.capture("History", item)
+		if err != nil {
+			return err
+		}
+		entries, err := parseVSSHistory(strings.NewReader(string(out)))
+		if err != nil {
+			return fmt.Errorf("%s: %v", item, err)
+		}
+		// A label marks the next older version listed
+		var pending []*vssEntry
+		for _, entry := range entries {
+			if !entry.isContent() {
+				if entry.label != "" {
+					pending = append(pending, entry)
+				}
+				continue
+			}
+			content, err := ss.get(item, entry.version)
+			if err != nil {
+				return err
+			}
+			fv := &vssFileVersion{strings.TrimPrefix(item, "$/"), entry, content}
+			versions = append(versions, fv)
+			for _, label := range pending {
+				if labels[label.label] == nil {
+					labels[label.label] = &labelInfo{entry: label}
+				}
+				labels[label.label].versions = append(labels[label.label].versions, fv)
+			}
+			pending = nil
+		}
+		baton.percentProgress(uint64(n + 1))
+	}
+	baton.endProgress()
+	if len(versions) == 0 {
+		return errors.New("no file versions found in SourceSafe database")
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		if !versions[i].entry.date.Equal(versions[j].entry.date) {
+			return versions[i].entry.date.Before(versions[j].entry.date)
+		}
+		if versions[i].path != versions[j].path {
+			return versions[i].path < versions[j].path
+		}
+		return versions[i].entry.version < versions[j].entry.version
+	})
+
+	// Coalesce them into changesets
+	type changeset struct {
+		versions []*vssFileVersion
+		paths    map[string]bool
+		date     time.Time
+		commit   *Commit
+	}
+	type changesetKey struct {
+		user    string
+		comment string
+	}
+	open := make(map[changesetKey]*changeset)
+	located := make(map[*vssFileVersion]int)
+	var changesets []*changeset
+	for _, fv := range versions {
+		key := changesetKey{fv.entry.user, fv.entry.comment}
+		cs := open[key]
+		if cs == nil || fv.entry.date.Sub(cs.date) > vssCommitWindow || cs.paths[fv.path] {
+			cs = &changeset{paths: make(map[string]bool)}
+			open[key] = cs
+			changesets = append(changesets, cs)
+		}
+		cs.versions = append(cs.versions, fv)
+		cs.paths[fv.path] = true
+		cs.date = fv.entry.date
+		located[fv] = len(changesets) - 1
+	}
+
+	var last *Commit
+	var lastDate time.Time
+	for _, cs := range changesets {
+		// Keep time order and commit order in agreement
+		date := cs.date
+		if !date.After(lastDate) && !lastDate.IsZero() {
+			date = lastDate.Add(time.Second)
+		}
+		lastDate = date
+		commit := newCommit(repo)
+		user := cs.versions[0].entry.user
+		attribution := fmt.Sprintf("%s <%s> %d +0000", user, user, date.Unix())
+		newattr, err := newAttribution(attribution)
+		if err != nil {
+			return fmt.Errorf("ill-formed attribution %q", attribution)
+		}
+		commit.committer = *newattr
+		commit.Comment = cs.versions[0].entry.comment
+		commit.setBranch("refs/heads/master")
+		if last != nil {
+			commit.setParents([]CommitLike{last})
+		}
+		sort.SliceStable(cs.versions, func(i, j int) bool {
+			return cs.versions[i].path < cs.versions[j].path
+		})
+		for _, fv := range cs.versions {
+			blob := newBlob(repo)
+			blob.setContent(fv.content, noOffset)
+			blob.setMark(repo.newmark())
+			repo.addEvent(blob)
+			op := newFileOp(repo)
+			op.construct(opM, "100644", blob.getMark(), fv.path)
+			commit.appendOperation(op)
+			repo.legacyMap[fmt.Sprintf("VSS:%s %d", fv.path, fv.entry.version)] = commit
+		}
+		commit.setMark(repo.newmark())
+		repo.addEvent(commit)
+		cs.commit = commit
+		last = commit
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := labels[name]
+		newest := 0
+		for _, fv := range info.versions {
+			if located[fv] > newest {
+				newest = located[fv]
+			}
+		}
+		attribution := fmt.Sprintf("%s <%s> %d +0000", info.entry.user, info.entry.user, info.entry.date.Unix())
+		tagger, err := newAttribution(attribution)
+		if err != nil {
+			return fmt.Errorf("ill-formed attribution %q", attribution)
+		}
+		// Label names may hold spaces, which tag names cannot
+		tagname := strings.Join(strings.Fields(name), "_")
+		repo.addEvent(newTag(repo, tagname, changesets[newest].commit.mark, tagger, info.entry.comment))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+## Test @anc and @dsc depth limits and tag arguments
+read <svnfodder.fi
+set interactive
+set relax
+@anc(:8) resolve expect :8 and every commit before it
+@anc1(:8) resolve expect :8 and its parent
+@anc2(:31) resolve expect :31, both merge parents, and their parents
+@anc0(:8) resolve expect :8 alone
+@dsc1(:25) resolve expect :25 and the merge that follows it
+@anc(<annotated>) resolve expect the tag and everything before :17
+@anc1(<annotated>) resolve expect the tag, :17, and its parent
+@min1(:8) resolve expect an error
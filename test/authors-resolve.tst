@@ -0,0 +1,43 @@
+## Test authors resolve with an external identity resolver
+set relax
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer fred <fred> 1000000000 +0000
+data 8
+Initial
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+author hilda <hilda> 1000900000 +0000
+committer fred <fred> 1000900000 +0000
+data 7
+Second
+from :2
+M 100644 :1 NEWS
+
+commit refs/heads/master
+mark :4
+committer nobody <nobody> 1001000000 +0000
+data 6
+Third
+from :3
+M 100644 :1 TODO
+
+EOF
+authors read <<EOF
+hilda = Hilda J. Foonly <hilda@foonly.org>
+EOF
+set echo
+set interactive
+authors resolve sed -n -e 's/^fred = .*/Fred J. Foonly <fred@foonly.org> -0500/p'
+authors write
+clear interactive
+write -
+authors resolve
@@ -0,0 +1,39 @@
+## Test authors write --stats skeleton generation
+set relax
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer fred <fred> 1000000000 -0500
+data 8
+Initial
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+committer fred <fred> 1000900000 -0400
+data 7
+Second
+from :2
+M 100644 :1 NEWS
+
+commit refs/heads/master
+mark :4
+author hilda <hilda> 1001000000 +0100
+committer fred <fred> 1001000000 -0500
+data 6
+Third
+from :3
+M 100644 :1 TODO
+
+EOF
+authors write --stats >/tmp/authors-stats$$.map
+shell cat /tmp/authors-stats$$.map
+authors read </tmp/authors-stats$$.map
+write -
+authors write --stats --format=cvsimport
+shell rm -f /tmp/authors-stats$$.map
@@ -20,3 +20,5 @@ from :2
 
 EOF
 authors write
+authors write --format=cvsimport
+authors write --format=mailmap
@@ -0,0 +1,3 @@
+## Test lint's fileop validity checks
+read <badops.fi
+lint --fileops
@@ -0,0 +1,6 @@
+## Test the binary-content audit
+set relax
+read <gitattributes.fi
+binaries
+binaries --top=1
+binaries --top=x
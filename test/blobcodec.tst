@@ -0,0 +1,36 @@
+## Test zstd compression of on-disk blobs
+set relax
+set blobcodec lzma
+set compressblobs
+set blobcodec zstd
+read <sample1.fi
+# filter writes new blob content to disk through the codec
+=B filter --regex /e/E/
+shell for f in $(find .rs$$-* -path '*/blobs/*' -type f); do head -c4 $f | od -An -tx1; done | sort -u
+write -
+drop
+set blobcodec gzip
+read <sample1.fi
+=B filter --regex /e/E/
+shell for f in $(find .rs$$-* -path '*/blobs/*' -type f); do head -c2 $f | od -An -tx1; done | sort -u
+write -
+drop
+# Each repository has its own codec
+set blobcodec zstd
+read <sample1.fi
+=B filter --regex /e/E/
+rename squeezed
+set blobcodec gzip
+read <sample1.fi
+=B filter --regex /o/O/
+rename zipped
+choose squeezed
+set --repo blobcodec gzip
+shell for f in $(find .rs$$-squeezed -path '*/blobs/*' -type f); do head -c2 $f | od -An -tx1; done | sort -u
+set --repo blobcodec zstd
+shell for f in $(find .rs$$-squeezed -path '*/blobs/*' -type f); do head -c4 $f | od -An -tx1; done | sort -u
+# Uniting re-encodes the zstd blobs for the gzip union
+unite squeezed zipped
+write -
+clear blobcodec
+clear compressblobs
@@ -0,0 +1,22 @@
+## Test sharing on-disk blobs between repositories
+set relax
+set blobstore
+read <sample1.fi
+=B filter --regex /e/E/
+rename first
+read <sample1.fi
+=B filter --regex /e/E/
+rename second
+# Identical content in both repositories is stored once
+shell find .rs$$.blobstore -type f | wc -l
+shell find .rs$$-first .rs$$-second -path '*/blobs/*' -type f | wc -l
+# Content changed in one repository gets a file of its own
+choose first
+=B filter --regex /E/e/
+shell find .rs$$.blobstore -type f | wc -l
+# Dropping a repository releases its references
+drop first
+shell find .rs$$.blobstore -type f | wc -l
+choose second
+write -
+clear blobstore
@@ -0,0 +1,13 @@
+## Test listing callouts and resolving them against the cut-from history
+read <debranch3.fi
+/alternate/b delete
+# Relies on the fact that callout.chk was created from the branch just deleted
+read <callout.chk
+choose callout.chk
+callouts
+callouts resolve
+callouts resolve debranch3
+print after resolution
+callouts list
+# The result should be topologically equivalent to the original debranch3.fi
+write -
@@ -0,0 +1,7 @@
+## Test reporting of unresolved ChangeLog attributions
+read <liftlog.fi
+authors read <<EOF
+hilda = Hilda J. Foonly <hilda@foonly.org> America/Los_Angeles
+EOF
+set echo
+changelogs --unresolved
@@ -0,0 +1,11 @@
+## Test cross-repository cherry equivalence report
+set echo
+read <cherry-upstream.fi
+read <cherry-fork.fi
+choose cherry-fork
+cherry cherry-upstream
+:2,:4 cherry cherry-upstream
+set relax
+cherry
+cherry cherry-fork
+cherry nonesuch
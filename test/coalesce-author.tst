@@ -0,0 +1,83 @@
+## Test coalesce --author on per-file commits
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+author Alice <alice@example.com> 1456976347 -0500
+committer cvs2git <cvs2git> 1456976347 -0500
+data 15
+Initial import
+M 100644 :1 README
+
+blob
+mark :3
+data 2
+b
+
+commit refs/heads/master
+mark :4
+author Alice <alice@example.com> 1456977000 -0500
+committer cvs2git <cvs2git> 1456977000 -0500
+data 21
+Fix overflow in foo.
+from :2
+M 100644 :3 foo.c
+
+blob
+mark :5
+data 2
+c
+
+commit refs/heads/master
+mark :6
+author Alice <alice@example.com> 1456977030 -0500
+committer cvs2git <cvs2git> 1456977030 -0500
+data 23
+Declare the new limit.
+from :4
+M 100644 :5 foo.h
+
+commit refs/heads/master
+mark :7
+author Alice <alice@example.com> 1456977060 -0500
+committer cvs2git <cvs2git> 1456977060 -0500
+data 21
+Fix overflow in foo.
+from :6
+M 100644 :3 bar.c
+
+commit refs/heads/master
+mark :8
+author Bob <bob@example.com> 1456977070 -0500
+committer cvs2git <cvs2git> 1456977070 -0500
+data 14
+Tweak README.
+from :7
+M 100644 :5 README
+
+commit refs/heads/master
+mark :9
+author Bob <bob@example.com> 1456977100 -0500
+committer cvs2git <cvs2git> 1456977100 -0500
+data 12
+Tweak NEWS.
+from :8
+M 100644 :5 NEWS
+
+commit refs/heads/master
+mark :10
+author Bob <bob@example.com> 1456987100 -0500
+committer cvs2git <cvs2git> 1456987100 -0500
+data 11
+Much later
+from :9
+M 100644 :1 NEWS
+
+EOF
+set echo
+coalesce --author
+write -
@@ -0,0 +1,69 @@
+## Test coalesce --pattern on auto-commit noise
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@foobar.com> 1456976347 -0500
+data 15
+Initial import
+M 100644 :1 file
+
+blob
+mark :3
+data 2
+b
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@foobar.com> 1456976447 -0500
+data 16
+wip: autosave 1
+from :2
+M 100644 :3 file
+
+blob
+mark :5
+data 2
+c
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@foobar.com> 1456976507 -0500
+data 11
+checkpoint
+from :4
+M 100644 :5 file
+
+blob
+mark :7
+data 2
+d
+
+commit refs/heads/master
+mark :8
+committer J. Random Hacker <jrh@foobar.com> 1456976567 -0500
+data 16
+wip: autosave 2
+from :6
+M 100644 :7 file
+
+blob
+mark :9
+data 2
+e
+
+commit refs/heads/master
+mark :10
+committer J. Random Hacker <jrh@foobar.com> 1456976627 -0500
+data 13
+Real change.
+from :8
+M 100644 :9 file
+
+EOF
+coalesce --pattern=^(wip|checkpoint)
+list
@@ -0,0 +1,7 @@
+## Test lint's comment-policy checks
+set echo
+read <liftlog.fi
+lint --comments=comments.policy
+=C & /ChangeLog/ lint --comments=comments.policy
+set relax
+lint --comments=nonexistent.policy
@@ -0,0 +1,18 @@
+## Test clean and smudge content filter hooks
+set relax
+set interactive
+contentfilter clean *.txt --dedos
+contentfilter smudge config/* --regex /password=.*/password=REDACTED/g
+contentfilter smudge *.txt --shell tr a-z A-Z
+contentfilter
+read <contentfilter.fi
+# notes.txt and raw.dat shared a blob; only the .txt copy is cleaned
+write -
+contentfilter clear smudge
+contentfilter
+write -
+contentfilter clear
+contentfilter
+contentfilter fuzz *.c --dedos
+contentfilter clean *.c
+contentfilter clean *.c --frobnicate
@@ -0,0 +1,3 @@
+## native reader for CVS master files
+read --native cvsrepo
+write -
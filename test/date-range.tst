@@ -0,0 +1,56 @@
+## Test date ranges in selections
+set relax
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer Alice <alice@example.com> 1546344000 +0000
+data 10
+New year.
+M 100644 :1 file0
+
+commit refs/heads/master
+mark :3
+author Bob <bob@example.com> 1546250400 +0000
+committer Alice <alice@example.com> 1552640400 +0000
+data 13
+Late commit.
+from :2
+M 100644 :1 file1
+
+commit refs/heads/master
+mark :4
+committer Alice <alice@example.com> 1561935600 +0000
+data 10
+Mid-year.
+from :3
+M 100644 :1 file2
+
+commit refs/heads/master
+mark :5
+committer Alice <alice@example.com> 1561968000 +0000
+data 6
+July.
+from :4
+M 100644 :1 file3
+
+tag v1
+from :2
+tagger Alice <alice@example.com> 1548979200 +0000
+data 8
+Tagged.
+
+EOF
+set interactive
+<2019-01-01..2019-06-30> resolve expect both halves of the year
+<2019-01-01..2019-06-30> & =C resolve expect commits only
+<2019-02-01T00:00:00Z..2019-06-30T23:00:00Z> resolve expect the tag and :3 to :4
+<2019-07-01..> resolve expect :5
+<..2019-01-31> resolve expect :2
+<author@..2019-01-31> resolve expect :2 and the late commit
+<2020-01-01..2020-12-31> resolve expect nothing
+<2019-06-30..2019-01-01> resolve expect an error
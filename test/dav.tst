@@ -0,0 +1,10 @@
+## Test DAV autoversioning quirks in Subversion dumps
+read <dav.svn
+print Without policies
+list
+tags
+read --anonymous-author=davuser --squash-property-revisions <dav.svn
+print Attributed and squashed
+list
+tags
+write -
@@ -0,0 +1,7 @@
+## Test removing merge bubbles
+set relax
+read <debubble.fi
+set interactive
+debubble
+clear interactive
+write -
@@ -0,0 +1,10 @@
+## Deterministic mode renumbers marks and sorts listings
+set deterministic
+read <testrepo.fi
+:4 squash
+=C assign zz
+1..3 assign aa
+assign
+write -
+# The renumbering is confined to the write
+:6,:8 resolve
@@ -0,0 +1,5 @@
+## Test the encodings report
+read <encodings.fi
+encodings
+print Event numbers in the report are a valid selection
+3,7 list
@@ -0,0 +1,18 @@
+## Test fileop-level selection and surgery
+read <testrepo.fi
+print All deletions
+ops --type=D
+print Ops touching doomed files in a range
+8..19 ops /^doomed/
+print Retarget doomed3 in some commits only
+14..18 ops /^doomed(3)$/ retarget victim\1
+1..$ ops /doomed3|victim/
+print Collisions are refused
+set relax
+30 ops /^renamed1$/ retarget bar
+clear relax
+print Mode change and deletion
+24 ops /^foo$/ mode 100755
+=C ops /^README$/ --type=M delete
+ops
+lint --fileops
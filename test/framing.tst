@@ -0,0 +1,6 @@
+## Test done and checkpoint framing on write
+read <simple.fi
+:1..:16 write --done --checkpoint=2
+set relax
+write --checkpoint=0
+clear relax
@@ -0,0 +1,5 @@
+## Test generation of .gitattributes from sniffed content
+read <gitattributes.fi
+gitattributes --list
+gitattributes
+write -
@@ -0,0 +1,9 @@
+## Test building a git repository by writing its objects directly
+shell rm -fr /tmp/gitbuild-$$ /tmp/gitbuild-native-$$
+import sample1.fi /tmp/gitbuild-$$
+import --native sample1.fi /tmp/gitbuild-native-$$
+shell cd /tmp/gitbuild-native-$$ && git fsck --strict --no-progress && git for-each-ref --format='%(objectname) %(objecttype) %(refname)'
+shell cd /tmp/gitbuild-native-$$ && git log --all --format='%H %ad %s' --date=raw
+shell cd /tmp/gitbuild-$$ && git for-each-ref --format='%(objectname) %(objecttype) %(refname)' >/tmp/gitbuild-$$.refs
+shell cd /tmp/gitbuild-native-$$ && git for-each-ref --format='%(objectname) %(objecttype) %(refname)' | diff /tmp/gitbuild-$$.refs - && echo same hashes as fast-import
+shell rm -fr /tmp/gitbuild-$$ /tmp/gitbuild-native-$$ /tmp/gitbuild-$$.refs
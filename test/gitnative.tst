@@ -0,0 +1,10 @@
+## Test reading a git repository straight from its object database
+shell rm -fr /tmp/gitnative-$$
+import bt2.fi /tmp/gitnative-$$
+read --native /tmp/gitnative-$$
+write -
+shell rm -fr /tmp/gitnative-$$
+import be2.fi /tmp/gitnative-$$
+read --native /tmp/gitnative-$$
+write -
+shell rm -fr /tmp/gitnative-$$
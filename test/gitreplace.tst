@@ -0,0 +1,16 @@
+## Test honoring git replace refs and grafts on read
+shell rm -fr /tmp/gitreplace-$$
+import gitreplace.fi /tmp/gitreplace-$$
+shell cd /tmp/gitreplace-$$ && git replace --graft refs/heads/master~1 refs/heads/master~3
+read /tmp/gitreplace-$$
+write -
+read --bake-replacements /tmp/gitreplace-$$
+write -
+read --native /tmp/gitreplace-$$
+write -
+read --native --bake-replacements /tmp/gitreplace-$$
+write -
+shell cd /tmp/gitreplace-$$ && git replace -d $(git replace -l) >/dev/null && echo $(git rev-parse refs/heads/master~1 refs/heads/master~3) >.git/info/grafts
+read --native /tmp/gitreplace-$$
+write -
+shell rm -fr /tmp/gitreplace-$$
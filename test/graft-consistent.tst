@@ -0,0 +1,73 @@
+## Test graft --consistent, stitching pre-history onto a live repository
+read <<EOF
+blob
+mark :1
+data 8
+release
+
+blob
+mark :2
+data 9
+old code
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 13
+Tarball 1.0.
+M 100644 :1 README
+M 100644 :2 old.c
+
+blob
+mark :4
+data 9
+lib v1.1
+
+commit refs/heads/master
+mark :5
+committer J. Random Hacker <jrh@example.com> 1000100000 +0000
+data 13
+Tarball 1.1.
+from :3
+M 100644 :4 lib.c
+
+EOF
+rename tarballs
+read <<EOF
+blob
+mark :1
+data 8
+release
+
+blob
+mark :2
+data 9
+lib live
+
+blob
+mark :3
+data 9
+new code
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000200000 +0000
+data 14
+Live history.
+M 100644 :1 README
+M 100644 :2 lib.c
+M 100644 :3 new.c
+
+commit refs/heads/master
+mark :5
+committer J. Random Hacker <jrh@example.com> 1000300000 +0000
+data 13
+Live change.
+from :4
+M 100755 :3 new.c
+
+EOF
+rename live
+choose tarballs
+:5 graft --consistent live
+write -
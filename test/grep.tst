@@ -0,0 +1,9 @@
+## Test searching blob content and comments
+set relax
+read <sample1.fi
+grep /test/
+grep --comments /[Ss]ubversion|example/
+:1..:10 grep --path=/README/ /e/
+grep --path=README /e/
+grep /(/
+grep --bogus /x/
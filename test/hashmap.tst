@@ -0,0 +1,13 @@
+## Test the table of object names a rebuild gave commits
+set relax
+read <deletion.svn
+prefer git
+hashmap
+shell rm -fr /tmp/hashmap-$$
+rebuild /tmp/hashmap-$$
+hashmap
+<3> hashmap
+shell cat /tmp/hashmap-$$/.git/hash-map
+:6 setfield comment "Changed.\n"
+<4> hashmap
+shell rm -fr /tmp/hashmap-$$
@@ -0,0 +1,12 @@
+## Test translation of ignore files between dialects
+set relax
+read <ignorefiles.fi
+set interactive
+ignores translate cvs git
+ignores translate git hg
+write -
+ignores translate hg cvs
+write -
+ignores translate svn:ignore git
+ignores translate darcs git
+ignores translate git
@@ -0,0 +1,40 @@
+## Test ignore-pattern translation into .gitignore syntax
+debug ignores
+debug ignores svn:ignore <<EOF
+*.o
+build
+#notacomment
+
+EOF
+debug ignores svn:global-ignores <<EOF
+*.pyc
+#hash
+!bang
+EOF
+debug ignores cvs <<EOF
+core
+!
+EOF
+debug ignores hg <<EOF
+# comment
+syntax: glob
+*.orig
+build/*.o
+re:^foo$
+EOF
+debug ignores bzr <<EOF
+./config.h
+!important.o
+doc/*.html
+RE:.*~
+EOF
+debug ignores git <<EOF
+/top
+!keep
+dir/
+EOF
+set relax
+debug ignores nonesuch <<EOF
+x
+EOF
+debug frobs
@@ -0,0 +1,11 @@
+## Test incremental edit sessions
+read <testrepo.fi
+shell printf '#!/bin/sh\necho "editor called on $(grep -c ^Event-Number "$@") events"\nsed -i "s/^Committer: .*/Committer: J. Random Hacker <jrh@example.com>/" "$@"\n' >incredit.sh
+shell chmod +x incredit.sh
+3..9 edit --incremental=2 ./incredit.sh
+print Committers after incremental edit
+3..11 attribution
+print An empty batch ends the session
+shell printf '#!/bin/sh\necho called\n: >"$@"\n' >incredit.sh
+11..19 edit --incremental=1 ./incredit.sh
+shell rm -f incredit.sh
@@ -0,0 +1,42 @@
+## Test refusal to discard unsaved surgery
+set echo
+set relax
+set interactive
+set quiet
+read <min.fi
+drop
+read <min.fi
+1 delete
+drop
+quit
+write >/dev/null
+drop
+read <min.fi
+1 delete
+drop --force
+read <min.fi
+read <min.fi
+:2 setfield comment "Changed.\n"
+drop min
+drop min2
+drop --force
+read <min.fi
+list
+ops
+stats
+tag nosuch delete
+drop
+read <min.fi
+ops --type=M delete
+drop
+drop --force
+read <min.fi
+sign verify
+sign keep
+drop
+drop --force
+read <min.fi
+read <min.fi
+unite min min2
+drop
+quit --force
@@ -0,0 +1,12 @@
+## Test migrating large files to Git LFS
+set relax
+read <lfs.fi
+lfs migrate
+lfs migrate --size=zero
+# Splits the blob shared with docs/copy.txt
+lfs migrate --objects=/tmp/lfs-$$ *.png data/*.dat
+# Already migrated content is not migrated again
+:6 lfs migrate --size=8 --objects=/tmp/lfs-$$
+shell cd /tmp/lfs-$$ && find . -type f | sort
+shell rm -fr /tmp/lfs-$$
+write -
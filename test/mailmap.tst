@@ -0,0 +1,44 @@
+## Test reading and writing .mailmap files
+set relax
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+author jrh <jrh@localhost> 1456976347 -0500
+committer jrandom <JRH@Example.com> 1456976347 -0500
+data 8
+Initial
+M 100644 :1 README
+
+commit refs/heads/master
+mark :3
+author Ann Other <ann@old.example.com> 1456976447 -0500
+committer Ann <ann@old.example.com> 1456976447 -0500
+data 7
+Second
+from :2
+M 100644 :1 NEWS
+
+tag v1
+from :3
+tagger Ann <ann@old.example.com> 1456976547 -0500
+data 8
+Release
+EOF
+authors read --format=mailmap <<EOF
+# Comments and blank lines are ignored
+
+J. Random Hacker <jrh@example.com> <jrh@localhost>
+J. Random Hacker <jrh@example.com>
+Ann Other <ann@example.com> Ann <ann@old.example.com>
+<ann@new.example.com> <ann@old.example.com>
+Nobody Special <nobody@example.com> # No attribution uses this
+EOF
+set echo
+authors read --format=bogus <mailmap.tst
+write -
+authors write --format=mailmap
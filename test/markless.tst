@@ -0,0 +1,47 @@
+## Test reading commits and tags without marks
+read <<EOF
+blob
+mark :1
+data 6
+first
+
+blob
+mark :2
+data 7
+second
+
+reset refs/heads/master
+commit refs/heads/master
+committer Ralph Roister-Doister <roister@doister.com> 1288996926 -0400
+data 14
+Unmarked root
+M 100644 :1 README
+
+commit refs/heads/topic
+committer Ralph Roister-Doister <roister@doister.com> 1288996950 -0400
+data 15
+Unmarked child
+from refs/heads/master
+M 100644 :2 README
+
+commit refs/heads/master
+mark :3
+committer Ralph Roister-Doister <roister@doister.com> 1288996970 -0400
+data 13
+Marked merge
+from refs/heads/master
+merge refs/heads/topic^0
+M 100644 :2 README
+
+tag v1
+from refs/heads/topic
+tagger Ralph Roister-Doister <roister@doister.com> 1288996990 -0400
+data 13
+Tag by name.
+
+reset refs/tags/lightweight
+from master
+
+EOF
+inspect 4..$
+write -
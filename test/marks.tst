@@ -0,0 +1,39 @@
+## Test exporting marks on rebuild and importing them on read
+shell rm -fr /tmp/marks-$$ /tmp/marks-$$.marks /tmp/marks-native-$$ /tmp/marks-$$.native
+read <multitag.fi
+prefer git
+rebuild --export-marks=/tmp/marks-$$.marks /tmp/marks-$$
+shell cat /tmp/marks-$$.marks
+rebuild --native --export-marks=/tmp/marks-$$.native /tmp/marks-native-$$
+shell diff /tmp/marks-$$.marks /tmp/marks-$$.native && echo native marks agree
+drop
+read --import-marks=/tmp/marks-$$.marks <<EOF
+blob
+mark :6
+data 6
+hello
+
+commit refs/heads/master
+mark :7
+author Julien _FrnchFrgg_ RIVAUD <frnchfrgg@free.fr> 1364254000 +0100
+committer Julien _FrnchFrgg_ RIVAUD <frnchfrgg@free.fr> 1364254000 +0100
+data 29
+Continue from an earlier run
+from :5
+M 100644 :6 c
+M 100644 :1 d
+
+reset refs/heads/side
+from :4
+
+tag v3
+from :4
+tagger Julien _FrnchFrgg_ RIVAUD <frnchfrgg@free.fr> 1364254100 +0100
+data 11
+Third tag
+
+EOF
+write >/tmp/marks-$$.fi
+shell cat /tmp/marks-$$.fi
+shell cd /tmp/marks-$$ && git fast-import --quiet </tmp/marks-$$.fi && git log --format='%s' master && git for-each-ref --format='%(objectname) %(refname)'
+shell rm -fr /tmp/marks-$$ /tmp/marks-$$.marks /tmp/marks-$$.fi /tmp/marks-native-$$ /tmp/marks-$$.native
@@ -0,0 +1,11 @@
+## Test setting and clearing a memory budget
+set membudget 1024
+set
+read <testrepo.fi
+:1..:10 list
+clear membudget
+set
+set relax
+set membudget
+set membudget -3
+clear relax
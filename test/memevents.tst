@@ -0,0 +1,5 @@
+## Per-event memory estimate
+read <testrepo.fi
+memory --events
+=C manifest >/dev/null
+memory --events
@@ -0,0 +1,12 @@
+## Test the --mergeinfo read option policies
+read --mergeinfo=none <mergeinfo-with-split.svn
+print Policy none
+=M list
+read --mergeinfo=complete <mergeinfo-with-split.svn
+print Policy complete
+=M list
+read --mergeinfo=all <mergeinfo-with-split.svn
+print Policy all
+=M list
+set relax
+read --mergeinfo=some <mergeinfo-with-split.svn
@@ -0,0 +1,21 @@
+## Test notes lifted from git and the note and notes commands
+set relax
+set testmode
+read <notelift.fi
+# The notes branch names commits by hash; after reading it uses marks
+notes
+:4 note <<EOF
+Reviewed-by: J. Random Hacker
+EOF
+:2 note --ref=review <<EOF
+Looks fine.
+EOF
+notes
+notes --ref=review
+:6 note --remove
+# Nothing to remove here
+:6 note --remove
+# Deleting a commit moves its note where its tags go
+:4 squash --tagback
+notes
+write -
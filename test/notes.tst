@@ -0,0 +1,19 @@
+## Test N (note) fileop surgery
+set relax
+read <notes.fi
+# Attach a new inline note to the second commit
+:6 add N inline :4 <<EOF
+Tested-by: J. Random Hacker
+EOF
+# Modify the note on the first commit to point at different data
+:6 add N :3 :2
+# Next one is expected to fail, :5 is not a commit
+:6 add N inline :5 <<EOF
+This should not appear
+EOF
+write -
+:6 remove N :2
+write -
+# A plain stream keeps its notes whatever type is preferred
+prefer hg
+:6 write -
@@ -0,0 +1,10 @@
+## Test the one-shot import and export commands
+shell rm -fr /tmp/oneshot-$$
+import testrepo.fi /tmp/oneshot-$$
+export --done /tmp/oneshot-$$
+set relax
+import --type=nonesuch testrepo.fi /tmp/oneshot-$$
+import testrepo.fi
+export /nonexistent
+clear relax
+shell rm -fr /tmp/oneshot-$$
@@ -0,0 +1,29 @@
+## Test that original-oid lines survive reading, surgery and writing
+read <<EOF
+blob
+mark :1
+original-oid ce013625030ba8dba906f756967f9e9ca394464a
+data 6
+hello
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+original-oid 1111111111111111111111111111111111111111
+author Ann Example <ann@example.com> 1500000000 +0200
+committer Ann Example <ann@example.com> 1500000000 +0200
+data 14
+First commit.
+M 100644 :1 hello
+
+tag v1
+from :2
+original-oid 2222222222222222222222222222222222222222
+tagger Ann Example <ann@example.com> 1500000100 +0200
+data 15
+First release.
+
+EOF
+(=C) filter --regex /First/Initial/
+(=C | =T) msgout
+write -
@@ -0,0 +1,18 @@
+## Test breaking up a repository by directory
+set relax
+set interactive
+read <subdirectory.fi
+partition src=source lib=library:keep
+clear interactive
+choose source
+write -
+choose library
+write -
+choose subdirectory
+:8 manifest
+set interactive
+partition src=source
+partition src
+partition /=top
+partition --empty=frob src=other
+partition src=other:frob
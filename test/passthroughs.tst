@@ -0,0 +1,26 @@
+## Test passthrough reporting and write-time policies
+set relax
+read <<EOF
+# A comment is always acceptable
+blob
+mark :1
+data 6
+hello
+
+frobnicate --all
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@foobar.com> 1456976347 -0500
+data 15
+Initial commit
+M 100644 :1 README
+
+progress done reading
+EOF
+passthroughs
+print Preserved by default
+write
+print Dropped on request
+write --passthrough=drop
+print Refused on request
+write --passthrough=fail
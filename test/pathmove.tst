@@ -0,0 +1,7 @@
+## Test recording a reorganization as renames with path move
+read <pathmove.fi
+path ^src$ move lib
+path ^README$ move README.md
+:6 write
+print The result is clean
+lint --fileops
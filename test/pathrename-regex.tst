@@ -0,0 +1,15 @@
+## Test regular-expression path rewriting with pathrename
+set relax
+set interactive
+read <sample1.fi
+pathrename --dry-run |^(README2?)$| |doc/\1|
+pathrename |^(hello|goodbye)$| |greeting|
+pathrename |^README2$| |README|
+pathrename |^foo/(.*)/(.*)$| |\2/\1|
+pathrename |^(README2?)$| |doc/\1|
+:31 manifest
+pathrename /x/
+pathrename --frob /x/ /y/
+pathrename /x/ y
+clear interactive
+write -
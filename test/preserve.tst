@@ -0,0 +1,15 @@
+## Test editing the preserve and prenuke lists
+read <simple.fi
+preserve
+preserve add preserve.tst
+preserve list
+preserve remove preserve.tst
+preserve list
+prefer git
+preserve --prenuke
+preserve --prenuke add .git/info
+preserve --prenuke remove .git/hooks
+preserve --prenuke list
+set relax
+preserve --prenuke remove .git/hooks
+clear relax
@@ -0,0 +1,9 @@
+## Select commits by property key and value
+read --native cvsrepo
+/^cvs-revisions$/k resolve
+/hello\.sh 1\.2/v resolve
+read <bzr.fi
+/^branch-nick$/k resolve
+/bzr-testrepo/v resolve
+/branch/v resolve
+/branch-nick/kv resolve
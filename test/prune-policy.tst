@@ -0,0 +1,14 @@
+## Test prune's policy options
+set relax
+read <prune-policy.fi
+set interactive
+prune --dry-run --merges
+prune --dry-run --canonicalize --keep-tagged
+prune --frob
+clear interactive
+prune --merges
+write -
+drop --force
+read <prune-policy.fi
+prune --canonicalize --tagify --keep-tagged
+write -
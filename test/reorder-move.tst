@@ -0,0 +1,15 @@
+## Test moving commits along their branch with reorder
+set relax
+read <reorder.fi
+:30 reorder --earlier=2
+:30,:26,:28 inspect
+drop
+read <reorder.fi
+:19 reorder --later=1 --fix
+:19 inspect
+:24 reorder --later=1 --fix
+:24 inspect
+:17 reorder --earlier=1
+:21 reorder --earlier=x
+:21 reorder --earlier=1 --later=1
+:33 reorder --later=1
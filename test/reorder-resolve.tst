@@ -0,0 +1,26 @@
+## Test resolution of fileop conflicts during reorder and reparent
+set relax
+read <reorder.fi
+print Retain the dangling delete
+:26,:24 reorder <<EOF
+r
+EOF
+:26 inspect
+drop
+read <reorder.fi
+print Answers not offered are asked again; s is not valid for D
+:26,:24 reorder <<EOF
+x
+s
+d
+EOF
+:26 inspect
+print Synthesize the rename target from the old content of its source
+:31 reparent --rebase <<EOF
+s
+EOF
+:31 inspect
+print End of input drops the op
+:32 reparent --rebase <<EOF
+EOF
+:32 inspect
@@ -0,0 +1,28 @@
+## Test writing edited Subversion metadata back as revprops
+read <revprops.svn
+print Nothing edited yet
+revprops
+msgin <<EOF
+------------------------------------------------------------------------------
+Event-Number: 4
+Event-Mark: :3
+Branch: refs/heads/master
+Committer: J. Random Hacker <jrh@random.org>
+Committer-Date: Thu, 02 Jan 2020 10:00:00 +0000
+Legacy-ID: 1
+
+First revision, with the rationale for it.
+------------------------------------------------------------------------------
+Event-Number: 6
+Event-Mark: :5
+Branch: refs/heads/master
+Parents: :3
+Committer: esr <esr>
+Committer-Date: Fri, 03 Jan 2020 11:30:00 +0000
+Legacy-ID: 2
+Property-Reviewed-By: esr
+
+Second revision.
+EOF
+print After editing
+revprops
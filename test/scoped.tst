@@ -0,0 +1,67 @@
+## Test scoping an option flag to one repository
+read <<EOF
+blob
+mark :1
+data 14
+Example file.
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Chris P. Bacon <cpb@example.com> 1588089692 -0700
+data 10
+Original.
+M 100644 :1 README
+EOF
+rename first
+read <<EOF
+blob
+mark :1
+data 14
+Example file.
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+committer Chris P. Bacon <cpb@example.com> 1588089692 -0700
+data 10
+Original.
+M 100644 :1 README
+EOF
+rename second
+choose first
+set --repo canonicalize
+set
+msgin <<EOF
+------------------------------------------------------------------------------
+Event-Number: 3
+Event-Mark: :2
+Branch: refs/heads/master
+Committer: Chris P. Bacon <cpb@example.com>
+Committer-Date: Tue, 28 Apr 2020 09:01:32 -0700
+
+   Padded comment.   
+
+
+EOF
+write -
+choose second
+msgin <<EOF
+------------------------------------------------------------------------------
+Event-Number: 3
+Event-Mark: :2
+Branch: refs/heads/master
+Committer: Chris P. Bacon <cpb@example.com>
+Committer-Date: Tue, 28 Apr 2020 09:01:32 -0700
+
+   Padded comment.   
+
+
+EOF
+write -
+choose first
+set --inherit canonicalize
+set
+set relax
+set --repo quiet
+clear relax
@@ -0,0 +1,91 @@
+## Test batch field edits from CSV
+read <<EOF
+blob
+mark :1
+data 6
+first
+
+blob
+mark :2
+data 7
+second
+
+reset refs/heads/master
+commit refs/heads/master
+mark :3
+committer Ralph Roister-Doister <roister@doister.com> 1288996900 -0400
+data 12
+Empty root.
+
+commit refs/heads/master
+mark :4
+committer Ralph Roister-Doister <roister@doister.com> 1288996910 -0400
+data 12
+Add README.
+from :3
+M 100644 :1 README
+
+commit refs/heads/master
+mark :5
+committer Ralph Roister-Doister <roister@doister.com> 1288996920 -0400
+data 17
+Empty, untagged.
+from :4
+
+commit refs/heads/master
+mark :6
+committer Ralph Roister-Doister <roister@doister.com> 1288996930 -0400
+data 15
+Empty, tagged.
+from :5
+
+tag v1
+from :6
+tagger Ralph Roister-Doister <roister@doister.com> 1288996935 -0400
+data 12
+Release v1.
+
+commit refs/heads/master
+mark :7
+committer Ralph Roister-Doister <roister@doister.com> 1288996940 -0400
+data 15
+Modify README.
+from :6
+M 100644 :2 README
+
+commit refs/heads/master
+mark :8
+committer Ralph Roister-Doister <roister@doister.com> 1288996950 -0400
+data 11
+Empty tip.
+from :7
+
+reset refs/heads/lonely
+commit refs/heads/lonely
+mark :9
+committer Ralph Roister-Doister <roister@doister.com> 1288996960 -0400
+data 19
+Lonely empty root.
+
+EOF
+setfields <<EOF
+selector,field,value
+# Fix up the root commit
+:3,committeremail,ralph@example.com
+:4,authorname,"Roister-Doister, Ralph"
+(:6|:7),comment,"Rewritten
+comment.
+"
+EOF
+setfields --tsv <<EOF
+<v1>	taggeremail	release@example.com
+EOF
+set relax
+setfields <<EOF
+:3,committername,Nobody
+:999,committername,Nobody
+/nomatch/,comment,Nothing
+:4,comment
+EOF
+clear relax
+write -
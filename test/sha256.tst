@@ -0,0 +1,12 @@
+## Test reading, editing and rebuilding a SHA-256 git repository
+shell rm -fr /tmp/sha256-$$ /tmp/sha256-out-$$
+shell git init --quiet --object-format=sha256 /tmp/sha256-$$ && git -C /tmp/sha256-$$ fast-import --quiet <bt2.fi
+read /tmp/sha256-$$
+hash
+write -
+=C filter --regex /Commit/Change/
+rebuild /tmp/sha256-out-$$
+shell cd /tmp/sha256-out-$$ && git rev-parse --show-object-format && git fsck --strict --no-progress && git log --all --format='%H %T %s'
+read --native /tmp/sha256-out-$$
+=C hash --tree
+shell rm -fr /tmp/sha256-$$ /tmp/sha256-out-$$
@@ -0,0 +1,6 @@
+## Test shallow writes truncated by count and by date
+read <deleteall.fi
+print Keep the last two commits
+write --shallow=2
+print Keep commits since a date, with their descendants
+write --shallow=2011-11-30T20:00:00Z
@@ -0,0 +1,18 @@
+## Test the signatures report and the signing policy on tags
+set relax
+read <signtag.fi
+# Both signed tags are as they were read
+signatures --stream
+:6 filter --replace-comment /three/drei/
+# v2 now points at a commit with a new hash
+signatures --stream
+sign bogus
+sign resign
+sign
+write -
+sign keep
+sign
+write -
+sign resign echo "-----BEGIN PGP SIGNATURE-----"; echo; echo resigned; echo "-----END PGP SIGNATURE-----"
+sign
+write -
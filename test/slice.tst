@@ -0,0 +1,6 @@
+## Test selection-scoped write with --slice
+read <bt.fi
+print Without the option parents outside the selection become incremental cookies
+:8 write
+print With it they become callouts
+:8 write --slice
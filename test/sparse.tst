@@ -0,0 +1,9 @@
+## Test full and sparse checkout
+read <simple.fi
+116 checkout full
+!find full -type f | sort
+!cat full/test/Makefile
+!rm -fr full
+116 checkout sparse test /\.txt$/
+!find sparse -type f | sort
+!rm -fr sparse
@@ -0,0 +1,46 @@
+## Test splitting a commit into several pieces
+set relax
+read <<EOF
+blob
+mark :1
+data 4
+one
+
+blob
+mark :2
+data 4
+two
+
+commit refs/heads/master
+mark :3
+author Ann Author <ann@example.com> 1000000000 +0000
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 14
+Mixed change.
+M 100644 :1 README
+M 100644 :2 src/main.c
+M 100644 :1 doc/guide.txt
+M 100644 :2 src/util.c
+M 100644 :1 NEWS
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000100000 +0000
+data 21
+Mixed change, again.
+from :3
+M 100644 :2 README
+M 100644 :1 src/main.c
+D NEWS
+M 100644 :2 src/main.c
+
+EOF
+set echo
+:3 split matching /^src/ /^doc/ comment "{comment} ({n}/{count})"
+:4 split into 1,2,3
+:4 split into 1,2 2,3,4
+:4 split into 1,3 2,5
+:4 split into 4 1,2,3
+:3 split matching /^nothing/
+:4 split into 1,3 2,4 author "Part {n}" part{n}@example.com
+inspect
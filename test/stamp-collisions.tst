@@ -0,0 +1,39 @@
+## Test action-stamp collision detection and disambiguation
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer Alice <alice@example.com> 1000000000 +0000
+data 6
+Root.
+M 100644 :1 file0
+
+commit refs/heads/master
+mark :3
+committer Alice <alice@example.com> 1000000000 +0000
+data 21
+Same second as root.
+from :2
+M 100644 :1 file1
+
+commit refs/heads/master
+mark :4
+committer Bob <bob@example.com> 1000000100 +0000
+data 25
+Fixes the bug in [[:3]].
+from :3
+M 100644 :1 file2
+
+EOF
+set echo
+stamp
+<2001-09-09T01:46:40Z!alice@example.com> stamp
+<2001-09-09T01:46:40Z!alice@example.com#2> stamp
+lint --uniqueness
+references lift
+:4 inspect
+:4 write --callout
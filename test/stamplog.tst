@@ -0,0 +1,26 @@
+## Test the opt-in read-time report of action-stamp collisions
+log +stamps
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer Alice <alice@example.com> 1000000000 +0000
+data 6
+Root.
+M 100644 :1 file0
+
+commit refs/heads/master
+mark :3
+committer Alice <alice@example.com> 1000000000 +0000
+data 21
+Same second as root.
+from :2
+M 100644 :1 file1
+
+EOF
+log -stamps
+stamp
@@ -0,0 +1,11 @@
+## Test coalescing of Subversion commit storms at read time
+read <storms.svn
+print Without coalescing
+list
+read --coalesce-window=60 <storms.svn
+print Coalesced within a one-minute window
+list
+read --coalesce-window=60 --coalesce-prefix=trunk/data <storms.svn
+print Coalesced only under trunk/data
+list
+ops
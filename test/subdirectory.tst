@@ -0,0 +1,19 @@
+## Test restricting history to a subdirectory
+set relax
+set interactive
+read <subdirectory.fi
+subdirectory src/
+clear interactive
+write -
+set interactive
+drop --force
+read <subdirectory.fi
+subdirectory --empty=keep src
+:9 manifest
+drop --force
+read <subdirectory.fi
+subdirectory --empty=tagify src
+tags
+subdirectory
+subdirectory --empty=frob src
+subdirectory /
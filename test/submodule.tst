@@ -0,0 +1,18 @@
+## Test submodule surgery and .gitmodules consistency
+set relax
+read <submodule.fi
+submodule
+# A second submodule, and a URL change for the first
+:5 submodule add --branch=stable vendor/tool https://example.com/tool.git 3333333333333333333333333333333333333333
+submodule retarget --url=https://example.org/lib.git lib 4444444444444444444444444444444444444444
+submodule
+# Renaming a gitlink renames its path in .gitmodules
+path ^lib$ rename deps/lib
+:7 submodule remove vendor/tool
+submodule remove nosuch
+submodule add lib https://example.com/x.git 5555555555555555555555555555555555555555
+:2 submodule add README https://example.com/x.git 5555555555555555555555555555555555555555
+# Retargeting through a commit map, as after converting the submodule
+:4 submodule retarget --map=submodule.map deps/lib
+submodule list
+write -
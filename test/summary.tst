@@ -0,0 +1,5 @@
+## Test the conversion summary report
+read <gitignore.svn
+summary
+read <simpletag.svn
+summary --json
@@ -0,0 +1,4 @@
+## Read-time sharing of identical Subversion file copies
+set quiet
+read <split-dir.svn
+stats
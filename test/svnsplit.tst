@@ -0,0 +1,8 @@
+## Test split policy options for mixed Subversion revisions
+read <mixedbranch.svn
+print Default splitting
+splits
+read --split-suffix=-part%d --split-comment=(Split\x20from\x20a\x20mixed\x20revision.) --split-trunk-first <mixedbranch.svn
+print With trunk first, a custom suffix, and a custom comment
+splits
+7,8 write
@@ -0,0 +1,7 @@
+## Test writing a Subversion dump and reading it back
+read <svnwrite.fi
+write --format=svn >/tmp/svnwrite$$.svn
+shell cat /tmp/svnwrite$$.svn
+read </tmp/svnwrite$$.svn
+shell rm -f /tmp/svnwrite$$.svn
+write
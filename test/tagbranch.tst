@@ -0,0 +1,10 @@
+## Test conversion between frozen branches and annotated tags
+read <tagbranch.fi
+set relax
+branch dev totag
+branch release-1.0 totag v1.0
+print After branch totag
+write -
+tag v0.9 tobranch preview-0.9
+print After tag tobranch
+write -
@@ -0,0 +1,14 @@
+## Test detection and remediation of commits to Subversion tags
+read <tagcommits.svn
+tagcommits
+print Keep
+tagcommits --keep
+tags
+read <tagcommits.svn
+print Fold
+tagcommits --fold
+write -
+read <tagcommits.svn
+print Branch
+tagcommits --branch
+write -
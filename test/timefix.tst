@@ -0,0 +1,61 @@
+## Test repair of non-monotonic timestamps
+read <<EOF
+blob
+mark :1
+data 2
+a
+
+commit refs/heads/master
+mark :2
+committer Alice <alice@example.com> 1000000000 +0000
+data 6
+Root.
+M 100644 :1 file0
+
+commit refs/heads/master
+mark :3
+committer Alice <alice@example.com> 1000000100 +0000
+data 6
+Fine.
+from :2
+M 100644 :1 file1
+
+commit refs/heads/master
+mark :4
+author Bob <bob@example.com> 999998990 -0500
+committer Bob <bob@example.com> 999999000 -0500
+data 8
+Skewed.
+from :3
+M 100644 :1 file2
+
+commit refs/heads/master
+mark :5
+committer Alice <alice@example.com> 1000000050 +0000
+data 16
+Behind its fix.
+from :4
+M 100644 :1 file3
+
+commit refs/heads/side
+mark :6
+committer Carol <carol@example.com> 1000000200 +0000
+data 6
+Side.
+from :3
+M 100644 :1 file4
+
+commit refs/heads/master
+mark :7
+committer Alice <alice@example.com> 1000000150 +0000
+data 7
+Merge.
+from :5
+merge :6
+
+EOF
+set echo
+timefix --dry-run
+timefix
+timefix
+write -
@@ -0,0 +1,9 @@
+## Test timezone inference
+set relax
+read <timezones.fi
+set echo
+timezones --dry-run
+timezones --confidence=bogus
+timezones
+timezones --confidence=low
+:2,:4,:7,:10,:30 inspect
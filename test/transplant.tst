@@ -0,0 +1,86 @@
+## Test transplanting commits between repositories
+set relax
+read <<EOF
+blob
+mark :1
+data 5
+base
+
+blob
+mark :2
+data 6
+fixed
+
+commit refs/heads/master
+mark :3
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 7
+Start.
+M 100644 :1 README
+
+commit refs/heads/master
+mark :4
+committer J. Random Hacker <jrh@example.com> 1000100000 +0000
+data 10
+Fix note.
+from :3
+M 100644 :2 NOTES
+
+reset refs/heads/master
+from :4
+
+EOF
+rename upstream
+read <<EOF
+blob
+mark :1
+data 5
+base
+
+commit refs/heads/master
+mark :2
+committer J. Random Hacker <jrh@example.com> 1000000000 +0000
+data 7
+Start.
+M 100644 :1 README
+
+blob
+mark :3
+data 6
+fixed
+
+blob
+mark :4
+data 8
+feature
+
+commit refs/heads/master
+mark :5
+author A. U. Thor <author@example.com> 1000200000 +0000
+committer J. Random Hacker <jrh@example.com> 1000200000 +0000
+data 20
+Add feature.
+
+Body.
+from :2
+M 100644 :3 CHANGES
+M 100644 :4 feature.c
+
+commit refs/heads/master
+mark :6
+committer J. Random Hacker <jrh@example.com> 1000300000 +0000
+data 15
+Rename README.
+from :5
+R README README.txt
+
+EOF
+rename fork
+set interactive
+:5,:6 transplant upstream master
+:5 transplant upstream nosuch
+:5 transplant fork master
+transplant upstream master
+clear interactive
+choose upstream
+write -
@@ -0,0 +1,10 @@
+## Test the @tsm() selection function
+read <treesame.fi
+print Commits sharing the tree of :2
+@tsm(:2) list
+print Commits sharing the tree of :4
+@tsm(:4) list
+print Redundant commits only
+@tsm(:2) & ~:2 list
+print Non-commit arguments select nothing
+@tsm(:1) list
@@ -0,0 +1,13 @@
+## Test detection and linking of commits duplicated across branches
+read <twins.fi
+print Report only
+twins
+print Twins limited to a selection
+6..8 twins
+print Link by merge
+twins --merge
+9 inspect
+print Link by cherry-pick trailer
+read <twins.fi
+twins --trailer
+9 msgout
@@ -0,0 +1,14 @@
+## Test uniting repositories whose blobs are compressed differently
+set relax
+set compressblobs
+read <sample1.fi
+# filter writes new blob content to disk through the codec
+=B filter --regex /e/E/
+rename gzipped
+clear compressblobs
+read <sample1.fi
+=B filter --regex /o/O/
+rename raw
+# The union is uncompressed; blobs from gzipped must be re-encoded
+unite gzipped raw
+write -
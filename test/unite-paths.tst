@@ -0,0 +1,15 @@
+## Test unite path-collision strategies
+set relax
+read <unitepaths1.fi
+read <unitepaths2.fi
+set interactive
+unite --paths=fail unitepaths1 unitepaths2
+unite --paths=frob unitepaths1 unitepaths2
+clear interactive
+unite --paths=prefix unitepaths1 unitepaths2
+write -
+drop --force
+read <unitepaths1.fi
+read <unitepaths2.fi
+unite --paths=newest unitepaths1 unitepaths2
+write -
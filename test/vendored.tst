@@ -0,0 +1,8 @@
+## Test detection of vendored trees
+read <vendored.fi
+print Wholesale replacement
+vendored
+print With known release hashes
+vendored --hashes=vendored.hashes
+print A selection touching zlib only once
+1..15 vendored
@@ -0,0 +1,18 @@
+## Test mirroring a live repository with watch
+shell rm -fr /tmp/watch-src-$$ /tmp/watch-dst-$$ /tmp/watch-$$.rs /tmp/watch-$$.log
+import testrepo.fi /tmp/watch-src-$$
+shell printf 'tag mirrored create :4\n' >/tmp/watch-$$.rs
+set quiet
+watch --count=1 --interval=1 --script=/tmp/watch-$$.rs /tmp/watch-src-$$ /tmp/watch-dst-$$ >/tmp/watch-$$.log
+shell sed 's/-[0-9][0-9]*/-PID/g' /tmp/watch-$$.log
+shell git -C /tmp/watch-dst-$$ log -2 --format='%s' --all
+shell git -C /tmp/watch-dst-$$ tag -l
+watch --count=1 /tmp/watch-src-$$ /tmp/watch-dst-$$ >/dev/null
+shell ls -d /tmp/watch-dst-$$* | wc -l
+shell git -C /tmp/watch-dst-$$ tag -l | wc -l
+set relax
+watch /tmp/watch-src-$$
+watch --interval=0 /tmp/watch-src-$$ /tmp/watch-dst-$$
+watch /tmp /tmp/watch-dst-$$
+clear relax
+shell rm -fr /tmp/watch-src-$$ /tmp/watch-dst-$$ /tmp/watch-$$.rs /tmp/watch-$$.log
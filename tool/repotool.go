@@ -266,6 +266,11 @@ func isdir(pathname string) bool {
 	return err == nil && st.Mode().IsDir()
 }
 
+func isfile(pathname string) bool {
+	st, err := os.Stat(pathname)
+	return err == nil && st.Mode().IsRegular()
+}
+
 func islink(pathname string) bool {
 	st, err := os.Stat(pathname)
 	return err == nil && (st.Mode()&os.ModeSymlink) != 0